@@ -0,0 +1,81 @@
+package kusto
+
+// az_cli.go holds the sign in as the user that is logged in to the Azure CLI.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	goErrors "errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+)
+
+// azCliTimeout is how long the Azure CLI gets to return a token.
+const azCliTimeout = time.Minute
+
+// AzCliConfig signs in as the user that is logged in to the Azure CLI with "az login", which suits development on
+// a machine that has it. The client runs "az account get-access-token" for the tokens of the endpoint, and runs it
+// again before each token expires.
+type AzCliConfig struct {
+	// TenantID is the tenant to get the tokens from, if not the default tenant of the Azure CLI.
+	TenantID string
+
+	// command replaces "az" in tests.
+	command string
+}
+
+// fetchToken implements fetchToken with the Azure CLI. Failures are of kind errors.KAuth.
+func (c *AzCliConfig) fetchToken(ctx context.Context, resource string) (string, time.Time, error) {
+	command := "az"
+	if c.command != "" {
+		command = c.command
+	}
+	args := []string{"account", "get-access-token", "--resource", resource, "--output", "json"}
+	if c.TenantID != "" {
+		args = append(args, "--tenant", c.TenantID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, azCliTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		switch {
+		case goErrors.Is(err, exec.ErrNotFound) || goErrors.Is(err, os.ErrNotExist):
+			return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "the Azure CLI(%s) is not installed or not on the PATH", command).SetNoRetry()
+		case strings.Contains(msg, "az login"):
+			return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "the Azure CLI is not logged in, run \"az login\": %s", msg).SetNoRetry()
+		case ctx.Err() != nil:
+			return "", time.Time{}, errors.E(errors.OpServConn, errors.KAuth, fmt.Errorf("the Azure CLI did not return a token: %w", ctx.Err()))
+		}
+		return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "the Azure CLI could not get a token(%s): %s", err, msg)
+	}
+
+	var token struct {
+		AccessToken string `json:"accessToken"`
+		// ExpiresOn is the expiry in local time, such as "2022-02-01 15:04:05.000000".
+		ExpiresOn string `json:"expiresOn"`
+		// ExpiresOnUnix is the expiry in seconds since the epoch, which only newer versions return.
+		ExpiresOnUnix int64 `json:"expires_on"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &token); err != nil || token.AccessToken == "" {
+		return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "the Azure CLI returned a token that could not be read")
+	}
+	if token.ExpiresOnUnix != 0 {
+		return token.AccessToken, time.Unix(token.ExpiresOnUnix, 0), nil
+	}
+	expiresOn, err := time.ParseInLocation("2006-01-02 15:04:05.999999", token.ExpiresOn, time.Local)
+	if err != nil {
+		return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "the Azure CLI returned a token with a bad expiresOn(%s)", token.ExpiresOn)
+	}
+	return token.AccessToken, expiresOn, nil
+}
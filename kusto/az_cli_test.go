@@ -0,0 +1,142 @@
+package kusto
+
+import (
+	"context"
+	goErrors "errors"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAzCli writes a script that stands in for the Azure CLI, which runs script and appends its arguments to the
+// file at the returned path.
+func fakeAzCli(t *testing.T, script string) (command, argsFile string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake Azure CLI is a shell script")
+	}
+	dir := t.TempDir()
+	command = filepath.Join(dir, "az")
+	argsFile = filepath.Join(dir, "args")
+	err := ioutil.WriteFile(command, []byte("#!/bin/sh\necho \"$@\" >> "+argsFile+"\n"+script), 0700)
+	require.NoError(t, err)
+	return command, argsFile
+}
+
+func TestAzCli(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc   string
+		script string
+		want   string
+		// wantExpiry is when the token expires, if not zero.
+		wantExpiry time.Time
+		// wantErr is a part of the error, if any.
+		wantErr string
+	}{
+		{
+			desc:       "Expiry in local time",
+			script:     `echo '{"accessToken":"token","expiresOn":"2030-01-02 03:04:05.123456","tokenType":"Bearer"}'`,
+			want:       "token",
+			wantExpiry: time.Date(2030, 1, 2, 3, 4, 5, 123456000, time.Local),
+		},
+		{
+			desc:       "Expiry since the epoch",
+			script:     `echo '{"accessToken":"token","expiresOn":"2030-01-02 03:04:05.000000","expires_on":1893553445}'`,
+			want:       "token",
+			wantExpiry: time.Unix(1893553445, 0),
+		},
+		{
+			desc:    "Not logged in",
+			script:  `echo "ERROR: Please run 'az login' to setup account." >&2; exit 1`,
+			wantErr: `the Azure CLI is not logged in, run "az login"`,
+		},
+		{
+			desc:    "Other failure",
+			script:  `echo "ERROR: something broke" >&2; exit 2`,
+			wantErr: "something broke",
+		},
+		{
+			desc:    "Bad output",
+			script:  `echo 'not json'`,
+			wantErr: "could not be read",
+		},
+		{
+			desc:    "Bad expiry",
+			script:  `echo '{"accessToken":"token","expiresOn":"tomorrow"}'`,
+			wantErr: "bad expiresOn(tomorrow)",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			command, argsFile := fakeAzCli(t, test.script)
+			token, expiresOn, err := (&AzCliConfig{TenantID: "tenant", command: command}).fetchToken(context.Background(), "https://mycluster.kusto.windows.net")
+
+			args, readErr := ioutil.ReadFile(argsFile)
+			require.NoError(t, readErr)
+			assert.Equal(t, "account get-access-token --resource https://mycluster.kusto.windows.net --output json --tenant tenant\n", string(args))
+
+			if test.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr)
+				var e *errors.Error
+				require.True(t, goErrors.As(err, &e))
+				assert.Equal(t, errors.KAuth, e.Kind)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, token)
+			assert.True(t, test.wantExpiry.Equal(expiresOn), "got expiry %s, want %s", expiresOn, test.wantExpiry)
+		})
+	}
+}
+
+func TestAzCliNotInstalled(t *testing.T) {
+	t.Parallel()
+
+	_, _, err := (&AzCliConfig{command: filepath.Join(t.TempDir(), "no-az")}).fetchToken(context.Background(), "https://mycluster.kusto.windows.net")
+	require.Error(t, err)
+	var e *errors.Error
+	require.True(t, goErrors.As(err, &e))
+	assert.Equal(t, errors.KAuth, e.Kind)
+	assert.Contains(t, err.Error(), "is not installed or not on the PATH")
+}
+
+func TestAzCliTokenCache(t *testing.T) {
+	t.Parallel()
+
+	// Each token expires in an hour, so the client runs the Azure CLI once for many calls.
+	command, argsFile := fakeAzCli(t, `echo "{\"accessToken\":\"token\",\"expires_on\":$(($(date +%s) + 3600))}"`)
+
+	a := Authorization{AzCli: &AzCliConfig{command: command}}
+	require.NoError(t, a.Validate("https://mycluster.kusto.windows.net"))
+	authorizer := a.Authorizer.(*tokenAuthorizer)
+
+	for i := 0; i < 3; i++ {
+		token, err := authorizer.getToken(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "token", token)
+	}
+	args, err := ioutil.ReadFile(argsFile)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(args), "\n"))
+
+	// A token that is about to expire is fetched again.
+	authorizer.expiresOn = time.Now().Add(time.Minute)
+	_, err = authorizer.getToken(context.Background())
+	require.NoError(t, err)
+	args, err = ioutil.ReadFile(argsFile)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(args), "\n"))
+}
@@ -0,0 +1,65 @@
+package kusto
+
+// compress.go holds the gzip compression of the bodies of the requests of queries and commands.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+)
+
+// defaultCompressThreshold is the size in bytes above which the body of a request is compressed by default.
+const defaultCompressThreshold = 4 * 1024
+
+// compression is how the bodies of the requests of a Client are compressed. The zero value compresses none.
+type compression struct {
+	// enabled is unset by WithoutRequestCompression().
+	enabled bool
+	// threshold is the size in bytes above which a body is compressed.
+	threshold int
+}
+
+// validate returns an error if the settings of c cannot be used.
+func (c compression) validate() error {
+	if c.threshold < 0 {
+		return errors.ES(errors.OpServConn, errors.KClientArgs, "WithRequestCompressionThreshold(%d): cannot be negative", c.threshold).SetNoRetry()
+	}
+	return nil
+}
+
+// applies tells if a body of size bytes is compressed.
+func (c compression) applies(size int) bool {
+	return c.enabled && size > c.threshold
+}
+
+// WithRequestCompressionThreshold sets the size in bytes above which the body of a query or command, which holds its
+// text and parameters, is sent compressed with gzip. 0 compresses every body. The default is 4 KiB, as smaller
+// bodies gain little from it.
+func WithRequestCompressionThreshold(threshold int) Option {
+	return func(c *Client) {
+		c.compression.threshold = threshold
+	}
+}
+
+// WithoutRequestCompression makes the client send the bodies of queries and commands uncompressed, such as for a
+// proxy that cannot handle compressed requests. The responses are still asked for compressed.
+func WithoutRequestCompression() Option {
+	return func(c *Client) {
+		c.compression.enabled = false
+	}
+}
+
+// gzipBody returns body compressed with gzip.
+func gzipBody(op errors.Op, body []byte) ([]byte, error) {
+	var buff bytes.Buffer
+	zw := gzip.NewWriter(&buff)
+	if _, err := zw.Write(body); err != nil {
+		return nil, errors.E(op, errors.KInternal, fmt.Errorf("could not gzip the request body: %w", err))
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.E(op, errors.KInternal, fmt.Errorf("could not gzip the request body: %w", err))
+	}
+	return buff.Bytes(), nil
+}
@@ -0,0 +1,156 @@
+package kusto
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// compressedRequest is what the server of TestRequestCompression got.
+type compressedRequest struct {
+	contentEncoding  string
+	acceptEncoding   string
+	contentLength    int64
+	transferEncoding []string
+	csl              string
+}
+
+func TestRequestCompression(t *testing.T) {
+	t.Parallel()
+
+	small := "T | take 1"
+	large := "T | where Name in (" + strings.Repeat(`"name",`, 1000) + `"name")`
+
+	tests := []struct {
+		desc         string
+		compression  compression
+		csl          string
+		wantEncoding string
+	}{
+		{desc: "Small body is not compressed", compression: compression{enabled: true, threshold: defaultCompressThreshold}, csl: small},
+		{desc: "Large body is compressed", compression: compression{enabled: true, threshold: defaultCompressThreshold}, csl: large, wantEncoding: "gzip"},
+		{desc: "Threshold of 0 compresses every body", compression: compression{enabled: true, threshold: 0}, csl: small, wantEncoding: "gzip"},
+		{desc: "Opt-out", compression: compression{threshold: defaultCompressThreshold}, csl: large},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				mu   sync.Mutex
+				reqs []compressedRequest
+			)
+			client := testClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got := compressedRequest{
+					contentEncoding:  r.Header.Get("Content-Encoding"),
+					acceptEncoding:   r.Header.Get("Accept-Encoding"),
+					contentLength:    r.ContentLength,
+					transferEncoding: r.TransferEncoding,
+				}
+				var body io.Reader = r.Body
+				if got.contentEncoding == "gzip" {
+					zr, err := gzip.NewReader(r.Body)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					body = zr
+				}
+				var msg queryMsg
+				if err := json.NewDecoder(body).Decode(&msg); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				got.csl = msg.CSL
+				mu.Lock()
+				reqs = append(reqs, got)
+				mu.Unlock()
+
+				// The response is compressed, as the request allows.
+				w.Header().Set("Content-Encoding", "gzip")
+				zw := gzip.NewWriter(w)
+				if r.URL.Path == "/v1/rest/mgmt" {
+					io.WriteString(zw, retryV1Response)
+				} else {
+					io.WriteString(zw, retryV2Response)
+				}
+				zw.Close()
+			}))
+			client.conn.(*conn).compression = test.compression
+
+			iter, err := client.Query(context.Background(), "db", NewStmt(stringConstant(test.csl)))
+			require.NoError(t, err)
+			var rows int
+			require.NoError(t, iter.Do(func(*table.Row) error { rows++; return nil }))
+			assert.Equal(t, 1, rows)
+
+			iter, err = client.Mgmt(context.Background(), "db", NewStmt(stringConstant(".show tables | where TableName in "+test.csl)))
+			require.NoError(t, err)
+			require.NoError(t, iter.Do(func(*table.Row) error { return nil }))
+
+			require.Len(t, reqs, 2)
+			assert.Equal(t, test.csl, reqs[0].csl)
+			for _, got := range reqs {
+				assert.Equal(t, test.wantEncoding, got.contentEncoding)
+				assert.Equal(t, "gzip", got.acceptEncoding)
+				// The body has a length, rather than being sent chunked.
+				assert.Greater(t, got.contentLength, int64(0))
+				assert.Empty(t, got.transferEncoding)
+			}
+		})
+	}
+}
+
+func TestRequestCompressionOptions(t *testing.T) {
+	t.Parallel()
+
+	transport := &recordingTransport{body: retryV2Response}
+	newClient := func(options ...Option) (*Client, error) {
+		options = append([]Option{WithHTTPClient(&http.Client{Transport: transport})}, options...)
+		return New("https://mycluster.kusto.windows.net", Authorization{Authorizer: autorest.NullAuthorizer{}}, options...)
+	}
+
+	client, err := newClient()
+	require.NoError(t, err)
+	assert.Equal(t, compression{enabled: true, threshold: defaultCompressThreshold}, client.conn.(*conn).compression)
+
+	client, err = newClient(WithRequestCompressionThreshold(100))
+	require.NoError(t, err)
+	assert.Equal(t, compression{enabled: true, threshold: 100}, client.conn.(*conn).compression)
+
+	client, err = newClient(WithoutRequestCompression())
+	require.NoError(t, err)
+	assert.False(t, client.conn.(*conn).compression.enabled)
+
+	_, err = newClient(WithRequestCompressionThreshold(-1))
+	assert.Error(t, err)
+
+	// The body is sent as it was before it was compressed.
+	client, err = newClient(WithRequestCompressionThreshold(0))
+	require.NoError(t, err)
+	iter, err := client.Query(context.Background(), "db", NewStmt("T"))
+	require.NoError(t, err)
+	iter.Stop()
+	require.Len(t, transport.reqs, 1)
+	assert.Equal(t, "gzip", transport.reqs[0].Header.Get("Content-Encoding"))
+	body, err := transport.reqs[0].GetBody()
+	require.NoError(t, err)
+	zr, err := gzip.NewReader(body)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"csl":"T"`)
+}
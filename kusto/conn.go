@@ -7,13 +7,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	goErrors "errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/internal/frames"
@@ -23,6 +26,7 @@ import (
 	"github.com/Azure/azure-kusto-go/kusto/internal/version"
 
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/cenkalti/backoff/v4"
 	"github.com/google/uuid"
 )
 
@@ -40,32 +44,45 @@ type conn struct {
 	auth                           autorest.Authorizer
 	endMgmt, endQuery, streamQuery *url.URL
 	client                         *http.Client
+	// retry is how calls that fail before they get the results are retried.
+	retry retryPolicy
+	// tracer, if set, is called around each request, with the text of the query if traceCSL is set.
+	tracer   Tracer
+	traceCSL bool
+	// app and user are sent as the x-ms-app and x-ms-user headers, if set.
+	app, user string
+	// compression is how the bodies of the requests are compressed.
+	compression compression
 }
 
-// newConn returns a new conn object.
-func newConn(endpoint string, auth Authorization) (*conn, error) {
+// newConn returns a new conn object, which sends its requests with client, or with a client of its own if it is nil.
+func newConn(endpoint string, auth Authorization, client *http.Client) (*conn, error) {
 	if !validURL.MatchString(endpoint) {
 		return nil, errors.ES(errors.OpServConn, errors.KClientArgs, "endpoint is not valid(%s), should be https://<cluster name>.*", endpoint).SetNoRetry()
 	}
 
 	u, err := url.Parse(endpoint)
 	if err != nil {
-		return nil, errors.ES(errors.OpServConn, errors.KClientArgs, "could not parse the endpoint(%s): %s", endpoint, err).SetNoRetry()
+		return nil, errors.E(errors.OpServConn, errors.KClientArgs, fmt.Errorf("could not parse the endpoint(%s): %w", endpoint, err)).SetNoRetry()
 	}
 
 	c := &conn{
 		auth:        auth.Authorizer,
-		endMgmt:     &url.URL{Scheme: "https", Host: u.Hostname(), Path: "/v1/rest/mgmt"},
-		endQuery:    &url.URL{Scheme: "https", Host: u.Hostname(), Path: "/v2/rest/query"},
-		streamQuery: &url.URL{Scheme: "https", Host: u.Hostname(), Path: "/v1/rest/ingest/"},
-		client:      &http.Client{},
+		endMgmt:     &url.URL{Scheme: "https", Host: u.Host, Path: "/v1/rest/mgmt"},
+		endQuery:    &url.URL{Scheme: "https", Host: u.Host, Path: "/v2/rest/query"},
+		streamQuery: &url.URL{Scheme: "https", Host: u.Host, Path: "/v1/rest/ingest/"},
+		client:      client,
+	}
+	if c.client == nil {
+		c.client = &http.Client{}
 	}
 
 	return c, nil
 }
 
 type queryMsg struct {
-	DB         string            `json:"db"`
+	// DB is omitted for a command of the cluster.
+	DB         string            `json:"db,omitempty"`
 	CSL        string            `json:"csl"`
 	Properties requestProperties `json:"properties,omitempty"`
 }
@@ -127,9 +144,18 @@ func (c *conn) execute(ctx context.Context, execType int, db string, query Stmt,
 	header := http.Header{}
 	header.Add("Accept", "application/json")
 	header.Add("Accept-Encoding", "gzip")
-	header.Add("x-ms-client-version", "Kusto.Go.Client: "+version.Kusto)
+	header.Add("x-ms-client-version", version.Header)
+	if c.app != "" {
+		header.Add("x-ms-app", c.app)
+	}
+	if c.user != "" {
+		header.Add("x-ms-user", c.user)
+	}
 	header.Add("Content-Type", "application/json; charset=utf-8")
-	header.Add("x-ms-client-request-id", "KGC.execute;"+uuid.New().String())
+	if properties.ClientRequestID == "" {
+		properties.ClientRequestID = "KGC.execute;" + uuid.New().String()
+	}
+	header.Add("x-ms-client-request-id", properties.ClientRequestID)
 
 	var endpoint *url.URL
 	buff := bufferPool.Get().(*bytes.Buffer)
@@ -158,33 +184,103 @@ func (c *conn) execute(ctx context.Context, execType int, db string, query Stmt,
 		return execResp{}, errors.ES(op, errors.KInternal, "internal error: did not understand the type of execType: %d", execType)
 	}
 
-	req := &http.Request{
-		Method: http.MethodPost,
-		URL:    endpoint,
-		Header: header,
-		Body:   ioutil.NopCloser(buff),
+	reqBody := buff.Bytes()
+	if c.compression.applies(len(reqBody)) {
+		var err error
+		reqBody, err = gzipBody(op, reqBody)
+		if err != nil {
+			return execResp{}, err
+		}
+		header.Add("Content-Encoding", "gzip")
 	}
 
-	var err error
+	var (
+		resp     *http.Response
+		body     io.ReadCloser
+		attempts int
+	)
+	canRetry := idempotent(execType, query)
+	b := c.retry.backOff()
 	prep := c.auth.WithAuthorization()
-	req, err = prep(autorest.CreatePreparer()).Prepare(req)
-	if err != nil {
-		return execResp{}, errors.E(op, errors.KInternal, err)
-	}
+	start := time.Now()
+	err := backoff.Retry(func() error {
+		attempts++
+		// The length is set so that the body is not sent chunked, which some proxies do not accept.
+		req := (&http.Request{
+			Method:        http.MethodPost,
+			URL:           endpoint,
+			Header:        header.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(reqBody)),
+			ContentLength: int64(len(reqBody)),
+			GetBody: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(reqBody)), nil
+			},
+		}).WithContext(ctx)
 
-	resp, err := c.client.Do(req.WithContext(ctx))
-	if err != nil {
-		// TODO(jdoak): We need a http error unwrap function that pulls out an *errors.Error.
-		return execResp{}, errors.E(op, errors.KHTTPError, fmt.Errorf("with query %q: %w", query.String(), err))
-	}
+		req, err := prep(autorest.CreatePreparer()).Prepare(req)
+		if err != nil {
+			var e *errors.Error
+			if !goErrors.As(err, &e) {
+				e = errors.E(op, errors.KInternal, err)
+			}
+			return backoff.Permanent(e)
+		}
 
-	body, err := response.TranslateBody(resp, op)
-	if err != nil {
-		return execResp{}, err
-	}
+		var call *TraceCall
+		if c.tracer != nil {
+			call = c.traceStart(&req, op, endpoint, query, properties.ClientRequestID, attempts)
+		}
 
-	if resp.StatusCode != 200 {
-		return execResp{}, errors.HTTP(op, resp.Status, body, fmt.Sprintf("error from Kusto endpoint for query %q: ", query.String()))
+		resp, err = c.client.Do(req)
+		if err != nil {
+			// TODO(jdoak): We need a http error unwrap function that pulls out an *errors.Error.
+			e := errors.E(op, errors.KHTTPError, fmt.Errorf("with query %q: %w", query.String(), err))
+			e.SetRequestInfo("", properties.ClientRequestID, time.Since(start))
+			if call != nil {
+				c.traceEnd(req, call, nil, e)
+			}
+			if ctx.Err() != nil || !isTransientErr(e, canRetry) {
+				return backoff.Permanent(e)
+			}
+			return e
+		}
+		activityID := resp.Header.Get("x-ms-activity-id")
+
+		body, err = response.TranslateBody(resp, op)
+		if err != nil {
+			resp.Body.Close()
+			if call != nil {
+				c.traceEnd(req, call, resp, err)
+			}
+			return backoff.Permanent(err)
+		}
+
+		if resp.StatusCode != 200 {
+			defer body.Close()
+			e := errors.HTTP(op, resp.Status, body, fmt.Sprintf("error from Kusto endpoint for query %q: ", query.String()))
+			e.SetRequestInfo(activityID, properties.ClientRequestID, time.Since(start))
+			e.SetRetryAfter(response.RetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+			if call != nil {
+				c.traceEnd(req, call, resp, e)
+			}
+			if !isTransientErr(e, canRetry) {
+				return backoff.Permanent(e)
+			}
+			b.retryAfter = e.RetryAfter()
+			return e
+		}
+		if call != nil {
+			c.traceEnd(req, call, resp, nil)
+		}
+		return nil
+	}, backoff.WithContext(b, ctx))
+	if err != nil {
+		var e *errors.Error
+		if !goErrors.As(err, &e) {
+			// The context was done while waiting to retry.
+			e = errors.E(op, errors.KTimeout, err).SetRequestInfo("", properties.ClientRequestID, time.Since(start))
+		}
+		return execResp{}, e.SetAttempts(attempts)
 	}
 
 	var dec frames.Decoder
@@ -201,3 +297,33 @@ func (c *conn) execute(ctx context.Context, execType int, db string, query Stmt,
 
 	return execResp{reqHeader: header, respHeader: resp.Header, frameCh: frameCh}, nil
 }
+
+// traceStart calls TraceStart of the tracer of c for the request *req, which it replaces with one that has the
+// context that TraceStart returned. The returned TraceCall is for traceEnd().
+func (c *conn) traceStart(req **http.Request, op errors.Op, endpoint *url.URL, query Stmt, clientRequestID string, attempt int) *TraceCall {
+	csl := query.String()
+	call := &TraceCall{
+		Op:              op,
+		Endpoint:        endpoint.String(),
+		ClientRequestID: clientRequestID,
+		CSLHash:         cslHash(csl),
+		Attempt:         attempt,
+		Start:           time.Now(),
+	}
+	if c.traceCSL {
+		call.CSL = csl
+	}
+	*req = (*req).WithContext(c.tracer.TraceStart((*req).Context(), *call))
+	return call
+}
+
+// traceEnd calls TraceEnd of the tracer of c for call, which got resp, if any, or failed with err.
+func (c *conn) traceEnd(req *http.Request, call *TraceCall, resp *http.Response, err error) {
+	call.Duration = time.Since(call.Start)
+	call.Err = err
+	if resp != nil {
+		call.StatusCode = resp.StatusCode
+		call.ActivityID = resp.Header.Get("x-ms-activity-id")
+	}
+	c.tracer.TraceEnd(req.Context(), *call)
+}
@@ -0,0 +1,433 @@
+package kusto
+
+// conn_string.go holds the ConnectionStringBuilder, which makes the Authorization of a Client from a Kusto connection
+// string, the format that the Kusto SDKs of other languages share.
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+)
+
+// kustoClientAppID is the id of the public application that the Kusto tools use to sign users in.
+const kustoClientAppID = "db662dc1-0cfe-4e1c-a843-19a68e65be58"
+
+// Connection string keywords, by their name with no spaces in lower case. The names in the comments are the ones
+// the documentation uses, and the others are their aliases.
+const (
+	csDataSource        = "datasource"                     // Data Source, Addr, Address, Network Address, Server
+	csInitialCatalog    = "initialcatalog"                 // Initial Catalog, Database
+	csFederated         = "aadfederatedsecurity"           // AAD Federated Security, Fed, FederatedSecurity
+	csAppClientID       = "applicationclientid"            // Application Client Id, AppClientId
+	csAppKey            = "applicationkey"                 // Application Key, AppKey
+	csAuthorityID       = "authorityid"                    // Authority Id, TenantId
+	csAppCertPath       = "applicationcertificatepath"     // Application Certificate Path, AppCertPath
+	csAppCertPassword   = "applicationcertificatepassword" // Application Certificate Password, AppCertPassword
+	csInteractive       = "interactivelogin"               // Interactive Login, User Prompt
+	csManagedIdentity   = "msiauthentication"              // MSI Authentication, MSI Auth
+	csManagedIdentityID = "msiclientid"                    // MSI Client Id, Managed Identity Client Id
+	csAzCli             = "azcli"                          // Az Cli, Azure Cli
+	csUserToken         = "usertoken"                      // User Token, UsrToken
+	csAppToken          = "applicationtoken"               // Application Token, AppToken
+	csAppForTracing     = "applicationnamefortracing"      // Application Name for Tracing, TraceAppName
+	csUserForTracing    = "usernamefortracing"             // User Name for Tracing, TraceUserName
+)
+
+// csKeywords maps the keywords and their aliases, with no spaces and in lower case, to the keyword.
+var csKeywords = map[string]string{
+	"datasource": csDataSource, "addr": csDataSource, "address": csDataSource, "networkaddress": csDataSource, "server": csDataSource,
+	"initialcatalog": csInitialCatalog, "database": csInitialCatalog,
+	"aadfederatedsecurity": csFederated, "fed": csFederated, "federatedsecurity": csFederated,
+	"applicationclientid": csAppClientID, "appclientid": csAppClientID,
+	"applicationkey": csAppKey, "appkey": csAppKey,
+	"authorityid": csAuthorityID, "tenantid": csAuthorityID,
+	"applicationcertificatepath": csAppCertPath, "appcertpath": csAppCertPath,
+	"applicationcertificatepassword": csAppCertPassword, "appcertpassword": csAppCertPassword,
+	"interactivelogin": csInteractive, "userprompt": csInteractive,
+	"msiauthentication": csManagedIdentity, "msiauth": csManagedIdentity,
+	"msiclientid": csManagedIdentityID, "managedidentityclientid": csManagedIdentityID,
+	"azcli": csAzCli, "azurecli": csAzCli,
+	"usertoken": csUserToken, "usrtoken": csUserToken,
+	"applicationtoken": csAppToken, "apptoken": csAppToken,
+	"applicationnamefortracing": csAppForTracing, "traceappname": csAppForTracing,
+	"usernamefortracing": csUserForTracing, "traceusername": csUserForTracing,
+}
+
+// ConnectionStringBuilder holds what a Client needs to connect to a cluster, as parsed from a Kusto connection
+// string by NewConnectionStringBuilder() or set with its With methods, which can be chained. Pass it to
+// NewFromConnectionString() to get a Client, or use Authorization() with New().
+//
+// A connection string is a list of "keyword=value" pairs separated by semicolons, such as
+// "Data Source=https://mycluster.kusto.windows.net;Application Client Id=...;Application Key=...;Authority Id=...".
+// Keywords ignore case and spaces. A value can be put in single or double quotes to hold a semicolon, with the quote
+// doubled to put it in the value. The keywords are:
+//
+//	Data Source (Addr, Address, Network Address, Server): the endpoint of the cluster.
+//	Initial Catalog (Database): the database that the caller means to use, which the Client does not use itself.
+//	AAD Federated Security (Fed, FederatedSecurity): must be true if set, as the client only supports AAD.
+//	Application Client Id (AppClientId): the id of the application to sign in as.
+//	Application Key (AppKey): the secret of the application.
+//	Authority Id (TenantId): the tenant of the application or the user.
+//	Application Certificate Path (AppCertPath): the path of a PKCS#12 file with the certificate of the application.
+//	Application Certificate Password (AppCertPassword): the password of the certificate file.
+//	Interactive Login (User Prompt): true to sign a user in with a device code that is printed to stdout.
+//	MSI Authentication (MSI Auth): true to sign in as the managed identity of the host.
+//	MSI Client Id (Managed Identity Client Id): the client id of a user-assigned managed identity.
+//	Az Cli (Azure Cli): true to sign in as the user that is logged in to the Azure CLI.
+//	User Token (UsrToken), Application Token (AppToken): an AAD access token for the cluster to send as is.
+//	Application Name for Tracing (TraceAppName): the application that the service logs the requests for.
+//	User Name for Tracing (TraceUserName): the user that the service logs the requests for.
+//
+// Only one way to sign in can be set: an application key, an application certificate, the interactive login,
+// a managed identity, the Azure CLI or a token.
+type ConnectionStringBuilder struct {
+	// DataSource is the endpoint of the cluster, such as "https://mycluster.westus.kusto.windows.net".
+	DataSource string
+	// InitialCatalog is the database that the connection string names, if any.
+	InitialCatalog string
+	// ApplicationClientID is the id of the application, or of the application that signs a user in.
+	ApplicationClientID string
+	// ApplicationKey is the secret of the application.
+	ApplicationKey string
+	// AuthorityID is the tenant to sign in to.
+	AuthorityID string
+	// ApplicationCertificatePath is the path of a PKCS#12 file with the certificate of the application.
+	ApplicationCertificatePath string
+	// ApplicationCertificatePassword is the password of the certificate file.
+	ApplicationCertificatePassword string
+	// InteractiveLogin signs a user in with a device code.
+	InteractiveLogin bool
+	// ManagedIdentity signs in as the managed identity of the host, the user-assigned one with client id
+	// ManagedIdentityClientID if set.
+	ManagedIdentity         bool
+	ManagedIdentityClientID string
+	// AzCli signs in as the user that is logged in to the Azure CLI.
+	AzCli bool
+	// Token is an access token that is sent as is.
+	Token string
+	// ApplicationForTracing and UserForTracing are the application and the user that the service logs the requests
+	// for, see WithApplicationForTracing() and WithUserForTracing().
+	ApplicationForTracing string
+	UserForTracing        string
+}
+
+// NewConnectionStringBuilder parses the Kusto connection string connStr. An unknown keyword is an error that names it.
+// The errors never hold the values of the connection string, as they may be secrets.
+func NewConnectionStringBuilder(connStr string) (*ConnectionStringBuilder, error) {
+	pairs, err := splitConnectionString(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &ConnectionStringBuilder{}
+	for _, p := range pairs {
+		if err := b.set(p[0], p[1]); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// set sets the keyword key, as written in the connection string, to val.
+func (b *ConnectionStringBuilder) set(key, val string) error {
+	kw, ok := csKeywords[strings.ToLower(strings.Join(strings.Fields(key), ""))]
+	if !ok {
+		return csError("unknown keyword %q", key)
+	}
+
+	parseBool := func() (bool, error) {
+		v, err := strconv.ParseBool(val)
+		if err != nil {
+			return false, csError("the value of %q must be true or false", key)
+		}
+		return v, nil
+	}
+
+	var err error
+	switch kw {
+	case csDataSource:
+		b.DataSource = val
+	case csInitialCatalog:
+		b.InitialCatalog = val
+	case csFederated:
+		var fed bool
+		if fed, err = parseBool(); err == nil && !fed {
+			err = csError("%q cannot be false, the client only supports AAD authentication", key)
+		}
+	case csAppClientID:
+		b.ApplicationClientID = val
+	case csAppKey:
+		b.ApplicationKey = val
+	case csAuthorityID:
+		b.AuthorityID = val
+	case csAppCertPath:
+		b.ApplicationCertificatePath = val
+	case csAppCertPassword:
+		b.ApplicationCertificatePassword = val
+	case csInteractive:
+		b.InteractiveLogin, err = parseBool()
+	case csManagedIdentity:
+		b.ManagedIdentity, err = parseBool()
+	case csManagedIdentityID:
+		b.ManagedIdentityClientID = val
+	case csAzCli:
+		b.AzCli, err = parseBool()
+	case csUserToken, csAppToken:
+		b.Token = val
+	case csAppForTracing:
+		b.ApplicationForTracing = val
+	case csUserForTracing:
+		b.UserForTracing = val
+	}
+	return err
+}
+
+// splitConnectionString splits connStr into its keyword and value pairs.
+func splitConnectionString(connStr string) ([][2]string, error) {
+	var pairs [][2]string
+	i := 0
+	skipSpace := func() {
+		for i < len(connStr) && (connStr[i] == ' ' || connStr[i] == '\t') {
+			i++
+		}
+	}
+	for n := 1; ; n++ {
+		// Skip the empty parts.
+		for skipSpace(); i < len(connStr) && connStr[i] == ';'; skipSpace() {
+			i++
+		}
+		if i == len(connStr) {
+			return pairs, nil
+		}
+
+		// The keyword runs to the '=', as keywords cannot hold one.
+		eq := strings.IndexAny(connStr[i:], "=;")
+		if eq < 0 || connStr[i+eq] == ';' {
+			return nil, csError("part %d has no '='", n)
+		}
+		key := strings.TrimSpace(connStr[i : i+eq])
+		if key == "" {
+			return nil, csError("part %d has no keyword", n)
+		}
+		i += eq + 1
+
+		// The value runs to the ';', unless it is quoted.
+		skipSpace()
+		var val string
+		if i < len(connStr) && (connStr[i] == '"' || connStr[i] == '\'') {
+			var size int
+			var ok bool
+			if val, size, ok = unquoteValue(connStr[i:]); !ok {
+				return nil, csError("the value of %q has no closing quote", key)
+			}
+			i += size
+			if skipSpace(); i < len(connStr) && connStr[i] != ';' {
+				return nil, csError("the value of %q has text after its closing quote", key)
+			}
+		} else {
+			end := strings.IndexByte(connStr[i:], ';')
+			if end < 0 {
+				end = len(connStr) - i
+			}
+			val = strings.TrimSpace(connStr[i : i+end])
+			i += end
+		}
+		pairs = append(pairs, [2]string{key, val})
+	}
+}
+
+// unquoteValue returns the value that s starts with, which is in the quote that s starts with, and how many bytes
+// of s it takes. The quote is doubled to put it in the value.
+func unquoteValue(s string) (val string, size int, ok bool) {
+	q := s[0]
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != q {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == q {
+			sb.WriteByte(q)
+			i++
+			continue
+		}
+		return sb.String(), i + 1, true
+	}
+	return "", 0, false
+}
+
+// csError returns an error about a connection string. Callers must not put values of the connection string in it.
+func csError(format string, args ...interface{}) *errors.Error {
+	return errors.ES(errors.OpServConn, errors.KClientArgs, "connection string: "+format, args...).SetNoRetry()
+}
+
+// authModes returns the ways to sign in that are set.
+func (b *ConnectionStringBuilder) authModes() []string {
+	var modes []string
+	if b.ApplicationKey != "" {
+		modes = append(modes, "an application key")
+	}
+	if b.ApplicationCertificatePath != "" {
+		modes = append(modes, "an application certificate")
+	}
+	if b.InteractiveLogin {
+		modes = append(modes, "the interactive login")
+	}
+	if b.ManagedIdentity {
+		modes = append(modes, "a managed identity")
+	}
+	if b.AzCli {
+		modes = append(modes, "the Azure CLI")
+	}
+	if b.Token != "" {
+		modes = append(modes, "a token")
+	}
+	return modes
+}
+
+// validate checks that b has a data source and exactly one way to sign in, with what it needs.
+func (b *ConnectionStringBuilder) validate() error {
+	if b.DataSource == "" {
+		return csError("the Data Source is not set")
+	}
+
+	modes := b.authModes()
+	switch {
+	case len(modes) == 0:
+		return csError("no authentication is set, set an application key or certificate, the interactive login, a managed identity, the Azure CLI or a token")
+	case len(modes) > 1:
+		return csError("only one authentication can be set, but got %s", strings.Join(modes, " and "))
+	}
+
+	switch {
+	case b.ApplicationKey != "" || b.ApplicationCertificatePath != "":
+		if b.ApplicationClientID == "" || b.AuthorityID == "" {
+			return csError("%s needs the Application Client Id and the Authority Id", modes[0])
+		}
+	case b.ApplicationCertificatePassword != "":
+		return csError("the Application Certificate Password is set without the Application Certificate Path")
+	case b.ManagedIdentityClientID != "" && !b.ManagedIdentity:
+		return csError("the MSI Client Id is set without MSI Authentication")
+	}
+	return nil
+}
+
+// resetAuth unsets the ways to sign in.
+func (b *ConnectionStringBuilder) resetAuth() {
+	b.ApplicationKey = ""
+	b.ApplicationCertificatePath = ""
+	b.ApplicationCertificatePassword = ""
+	b.InteractiveLogin = false
+	b.ManagedIdentity = false
+	b.ManagedIdentityClientID = ""
+	b.AzCli = false
+	b.Token = ""
+}
+
+// WithAadAppKey signs in as the application appID with its secret appKey, in tenant authorityID. Like the other
+// With methods, it replaces the way to sign in that was set before.
+func (b *ConnectionStringBuilder) WithAadAppKey(appID, appKey, authorityID string) *ConnectionStringBuilder {
+	b.resetAuth()
+	b.ApplicationClientID, b.ApplicationKey, b.AuthorityID = appID, appKey, authorityID
+	return b
+}
+
+// WithAppCertificate signs in as the application appID with the certificate in the PKCS#12 file at certPath, which
+// has password certPassword, in tenant authorityID.
+func (b *ConnectionStringBuilder) WithAppCertificate(appID, certPath, certPassword, authorityID string) *ConnectionStringBuilder {
+	b.resetAuth()
+	b.ApplicationClientID, b.AuthorityID = appID, authorityID
+	b.ApplicationCertificatePath, b.ApplicationCertificatePassword = certPath, certPassword
+	return b
+}
+
+// WithInteractiveLogin signs a user in to tenant authorityID, or to their home tenant if it is empty, with a device
+// code that is printed to stdout for the user to enter.
+func (b *ConnectionStringBuilder) WithInteractiveLogin(authorityID string) *ConnectionStringBuilder {
+	b.resetAuth()
+	b.InteractiveLogin, b.AuthorityID = true, authorityID
+	return b
+}
+
+// WithSystemManagedIdentity signs in as the system-assigned managed identity of the host.
+func (b *ConnectionStringBuilder) WithSystemManagedIdentity() *ConnectionStringBuilder {
+	b.resetAuth()
+	b.ManagedIdentity = true
+	return b
+}
+
+// WithUserManagedIdentity signs in as the user-assigned managed identity with clientID.
+func (b *ConnectionStringBuilder) WithUserManagedIdentity(clientID string) *ConnectionStringBuilder {
+	b.resetAuth()
+	b.ManagedIdentity, b.ManagedIdentityClientID = true, clientID
+	return b
+}
+
+// WithAzCli signs in as the user that is logged in to the Azure CLI, to the tenant AuthorityID if it is set.
+func (b *ConnectionStringBuilder) WithAzCli() *ConnectionStringBuilder {
+	b.resetAuth()
+	b.AzCli = true
+	return b
+}
+
+// WithToken sends the access token token with each call. The token is not refreshed, so the calls fail once it expires.
+func (b *ConnectionStringBuilder) WithToken(token string) *ConnectionStringBuilder {
+	b.resetAuth()
+	b.Token = token
+	return b
+}
+
+// Authorization returns the Authorization for New() that signs in the way that b sets.
+func (b *ConnectionStringBuilder) Authorization() (Authorization, error) {
+	if err := b.validate(); err != nil {
+		return Authorization{}, err
+	}
+
+	switch {
+	case b.ApplicationKey != "":
+		return Authorization{Config: auth.NewClientCredentialsConfig(b.ApplicationClientID, b.ApplicationKey, b.AuthorityID)}, nil
+	case b.ApplicationCertificatePath != "":
+		return Authorization{
+			Config: auth.NewClientCertificateConfig(b.ApplicationCertificatePath, b.ApplicationCertificatePassword, b.ApplicationClientID, b.AuthorityID),
+		}, nil
+	case b.InteractiveLogin:
+		return Authorization{DeviceCode: &DeviceCodeConfig{ClientID: b.ApplicationClientID, TenantID: b.AuthorityID}}, nil
+	case b.ManagedIdentity:
+		return Authorization{ManagedIdentity: &ManagedIdentityConfig{ClientID: b.ManagedIdentityClientID}}, nil
+	case b.AzCli:
+		return Authorization{AzCli: &AzCliConfig{TenantID: b.AuthorityID}}, nil
+	}
+	return Authorization{Authorizer: autorest.NewBearerAuthorizer(staticToken(b.Token))}, nil
+}
+
+// staticToken is an access token that is never refreshed.
+type staticToken string
+
+// OAuthToken implements adal.OAuthTokenProvider.
+func (t staticToken) OAuthToken() string {
+	return string(t)
+}
+
+// NewFromConnectionString returns a new Client for the cluster and the sign in that kcsb sets. The application and
+// the user for tracing of kcsb are set before options, which can replace them.
+func NewFromConnectionString(kcsb *ConnectionStringBuilder, options ...Option) (*Client, error) {
+	a, err := kcsb.Authorization()
+	if err != nil {
+		return nil, err
+	}
+	var tracing []Option
+	if kcsb.ApplicationForTracing != "" {
+		tracing = append(tracing, WithApplicationForTracing(kcsb.ApplicationForTracing, ""))
+	}
+	if kcsb.UserForTracing != "" {
+		tracing = append(tracing, WithUserForTracing(kcsb.UserForTracing))
+	}
+	return New(kcsb.DataSource, a, append(tracing, options...)...)
+}
@@ -0,0 +1,316 @@
+package kusto
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConnectionStringBuilder(t *testing.T) {
+	t.Parallel()
+
+	const (
+		ds     = "Data Source=https://mycluster.kusto.windows.net;"
+		secret = "s3cr3t"
+	)
+
+	tests := []struct {
+		desc    string
+		connStr string
+		want    ConnectionStringBuilder
+		// wantErr is a part of the error, if the connection string is bad.
+		wantErr string
+	}{
+		{
+			desc:    "Application key",
+			connStr: ds + "AAD Federated Security=True;Application Client Id=app;Application Key=" + secret + ";Authority Id=tenant",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", ApplicationClientID: "app", ApplicationKey: secret, AuthorityID: "tenant"},
+		},
+		{
+			desc:    "Application key with aliases",
+			connStr: "Server=https://mycluster.kusto.windows.net;Fed=true;AppClientId=app;AppKey=" + secret + ";TenantId=tenant;Database=db",
+			want: ConnectionStringBuilder{
+				DataSource: "https://mycluster.kusto.windows.net", InitialCatalog: "db", ApplicationClientID: "app", ApplicationKey: secret, AuthorityID: "tenant",
+			},
+		},
+		{
+			desc:    "Keywords ignore case and spaces, values are trimmed",
+			connStr: " DATASOURCE = https://mycluster.kusto.windows.net ; federated security=TRUE;;app client id= app ;APPKEY=" + secret + ";tenant id=tenant;",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", ApplicationClientID: "app", ApplicationKey: secret, AuthorityID: "tenant"},
+		},
+		{
+			desc:    "Other data source aliases",
+			connStr: "Addr=a;Address=b;Network Address=c;Initial Catalog=db;MSI Auth=true",
+			want:    ConnectionStringBuilder{DataSource: "c", InitialCatalog: "db", ManagedIdentity: true},
+		},
+		{
+			desc:    "Quoted values",
+			connStr: ds + `Application Client Id='app';Application Key="a;b""c'd" ;Authority Id=tenant`,
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", ApplicationClientID: "app", ApplicationKey: `a;b"c'd`, AuthorityID: "tenant"},
+		},
+		{
+			desc:    "Application certificate",
+			connStr: ds + "Application Client Id=app;Application Certificate Path=/cert.pfx;Application Certificate Password=" + secret + ";Authority Id=tenant",
+			want: ConnectionStringBuilder{
+				DataSource: "https://mycluster.kusto.windows.net", ApplicationClientID: "app", AuthorityID: "tenant",
+				ApplicationCertificatePath: "/cert.pfx", ApplicationCertificatePassword: secret,
+			},
+		},
+		{
+			desc:    "Application certificate with aliases",
+			connStr: ds + "AppClientId=app;AppCertPath=/cert.pfx;AppCertPassword=" + secret + ";TenantId=tenant",
+			want: ConnectionStringBuilder{
+				DataSource: "https://mycluster.kusto.windows.net", ApplicationClientID: "app", AuthorityID: "tenant",
+				ApplicationCertificatePath: "/cert.pfx", ApplicationCertificatePassword: secret,
+			},
+		},
+		{
+			desc:    "Application and user for tracing",
+			connStr: ds + "Az Cli=true;Application Name for Tracing=MyApp:1.2;User Name for Tracing=jdoe",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", AzCli: true, ApplicationForTracing: "MyApp:1.2", UserForTracing: "jdoe"},
+		},
+		{
+			desc:    "Application and user for tracing with aliases",
+			connStr: ds + "Az Cli=true;TraceAppName=MyApp;TraceUserName=jdoe",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", AzCli: true, ApplicationForTracing: "MyApp", UserForTracing: "jdoe"},
+		},
+		{
+			desc:    "Interactive login",
+			connStr: ds + "Interactive Login=true;Authority Id=tenant",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", InteractiveLogin: true, AuthorityID: "tenant"},
+		},
+		{
+			desc:    "User prompt",
+			connStr: ds + "User Prompt=1",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", InteractiveLogin: true},
+		},
+		{
+			desc:    "System managed identity",
+			connStr: ds + "MSI Authentication=true",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", ManagedIdentity: true},
+		},
+		{
+			desc:    "User managed identity",
+			connStr: ds + "MSI Authentication=true;MSI Client Id=id",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", ManagedIdentity: true, ManagedIdentityClientID: "id"},
+		},
+		{
+			desc:    "User managed identity with alias",
+			connStr: ds + "MSI Auth=true;Managed Identity Client Id=id",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", ManagedIdentity: true, ManagedIdentityClientID: "id"},
+		},
+		{
+			desc:    "Azure CLI",
+			connStr: ds + "Az Cli=true",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", AzCli: true},
+		},
+		{
+			desc:    "Azure CLI with alias",
+			connStr: ds + "Azure CLI=true",
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", AzCli: true},
+		},
+		{
+			desc:    "User token",
+			connStr: ds + "User Token=" + secret,
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", Token: secret},
+		},
+		{
+			desc:    "User token with alias",
+			connStr: ds + "UsrToken=" + secret,
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", Token: secret},
+		},
+		{
+			desc:    "Application token",
+			connStr: ds + "Application Token=" + secret,
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", Token: secret},
+		},
+		{
+			desc:    "Application token with alias",
+			connStr: ds + "AppToken=" + secret,
+			want:    ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net", Token: secret},
+		},
+		{
+			desc:    "Empty",
+			connStr: "",
+			wantErr: "the Data Source is not set",
+		},
+		{
+			desc:    "No data source",
+			connStr: "User Token=" + secret,
+			wantErr: "the Data Source is not set",
+		},
+		{
+			desc:    "Unknown keyword",
+			connStr: ds + "Application Secret=" + secret,
+			wantErr: `unknown keyword "Application Secret"`,
+		},
+		{
+			desc:    "No equal sign",
+			connStr: ds + secret,
+			wantErr: "part 2 has no '='",
+		},
+		{
+			desc:    "No keyword",
+			connStr: ds + "=" + secret,
+			wantErr: "part 2 has no keyword",
+		},
+		{
+			desc:    "No closing quote",
+			connStr: ds + `Application Key="` + secret,
+			wantErr: `the value of "Application Key" has no closing quote`,
+		},
+		{
+			desc:    "Text after the closing quote",
+			connStr: ds + `Application Key="a"` + secret,
+			wantErr: `the value of "Application Key" has text after its closing quote`,
+		},
+		{
+			desc:    "Bad boolean",
+			connStr: ds + "MSI Authentication=" + secret,
+			wantErr: `the value of "MSI Authentication" must be true or false`,
+		},
+		{
+			desc:    "Federated security off",
+			connStr: ds + "Fed=false;User Token=" + secret,
+			wantErr: `"Fed" cannot be false`,
+		},
+		{
+			desc:    "No authentication",
+			connStr: ds + "Authority Id=tenant",
+			wantErr: "no authentication is set",
+		},
+		{
+			desc:    "Two authentications",
+			connStr: ds + "Application Client Id=app;Application Key=" + secret + ";Authority Id=tenant;Az Cli=true",
+			wantErr: "only one authentication can be set, but got an application key and the Azure CLI",
+		},
+		{
+			desc:    "Three authentications",
+			connStr: ds + "User Token=" + secret + ";MSI Auth=true;Interactive Login=true",
+			wantErr: "but got the interactive login and a managed identity and a token",
+		},
+		{
+			desc:    "Application key without a tenant",
+			connStr: ds + "Application Client Id=app;Application Key=" + secret,
+			wantErr: "an application key needs the Application Client Id and the Authority Id",
+		},
+		{
+			desc:    "Application certificate without an application",
+			connStr: ds + "Application Certificate Path=/cert.pfx;Authority Id=tenant",
+			wantErr: "an application certificate needs the Application Client Id and the Authority Id",
+		},
+		{
+			desc:    "Certificate password without a certificate",
+			connStr: ds + "Application Certificate Password=" + secret + ";Az Cli=true",
+			wantErr: "the Application Certificate Password is set without the Application Certificate Path",
+		},
+		{
+			desc:    "Managed identity client id without a managed identity",
+			connStr: ds + "MSI Client Id=id;Az Cli=true",
+			wantErr: "the MSI Client Id is set without MSI Authentication",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := NewConnectionStringBuilder(test.connStr)
+			if test.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr)
+				assert.NotContains(t, err.Error(), secret)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, *got)
+		})
+	}
+}
+
+func TestConnectionStringBuilderWith(t *testing.T) {
+	t.Parallel()
+
+	kcsb := &ConnectionStringBuilder{DataSource: "https://mycluster.kusto.windows.net"}
+
+	kcsb.WithAadAppKey("app", "key", "tenant")
+	assert.Equal(t, ConnectionStringBuilder{DataSource: kcsb.DataSource, ApplicationClientID: "app", ApplicationKey: "key", AuthorityID: "tenant"}, *kcsb)
+
+	// Each With method replaces the authentication set before.
+	kcsb.WithAppCertificate("app", "/cert.pfx", "password", "tenant")
+	assert.Equal(t, ConnectionStringBuilder{
+		DataSource: kcsb.DataSource, ApplicationClientID: "app", AuthorityID: "tenant",
+		ApplicationCertificatePath: "/cert.pfx", ApplicationCertificatePassword: "password",
+	}, *kcsb)
+	assert.Equal(t, ConnectionStringBuilder{DataSource: kcsb.DataSource, ApplicationClientID: "app", AuthorityID: "tenant", ManagedIdentity: true, ManagedIdentityClientID: "id"}, *kcsb.WithUserManagedIdentity("id"))
+	assert.Equal(t, ConnectionStringBuilder{DataSource: kcsb.DataSource, ApplicationClientID: "app", AuthorityID: "tenant", ManagedIdentity: true}, *kcsb.WithSystemManagedIdentity())
+	assert.Equal(t, ConnectionStringBuilder{DataSource: kcsb.DataSource, ApplicationClientID: "app", AuthorityID: "tenant", AzCli: true}, *kcsb.WithAzCli())
+	assert.Equal(t, ConnectionStringBuilder{DataSource: kcsb.DataSource, ApplicationClientID: "app", AuthorityID: "tenant", Token: "token"}, *kcsb.WithToken("token"))
+	assert.Equal(t, ConnectionStringBuilder{DataSource: kcsb.DataSource, ApplicationClientID: "app", AuthorityID: "other", InteractiveLogin: true}, *kcsb.WithInteractiveLogin("other"))
+}
+
+func TestConnectionStringBuilderAuthorization(t *testing.T) {
+	t.Parallel()
+
+	const endpoint = "https://mycluster.kusto.windows.net"
+
+	kcsb := &ConnectionStringBuilder{DataSource: endpoint}
+
+	a, err := kcsb.WithAadAppKey("app", "key", "tenant").Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, auth.NewClientCredentialsConfig("app", "key", "tenant"), a.Config)
+
+	a, err = kcsb.WithAppCertificate("app", "/cert.pfx", "password", "tenant").Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, auth.NewClientCertificateConfig("/cert.pfx", "password", "app", "tenant"), a.Config)
+
+	a, err = kcsb.WithInteractiveLogin("").Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, &DeviceCodeConfig{ClientID: "app"}, a.DeviceCode)
+
+	kcsb.ApplicationClientID = ""
+	a, err = kcsb.WithInteractiveLogin("tenant").Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, &DeviceCodeConfig{TenantID: "tenant"}, a.DeviceCode)
+
+	a, err = kcsb.WithUserManagedIdentity("id").Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, &ManagedIdentityConfig{ClientID: "id"}, a.ManagedIdentity)
+
+	kcsb.AuthorityID = "tenant"
+	a, err = kcsb.WithAzCli().Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, &AzCliConfig{TenantID: "tenant"}, a.AzCli)
+
+	a, err = kcsb.WithToken("token").Authorization()
+	require.NoError(t, err)
+	req, err := autorest.Prepare(&http.Request{Header: http.Header{}}, a.Authorizer.WithAuthorization())
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+
+	client, err := NewFromConnectionString(kcsb)
+	require.NoError(t, err)
+	assert.Equal(t, endpoint, client.Endpoint())
+
+	_, err = (&ConnectionStringBuilder{DataSource: endpoint, Token: "token", AzCli: true}).Authorization()
+	assert.Error(t, err)
+	_, err = NewFromConnectionString(&ConnectionStringBuilder{Token: "token"})
+	assert.Error(t, err)
+}
+
+func TestAuthorizationValidateCertificate(t *testing.T) {
+	t.Parallel()
+
+	a := Authorization{Config: auth.NewClientCertificateConfig("/does/not/exist.pfx", "", "app", "tenant")}
+	err := a.Validate("https://mycluster.kusto.windows.net")
+	// The certificate cannot be read, but the config was known and given the endpoint as its resource.
+	require.Error(t, err)
+	assert.False(t, strings.Contains(err.Error(), "not a type we know how to deal with"))
+	assert.Equal(t, "https://mycluster.kusto.windows.net", a.Config.(auth.ClientCertificateConfig).Resource)
+}
@@ -16,8 +16,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Separator is the string used to separate nested errors. By
@@ -45,16 +48,32 @@ type Kind uint16
 
 //go:generate stringer -type Kind
 const (
-	KOther           Kind = 0 // Other indicates the error kind was not defined.
-	KIO              Kind = 1 // External I/O error such as network failure.
-	KInternal        Kind = 2 // Internal error or inconsistency at the server.
-	KDBNotExist      Kind = 3 // Database does not exist.
-	KTimeout         Kind = 4 // The request timed out.
-	KLimitsExceeded  Kind = 5 // The request was too large.
-	KClientArgs      Kind = 6 // The client supplied some type of arg(s) that were invalid.
-	KHTTPError       Kind = 7 // The HTTP client gave some type of error. This wraps the http library error types.
-	KBlobstore       Kind = 8 // The Blobstore API returned some type of error.
-	KLocalFileSystem Kind = 9 // The local fileystem had an error. This could be permission, missing file, etc....
+	KOther           Kind = 0  // Other indicates the error kind was not defined.
+	KIO              Kind = 1  // External I/O error such as network failure.
+	KInternal        Kind = 2  // Internal error or inconsistency at the server.
+	KDBNotExist      Kind = 3  // Database does not exist.
+	KTimeout         Kind = 4  // The request timed out.
+	KLimitsExceeded  Kind = 5  // The request was too large.
+	KClientArgs      Kind = 6  // The client supplied some type of arg(s) that were invalid.
+	KHTTPError       Kind = 7  // The HTTP client gave some type of error. This wraps the http library error types.
+	KBlobstore       Kind = 8  // The Blobstore API returned some type of error.
+	KLocalFileSystem Kind = 9  // The local fileystem had an error. This could be permission, missing file, etc....
+	KTableNotExist   Kind = 10 // Table does not exist.
+	KMappingNotExist Kind = 11 // Ingestion mapping does not exist or is of the wrong kind.
+	KPayloadTooLarge Kind = 12 // The payload is larger than the service accepts, such as the streaming ingestion limit.
+	KMappingInvalid  Kind = 13 // The ingestion mapping is missing or of a kind that does not match the data format.
+	// KStreamingPolicyDisabled means streaming ingestion is not enabled on the table, database or cluster.
+	KStreamingPolicyDisabled Kind = 14
+	// KOptionInvalid means an option was passed to a client or an ingestion source that it does not apply to.
+	KOptionInvalid Kind = 15
+	// KAuth means the client could not get a token to sign in with, such as from the managed identity endpoint.
+	KAuth Kind = 16
+	// KDataFormat means the data of an ingestion does not match its format, such as a CSV record with the wrong
+	// number of fields, or has no records.
+	KDataFormat Kind = 17
+	// KUpdatePolicy means the data of an ingestion was ingested into its table, but an update policy of the table
+	// failed to ingest it into another one.
+	KUpdatePolicy Kind = 18
 )
 
 // Error is a core error for the Kusto package.
@@ -70,6 +89,18 @@ type Error struct {
 	restErrMsg []byte
 	decoded    map[string]interface{}
 	permanent  bool
+	// transient is set by SetTransient().
+	transient bool
+	// service is the OneApiError of a result that failed in-band, see OneToErr().
+	service *ServiceError
+	// statusCode is the HTTP status code of the response the error was made from, if any.
+	statusCode int
+	retryAfter time.Duration
+
+	activityId      string
+	clientRequestId string
+	elapsed         time.Duration
+	attempts        int
 
 	inner *Error
 }
@@ -103,12 +134,201 @@ func (e *Error) UnmarshalREST() map[string]interface{} {
 	return m
 }
 
+// ServiceError is the OneApiError that the service returned in the body of a failed response.
+type ServiceError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Code is the code of the error, such as "BadRequest_StreamingIngestionPolicyNotEnabled".
+	Code string
+	// Message is the general description of the error.
+	Message string
+	// Type is the type of the exception the service raised.
+	Type string
+	// Detail is the message of the exception, which tells what exactly went wrong, such as which mapping is wrong.
+	Detail string
+	// Permanent is if the request would fail the same way if sent again.
+	Permanent bool
+	// Context is the "@context" of the error, such as the activity id, the service and the machine the error
+	// happened on, which support asks for.
+	Context map[string]interface{}
+	// Inner is the "innererror" of the error, which is often more specific, such as the SEM0100 code of a
+	// semantic error. It is nil if there is none.
+	Inner *ServiceError
+}
+
+// oneAPIError is the JSON of a OneApiError, the "error" of the body of a failed response and of each of the
+// OneApiErrors of a result.
+type oneAPIError struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Type      string                 `json:"@type"`
+	Detail    string                 `json:"@message"`
+	Context   map[string]interface{} `json:"@context"`
+	Permanent bool                   `json:"@permanent"`
+	Inner     *oneAPIError           `json:"innererror"`
+}
+
+// serviceError returns o as a ServiceError of a response with statusCode, or nil if o has no code or message.
+func (o *oneAPIError) serviceError(statusCode int) *ServiceError {
+	if o == nil || (o.Code == "" && o.Message == "") {
+		return nil
+	}
+	return &ServiceError{
+		StatusCode: statusCode,
+		Code:       o.Code,
+		Message:    o.Message,
+		Type:       o.Type,
+		Detail:     o.Detail,
+		Permanent:  o.Permanent,
+		Context:    o.Context,
+		Inner:      o.Inner.serviceError(statusCode),
+	}
+}
+
+// DecodeServiceError decodes body, the body of a response with statusCode that failed, such as that of a query,
+// a management command or a streaming ingestion, into the OneApiError it holds. It returns false if body is not a
+// OneApiError, such as the HTML page of a gateway.
+func DecodeServiceError(body []byte, statusCode int) (ServiceError, bool) {
+	var msg struct {
+		Error *oneAPIError `json:"error"`
+	}
+	if len(body) == 0 || json.Unmarshal(body, &msg) != nil {
+		return ServiceError{}, false
+	}
+	se := msg.Error.serviceError(statusCode)
+	if se == nil {
+		return ServiceError{}, false
+	}
+	return *se, true
+}
+
+// Is reports if the code or the type of the error, or of its inner errors, contains code, such as "EntityNotFound"
+// for both "BadRequest_EntityNotFound" and "Kusto.Data.Exceptions.EntityNotFoundException".
+func (s ServiceError) Is(code string) bool {
+	for se := &s; se != nil; se = se.Inner {
+		if strings.Contains(se.Code, code) || strings.Contains(se.Type, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceError returns the error that the service returned in the body of the failed response, if the body was
+// a OneApiError, or in the OneApiErrors of a result that failed in-band. Errors wrapping another one return the
+// service error of the inner error if they have none. Bodies that are not JSON are only in the message of the error.
+func (e *Error) ServiceError() (ServiceError, bool) {
+	for err := e; err != nil; err = err.inner {
+		if se, ok := err.serviceError(); ok {
+			return se, true
+		}
+	}
+	return ServiceError{}, false
+}
+
+func (e *Error) serviceError() (ServiceError, bool) {
+	if e.service != nil {
+		return *e.service, true
+	}
+	return DecodeServiceError(e.restErrMsg, e.statusCode)
+}
+
+// AsServiceError returns the ServiceError of the first *Error in the chain of err, see Error.ServiceError().
+func AsServiceError(err error) (ServiceError, bool) {
+	var e *Error
+	if !errors.As(err, &e) {
+		return ServiceError{}, false
+	}
+	return e.ServiceError()
+}
+
+// Code returns the code of the error that the service returned, such as "BadRequest_EntityNotFound", or "" if err
+// does not hold one.
+func Code(err error) string {
+	se, _ := AsServiceError(err)
+	return se.Code
+}
+
+// StatusCode returns the HTTP status code of the response that the error was made from, or 0 if the error
+// does not come from an HTTP response, such as a network failure.
+func (e *Error) StatusCode() int {
+	return e.statusCode
+}
+
+// RetryAfter returns how long the service asked to wait before retrying with a Retry-After header, or 0.
+func (e *Error) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// SetRetryAfter records how long the service asked to wait before retrying.
+func (e *Error) SetRetryAfter(d time.Duration) *Error {
+	e.retryAfter = d
+	return e
+}
+
+// ActivityId returns the x-ms-activity-id that the service returned with the failed response, which identifies the
+// request in the service logs. Errors wrapping another one return the id of the inner error if they have none.
+func (e *Error) ActivityId() string {
+	if e.activityId == "" && e.inner != nil {
+		return e.inner.ActivityId()
+	}
+	return e.activityId
+}
+
+// ClientRequestId returns the client request id that the failed request was sent with.
+// Errors wrapping another one return the id of the inner error if they have none.
+func (e *Error) ClientRequestId() string {
+	if e.clientRequestId == "" && e.inner != nil {
+		return e.inner.ClientRequestId()
+	}
+	return e.clientRequestId
+}
+
+// Elapsed returns how long the failed request took, or 0 if the error does not come from a request.
+// Errors wrapping another one return the duration of the inner error if they have none.
+func (e *Error) Elapsed() time.Duration {
+	if e.elapsed == 0 && e.inner != nil {
+		return e.inner.Elapsed()
+	}
+	return e.elapsed
+}
+
+// SetRequestInfo records the ids and duration of the request that failed with this error.
+func (e *Error) SetRequestInfo(activityId, clientRequestId string, elapsed time.Duration) *Error {
+	e.activityId = activityId
+	e.clientRequestId = clientRequestId
+	e.elapsed = elapsed
+	return e
+}
+
+// Attempts returns how many times the request that failed with this error was sent, or 0 if the error does not
+// come from a request that the client retries. Errors wrapping another one return the count of the inner error
+// if they have none.
+func (e *Error) Attempts() int {
+	if e.attempts == 0 && e.inner != nil {
+		return e.inner.Attempts()
+	}
+	return e.attempts
+}
+
+// SetAttempts records how many times the request that failed with this error was sent.
+func (e *Error) SetAttempts(n int) *Error {
+	e.attempts = n
+	return e
+}
+
 // SetNoRetry sets this error so that Retry() will always return false.
 func (e *Error) SetNoRetry() *Error {
 	e.permanent = true
 	return e
 }
 
+// SetTransient sets this error so that Retryable() returns true whatever its Kind, unless an error in its chain is
+// permanent, such as when the service reported that the operation failed transiently.
+func (e *Error) SetTransient() *Error {
+	e.transient = true
+	return e
+}
+
 func (e *Error) isZero() bool {
 	return e == nil || (e.Op == OpUnknown && e.Kind == KOther && e.Err == nil)
 }
@@ -126,6 +346,41 @@ func (e *Error) Unwrap() error {
 	return e.inner
 }
 
+// Is reports if the error that e was made with is target, for errors.Is(). Unwrap() goes to the inner error when
+// there is one, so this is what finds the cause of an error made with E() that also wraps an inner error.
+func (e *Error) Is(target error) bool {
+	return e != nil && e.inner != nil && e.Err != nil && errors.Is(e.Err, target)
+}
+
+// As finds the first error that e was made with that matches target, for errors.As(), see Is().
+func (e *Error) As(target interface{}) bool {
+	return e != nil && e.inner != nil && e.Err != nil && errors.As(e.Err, target)
+}
+
+// KindOf returns the first Kind other than KOther of the *Error values in the chain of err, or KOther if there is
+// none, such as for errors that do not come from this package.
+func KindOf(err error) Kind {
+	for err != nil {
+		if e, ok := err.(*Error); ok && e.Kind != KOther {
+			return e.Kind
+		}
+		err = errors.Unwrap(err)
+	}
+	return KOther
+}
+
+// OpOf returns the first Op other than OpUnknown of the *Error values in the chain of err, or OpUnknown if there is
+// none.
+func OpOf(err error) Op {
+	for err != nil {
+		if e, ok := err.(*Error); ok && e.Op != OpUnknown {
+			return e.Op
+		}
+		err = errors.Unwrap(err)
+	}
+	return OpUnknown
+}
+
 // pad appends str to the buffer if the buffer already has some data.
 func pad(b *strings.Builder, str string) {
 	if b.Len() == 0 {
@@ -154,8 +409,10 @@ func (e *Error) Error() string {
 		if inner == nil {
 			break
 		}
-		pad(b, Separator)
-		b.WriteString(inner.Err.Error())
+		if inner.Err != nil {
+			pad(b, Separator)
+			b.WriteString(inner.Err.Error())
+		}
 		inner = inner.inner
 	}
 
@@ -165,37 +422,102 @@ func (e *Error) Error() string {
 	return b.String()
 }
 
-// Retry determines if the error is transient and the action can be retried or not.
-// Some errors that can be retried, such as a timeout, may never succeed, so avoid infinite retries.
+// Retry determines if the error is transient and the action can be retried or not. It is the same as Retryable(),
+// which it predates.
 func Retry(err error) bool {
+	return Retryable(err)
+}
+
+// Retryable reports if the operation that failed with err can succeed if it is done again, such as after a backoff.
+// Some errors that can be retried, such as a timeout, may never succeed, so avoid infinite retries. Whether the
+// operation can be done again without side effects, such as a command that the service may have run, is up to the
+// caller. The classification, checked in order, is:
+//
+//	Not an *Error                                      not retryable
+//	An *Error in the chain is permanent: SetNoRetry()  not retryable
+//	  was called, or the service sent "@permanent": true
+//	An *Error in the chain is transient:               retryable
+//	  SetTransient() was called
+//	The response had an HTTP status, from the first    408, 429, 500, 502, 503 and 504 are retryable,
+//	  *Error in the chain that has one or the response  every other status is not
+//	  of a storage error it wraps
+//	No status, by the Kind of every *Error in the      KHTTPError (no response, such as a network failure),
+//	  chain                                             KTimeout, KBlobstore and KAuth are retryable, every
+//	                                                   other Kind is not
+//
+// The errors of queries and commands, of streaming ingestion, of the storage operations of queued ingestion and of the
+// fetching of the ingestion resources are all classified this way.
+func Retryable(err error) bool {
 	var e *Error
-	if errors.As(err, &e) {
-		// e.permanent can be set multiple ways. If it is true, you can never retry.
-		// If it is false, it does not necessarily mean anything, you have to go a little further.
-		if e.permanent {
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	for cur := e; cur != nil; cur = cur.inner {
+		if len(cur.restErrMsg) > 0 {
+			cur.UnmarshalREST()
+		}
+		if cur.permanent {
 			return false
 		}
+	}
+	for cur := e; cur != nil; cur = cur.inner {
+		if cur.transient {
+			return true
+		}
+	}
+
+	if status := e.responseStatus(); status != 0 {
+		return retryableStatus(status)
+	}
 
-		switch e.Kind {
-		case KOther, KIO, KInternal, KDBNotExist, KLimitsExceeded, KClientArgs, KLocalFileSystem:
+	for cur := e; cur != nil; cur = cur.inner {
+		switch cur.Kind {
+		case KHTTPError, KTimeout, KBlobstore, KAuth:
+		default:
 			return false
-		case KHTTPError:
-			m := e.UnmarshalREST()
-			if m != nil {
-				if e.permanent {
-					return false
-				}
-			}
 		}
+	}
+	return true
+}
 
-		if e.inner != nil {
-			return Retry(e.inner)
-		}
+// Permanent reports if err is an error that doing the operation again cannot fix, which is any error that is not
+// Retryable().
+func Permanent(err error) bool {
+	return err != nil && !Retryable(err)
+}
+
+// retryableStatus reports if a request that got a response of status can succeed if sent again: the service was
+// throttling, unavailable or failed on its side, or the request timed out.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
 		return true
 	}
 	return false
 }
 
+// responseStatus returns the HTTP status of the response that e was made from: of the first error in its chain that
+// has one, or else of the response of a storage error that it wraps. It returns 0 if there was no response.
+func (e *Error) responseStatus() int {
+	for cur := e; cur != nil; cur = cur.inner {
+		if cur.statusCode != 0 {
+			return cur.statusCode
+		}
+	}
+	// The errors of the storage SDKs have the response they were made from.
+	for cur := e; cur != nil; cur = cur.inner {
+		var se interface{ Response() *http.Response }
+		if cur.Err != nil && errors.As(cur.Err, &se) {
+			if resp := se.Response(); resp != nil {
+				return resp.StatusCode
+			}
+		}
+	}
+	return 0
+}
+
 // E constructs an Error. You may pass in an Op, Kind and error.  This will strip a *errors.Error(the error in this package) if you
 // pass one of its Kind and Op and wrap it in here. It will wrap a non-*Error implementation of error.
 // If you want to wrap the *Error in an *Error, use W(). If you pass a nil error, it panics.
@@ -229,6 +551,9 @@ func HTTP(o Op, status string, body io.ReadCloser, prefix string) *Error {
 		restErrMsg: bodyBytes,
 		Err:        fmt.Errorf("%s(%s):\n%s", prefix, status, string(bodyBytes)),
 	}
+	if fields := strings.Fields(status); len(fields) > 0 {
+		e.statusCode, _ = strconv.Atoi(fields[0])
+	}
 	e.UnmarshalREST()
 	return e
 }
@@ -357,11 +682,26 @@ func oneToErr(m map[string]interface{}, err *Error, op Op) *Error {
 		msg = msg + ";See https://docs.microsoft.com/en-us/azure/kusto/concepts/querylimits"
 	}
 
+	e := ES(op, kind, msg)
+	e.service = decodeOneAPIError(errMap)
 	if err == nil {
-		return ES(op, kind, msg)
+		return e
 	}
 
-	W(ES(op, kind, msg), err)
+	W(e, err)
 
 	return err
 }
+
+// decodeOneAPIError returns the ServiceError of m, the "error" of a OneApiError of a result, or nil if it has none.
+func decodeOneAPIError(m map[string]interface{}) *ServiceError {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	var o oneAPIError
+	if err := json.Unmarshal(b, &o); err != nil {
+		return nil
+	}
+	return o.serviceError(0)
+}
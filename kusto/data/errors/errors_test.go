@@ -1,11 +1,16 @@
 package errors
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/kylelemons/godebug/pretty"
 )
@@ -128,6 +133,173 @@ func TestRetry(t *testing.T) {
 	}
 }
 
+// storageError is an error of the storage SDKs, which have the response they were made from.
+type storageError struct {
+	status int
+}
+
+func (e storageError) Error() string {
+	return fmt.Sprintf("storage error %d", e.status)
+}
+
+func (e storageError) Response() *http.Response {
+	return &http.Response{StatusCode: e.status}
+}
+
+func TestIsAs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		err  error
+		// is is the error that errors.Is() finds, and storage is the storage error that errors.As() finds, if any.
+		is       error
+		storage  *storageError
+		wantKind Kind
+		wantOp   Op
+	}{
+		{
+			desc:     "Context error wrapped twice",
+			err:      fmt.Errorf("query failed: %w", W(E(OpQuery, KTimeout, fmt.Errorf("waiting for the response: %w", context.DeadlineExceeded)), ES(OpQuery, KOther, "attempt 2 failed"))),
+			is:       context.DeadlineExceeded,
+			wantKind: KTimeout,
+			wantOp:   OpQuery,
+		},
+		{
+			// The cause of the outer error is found even though Unwrap() goes to the inner one.
+			desc:     "Context error of an error wrapping another",
+			err:      W(ES(OpQuery, KOther, "attempt 1 failed"), E(OpQuery, KTimeout, fmt.Errorf("stopped: %w", context.Canceled))),
+			is:       context.Canceled,
+			wantKind: KTimeout,
+			wantOp:   OpQuery,
+		},
+		{
+			desc:     "Storage error wrapped twice",
+			err:      fmt.Errorf("ingest failed: %w", E(OpFileIngest, KBlobstore, fmt.Errorf("problem uploading to Blob Storage: %w", storageError{status: 403}))),
+			storage:  &storageError{status: 403},
+			wantKind: KBlobstore,
+			wantOp:   OpFileIngest,
+		},
+		{
+			desc:     "Storage error under an inner error",
+			err:      W(E(OpFileIngest, KBlobstore, storageError{status: 503}), ES(OpUnknown, KOther, "chunk 3 failed")),
+			storage:  &storageError{status: 503},
+			wantKind: KBlobstore,
+			wantOp:   OpFileIngest,
+		},
+		{
+			desc:     "Not an *Error",
+			err:      fmt.Errorf("failed: %w", io.EOF),
+			is:       io.EOF,
+			wantKind: KOther,
+			wantOp:   OpUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			if test.is != nil && !errors.Is(test.err, test.is) {
+				t.Errorf("errors.Is(%v): got false, want true", test.is)
+			}
+			if errors.Is(test.err, io.ErrUnexpectedEOF) {
+				t.Errorf("errors.Is(io.ErrUnexpectedEOF): got true, want false")
+			}
+			var se storageError
+			if got := errors.As(test.err, &se); got != (test.storage != nil) {
+				t.Errorf("errors.As(storageError): got %v, want %v", got, test.storage != nil)
+			} else if got && se != *test.storage {
+				t.Errorf("errors.As(storageError): got %+v, want %+v", se, *test.storage)
+			}
+			if got := KindOf(test.err); got != test.wantKind {
+				t.Errorf("KindOf(): got %s, want %s", got, test.wantKind)
+			}
+			if got := OpOf(test.err); got != test.wantOp {
+				t.Errorf("OpOf(): got %s, want %s", got, test.wantOp)
+			}
+			// The message holds the whole chain.
+			if test.is != nil && !strings.Contains(test.err.Error(), test.is.Error()) {
+				t.Errorf("Error(): got %q, want it to hold %q", test.err.Error(), test.is.Error())
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	t.Parallel()
+
+	httpErr := func(status, body string) *Error {
+		return HTTP(OpQuery, status, ioutil.NopCloser(strings.NewReader(body)), "")
+	}
+
+	tests := []struct {
+		desc string
+		err  error
+		want bool
+	}{
+		{desc: "nil", err: nil, want: false},
+		{desc: "Not an *Error", err: context.DeadlineExceeded, want: false},
+		{desc: "Throttled", err: httpErr("429 Too Many Requests", ""), want: true},
+		{desc: "Request timeout", err: httpErr("408 Request Timeout", ""), want: true},
+		{desc: "Internal server error", err: httpErr("500 Internal Server Error", `{"error": {"code": "Internal"}}`), want: true},
+		{desc: "Permanent internal server error", err: httpErr("500 Internal Server Error", `{"error": {"@permanent": true}}`), want: false},
+		{desc: "Bad gateway", err: httpErr("502 Bad Gateway", "<html></html>"), want: true},
+		{desc: "Unavailable", err: httpErr("503 Service Unavailable", ""), want: true},
+		{desc: "Gateway timeout", err: httpErr("504 Gateway Timeout", ""), want: true},
+		{desc: "Not implemented", err: httpErr("501 Not Implemented", ""), want: false},
+		{desc: "Bad request", err: httpErr("400 Bad Request", `{"error": {"code": "BadRequest"`), want: false},
+		{desc: "Forbidden", err: httpErr("403 Forbidden", ""), want: false},
+		{desc: "Permanent throttled", err: httpErr("429 Too Many Requests", "").SetNoRetry(), want: false},
+		{desc: "Network failure", err: ES(OpIngestStream, KHTTPError, "connection refused"), want: true},
+		{desc: "Timeout", err: ES(OpQuery, KTimeout, "deadline exceeded"), want: true},
+		{desc: "Auth", err: ES(OpServConn, KAuth, "could not get a token"), want: true},
+		{desc: "Auth set as permanent", err: ES(OpServConn, KAuth, "not logged in").SetNoRetry(), want: false},
+		{desc: "Client args", err: ES(OpFileIngest, KClientArgs, "bad option"), want: false},
+		{desc: "Transient", err: ES(OpFileIngest, KInternal, "ingestion failed").SetTransient(), want: true},
+		{desc: "Transient and permanent", err: ES(OpFileIngest, KInternal, "ingestion failed").SetTransient().SetNoRetry(), want: false},
+		{desc: "Transient with a status", err: httpErr("400 Bad Request", "").SetTransient(), want: true},
+		{desc: "Payload too large", err: ES(OpIngestStream, KPayloadTooLarge, "too large"), want: false},
+		{desc: "Local file", err: E(OpFileIngest, KLocalFileSystem, io.ErrUnexpectedEOF), want: false},
+		{desc: "Storage without a response", err: E(OpFileIngest, KBlobstore, io.ErrUnexpectedEOF), want: true},
+		{desc: "Storage unavailable", err: E(OpFileIngest, KBlobstore, storageError{status: 503}), want: true},
+		{desc: "Storage forbidden", err: E(OpFileIngest, KBlobstore, fmt.Errorf("upload: %w", storageError{status: 403})), want: false},
+		{
+			desc: "Wrapped with fmt",
+			err:  fmt.Errorf("problem getting ingestion resources from Kusto: %w", httpErr("503 Service Unavailable", "")),
+			want: true,
+		},
+		{
+			desc: "Status of the inner error",
+			err:  W(httpErr("401 Unauthorized", ""), ES(OpMgmt, KHTTPError, "could not fetch")),
+			want: false,
+		},
+		{
+			desc: "Inner error is permanent",
+			err:  W(ES(OpIngestStream, KHTTPError, "refused").SetNoRetry(), ES(OpIngestStream, KTimeout, "gave up")),
+			want: false,
+		},
+		{
+			desc: "Inner error of a Kind that is not retryable",
+			err:  W(ES(OpQuery, KInternal, "bug"), ES(OpQuery, KTimeout, "gave up")),
+			want: false,
+		},
+	}
+
+	for _, test := range tests {
+		if got := Retryable(test.err); got != test.want {
+			t.Errorf("TestRetryable(%s): got %t, want %t", test.desc, got, test.want)
+		}
+		if got := Retry(test.err); got != test.want {
+			t.Errorf("TestRetryable(%s): Retry(): got %t, want %t", test.desc, got, test.want)
+		}
+		if got := Permanent(test.err); got != (test.err != nil && !test.want) {
+			t.Errorf("TestRetryable(%s): Permanent(): got %t, want %t", test.desc, got, test.err != nil && !test.want)
+		}
+	}
+}
+
 func TestOneToErr(t *testing.T) {
 	tests := []struct {
 		desc  string
@@ -177,12 +349,14 @@ func TestOneToErr(t *testing.T) {
 				},
 			},
 			want: &Error{
-				Op:  OpQuery,
-				Err: errors.New("Top level error"),
+				Op:      OpQuery,
+				Err:     errors.New("Top level error"),
+				service: &ServiceError{Code: "notAValidCode", Message: "Top level error"},
 				inner: &Error{
-					Op:   OpQuery,
-					Kind: KLimitsExceeded,
-					Err:  errors.New("Request was too large;See https://docs.microsoft.com/en-us/azure/kusto/concepts/querylimits"),
+					Op:      OpQuery,
+					Kind:    KLimitsExceeded,
+					Err:     errors.New("Request was too large;See https://docs.microsoft.com/en-us/azure/kusto/concepts/querylimits"),
+					service: &ServiceError{Code: "LimitsExceeded", Message: "Request was too large"},
 				},
 			},
 		},
@@ -197,3 +371,215 @@ func TestOneToErr(t *testing.T) {
 		}
 	}
 }
+
+func TestHTTPStatusCode(t *testing.T) {
+	tests := []struct {
+		status string
+		want   int
+	}{
+		{"429 Too Many Requests", 429},
+		{"503 Service Unavailable", 503},
+		{"", 0},
+		{"bad status", 0},
+	}
+
+	for _, test := range tests {
+		got := HTTP(OpIngestStream, test.status, ioutil.NopCloser(strings.NewReader("")), "")
+		if got.StatusCode() != test.want {
+			t.Errorf("TestHTTPStatusCode(%q): got %d, want %d", test.status, got.StatusCode(), test.want)
+		}
+	}
+
+	if got := E(OpIngestStream, KHTTPError, io.EOF).SetRetryAfter(time.Second).RetryAfter(); got != time.Second {
+		t.Errorf("TestHTTPStatusCode: got RetryAfter() == %s, want %s", got, time.Second)
+	}
+}
+
+func TestRequestInfo(t *testing.T) {
+	inner := HTTP(OpIngestStream, "500 Internal Server Error", ioutil.NopCloser(strings.NewReader("")), "").SetRequestInfo("activity", "request", time.Second).SetAttempts(3)
+	outer := W(inner, ES(OpIngestStream, KOther, "chunk 1 failed"))
+
+	for _, e := range []*Error{inner, outer} {
+		if got := e.ActivityId(); got != "activity" {
+			t.Errorf("TestRequestInfo(%s): got ActivityId() == %q, want %q", e, got, "activity")
+		}
+		if got := e.ClientRequestId(); got != "request" {
+			t.Errorf("TestRequestInfo(%s): got ClientRequestId() == %q, want %q", e, got, "request")
+		}
+		if got := e.Elapsed(); got != time.Second {
+			t.Errorf("TestRequestInfo(%s): got Elapsed() == %s, want %s", e, got, time.Second)
+		}
+		if got := e.Attempts(); got != 3 {
+			t.Errorf("TestRequestInfo(%s): got Attempts() == %d, want 3", e, got)
+		}
+	}
+
+	if got := ES(OpIngestStream, KClientArgs, "bad").ActivityId(); got != "" {
+		t.Errorf("TestRequestInfo: got ActivityId() == %q for an error without a request, want \"\"", got)
+	}
+}
+
+func TestServiceError(t *testing.T) {
+	tests := []struct {
+		desc string
+		body string
+		want ServiceError
+		ok   bool
+	}{
+		{
+			desc: "OneApiError",
+			body: `{"error":{"code":"BadRequest_EntityNotFound","message":"Request is invalid and cannot be executed.","@type":"Kusto.Data.Exceptions.EntityNotFoundException","@message":"Entity ID 'table' of kind 'Table' was not found.","@permanent":true}}`,
+			want: ServiceError{
+				StatusCode: 400,
+				Code:       "BadRequest_EntityNotFound",
+				Message:    "Request is invalid and cannot be executed.",
+				Type:       "Kusto.Data.Exceptions.EntityNotFoundException",
+				Detail:     "Entity ID 'table' of kind 'Table' was not found.",
+				Permanent:  true,
+			},
+			ok: true,
+		},
+		{desc: "Not JSON", body: "Bad Request"},
+		{desc: "JSON without an error", body: `{"Tables":[]}`},
+		{desc: "Empty error", body: `{"error":{}}`},
+	}
+
+	for _, test := range tests {
+		inner := HTTP(OpIngestStream, "400 Bad Request", ioutil.NopCloser(strings.NewReader(test.body)), "")
+		outer := W(inner, ES(OpIngestStream, KOther, "chunk 1 failed"))
+
+		for _, e := range []*Error{inner, outer} {
+			got, ok := e.ServiceError()
+			if ok != test.ok {
+				t.Errorf("TestServiceError(%s): got ok == %v, want %v", test.desc, ok, test.ok)
+				continue
+			}
+			if diff := pretty.Compare(test.want, got); diff != "" {
+				t.Errorf("TestServiceError(%s): -want/+got:\n%s", test.desc, diff)
+			}
+		}
+	}
+}
+
+func TestDecodeServiceError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		fixture string
+		status  int
+		want    ServiceError
+		// wantInner is the code of the inner error, if there is one.
+		wantInner string
+		// is is a code that ServiceError.Is() reports.
+		is string
+	}{
+		{
+			desc:    "Entity not found",
+			fixture: "entity_not_found.json",
+			status:  http.StatusBadRequest,
+			want: ServiceError{
+				StatusCode: http.StatusBadRequest,
+				Code:       "BadRequest_EntityNotFound",
+				Message:    "Request is invalid and cannot be executed.",
+				Type:       "Kusto.Data.Exceptions.EntityNotFoundException",
+				Detail:     "Entity ID 'Missing' of kind 'Table' was not found.",
+				Permanent:  true,
+			},
+			is: "EntityNotFound",
+		},
+		{
+			desc:    "Throttled",
+			fixture: "throttled.json",
+			status:  http.StatusTooManyRequests,
+			want: ServiceError{
+				StatusCode: http.StatusTooManyRequests,
+				Code:       "TooManyRequests",
+				Message:    "Request is throttled.",
+				Type:       "Kusto.DataNode.Exceptions.ControlCommandThrottledException",
+				Detail:     "The control command was aborted due to throttling. Retrying after some backoff might succeed. CommandType: 'TableSetOrAppend', Capacity: 4, Origin: 'CapacityPolicy/Ingestion'.",
+			},
+			is: "Throttled",
+		},
+		{
+			desc:    "Semantic error",
+			fixture: "semantic_error.json",
+			status:  http.StatusBadRequest,
+			want: ServiceError{
+				StatusCode: http.StatusBadRequest,
+				Code:       "General_BadRequest",
+				Message:    "Request is invalid and cannot be executed.",
+				Type:       "Kusto.Data.Exceptions.SyntaxException",
+				Detail:     "Syntax error: Query could not be parsed: SYN0002: A recognition error occurred in the query..",
+				Permanent:  true,
+			},
+			wantInner: "SYN0002",
+			is:        "SYN0002",
+		},
+		{
+			desc:    "Streaming policy disabled",
+			fixture: "streaming_policy_disabled.json",
+			status:  http.StatusBadRequest,
+			want: ServiceError{
+				StatusCode: http.StatusBadRequest,
+				Code:       "BadRequest_StreamingIngestionPolicyNotEnabled",
+				Message:    "Request is invalid and cannot be executed.",
+				Type:       "Kusto.DataNode.Exceptions.StreamingIngestionRequestException",
+				Detail:     "Bad streaming ingestion request to database.table : Streaming ingestion policy is not enabled for the table",
+				Permanent:  true,
+			},
+			is: "StreamingIngestionPolicyNotEnabled",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			body, err := ioutil.ReadFile("testdata/" + test.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, ok := DecodeServiceError(body, test.status)
+			if !ok {
+				t.Fatalf("DecodeServiceError(): got ok == false, want true")
+			}
+			if got.Context["activityId"] == nil || got.Context["machineName"] == nil {
+				t.Errorf("DecodeServiceError(): got Context %v, want the activityId and machineName", got.Context)
+			}
+			if got.Inner != nil || test.wantInner != "" {
+				if got.Inner == nil || got.Inner.Code != test.wantInner {
+					t.Errorf("DecodeServiceError(): got Inner %+v, want the code %q", got.Inner, test.wantInner)
+				}
+			}
+			if !got.Is(test.is) {
+				t.Errorf("ServiceError.Is(%q): got false, want true", test.is)
+			}
+			got.Context, got.Inner = nil, nil
+			if diff := pretty.Compare(test.want, got); diff != "" {
+				t.Errorf("DecodeServiceError(): -want/+got:\n%s", diff)
+			}
+
+			// The error made from the response holds the same, even wrapped.
+			e := HTTP(OpQuery, fmt.Sprintf("%d %s", test.status, http.StatusText(test.status)), ioutil.NopCloser(strings.NewReader(string(body))), "")
+			err = fmt.Errorf("query failed: %w", W(e, ES(OpQuery, KOther, "attempt 1 failed")))
+			if got := Code(err); got != test.want.Code {
+				t.Errorf("Code(): got %q, want %q", got, test.want.Code)
+			}
+			se, ok := AsServiceError(err)
+			if !ok || se.Permanent != test.want.Permanent {
+				t.Errorf("AsServiceError(): got %+v, %v, want Permanent == %v", se, ok, test.want.Permanent)
+			}
+		})
+	}
+
+	// Errors that the service did not return have no code.
+	if got := Code(ES(OpQuery, KClientArgs, "bad argument")); got != "" {
+		t.Errorf("Code(): got %q, want \"\"", got)
+	}
+	if got := Code(errors.New("not an *Error")); got != "" {
+		t.Errorf("Code(): got %q, want \"\"", got)
+	}
+}
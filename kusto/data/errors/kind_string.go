@@ -18,11 +18,20 @@ func _() {
 	_ = x[KHTTPError-7]
 	_ = x[KBlobstore-8]
 	_ = x[KLocalFileSystem-9]
+	_ = x[KTableNotExist-10]
+	_ = x[KMappingNotExist-11]
+	_ = x[KPayloadTooLarge-12]
+	_ = x[KMappingInvalid-13]
+	_ = x[KStreamingPolicyDisabled-14]
+	_ = x[KOptionInvalid-15]
+	_ = x[KAuth-16]
+	_ = x[KDataFormat-17]
+	_ = x[KUpdatePolicy-18]
 }
 
-const _Kind_name = "KOtherKIOKInternalKDBNotExistKTimeoutKLimitsExceededKClientArgsKHTTPErrorKBlobstoreKLocalFileSystem"
+const _Kind_name = "KOtherKIOKInternalKDBNotExistKTimeoutKLimitsExceededKClientArgsKHTTPErrorKBlobstoreKLocalFileSystemKTableNotExistKMappingNotExistKPayloadTooLargeKMappingInvalidKStreamingPolicyDisabledKOptionInvalidKAuthKDataFormatKUpdatePolicy"
 
-var _Kind_index = [...]uint8{0, 6, 9, 18, 29, 37, 52, 63, 73, 83, 99}
+var _Kind_index = [...]uint8{0, 6, 9, 18, 29, 37, 52, 63, 73, 83, 99, 113, 129, 145, 160, 184, 198, 203, 214, 227}
 
 func (i Kind) String() string {
 	if i >= Kind(len(_Kind_index)-1) {
@@ -7,60 +7,168 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto/data/value"
 )
 
 // decodeToStruct takes a list of columns and a row to decode into "p" which will be a pointer
 // to a struct (enforce in the decoder).
-func decodeToStruct(cols Columns, row value.Values, p interface{}) error {
+func decodeToStruct(cols Columns, row value.Values, p interface{}, opts toStructOptions) error {
 	t := reflect.TypeOf(p)
 	v := reflect.ValueOf(p)
 	fields := newFields(cols, t)
 
 	for i, col := range cols {
-		if err := fields.convert(col, row[i], t, v); err != nil {
+		if err := fields.convert(col, row[i], t, v, opts); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+var (
+	kustoType = reflect.TypeOf((*value.Kusto)(nil)).Elem()
+	timeType  = reflect.TypeOf(time.Time{})
+)
+
+// field is a field of a struct that a column decodes into.
+type field struct {
+	// name is the name of the field, with the names of the embedded structs it is in, such as "Base.ID".
+	name string
+	// index is the index of the field for reflect.Value.FieldByIndex().
+	index []int
+}
+
 // fields represents the fields inside a struct.
 type fields struct {
-	colNameToFieldName map[string]string
+	colNameToField map[string]field
+	// lowerColNameToField holds the fields by their lower case column name, to match columns ignoring case.
+	lowerColNameToField map[string]field
 }
 
 // newFields takes in the Columns from our row and the reflect.Type of our *struct.
 func newFields(cols Columns, ptr reflect.Type) fields {
-	nFields := fields{colNameToFieldName: map[string]string{}}
-	for i := 0; i < ptr.Elem().NumField(); i++ {
-		field := ptr.Elem().Field(i)
-		if tag := field.Tag.Get("kusto"); strings.TrimSpace(tag) != "" {
-			nFields.colNameToFieldName[tag] = field.Name
-		} else {
-			nFields.colNameToFieldName[field.Name] = field.Name
-		}
+	nFields := fields{colNameToField: map[string]field{}, lowerColNameToField: map[string]field{}}
+
+	// The fields of embedded structs are added after the fields of the struct they are in, so that a field wins
+	// over a field of the same name that is deeper in embedded structs, the way Go selects fields.
+	type embedded struct {
+		t      reflect.Type
+		index  []int
+		prefix string
 	}
+	queue := []embedded{{t: ptr.Elem()}}
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+
+		for i := 0; i < e.t.NumField(); i++ {
+			sf := e.t.Field(i)
+			index := append(append([]int{}, e.index...), i)
+
+			tag := strings.TrimSpace(sf.Tag.Get("kusto"))
+			if tag == "-" {
+				continue
+			}
+			if sf.Anonymous && tag == "" && isEmbeddedStruct(sf) {
+				t := sf.Type
+				if t.Kind() == reflect.Ptr {
+					t = t.Elem()
+				}
+				queue = append(queue, embedded{t: t, index: index, prefix: e.prefix + sf.Name + "."})
+				continue
+			}
+			if sf.PkgPath != "" { // Unexported.
+				continue
+			}
 
+			colName := sf.Name
+			if tag != "" {
+				colName = tag
+			}
+			nFields.add(colName, field{name: e.prefix + sf.Name, index: index})
+		}
+	}
 	return nFields
 }
 
+// add adds fd as the field that the column colName decodes into, unless a field was added for it before.
+func (f fields) add(colName string, fd field) {
+	if _, ok := f.colNameToField[colName]; !ok {
+		f.colNameToField[colName] = fd
+	}
+	if _, ok := f.lowerColNameToField[strings.ToLower(colName)]; !ok {
+		f.lowerColNameToField[strings.ToLower(colName)] = fd
+	}
+}
+
+// isEmbeddedStruct reports if the embedded field sf is a struct whose fields columns decode into, instead of a field
+// that a column decodes into, such as an embedded value.DateTime.
+func isEmbeddedStruct(sf reflect.StructField) bool {
+	t := sf.Type
+	if t.Kind() == reflect.Ptr {
+		// A pointer to an unexported struct cannot be allocated.
+		if sf.PkgPath != "" {
+			return false
+		}
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return false
+	}
+	return !t.Implements(kustoType) && !reflect.PtrTo(t).Implements(kustoType)
+}
+
+// lookup returns the field that the column named colName decodes into. A field whose name or tag is colName wins
+// over one that only matches it ignoring case.
+func (f fields) lookup(colName string) (field, bool) {
+	if fd, ok := f.colNameToField[colName]; ok {
+		return fd, true
+	}
+	fd, ok := f.lowerColNameToField[strings.ToLower(colName)]
+	return fd, ok
+}
+
 // convert converts a KustoValue that is for Column col into "v" reflect.Value with reflect.Type "t".
-func (f fields) convert(col Column, k value.Kusto, t reflect.Type, v reflect.Value) error {
-	fieldName, ok := f.colNameToFieldName[col.Name]
+func (f fields) convert(col Column, k value.Kusto, t reflect.Type, v reflect.Value, opts toStructOptions) error {
+	fd, ok := f.lookup(col.Name)
 	if !ok {
 		return nil
 	}
 
-	if fieldName == "-" {
-		return nil
+	fv := fieldByIndex(v.Elem(), fd.index)
+	if opts.errorOnNull && !k.HasValue() && !canHoldNull(fv.Type()) {
+		return fmt.Errorf("column %s is null, which struct.%s of type %s cannot hold", col.Name, fd.name, fv.Type())
 	}
 
-	err := k.Convert(v.Elem().FieldByName(fieldName))
+	err := k.Convert(fv)
 	if err != nil {
-		return fmt.Errorf("column %s could not store in struct.%s: %s", col.Name, fieldName, err.Error())
+		return fmt.Errorf("column %s could not store in struct.%s: %s", col.Name, fd.name, err.Error())
 	}
 
 	return nil
 }
+
+// canHoldNull reports if a field of type t can hold a null value.
+func canHoldNull(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		return true
+	}
+	return t.Implements(kustoType)
+}
+
+// fieldByIndex returns the field of struct v at index, allocating the embedded struct pointers on the way.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
@@ -138,11 +138,21 @@ func (r *Row) ExtractValues(ptrs ...interface{}) error {
 //   2. Otherwise, if the name of a field matches the name of a column (ignoring case),
 //      decode the column into the field.
 //
+//   3. The fields of an embedded struct, or pointer to struct, are decoded into as if they were
+//      fields of the outer struct, unless the embedded struct has a kusto tag. A field of the outer
+//      struct wins over a field of the same name in an embedded struct. Embedded struct pointers
+//      are allocated as needed.
+//
 // Slice and pointer fields will be set to nil if the source column is a null value, and a
 // non-nil value if the column is not NULL. To decode NULL values of other types, use
 // one of the kusto types (Int, Long, Dynamic, ...) as the type of the destination field.
 // You can check the .Valid field of those types to see if the value was set.
-func (r *Row) ToStruct(p interface{}) error {
+// A null value leaves a field of any other type, such as an int64 or a time.Time, as it was,
+// unless the ErrorOnNull() option is passed.
+//
+// A datetime column decodes into a time.Time and a timespan column into a time.Duration. A column that
+// cannot decode into its field, such as a long into a time.Duration, returns an error that names both.
+func (r *Row) ToStruct(p interface{}, options ...ToStructOption) error {
 	// Check if p is a pointer to a struct
 	if t := reflect.TypeOf(p); t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
 		return errors.ES(r.Op, errors.KClientArgs, "type %T is not a pointer to a struct", p)
@@ -151,7 +161,27 @@ func (r *Row) ToStruct(p interface{}) error {
 		return errors.ES(r.Op, errors.KClientArgs, "row does not have the correct number of values(%d) for the number of columns(%d)", len(r.Values), len(r.ColumnTypes))
 	}
 
-	return decodeToStruct(r.ColumnTypes, r.Values, p)
+	opts := toStructOptions{}
+	for _, o := range options {
+		o(&opts)
+	}
+	return decodeToStruct(r.ColumnTypes, r.Values, p, opts)
+}
+
+// ToStructOption is an option to Row.ToStruct().
+type ToStructOption func(o *toStructOptions)
+
+type toStructOptions struct {
+	errorOnNull bool
+}
+
+// ErrorOnNull makes ToStruct() return an error for a null value in a column whose field cannot hold a null, such
+// as an int64, a string or a time.Time, instead of leaving the field as it was. Pointer, slice, map and interface
+// fields and the kusto types can hold a null.
+func ErrorOnNull() ToStructOption {
+	return func(o *toStructOptions) {
+		o.errorOnNull = true
+	}
 }
 
 // String implements fmt.Stringer for a Row. This simply outputs a CSV version of the row.
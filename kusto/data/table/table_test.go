@@ -1,6 +1,9 @@
 package table
 
 import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -243,3 +246,365 @@ func TestExtractValueAll(t *testing.T) {
 	assert.Equal(t, time.Duration(10), timespanVar)
 	assert.Equal(t, "5.6", decimalVar)
 }
+
+// Common is embedded by the structs that rows decode into in the tests.
+type Common struct {
+	ID      int64
+	Created time.Time
+}
+
+type Audit struct {
+	User string
+	// ID is shadowed by Common.ID, which is less deep.
+	ID int64
+}
+
+func TestRowToStructEmbedded(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	columns := Columns{
+		{Name: "ID", Type: types.Long},
+		{Name: "Created", Type: types.DateTime},
+		{Name: "user", Type: types.String},
+		{Name: "Elapsed", Type: types.Timespan},
+		{Name: "Score", Type: types.Real},
+		{Name: "Secret", Type: types.String},
+		{Name: "Label", Type: types.String},
+	}
+	row := &Row{
+		ColumnTypes: columns,
+		Values: value.Values{
+			value.Long{Value: 1, Valid: true},
+			value.DateTime{Value: created, Valid: true},
+			value.String{Value: "adam", Valid: true},
+			value.Timespan{Value: 90 * time.Second, Valid: true},
+			value.Real{Valid: false},
+			value.String{Value: "secret", Valid: true},
+			value.String{Value: "label", Valid: true},
+		},
+	}
+
+	type record struct {
+		Common
+		*Audit
+		Elapsed time.Duration
+		Score   *float64
+		Secret  string `kusto:"-"`
+		Name    string `kusto:"Label"`
+	}
+
+	got := record{Score: float64Ptr(1)}
+	assert.NoError(t, row.ToStruct(&got))
+	assert.Equal(t, record{
+		Common:  Common{ID: 1, Created: created},
+		Audit:   &Audit{User: "adam"},
+		Elapsed: 90 * time.Second,
+		Score:   nil,
+		Name:    "label",
+	}, got)
+
+	// An embedded struct with a tag is a field that a column decodes into.
+	type tagged struct {
+		value.DateTime `kusto:"Created"`
+	}
+	var gotTagged tagged
+	assert.NoError(t, row.ToStruct(&gotTagged))
+	assert.Equal(t, value.DateTime{Value: created, Valid: true}, gotTagged.DateTime)
+
+	// A column that does not fit its field is an error that names both.
+	type mismatched struct {
+		Common
+		Elapsed int64
+	}
+	err := row.ToStruct(&mismatched{})
+	assert.EqualError(t, err, "column Elapsed could not store in struct.Elapsed: Column was type Kusto.Timespan, receiver was int64")
+
+	type embeddedMismatch struct {
+		Common
+	}
+	row.Values[1] = value.Long{Value: 1, Valid: true}
+	err = row.ToStruct(&embeddedMismatch{})
+	assert.EqualError(t, err, "column Created could not store in struct.Common.Created: Column was type Kusto.Long, receiver was time.Time")
+}
+
+// MyLong and the other named types check that ToStruct decodes into types defined on the Go types of the columns.
+type (
+	MyLong   int64
+	MyString string
+)
+
+// generated is a struct with a field of each kind that a column of each type decodes into.
+type generated struct {
+	Bool        bool
+	PtrBool     *bool
+	DateTime    time.Time
+	PtrDateTime *time.Time
+	GUID        uuid.UUID
+	PtrGUID     *uuid.UUID
+	Int         int32
+	PtrInt      *int32
+	Long        MyLong
+	PtrLong     *MyLong
+	Real        float64
+	PtrReal     *float64
+	String      MyString
+	PtrString   *MyString
+	Timespan    time.Duration
+	PtrTimespan *time.Duration
+	Decimal     string
+	PtrDecimal  *string
+	KLong       value.Long
+	PtrKLong    *value.Long
+}
+
+// TestRowToStructGenerated decodes generated rows, with null values, into the same struct again and again, which
+// checks that every column overwrites its field.
+func TestRowToStructGenerated(t *testing.T) {
+	t.Parallel()
+
+	columns := Columns{}
+	for _, c := range []struct {
+		name string
+		typ  types.Column
+	}{
+		{"Bool", types.Bool}, {"DateTime", types.DateTime}, {"GUID", types.GUID}, {"Int", types.Int},
+		{"Long", types.Long}, {"Real", types.Real}, {"String", types.String}, {"Timespan", types.Timespan},
+		{"Decimal", types.Decimal},
+	} {
+		columns = append(columns, Column{Name: c.name, Type: c.typ}, Column{Name: "Ptr" + c.name, Type: c.typ})
+	}
+	columns = append(columns, Column{Name: "KLong", Type: types.Long}, Column{Name: "PtrKLong", Type: types.Long})
+
+	rng := rand.New(rand.NewSource(1))
+	got := generated{}
+	for i := 0; i < 1000; i++ {
+		valid := func() bool { return rng.Intn(4) != 0 }
+		want := generated{}
+		values := value.Values{}
+
+		b := value.Bool{Value: rng.Intn(2) == 0, Valid: valid()}
+		values = append(values, b, b)
+		if b.Valid {
+			want.Bool, want.PtrBool = b.Value, &b.Value
+		}
+
+		dt := value.DateTime{Value: time.Unix(0, rng.Int63()).UTC(), Valid: valid()}
+		values = append(values, dt, dt)
+		if dt.Valid {
+			want.DateTime, want.PtrDateTime = dt.Value, &dt.Value
+		}
+
+		g := value.GUID{Valid: valid()}
+		rng.Read(g.Value[:])
+		values = append(values, g, g)
+		if g.Valid {
+			want.GUID, want.PtrGUID = g.Value, &g.Value
+		}
+
+		in := value.Int{Value: rng.Int31() - rng.Int31(), Valid: valid()}
+		values = append(values, in, in)
+		if in.Valid {
+			want.Int, want.PtrInt = in.Value, &in.Value
+		}
+
+		l := value.Long{Value: rng.Int63() - rng.Int63(), Valid: valid()}
+		values = append(values, l, l)
+		if l.Valid {
+			myLong := MyLong(l.Value)
+			want.Long, want.PtrLong = myLong, &myLong
+		}
+
+		r := value.Real{Value: rng.NormFloat64() * 1e10, Valid: valid()}
+		values = append(values, r, r)
+		if r.Valid {
+			want.Real, want.PtrReal = r.Value, &r.Value
+		}
+
+		s := value.String{Value: fmt.Sprintf("s%d", rng.Int()), Valid: valid()}
+		values = append(values, s, s)
+		if s.Valid {
+			myString := MyString(s.Value)
+			want.String, want.PtrString = myString, &myString
+		}
+
+		ts := value.Timespan{Value: time.Duration(rng.Int63() - rng.Int63()), Valid: valid()}
+		values = append(values, ts, ts)
+		if ts.Valid {
+			want.Timespan, want.PtrTimespan = ts.Value, &ts.Value
+		}
+
+		d := value.Decimal{Value: fmt.Sprintf("%d.%d", rng.Int63(), rng.Intn(1000)), Valid: valid()}
+		values = append(values, d, d)
+		if d.Valid {
+			want.Decimal, want.PtrDecimal = d.Value, &d.Value
+		}
+
+		kl := value.Long{Value: rng.Int63(), Valid: valid()}
+		values = append(values, kl, kl)
+		want.KLong, want.PtrKLong = kl, &kl
+
+		// Null values leave non-pointer fields as they were, so those are reset to compare.
+		got = generated{PtrBool: got.PtrBool, PtrDateTime: got.PtrDateTime, PtrGUID: got.PtrGUID, PtrInt: got.PtrInt,
+			PtrLong: got.PtrLong, PtrReal: got.PtrReal, PtrString: got.PtrString, PtrTimespan: got.PtrTimespan,
+			PtrDecimal: got.PtrDecimal, PtrKLong: got.PtrKLong}
+		row := &Row{ColumnTypes: columns, Values: values}
+		if !assert.NoError(t, row.ToStruct(&got), "row %d: %s", i, row) {
+			return
+		}
+		if !assert.Equal(t, want, got, "row %d: %s", i, row) {
+			return
+		}
+
+		// Every column fails to decode into a field of another type, instead of panicking.
+		for j, col := range columns {
+			other := columns[(j+2)%len(columns)]
+			if other.Type == col.Type {
+				continue
+			}
+			misplaced := Columns{{Name: other.Name, Type: col.Type}}
+			row := &Row{ColumnTypes: misplaced, Values: value.Values{values[j]}}
+			assert.Error(t, row.ToStruct(&generated{}), "%s into %s", col.Type, other.Name)
+		}
+	}
+}
+
+func TestRowToStructDynamic(t *testing.T) {
+	t.Parallel()
+
+	type Bag struct {
+		Name  string                 `json:"name"`
+		Tags  []interface{}          `json:"tags"`
+		Props map[string]interface{} `json:"props"`
+	}
+	type dynamics struct {
+		Map     map[string]interface{}
+		Slice   []interface{}
+		Raw     json.RawMessage
+		Struct  Bag
+		PtrBag  *Bag
+		String  string
+		Any     interface{}
+		Dynamic value.Dynamic
+	}
+
+	row := func(d value.Dynamic, names ...string) *Row {
+		r := &Row{}
+		for _, name := range names {
+			r.ColumnTypes = append(r.ColumnTypes, Column{Name: name, Type: types.Dynamic})
+			r.Values = append(r.Values, d)
+		}
+		return r
+	}
+
+	// The result of pack("name", "a", "tags", pack_array(1, "two", true, dynamic(null)), "props", pack("nested", pack("n", 1.5))),
+	// as the service returns it.
+	var bag value.Dynamic
+	assert.NoError(t, bag.Unmarshal(map[string]interface{}{
+		"name":  "a",
+		"tags":  []interface{}{float64(1), "two", true, nil},
+		"props": map[string]interface{}{"nested": map[string]interface{}{"n": 1.5}},
+	}))
+
+	got := dynamics{}
+	assert.NoError(t, row(bag, "Map", "Raw", "Struct", "PtrBag", "String", "Any", "Dynamic").ToStruct(&got))
+	wantBag := Bag{
+		Name:  "a",
+		Tags:  []interface{}{float64(1), "two", true, nil},
+		Props: map[string]interface{}{"nested": map[string]interface{}{"n": 1.5}},
+	}
+	wantMap := map[string]interface{}{
+		"name":  "a",
+		"tags":  []interface{}{float64(1), "two", true, nil},
+		"props": map[string]interface{}{"nested": map[string]interface{}{"n": 1.5}},
+	}
+	assert.Equal(t, wantMap, got.Map)
+	assert.JSONEq(t, string(bag.Value), string(got.Raw))
+	assert.Equal(t, wantBag, got.Struct)
+	assert.Equal(t, &wantBag, got.PtrBag)
+	assert.JSONEq(t, string(bag.Value), got.String)
+	assert.Equal(t, wantMap, got.Any)
+	assert.Equal(t, bag, got.Dynamic)
+
+	// An array of mixed types.
+	var array value.Dynamic
+	assert.NoError(t, array.Unmarshal(`[1,"two",{"three":3},[4],null]`))
+	got = dynamics{}
+	assert.NoError(t, row(array, "Slice", "Raw", "Any").ToStruct(&got))
+	wantSlice := []interface{}{float64(1), "two", map[string]interface{}{"three": float64(3)}, []interface{}{float64(4)}, nil}
+	assert.Equal(t, wantSlice, got.Slice)
+	assert.Equal(t, json.RawMessage(`[1,"two",{"three":3},[4],null]`), got.Raw)
+	assert.Equal(t, wantSlice, got.Any)
+
+	// A null leaves maps, slices and pointers nil.
+	var null value.Dynamic
+	assert.NoError(t, null.Unmarshal(nil))
+	got = dynamics{}
+	assert.NoError(t, row(null, "Map", "Slice", "Raw", "Struct", "PtrBag", "String", "Any", "Dynamic").ToStruct(&got))
+	assert.Equal(t, dynamics{Dynamic: null}, got)
+
+	// Malformed JSON fails with the name of the column.
+	bad := value.Dynamic{Value: []byte(`{"name":`), Valid: true}
+	err := row(bad, "Map").ToStruct(&dynamics{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "column Map")
+}
+
+func TestRowToStructErrorOnNull(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []struct {
+		name  string
+		typ   types.Column
+		valid value.Kusto
+		null  value.Kusto
+	}{
+		{"Bool", types.Bool, value.Bool{Value: true, Valid: true}, value.Bool{}},
+		{"DateTime", types.DateTime, value.DateTime{Value: now, Valid: true}, value.DateTime{}},
+		{"GUID", types.GUID, value.GUID{Value: guid, Valid: true}, value.GUID{}},
+		{"Int", types.Int, value.Int{Value: 1, Valid: true}, value.Int{}},
+		{"Long", types.Long, value.Long{Value: 1, Valid: true}, value.Long{}},
+		{"Real", types.Real, value.Real{Value: 1.5, Valid: true}, value.Real{}},
+		{"String", types.String, value.String{Value: "s", Valid: true}, value.String{}},
+		{"Timespan", types.Timespan, value.Timespan{Value: time.Second, Valid: true}, value.Timespan{}},
+		{"Decimal", types.Decimal, value.Decimal{Value: "1.5", Valid: true}, value.Decimal{}},
+	} {
+		assert.True(t, c.valid.HasValue(), c.name)
+		assert.False(t, c.null.HasValue(), c.name)
+
+		row := func(name string, v value.Kusto) *Row {
+			return &Row{ColumnTypes: Columns{{Name: name, Type: c.typ}}, Values: value.Values{v}}
+		}
+
+		// A null into a field that cannot hold one fails with the option, and leaves the field as it was without.
+		got := generated{}
+		err := row(c.name, c.null).ToStruct(&got, ErrorOnNull())
+		if assert.Error(t, err, c.name) {
+			assert.Contains(t, err.Error(), fmt.Sprintf("column %s is null, which struct.%s", c.name, c.name))
+		}
+		assert.NoError(t, row(c.name, c.null).ToStruct(&got), c.name)
+		assert.Equal(t, generated{}, got, c.name)
+
+		// Values and fields that hold nulls decode with the option.
+		assert.NoError(t, row(c.name, c.valid).ToStruct(&got, ErrorOnNull()), c.name)
+		assert.NotEqual(t, generated{}, got, c.name)
+		got = generated{}
+		assert.NoError(t, row("Ptr"+c.name, c.valid).ToStruct(&got, ErrorOnNull()), c.name)
+		assert.NotEqual(t, generated{}, got, c.name)
+		got = generated{}
+		assert.NoError(t, row("Ptr"+c.name, c.null).ToStruct(&got, ErrorOnNull()), c.name)
+		assert.Equal(t, generated{}, got, c.name)
+	}
+
+	kl := struct {
+		Long    value.Long
+		Dynamic map[string]interface{}
+	}{}
+	r := &Row{
+		ColumnTypes: Columns{{Name: "Long", Type: types.Long}, {Name: "Dynamic", Type: types.Dynamic}},
+		Values:      value.Values{value.Long{}, value.Dynamic{}},
+	}
+	assert.NoError(t, r.ToStruct(&kl, ErrorOnNull()))
+	assert.False(t, kl.Long.HasValue())
+	assert.Nil(t, kl.Dynamic)
+}
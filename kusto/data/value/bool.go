@@ -15,6 +15,11 @@ type Bool struct {
 
 func (Bool) isKustoVal() {}
 
+// HasValue implements Kusto. It reports if the value is not null, which is the same as .Valid.
+func (bo Bool) HasValue() bool {
+	return bo.Valid
+}
+
 // String implements fmt.Stringer.
 func (bo Bool) String() string {
 	if !bo.Valid {
@@ -51,14 +56,14 @@ func (bo Bool) Convert(v reflect.Value) error {
 			v.SetBool(bo.Value)
 		}
 		return nil
-	case t.ConvertibleTo(reflect.TypeOf(new(bool))):
-		if bo.Valid {
-			b := new(bool)
-			if bo.Value {
-				*b = true
-			}
-			v.Set(reflect.ValueOf(b))
+	case t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Bool:
+		if !bo.Valid {
+			v.Set(reflect.Zero(t))
+			return nil
 		}
+		b := reflect.New(t.Elem())
+		b.Elem().SetBool(bo.Value)
+		v.Set(b)
 		return nil
 	case t.ConvertibleTo(reflect.TypeOf(Bool{})):
 		v.Set(reflect.ValueOf(bo))
@@ -67,5 +72,5 @@ func (bo Bool) Convert(v reflect.Value) error {
 		v.Set(reflect.ValueOf(&bo))
 		return nil
 	}
-	return fmt.Errorf("Column was type Kusto.Bool, receiver had base Kind %s ", t.Kind())
+	return fmt.Errorf("Column was type Kusto.Bool, receiver was %s", t)
 }
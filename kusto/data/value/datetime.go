@@ -24,6 +24,11 @@ func (d DateTime) String() string {
 
 func (DateTime) isKustoVal() {}
 
+// HasValue implements Kusto. It reports if the value is not null, which is the same as .Valid.
+func (d DateTime) HasValue() bool {
+	return d.Valid
+}
+
 // Marshal marshals the DateTime into a Kusto compatible string.
 func (d DateTime) Marshal() string {
 	if !d.Valid {
@@ -64,11 +69,12 @@ func (d DateTime) Convert(v reflect.Value) error {
 			v.Set(reflect.ValueOf(d.Value))
 		}
 		return nil
-	case t.ConvertibleTo(reflect.TypeOf(new(time.Time))):
-		if d.Valid {
-			t := &d.Value
-			v.Set(reflect.ValueOf(t))
+	case t == reflect.TypeOf(new(time.Time)):
+		if !d.Valid {
+			v.Set(reflect.Zero(t))
+			return nil
 		}
+		v.Set(reflect.ValueOf(&d.Value))
 		return nil
 	case t.ConvertibleTo(reflect.TypeOf(DateTime{})):
 		v.Set(reflect.ValueOf(d))
@@ -77,5 +83,5 @@ func (d DateTime) Convert(v reflect.Value) error {
 		v.Set(reflect.ValueOf(&d))
 		return nil
 	}
-	return fmt.Errorf("Column was type Kusto.DateTime, receiver had base Kind %s ", t.Kind())
+	return fmt.Errorf("Column was type Kusto.DateTime, receiver was %s", t)
 }
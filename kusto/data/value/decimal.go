@@ -9,7 +9,8 @@ import (
 
 // Decimal represents a Kusto decimal type.  Decimal implements Kusto.
 // Because Go does not have a dynamic decimal type that meets all needs, Decimal
-// provides the string representation for you to unmarshal into.
+// provides the string representation for you to unmarshal into. Kusto decimals hold up to 34 significant
+// digits, more than a float64 can, so the string keeps every digit; use Rat or BigFloat to compute with it.
 type Decimal struct {
 	// Value holds the value of the type.
 	Value string
@@ -19,6 +20,11 @@ type Decimal struct {
 
 func (Decimal) isKustoVal() {}
 
+// HasValue implements Kusto. It reports if the value is not null, which is the same as .Valid.
+func (d Decimal) HasValue() bool {
+	return d.Valid
+}
+
 // String implements fmt.Stringer.
 func (d Decimal) String() string {
 	if !d.Valid {
@@ -32,7 +38,48 @@ func (d *Decimal) ParseFloat(base int, prec uint, mode big.RoundingMode) (f *big
 	return big.ParseFloat(d.Value, base, prec, mode)
 }
 
-var DecRE = regexp.MustCompile(`^((\d+\.?\d*)|(\d*\.?\d+))$`) // Matches decimal numbers, with or without decimal dot, with optional parts missing.
+// Rat returns the exact value of the Decimal. It returns nil if the value is not set.
+func (d Decimal) Rat() (*big.Rat, error) {
+	if !d.Valid {
+		return nil, nil
+	}
+	r, ok := new(big.Rat).SetString(d.Value)
+	if !ok {
+		return nil, fmt.Errorf("decimal value %q could not be parsed", d.Value)
+	}
+	return r, nil
+}
+
+// BigFloat returns the value of the Decimal as a *big.Float with enough precision to hold all of its digits, so that
+// f.Text('f', -1) gives them back. It returns nil if the value is not set.
+func (d Decimal) BigFloat() (*big.Float, error) {
+	if !d.Valid {
+		return nil, nil
+	}
+	f, _, err := big.ParseFloat(d.Value, 10, decimalPrec(d.Value), big.ToNearestEven)
+	if err != nil {
+		return nil, fmt.Errorf("decimal value %q could not be parsed: %s", d.Value, err)
+	}
+	return f, nil
+}
+
+// decimalPrec is the precision in bits that a *big.Float needs to hold the digits of s, which is more than the 3.33
+// bits of each digit, so that the shortest decimal that the float rounds to is s.
+func decimalPrec(s string) uint {
+	digits := 0
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	if prec := uint(digits*4 + 8); prec > 64 {
+		return prec
+	}
+	return 64
+}
+
+// DecRE matches decimal numbers, with or without a sign or decimal dot, with optional parts missing.
+var DecRE = regexp.MustCompile(`^[-+]?((\d+\.?\d*)|(\d*\.?\d+))$`)
 
 // Unmarshal unmarshals i into Decimal. i must be a string representing a decimal type or nil.
 func (d *Decimal) Unmarshal(i interface{}) error {
@@ -62,14 +109,31 @@ func (d Decimal) Convert(v reflect.Value) error {
 	switch {
 	case t.Kind() == reflect.String:
 		if d.Valid {
-			v.Set(reflect.ValueOf(d.Value))
+			v.SetString(d.Value)
 		}
 		return nil
-	case t.ConvertibleTo(reflect.TypeOf(new(string))):
-		if d.Valid {
-			i := &d.Value
-			v.Set(reflect.ValueOf(i))
+	case t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.String:
+		if !d.Valid {
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+		str := reflect.New(t.Elem())
+		str.Elem().SetString(d.Value)
+		v.Set(str)
+		return nil
+	case t == reflect.TypeOf(&big.Float{}) || t == reflect.TypeOf(big.Float{}):
+		f, err := d.BigFloat()
+		if err != nil {
+			return err
 		}
+		d.setBig(v, f)
+		return nil
+	case t == reflect.TypeOf(&big.Rat{}) || t == reflect.TypeOf(big.Rat{}):
+		r, err := d.Rat()
+		if err != nil {
+			return err
+		}
+		d.setBig(v, r)
 		return nil
 	case t.ConvertibleTo(reflect.TypeOf(Decimal{})):
 		v.Set(reflect.ValueOf(d))
@@ -78,5 +142,19 @@ func (d Decimal) Convert(v reflect.Value) error {
 		v.Set(reflect.ValueOf(&d))
 		return nil
 	}
-	return fmt.Errorf("Column was type Kusto.Decimal, receiver had base Kind %s ", t.Kind())
+	return fmt.Errorf("Column was type Kusto.Decimal, receiver was %s", t)
+}
+
+// setBig sets v, a *big.Float or *big.Rat or the value of one, to x, which is of the pointer type. If d is not set,
+// pointers are set to nil and values are left as they are.
+func (d Decimal) setBig(v reflect.Value, x interface{}) {
+	switch {
+	case !d.Valid && v.Kind() == reflect.Ptr:
+		v.Set(reflect.Zero(v.Type()))
+	case !d.Valid:
+	case v.Kind() == reflect.Ptr:
+		v.Set(reflect.ValueOf(x))
+	default:
+		v.Set(reflect.ValueOf(x).Elem())
+	}
 }
@@ -16,6 +16,11 @@ type Dynamic struct {
 
 func (Dynamic) isKustoVal() {}
 
+// HasValue implements Kusto. It reports if the value is not null, which is the same as .Valid.
+func (d Dynamic) HasValue() bool {
+	return d.Valid
+}
+
 // String implements fmt.Stringer.
 func (d Dynamic) String() string {
 	if !d.Valid {
@@ -55,7 +60,9 @@ func (d *Dynamic) Unmarshal(i interface{}) error {
 	return nil
 }
 
-// Convert Dynamic into reflect value.
+// Convert Dynamic into reflect value. The receiver is chosen by its type: a Dynamic, a string or []byte (including
+// json.RawMessage) receive the JSON text, while maps, slices, structs and interface{} receive it decoded. A null
+// leaves maps, slices, []byte and interface{} nil.
 func (d Dynamic) Convert(v reflect.Value) error {
 	t := v.Type()
 	if t.Kind() == reflect.Ptr {
@@ -66,14 +73,18 @@ func (d Dynamic) Convert(v reflect.Value) error {
 	switch {
 	case t.ConvertibleTo(reflect.TypeOf(Dynamic{})):
 		valueToSet = reflect.ValueOf(d)
-	case t.ConvertibleTo(reflect.TypeOf([]byte{})):
-		if t.Kind() == reflect.String {
-			s := string(d.Value)
-			valueToSet = reflect.ValueOf(s)
-		} else {
-			valueToSet = reflect.ValueOf(d.Value)
+	case t.Kind() == reflect.String:
+		valueToSet = reflect.ValueOf(string(d.Value)).Convert(t)
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		if !d.Valid {
+			return nil
 		}
-	case t.Kind() == reflect.Slice || t.Kind() == reflect.Map:
+
+		// The row may share its buffer, so the receiver gets its own copy.
+		b := make([]byte, len(d.Value))
+		copy(b, d.Value)
+		valueToSet = reflect.ValueOf(b).Convert(t)
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Map || (t.Kind() == reflect.Interface && t.NumMethod() == 0):
 		if !d.Valid {
 			return nil
 		}
@@ -85,6 +96,10 @@ func (d Dynamic) Convert(v reflect.Value) error {
 
 		valueToSet = ptr.Elem()
 	case t.Kind() == reflect.Struct:
+		if len(d.Value) == 0 {
+			return nil
+		}
+
 		structPtr := reflect.New(t)
 
 		if err := json.Unmarshal([]byte(d.Value), structPtr.Interface()); err != nil {
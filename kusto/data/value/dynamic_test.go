@@ -1,6 +1,7 @@
 package value_test
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 
@@ -33,6 +34,7 @@ func TestDynamicConverter(t *testing.T) {
 	wantByteArray := []byte(`hello`)
 	emptyStr := ""
 	wantStr := "hello"
+	wantRaw := json.RawMessage(`{"name":"A","id":1}`)
 
 	testCases := []DynamicConverterTestCase{
 		{
@@ -53,6 +55,18 @@ func TestDynamicConverter(t *testing.T) {
 			Target: reflect.ValueOf(&emptyStr),
 			Want:   &wantStr,
 		},
+		{
+			Desc:   "convert to json.RawMessage",
+			Value:  value.Dynamic{Value: []byte(`{"name":"A","id":1}`), Valid: true},
+			Target: reflect.ValueOf(&json.RawMessage{}),
+			Want:   &wantRaw,
+		},
+		{
+			Desc:   "convert to []interface{}",
+			Value:  value.Dynamic{Value: []byte(`[1,"two",{"three":3},null]`), Valid: true},
+			Target: reflect.ValueOf(&[]interface{}{}),
+			Want:   &[]interface{}{float64(1), "two", map[string]interface{}{"three": float64(3)}, nil},
+		},
 		{
 			Desc:   "convert to []string",
 			Value:  value.Dynamic{Value: []byte(`["hello", "world"]`), Valid: true},
@@ -17,6 +17,11 @@ type GUID struct {
 
 func (GUID) isKustoVal() {}
 
+// HasValue implements Kusto. It reports if the value is not null, which is the same as .Valid.
+func (g GUID) HasValue() bool {
+	return g.Valid
+}
+
 // String implements fmt.Stringer.
 func (g GUID) String() string {
 	if !g.Valid {
@@ -54,11 +59,12 @@ func (g GUID) Convert(v reflect.Value) error {
 			v.Set(reflect.ValueOf(g.Value))
 		}
 		return nil
-	case t.ConvertibleTo(reflect.TypeOf(new(uuid.UUID))):
-		if g.Valid {
-			t := &g.Value
-			v.Set(reflect.ValueOf(t))
+	case t == reflect.TypeOf(new(uuid.UUID)):
+		if !g.Valid {
+			v.Set(reflect.Zero(t))
+			return nil
 		}
+		v.Set(reflect.ValueOf(&g.Value))
 		return nil
 	case t.ConvertibleTo(reflect.TypeOf(GUID{})):
 		v.Set(reflect.ValueOf(g))
@@ -67,5 +73,5 @@ func (g GUID) Convert(v reflect.Value) error {
 		v.Set(reflect.ValueOf(&g))
 		return nil
 	}
-	return fmt.Errorf("Column was type Kusto.GUID, receiver had base Kind %s ", t.Kind())
+	return fmt.Errorf("Column was type Kusto.GUID, receiver was %s", t)
 }
@@ -18,6 +18,11 @@ type Int struct {
 
 func (Int) isKustoVal() {}
 
+// HasValue implements Kusto. It reports if the value is not null, which is the same as .Valid.
+func (in Int) HasValue() bool {
+	return in.Valid
+}
+
 // String implements fmt.Stringer.
 func (in Int) String() string {
 	if !in.Valid {
@@ -68,14 +73,17 @@ func (in Int) Convert(v reflect.Value) error {
 	switch {
 	case t.Kind() == reflect.Int32:
 		if in.Valid {
-			v.Set(reflect.ValueOf(in.Value))
+			v.SetInt(int64(in.Value))
 		}
 		return nil
-	case t.ConvertibleTo(reflect.TypeOf(new(int32))):
-		if in.Valid {
-			i := &in.Value
-			v.Set(reflect.ValueOf(i))
+	case t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Int32:
+		if !in.Valid {
+			v.Set(reflect.Zero(t))
+			return nil
 		}
+		i := reflect.New(t.Elem())
+		i.Elem().SetInt(int64(in.Value))
+		v.Set(i)
 		return nil
 	case t.ConvertibleTo(reflect.TypeOf(Int{})):
 		v.Set(reflect.ValueOf(in))
@@ -84,5 +92,5 @@ func (in Int) Convert(v reflect.Value) error {
 		v.Set(reflect.ValueOf(&in))
 		return nil
 	}
-	return fmt.Errorf("Column was type Kusto.Int, receiver had base Kind %s ", t.Kind())
+	return fmt.Errorf("Column was type Kusto.Int, receiver was %s", t)
 }
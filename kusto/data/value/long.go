@@ -18,6 +18,11 @@ type Long struct {
 
 func (Long) isKustoVal() {}
 
+// HasValue implements Kusto. It reports if the value is not null, which is the same as .Valid.
+func (l Long) HasValue() bool {
+	return l.Valid
+}
+
 // String implements fmt.Stringer.
 func (l Long) String() string {
 	if !l.Valid {
@@ -63,17 +68,19 @@ func (l *Long) Unmarshal(i interface{}) error {
 func (l Long) Convert(v reflect.Value) error {
 	t := v.Type()
 	switch {
-	case t.Kind() == reflect.Int64:
+	case t.Kind() == reflect.Int64 && t != durationType:
 		if l.Valid {
-			v.Set(reflect.ValueOf(l.Value))
+			v.SetInt(l.Value)
 		}
 		return nil
-	case t.ConvertibleTo(reflect.TypeOf(new(int64))):
-		if l.Valid {
-			i := &l.Value
-			fmt.Println(i)
-			v.Set(reflect.ValueOf(i))
+	case t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Int64 && t.Elem() != durationType:
+		if !l.Valid {
+			v.Set(reflect.Zero(t))
+			return nil
 		}
+		i := reflect.New(t.Elem())
+		i.Elem().SetInt(l.Value)
+		v.Set(i)
 		return nil
 	case t.ConvertibleTo(reflect.TypeOf(Long{})):
 		v.Set(reflect.ValueOf(l))
@@ -82,5 +89,5 @@ func (l Long) Convert(v reflect.Value) error {
 		v.Set(reflect.ValueOf(&l))
 		return nil
 	}
-	return fmt.Errorf("Column was type Kusto.Long, receiver had base Kind %s ", t.Kind())
+	return fmt.Errorf("Column was type Kusto.Long, receiver was %s", t)
 }
@@ -17,6 +17,11 @@ type Real struct {
 
 func (Real) isKustoVal() {}
 
+// HasValue implements Kusto. It reports if the value is not null, which is the same as .Valid.
+func (r Real) HasValue() bool {
+	return r.Valid
+}
+
 // String implements fmt.Stringer.
 func (r Real) String() string {
 	if !r.Valid {
@@ -59,14 +64,17 @@ func (r Real) Convert(v reflect.Value) error {
 	switch {
 	case t.Kind() == reflect.Float64:
 		if r.Valid {
-			v.Set(reflect.ValueOf(r.Value))
+			v.SetFloat(r.Value)
 		}
 		return nil
-	case t.ConvertibleTo(reflect.TypeOf(new(float64))):
-		if r.Valid {
-			i := &r.Value
-			v.Set(reflect.ValueOf(i))
+	case t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Float64:
+		if !r.Valid {
+			v.Set(reflect.Zero(t))
+			return nil
 		}
+		f := reflect.New(t.Elem())
+		f.Elem().SetFloat(r.Value)
+		v.Set(f)
 		return nil
 	case t.ConvertibleTo(reflect.TypeOf(Real{})):
 		v.Set(reflect.ValueOf(r))
@@ -75,5 +83,5 @@ func (r Real) Convert(v reflect.Value) error {
 		v.Set(reflect.ValueOf(&r))
 		return nil
 	}
-	return fmt.Errorf("Column was type Kusto.Real, receiver had base Kind %s ", t.Kind())
+	return fmt.Errorf("Column was type Kusto.Real, receiver was %s", t)
 }
@@ -15,6 +15,11 @@ type String struct {
 
 func (String) isKustoVal() {}
 
+// HasValue implements Kusto. It reports if the value is not null, which is the same as .Valid.
+func (s String) HasValue() bool {
+	return s.Valid
+}
+
 // String implements fmt.Stringer.
 func (s String) String() string {
 	if !s.Valid {
@@ -47,14 +52,17 @@ func (s String) Convert(v reflect.Value) error {
 	switch {
 	case t.Kind() == reflect.String:
 		if s.Valid {
-			v.Set(reflect.ValueOf(s.Value))
+			v.SetString(s.Value)
 		}
 		return nil
-	case t.ConvertibleTo(reflect.TypeOf(new(string))):
-		if s.Valid {
-			i := &s.Value
-			v.Set(reflect.ValueOf(i))
+	case t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.String:
+		if !s.Valid {
+			v.Set(reflect.Zero(t))
+			return nil
 		}
+		str := reflect.New(t.Elem())
+		str.Elem().SetString(s.Value)
+		v.Set(str)
 		return nil
 	case t.ConvertibleTo(reflect.TypeOf(String{})):
 		v.Set(reflect.ValueOf(s))
@@ -63,5 +71,5 @@ func (s String) Convert(v reflect.Value) error {
 		v.Set(reflect.ValueOf(&s))
 		return nil
 	}
-	return fmt.Errorf("Column was type Kusto.String, receiver had base Kind %s ", t.Kind())
+	return fmt.Errorf("Column was type Kusto.String, receiver was %s", t)
 }
@@ -20,6 +20,11 @@ type Timespan struct {
 
 func (Timespan) isKustoVal() {}
 
+// HasValue implements Kusto. It reports if the value is not null, which is the same as .Valid.
+func (t Timespan) HasValue() bool {
+	return t.Valid
+}
+
 // String implements fmt.Stringer.
 func (t Timespan) String() string {
 	if !t.Valid {
@@ -73,17 +78,12 @@ func (t Timespan) Marshal() string {
 	milliseconds := val / time.Millisecond
 	val = val - (milliseconds * time.Millisecond)
 	ticks := val / tick
+	// Remove any trailing 0's of the sub-second part, but not of the seconds, as in "00:01:30".
 	if milliseconds > 0 || ticks > 0 {
-		sb.WriteString(fmt.Sprintf(".%03d%d", milliseconds, ticks))
-	}
-
-	// Remove any trailing 0's.
-	str := strings.TrimRight(sb.String(), "0")
-	if strings.HasSuffix(str, ":") {
-		str = str + "00"
+		sb.WriteString(strings.TrimRight(fmt.Sprintf(".%03d%04d", milliseconds, ticks), "0"))
 	}
 
-	return str
+	return sb.String()
 }
 
 // Unmarshal unmarshals i into Timespan. i must be a string representing a Values timespan or nil.
@@ -240,20 +240,24 @@ func (t *Timespan) unmarshalSeconds(s string) (time.Duration, error) {
 	return 0, fmt.Errorf("timespan's seconds field did not have the requisite '.'s, was %s", s)
 }
 
+// durationType is the reflect.Type of time.Duration, which only a Timespan converts into, although it is an int64.
+var durationType = reflect.TypeOf(time.Duration(0))
+
 // Convert Timespan into reflect value.
 func (ts Timespan) Convert(v reflect.Value) error {
 	t := v.Type()
 	switch {
-	case t.AssignableTo(reflect.TypeOf(time.Duration(0))):
+	case t == durationType:
 		if ts.Valid {
 			v.Set(reflect.ValueOf(ts.Value))
 		}
 		return nil
-	case t.ConvertibleTo(reflect.TypeOf(new(time.Duration))):
-		if ts.Valid {
-			t := &ts.Value
-			v.Set(reflect.ValueOf(t))
+	case t == reflect.PtrTo(durationType):
+		if !ts.Valid {
+			v.Set(reflect.Zero(t))
+			return nil
 		}
+		v.Set(reflect.ValueOf(&ts.Value))
 		return nil
 	case t.ConvertibleTo(reflect.TypeOf(Timespan{})):
 		v.Set(reflect.ValueOf(ts))
@@ -262,5 +266,5 @@ func (ts Timespan) Convert(v reflect.Value) error {
 		v.Set(reflect.ValueOf(&ts))
 		return nil
 	}
-	return fmt.Errorf("Column was type Kusto.Timespan, receiver had base Kind %s ", t.Kind())
+	return fmt.Errorf("Column was type Kusto.Timespan, receiver was %s", t)
 }
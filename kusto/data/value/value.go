@@ -26,10 +26,11 @@ Each type defined above has at minimum two fields:
 	.Value - The type specific value
 	.Valid - True if the value was non-null in the Kusto table
 
-Each provides at minimum the following two methods:
+Each provides at minimum the following three methods:
 
 	.String() - Returns the string representation of the value.
 	.Unmarshal() - Unmarshals the value into a standard Go type.
+	.HasValue() - Reports if the value was non-null, the same as .Valid.
 
 The Unmarshal() is for internal use, it should not be needed by an end user. Use .Value or table.Row.ToStruct() instead.
 */
@@ -44,6 +45,8 @@ type Kusto interface {
 	String() string
 	// Convert into reflect value.
 	Convert(v reflect.Value) error
+	// HasValue reports if the value is not null.
+	HasValue() bool
 }
 
 // Values is a list of Kusto values, usually an ordered row.
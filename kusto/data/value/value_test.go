@@ -3,6 +3,8 @@ package value
 import (
 	"encoding/json"
 	"math"
+	"math/big"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -480,6 +482,9 @@ func TestTimespan(t *testing.T) {
 		{i: "00:00:03", want: Timespan{Value: 3 * time.Second, Valid: true}},
 		{i: "00:04:03", want: Timespan{Value: 4*time.Minute + 3*time.Second, Valid: true}},
 		{i: "02:04:03", want: Timespan{Value: 2*time.Hour + 4*time.Minute + 3*time.Second, Valid: true}},
+		{i: "00:01:30", want: Timespan{Value: 90 * time.Second, Valid: true}},
+		{i: "10:00:00", want: Timespan{Value: 10 * time.Hour, Valid: true}},
+		{i: "00:00:00.0000005", want: Timespan{Value: 500 * time.Nanosecond, Valid: true}},
 		{i: "00:00:00.099", want: Timespan{Value: 99 * time.Millisecond, Valid: true}},
 		{i: "02:04:03.0123", want: Timespan{Value: 2*time.Hour + 4*time.Minute + 3*time.Second + 12300*time.Microsecond, Valid: true}},
 		{i: "01.00:00:00", want: Timespan{Value: 24 * time.Hour, Valid: true}},
@@ -549,6 +554,13 @@ func TestDecimal(t *testing.T) {
 		{desc: "Conversion of '1.',", i: "1.", want: Decimal{Value: "1.", Valid: true}},
 		{desc: "Conversion of '0.1',", i: "0.1", want: Decimal{Value: "0.1", Valid: true}},
 		{desc: "Conversion of '3.07',", i: "3.07", want: Decimal{Value: "3.07", Valid: true}},
+		{desc: "Conversion of max", i: "79228162514264337593543950335", want: Decimal{Value: "79228162514264337593543950335", Valid: true}},
+		{desc: "Conversion of min", i: "-79228162514264337593543950335", want: Decimal{Value: "-79228162514264337593543950335", Valid: true}},
+		{desc: "Conversion of a small fraction", i: "0.0000000000000000000000000001", want: Decimal{Value: "0.0000000000000000000000000001", Valid: true}},
+		{desc: "Conversion of negative zero", i: "-0", want: Decimal{Value: "-0", Valid: true}},
+		{desc: "Conversion of null", i: nil, want: Decimal{}},
+		{desc: "cannot be two signs", i: "--1", err: true},
+		{desc: "cannot be a float string", i: "1e5", err: true},
 	}
 
 	for _, test := range tests {
@@ -569,6 +581,55 @@ func TestDecimal(t *testing.T) {
 	}
 }
 
+func TestDecimalConvert(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []string{
+		"79228162514264337593543950335",
+		"-79228162514264337593543950335",
+		"0.0000000000000000000000000001",
+		"-7922816251426433759354395033.5",
+		"-0",
+	} {
+		d := Decimal{Value: v, Valid: true}
+
+		var got struct {
+			String   string
+			PtrFloat *big.Float
+			Float    big.Float
+			PtrRat   *big.Rat
+			Rat      big.Rat
+			Decimal  Decimal
+		}
+		rv := reflect.ValueOf(&got).Elem()
+		for i := 0; i < rv.NumField(); i++ {
+			assert.NoError(t, d.Convert(rv.Field(i)), "%s into %s", v, rv.Type().Field(i).Name)
+		}
+
+		want, ok := new(big.Rat).SetString(v)
+		assert.True(t, ok)
+		assert.Equal(t, v, got.String)
+		assert.Equal(t, d, got.Decimal)
+		// Every digit is kept, not only those that fit a float64.
+		assert.Equal(t, v, got.PtrFloat.Text('f', -1))
+		assert.Equal(t, got.PtrFloat.Text('f', -1), got.Float.Text('f', -1))
+		assert.Equal(t, 0, want.Cmp(got.PtrRat), v)
+		assert.Equal(t, 0, want.Cmp(&got.Rat), v)
+		assert.Equal(t, strings.HasPrefix(v, "-"), got.PtrFloat.Signbit(), v)
+	}
+
+	// A null decimal sets pointers to nil.
+	f, r := big.NewFloat(1), big.NewRat(1, 2)
+	assert.NoError(t, Decimal{}.Convert(reflect.ValueOf(&f).Elem()))
+	assert.NoError(t, Decimal{}.Convert(reflect.ValueOf(&r).Elem()))
+	assert.Nil(t, f)
+	assert.Nil(t, r)
+
+	_, err := Decimal{Value: "abc", Valid: true}.Rat()
+	assert.Error(t, err)
+	assert.Error(t, Decimal{Value: "abc", Valid: true}.Convert(reflect.ValueOf(&f).Elem()))
+}
+
 func timeMustParse(layout string, p string) time.Time {
 	t, err := time.Parse(layout, p)
 	if err != nil {
@@ -0,0 +1,222 @@
+package kusto
+
+// device_code.go holds the sign in of a user with a device code, for tools that run where no browser can be opened.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+)
+
+const (
+	// defaultAuthorityHost is the host of the Azure AD endpoints.
+	defaultAuthorityHost = "https://login.microsoftonline.com"
+	// deviceCodeSlowDown is how much longer to wait between polls when the identity service asks to slow down.
+	deviceCodeSlowDown = 5 * time.Second
+	// defaultDeviceCodeInterval is the wait between polls when the identity service does not set one.
+	defaultDeviceCodeInterval = 5 * time.Second
+)
+
+// DeviceCode is what a user needs to sign in with a device code.
+type DeviceCode struct {
+	// VerificationURL is the page to sign in at, such as "https://microsoft.com/devicelogin".
+	VerificationURL string
+	// UserCode is the code to enter on that page.
+	UserCode string
+	// Message is the instruction of the identity service to the user, which holds both.
+	Message string
+	// ExpiresOn is when the code expires.
+	ExpiresOn time.Time
+}
+
+// DeviceCodeConfig signs a user in with a device code: the client gives the user a code to enter at a page of the
+// identity service, and waits for them to sign in there. It does so with the first call, and then gets new tokens
+// with the refresh token of the user, so that the user only signs in again once the refresh token expires. A Client
+// and the ingestion clients made from it share the sign in.
+type DeviceCodeConfig struct {
+	// ClientID is the id of the public application to sign in with. If empty, the application of the Kusto tools.
+	ClientID string
+	// TenantID is the tenant to sign in to. If empty, the home tenant of the user.
+	TenantID string
+	// Prompt is called with the code that the user needs to sign in. If nil, the Message of the code is written to
+	// Output, or to stdout if Output is nil too.
+	Prompt func(code DeviceCode)
+	Output io.Writer
+
+	// authorityHost and interval replace defaultAuthorityHost and the wait between polls in tests.
+	authorityHost string
+	interval      time.Duration
+
+	mu           sync.Mutex
+	refreshToken string
+}
+
+// tokenResponse is the response of the Azure AD token endpoint.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// fetchToken implements fetchToken, with the refresh token of the user if there is one, or else by signing the user
+// in. Failures are of kind errors.KAuth.
+func (c *DeviceCodeConfig) fetchToken(ctx context.Context, resource string) (string, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	scope := strings.TrimSuffix(resource, "/") + "/.default offline_access"
+	if c.refreshToken != "" {
+		tr, err := c.post(ctx, "token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {c.refreshToken},
+			"scope":         {scope},
+		})
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if tr.Error == "" {
+			return c.keep(tr)
+		}
+		// The refresh token expired or was revoked, so the user has to sign in again.
+		c.refreshToken = ""
+	}
+
+	var dc struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURI string `json:"verification_uri"`
+		ExpiresIn       int64  `json:"expires_in"`
+		Interval        int64  `json:"interval"`
+		Message         string `json:"message"`
+		Error           string `json:"error"`
+		Description     string `json:"error_description"`
+	}
+	if err := c.do(ctx, "devicecode", url.Values{"scope": {scope}}, &dc); err != nil {
+		return "", time.Time{}, err
+	}
+	if dc.Error != "" || dc.DeviceCode == "" {
+		return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "could not start the device code sign in: %s: %s", dc.Error, dc.Description).SetNoRetry()
+	}
+
+	code := DeviceCode{
+		VerificationURL: dc.VerificationURI,
+		UserCode:        dc.UserCode,
+		Message:         dc.Message,
+		ExpiresOn:       time.Now().Add(time.Duration(dc.ExpiresIn) * time.Second),
+	}
+	if code.Message == "" {
+		code.Message = fmt.Sprintf("To sign in, use a web browser to open the page %s and enter the code %s to authenticate.", code.VerificationURL, code.UserCode)
+	}
+	switch {
+	case c.Prompt != nil:
+		c.Prompt(code)
+	case c.Output != nil:
+		fmt.Fprintln(c.Output, code.Message)
+	default:
+		fmt.Fprintln(os.Stdout, code.Message)
+	}
+
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDeviceCodeInterval
+	}
+	if c.interval > 0 {
+		interval = c.interval
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return "", time.Time{}, errors.E(errors.OpServConn, errors.KAuth, fmt.Errorf("stopped waiting for the device code sign in: %w", ctx.Err()))
+		case <-timer.C:
+		}
+
+		tr, err := c.post(ctx, "token", url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {dc.DeviceCode},
+		})
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		switch tr.Error {
+		case "":
+			return c.keep(tr)
+		case "authorization_pending":
+		case "slow_down":
+			interval += deviceCodeSlowDown
+		default:
+			// Such as expired_token, when the user did not sign in in time, or authorization_declined.
+			return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "the device code sign in failed: %s: %s", tr.Error, tr.Description).SetNoRetry()
+		}
+		timer.Reset(interval)
+	}
+}
+
+// keep keeps the refresh token of tr, and returns its access token.
+func (c *DeviceCodeConfig) keep(tr tokenResponse) (string, time.Time, error) {
+	if tr.AccessToken == "" {
+		return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "the identity service returned a token that could not be read")
+	}
+	if tr.RefreshToken != "" {
+		c.refreshToken = tr.RefreshToken
+	}
+	return tr.AccessToken, time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second), nil
+}
+
+// post posts form to the token endpoint path of the tenant.
+func (c *DeviceCodeConfig) post(ctx context.Context, path string, form url.Values) (tokenResponse, error) {
+	var tr tokenResponse
+	err := c.do(ctx, path, form, &tr)
+	return tr, err
+}
+
+// do posts form, with the client id, to the endpoint path of the tenant and decodes the response into v. The
+// identity service returns its errors as JSON, which are decoded into v too.
+func (c *DeviceCodeConfig) do(ctx context.Context, path string, form url.Values, v interface{}) error {
+	host, tenant, clientID := c.authorityHost, c.TenantID, c.ClientID
+	if host == "" {
+		host = defaultAuthorityHost
+	}
+	if tenant == "" {
+		tenant = "organizations"
+	}
+	if clientID == "" {
+		clientID = kustoClientAppID
+	}
+	form.Set("client_id", clientID)
+
+	u := fmt.Sprintf("%s/%s/oauth2/v2.0/%s", strings.TrimSuffix(host, "/"), url.PathEscape(tenant), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.E(errors.OpServConn, errors.KAuth, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.E(errors.OpServConn, errors.KAuth, fmt.Errorf("could not reach the identity service: %w", err))
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.E(errors.OpServConn, errors.KAuth, fmt.Errorf("could not read the response of the identity service: %w", err))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return errors.ES(errors.OpServConn, errors.KAuth, "the identity service returned %s, which could not be read", resp.Status)
+	}
+	return nil
+}
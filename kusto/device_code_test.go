@@ -0,0 +1,167 @@
+package kusto
+
+import (
+	"bytes"
+	"context"
+	goErrors "errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAAD serves the device code endpoints of a tenant. The user signs in after pending polls.
+type fakeAAD struct {
+	pending int
+	// refreshFails makes the refresh token grant fail.
+	refreshFails bool
+
+	mu          sync.Mutex
+	deviceCodes int
+	scope       string
+	polls       int
+	refreshes   []string
+}
+
+func (f *fakeAAD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("client_id") != kustoClientAppID {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_client","error_description":"bad client"}`)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/tenant/oauth2/v2.0/devicecode":
+		f.deviceCodes++
+		f.scope = r.PostForm.Get("scope")
+		fmt.Fprintf(w, `{"device_code":"device%d","user_code":"CODE%d","verification_uri":"https://microsoft.com/devicelogin","expires_in":900,"interval":5,`+
+			`"message":"Enter CODE%d at https://microsoft.com/devicelogin"}`, f.deviceCodes, f.deviceCodes, f.deviceCodes)
+	case "/tenant/oauth2/v2.0/token":
+		switch r.PostForm.Get("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			f.polls++
+			if f.polls <= f.pending {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"authorization_pending","error_description":"waiting for the user"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"access_token":"token-%s","refresh_token":"refresh1","expires_in":3600}`, f.scope)
+		case "refresh_token":
+			f.refreshes = append(f.refreshes, r.PostForm.Get("refresh_token"))
+			if f.refreshFails {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"invalid_grant","error_description":"refresh token expired"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"access_token":"token-%s","refresh_token":"refresh%d","expires_in":3600}`, r.PostForm.Get("scope"), len(f.refreshes)+1)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestDeviceCode(t *testing.T) {
+	t.Parallel()
+
+	aad := &fakeAAD{pending: 2}
+	server := httptest.NewServer(aad)
+	defer server.Close()
+
+	var codes []DeviceCode
+	config := &DeviceCodeConfig{
+		TenantID:      "tenant",
+		Prompt:        func(code DeviceCode) { codes = append(codes, code) },
+		authorityHost: server.URL,
+		interval:      time.Millisecond,
+	}
+
+	client, err := New("https://mycluster.kusto.windows.net", Authorization{DeviceCode: config})
+	require.NoError(t, err)
+	authorizer := client.conn.(*conn).auth.(*tokenAuthorizer)
+
+	token, err := authorizer.getToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-https://mycluster.kusto.windows.net/.default offline_access", token)
+	require.Len(t, codes, 1)
+	assert.Equal(t, "CODE1", codes[0].UserCode)
+	assert.Equal(t, "https://microsoft.com/devicelogin", codes[0].VerificationURL)
+	assert.Equal(t, "Enter CODE1 at https://microsoft.com/devicelogin", codes[0].Message)
+	assert.WithinDuration(t, time.Now().Add(15*time.Minute), codes[0].ExpiresOn, time.Minute)
+	assert.Equal(t, 3, aad.polls)
+
+	// The token is kept until it is about to expire, and then refreshed without the user.
+	_, err = authorizer.getToken(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, aad.refreshes)
+	authorizer.expiresOn = time.Now()
+	_, err = authorizer.getToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"refresh1"}, aad.refreshes)
+
+	// The ingestion clients made from the Client share the sign in.
+	a := client.Auth()
+	require.NoError(t, a.Validate("https://ingest-mycluster.kusto.windows.net"))
+	token, err = a.Authorizer.(*tokenAuthorizer).getToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-https://ingest-mycluster.kusto.windows.net/.default offline_access", token)
+	assert.Equal(t, []string{"refresh1", "refresh2"}, aad.refreshes)
+	assert.Equal(t, 1, aad.deviceCodes)
+	assert.Len(t, codes, 1)
+}
+
+func TestDeviceCodeSignInAgain(t *testing.T) {
+	t.Parallel()
+
+	aad := &fakeAAD{refreshFails: true}
+	server := httptest.NewServer(aad)
+	defer server.Close()
+
+	var out bytes.Buffer
+	config := &DeviceCodeConfig{TenantID: "tenant", Output: &out, authorityHost: server.URL, interval: time.Millisecond}
+
+	_, _, err := config.fetchToken(context.Background(), "https://mycluster.kusto.windows.net")
+	require.NoError(t, err)
+	// The refresh token expired, so the user is asked to sign in again.
+	_, _, err = config.fetchToken(context.Background(), "https://mycluster.kusto.windows.net")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"refresh1"}, aad.refreshes)
+	assert.Equal(t, 2, aad.deviceCodes)
+	assert.Equal(t, "Enter CODE1 at https://microsoft.com/devicelogin\nEnter CODE2 at https://microsoft.com/devicelogin\n", out.String())
+}
+
+func TestDeviceCodeErrors(t *testing.T) {
+	t.Parallel()
+
+	// The user never signs in, so the call gives up when its context is done.
+	aad := &fakeAAD{pending: 1 << 30}
+	server := httptest.NewServer(aad)
+	defer server.Close()
+
+	config := &DeviceCodeConfig{TenantID: "tenant", Prompt: func(DeviceCode) {}, authorityHost: server.URL, interval: time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := config.fetchToken(ctx, "https://mycluster.kusto.windows.net")
+	require.Error(t, err)
+	var e *errors.Error
+	require.True(t, goErrors.As(err, &e))
+	assert.Equal(t, errors.KAuth, e.Kind)
+	assert.True(t, goErrors.Is(err, context.DeadlineExceeded))
+
+	// The identity service refuses the application.
+	config = &DeviceCodeConfig{ClientID: "other", TenantID: "tenant", authorityHost: server.URL}
+	_, _, err = config.fetchToken(context.Background(), "https://mycluster.kusto.windows.net")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "could not start the device code sign in: invalid_client: bad client")
+	require.True(t, goErrors.As(err, &e))
+	assert.Equal(t, errors.KAuth, e.Kind)
+}
@@ -27,6 +27,14 @@ To begin using this package, create an Authorizer and a client targeting your Ku
 	}
 For more examples on ways to create an Authorization object, see the Authorization object documentation.
 
+A Client can also be made from a Kusto connection string, the format that the Kusto SDKs of other languages share:
+	kcsb, err := kusto.NewConnectionStringBuilder("Data Source=https://mycluster.kusto.windows.net;MSI Authentication=true")
+	if err != nil {
+		panic("add error handling")
+	}
+
+	client, err := kusto.NewFromConnectionString(kcsb)
+
 
 Querying for Rows
 
@@ -121,7 +129,7 @@ The following is a conversion table from the Kusto column types to native Go val
 	------------------------------------------------------------------------------
 	timestamp			value.Timestamp, time.Duration, *time.Duration
 	------------------------------------------------------------------------------
-	decimal				value.Decimal, string, *string
+	decimal				value.Decimal, string, *string, big.Float, *big.Float, big.Rat, *big.Rat
 	==============================================================================
 
 For more information on Kusto scalar types, see: https://docs.microsoft.com/en-us/azure/kusto/query/scalar-data-types/
@@ -0,0 +1,250 @@
+package kusto
+
+// export.go holds the helpers of RowIterator that write the rows of the primary result as JSON or CSV.
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+)
+
+// ExportOption is an optional argument to ToJSON() and ToCSV().
+type ExportOption func(o *exportOptions)
+
+type exportOptions struct {
+	ndjson bool
+	crlf   bool
+}
+
+// ExportNDJSON makes ToJSON() write a JSON object per line, without the array around them. It is ignored by ToCSV().
+func ExportNDJSON() ExportOption {
+	return func(o *exportOptions) {
+		o.ndjson = true
+	}
+}
+
+// ExportCRLF makes ToCSV() end the lines with \r\n, as RFC 4180 does, instead of \n. It is ignored by ToJSON().
+func ExportCRLF() ExportOption {
+	return func(o *exportOptions) {
+		o.crlf = true
+	}
+}
+
+// ToJSON writes the rows to w as a JSON array of objects, one per line, whose keys are the names of the columns in
+// their order. Each row is written once it is read, so the result is never held in memory. Values are written as the
+// service sends them: nulls are null, bools, ints, longs and reals are JSON values, decimals, datetimes, timespans
+// and guids are strings, and dynamics are their JSON. Reals that are not numbers are "NaN", "Infinity" or
+// "-Infinity", and datetimes are RFC 3339 in UTC.
+//
+// ToJSON stops with the error of the RowIterator, or with an error of a row, and w then holds the rows before it,
+// without the end of the array. A progressive query whose rows replace the ones written fails as well.
+func (r *RowIterator) ToJSON(w io.Writer, options ...ExportOption) error {
+	o := exportOptions{}
+	for _, option := range options {
+		option(&o)
+	}
+
+	cols, err := r.Columns()
+	if err != nil {
+		return err
+	}
+	keys := make([][]byte, len(cols))
+	for i, col := range cols {
+		// Marshaling a string cannot fail.
+		key, _ := json.Marshal(col.Name)
+		keys[i] = append(key, ':')
+	}
+
+	buf := &bytes.Buffer{}
+	written := 0
+	err = r.export("ToJSON", func(row *table.Row) error {
+		buf.Reset()
+		switch {
+		case o.ndjson:
+		case written == 0:
+			buf.WriteString("[\n")
+		default:
+			buf.WriteString(",\n")
+		}
+		buf.WriteByte('{')
+		for i, v := range row.Values {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(keys[i])
+			writeJSONValue(buf, v)
+		}
+		buf.WriteByte('}')
+		if o.ndjson {
+			buf.WriteByte('\n')
+		}
+		written++
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case o.ndjson:
+		return nil
+	case written == 0:
+		_, err = io.WriteString(w, "[]\n")
+	default:
+		_, err = io.WriteString(w, "\n]\n")
+	}
+	if err != nil {
+		return errors.E(r.op, errors.KIO, err)
+	}
+	return nil
+}
+
+// ToCSV writes the rows to w as CSV, after a header with the names of the columns. Fields are quoted as RFC 4180
+// says, when they have a comma, a quote or a line break. Each row is written once it is read, so the result is never
+// held in memory. Values are written as ToJSON() does, without quotes: nulls are empty fields, as are empty strings,
+// and dynamics are their JSON.
+//
+// ToCSV stops with an error as ToJSON() does, and w then holds the rows before it.
+func (r *RowIterator) ToCSV(w io.Writer, options ...ExportOption) error {
+	o := exportOptions{}
+	for _, option := range options {
+		option(&o)
+	}
+
+	cols, err := r.Columns()
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = o.crlf
+	record := make([]string, len(cols))
+	for i, col := range cols {
+		record[i] = col.Name
+	}
+	if err := cw.Write(record); err != nil {
+		return errors.E(r.op, errors.KIO, err)
+	}
+
+	err = r.export("ToCSV", func(row *table.Row) error {
+		for i, v := range row.Values {
+			record[i] = textValue(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+		// The writer is flushed for every row, so that the rows are streamed, and the ones before an error are kept.
+		cw.Flush()
+		return cw.Error()
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return errors.E(r.op, errors.KIO, err)
+	}
+	return nil
+}
+
+// export calls write for every row of r, for method. The errors of write are errors to write the output.
+func (r *RowIterator) export(method string, write func(row *table.Row) error) error {
+	written := false
+	for {
+		row, inlineErr, err := r.NextRowOrError()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if inlineErr != nil {
+			return inlineErr
+		}
+		if row.Replace && written {
+			return errors.ES(r.op, errors.KClientArgs, "%s() cannot replace the rows it wrote, which a progressive query asks for", method).SetNoRetry()
+		}
+		if err := write(row); err != nil {
+			return errors.E(r.op, errors.KIO, err)
+		}
+		written = true
+	}
+}
+
+// writeJSONValue writes v to buf as the service does in JSON.
+func writeJSONValue(buf *bytes.Buffer, v value.Kusto) {
+	if v == nil || !v.HasValue() {
+		buf.WriteString("null")
+		return
+	}
+	switch v := v.(type) {
+	case value.Bool, value.Int, value.Long:
+		buf.WriteString(v.String())
+	case value.Real:
+		s := realText(v.Value)
+		if math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+			writeJSONString(buf, s)
+			return
+		}
+		buf.WriteString(s)
+	case value.Dynamic:
+		// A dynamic is written on one line, as its JSON, or as a string if it is not JSON.
+		if err := json.Compact(buf, v.Value); err != nil {
+			writeJSONString(buf, string(v.Value))
+		}
+	default:
+		writeJSONString(buf, textValue(v))
+	}
+}
+
+// writeJSONString writes s to buf as a JSON string.
+func writeJSONString(buf *bytes.Buffer, s string) {
+	// Marshaling a string cannot fail.
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
+
+// textValue returns v as text, which is "" for nulls.
+func textValue(v value.Kusto) string {
+	if v == nil || !v.HasValue() {
+		return ""
+	}
+	switch v := v.(type) {
+	case value.Real:
+		return realText(v.Value)
+	case value.DateTime:
+		return v.Value.UTC().Format(time.RFC3339Nano)
+	case value.Timespan:
+		return v.Marshal()
+	case value.Dynamic:
+		b := &bytes.Buffer{}
+		if err := json.Compact(b, v.Value); err != nil {
+			return string(v.Value)
+		}
+		return b.String()
+	}
+	return v.String()
+}
+
+// realText returns f as the shortest text that parses back to it, with the names that the service uses for the
+// values that are not numbers.
+func realText(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,193 @@
+package kusto
+
+import (
+	"bytes"
+	goErrors "errors"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exportColumns are a column of every type.
+var exportColumns = table.Columns{
+	{Name: "Bool", Type: types.Bool},
+	{Name: "Int", Type: types.Int},
+	{Name: "Long", Type: types.Long},
+	{Name: "Real", Type: types.Real},
+	{Name: "Decimal", Type: types.Decimal},
+	{Name: "String", Type: types.String},
+	{Name: "Dynamic", Type: types.Dynamic},
+	{Name: "DateTime", Type: types.DateTime},
+	{Name: "Timespan", Type: types.Timespan},
+	{Name: "GUID", Type: types.GUID},
+}
+
+// exportRows returns a RowIterator of rows with all the types, with nulls and with values to quote, followed by err
+// if it is set.
+func exportRows(t *testing.T, err error) *RowIterator {
+	m, e := NewMockRows(exportColumns)
+	require.NoError(t, e)
+
+	rows := []value.Values{
+		{
+			value.Bool{Value: true, Valid: true},
+			value.Int{Value: -7, Valid: true},
+			value.Long{Value: math.MaxInt64, Valid: true},
+			value.Real{Value: 1.5, Valid: true},
+			value.Decimal{Value: "79228162514264337593543950335.1", Valid: true},
+			value.String{Value: "hello", Valid: true},
+			value.Dynamic{Value: []byte(`{"a": [1, 2.5, "x"],
+				"b": {"c": null}}`), Valid: true},
+			value.DateTime{Value: time.Date(2021, 3, 4, 5, 6, 7, 100, time.FixedZone("", 3600)), Valid: true},
+			value.Timespan{Value: 26*time.Hour + 3*time.Minute + 4*time.Second + 500*time.Millisecond, Valid: true},
+			value.GUID{Value: uuid.MustParse("3f6a0f5d-6b41-4a0e-8a43-b6b1c5b25c4f"), Valid: true},
+		},
+		{
+			value.Bool{},
+			value.Int{},
+			value.Long{},
+			value.Real{},
+			value.Decimal{},
+			value.String{},
+			value.Dynamic{},
+			value.DateTime{},
+			value.Timespan{},
+			value.GUID{},
+		},
+		{
+			value.Bool{Value: false, Valid: true},
+			value.Int{Value: 0, Valid: true},
+			value.Long{Value: -1, Valid: true},
+			value.Real{Value: math.NaN(), Valid: true},
+			value.Decimal{Value: "-0.001", Valid: true},
+			value.String{Value: "a \"quoted\", multi-line\nstring", Valid: true},
+			value.Dynamic{Value: []byte(`"a string, with a comma"`), Valid: true},
+			value.DateTime{Value: time.Date(1999, 12, 31, 23, 59, 59, 0, time.UTC), Valid: true},
+			value.Timespan{Value: -90 * time.Second, Valid: true},
+			value.GUID{Value: uuid.Nil, Valid: true},
+		},
+		{
+			value.Bool{Value: true, Valid: true},
+			value.Int{Value: math.MaxInt32, Valid: true},
+			value.Long{Value: math.MinInt64, Valid: true},
+			value.Real{Value: math.Inf(-1), Valid: true},
+			value.Decimal{Value: "1E-10", Valid: true},
+			value.String{Value: "", Valid: true},
+			value.Dynamic{Value: []byte(`not JSON`), Valid: true},
+			value.DateTime{Value: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), Valid: true},
+			value.Timespan{Value: 0, Valid: true},
+			value.GUID{Value: uuid.MustParse("00000000-0000-0000-0000-000000000001"), Valid: true},
+		},
+	}
+	for _, row := range rows {
+		require.NoError(t, m.Row(row))
+	}
+	if err != nil {
+		require.NoError(t, m.Error(err))
+	}
+
+	iter := &RowIterator{}
+	require.NoError(t, iter.Mock(m))
+	return iter
+}
+
+// TestExportGolden compares the output of ToJSON() and ToCSV() to the files in testdata, so changes to the formats
+// are seen in review.
+func TestExportGolden(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		golden string
+		export func(iter *RowIterator, w *bytes.Buffer) error
+	}{
+		{
+			golden: "export.json",
+			export: func(iter *RowIterator, w *bytes.Buffer) error { return iter.ToJSON(w) },
+		},
+		{
+			golden: "export.ndjson",
+			export: func(iter *RowIterator, w *bytes.Buffer) error { return iter.ToJSON(w, ExportNDJSON()) },
+		},
+		{
+			golden: "export.csv",
+			export: func(iter *RowIterator, w *bytes.Buffer) error { return iter.ToCSV(w) },
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.golden, func(t *testing.T) {
+			t.Parallel()
+
+			iter := exportRows(t, nil)
+			defer iter.Stop()
+			got := &bytes.Buffer{}
+			require.NoError(t, test.export(iter, got))
+
+			want, err := ioutil.ReadFile(filepath.Join("testdata", test.golden))
+			require.NoError(t, err)
+			assert.Equal(t, string(want), got.String())
+		})
+	}
+}
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+
+	// A result without rows.
+	m, err := NewMockRows(table.Columns{{Name: "x", Type: types.Long}, {Name: "y, z", Type: types.String}})
+	require.NoError(t, err)
+	iter := &RowIterator{}
+	require.NoError(t, iter.Mock(m))
+	got := &bytes.Buffer{}
+	require.NoError(t, iter.ToJSON(got))
+	assert.Equal(t, "[]\n", got.String())
+
+	m, err = NewMockRows(table.Columns{{Name: "x", Type: types.Long}, {Name: "y, z", Type: types.String}})
+	require.NoError(t, err)
+	iter = &RowIterator{}
+	require.NoError(t, iter.Mock(m))
+	got.Reset()
+	require.NoError(t, iter.ToCSV(got, ExportCRLF()))
+	assert.Equal(t, "x,\"y, z\"\r\n", got.String())
+
+	// The rows before an error of the RowIterator are written.
+	queryErr := errors.ES(errors.OpQuery, errors.KInternal, "the query failed")
+
+	got.Reset()
+	err = exportRows(t, queryErr).ToJSON(got)
+	assert.True(t, goErrors.Is(err, queryErr))
+	want, err := ioutil.ReadFile(filepath.Join("testdata", "export.json"))
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimSuffix(string(want), "\n]\n"), got.String(), "the array is not ended")
+
+	got.Reset()
+	err = exportRows(t, queryErr).ToCSV(got)
+	assert.True(t, goErrors.Is(err, queryErr))
+	want, err = ioutil.ReadFile(filepath.Join("testdata", "export.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, string(want), got.String())
+
+	// The errors of the writer are returned.
+	err = exportRows(t, nil).ToJSON(failingWriter{})
+	assert.Equal(t, errors.KIO, errors.KindOf(err))
+	err = exportRows(t, nil).ToCSV(failingWriter{})
+	assert.Equal(t, errors.KIO, errors.KindOf(err))
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, goErrors.New("disk full")
+}
@@ -0,0 +1,280 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+)
+
+const (
+	// defaultBatchBytes is the default size of a batch of a StreamBatcher, before compression.
+	defaultBatchBytes = 1 * mb
+	// defaultBatchLatency is the default time a record waits in a StreamBatcher before its batch is sent.
+	defaultBatchLatency = time.Second
+)
+
+// BatcherClosedErr is returned by the methods of a StreamBatcher after Close() was called.
+var BatcherClosedErr = errors.ES(errors.OpIngestStream, errors.KClientArgs, "the stream batcher is closed").SetNoRetry()
+
+// BatchOption is an optional argument to NewStreamBatcher().
+type BatchOption func(b *StreamBatcher)
+
+// WithMaxBatchBytes sets the largest batch, before compression, that the StreamBatcher sends. A batch is sent as soon
+// as the next record would take it over maxBytes. The default is 1 MiB, and maxBytes cannot be over what fits the
+// streaming size limit of the client once compressed.
+func WithMaxBatchBytes(maxBytes int) BatchOption {
+	return func(b *StreamBatcher) {
+		b.maxBytes = maxBytes
+	}
+}
+
+// WithMaxBatchLatency sets how long a record waits for more records before its batch is sent. The default is 1 second.
+func WithMaxBatchLatency(d time.Duration) BatchOption {
+	return func(b *StreamBatcher) {
+		b.maxLatency = d
+	}
+}
+
+// WithBatchMappingRef sets the name of the ingestion mapping that the batches are ingested with. The mapping must be
+// of the kind that suits the format of the StreamBatcher.
+func WithBatchMappingRef(name string) BatchOption {
+	return func(b *StreamBatcher) {
+		b.mappingRef = name
+	}
+}
+
+// WithBatchErrorHandler sets a function that gets each batch that failed to be sent, with the error, such as to
+// ingest it with queued ingestion instead. It is called from the goroutine that sent the batch, one batch at a time.
+func WithBatchErrorHandler(handler func(batch []byte, err error)) BatchOption {
+	return func(b *StreamBatcher) {
+		b.onError = handler
+	}
+}
+
+// StreamBatcher gathers records into batches that are sent with a Streaming client, for data that comes one record
+// at a time. A batch is sent when the next record would take it over the max batch size, when its first record
+// waited for the max latency, on Flush() and on Close(). Records are never split across batches.
+// Batches are sent one at a time, in the order they were made. Failed batches are passed to the handler set with
+// WithBatchErrorHandler(). Without one, the error is returned by the call that sent the batch, or, for a batch sent
+// after the max latency, by the next call. Methods are safe for concurrent use.
+type StreamBatcher struct {
+	s       *Streaming
+	options []FileOption
+
+	maxBytes   int
+	maxLatency time.Duration
+	mappingRef string
+	onError    func(batch []byte, err error)
+
+	mu     sync.Mutex
+	buf    []byte
+	timer  *time.Timer
+	gen    int
+	err    error
+	closed bool
+
+	// sendMu makes batches go one at a time, and timers tracks the pending timers.
+	sendMu sync.Mutex
+	timers sync.WaitGroup
+}
+
+// NewStreamBatcher creates a StreamBatcher that sends records of format with s. format must be a delimited text
+// format or JSON, where each record is on its own line, or MultiJSON. Streaming JSON requires a mapping reference,
+// set with WithBatchMappingRef().
+func NewStreamBatcher(s *Streaming, format DataFormat, options ...BatchOption) (*StreamBatcher, error) {
+	b := &StreamBatcher{
+		s:          s,
+		maxBytes:   defaultBatchBytes,
+		maxLatency: defaultBatchLatency,
+	}
+	for _, option := range options {
+		option(b)
+	}
+
+	if !isRecordFormat(format) {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "NewStreamBatcher(): format %s cannot be batched, only delimited text and JSON formats can", format.CamelCase()).SetNoRetry()
+	}
+	limit := s.maxPayloadSize
+	if limit == 0 {
+		limit = maxStreamingSize
+	}
+	// Deflate never grows data by more than a few bytes per 64 KiB block, so this is under the limit once compressed.
+	if maxBytes := limit - limit/1024 - gzipTail; b.maxBytes <= 0 || int64(b.maxBytes) > maxBytes {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "WithMaxBatchBytes(%d): must be between 1 and %d", b.maxBytes, maxBytes).SetNoRetry()
+	}
+	if b.maxLatency <= 0 {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "WithMaxBatchLatency(%s): must be positive", b.maxLatency).SetNoRetry()
+	}
+
+	b.options = []FileOption{FileFormat(format)}
+	if b.mappingRef != "" {
+		b.options = append(b.options, IngestionMappingRef(b.mappingRef, format.MappingKind()))
+	}
+	props := properties.All{}
+	for _, option := range b.options {
+		if err := option.Run(&props, StreamingClient, FromReader); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateStreamMapping(props); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Add adds record to the current batch, first sending the batch if record would take it over the max batch size.
+// A newline is added to record if it does not end with one. A record larger than the max batch size by itself is
+// refused with an error of Kind errors.KPayloadTooLarge. Add does not keep record. If sending a batch failed, record
+// is still added to the next batch.
+func (b *StreamBatcher) Add(ctx context.Context, record []byte) error {
+	if len(record) == 0 {
+		return nil
+	}
+	size := len(record)
+	if record[len(record)-1] != '\n' {
+		size++
+	}
+	if size > b.maxBytes {
+		return errors.ES(errors.OpIngestStream, errors.KPayloadTooLarge, "a record of %d bytes is larger than the max batch size of %d bytes", size, b.maxBytes).SetNoRetry()
+	}
+
+	var sendErr error
+	b.mu.Lock()
+	for {
+		if b.closed {
+			b.mu.Unlock()
+			return BatcherClosedErr
+		}
+		if len(b.buf)+size <= b.maxBytes {
+			break
+		}
+		batch := b.take()
+		b.mu.Unlock()
+		if err := b.send(ctx, batch); err != nil {
+			sendErr = err
+		}
+		b.mu.Lock()
+	}
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, record...)
+	if size > len(record) {
+		b.buf = append(b.buf, '\n')
+	}
+	if b.timer == nil {
+		b.startTimer()
+	}
+	if err := b.pendingErr(); sendErr == nil {
+		sendErr = err
+	}
+	return sendErr
+}
+
+// Flush sends the current batch, if any.
+func (b *StreamBatcher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return BatcherClosedErr
+	}
+	batch := b.take()
+	err := b.pendingErr()
+	b.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return b.send(ctx, batch)
+}
+
+// Close sends the current batch, if any, and waits for batches being sent. Later calls fail with BatcherClosedErr.
+// Close does not close the Streaming client.
+func (b *StreamBatcher) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return BatcherClosedErr
+	}
+	b.closed = true
+	batch := b.take()
+	b.mu.Unlock()
+
+	err := b.send(ctx, batch)
+	b.timers.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return b.pendingErr()
+}
+
+// take returns the current batch and starts a new one. b.mu must be held.
+func (b *StreamBatcher) take() []byte {
+	batch := b.buf
+	b.buf = nil
+	if b.timer != nil && b.timer.Stop() {
+		b.timers.Done()
+	}
+	b.timer = nil
+	b.gen++
+	return batch
+}
+
+// startTimer sends the current batch once it waited for the max latency. b.mu must be held.
+func (b *StreamBatcher) startTimer() {
+	gen := b.gen
+	b.timers.Add(1)
+	b.timer = time.AfterFunc(b.maxLatency, func() {
+		defer b.timers.Done()
+
+		b.mu.Lock()
+		if gen != b.gen {
+			// The batch was sent already.
+			b.mu.Unlock()
+			return
+		}
+		b.timer = nil
+		batch := b.take()
+		b.mu.Unlock()
+
+		if err := b.send(context.Background(), batch); err != nil {
+			b.mu.Lock()
+			b.err = err
+			b.mu.Unlock()
+		}
+	})
+}
+
+// pendingErr returns and forgets the error of a batch sent after the max latency. b.mu must be held.
+func (b *StreamBatcher) pendingErr() error {
+	err := b.err
+	b.err = nil
+	return err
+}
+
+// send streams batch. It returns the error if the batch failed and there is no error handler.
+func (b *StreamBatcher) send(ctx context.Context, batch []byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+
+	_, err := b.s.FromReader(ctx, bytes.NewReader(batch), b.options...)
+	if err == nil {
+		return nil
+	}
+	if b.onError != nil {
+		b.onError(batch, err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+package ingest
+
+import (
+	stdgzip "compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchRecorder is a Streaming client that records the batches it gets, uncompressed.
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches []string
+	mapping []string
+	fail    error
+}
+
+func (r *batchRecorder) streaming() *Streaming {
+	return &Streaming{
+		db:    "db",
+		table: "table",
+		streamConn: fakeStreamIngestor{
+			onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+				zr, err := stdgzip.NewReader(payload)
+				if err != nil {
+					return err
+				}
+				b, err := ioutil.ReadAll(zr)
+				if err != nil {
+					return err
+				}
+
+				r.mu.Lock()
+				defer r.mu.Unlock()
+				r.batches = append(r.batches, string(b))
+				r.mapping = append(r.mapping, mappingName)
+				return r.fail
+			},
+		},
+	}
+}
+
+func (r *batchRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.batches...)
+}
+
+func TestStreamBatcher(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	tests := []struct {
+		desc    string
+		options []BatchOption
+		records []string
+		want    []string
+	}{
+		{
+			desc:    "Close flushes",
+			records: []string{"a,1", "b,2\n", "c,3"},
+			want:    []string{"a,1\nb,2\nc,3\n"},
+		},
+		{
+			desc:    "Batches by size without splitting records",
+			options: []BatchOption{WithMaxBatchBytes(8)},
+			records: []string{"a,1", "b,2", "c,3", "dddddd"},
+			want:    []string{"a,1\nb,2\n", "c,3\n", "dddddd\n"},
+		},
+		{
+			desc:    "A record of exactly the batch size",
+			options: []BatchOption{WithMaxBatchBytes(4)},
+			records: []string{"a,1", "b,2"},
+			want:    []string{"a,1\n", "b,2\n"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			rec := &batchRecorder{}
+			b, err := NewStreamBatcher(rec.streaming(), CSV, test.options...)
+			require.NoError(t, err)
+
+			for _, r := range test.records {
+				require.NoError(t, b.Add(ctx, []byte(r)))
+			}
+			require.NoError(t, b.Close(ctx))
+
+			assert.Equal(t, test.want, rec.get())
+			assert.Equal(t, BatcherClosedErr, b.Add(ctx, []byte("x")))
+			assert.Equal(t, BatcherClosedErr, b.Close(ctx))
+		})
+	}
+}
+
+func TestStreamBatcherLatency(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	rec := &batchRecorder{}
+	b, err := NewStreamBatcher(rec.streaming(), CSV, WithMaxBatchLatency(10*time.Millisecond))
+	require.NoError(t, err)
+
+	require.NoError(t, b.Add(ctx, []byte("a,1")))
+	require.NoError(t, b.Add(ctx, []byte("b,2")))
+	require.Eventually(t, func() bool { return len(rec.get()) == 1 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"a,1\nb,2\n"}, rec.get())
+
+	require.NoError(t, b.Add(ctx, []byte("c,3")))
+	require.NoError(t, b.Flush(ctx))
+	require.NoError(t, b.Close(ctx))
+	assert.Equal(t, []string{"a,1\nb,2\n", "c,3\n"}, rec.get())
+}
+
+func TestStreamBatcherConcurrent(t *testing.T) {
+	t.Parallel()
+
+	const writers, perWriter = 8, 200
+
+	ctx := context.Background()
+	rec := &batchRecorder{}
+	b, err := NewStreamBatcher(rec.streaming(), JSON, WithMaxBatchBytes(512), WithMaxBatchLatency(time.Millisecond), WithBatchMappingRef("map"))
+	require.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				assert.NoError(t, b.Add(ctx, []byte(fmt.Sprintf(`{"w":%d,"i":%d}`, w, i))))
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, b.Close(ctx))
+
+	seen := map[string]bool{}
+	for _, batch := range rec.get() {
+		assert.LessOrEqual(t, len(batch), 512)
+		assert.True(t, strings.HasSuffix(batch, "\n"))
+		for _, line := range strings.Split(strings.TrimSuffix(batch, "\n"), "\n") {
+			assert.False(t, seen[line], "record %s sent twice", line)
+			seen[line] = true
+		}
+	}
+	assert.Len(t, seen, writers*perWriter)
+	for _, m := range rec.mapping {
+		assert.Equal(t, "map", m)
+	}
+}
+
+func TestStreamBatcherErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	failure := errors.ES(errors.OpIngestStream, errors.KHTTPError, "failed")
+
+	t.Run("Handler gets the failed batch", func(t *testing.T) {
+		t.Parallel()
+
+		rec := &batchRecorder{fail: failure}
+		var failed []string
+		b, err := NewStreamBatcher(rec.streaming(), CSV, WithMaxBatchBytes(4), WithBatchErrorHandler(func(batch []byte, err error) {
+			assert.Equal(t, failure, err)
+			failed = append(failed, string(batch))
+		}))
+		require.NoError(t, err)
+
+		require.NoError(t, b.Add(ctx, []byte("a,1")))
+		require.NoError(t, b.Add(ctx, []byte("b,2")))
+		require.NoError(t, b.Close(ctx))
+		assert.Equal(t, []string{"a,1\n", "b,2\n"}, failed)
+	})
+
+	t.Run("Without a handler the error is returned", func(t *testing.T) {
+		t.Parallel()
+
+		rec := &batchRecorder{fail: failure}
+		b, err := NewStreamBatcher(rec.streaming(), CSV, WithMaxBatchBytes(4))
+		require.NoError(t, err)
+
+		require.NoError(t, b.Add(ctx, []byte("a,1")))
+		assert.Equal(t, failure, b.Add(ctx, []byte("b,2")))
+		assert.Equal(t, failure, b.Flush(ctx))
+	})
+
+	t.Run("A latency flush error is returned by the next call", func(t *testing.T) {
+		t.Parallel()
+
+		rec := &batchRecorder{fail: failure}
+		b, err := NewStreamBatcher(rec.streaming(), CSV, WithMaxBatchLatency(time.Millisecond))
+		require.NoError(t, err)
+
+		require.NoError(t, b.Add(ctx, []byte("a,1")))
+		require.Eventually(t, func() bool { return len(rec.get()) == 1 }, 5*time.Second, time.Millisecond)
+		assert.Equal(t, failure, b.Close(ctx))
+	})
+
+	t.Run("Oversized record", func(t *testing.T) {
+		t.Parallel()
+
+		rec := &batchRecorder{}
+		b, err := NewStreamBatcher(rec.streaming(), CSV, WithMaxBatchBytes(4))
+		require.NoError(t, err)
+
+		err = b.Add(ctx, []byte("aaaa"))
+		require.Error(t, err)
+		assert.Equal(t, errors.KPayloadTooLarge, err.(*errors.Error).Kind)
+		require.NoError(t, b.Close(ctx))
+		assert.Empty(t, rec.get())
+	})
+}
+
+func TestNewStreamBatcherOptions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		format  DataFormat
+		options []BatchOption
+	}{
+		{desc: "Parquet cannot be batched", format: Parquet},
+		{desc: "JSON requires a mapping", format: JSON},
+		{desc: "Zero batch size", format: CSV, options: []BatchOption{WithMaxBatchBytes(0)}},
+		{desc: "Batch size over the streaming limit", format: CSV, options: []BatchOption{WithMaxBatchBytes(maxStreamingSize)}},
+		{desc: "Zero latency", format: CSV, options: []BatchOption{WithMaxBatchLatency(0)}},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := NewStreamBatcher((&batchRecorder{}).streaming(), test.format, test.options...)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+)
+
+// gzipTail is more than the bytes that closing a flushed gzip stream adds: an empty final block and the trailer.
+const gzipTail = 16
+
+// recordReader splits a payload into records, each returned with its delimiter.
+type recordReader interface {
+	next() ([]byte, error)
+}
+
+// newRecordReader returns the recordReader for format, or an error if payloads of format cannot be split on
+// record boundaries.
+func newRecordReader(r io.Reader, format DataFormat) (recordReader, error) {
+	br := bufio.NewReader(r)
+	switch format {
+	case CSV, PSV, SCSV, SOHSV:
+		return &lineReader{r: br, quoted: true}, nil
+	case TSV, TSVE, TXT, JSON:
+		return &lineReader{r: br}, nil
+	case MultiJSON:
+		return newJSONReader(br), nil
+	}
+	return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "format %s cannot be split on record boundaries, auto chunking supports only delimited text and JSON formats", format.CamelCase()).SetNoRetry()
+}
+
+// isRecordFormat reports if payloads of format are a sequence of records that can be split and joined.
+func isRecordFormat(format DataFormat) bool {
+	switch format {
+	case CSV, PSV, SCSV, SOHSV, TSV, TSVE, TXT, JSON, MultiJSON:
+		return true
+	}
+	return false
+}
+
+// lineReader reads records delimited by "\n". If quoted is set, delimiters inside a double quoted field don't end
+// the record.
+type lineReader struct {
+	r      *bufio.Reader
+	quoted bool
+}
+
+func (l *lineReader) next() ([]byte, error) {
+	var rec []byte
+	for {
+		line, err := l.r.ReadBytes('\n')
+		rec = append(rec, line...)
+		if err != nil {
+			if err == io.EOF && len(rec) > 0 {
+				// The last record may not end with a delimiter, but it is followed by others once chunked.
+				return append(rec, '\n'), nil
+			}
+			return nil, err
+		}
+		// An escaped quote is doubled, so an odd number of quotes means a field is still open.
+		if !l.quoted || bytes.Count(rec, []byte{'"'})%2 == 0 {
+			return rec, nil
+		}
+	}
+}
+
+// jsonReader reads the records of a MultiJSON payload: concatenated JSON documents, where a document that is
+// an array holds one record per element. Arrays are read element by element, so they are never held as a whole.
+type jsonReader struct {
+	r       *bufio.Reader
+	dec     *json.Decoder
+	inArray bool
+}
+
+func newJSONReader(r *bufio.Reader) *jsonReader {
+	return &jsonReader{r: r, dec: json.NewDecoder(r)}
+}
+
+func (j *jsonReader) next() ([]byte, error) {
+	for {
+		if j.inArray {
+			if !j.dec.More() {
+				if _, err := j.dec.Token(); err != nil { // The closing ']'.
+					return nil, err
+				}
+				j.inArray = false
+				continue
+			}
+		} else {
+			c, err := j.peek()
+			if err != nil {
+				return nil, err
+			}
+			if c == '[' {
+				if _, err := j.dec.Token(); err != nil {
+					return nil, err
+				}
+				j.inArray = true
+				continue
+			}
+		}
+
+		var raw json.RawMessage
+		if err := j.dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		return append(raw, '\n'), nil
+	}
+}
+
+// peek returns the first byte of the next document, looking first at what the decoder already buffered.
+func (j *jsonReader) peek() (byte, error) {
+	buffered := j.dec.Buffered()
+	b := []byte{0}
+	for {
+		if _, err := buffered.Read(b); err != nil {
+			break
+		}
+		if !isJSONSpace(b[0]) {
+			return b[0], nil
+		}
+	}
+
+	// Only whitespace is left in the decoder, which can be skipped in the input it reads next.
+	for {
+		c, err := j.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if !isJSONSpace(c) {
+			return c, j.r.UnreadByte()
+		}
+	}
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// chunker gathers records into chunks that are under limit bytes once compressed.
+type chunker struct {
+	limit int64
+
+	raw bytes.Buffer
+	z   bytes.Buffer
+	zw  *gzip.Writer
+	// unflushed is the number of bytes written to zw since it was last flushed, which may not be in z yet.
+	unflushed int64
+}
+
+func newChunker(limit int64, level int) *chunker {
+	c := &chunker{limit: limit}
+	// The level was validated by the CompressionLevel() option.
+	c.zw, _ = gzip.NewWriterLevel(&c.z, level)
+	return c
+}
+
+// add adds rec to the current chunk. It returns false, leaving the chunk as it was, if the chunk would then go
+// over the limit.
+func (c *chunker) add(rec []byte) (bool, error) {
+	before := c.raw.Len()
+	c.raw.Write(rec)
+	if _, err := c.zw.Write(rec); err != nil {
+		return false, err
+	}
+	c.unflushed += int64(len(rec))
+
+	// Flushing costs some compression, so it is only done once the size could be over the limit: deflate never
+	// grows data by more than a few bytes per 64 KiB block.
+	if int64(c.z.Len())+c.unflushed+c.unflushed/1024+gzipTail <= c.limit {
+		return true, nil
+	}
+	if err := c.zw.Flush(); err != nil {
+		return false, err
+	}
+	c.unflushed = 0
+	if int64(c.z.Len())+gzipTail <= c.limit {
+		return true, nil
+	}
+
+	c.raw.Truncate(before)
+	return false, nil
+}
+
+// len returns the uncompressed size of the current chunk.
+func (c *chunker) len() int {
+	return c.raw.Len()
+}
+
+// flush returns the current chunk, compressed, and starts a new one.
+func (c *chunker) flush() ([]byte, error) {
+	// The records were written to zw and then maybe removed from raw, so the chunk is compressed again.
+	var out bytes.Buffer
+	c.zw.Reset(&out)
+	if _, err := c.zw.Write(c.raw.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := c.zw.Close(); err != nil {
+		return nil, err
+	}
+
+	c.raw.Reset()
+	c.z.Reset()
+	c.zw.Reset(&c.z)
+	c.unflushed = 0
+	return out.Bytes(), nil
+}
+
+// streamChunks streams payload in chunks of whole records that are under limit bytes once compressed, one after
+// the other, with send. The Result it returns lists the Result of each chunk.
+func streamChunks(send sendFunc, ctx context.Context, payload io.Reader, props properties.All, limit int64) (*Result, error) {
+	if !props.Source.ShouldCompress() {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "auto chunking needs an uncompressed source to find the record boundaries").SetNoRetry()
+	}
+	if props.Ingestion.Additional.Format == DFUnknown {
+		props.Ingestion.Additional.Format = CSV
+	}
+	records, err := newRecordReader(payload, props.Ingestion.Additional.Format)
+	if err != nil {
+		return nil, err
+	}
+	defaultClientRequestId(&props)
+
+	// Each chunk is its own request, and the source is deleted only once all of them succeeded.
+	chunkProps := props
+	chunkProps.Source.Compression = properties.GZIP
+	chunkProps.Source.DeleteLocalSource = false
+	chunkProps.Streaming.MaxPayloadSize = limit
+
+	agg := newResult()
+	agg.putProps(props)
+	agg.method = StreamingIngestion
+	agg.bytesRead, agg.bytesUploaded = 0, 0
+	agg.clientRequestId = props.Streaming.ClientRequestId
+
+	sendChunk := func(chunk []byte, size int) error {
+		chunkProps.Streaming.ClientRequestId = fmt.Sprintf("%s;%d", props.Streaming.ClientRequestId, len(agg.chunks))
+		result, err := send(ctx, bytes.NewReader(chunk), chunkProps)
+		if err != nil {
+			outer := errors.ES(errors.OpIngestStream, errors.KOther, "chunk %d failed, the chunks before it were ingested", len(agg.chunks))
+			if e, ok := err.(*errors.Error); ok {
+				outer.Kind = e.Kind
+				return errors.W(e, outer)
+			}
+			return errors.W(errors.E(errors.OpIngestStream, errors.KOther, err), outer)
+		}
+		result.bytesRead = int64(size)
+		agg.bytesRead += result.bytesRead
+		agg.bytesUploaded += result.bytesUploaded
+		agg.chunks = append(agg.chunks, result)
+		return nil
+	}
+
+	chunks := newChunker(limit, props.Source.GzipLevel())
+	flush := func() error {
+		size := chunks.len()
+		chunk, err := chunks.flush()
+		if err != nil {
+			return errors.E(errors.OpIngestStream, errors.KIO, err)
+		}
+		return sendChunk(chunk, size)
+	}
+
+	for n := 0; ; n++ {
+		rec, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.E(errors.OpIngestStream, errors.KClientArgs, fmt.Errorf("could not read record %d: %w", n, err)).SetNoRetry()
+		}
+
+		ok, err := chunks.add(rec)
+		if err == nil && !ok && chunks.len() > 0 {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			ok, err = chunks.add(rec)
+		}
+		if err != nil {
+			return nil, errors.E(errors.OpIngestStream, errors.KIO, err)
+		}
+		if !ok {
+			return nil, errors.ES(errors.OpIngestStream, errors.KPayloadTooLarge, "record %d (counting from 0) is over the chunk limit of %d bytes by itself", n, limit).SetNoRetry()
+		}
+	}
+
+	if chunks.len() > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := props.ApplyDeleteLocalSourceOption(); err != nil {
+		return nil, err
+	}
+	agg.record.Status = "Success"
+	return agg, nil
+}
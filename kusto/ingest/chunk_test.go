@@ -0,0 +1,156 @@
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readRecords(t *testing.T, data string, format DataFormat) []string {
+	records, err := newRecordReader(strings.NewReader(data), format)
+	require.NoError(t, err)
+
+	var got []string
+	for {
+		rec, err := records.next()
+		if err == io.EOF {
+			return got
+		}
+		require.NoError(t, err)
+		got = append(got, string(rec))
+	}
+}
+
+func TestRecordReader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc   string
+		format DataFormat
+		data   string
+		want   []string
+	}{
+		{
+			desc:   "CSV",
+			format: CSV,
+			data:   "a,b\nc,d",
+			want:   []string{"a,b\n", "c,d\n"},
+		},
+		{
+			desc:   "CSV with a quoted delimiter",
+			format: CSV,
+			data:   "a,\"b\nc \"\"d\"\"\"\ne,f\n",
+			want:   []string{"a,\"b\nc \"\"d\"\"\"\n", "e,f\n"},
+		},
+		{
+			desc:   "TSV does not quote",
+			format: TSV,
+			data:   "a\t\"b\nc\td\n",
+			want:   []string{"a\t\"b\n", "c\td\n"},
+		},
+		{
+			desc:   "MultiJSON",
+			format: MultiJSON,
+			data:   "{\"a\":\n1} [{\"a\":2},\n {\"a\":3}] \n{\"a\":4}\n",
+			want:   []string{"{\"a\":\n1}\n", "{\"a\":2}\n", "{\"a\":3}\n", "{\"a\":4}\n"},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, readRecords(t, test.data, test.format), test.desc)
+	}
+
+	_, err := newRecordReader(strings.NewReader(""), Parquet)
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind)
+}
+
+func chunkedStreaming(limit int64, sent *[][]byte) *Streaming {
+	return &Streaming{
+		db:        "db",
+		table:     "table",
+		chunkSize: limit,
+		streamConn: fakeStreamIngestor{
+			onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+				b, err := ioutil.ReadAll(payload)
+				if err != nil {
+					return err
+				}
+				*sent = append(*sent, b)
+				return nil
+			},
+		},
+	}
+}
+
+func TestAutoChunking(t *testing.T) {
+	t.Parallel()
+
+	// Random values compress poorly, so that the data needs several chunks.
+	rnd := rand.New(rand.NewSource(1))
+	data := &strings.Builder{}
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(data, "%d,%x,\"a\nb\"\n", i, rnd.Int63())
+	}
+
+	const limit = 8 * 1024
+	var sent [][]byte
+	result, err := chunkedStreaming(limit, &sent).FromReader(context.Background(), strings.NewReader(data.String()), FileFormat(CSV))
+	require.NoError(t, err)
+
+	require.Greater(t, len(sent), 1)
+	require.Len(t, result.Chunks(), len(sent))
+	assert.Equal(t, StreamingIngestion, result.Method())
+	assert.Equal(t, int64(data.Len()), result.BytesRead())
+
+	got := &bytes.Buffer{}
+	var uploaded int64
+	for i, chunk := range sent {
+		assert.LessOrEqual(t, len(chunk), limit)
+		uploaded += int64(len(chunk))
+		zr, err := gzip.NewReader(bytes.NewReader(chunk))
+		require.NoError(t, err)
+		plain, err := ioutil.ReadAll(zr)
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(string(plain), "\"a\nb\"\n"), "chunk %d should end on a record boundary", i)
+		got.Write(plain)
+	}
+	assert.Equal(t, data.String(), got.String())
+	assert.Equal(t, uploaded, result.BytesUploaded())
+}
+
+func TestAutoChunkingErrors(t *testing.T) {
+	t.Parallel()
+
+	var sent [][]byte
+	streaming := chunkedStreaming(1024, &sent)
+
+	rnd := rand.New(rand.NewSource(1))
+	big := make([]byte, 4096)
+	for i := range big {
+		big[i] = byte('a' + rnd.Intn(26))
+	}
+	_, err := streaming.FromReader(context.Background(), strings.NewReader("a\nb\n"+string(big)+"\nc\n"), FileFormat(CSV))
+	require.Error(t, err)
+	assert.Equal(t, errors.KPayloadTooLarge, err.(*errors.Error).Kind)
+	assert.Contains(t, err.Error(), "record 2")
+
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a\n"), FileFormat(AVRO), IngestionMappingRef("mapping", AVRO))
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind)
+
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a\n"), FileFormat(CSV), DontCompress())
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind)
+}
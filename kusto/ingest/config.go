@@ -0,0 +1,252 @@
+package ingest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/conn"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/gzip"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/queued"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+const (
+	// minBlockSize and maxBlockSize are the bounds of WithBlockSize().
+	minBlockSize = 1 * mb
+	maxBlockSize = 100 * mb
+	// maxUploadParallelism is the bound of WithUploadParallelism().
+	maxUploadParallelism = 64
+)
+
+// maxStagingPrefix is the longest prefix allowed by WithStagingPrefix(), which leaves room for the generated part
+// of the blob name within the 1024 characters allowed by blob storage.
+const maxStagingPrefix = 512
+
+// config holds the settings of an Ingestion, as set by the Options passed to New(). New() validates it, then
+// hands each internal component the part of it that concerns that component.
+type config struct {
+	bufferSize int
+	maxBuffers int
+	// blockSize and parallelism are set by WithBlockSize() and WithUploadParallelism(), 0 for the defaults.
+	blockSize   int
+	parallelism int
+
+	ingestionEndpoint string
+	stagingPrefix     string
+	noStatusReporting bool
+	refreshInterval   time.Duration
+
+	maxStreamingSize    int64
+	streamingHTTPClient *http.Client
+	// tracer is the kusto.Tracer of the QueryClient, which streaming ingestion requests are traced with.
+	tracer kusto.Tracer
+	// spans is set by WithSpanTracer().
+	spans SpanTracer
+	// app and user are the application and the user for tracing of the QueryClient, see queryTracingIdentity().
+	app, user string
+	// tlsConfig is the TLS config of the QueryClient, see queryTLSConfig(). storageHTTPClient is the client of the
+	// requests to the ingestion storage made with it, nil for the defaults of the storage SDKs.
+	tlsConfig         *tls.Config
+	storageHTTPClient *http.Client
+	// streamingMaxIdleConns, streamingMaxConns and streamingTimeouts are 0 for the defaults of the connections that
+	// streaming ingestion opens.
+	streamingMaxIdleConns int
+	streamingMaxConns     int
+	streamingTimeouts     ConnectionTimeouts
+	streamingEndpoint     string
+
+	// storageCred is nil to authenticate to the ingestion storage with shared access signatures.
+	storageCred azcore.TokenCredential
+
+	// compressionLevel is nil to compress with the default level.
+	compressionLevel *int
+	// compressionBuffer is set by WithCompressionBufferSize(), 0 for the default.
+	compressionBuffer int
+
+	// rateLimit, rateBurst and maxInFlight are set by WithRateLimit() and WithMaxInFlight(), 0 for no limit.
+	rateLimit   float64
+	rateBurst   int
+	maxInFlight int
+
+	// uploadRetry, enqueueRetry and streamingRetry are set by WithRetryPolicy().
+	uploadRetry    BackoffPolicy
+	enqueueRetry   BackoffPolicy
+	streamingRetry BackoffPolicy
+
+	// journal is set by WithJournal(), nil for no journal.
+	journal Journal
+
+	// statusTable is set by WithStatusTable(), "" for the status tables of the ingestion resources.
+	statusTable string
+}
+
+// validate checks the values set by the options passed to New().
+func (c config) validate() error {
+	if c.bufferSize < 0 || c.maxBuffers < 0 {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "buffer size(%d) and number of buffers(%d) cannot be negative", c.bufferSize, c.maxBuffers).SetNoRetry()
+	}
+
+	if c.blockSize != 0 && (c.blockSize < minBlockSize || c.blockSize > maxBlockSize) {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithBlockSize(%d): must be between %d and %d", c.blockSize, minBlockSize, maxBlockSize).SetNoRetry()
+	}
+	if c.parallelism != 0 && (c.parallelism < 1 || c.parallelism > maxUploadParallelism) {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithUploadParallelism(%d): must be between 1 and %d", c.parallelism, maxUploadParallelism).SetNoRetry()
+	}
+	if (c.blockSize != 0 || c.parallelism != 0) && (c.bufferSize != 0 || c.maxBuffers != 0) {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithBlockSize() and WithUploadParallelism() cannot be used with WithBufferSize() or WithStaticBuffer()").SetNoRetry()
+	}
+
+	if c.maxStreamingSize < 0 {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithMaxStreamingSize(%d): size cannot be negative", c.maxStreamingSize).SetNoRetry()
+	}
+	if c.streamingMaxIdleConns < 0 || c.streamingMaxConns < 0 {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithStreamingConnectionLimits(%d, %d): limits cannot be negative", c.streamingMaxIdleConns, c.streamingMaxConns).SetNoRetry()
+	}
+	if err := c.streamingTimeouts.validate(errors.OpFileIngest, "WithStreamingConnectionTimeouts"); err != nil {
+		return err
+	}
+	if err := validateStreamingEndpoint(errors.OpFileIngest, "WithStreamingEndpoint", c.streamingEndpoint); err != nil {
+		return err
+	}
+	if c.streamingHTTPClient != nil && (c.streamingMaxIdleConns > 0 || c.streamingMaxConns > 0 || c.streamingTimeouts != (ConnectionTimeouts{})) {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithStreamingConnectionLimits() and WithStreamingConnectionTimeouts() cannot be used with WithStreamingHTTPClient(), set them on the client").SetNoRetry()
+	}
+
+	if c.refreshInterval != 0 && c.refreshInterval < resources.MinRefreshInterval {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithResourceRefreshInterval(%s): cannot be shorter than %s", c.refreshInterval, resources.MinRefreshInterval).SetNoRetry()
+	}
+
+	if c.compressionLevel != nil {
+		if err := gzip.ValidateLevel(*c.compressionLevel); err != nil {
+			return errors.E(errors.OpFileIngest, errors.KClientArgs, fmt.Errorf("WithCompressionLevel(): %w", err)).SetNoRetry()
+		}
+	}
+	if err := gzip.ValidateBufferSize(c.compressionBuffer); err != nil {
+		return errors.E(errors.OpFileIngest, errors.KClientArgs, fmt.Errorf("WithCompressionBufferSize(): %w", err)).SetNoRetry()
+	}
+
+	if err := validateLimits(errors.OpFileIngest, "WithRateLimit", "WithMaxInFlight", c.rateLimit, c.rateBurst, c.maxInFlight); err != nil {
+		return err
+	}
+
+	for _, p := range []BackoffPolicy{c.uploadRetry, c.enqueueRetry, c.streamingRetry} {
+		if err := p.Validate(); err != nil {
+			return errors.E(errors.OpFileIngest, errors.KClientArgs, fmt.Errorf("WithRetryPolicy(): %w", err)).SetNoRetry()
+		}
+	}
+
+	if c.statusTable != "" {
+		if c.noStatusReporting {
+			return errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithStatusTable() cannot be used with WithoutStatusReporting()").SetNoRetry()
+		}
+		if _, err := resources.ParseStatusTable(c.statusTable); err != nil {
+			return errors.E(errors.OpFileIngest, errors.KClientArgs, fmt.Errorf("WithStatusTable(): %w", err)).SetNoRetry()
+		}
+	}
+
+	if len(c.stagingPrefix) > maxStagingPrefix {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithStagingPrefix(): prefix cannot be longer than %d characters", maxStagingPrefix).SetNoRetry()
+	}
+	if strings.HasPrefix(c.stagingPrefix, "/") || strings.ContainsAny(c.stagingPrefix, "\\?#") || strings.IndexFunc(c.stagingPrefix, unicode.IsControl) != -1 {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithStagingPrefix(%q): not a valid blob name prefix", c.stagingPrefix).SetNoRetry()
+	}
+
+	return nil
+}
+
+// streamingOptions returns the options for the Streaming client of a Managed client.
+func (c config) streamingOptions() []StreamingOption {
+	return []StreamingOption{
+		WithStreamingSizeLimit(c.maxStreamingSize),
+		WithHTTPClient(c.streamingHTTPClient),
+		WithConnectionLimits(c.streamingMaxIdleConns, c.streamingMaxConns),
+		WithConnectionTimeouts(c.streamingTimeouts),
+		WithEndpoint(c.streamingEndpoint),
+		WithStreamingSpanTracer(c.spans),
+		WithStreamingRetryPolicy(c.streamingRetry),
+	}
+}
+
+// connOptions returns the options for the connection of Stream() and StreamReader().
+func (c config) connOptions() []conn.Option {
+	options := []conn.Option{
+		conn.WithHTTPClient(c.streamingHTTPClient),
+		conn.WithConnectionLimits(c.streamingMaxIdleConns, c.streamingMaxConns),
+		conn.WithTimeouts(c.streamingTimeouts.conn()),
+		conn.WithTracer(c.tracer),
+		conn.WithSpanTracer(c.spans),
+		conn.WithTracingIdentity(c.app, c.user),
+		conn.WithTLSConfig(c.tlsConfig),
+	}
+	if c.streamingEndpoint != "" {
+		options = append(options, conn.WithEndpoint(c.streamingEndpoint))
+	}
+	return options
+}
+
+// managerOptions returns the options for the resources.Manager.
+func (c config) managerOptions() []resources.Option {
+	options := []resources.Option{resources.WithSpanTracer(c.spans)}
+	if c.noStatusReporting {
+		options = append(options, resources.WithoutStatusTables())
+	}
+	if c.refreshInterval != 0 {
+		options = append(options, resources.WithRefreshInterval(c.refreshInterval))
+	}
+	return options
+}
+
+// queuedOptions returns the options for the queued ingestion.
+func (c config) queuedOptions() []queued.Option {
+	bufferSize := c.bufferSize
+	if c.blockSize != 0 {
+		bufferSize = c.blockSize
+	}
+	options := []queued.Option{
+		queued.WithStaticBuffer(bufferSize, c.maxBuffers),
+		queued.WithUploadParallelism(c.parallelism),
+		queued.WithStagingPrefix(c.stagingPrefix),
+		queued.WithTokenCredential(c.storageCred),
+		queued.WithHTTPClient(c.storageHTTPClient),
+		queued.WithSpanTracer(c.spans),
+		queued.WithRetryPolicies(c.uploadRetry, c.enqueueRetry),
+		queued.WithCompressionBuffer(c.compressionBuffer),
+	}
+	if c.journal != nil {
+		options = append(options, queued.WithBeforeEnqueue(recordPending(c.journal)))
+	}
+	return options
+}
+
+// tlsHTTPClient returns a client that opens its connections with config, for the storage SDKs, whose clients
+// otherwise use their own defaults.
+func tlsHTTPClient(config *tls.Config) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = config
+	return &http.Client{Transport: t}
+}
+
+// sourceOptions returns the source properties that ingestions start with.
+func (c config) sourceOptions() properties.SourceOptions {
+	if c.compressionLevel == nil {
+		return properties.SourceOptions{}
+	}
+	return properties.SourceOptions{CompressionLevel: *c.compressionLevel, CompressionLevelSet: true}
+}
+
+// streamingLimit returns the largest payload, after compression, that is streamed.
+func (c config) streamingLimit() int64 {
+	if c.maxStreamingSize == 0 {
+		return maxStreamingSize
+	}
+	return c.maxStreamingSize
+}
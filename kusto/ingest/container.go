@@ -0,0 +1,279 @@
+package ingest
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/queued"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+// defaultContainerConcurrency is how many blobs FromContainer() queues at once by default.
+const defaultContainerConcurrency = 8
+
+// ContainerOption is an optional argument to FromContainer().
+type ContainerOption func(o *containerOptions)
+
+type containerOptions struct {
+	prefix      string
+	suffix      string
+	pattern     string
+	marker      string
+	cred        azcore.TokenCredential
+	concurrency int
+	dryRun      bool
+	options     []FileOption
+}
+
+// WithBlobPrefix only ingests the blobs whose name starts with prefix, such as "events/2023/". The prefix is given to
+// the listing, so the other blobs are not listed at all.
+func WithBlobPrefix(prefix string) ContainerOption {
+	return func(o *containerOptions) {
+		o.prefix = prefix
+	}
+}
+
+// WithBlobSuffix only ingests the blobs whose name ends with suffix, such as ".csv.gz".
+func WithBlobSuffix(suffix string) ContainerOption {
+	return func(o *containerOptions) {
+		o.suffix = suffix
+	}
+}
+
+// WithBlobPattern only ingests the blobs whose name matches pattern, with the syntax of path.Match(), such as
+// "events/*/part-*.json". A "*" does not match the "/" of the virtual directories.
+func WithBlobPattern(pattern string) ContainerOption {
+	return func(o *containerOptions) {
+		o.pattern = pattern
+	}
+}
+
+// WithListMarker starts the listing of the container at marker, such as the BatchResult.Marker of a FromContainer()
+// whose listing failed, to resume it.
+func WithListMarker(marker string) ContainerOption {
+	return func(o *containerOptions) {
+		o.marker = marker
+	}
+}
+
+// WithContainerCredential lists the container with Azure AD tokens from cred instead of the shared access signature
+// of its URL. A blob listed with tokens is ingested with the ";impersonate" suffix, for the service to read it with
+// the identity of the caller, unless the URL of the container has a shared access signature.
+func WithContainerCredential(cred azcore.TokenCredential) ContainerOption {
+	return func(o *containerOptions) {
+		o.cred = cred
+	}
+}
+
+// WithContainerConcurrency sets how many blobs are queued at once. The default is 8. The limits of WithRateLimit()
+// and WithMaxInFlight() apply as well.
+func WithContainerConcurrency(n int) ContainerOption {
+	return func(o *containerOptions) {
+		o.concurrency = n
+	}
+}
+
+// DryRun lists the blobs that match without ingesting them, for BatchResult.Blobs to show what would be ingested.
+func DryRun() ContainerOption {
+	return func(o *containerOptions) {
+		o.dryRun = true
+	}
+}
+
+// WithBlobOptions sets the FileOptions that each blob is ingested with, as with FromBlob().
+func WithBlobOptions(options ...FileOption) ContainerOption {
+	return func(o *containerOptions) {
+		o.options = options
+	}
+}
+
+// BatchResult is what FromContainer() did with the blobs of a container.
+type BatchResult struct {
+	// Blobs are the names of the blobs that matched and were not empty, in the order of the listing.
+	Blobs []string
+	// Skipped are the names of the blobs that matched but were empty, which are not ingested.
+	Skipped []string
+	// Results are the Results of the blobs that were queued, by name.
+	Results map[string]*Result
+	// Errors are the errors of the blobs that could not be queued, by name.
+	Errors map[string]error
+	// Marker is where the listing stopped when it failed, for WithListMarker() to resume it. It is "" once the
+	// container was listed to the end.
+	Marker string
+}
+
+// blobPager mimics *azblob.ContainerListBlobFlatSegmentPager to allow fakes for testing.
+type blobPager interface {
+	NextPage(ctx context.Context) bool
+	PageResponse() azblob.ContainerListBlobFlatSegmentResponse
+	Err() error
+}
+
+// FromContainer ingests the blobs of the container at containerURL that match the options, each one as FromBlob()
+// would, with the size from the listing as the size of its data when it is not compressed. containerURL is listed
+// with its shared access signature, which needs the list permission, or with WithContainerCredential().
+// The blobs are queued while the container is listed, and the error of a blob is in BatchResult.Errors and does not
+// stop the others. The error returned is for the listing: when it fails midway, the BatchResult has the blobs queued
+// until then, and its Marker resumes the listing with WithListMarker(). When ctx is done, the Marker resumes the
+// listing at the page that was being queued, whose blobs may be queued again. Empty blobs are skipped.
+func (i *Ingestion) FromContainer(ctx context.Context, containerURL string, options ...ContainerOption) (*BatchResult, error) {
+	if i.isClosed() {
+		return nil, ClientClosedErr
+	}
+
+	o := containerOptions{concurrency: defaultContainerConcurrency}
+	for _, option := range options {
+		option(&o)
+	}
+	if o.concurrency < 1 {
+		return nil, errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithContainerConcurrency(%d): must be at least 1", o.concurrency).SetNoRetry()
+	}
+	if _, err := path.Match(o.pattern, ""); err != nil {
+		return nil, errors.ES(errors.OpFileIngest, errors.KClientArgs, "WithBlobPattern(%q): %s", o.pattern, err).SetNoRetry()
+	}
+	u, err := url.Parse(containerURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, errors.ES(errors.OpFileIngest, errors.KClientArgs, "FromContainer(): %q is not the URL of a container", containerURL).SetNoRetry()
+	}
+
+	pager, err := i.containerPager(containerURL, o)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &BatchResult{Results: map[string]*Result{}, Errors: map[string]error{}}
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, o.concurrency)
+	)
+
+	marker := o.marker
+	for pager.NextPage(ctx) {
+		resp := pager.PageResponse()
+		if resp.Segment != nil {
+			for _, item := range resp.Segment.BlobItems {
+				if item == nil || item.Name == nil || !o.matches(*item.Name) {
+					continue
+				}
+				name := *item.Name
+				var size int64
+				if item.Properties != nil && item.Properties.ContentLength != nil {
+					size = *item.Properties.ContentLength
+				}
+				if size == 0 {
+					batch.Skipped = append(batch.Skipped, name)
+					continue
+				}
+				batch.Blobs = append(batch.Blobs, name)
+				if o.dryRun {
+					continue
+				}
+
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					wg.Wait()
+					batch.Marker = marker
+					return batch, ctx.Err()
+				}
+				wg.Add(1)
+				go func() {
+					defer func() { <-slots }()
+					defer wg.Done()
+
+					result, err := i.fromBlob(ctx, blobURI(u, name, o.cred != nil), sizeHint(name, size), o.options, i.newProp())
+
+					mu.Lock()
+					defer mu.Unlock()
+					if err != nil {
+						batch.Errors[name] = err
+						return
+					}
+					batch.Results[name] = result
+				}()
+			}
+		}
+		if resp.NextMarker == nil {
+			marker = ""
+		} else {
+			marker = *resp.NextMarker
+		}
+	}
+	wg.Wait()
+
+	if err := pager.Err(); err != nil {
+		batch.Marker = marker
+		return batch, errors.E(errors.OpFileIngest, errors.KBlobstore, err)
+	}
+	return batch, nil
+}
+
+// containerPager lists the container at containerURL from the marker of o.
+func (i *Ingestion) containerPager(containerURL string, o containerOptions) (blobPager, error) {
+	listOptions := &azblob.ContainerListBlobFlatSegmentOptions{}
+	if o.prefix != "" {
+		listOptions.Prefix = &o.prefix
+	}
+	if o.marker != "" {
+		listOptions.Marker = &o.marker
+	}
+	if i.listBlobs != nil {
+		return i.listBlobs(containerURL, listOptions), nil
+	}
+
+	var clientOptions *azblob.ClientOptions
+	if i.cfg.storageHTTPClient != nil {
+		clientOptions = &azblob.ClientOptions{Transporter: i.cfg.storageHTTPClient}
+	}
+	var container azblob.ContainerClient
+	var err error
+	if o.cred != nil {
+		container, err = azblob.NewContainerClient(containerURL, o.cred, clientOptions)
+	} else {
+		container, err = azblob.NewContainerClientWithNoCredential(containerURL, clientOptions)
+	}
+	if err != nil {
+		return nil, errors.E(errors.OpFileIngest, errors.KBlobstore, err)
+	}
+	return container.ListBlobsFlat(listOptions), nil
+}
+
+// matches reports if the blob called name is to be ingested.
+func (o containerOptions) matches(name string) bool {
+	if !strings.HasPrefix(name, o.prefix) || !strings.HasSuffix(name, o.suffix) {
+		return false
+	}
+	if o.pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(o.pattern, name)
+	return ok
+}
+
+// sizeHint returns the size of the data of the blob called name of size bytes, which is only known when the blob is
+// not compressed.
+func sizeHint(name string, size int64) int64 {
+	if queued.CompressionDiscovery(name) != properties.CTNone {
+		return 0
+	}
+	return size
+}
+
+// blobURI returns the URI of the blob called name in the container at container, with the shared access signature
+// of container. Without one, the URI of a blob listed with tokens has the ";impersonate" suffix.
+func blobURI(container *url.URL, name string, impersonate bool) string {
+	u := *container
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+	u.RawPath = ""
+	if impersonate && u.RawQuery == "" {
+		return u.String() + ";impersonate"
+	}
+	return u.String()
+}
@@ -0,0 +1,236 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePager returns pages of blobs, and fails with err after them if it is set.
+type fakePager struct {
+	pages []map[string]int64
+	err   error
+
+	next int
+	page azblob.ContainerListBlobFlatSegmentResponse
+}
+
+func (p *fakePager) NextPage(ctx context.Context) bool {
+	if p.next >= len(p.pages) {
+		return false
+	}
+	var items []*azblob.BlobItemInternal
+	for _, name := range sortedNames(p.pages[p.next]) {
+		name, size := name, p.pages[p.next][name]
+		items = append(items, &azblob.BlobItemInternal{Name: &name, Properties: &azblob.BlobPropertiesInternal{ContentLength: &size}})
+	}
+	p.next++
+	p.page = azblob.ContainerListBlobFlatSegmentResponse{}
+	p.page.Segment = &azblob.BlobFlatListSegment{BlobItems: items}
+	if p.next < len(p.pages) || p.err != nil {
+		marker := fmt.Sprintf("page%d", p.next)
+		p.page.NextMarker = &marker
+	}
+	return true
+}
+
+func (p *fakePager) PageResponse() azblob.ContainerListBlobFlatSegmentResponse {
+	return p.page
+}
+
+func (p *fakePager) Err() error {
+	if p.next < len(p.pages) {
+		return nil
+	}
+	return p.err
+}
+
+func sortedNames(blobs map[string]int64) []string {
+	var names []string
+	for name := range blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFromContainer(t *testing.T) {
+	t.Parallel()
+
+	const containerURL = "https://account.blob.core.windows.net/container?sig=secret"
+	pages := []map[string]int64{
+		{
+			"events/2023/01.csv":    10,
+			"events/2023/02.csv.gz": 20,
+			"events/2023/empty.csv": 0,
+			"events/2023/readme.md": 5,
+		},
+		{
+			"events/2023/03.csv":  30,
+			"events/2023/bad.csv": 40,
+			"events/2023/x/y.csv": 50,
+		},
+	}
+	listErr := goErrors.New("listing failed")
+
+	tests := []struct {
+		desc        string
+		options     []ContainerOption
+		listErr     error
+		wantErr     bool
+		wantBlobs   []string
+		wantQueued  map[string]int64
+		wantSkipped []string
+		wantFailed  []string
+		wantMarker  string
+	}{
+		{
+			desc:        "Suffix",
+			options:     []ContainerOption{WithBlobPrefix("events/2023/"), WithBlobSuffix(".csv")},
+			wantBlobs:   []string{"events/2023/01.csv", "events/2023/03.csv", "events/2023/bad.csv", "events/2023/x/y.csv"},
+			wantQueued:  map[string]int64{"events/2023/01.csv": 10, "events/2023/03.csv": 30, "events/2023/x/y.csv": 50},
+			wantSkipped: []string{"events/2023/empty.csv"},
+			wantFailed:  []string{"events/2023/bad.csv"},
+		},
+		{
+			desc:       "Pattern",
+			options:    []ContainerOption{WithBlobPattern("events/*/0*"), WithContainerConcurrency(1)},
+			wantBlobs:  []string{"events/2023/01.csv", "events/2023/02.csv.gz", "events/2023/03.csv"},
+			wantQueued: map[string]int64{"events/2023/01.csv": 10, "events/2023/02.csv.gz": 0, "events/2023/03.csv": 30},
+		},
+		{
+			desc:        "Dry run",
+			options:     []ContainerOption{WithBlobSuffix(".csv"), DryRun()},
+			wantBlobs:   []string{"events/2023/01.csv", "events/2023/03.csv", "events/2023/bad.csv", "events/2023/x/y.csv"},
+			wantQueued:  map[string]int64{},
+			wantSkipped: []string{"events/2023/empty.csv"},
+		},
+		{
+			desc:       "The listing fails midway",
+			options:    []ContainerOption{WithBlobPattern("events/2023/0*")},
+			listErr:    listErr,
+			wantErr:    true,
+			wantBlobs:  []string{"events/2023/01.csv", "events/2023/02.csv.gz", "events/2023/03.csv"},
+			wantQueued: map[string]int64{"events/2023/01.csv": 10, "events/2023/02.csv.gz": 0, "events/2023/03.csv": 30},
+			wantMarker: "page2",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ingestion, err := New(mockClient{endpoint: "https://test.kusto.windows.net"}, "db", "table")
+			require.NoError(t, err)
+			defer ingestion.Close()
+
+			var mu sync.Mutex
+			queued := map[string]int64{}
+			ingestion.fs = resources.FsMock{
+				OnBlob: func(ctx context.Context, from string, fileSize int64, props properties.All) error {
+					if from == "https://account.blob.core.windows.net/container/events/2023/bad.csv?sig=secret" {
+						return errors.ES(errors.OpFileIngest, errors.KBlobstore, "queue unavailable")
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					queued[from] = fileSize
+					assert.Equal(t, "table", props.Ingestion.TableName)
+					return nil
+				},
+			}
+			ingestion.listBlobs = func(containerURL string, options *azblob.ContainerListBlobFlatSegmentOptions) blobPager {
+				assert.Nil(t, options.Marker)
+				return &fakePager{pages: pages, err: test.listErr}
+			}
+
+			batch, err := ingestion.FromContainer(context.Background(), containerURL, test.options...)
+			if test.wantErr {
+				require.Error(t, err)
+				assert.True(t, goErrors.Is(err, listErr))
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, test.wantBlobs, batch.Blobs)
+			assert.Equal(t, test.wantSkipped, batch.Skipped)
+			assert.Equal(t, test.wantMarker, batch.Marker)
+			wantQueued := map[string]int64{}
+			for name, size := range test.wantQueued {
+				wantQueued["https://account.blob.core.windows.net/container/"+name+"?sig=secret"] = size
+			}
+			assert.Equal(t, wantQueued, queued)
+			assert.Len(t, batch.Results, len(test.wantQueued))
+			var failed []string
+			for name := range batch.Errors {
+				failed = append(failed, name)
+			}
+			assert.Equal(t, test.wantFailed, failed)
+		})
+	}
+}
+
+func TestFromContainerResume(t *testing.T) {
+	t.Parallel()
+
+	ingestion, err := New(mockClient{endpoint: "https://test.kusto.windows.net"}, "db", "table")
+	require.NoError(t, err)
+	defer ingestion.Close()
+	ingestion.fs = resources.FsMock{}
+
+	var prefix, marker *string
+	ingestion.listBlobs = func(containerURL string, options *azblob.ContainerListBlobFlatSegmentOptions) blobPager {
+		prefix, marker = options.Prefix, options.Marker
+		return &fakePager{pages: []map[string]int64{{"events/b.csv": 1}}}
+	}
+
+	batch, err := ingestion.FromContainer(context.Background(), "https://account.blob.core.windows.net/container", WithBlobPrefix("events/"), WithListMarker("page2"))
+	require.NoError(t, err)
+	require.NotNil(t, prefix)
+	require.NotNil(t, marker)
+	assert.Equal(t, "events/", *prefix)
+	assert.Equal(t, "page2", *marker)
+	assert.Equal(t, []string{"events/b.csv"}, batch.Blobs)
+	assert.Equal(t, "", batch.Marker)
+
+	for _, options := range [][]ContainerOption{{WithContainerConcurrency(0)}, {WithBlobPattern("[")}} {
+		_, err := ingestion.FromContainer(context.Background(), "https://account.blob.core.windows.net/container", options...)
+		require.Error(t, err)
+		assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+	}
+	_, err = ingestion.FromContainer(context.Background(), "container")
+	assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+}
+
+func TestBlobURI(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		container   string
+		name        string
+		impersonate bool
+		want        string
+	}{
+		{"https://account.blob.core.windows.net/container?sig=secret", "a/b.csv", false, "https://account.blob.core.windows.net/container/a/b.csv?sig=secret"},
+		{"https://account.blob.core.windows.net/container/", "a b.csv", false, "https://account.blob.core.windows.net/container/a%20b.csv"},
+		{"https://account.blob.core.windows.net/container", "b.csv", true, "https://account.blob.core.windows.net/container/b.csv;impersonate"},
+		{"https://account.blob.core.windows.net/container?sig=secret", "b.csv", true, "https://account.blob.core.windows.net/container/b.csv?sig=secret"},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.container)
+		require.NoError(t, err)
+		assert.Equal(t, test.want, blobURI(u, test.name, test.impersonate))
+	}
+}
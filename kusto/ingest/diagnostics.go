@@ -0,0 +1,65 @@
+package ingest
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+)
+
+// IngestionDiagnostics is a snapshot of the ingestion resources that a client uses, as returned by
+// Ingestion.Diagnostics(). The URIs have their shared access signature removed, so they can be logged.
+type IngestionDiagnostics struct {
+	// Containers are the temporary storage containers that data is staged in before ingestion.
+	Containers []string
+	// Queues are the queues that ingestion messages are posted to.
+	Queues []string
+	// StatusTables are the tables that ingestion statuses are reported to, which is the table of WithStatusTable() if
+	// it is set.
+	StatusTables []string
+	// ReportQueues are the queues that ingestion results are reported to.
+	ReportQueues []string
+
+	// LastRefresh is when the resources were last fetched from the cluster.
+	LastRefresh time.Time
+	// LastRefreshError is the error of the last attempt to fetch the resources, if it failed. The resources from
+	// LastRefresh are used until a fetch succeeds.
+	LastRefreshError error
+}
+
+// Diagnostics returns the ingestion resources that the client currently uses and when they were fetched, such as to
+// find which storage an ingestion went to when it fails. It does not fetch the resources, see RefreshResources()
+// for that, and can be called while ingestions are running.
+func (i *Ingestion) Diagnostics(ctx context.Context) (IngestionDiagnostics, error) {
+	res, err := i.mgr.Resources()
+	if err != nil {
+		return IngestionDiagnostics{}, errors.E(errors.OpFileIngest, errors.KOther, err)
+	}
+
+	d := IngestionDiagnostics{
+		Containers:   redactURIs(res.Containers),
+		Queues:       redactURIs(res.Queues),
+		StatusTables: redactURIs(res.Tables),
+		ReportQueues: redactURIs(res.ReportQueues),
+	}
+	if i.cfg.statusTable != "" {
+		if tables, err := i.statusTables(); err == nil {
+			d.StatusTables = redactURIs(tables)
+		}
+	}
+	d.LastRefresh, d.LastRefreshError = i.mgr.LastFetch()
+	return d, nil
+}
+
+// redactURIs returns uris without their query, which holds the shared access signature.
+func redactURIs(uris []*resources.URI) []string {
+	var redacted []string
+	for _, uri := range uris {
+		u := *uri.URL()
+		u.RawQuery = ""
+		u.ForceQuery = false
+		redacted = append(redacted, u.String())
+	}
+	return redacted
+}
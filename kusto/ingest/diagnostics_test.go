@@ -0,0 +1,78 @@
+package ingest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnostics(t *testing.T) {
+	t.Parallel()
+
+	rows := []value.Values{}
+	for _, r := range [][2]string{
+		{"TempStorage", "https://account.blob.core.windows.net/container?sv=2020&sig=secret"},
+		{"SecuredReadyForAggregationQueue", "https://account.queue.core.windows.net/aggregation?sig=secret"},
+		{"IngestionsStatusTable", "https://account.table.core.windows.net/status?sig=secret"},
+		{"SuccessfulIngestionsQueue", "https://account.queue.core.windows.net/success?sig=secret"},
+		{"FailedIngestionsQueue", "https://account.queue.core.windows.net/failure?sig=secret"},
+	} {
+		rows = append(rows, value.Values{value.String{Value: r[0], Valid: true}, value.String{Value: r[1], Valid: true}})
+	}
+	client := mockClient{
+		endpoint: "https://test.kusto.windows.net",
+		onMgmt: func(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+			if query.String() == ".get kusto identity token" {
+				return resources.NewFakeMgmt(
+					table.Columns{{Name: "AuthorizationContext", Type: types.String}},
+					[]value.Values{{value.String{Value: "token", Valid: true}}},
+					false,
+				).Mgmt(ctx, db, query, options...)
+			}
+			return resources.FakeResources(rows, false).Mgmt(ctx, db, query, options...)
+		},
+	}
+
+	before := time.Now()
+	ingestion, err := New(client, "db", "table")
+	require.NoError(t, err)
+
+	got, err := ingestion.Diagnostics(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://account.blob.core.windows.net/container"}, got.Containers)
+	assert.Equal(t, []string{"https://account.queue.core.windows.net/aggregation"}, got.Queues)
+	assert.Equal(t, []string{"https://account.table.core.windows.net/status"}, got.StatusTables)
+	assert.Equal(t, []string{"https://account.queue.core.windows.net/success", "https://account.queue.core.windows.net/failure"}, got.ReportQueues)
+	assert.False(t, got.LastRefresh.Before(before))
+	assert.NoError(t, got.LastRefreshError)
+
+	// Snapshots can be taken while the resources are refreshed.
+	wg := sync.WaitGroup{}
+	for n := 0; n < 4; n++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, ingestion.RefreshResources(context.Background()))
+		}()
+		go func() {
+			defer wg.Done()
+			d, err := ingestion.Diagnostics(context.Background())
+			assert.NoError(t, err)
+			assert.Len(t, d.Containers, 1)
+		}()
+	}
+	wg.Wait()
+
+	after, err := ingestion.Diagnostics(context.Background())
+	require.NoError(t, err)
+	assert.True(t, after.LastRefresh.After(got.LastRefresh))
+}
@@ -60,6 +60,22 @@ data via an io.Reader.
 It is important to remember that FromReader() will terminate when it receives an io.EOF from the io.Reader.  Use io.Readers that won't
 return io.EOF until the io.Writer is closed (such as io.Pipe).
 
+Ingestion from a query result
+
+The rows of a query, for example one run against another cluster, can be ingested directly:
+
+	iter, err := sourceClient.Query(ctx, "database", kusto.NewStmt("MyTable | where Timestamp > ago(1d)"))
+	if err != nil {
+		panic("add error handling")
+	}
+	defer iter.Stop()
+
+	if _, err := in.FromRowIterator(ctx, iter, ingest.SplitSize(512*1024*1024)); err != nil {
+		panic("add error handling")
+	}
+
+Rows are serialized as CSV unless the FileFormat() option asks for JSON or MultiJSON. SplitSize() stages the result as several blobs.
+
 Ingestion from a Stream
 
 Instestion from a stream commits blocks of fully formed data encodes (JSON, AVRO, ...) into Kusto:
@@ -94,5 +110,23 @@ This feature is not suitable for users running ingestion at high rates, and may
 			// failureStatus, _ := ingest.GetIngestionFailureStatus(err)
 		}
 	}
+
+The error of a failed ingestion is an *errors.Error whose Kind is chosen from the error code of the failure, such as
+errors.KDataFormat for data that does not match its format, and which is errors.Retryable() when the service reported
+a transient failure. A failure of an update policy is of Kind errors.KUpdatePolicy: the data was ingested into the
+table, but not into the table of the update policy. The StatusRecord of the failure can be found with errors.As():
+
+	var rec ingest.StatusRecord
+	if errors.As(err, &rec) {
+		// rec.ErrorCode, rec.Details, ...
+	}
+
+Wait() uses a goroutine for each ingestion. When many ingestions are in flight, use StatusChan() or WatchStatus()
+instead, which follow all the ingestions of an Ingestion with a single goroutine:
+
+	rec := <-status.StatusChan(ctx)
+	if err := rec.Err(); err != nil {
+		// the operation complete with an error, the same one that Wait() returns
+	}
 */
 package ingest
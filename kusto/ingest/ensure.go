@@ -0,0 +1,365 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/unsafe"
+	"github.com/google/uuid"
+)
+
+// EnsureOption is an optional argument to EnsureTableFromStruct().
+type EnsureOption func(e *ensureOptions)
+
+type ensureOptions struct {
+	mappingName string
+}
+
+// MappingName sets the name of the JSON ingestion mapping created by EnsureTableFromStruct().
+// By default the mapping is named "<table>_mapping".
+func MappingName(name string) EnsureOption {
+	return func(e *ensureOptions) {
+		e.mappingName = name
+	}
+}
+
+// EnsureTableFromStruct creates or extends table "tableName" in database "db" so that it has a column for every field of
+// the struct v (or pointer to struct), and creates or alters a JSON ingestion mapping from the JSON representation of the
+// struct to those columns. It returns the name of the mapping, to be used with IngestionMappingRef(name, JSON).
+//
+// Column names come from the field's `kusto` tag, then its `json` tag, then the field name. Fields tagged with `kusto:"-"` or
+// `json:"-"` and unexported fields are skipped. Go types map to Kusto types as follows: string is string, bool is bool,
+// int8/int16/int32/uint8/uint16 are int, other integers are long, floats are real, time.Time is datetime, time.Duration
+// is timespan, uuid.UUID is guid, and maps, slices, structs and interfaces are dynamic. Note that encoding/json writes a
+// time.Duration as a number of nanoseconds, which Kusto does not read as a timespan, so give such fields a custom encoding.
+//
+// Existing tables are only merged into: columns are never dropped, and if an existing column has a different type
+// than the struct field an error is returned without changing the table.
+func EnsureTableFromStruct(ctx context.Context, client QueryClient, db, tableName string, v interface{}, options ...EnsureOption) (string, error) {
+	opts := ensureOptions{mappingName: tableName + "_mapping"}
+	for _, o := range options {
+		o(&opts)
+	}
+
+	cols, err := structColumns(reflect.TypeOf(v))
+	if err != nil {
+		return "", err
+	}
+
+	existing, err := tableSchema(ctx, client, db, tableName)
+	if err != nil {
+		return "", err
+	}
+	for _, col := range cols {
+		if t, ok := existing[col.name]; ok && t != col.kind {
+			return "", errors.ES(
+				errors.OpMgmt,
+				errors.KClientArgs,
+				"table %q already has column %q of type %s, which cannot be changed to %s", tableName, col.name, t, col.kind,
+			).SetNoRetry()
+		}
+	}
+
+	if _, err := mgmtDo(ctx, client, db, createMergeTableStmt(tableName, cols)); err != nil {
+		return "", err
+	}
+
+	stmt, err := createJSONMappingStmt(tableName, opts.mappingName, cols)
+	if err != nil {
+		return "", err
+	}
+	if _, err := mgmtDo(ctx, client, db, stmt); err != nil {
+		return "", err
+	}
+
+	return opts.mappingName, nil
+}
+
+// structColumn describes the column generated for a struct field.
+type structColumn struct {
+	name string
+	kind types.Column
+	path string
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	uuidType     = reflect.TypeOf(uuid.UUID{})
+	bytesType    = reflect.TypeOf([]byte{})
+)
+
+// structColumns returns the columns for the fields of struct type t, in field order.
+func structColumns(t reflect.Type) ([]structColumn, error) {
+	if t == nil {
+		return nil, errors.ES(errors.OpMgmt, errors.KClientArgs, "EnsureTableFromStruct() requires a struct or *struct, got nil").SetNoRetry()
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, errors.ES(errors.OpMgmt, errors.KClientArgs, "EnsureTableFromStruct() requires a struct or *struct, got %s", t).SetNoRetry()
+	}
+
+	var cols []structColumn
+	if err := appendStructColumns(&cols, t); err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 {
+		return nil, errors.ES(errors.OpMgmt, errors.KClientArgs, "struct %s has no exported fields to create columns from", t).SetNoRetry()
+	}
+
+	seen := map[string]bool{}
+	for _, col := range cols {
+		if seen[col.name] {
+			return nil, errors.ES(errors.OpMgmt, errors.KClientArgs, "struct %s has more than one field for column %q", t, col.name).SetNoRetry()
+		}
+		seen[col.name] = true
+	}
+	return cols, nil
+}
+
+func appendStructColumns(cols *[]structColumn, t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		jsonName, jsonOpts := splitTag(field.Tag.Get("json"))
+		kustoName := strings.TrimSpace(field.Tag.Get("kusto"))
+		if field.Tag.Get("json") == "-" || kustoName == "-" {
+			continue
+		}
+
+		// Embedded structs without a name have their fields promoted, like encoding/json does.
+		if field.Anonymous && jsonName == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if err := appendStructColumns(cols, ft); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if jsonName == "" {
+			jsonName = field.Name
+		}
+		name := kustoName
+		if name == "" {
+			name = jsonName
+		}
+
+		kind, err := kustoType(field.Type)
+		if err != nil {
+			return errors.E(errors.OpMgmt, errors.KClientArgs, fmt.Errorf("field %s: %w", field.Name, err)).SetNoRetry()
+		}
+		if jsonOpts == "string" {
+			kind = types.String
+		}
+
+		*cols = append(*cols, structColumn{name: name, kind: kind, path: jsonPath(jsonName)})
+	}
+	return nil
+}
+
+func splitTag(tag string) (name, opts string) {
+	if idx := strings.Index(tag, ","); idx != -1 {
+		name, opts = tag[:idx], tag[idx+1:]
+		// Only the ",string" option changes the encoding of a value.
+		if !strings.Contains(","+opts+",", ",string,") {
+			opts = ""
+		} else {
+			opts = "string"
+		}
+		return name, opts
+	}
+	return tag, ""
+}
+
+// kustoType returns the Kusto column type used to store values of Go type t.
+func kustoType(t reflect.Type) (types.Column, error) {
+	switch t {
+	case timeType:
+		return types.DateTime, nil
+	case durationType:
+		return types.Timespan, nil
+	case uuidType:
+		return types.GUID, nil
+	case bytesType:
+		// encoding/json writes []byte as a base64 string.
+		return types.String, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return kustoType(t.Elem())
+	case reflect.String:
+		return types.String, nil
+	case reflect.Bool:
+		return types.Bool, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return types.Int, nil
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return types.Long, nil
+	case reflect.Float32, reflect.Float64:
+		return types.Real, nil
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct, reflect.Interface:
+		return types.Dynamic, nil
+	}
+	return "", fmt.Errorf("type %s has no Kusto column type", t)
+}
+
+var simpleJSONName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// jsonPath returns the JSON path of a top level property.
+func jsonPath(name string) string {
+	if simpleJSONName.MatchString(name) {
+		return "$." + name
+	}
+	return "$['" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(name) + "']"
+}
+
+// tableSchema returns the column types of an existing table, or an empty map if the table does not exist.
+func tableSchema(ctx context.Context, client QueryClient, db, tableName string) (map[string]types.Column, error) {
+	rows, err := mgmtDo(ctx, client, db, showTableStmt(tableName).Add(" cslschema"))
+	if err != nil {
+		if isEntityNotFound(err) {
+			return map[string]types.Column{}, nil
+		}
+		return nil, err
+	}
+
+	schema := map[string]types.Column{}
+	for _, row := range rows {
+		rec := struct {
+			Schema string `kusto:"Schema"`
+		}{}
+		if err := row.ToStruct(&rec); err != nil {
+			return nil, err
+		}
+		if err := parseCSLSchema(rec.Schema, schema); err != nil {
+			return nil, err
+		}
+	}
+	return schema, nil
+}
+
+// parseCSLSchema parses a schema in the "name:type, ['other name']:type" format into m.
+func parseCSLSchema(s string, m map[string]types.Column) error {
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s), ",")) {
+		var name string
+		if strings.HasPrefix(s, "['") || strings.HasPrefix(s, `["`) {
+			end := s[1:2] + "]"
+			b := strings.Builder{}
+			i := 2
+			for ; i < len(s) && !strings.HasPrefix(s[i:], end); i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return fmt.Errorf("could not parse table schema %q", s)
+			}
+			name = b.String()
+			s = s[i+len(end):]
+		} else {
+			idx := strings.Index(s, ":")
+			if idx == -1 {
+				return fmt.Errorf("could not parse table schema %q", s)
+			}
+			name = strings.TrimSpace(s[:idx])
+			s = s[idx:]
+		}
+
+		if !strings.HasPrefix(s, ":") {
+			return fmt.Errorf("could not parse table schema, column %q has no type", name)
+		}
+		s = s[1:]
+		end := strings.Index(s, ",")
+		if end == -1 {
+			end = len(s)
+		}
+		m[name] = types.Column(strings.TrimSpace(s[:end]))
+		s = s[end:]
+	}
+	return nil
+}
+
+func createMergeTableStmt(tableName string, cols []structColumn) kusto.Stmt {
+	b := strings.Builder{}
+	b.WriteString(quoteName(tableName))
+	b.WriteString(" (")
+	for i, col := range cols {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(quoteName(col.name))
+		b.WriteString(":")
+		b.WriteString(string(col.kind))
+	}
+	b.WriteString(")")
+
+	return kusto.NewStmt(".create-merge table ", kusto.UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).UnsafeAdd(b.String())
+}
+
+func createJSONMappingStmt(tableName, mappingName string, cols []structColumn) (kusto.Stmt, error) {
+	type properties struct {
+		Path string `json:"Path"`
+	}
+	type mappingCol struct {
+		Column     string     `json:"column"`
+		Properties properties `json:"Properties"`
+	}
+
+	mapping := make([]mappingCol, 0, len(cols))
+	for _, col := range cols {
+		mapping = append(mapping, mappingCol{Column: col.name, Properties: properties{Path: col.path}})
+	}
+	b, err := json.Marshal(mapping)
+	if err != nil {
+		return kusto.Stmt{}, errors.E(errors.OpMgmt, errors.KInternal, fmt.Errorf("could not encode the ingestion mapping: %w", err)).SetNoRetry()
+	}
+
+	return kusto.NewStmt(".create-or-alter table ", kusto.UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).
+		UnsafeAdd(quoteName(tableName)).
+		Add(" ingestion json mapping ").
+		UnsafeAdd(quoteString(mappingName) + " " + quoteString(string(b))), nil
+}
+
+// quoteString returns s as a Kusto string literal.
+func quoteString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s) + `"`
+}
+
+// mgmtDo runs a management command and returns all the rows it produced.
+func mgmtDo(ctx context.Context, client QueryClient, db string, stmt kusto.Stmt) ([]*table.Row, error) {
+	iter, err := client.Mgmt(ctx, db, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Stop()
+
+	var rows []*table.Row
+	err = iter.Do(
+		func(row *table.Row) error {
+			rows = append(rows, row)
+			return nil
+		},
+	)
+	return rows, err
+}
@@ -0,0 +1,203 @@
+package ingest
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKustoType(t *testing.T) {
+	t.Parallel()
+
+	var (
+		s     string
+		i     int
+		iface interface{}
+	)
+
+	tests := []struct {
+		v    interface{}
+		want types.Column
+		err  bool
+	}{
+		{v: "", want: types.String},
+		{v: []byte{}, want: types.String},
+		{v: true, want: types.Bool},
+		{v: int8(0), want: types.Int},
+		{v: int16(0), want: types.Int},
+		{v: int32(0), want: types.Int},
+		{v: uint8(0), want: types.Int},
+		{v: uint16(0), want: types.Int},
+		{v: 0, want: types.Long},
+		{v: int64(0), want: types.Long},
+		{v: uint(0), want: types.Long},
+		{v: uint32(0), want: types.Long},
+		{v: uint64(0), want: types.Long},
+		{v: float32(0), want: types.Real},
+		{v: float64(0), want: types.Real},
+		{v: time.Time{}, want: types.DateTime},
+		{v: &time.Time{}, want: types.DateTime},
+		{v: time.Duration(0), want: types.Timespan},
+		{v: uuid.UUID{}, want: types.GUID},
+		{v: &s, want: types.String},
+		{v: &i, want: types.Long},
+		{v: map[string]interface{}{}, want: types.Dynamic},
+		{v: []string{}, want: types.Dynamic},
+		{v: [2]int{}, want: types.Dynamic},
+		{v: struct{ A int }{}, want: types.Dynamic},
+		{v: &iface, want: types.Dynamic},
+		{v: complex(1, 2), err: true},
+		{v: make(chan int), err: true},
+		{v: func() {}, err: true},
+	}
+
+	for _, test := range tests {
+		got, err := kustoType(reflect.TypeOf(test.v))
+		if test.err {
+			assert.Error(t, err, "%T", test.v)
+			continue
+		}
+		assert.NoError(t, err, "%T", test.v)
+		assert.Equal(t, test.want, got, "%T", test.v)
+	}
+}
+
+type ensureEmbedded struct {
+	Embedded string
+}
+
+type ensureRecord struct {
+	ensureEmbedded
+	Plain     string
+	JSONName  int64          `json:"json_name,omitempty"`
+	KustoName time.Time      `kusto:"KustoName" json:"when"`
+	Quoted    int            `json:",string"`
+	Odd       bool           `json:"odd name"`
+	Props     map[string]int `json:"props"`
+	Skipped   string         `json:"-"`
+	Skipped2  string         `kusto:"-"`
+	unexp     string
+}
+
+func TestStructColumns(t *testing.T) {
+	t.Parallel()
+
+	got, err := structColumns(reflect.TypeOf(&ensureRecord{}))
+	require.NoError(t, err)
+	assert.Equal(t, []structColumn{
+		{name: "Embedded", kind: types.String, path: "$.Embedded"},
+		{name: "Plain", kind: types.String, path: "$.Plain"},
+		{name: "json_name", kind: types.Long, path: "$.json_name"},
+		{name: "KustoName", kind: types.DateTime, path: "$.when"},
+		{name: "Quoted", kind: types.String, path: "$.Quoted"},
+		{name: "odd name", kind: types.Bool, path: "$['odd name']"},
+		{name: "props", kind: types.Dynamic, path: "$.props"},
+	}, got)
+
+	for _, v := range []interface{}{nil, 1, struct{ a int }{}, struct {
+		A int
+		B int `json:"A"`
+	}{}} {
+		_, err := structColumns(reflect.TypeOf(v))
+		assert.Error(t, err, "%#v", v)
+	}
+}
+
+func TestParseCSLSchema(t *testing.T) {
+	t.Parallel()
+
+	got := map[string]types.Column{}
+	require.NoError(t, parseCSLSchema(`a:string, ['b, c']:long,["d\"e"]:dynamic`, got))
+	assert.Equal(t, map[string]types.Column{"a": types.String, "b, c": types.Long, `d"e`: types.Dynamic}, got)
+
+	assert.Error(t, parseCSLSchema(`a`, map[string]types.Column{}))
+	assert.Error(t, parseCSLSchema(`['a:string`, map[string]types.Column{}))
+}
+
+func TestEnsureTableFromStruct(t *testing.T) {
+	t.Parallel()
+
+	type rec struct {
+		Name  string
+		Count int32 `json:"count"`
+	}
+
+	const (
+		createCmd  = `.create-merge table ["Events"] (["Name"]:string, ["count"]:int)`
+		mappingCmd = `.create-or-alter table ["Events"] ingestion json mapping "map" ` +
+			`"[{\"column\":\"Name\",\"Properties\":{\"Path\":\"$.Name\"}},{\"column\":\"count\",\"Properties\":{\"Path\":\"$.count\"}}]"`
+	)
+
+	tests := []struct {
+		desc     string
+		schema   string
+		want     []string
+		wantKind errors.Kind
+	}{
+		{
+			desc: "New table",
+			want: []string{`.show table ["Events"] cslschema`, createCmd, mappingCmd},
+		},
+		{
+			desc:   "Existing table with other columns",
+			schema: "Name:string, Other:dynamic",
+			want:   []string{`.show table ["Events"] cslschema`, createCmd, mappingCmd},
+		},
+		{
+			desc:     "Existing column of another type",
+			schema:   "Name:string, count:long",
+			want:     []string{`.show table ["Events"] cslschema`},
+			wantKind: errors.KClientArgs,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var got []string
+			client := mockClient{
+				onMgmt: func(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+					assert.Equal(t, "db", db)
+					got = append(got, query.String())
+					if !strings.HasSuffix(query.String(), "cslschema") {
+						return nil, nil
+					}
+					if test.schema == "" {
+						return nil, errors.HTTP(errors.OpMgmt, "400 Bad Request", ioutil.NopCloser(strings.NewReader(entityNotFoundBody)), "")
+					}
+
+					mock, err := kusto.NewMockRows(table.Columns{{Name: "TableName", Type: types.String}, {Name: "Schema", Type: types.String}})
+					require.NoError(t, err)
+					require.NoError(t, mock.Row(value.Values{value.String{Value: "Events", Valid: true}, value.String{Value: test.schema, Valid: true}}))
+					iter := &kusto.RowIterator{}
+					require.NoError(t, iter.Mock(mock))
+					return iter, nil
+				},
+			}
+
+			name, err := EnsureTableFromStruct(context.Background(), client, "db", "Events", rec{}, MappingName("map"))
+			if test.wantKind != errors.KOther {
+				require.Error(t, err)
+				assert.Equal(t, test.wantKind, err.(*errors.Error).Kind)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, "map", name)
+			}
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/unsafe"
+	"github.com/google/uuid"
+)
+
+// lookupFailureSkew is how long before the Result of an ingestion LookupFailure() looks for its failure, for the
+// clock of the client to be ahead of the one of the service.
+const lookupFailureSkew = 5 * time.Minute
+
+// IngestionFailure is a failure of a queued ingestion, as listed by the ".show ingestion failures" command.
+type IngestionFailure struct {
+	// OperationID is the id of the operation of the ingestion.
+	OperationID uuid.UUID `kusto:"OperationId"`
+	// Database and Table are where the data was to be ingested.
+	Database string
+	Table    string
+	// FailedOn is when the ingestion failed.
+	FailedOn time.Time
+	// IngestionSourcePath is the URI of the blob that the data was read from, without its secrets.
+	IngestionSourcePath string
+	// Details is the description of the failure.
+	Details string
+	// FailureKind is Permanent or Transient.
+	FailureKind FailureStatusCode
+	// ErrorCode is the code of the failure, such as "BadRequest_EmptyBlob", see StatusRecord.ErrorCode.
+	ErrorCode string
+	// OriginatesFromUpdatePolicy is set when the failure is of an update policy of the table.
+	OriginatesFromUpdatePolicy bool
+	// RootActivityID is the id of the activity of the ingestion, for the support of the service.
+	RootActivityID uuid.UUID `kusto:"RootActivityId"`
+	// OperationKind is the kind of the operation, such as "DataIngestPull".
+	OperationKind string
+	// ShouldRetry is set when the service would retry the ingestion.
+	ShouldRetry bool
+}
+
+// FailureQueryOption is an optional argument to IngestionFailures().
+type FailureQueryOption func(o *failureQuery)
+
+type failureQuery struct {
+	since, before time.Time
+	table         string
+	operationID   uuid.UUID
+	sourcePath    string
+}
+
+// FailedSince only lists the failures that happened at t or after it.
+func FailedSince(t time.Time) FailureQueryOption {
+	return func(o *failureQuery) {
+		o.since = t
+	}
+}
+
+// FailedBefore only lists the failures that happened before t.
+func FailedBefore(t time.Time) FailureQueryOption {
+	return func(o *failureQuery) {
+		o.before = t
+	}
+}
+
+// FailuresOfTable only lists the failures of the ingestions to the table called name.
+func FailuresOfTable(name string) FailureQueryOption {
+	return func(o *failureQuery) {
+		o.table = name
+	}
+}
+
+// FailuresOfOperation only lists the failures of the operation with id, such as the OperationID of a StatusRecord.
+func FailuresOfOperation(id uuid.UUID) FailureQueryOption {
+	return func(o *failureQuery) {
+		o.operationID = id
+	}
+}
+
+// FailuresOfSource only lists the failures of the ingestions of the blobs whose URI contains path, such as the name
+// of a blob. The query of a URI, which holds its shared access signature, is ignored.
+func FailuresOfSource(path string) FailureQueryOption {
+	return func(o *failureQuery) {
+		o.sourcePath = path
+	}
+}
+
+// IngestionFailures lists the failures of the queued ingestions to db with the ".show ingestion failures" command,
+// which the service keeps for 14 days, oldest first. The options filter the failures in the service. The user of
+// client needs to be an admin or an ingestor of db, or a monitor of the cluster. Columns that the service adds to
+// the result over time are ignored.
+func IngestionFailures(ctx context.Context, client QueryClient, db string, options ...FailureQueryOption) ([]IngestionFailure, error) {
+	o := failureQuery{}
+	for _, option := range options {
+		option(&o)
+	}
+
+	iter, err := client.Mgmt(ctx, db, o.stmt())
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Stop()
+
+	var failures []IngestionFailure
+	err = iter.DoOnRowOrError(func(row *table.Row, e *errors.Error) error {
+		if e != nil {
+			return e
+		}
+		var f IngestionFailure
+		if err := row.ToStruct(&f); err != nil {
+			return errors.E(errors.OpMgmt, errors.KInternal, fmt.Errorf("could not decode the result of .show ingestion failures: %w", err))
+		}
+		failures = append(failures, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+// stmt returns the ".show ingestion failures" command with the filters of o.
+func (o failureQuery) stmt() kusto.Stmt {
+	var filters []string
+	if !o.since.IsZero() {
+		filters = append(filters, "FailedOn >= "+datetimeLiteral(o.since))
+	}
+	if !o.before.IsZero() {
+		filters = append(filters, "FailedOn < "+datetimeLiteral(o.before))
+	}
+	if o.table != "" {
+		filters = append(filters, "Table == "+quoteString(o.table))
+	}
+	if o.operationID != uuid.Nil {
+		filters = append(filters, "OperationId == guid("+o.operationID.String()+")")
+	}
+	if path := withoutQuery(o.sourcePath); path != "" {
+		filters = append(filters, "IngestionSourcePath contains "+quoteString(path))
+	}
+
+	stmt := kusto.NewStmt(".show ingestion failures", kusto.UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true}))
+	if len(filters) > 0 {
+		stmt = stmt.UnsafeAdd(" | where " + strings.Join(filters, " and "))
+	}
+	return stmt.Add(" | order by FailedOn asc")
+}
+
+// datetimeLiteral returns t as a Kusto datetime literal.
+func datetimeLiteral(t time.Time) string {
+	return "datetime(" + t.UTC().Format(time.RFC3339Nano) + ")"
+}
+
+// withoutQuery returns path without the query of a URI.
+func withoutQuery(path string) string {
+	if u, err := url.Parse(path); err == nil && u.Scheme != "" {
+		u.RawQuery = ""
+		u.ForceQuery = false
+		return u.String()
+	}
+	return path
+}
+
+// LookupFailure returns the failure of the queued ingestion of r with IngestionFailures(), or nil if the service
+// did not list one. The rows of the failures have no source id, so the ingestion is found by the blob it was read
+// from: the blob that FromFile() or FromReader() staged, or the one that was queued. client needs the permissions
+// of IngestionFailures(). Failures are listed a few minutes after they happen, and only when the service gave up on
+// the ingestion.
+func (r *Result) LookupFailure(ctx context.Context, client QueryClient) (*IngestionFailure, error) {
+	if r.method != QueuedIngestion {
+		return nil, errors.ES(errors.OpFileIngest, errors.KClientArgs, "LookupFailure() can only look up queued ingestions").SetNoRetry()
+	}
+
+	source := r.blobName
+	if source == "" {
+		source = r.record.IngestionSourcePath
+	}
+	if source == "" || source == undefinedString {
+		return nil, errors.ES(errors.OpFileIngest, errors.KClientArgs, "LookupFailure(): the blob of the ingestion is not known").SetNoRetry()
+	}
+
+	options := []FailureQueryOption{FailuresOfTable(r.record.Table), FailuresOfSource(source)}
+	if !r.queuedOn.IsZero() {
+		options = append(options, FailedSince(r.queuedOn.Add(-lookupFailureSkew)))
+	}
+	failures, err := IngestionFailures(ctx, client, r.record.Database, options...)
+	if err != nil {
+		return nil, err
+	}
+	if len(failures) == 0 {
+		return nil, nil
+	}
+	// The last failure is the one the service stopped at.
+	return &failures[len(failures)-1], nil
+}
@@ -0,0 +1,224 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failuresMgmt answers ".show ingestion failures" with rows, and records the commands it got.
+type failuresMgmt struct {
+	rows []value.Values
+	err  error
+
+	mu    sync.Mutex
+	dbs   []string
+	stmts []string
+}
+
+// failureColumns are the columns of ".show ingestion failures", with a column that the service added since.
+var failureColumns = table.Columns{
+	{Name: "OperationId", Type: types.GUID},
+	{Name: "Database", Type: types.String},
+	{Name: "Table", Type: types.String},
+	{Name: "FailedOn", Type: types.DateTime},
+	{Name: "IngestionSourcePath", Type: types.String},
+	{Name: "Details", Type: types.String},
+	{Name: "FailureKind", Type: types.String},
+	{Name: "RootActivityId", Type: types.GUID},
+	{Name: "OperationKind", Type: types.String},
+	{Name: "OriginatesFromUpdatePolicy", Type: types.Bool},
+	{Name: "ErrorCode", Type: types.String},
+	{Name: "Principal", Type: types.String},
+	{Name: "ShouldRetry", Type: types.Bool},
+	{Name: "NewColumn", Type: types.Dynamic},
+}
+
+func failureRow(op uuid.UUID, failedOn time.Time, path, code string) value.Values {
+	return value.Values{
+		value.GUID{Value: op, Valid: true},
+		value.String{Value: "db", Valid: true},
+		value.String{Value: "table", Valid: true},
+		value.DateTime{Value: failedOn, Valid: true},
+		value.String{Value: path, Valid: true},
+		value.String{Value: "details of " + code, Valid: true},
+		value.String{Value: "Permanent", Valid: true},
+		value.GUID{Value: op, Valid: true},
+		value.String{Value: "DataIngestPull", Valid: true},
+		value.Bool{Value: false, Valid: true},
+		value.String{Value: code, Valid: true},
+		value.String{Value: "aadapp=app", Valid: true},
+		value.Bool{Value: false, Valid: true},
+		value.Dynamic{Value: []byte(`{"a":1}`), Valid: true},
+	}
+}
+
+func (f *failuresMgmt) client() mockClient {
+	return mockClient{
+		endpoint: "https://test.kusto.windows.net",
+		onMgmt: func(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+			if !strings.HasPrefix(query.String(), ".show ingestion failures") {
+				return nil, nil
+			}
+			f.mu.Lock()
+			f.dbs = append(f.dbs, db)
+			f.stmts = append(f.stmts, query.String())
+			f.mu.Unlock()
+			if f.err != nil {
+				return nil, f.err
+			}
+			return resources.NewFakeMgmt(failureColumns, f.rows, false).Mgmt(ctx, db, query, options...)
+		},
+	}
+}
+
+func TestIngestionFailures(t *testing.T) {
+	t.Parallel()
+
+	op1, op2 := uuid.New(), uuid.New()
+	failedOn := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	mgmt := &failuresMgmt{rows: []value.Values{
+		failureRow(op1, failedOn, "https://account.blob.core.windows.net/container/a.csv", "BadRequest_EmptyBlob"),
+		failureRow(op2, failedOn.Add(time.Minute), "https://account.blob.core.windows.net/container/b.csv", "Stream_WrongNumberOfFields"),
+	}}
+
+	failures, err := IngestionFailures(context.Background(), mgmt.client(), "db")
+	require.NoError(t, err)
+	require.Len(t, failures, 2)
+	assert.Equal(t, IngestionFailure{
+		OperationID:         op1,
+		Database:            "db",
+		Table:               "table",
+		FailedOn:            failedOn,
+		IngestionSourcePath: "https://account.blob.core.windows.net/container/a.csv",
+		Details:             "details of BadRequest_EmptyBlob",
+		FailureKind:         Permanent,
+		ErrorCode:           "BadRequest_EmptyBlob",
+		RootActivityID:      op1,
+		OperationKind:       "DataIngestPull",
+	}, failures[0])
+	assert.Equal(t, op2, failures[1].OperationID)
+	assert.Equal(t, []string{"db"}, mgmt.dbs)
+	assert.Equal(t, []string{".show ingestion failures | order by FailedOn asc"}, mgmt.stmts)
+
+	// The errors of the command are returned as they are.
+	mgmtErr := errors.ES(errors.OpMgmt, errors.KHTTPError, "forbidden")
+	mgmt = &failuresMgmt{err: mgmtErr}
+	_, err = IngestionFailures(context.Background(), mgmt.client(), "db")
+	assert.True(t, goErrors.Is(err, mgmtErr))
+}
+
+func TestFailureQueryStmt(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(2023, 1, 2, 3, 4, 5, 600, time.FixedZone("", 3600))
+	op := uuid.MustParse("3f6a0f5d-6b41-4a0e-8a43-b6b1c5b25c4f")
+
+	tests := []struct {
+		desc    string
+		options []FailureQueryOption
+		want    string
+	}{
+		{
+			desc: "No filters",
+			want: ".show ingestion failures | order by FailedOn asc",
+		},
+		{
+			desc:    "Time window",
+			options: []FailureQueryOption{FailedSince(since), FailedBefore(since.Add(time.Hour))},
+			want: ".show ingestion failures | where FailedOn >= datetime(2023-01-02T02:04:05.0000006Z) and " +
+				"FailedOn < datetime(2023-01-02T03:04:05.0000006Z) | order by FailedOn asc",
+		},
+		{
+			desc:    "Table and operation",
+			options: []FailureQueryOption{FailuresOfTable(`my "table"`), FailuresOfOperation(op)},
+			want: `.show ingestion failures | where Table == "my \"table\"" and ` +
+				`OperationId == guid(3f6a0f5d-6b41-4a0e-8a43-b6b1c5b25c4f) | order by FailedOn asc`,
+		},
+		{
+			desc:    "Source without its signature",
+			options: []FailureQueryOption{FailuresOfSource("https://account.blob.core.windows.net/container/a.csv?sig=secret")},
+			want:    `.show ingestion failures | where IngestionSourcePath contains "https://account.blob.core.windows.net/container/a.csv" | order by FailedOn asc`,
+		},
+		{
+			desc:    "Source by blob name",
+			options: []FailureQueryOption{FailuresOfSource("db_table_1.csv.gz")},
+			want:    `.show ingestion failures | where IngestionSourcePath contains "db_table_1.csv.gz" | order by FailedOn asc`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			o := failureQuery{}
+			for _, option := range test.options {
+				option(&o)
+			}
+			assert.Equal(t, test.want, o.stmt().String())
+		})
+	}
+}
+
+func TestLookupFailure(t *testing.T) {
+	t.Parallel()
+
+	op1, op2 := uuid.New(), uuid.New()
+	now := time.Now().UTC()
+	mgmt := &failuresMgmt{rows: []value.Values{
+		failureRow(op1, now, "https://account.blob.core.windows.net/container/db_table_1.csv.gz", "General_InternalServerError"),
+		failureRow(op2, now.Add(time.Minute), "https://account.blob.core.windows.net/container/db_table_1.csv.gz", "BadRequest_EmptyBlob"),
+	}}
+
+	ingestion, err := New(mgmt.client(), "db", "table")
+	require.NoError(t, err)
+	defer ingestion.Close()
+	ingestion.fs = resources.FsMock{
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			return "db_table_1.csv.gz", nil
+		},
+	}
+
+	result, err := ingestion.FromReader(context.Background(), strings.NewReader("a,b"))
+	require.NoError(t, err)
+
+	failure, err := result.LookupFailure(context.Background(), mgmt.client())
+	require.NoError(t, err)
+	require.NotNil(t, failure)
+	assert.Equal(t, op2, failure.OperationID, "the last failure is the one the service stopped at")
+	assert.Equal(t, "BadRequest_EmptyBlob", failure.ErrorCode)
+
+	require.Len(t, mgmt.stmts, 1)
+	assert.Equal(t, "db", mgmt.dbs[0])
+	assert.Contains(t, mgmt.stmts[0], `Table == "table"`)
+	assert.Contains(t, mgmt.stmts[0], `IngestionSourcePath contains "db_table_1.csv.gz"`)
+	assert.Contains(t, mgmt.stmts[0], "FailedOn >= datetime(")
+
+	// No failure was listed.
+	mgmt.rows = nil
+	failure, err = result.LookupFailure(context.Background(), mgmt.client())
+	require.NoError(t, err)
+	assert.Nil(t, failure)
+
+	// Only queued ingestions are listed.
+	streamed := newResult()
+	streamed.method = StreamingIngestion
+	_, err = streamed.LookupFailure(context.Background(), mgmt.client())
+	assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+}
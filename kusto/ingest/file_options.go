@@ -3,15 +3,19 @@ package ingest
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/gzip"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
-	"github.com/cenkalti/backoff/v4"
 )
 
+// SourceScope is a set of the ingestion methods, by the source of the data, that a FileOption applies to.
 type SourceScope uint
 
+// ClientScope is a set of the clients that a FileOption applies to.
 type ClientScope uint
 
 const (
@@ -23,28 +27,94 @@ const (
 	ManagedClient
 )
 
+var sourceNames = []struct {
+	scope SourceScope
+	name  string
+}{{FromFile, "FromFile"}, {FromReader, "FromReader"}, {FromBlob, "FromBlob"}}
+
+var clientNames = []struct {
+	scope ClientScope
+	name  string
+	// kind is how the ingestion of the client is called in messages.
+	kind string
+}{{QueuedClient, "QueuedClient", "queued"}, {StreamingClient, "StreamingClient", "streaming"}, {ManagedClient, "ManagedClient", "managed streaming"}}
+
+// String returns the names of the sources in s, separated with "|".
 func (s SourceScope) String() string {
-	switch s {
-	case FromFile:
-		return "FromFile"
-	case FromReader:
-		return "FromReader"
-	case FromBlob:
-		return "FromBlob"
-	default:
-		panic(fmt.Sprintf("unknown SourceScope %d", s))
+	var names []string
+	for _, n := range sourceNames {
+		if s&n.scope != 0 {
+			names = append(names, n.name)
+			s &^= n.scope
+		}
 	}
+	if s != 0 || len(names) == 0 {
+		names = append(names, fmt.Sprintf("SourceScope(%d)", s))
+	}
+	return strings.Join(names, "|")
 }
 
+// String returns the names of the clients in s, separated with "|".
 func (s ClientScope) String() string {
-	switch s {
-	case QueuedClient:
-		return "QueuedClient"
-	case StreamingClient:
-		return "StreamingClient"
-	default:
-		panic(fmt.Sprintf("unknown ClientScope %d", s))
+	var names []string
+	for _, n := range clientNames {
+		if s&n.scope != 0 {
+			names = append(names, n.name)
+			s &^= n.scope
+		}
+	}
+	if s != 0 || len(names) == 0 {
+		names = append(names, fmt.Sprintf("ClientScope(%d)", s))
+	}
+	return strings.Join(names, "|")
+}
+
+// OptionError is the error of a FileOption passed to a client or an ingestion method that it does not apply to.
+// It is wrapped in an *errors.Error of Kind errors.KOptionInvalid and can be found with errors.As().
+type OptionError struct {
+	// Option is the name of the option, such as "DeleteSource".
+	Option string
+	// Client and Source are the client and the ingestion method that the option was passed to.
+	Client ClientScope
+	Source SourceScope
+	// ValidClients and ValidSources are the clients and the ingestion methods that the option applies to.
+	ValidClients ClientScope
+	ValidSources SourceScope
+}
+
+// Error implements error.
+func (e *OptionError) Error() string {
+	var kinds, valid []string
+	for _, n := range clientNames {
+		if e.Client&n.scope != 0 {
+			kinds = append(kinds, n.kind)
+		}
+		if e.ValidClients&n.scope != 0 {
+			valid = append(valid, n.kind)
+		}
+	}
+	var sources []string
+	for _, n := range sourceNames {
+		if e.ValidSources&n.scope != 0 {
+			sources = append(sources, n.name+"()")
+		}
+	}
+
+	return fmt.Sprintf(
+		"option %s() is not valid for %s ingestion with %s() (valid for: %s ingestion with %s)",
+		e.Option, joinNames(kinds), e.Source, joinNames(valid), joinNames(sources),
+	)
+}
+
+// joinNames joins names as in "a, b and c".
+func joinNames(names []string) string {
+	switch len(names) {
+	case 0:
+		return "no"
+	case 1:
+		return names[0]
 	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
 }
 
 // FileOption is an optional argument to FromFile().
@@ -82,12 +152,14 @@ func (o option) Run(p *properties.All, clientType ClientScope, sourceType Source
 		errType = errors.OpIngestStream
 	}
 
-	if o.clientScopes&clientType == 0 {
-		return errors.ES(errType, errors.KClientArgs, fmt.Sprintf("%s is not valid for client '%s'", o.name, clientType))
-	}
-
-	if o.sourceScope&sourceType == 0 {
-		return errors.ES(errType, errors.KClientArgs, fmt.Sprintf("%s is not valid for ingestion source type '%s' for client '%s'", o.name, sourceType, clientType))
+	if o.clientScopes&clientType == 0 || o.sourceScope&sourceType == 0 {
+		return errors.E(errType, errors.KOptionInvalid, &OptionError{
+			Option:       o.name,
+			Client:       clientType,
+			Source:       sourceType,
+			ValidClients: o.clientScopes,
+			ValidSources: o.sourceScope,
+		}).SetNoRetry()
 	}
 
 	return o.run(p)
@@ -132,10 +204,133 @@ func DontCompress() FileOption {
 	}
 }
 
-func backOff(off *backoff.ExponentialBackOff) FileOption {
+// CompressionType is the compression of the data of an ingestion.
+type CompressionType = properties.CompressionType
+
+const (
+	// CTNone is data that is not compressed.
+	CTNone CompressionType = properties.CTNone
+	// CTGZip is data compressed with gzip.
+	CTGZip CompressionType = properties.GZIP
+	// CTZip is a zip archive. Only queued ingestion takes zip data.
+	CTZip CompressionType = properties.ZIP
+)
+
+// Compression sets the compression of the source, instead of finding it from the extension of the file or blob name,
+// where a reader is taken as not compressed. A source of CTGZip or CTZip is sent as it is, one of CTNone is compressed
+// with gzip unless DontCompress() is also set. Streaming ingestion takes CTGZip data but not CTZip data, which
+// Managed sends with queued ingestion. Result.Compression() returns the compression of the data that was sent.
+func Compression(c CompressionType) FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			switch c {
+			case CTNone, CTGZip, CTZip:
+			default:
+				return errors.ES(errors.OpUnknown, errors.KClientArgs, "Compression(%d): not a compression type", c).SetNoRetry()
+			}
+			p.Source.Compression = c
+			return nil
+		},
+		clientScopes: QueuedClient | StreamingClient | ManagedClient,
+		sourceScope:  FromFile | FromReader | FromBlob,
+		name:         "Compression",
+	}
+}
+
+// BlobNameHint adds name to the name of the blob that queued ingestion stages the data in, such as to find the blob
+// of an ingestion when debugging it. Characters other than ASCII letters, digits, '-', '.' and '_' are replaced with
+// '_' and name is cut to 128 characters. The blob name still ends with a UUID and the extension of the data, so the
+// same name can be used for many ingestions. Result.BlobName() returns the blob name. See also WithStagingPrefix().
+func BlobNameHint(name string) FileOption {
 	return option{
 		run: func(p *properties.All) error {
-			p.ManagedStreaming.Backoff = off
+			p.Source.BlobNameHint = name
+			return nil
+		},
+		clientScopes: QueuedClient | ManagedClient,
+		sourceScope:  FromFile | FromReader,
+		name:         "BlobNameHint",
+	}
+}
+
+// blobMetadataKey matches the names of blob metadata, which must be C# identifiers. Only ASCII ones are accepted, as
+// they are sent as HTTP headers.
+var blobMetadataKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// WithBlobMetadata sets the metadata of the blob that queued ingestion stages the data in, such as the tags that the
+// governance of a storage account requires. The keys must be valid C# identifiers and must differ in more than
+// their case, as blob metadata names are case-insensitive. The metadata is not sent to Kusto. It is ignored, with a
+// warning in Result.Warnings(), when the data is ingested from a blob URI, as the client creates no blob.
+func WithBlobMetadata(metadata map[string]string) FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			copied := make(map[string]string, len(metadata))
+			seen := make(map[string]string, len(metadata))
+			for k, v := range metadata {
+				if !blobMetadataKey.MatchString(k) {
+					return errors.ES(errors.OpUnknown, errors.KClientArgs, "WithBlobMetadata(): %q is not a valid metadata name, which must be a C# identifier", k).SetNoRetry()
+				}
+				if other, ok := seen[strings.ToLower(k)]; ok {
+					return errors.ES(errors.OpUnknown, errors.KClientArgs, "WithBlobMetadata(): the metadata names %q and %q only differ in their case", other, k).SetNoRetry()
+				}
+				seen[strings.ToLower(k)] = k
+				copied[k] = v
+			}
+			p.Source.BlobMetadata = copied
+			return nil
+		},
+		clientScopes: QueuedClient | ManagedClient,
+		sourceScope:  FromFile | FromReader | FromBlob,
+		name:         "WithBlobMetadata",
+	}
+}
+
+// WithBlobTier sets the access tier of the blob that queued ingestion stages the data in, "Hot" or "Cool", such as
+// "Cool" for blobs that are only read once by the ingestion. "Archive" is not accepted, as Kusto could not read the
+// blob. The default is the tier of the storage account. As WithBlobMetadata(), it is ignored when the data is
+// ingested from a blob URI.
+func WithBlobTier(tier string) FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			switch {
+			case strings.EqualFold(tier, "Hot"):
+				p.Source.BlobTier = "Hot"
+			case strings.EqualFold(tier, "Cool"):
+				p.Source.BlobTier = "Cool"
+			default:
+				return errors.ES(errors.OpUnknown, errors.KClientArgs, "WithBlobTier(%q): the tier must be Hot or Cool", tier).SetNoRetry()
+			}
+			return nil
+		},
+		clientScopes: QueuedClient | ManagedClient,
+		sourceScope:  FromFile | FromReader | FromBlob,
+		name:         "WithBlobTier",
+	}
+}
+
+// CompressionLevel sets the gzip level that the client compresses the data with, from gzip.HuffmanOnly to
+// gzip.BestCompression of the compress/gzip package. gzip.BestSpeed suits CPU bound ingestion, gzip.BestCompression
+// reduces the bytes uploaded. It has no effect with DontCompress() or on data that is already compressed.
+func CompressionLevel(level int) FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			if err := gzip.ValidateLevel(level); err != nil {
+				return errors.E(errors.OpUnknown, errors.KClientArgs, fmt.Errorf("CompressionLevel(): %w", err)).SetNoRetry()
+			}
+			p.Source.CompressionLevel = level
+			p.Source.CompressionLevelSet = true
+			return nil
+		},
+		clientScopes: QueuedClient | StreamingClient | ManagedClient,
+		sourceScope:  FromFile | FromReader,
+		name:         "CompressionLevel",
+	}
+}
+
+func backOff(policy BackoffPolicy) FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			p.ManagedStreaming.Retry = policy
 			return nil
 		},
 		clientScopes: ManagedClient,
@@ -191,7 +386,8 @@ const (
 	SCSV DataFormat = properties.SCSV
 	// SOHSV is a file containing SOH-separated values(ASCII codepoint 1).
 	SOHSV DataFormat = properties.SOHSV
-	// SStream indicates the source is encoded as a Microsoft Cosmos Structured Streams format
+	// SStream indicates the source is encoded as a Microsoft Cosmos Structured Streams format. It can only be ingested with
+	// queued ingestion.
 	SStream DataFormat = properties.SStream
 	// TSV is a file containing tab seperated values ("\t").
 	TSV DataFormat = properties.TSV
@@ -199,16 +395,24 @@ const (
 	TSVE DataFormat = properties.TSVE
 	// TXT is a text file with lines ending with "\n".
 	TXT DataFormat = properties.TXT
-	// W3CLogFile indicates the source is encoded using W3C Extended Log File format
+	// W3CLogFile indicates the source is encoded using W3C Extended Log File format. This is the format detected for ".log" files.
 	W3CLogFile DataFormat = properties.W3CLogFile
 	// SingleJSON indicates the source is a single JSON value -- newlines are regular whitespace.
 	SingleJSON DataFormat = properties.SingleJSON
 )
 
+// ParseDataFormat returns the DataFormat named s. s is the name the service uses for the format, as String() returns
+// it, such as "csv" or "multijson", or one of the aliases "jsonl" and "ndjson" for MultiJSON and "text" for TXT.
+// Case is ignored. DataFormat can also be read from and written to JSON and text with these names, so it can be used
+// in configuration structs.
+func ParseDataFormat(s string) (DataFormat, error) {
+	return properties.ParseDataFormat(s)
+}
+
 // IngestionMapping provides runtime mapping of the data being imported to the fields in the table.
 // "ref" will be JSON encoded, so it can be any type that can be JSON marshalled. If you pass a string
 // or []byte, it will be interpreted as already being JSON encoded.
-// mappingKind can only be: CSV, JSON, AVRO, Parquet or ORC.
+// mappingKind can only be: CSV, JSON, AVRO, Parquet, ORC or W3CLogFile.
 func IngestionMapping(mapping interface{}, mappingKind DataFormat) FileOption {
 	return option{
 		run: func(p *properties.All) error {
@@ -238,6 +442,9 @@ func IngestionMapping(mapping interface{}, mappingKind DataFormat) FileOption {
 				j = string(b)
 			}
 
+			if err := checkMappingKind(errors.OpUnknown, p.Ingestion.Additional.Format, mappingKind); err != nil {
+				return err
+			}
 			p.Ingestion.Additional.IngestionMapping = j
 			p.Ingestion.Additional.IngestionMappingType = mappingKind
 
@@ -250,7 +457,8 @@ func IngestionMapping(mapping interface{}, mappingKind DataFormat) FileOption {
 }
 
 // IngestionMappingRef provides the name of a pre-created mapping for the data being imported to the fields in the table.
-// mappingKind can only be: CSV, JSON, AVRO, Parquet or ORC.
+// mappingKind can only be: CSV, JSON, AVRO, Parquet, ORC or W3CLogFile, and must suit the format of the data. Streaming JSON or
+// Avro data requires a mapping reference.
 // For more details, see: https://docs.microsoft.com/en-us/azure/kusto/management/create-ingestion-mapping-command
 func IngestionMappingRef(refName string, mappingKind DataFormat) FileOption {
 	return option{
@@ -258,6 +466,9 @@ func IngestionMappingRef(refName string, mappingKind DataFormat) FileOption {
 			if !mappingKind.IsValidMappingKind() {
 				return errors.ES(errors.OpUnknown, errors.KClientArgs, "IngestionMappingRef() option does not support EncodingType %v", mappingKind).SetNoRetry()
 			}
+			if err := checkMappingKind(errors.OpUnknown, p.Ingestion.Additional.Format, mappingKind); err != nil {
+				return err
+			}
 			p.Ingestion.Additional.IngestionMappingRef = refName
 			p.Ingestion.Additional.IngestionMappingType = mappingKind
 			return nil
@@ -281,6 +492,21 @@ func DeleteSource() FileOption {
 	}
 }
 
+// DeleteBlobOnEnqueueFailure deletes the blob that the data was uploaded to if the blob cannot be queued for
+// ingestion. By default the blob is kept, and the error wraps an *EnqueueError with its URI, which RetryEnqueue()
+// queues again without uploading the data again.
+func DeleteBlobOnEnqueueFailure() FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			p.Source.DeleteBlobOnEnqueueFailure = true
+			return nil
+		},
+		clientScopes: QueuedClient | ManagedClient,
+		sourceScope:  FromFile | FromReader,
+		name:         "DeleteBlobOnEnqueueFailure",
+	}
+}
+
 // IgnoreSizeLimit ignores the size limit for data ingestion.
 func IgnoreSizeLimit() FileOption {
 	return option{
@@ -409,11 +635,17 @@ func ValidationPolicy(policy ValPolicy) FileOption {
 }
 
 // FileFormat can be used to indicate what type of encoding is supported for the file. This is only needed if
-// the file extension is not present. A file like: "input.json.gz" or "input.json" does not need this option, while
+// the file extension is not present. A file like: "input.csv.gz" or "input.csv" does not need this option, while
 // "input" would.
+// Files with a ".json" extension are ingested as MultiJSON, which accepts both one record per line and records that
+// span lines. Use FileFormat(JSON) only for data that has exactly one record per line, as with that format
+// Kusto stops at the first line that is not a complete record.
 func FileFormat(et DataFormat) FileOption {
 	return option{
 		run: func(p *properties.All) error {
+			if err := checkMappingKind(errors.OpUnknown, et, p.Ingestion.Additional.IngestionMappingType); err != nil {
+				return err
+			}
 			p.Ingestion.Additional.Format = et
 			return nil
 		},
@@ -423,6 +655,22 @@ func FileFormat(et DataFormat) FileOption {
 	}
 }
 
+// checkMappingKind returns an error of Kind errors.KMappingInvalid for op if data of format cannot be mapped with a
+// mapping of kind. Either being unknown means there is nothing to check yet.
+func checkMappingKind(op errors.Op, format, kind DataFormat) error {
+	if format == DFUnknown || kind == DFUnknown || format.MappingKind() == kind {
+		return nil
+	}
+	if format.MappingKind() == DFUnknown {
+		return errors.ES(op, errors.KMappingInvalid, "data of format %s does not use an ingestion mapping, but a mapping of kind %s was set", format.CamelCase(), kind.CamelCase()).SetNoRetry()
+	}
+	return errors.ES(
+		op,
+		errors.KMappingInvalid,
+		"data of format %s needs an ingestion mapping of kind %s, but the mapping is of kind %s", format.CamelCase(), format.MappingKind().CamelCase(), kind.CamelCase(),
+	).SetNoRetry()
+}
+
 // ClientRequestId is an identifier for the ingestion, that can later be queried.
 func ClientRequestId(clientRequestId string) FileOption {
 	return option{
@@ -435,3 +683,36 @@ func ClientRequestId(clientRequestId string) FileOption {
 		name:         "ClientRequestId",
 	}
 }
+
+// AdditionalProperties sets ingestion properties that the SDK has no FileOption for, such as ones that the service
+// added since. They go in the AdditionalProperties of queued ingestion and in the query parameters of streaming
+// ingestion, with each value sent as the string it is given, so a JSON value must be passed already encoded. The
+// properties that other FileOptions set win over these, and the ones that the SDK sets itself, such as "format",
+// "ingestionMappingReference" or "authorizationContext", cannot be set and are an error. Calls add to each other.
+func AdditionalProperties(props map[string]string) FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			for k := range props {
+				if k == "" {
+					return errors.ES(errors.OpUnknown, errors.KClientArgs, "AdditionalProperties(): a property name cannot be empty").SetNoRetry()
+				}
+				if properties.IsManagedAdditional(k) {
+					return errors.ES(errors.OpUnknown, errors.KClientArgs, "AdditionalProperties(): property %q is set by the SDK, use the FileOption for it instead", k).SetNoRetry()
+				}
+			}
+
+			extra := make(map[string]string, len(p.Ingestion.Additional.Extra)+len(props))
+			for k, v := range p.Ingestion.Additional.Extra {
+				extra[k] = v
+			}
+			for k, v := range props {
+				extra[k] = v
+			}
+			p.Ingestion.Additional.Extra = extra
+			return nil
+		},
+		sourceScope:  FromFile | FromReader | FromBlob,
+		clientScopes: QueuedClient | StreamingClient | ManagedClient,
+		name:         "AdditionalProperties",
+	}
+}
@@ -2,11 +2,21 @@ package ingest
 
 import (
 	"bytes"
+	stdgzip "compress/gzip"
 	"context"
+	goErrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto"
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -74,7 +84,7 @@ func TestOptions(t *testing.T) {
 			ingestor: streamingClient,
 			from:     fromFile,
 			op:       errors.OpIngestStream,
-			kind:     errors.KClientArgs,
+			kind:     errors.KOptionInvalid,
 		},
 		{
 			desc:     "Invalid option for queued ingestor from file",
@@ -82,7 +92,7 @@ func TestOptions(t *testing.T) {
 			ingestor: queuedClient,
 			from:     fromFile,
 			op:       errors.OpFileIngest,
-			kind:     errors.KClientArgs,
+			kind:     errors.KOptionInvalid,
 		},
 		{
 			desc:     "Invalid option for queued ingestor from reader",
@@ -90,7 +100,7 @@ func TestOptions(t *testing.T) {
 			ingestor: queuedClient,
 			from:     fromReader,
 			op:       errors.OpFileIngest,
-			kind:     errors.KClientArgs,
+			kind:     errors.KOptionInvalid,
 		},
 		{
 			desc:     "Invalid option for queued ingestor from blob",
@@ -98,7 +108,7 @@ func TestOptions(t *testing.T) {
 			ingestor: queuedClient,
 			from:     fromBlob,
 			op:       errors.OpFileIngest,
-			kind:     errors.KClientArgs,
+			kind:     errors.KOptionInvalid,
 		},
 		{
 			desc:     "Invalid option for streaming ingestor from reader",
@@ -106,7 +116,7 @@ func TestOptions(t *testing.T) {
 			ingestor: streamingClient,
 			from:     fromReader,
 			op:       errors.OpIngestStream,
-			kind:     errors.KClientArgs,
+			kind:     errors.KOptionInvalid,
 		},
 		{
 			desc:     "Invalid option for managed ingestor from reader",
@@ -114,7 +124,7 @@ func TestOptions(t *testing.T) {
 			ingestor: managedClient,
 			from:     fromReader,
 			op:       errors.OpFileIngest,
-			kind:     errors.KClientArgs,
+			kind:     errors.KOptionInvalid,
 		},
 	}
 
@@ -144,3 +154,357 @@ func TestOptions(t *testing.T) {
 
 	}
 }
+
+func TestOptionScopes(t *testing.T) {
+	t.Parallel()
+
+	all := QueuedClient | StreamingClient | ManagedClient
+	queued := QueuedClient | ManagedClient
+	anySource := FromFile | FromReader | FromBlob
+
+	tests := []struct {
+		option  FileOption
+		clients ClientScope
+		sources SourceScope
+	}{
+		{option: Database("db"), clients: all, sources: anySource},
+		{option: Table("table"), clients: all, sources: anySource},
+		{option: DontCompress(), clients: all, sources: FromFile | FromReader},
+		{option: BlobNameHint("hint"), clients: queued, sources: FromFile | FromReader},
+		{option: CompressionLevel(1), clients: all, sources: FromFile | FromReader},
+		{option: WithBlobMetadata(map[string]string{"costCenter": "1"}), clients: queued, sources: anySource},
+		{option: WithBlobTier("Cool"), clients: queued, sources: anySource},
+		{option: backOff(BackoffPolicy{}), clients: ManagedClient, sources: anySource},
+		{option: FlushImmediately(), clients: queued, sources: anySource},
+		{option: IngestionMapping(`[{"column":"a","Properties":{"Ordinal":"0"}}]`, CSV), clients: queued, sources: anySource},
+		{option: IngestionMappingRef("map", CSV), clients: all, sources: anySource},
+		{option: DeleteSource(), clients: all, sources: FromFile},
+		{option: DeleteBlobOnEnqueueFailure(), clients: queued, sources: FromFile | FromReader},
+		{option: IgnoreSizeLimit(), clients: queued, sources: anySource},
+		{option: Tags([]string{"tag"}), clients: queued, sources: anySource},
+		{option: IfNotExists("tag"), clients: queued, sources: anySource},
+		{option: ReportResultToTable(), clients: queued, sources: anySource},
+		{option: SetCreationTime(time.Now()), clients: queued, sources: anySource},
+		{option: ValidationPolicy(ValPolicy{}), clients: queued, sources: anySource},
+		{option: FileFormat(CSV), clients: all, sources: anySource},
+		{option: ClientRequestId("id"), clients: StreamingClient | ManagedClient, sources: anySource},
+		{option: ValidateTarget(), clients: queued, sources: anySource},
+		{option: SourceID(uuid.New()), clients: queued, sources: anySource},
+		{option: SkipIfAlreadySucceeded(), clients: queued, sources: anySource},
+		{option: SplitSize(mb), clients: QueuedClient, sources: FromReader},
+		{option: AdditionalProperties(map[string]string{"zipPattern": "*.csv"}), clients: all, sources: anySource},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.clients, test.option.ClientScopes(), test.option.String())
+		assert.Equal(t, test.sources, test.option.SourceScopes(), test.option.String())
+
+		for _, client := range []ClientScope{QueuedClient, StreamingClient, ManagedClient} {
+			for _, source := range []SourceScope{FromFile, FromReader, FromBlob} {
+				props := properties.All{}
+				err := test.option.Run(&props, client, source)
+
+				if test.clients&client != 0 && test.sources&source != 0 {
+					assert.NoError(t, err, "%s() with %s and %s", test.option, client, source)
+					continue
+				}
+				require.Error(t, err, "%s() with %s and %s", test.option, client, source)
+				assert.Equal(t, errors.KOptionInvalid, err.(*errors.Error).Kind)
+				var oe *OptionError
+				require.True(t, goErrors.As(err, &oe))
+				assert.Equal(t, OptionError{Option: test.option.String(), Client: client, Source: source, ValidClients: test.clients, ValidSources: test.sources}, *oe)
+			}
+		}
+	}
+}
+
+func TestBlobMetadataAndTier(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		option   FileOption
+		err      bool
+		metadata map[string]string
+		tier     string
+	}{
+		{
+			desc:     "Metadata",
+			option:   WithBlobMetadata(map[string]string{"costCenter": "1234", "data_classification": "confidential", "_v2": ""}),
+			metadata: map[string]string{"costCenter": "1234", "data_classification": "confidential", "_v2": ""},
+		},
+		{desc: "Name starting with a digit", option: WithBlobMetadata(map[string]string{"2fa": "x"}), err: true},
+		{desc: "Name with a dash", option: WithBlobMetadata(map[string]string{"cost-center": "x"}), err: true},
+		{desc: "Name that is not ASCII", option: WithBlobMetadata(map[string]string{"coût": "x"}), err: true},
+		{desc: "Empty name", option: WithBlobMetadata(map[string]string{"": "x"}), err: true},
+		{desc: "Names that only differ in their case", option: WithBlobMetadata(map[string]string{"Owner": "a", "owner": "b"}), err: true},
+		{desc: "Cool", option: WithBlobTier("Cool"), tier: "Cool"},
+		{desc: "Tier in another case", option: WithBlobTier("hot"), tier: "Hot"},
+		{desc: "Archive", option: WithBlobTier("Archive"), err: true},
+		{desc: "Unknown tier", option: WithBlobTier("Premium"), err: true},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			props := properties.All{}
+			err := test.option.Run(&props, QueuedClient, FromReader)
+			if test.err {
+				require.Error(t, err)
+				assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.metadata, props.Source.BlobMetadata)
+			assert.Equal(t, test.tier, props.Source.BlobTier)
+		})
+	}
+
+	// The metadata is copied, for the caller to reuse its map.
+	metadata := map[string]string{"owner": "a"}
+	props := properties.All{}
+	require.NoError(t, WithBlobMetadata(metadata).Run(&props, QueuedClient, FromReader))
+	metadata["owner"] = "b"
+	assert.Equal(t, "a", props.Source.BlobMetadata["owner"])
+}
+
+func TestOptionError(t *testing.T) {
+	t.Parallel()
+
+	err := DeleteSource().Run(&properties.All{}, StreamingClient, FromBlob)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "option DeleteSource() is not valid for streaming ingestion with FromBlob() (valid for: queued, streaming and managed streaming ingestion with FromFile())")
+	assert.False(t, errors.Retry(err))
+
+	assert.Equal(t, "QueuedClient|ManagedClient", (QueuedClient | ManagedClient).String())
+	assert.Equal(t, "ManagedClient", ManagedClient.String())
+	assert.Equal(t, "FromFile|FromBlob", (FromFile | FromBlob).String())
+	assert.Equal(t, "SourceScope(0)", SourceScope(0).String())
+}
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("a,1\nb,2\n")
+	gz := &bytes.Buffer{}
+	zw := stdgzip.NewWriter(gz)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	type source int
+	const (
+		queuedFile source = iota
+		queuedReader
+		queuedBlob
+		streamingFile
+		streamingReader
+	)
+	sources := map[source]string{
+		queuedFile: "queued FromFile", queuedReader: "queued FromReader", queuedBlob: "queued FromBlob",
+		streamingFile: "streaming FromFile", streamingReader: "streaming FromReader",
+	}
+
+	tests := []struct {
+		desc string
+		// ext is the extension of the file or blob name.
+		ext      string
+		declared CompressionType
+		// compress is if the client compresses the data, and want the compression of the data it sends.
+		compress bool
+		want     CompressionType
+		// streamErr is if streaming refuses the source.
+		streamErr bool
+	}{
+		{desc: "Uncompressed name", ext: ".csv", compress: true, want: CTGZip},
+		{desc: "Gzip name", ext: ".csv.gz", want: CTGZip},
+		{desc: "Declared none", ext: ".csv", declared: CTNone, compress: true, want: CTGZip},
+		{desc: "Declared none over a gzip name", ext: ".csv.gz", declared: CTNone, compress: true, want: CTGZip},
+		{desc: "Declared gzip", ext: ".csv", declared: CTGZip, want: CTGZip},
+		{desc: "Declared zip", ext: ".csv", declared: CTZip, want: CTZip, streamErr: true},
+	}
+
+	formats := []struct {
+		format  DataFormat
+		options []FileOption
+		// binary is if data of the format is never gzipped by the client, as it is compressed internally.
+		binary bool
+		// queuedOnly is if data of the format cannot be streamed.
+		queuedOnly bool
+	}{
+		{format: CSV, options: []FileOption{FileFormat(CSV)}},
+		{format: JSON, options: []FileOption{FileFormat(JSON), IngestionMappingRef("map", JSON)}},
+		{format: Raw, options: []FileOption{FileFormat(Raw)}},
+		{format: TXT, options: []FileOption{FileFormat(TXT)}},
+		{format: W3CLogFile, options: []FileOption{FileFormat(W3CLogFile)}},
+		{format: AVRO, options: []FileOption{FileFormat(AVRO), IngestionMappingRef("map", AVRO)}},
+		{format: Parquet, options: []FileOption{FileFormat(Parquet)}},
+		{format: ApacheAVRO, options: []FileOption{FileFormat(ApacheAVRO), IngestionMappingRef("map", AVRO)}, binary: true},
+		{format: SStream, options: []FileOption{FileFormat(SStream)}, binary: true, queuedOnly: true},
+	}
+
+	for _, test := range tests {
+		for _, f := range formats {
+			test := test
+			if f.binary && test.compress {
+				// Binary formats are sent as they are.
+				test.compress, test.want = false, CTNone
+			}
+			test.streamErr = test.streamErr || f.queuedOnly
+
+			for src, srcName := range sources {
+				if (src == queuedReader || src == streamingReader) && test.ext != ".csv" {
+					// Readers have no name to discover the compression from.
+					continue
+				}
+				options := append([]FileOption{}, f.options...)
+				if test.declared != 0 {
+					options = append(options, Compression(test.declared))
+				}
+				payload := data
+				if test.declared == CTGZip || (test.declared == 0 && test.ext == ".csv.gz") {
+					payload = gz.Bytes()
+				}
+				desc := fmt.Sprintf("%s, %s, %s", test.desc, f.format, srcName)
+
+				file := filepath.Join(t.TempDir(), "data"+test.ext)
+				require.NoError(t, ioutil.WriteFile(file, payload, 0644))
+				blob := "https://account.blob.core.windows.net/container/data" + test.ext + "?sig=secret"
+
+				client := mockClient{endpoint: "https://test.kusto.windows.net"}
+				queuedClient, err := New(client, "db", "table")
+				require.NoError(t, err)
+				var compressed *bool
+				queuedClient.fs = resources.FsMock{
+					OnLocal: func(ctx context.Context, from string, props properties.All) (string, error) {
+						c := props.ShouldCompress()
+						compressed = &c
+						return "", nil
+					},
+					OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+						c := props.ShouldCompress()
+						compressed = &c
+						return "", nil
+					},
+				}
+
+				var sent []byte
+				var sentCompression CompressionType
+				streamingClient := &Streaming{
+					db:    "db",
+					table: "table",
+					streamConn: fakeStreamIngestor{
+						onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+							sent, err = ioutil.ReadAll(payload)
+							return err
+						},
+						onCompression: func(compression properties.CompressionType) {
+							sentCompression = compression
+						},
+					},
+				}
+
+				var result *Result
+				ctx := context.Background()
+				switch src {
+				case queuedFile:
+					result, err = queuedClient.FromFile(ctx, file, options...)
+				case queuedReader:
+					result, err = queuedClient.FromReader(ctx, bytes.NewReader(payload), options...)
+				case queuedBlob:
+					result, err = queuedClient.FromFile(ctx, blob, options...)
+				case streamingFile:
+					result, err = streamingClient.FromFile(ctx, file, options...)
+				case streamingReader:
+					result, err = streamingClient.FromReader(ctx, bytes.NewReader(payload), options...)
+				}
+
+				isStreaming := src == streamingFile || src == streamingReader
+				if isStreaming && test.streamErr {
+					assert.Error(t, err, desc)
+					continue
+				}
+				require.NoError(t, err, desc)
+
+				switch {
+				case src == queuedBlob:
+					// Blobs are ingested as they are, with the compression of their name unless it is declared.
+					want := test.declared
+					if want == 0 {
+						want = CTNone
+						if test.ext == ".csv.gz" {
+							want = CTGZip
+						}
+					}
+					assert.Equal(t, want, result.Compression(), desc)
+				case isStreaming:
+					assert.Equal(t, test.want, result.Compression(), desc)
+					// The compression the data is sent with decides its Content-Encoding header.
+					assert.Equal(t, test.want, sentCompression, desc)
+					if test.compress {
+						zr, err := stdgzip.NewReader(bytes.NewReader(sent))
+						require.NoError(t, err, desc)
+						got, err := ioutil.ReadAll(zr)
+						require.NoError(t, err, desc)
+						assert.Equal(t, payload, got, desc)
+					} else {
+						assert.Equal(t, payload, sent, desc)
+					}
+				default:
+					assert.Equal(t, test.want, result.Compression(), desc)
+					require.NotNil(t, compressed, desc)
+					assert.Equal(t, test.compress, *compressed, desc)
+				}
+			}
+		}
+	}
+}
+
+func TestAdditionalProperties(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Calls add to each other", func(t *testing.T) {
+		t.Parallel()
+
+		props := properties.All{}
+		require.NoError(t, AdditionalProperties(map[string]string{"a": "1", "b": "2"}).Run(&props, QueuedClient, FromFile))
+		require.NoError(t, AdditionalProperties(map[string]string{"b": "3", "zipPattern": "*.csv"}).Run(&props, QueuedClient, FromFile))
+		assert.Equal(t, map[string]string{"a": "1", "b": "3", "zipPattern": "*.csv"}, props.Ingestion.Additional.Extra)
+	})
+
+	t.Run("Invalid names", func(t *testing.T) {
+		t.Parallel()
+
+		for _, name := range []string{"", "format", "IngestionMappingReference", "authorizationContext", "streamFormat"} {
+			props := properties.All{}
+			err := AdditionalProperties(map[string]string{name: "x"}).Run(&props, StreamingClient, FromReader)
+			require.Error(t, err, name)
+			assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind, name)
+			assert.Nil(t, props.Ingestion.Additional.Extra, name)
+		}
+	})
+
+	t.Run("Streaming sends them as query parameters", func(t *testing.T) {
+		t.Parallel()
+
+		var got map[string]string
+		streamingClient := &Streaming{
+			db:    "db",
+			table: "table",
+			streamConn: fakeStreamIngestor{
+				onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+					return nil
+				},
+				onAdditional: func(additional map[string]string) {
+					got = additional
+				},
+			},
+		}
+
+		_, err := streamingClient.FromReader(context.Background(), bytes.NewReader([]byte("a,1\n")), FileFormat(CSV), AdditionalProperties(map[string]string{"ignoreFirstRecord": "true"}))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"ignoreFirstRecord": "true"}, got)
+	})
+}
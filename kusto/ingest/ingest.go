@@ -3,20 +3,68 @@ package ingest
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/conn"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/gzip"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/queued"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/trace"
 	"github.com/google/uuid"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 )
 
+// Ingestor is what the queued, streaming and managed clients have in common, for code that ingests data to be
+// written once and be given the client that suits it, such as with NewClient().
 type Ingestor interface {
 	FromFile(ctx context.Context, fPath string, options ...FileOption) (*Result, error)
 	FromReader(ctx context.Context, reader io.Reader, options ...FileOption) (*Result, error)
+	// FromBlob ingests the blob at blobURI, which the service reads from storage itself.
+	FromBlob(ctx context.Context, blobURI string, options ...FileOption) (*Result, error)
+	Close() error
+}
+
+var (
+	_ Ingestor = (*Ingestion)(nil)
+	_ Ingestor = (*Streaming)(nil)
+	_ Ingestor = (*Managed)(nil)
+)
+
+// NewClient returns the client of kind for db and table, such as one set by configuration: QueuedClient is New(),
+// StreamingClient is NewStreaming() and ManagedClient is NewManaged(). options are validated as New() validates them
+// for all the kinds. A streaming client takes the options about streaming ingestion, such as
+// WithStreamingEndpoint(), WithMaxStreamingSize(), WithRateLimit() or WithRetryPolicy(), and ignores the others.
+func NewClient(client QueryClient, db, table string, kind ClientScope, options ...Option) (Ingestor, error) {
+	switch kind {
+	case QueuedClient:
+		return New(client, db, table, options...)
+	case StreamingClient:
+		i := &Ingestion{}
+		for _, option := range options {
+			option(i)
+		}
+		if err := i.cfg.validate(); err != nil {
+			return nil, err
+		}
+		limiter := newLimiter(i.cfg.rateLimit, i.cfg.rateBurst, i.cfg.maxInFlight)
+		return NewStreaming(client, db, table, append(i.cfg.streamingOptions(), withLimiter(limiter))...)
+	case ManagedClient:
+		return NewManaged(client, db, table, options...)
+	}
+	return nil, errors.ES(errors.OpFileIngest, errors.KClientArgs, "NewClient(): %v is not one of QueuedClient, StreamingClient or ManagedClient", kind).SetNoRetry()
 }
 
 // Ingestion provides data ingestion from external sources into Kusto.
@@ -30,52 +78,370 @@ type Ingestion struct {
 	fs queued.Queued
 
 	connMu     sync.Mutex
-	streamConn *conn.Conn
-
-	bufferSize int
-	maxBuffers int
+	streamConn streamIngestor
+
+	cfg config
+
+	targets targetCache
+	// statusReader reads the rows of the status table for SkipIfAlreadySucceeded() in tests, see readStatus().
+	statusReader func(sourceID uuid.UUID) (map[string]interface{}, error)
+	// purgeRows is the status table that PurgeStatuses() purges in tests.
+	purgeRows statusRows
+	// listBlobs lists the containers of FromContainer() in tests, see containerPager().
+	listBlobs func(containerURL string, options *azblob.ContainerListBlobFlatSegmentOptions) blobPager
+	// poller follows the status of the Results watched with StatusChan().
+	poller *statusPoller
+	// limiter holds back the ingestions, see WithRateLimit() and WithMaxInFlight().
+	limiter *limiter
+
+	closed int32
+	// unregister stops the QueryClient from closing the client, see closeWithClient().
+	unregister func()
+	// parent is the client that a handle of ForTable() was made from, which owns the resources that they share.
+	parent *Ingestion
 }
 
-// Option is an optional argument to New().
+// Option is an optional argument to New(). The values set by options are validated by New().
 type Option func(s *Ingestion)
 
 // WithStaticBuffer configures the ingest client to upload data to Kusto using a set of one or more static memory buffers with a fixed size.
 func WithStaticBuffer(bufferSize int, maxBuffers int) Option {
 	return func(s *Ingestion) {
-		s.bufferSize = bufferSize
-		s.maxBuffers = maxBuffers
+		s.cfg.bufferSize = bufferSize
+		s.cfg.maxBuffers = maxBuffers
 	}
 }
 
-// New is a constructor for Ingestion.
-func New(client QueryClient, db, table string, options ...Option) (*Ingestion, error) {
-	mgr, err := resources.New(client)
-	if err != nil {
-		return nil, err
+// WithIngestionEndpoint sets the Data Management endpoint used to get the ingestion resources and authorization
+// context, for when it is not the cluster endpoint prefixed with "ingest-", as can be the case with Private Link.
+// endpoint must be an absolute https URL. This has no effect on streaming ingestion, see WithStreamingEndpoint().
+func WithIngestionEndpoint(endpoint string) Option {
+	return func(s *Ingestion) {
+		s.cfg.ingestionEndpoint = endpoint
+	}
+}
+
+// WithBufferSize sets the size of the buffers used to upload data to blob storage, keeping the default number of
+// buffers. This is also the size of the blocks that local files are uploaded in. 0 keeps the default size.
+// This is overridden by a later WithStaticBuffer().
+func WithBufferSize(size int) Option {
+	return func(s *Ingestion) {
+		s.cfg.bufferSize = size
+	}
+}
+
+// WithBlockSize sets the size of the blocks that FromFile() and FromReader() stage blobs in, between 1 MiB and
+// 100 MiB. Larger blocks make fewer requests for large files. The default is 8 MiB. Up to the block size times the
+// upload parallelism is buffered in memory for each upload from a reader. This cannot be used with WithBufferSize()
+// or WithStaticBuffer().
+func WithBlockSize(size int) Option {
+	return func(s *Ingestion) {
+		s.cfg.blockSize = size
+	}
+}
+
+// WithUploadParallelism sets how many blocks of a blob FromFile() and FromReader() upload at once, between 1 and 64.
+// More blocks at once can use more of a fast link. The default is 50. Up to the block size times the upload
+// parallelism is buffered in memory for each upload from a reader. This cannot be used with WithBufferSize() or
+// WithStaticBuffer().
+func WithUploadParallelism(parallelism int) Option {
+	return func(s *Ingestion) {
+		s.cfg.parallelism = parallelism
+	}
+}
+
+// WithStagingPrefix sets a prefix for the names of the blobs that FromFile() and FromReader() stage before
+// ingestion. The prefix may contain "/" to place the blobs in a virtual directory of the staging container.
+func WithStagingPrefix(prefix string) Option {
+	return func(s *Ingestion) {
+		s.cfg.stagingPrefix = prefix
+	}
+}
+
+// WithoutStatusReporting makes the client skip the ingestion status tables when it resolves the ingestion
+// resources, for callers that never use ReportResultToTable(). Ingestions that ask to report their status to
+// a table then fail with an error of Kind errors.KClientArgs.
+func WithoutStatusReporting() Option {
+	return func(s *Ingestion) {
+		s.cfg.noStatusReporting = true
+	}
+}
+
+// WithStatusTable makes the ingestions that use ReportResultToTable() report their status to the table at
+// tableURI, such as a table of a storage account of the caller, instead of to the status tables of the ingestion
+// resources of the cluster. tableURI must be https://<account>.table.<domain>/<table name>?<SAS>, with a shared
+// access signature that lets the client and the service add, update and read rows, and lets PurgeStatuses() delete
+// them. The table must exist. Result.Wait(), StatusChan() and the other reads of the status use the same table.
+func WithStatusTable(tableURI string) Option {
+	return func(s *Ingestion) {
+		s.cfg.statusTable = tableURI
+	}
+}
+
+// WithMaxStreamingSize sets the largest payload, after compression, that Stream(), StreamReader() and a Managed
+// client stream, for clusters where the streaming ingestion limit was raised. 0 keeps the default of 4 MiB.
+func WithMaxStreamingSize(size int64) Option {
+	return func(s *Ingestion) {
+		s.cfg.maxStreamingSize = size
+	}
+}
+
+// WithCompressionLevel sets the gzip level that data is compressed with, unless overridden by the CompressionLevel()
+// FileOption. See CompressionLevel() for the accepted levels.
+func WithCompressionLevel(level int) Option {
+	return func(s *Ingestion) {
+		s.cfg.compressionLevel = &level
+	}
+}
+
+// WithCompressionBufferSize sets the size of the buffers that FromReader() and FromFile() read the data into before
+// they compress it for queued ingestion, between 4 KiB and 4 MiB. The default is 32 KiB. Larger buffers make fewer
+// calls to the compressor for readers that return much at once, the compressed data is the same. The buffers are pooled.
+func WithCompressionBufferSize(size int) Option {
+	return func(s *Ingestion) {
+		s.cfg.compressionBuffer = size
+	}
+}
+
+// WithResourceRefreshInterval sets how often the ingestion resources and the authorization context are fetched again
+// in the background, such as to lower the load of ".get ingestion resources" on the cluster. 0 keeps the default of
+// 1 hour, and the interval cannot be shorter than 1 minute. See also RefreshResources().
+func WithResourceRefreshInterval(d time.Duration) Option {
+	return func(s *Ingestion) {
+		s.cfg.refreshInterval = d
+	}
+}
+
+// WithStreamingHTTPClient makes Stream(), StreamReader() and a Managed client send streaming ingestion requests with
+// client, such as to go through a proxy, use custom TLS settings or tune the connection pool. The timeout of client
+// applies to each request. This has no effect on queued ingestion. By default, the requests are sent with the client
+// of the QueryClient if it was made with kusto.WithHTTPClient(), as are the commands that fetch the ingestion
+// resources, unless WithStreamingConnectionLimits() or WithStreamingConnectionTimeouts() are passed.
+func WithStreamingHTTPClient(client *http.Client) Option {
+	return func(s *Ingestion) {
+		s.cfg.streamingHTTPClient = client
+	}
+}
+
+// WithStreamingEndpoint makes Stream(), StreamReader() and a Managed client send streaming ingestion requests to
+// endpoint, an absolute https URL, for when the engine of the cluster is not reached at the endpoint of the
+// QueryClient, as can be the case with Private Link. See also WithIngestionEndpoint() for queued ingestion.
+func WithStreamingEndpoint(endpoint string) Option {
+	return func(s *Ingestion) {
+		s.cfg.streamingEndpoint = endpoint
 	}
+}
+
+// WithStreamingConnectionLimits sets how many idle connections to the service Stream(), StreamReader() and a Managed
+// client keep for reuse, and how many connections they open at most. See WithConnectionLimits(). It cannot be used
+// with WithStreamingHTTPClient().
+func WithStreamingConnectionLimits(maxIdleConnsPerHost, maxConnsPerHost int) Option {
+	return func(s *Ingestion) {
+		s.cfg.streamingMaxIdleConns = maxIdleConnsPerHost
+		s.cfg.streamingMaxConns = maxConnsPerHost
+	}
+}
 
+// WithStreamingConnectionTimeouts sets the timeouts of the connections that Stream(), StreamReader() and a Managed
+// client open to the service. See ConnectionTimeouts for the defaults. It cannot be used with
+// WithStreamingHTTPClient().
+func WithStreamingConnectionTimeouts(timeouts ConnectionTimeouts) Option {
+	return func(s *Ingestion) {
+		s.cfg.streamingTimeouts = timeouts
+	}
+}
+
+// WithStorageTokenCredential makes queued ingestion authenticate to the ingestion storage with Azure AD tokens from
+// cred, such as one from the azidentity package, instead of the shared access signatures that the cluster returns with
+// the storage URIs. Blobs are uploaded and ingestion messages are posted with the tokens, so the principal of cred
+// needs the Storage Blob Data Contributor and Storage Queue Data Message Sender roles on the storage.
+// The ingestion message keeps the shared access signature of the container, if the cluster returned one, for the
+// service to read the blob. If it did not, the service reads the blob with its own identity.
+// The status tables of ReportResultToTable() are still accessed with their shared access signatures.
+func WithStorageTokenCredential(cred azcore.TokenCredential) Option {
+	return func(s *Ingestion) {
+		s.cfg.storageCred = cred
+	}
+}
+
+// WithSpanTracer makes the client start spans with tracer around the phases of its ingestions, and around the
+// fetches of the ingestion resources, see SpanTracer. A Managed client also starts them around its streaming
+// ingestion requests.
+func WithSpanTracer(tracer SpanTracer) Option {
+	return func(s *Ingestion) {
+		s.cfg.spans = tracer
+	}
+}
+
+// WithRateLimit makes the client start at most opsPerSecond ingestions per second, burst of which can start at once,
+// such as to keep a backfill from getting the ingestion storage throttled. An ingestion is the upload of its data and
+// the post of its message to the queue, or a streaming ingestion request. Ingestions over the limit wait for their
+// turn, or fail with the error of their context when it is done first. The limit is shared by all the goroutines that
+// use the client. There is no limit by default.
+func WithRateLimit(opsPerSecond float64, burst int) Option {
+	return func(s *Ingestion) {
+		s.cfg.rateLimit = opsPerSecond
+		s.cfg.rateBurst = burst
+	}
+}
+
+// WithMaxInFlight makes the client run at most n ingestions at once, see WithRateLimit(). Ingestions over the limit
+// wait for one to be done. There is no limit by default.
+func WithMaxInFlight(n int) Option {
+	return func(s *Ingestion) {
+		s.cfg.maxInFlight = n
+	}
+}
+
+// WithRetryPolicy sets how the client retries the operations that fail with an error that can be retried, see
+// errors.Retryable(): the uploads of the data to the ingestion storage with upload, the posts of the ingestion
+// messages to the queues with enqueue, and the streaming ingestion requests of StreamReader(), Stream() and of a
+// Managed client with streaming. The upload of a reader is not retried, as it cannot be read again. A streaming
+// payload that can be retried is buffered in memory to be sent again. The zero BackoffPolicy does not retry, which is
+// the default for all three.
+func WithRetryPolicy(upload, enqueue, streaming BackoffPolicy) Option {
+	return func(s *Ingestion) {
+		s.cfg.uploadRetry = upload
+		s.cfg.enqueueRetry = enqueue
+		s.cfg.streamingRetry = streaming
+	}
+}
+
+// New is a constructor for Ingestion.
+func New(client QueryClient, db, table string, options ...Option) (*Ingestion, error) {
 	i := &Ingestion{
 		client: client,
-		mgr:    mgr,
 		db:     db,
 		table:  table,
+		poller: newStatusPoller(),
 	}
 
 	for _, option := range options {
 		option(i)
 	}
+	if err := i.cfg.validate(); err != nil {
+		return nil, err
+	}
+	i.limiter = newLimiter(i.cfg.rateLimit, i.cfg.rateBurst, i.cfg.maxInFlight)
+	if i.cfg.streamingHTTPClient == nil && i.cfg.streamingMaxIdleConns == 0 && i.cfg.streamingMaxConns == 0 && i.cfg.streamingTimeouts == (ConnectionTimeouts{}) {
+		i.cfg.streamingHTTPClient = queryHTTPClient(client)
+	}
+	i.cfg.tracer = queryTracer(client)
+	i.cfg.app, i.cfg.user = queryTracingIdentity(client)
+	if i.cfg.tlsConfig = queryTLSConfig(client); i.cfg.tlsConfig != nil {
+		i.cfg.storageHTTPClient = tlsHTTPClient(i.cfg.tlsConfig)
+	}
 
-	fs, err := queued.New(db, table, mgr, queued.WithStaticBuffer(i.bufferSize, i.maxBuffers))
+	var dm resources.Mgmter = client
+	mgrOptions := i.cfg.managerOptions()
+	if i.cfg.ingestionEndpoint != "" {
+		var direct bool
+		var err error
+		dm, direct, err = newDMClient(i.cfg.ingestionEndpoint, client.Auth(), queryClientOptions(client)...)
+		if err != nil {
+			return nil, err
+		}
+		if direct {
+			mgrOptions = append(mgrOptions, resources.DirectMgmt())
+		}
+	} else if isDMEndpoint(client.Endpoint()) {
+		// The client was built with the "ingest-" endpoint, which already is the Data Management endpoint.
+		mgrOptions = append(mgrOptions, resources.DirectMgmt())
+	}
+
+	mgr, err := resources.New(dm, mgrOptions...)
+	if err != nil {
+		return nil, err
+	}
+	i.mgr = mgr
+
+	fs, err := queued.New(db, table, mgr, i.cfg.queuedOptions()...)
 	if err != nil {
 		return nil, err
 	}
 
 	i.fs = fs
 
+	unregister := closeWithClient(client, func() { i.Close() })
+	i.connMu.Lock()
+	i.unregister = unregister
+	i.connMu.Unlock()
+
 	return i, nil
 }
 
-func (i *Ingestion) prepForIngestion(ctx context.Context, options []FileOption, props properties.All, source SourceScope) (*Result, properties.All, error) {
+// ForTable returns a client that ingests into db and table instead of the database and table of i, and otherwise is
+// the same as i: it shares the ingestion resources and their background refresh, the buffers of the uploads, the
+// HTTP clients, the streaming connection, the limits of WithRateLimit() and WithMaxInFlight() and the status polling
+// of i, so it is cheap to make one per table. The handle is closed with the client that it was made from, directly or
+// not, and its own Close only makes its later calls fail with ClientClosedErr, leaving the other handles open.
+func (i *Ingestion) ForTable(db, table string) *Ingestion {
+	root := i
+	if i.parent != nil {
+		root = i.parent
+	}
+
+	h := &Ingestion{
+		db:           db,
+		table:        table,
+		client:       root.client,
+		mgr:          root.mgr,
+		fs:           root.fs,
+		cfg:          root.cfg,
+		statusReader: root.statusReader,
+		purgeRows:    root.purgeRows,
+		listBlobs:    root.listBlobs,
+		poller:       root.poller,
+		limiter:      root.limiter,
+		parent:       root,
+	}
+	if fs, ok := root.fs.(*queued.Ingestion); ok {
+		h.fs = fs.ForTable(db, table)
+	}
+	return h
+}
+
+// Close closes the client: the background refresh of the ingestion resources stops, the idle connections of
+// streaming ingestion are closed, and later calls fail with ClientClosedErr. Ingestions in progress finish, and the
+// Results watched with StatusChan() receive StatusRetrievalCanceled. The client is closed with the kusto.Client it was made from. Close can be called more than once.
+// Closing a client closes the handles of ForTable() made from it, while closing a handle only closes the handle.
+func (i *Ingestion) Close() error {
+	if !atomic.CompareAndSwapInt32(&i.closed, 0, 1) {
+		return nil
+	}
+	if i.parent != nil {
+		return nil
+	}
+	if i.mgr != nil {
+		i.mgr.Close()
+	}
+	if i.poller != nil {
+		i.poller.close()
+	}
+
+	i.connMu.Lock()
+	defer i.connMu.Unlock()
+	if i.unregister != nil {
+		i.unregister()
+	}
+	if c, ok := i.streamConn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (i *Ingestion) isClosed() bool {
+	return atomic.LoadInt32(&i.closed) == 1 || (i.parent != nil && i.parent.isClosed())
+}
+
+// prepForIngestion runs options and prepares props for an ingestion from source, whose name is used to find the
+// compression of the source if it is not set by the options.
+func (i *Ingestion) prepForIngestion(ctx context.Context, options []FileOption, props properties.All, source SourceScope, name string) (_ *Result, _ properties.All, err error) {
+	if i.isClosed() {
+		return nil, properties.All{}, ClientClosedErr
+	}
+	ctx, span := trace.Start(ctx, i.cfg.spans, trace.Prepare, trace.String(trace.DBNamespace, i.db), trace.String(trace.DBCollection, i.table))
+	defer func() { span.End(err) }()
 	result := newResult()
 
 	auth, err := i.mgr.AuthContext(ctx)
@@ -90,7 +456,32 @@ func (i *Ingestion) prepForIngestion(ctx context.Context, options []FileOption,
 			return nil, properties.All{}, err
 		}
 	}
+	queued.DiscoverCompression(&props, name)
 
+	if props.Source.SkipIfAlreadySucceeded {
+		if rec, ok := i.alreadySucceeded(props.Source.ID); ok {
+			result.putSkipped(rec)
+			return result, props, nil
+		}
+	}
+
+	if props.Source.ValidateTarget {
+		if err := i.validateTarget(ctx, props); err != nil {
+			return nil, properties.All{}, err
+		}
+	}
+
+	if i.cfg.noStatusReporting {
+		switch props.Ingestion.ReportMethod {
+		case properties.ReportStatusToTable, properties.ReportStatusToQueueAndTable:
+			return nil, properties.All{}, errors.ES(errors.OpFileIngest, errors.KClientArgs, "ReportResultToTable() cannot be used with a client created WithoutStatusReporting()").SetNoRetry()
+		}
+	}
+
+	if i.cfg.journal != nil && props.Source.ID == uuid.Nil {
+		// The entries of the journal are keyed by the id.
+		props.Source.ID = uuid.New()
+	}
 	if props.Ingestion.ReportLevel != properties.None {
 		if props.Source.ID == uuid.Nil {
 			props.Source.ID = uuid.New()
@@ -98,18 +489,16 @@ func (i *Ingestion) prepForIngestion(ctx context.Context, options []FileOption,
 
 		switch props.Ingestion.ReportMethod {
 		case properties.ReportStatusToTable, properties.ReportStatusToQueueAndTable:
-			managerResources, err := i.mgr.Resources()
+			table, err := i.statusTable(props.Source.ID)
 			if err != nil {
 				return nil, properties.All{}, err
 			}
 
-			if len(managerResources.Tables) == 0 {
-				return nil, properties.All{}, fmt.Errorf("User requested reporting status to table, yet status table resource URI is not found")
+			props.Ingestion.TableEntryRef = &properties.StatusTableDescription{
+				TableConnectionString: table.URL().String(),
+				PartitionKey:          props.Source.ID.String(),
+				RowKey:                uuid.Nil.String(),
 			}
-
-			props.Ingestion.TableEntryRef.TableConnectionString = managerResources.Tables[0].URL().String()
-			props.Ingestion.TableEntryRef.PartitionKey = props.Source.ID.String()
-			props.Ingestion.TableEntryRef.RowKey = uuid.Nil.String()
 			break
 		}
 	}
@@ -124,80 +513,205 @@ func (i *Ingestion) FromFile(ctx context.Context, fPath string, options ...FileO
 	return i.fromFile(ctx, fPath, options, i.newProp())
 }
 
+// FromBlob ingests the blob at blobURI, which the service reads from storage itself, as FromFile() does with a blob
+// URI. blobURI must give the service access to the blob, such as with a SAS token or the ";impersonate" suffix.
+// This method is thread-safe.
+func (i *Ingestion) FromBlob(ctx context.Context, blobURI string, options ...FileOption) (*Result, error) {
+	if err := validateBlobURI(blobURI); err != nil {
+		return nil, err
+	}
+	return i.fromBlob(ctx, blobURI, 0, options, i.newProp())
+}
+
+// validateBlobURI checks that blobURI is the URI of a blob, which FromFile() would ingest as a blob, for FromBlob().
+func validateBlobURI(blobURI string) error {
+	u, err := url.Parse(blobURI)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "abfss") {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "FromBlob(): %q is not a blob URI", blobURI).SetNoRetry()
+	}
+	return nil
+}
+
 // fromFile is an internal function to allow managed streaming to pass a properties object to the ingestion.
 func (i *Ingestion) fromFile(ctx context.Context, fPath string, options []FileOption, props properties.All) (*Result, error) {
-	local, err := queued.IsLocalPath(fPath)
+	path, local, err := queued.LocalPath(fPath)
 	if err != nil {
 		return nil, err
 	}
 
-	var scope SourceScope
-	if local {
-		scope = FromFile
-		props.Source.OriginalSource = fPath
-	} else {
-		scope = FromBlob
+	if !local {
+		return i.fromBlob(ctx, fPath, 0, options, props)
 	}
 
-	result, props, err := i.prepForIngestion(ctx, options, props, scope)
+	props.Source.OriginalSource = path
+	props.Source.Counts = &properties.ByteCounts{}
+	result, props, err := i.prepForIngestion(ctx, options, props, FromFile, path)
+	if err != nil || result.Skipped() {
+		return result, err
+	}
+
+	release, err := i.limiter.acquire(ctx, i.cfg.spans)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
 
 	result.record.IngestionSourcePath = fPath
+	result.blobName, err = i.fs.Local(ctx, path, props)
+	if err != nil {
+		i.completeJournal(result, err)
+		return nil, i.missingResourceError(err)
+	}
 
-	if local {
-		err = i.fs.Local(ctx, fPath, props)
-	} else {
+	result.putCounts(props.Source.Counts)
+	result.putQueued(i.statusTable, i.cfg.storageHTTPClient, i.poller)
+	i.completeJournal(result, nil)
+	return result, nil
+}
+
+// fromBlob ingests the blob at blobURI, whose data is size bytes before compression, or 0 if that is not known.
+func (i *Ingestion) fromBlob(ctx context.Context, blobURI string, size int64, options []FileOption, props properties.All) (*Result, error) {
+	// The name of the blob, without the query of its URI.
+	name := blobURI
+	if u, err := url.Parse(blobURI); err == nil {
+		name = u.Path
+	}
 
-		err = i.fs.Blob(ctx, fPath, 0, props)
+	result, props, err := i.prepForIngestion(ctx, options, props, FromBlob, name)
+	if err != nil || result.Skipped() {
+		return result, err
+	}
+	// The blob is ingested as it is.
+	result.compression = props.Source.Compression
+	result.record.IngestionSourcePath = blobURI
+	if props.Source.BlobMetadata != nil {
+		result.warnings = append(result.warnings, "WithBlobMetadata() was ignored, as the blob of the caller is ingested")
+	}
+	if props.Source.BlobTier != "" {
+		result.warnings = append(result.warnings, "WithBlobTier() was ignored, as the blob of the caller is ingested")
 	}
 
+	release, err := i.limiter.acquire(ctx, i.cfg.spans)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
 
-	result.putQueued(i.mgr)
+	if err := i.fs.Blob(ctx, blobURI, size, props); err != nil {
+		i.completeJournal(result, err)
+		return nil, i.missingResourceError(err)
+	}
+
+	result.putCounts(props.Source.Counts)
+	result.putQueued(i.statusTable, i.cfg.storageHTTPClient, i.poller)
+	i.completeJournal(result, nil)
 	return result, nil
 }
 
 // FromReader allows uploading a data file for Kusto from an io.Reader. The content is uploaded to Blobstore and
 // ingested after all data in the reader is processed. Content should not use compression as the content will be
 // compressed with gzip. This method is thread-safe.
+// If reader is a file, such as an *os.File, the format and the compression are found from its name as FromFile()
+// does, unless set by the options. An *os.File that was not read from is also uploaded like FromFile() uploads it.
 func (i *Ingestion) FromReader(ctx context.Context, reader io.Reader, options ...FileOption) (*Result, error) {
 	return i.fromReader(ctx, reader, options, i.newProp())
 }
 
+// namedFile is a reader of a file that knows its name, such as an *os.File.
+type namedFile interface {
+	io.Reader
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
 // fromReader is an internal function to allow managed streaming to pass a properties object to the ingestion.
 func (i *Ingestion) fromReader(ctx context.Context, reader io.Reader, options []FileOption, props properties.All) (*Result, error) {
-	result, props, err := i.prepForIngestion(ctx, options, props, FromReader)
-	if err != nil {
-		return nil, err
+	var name string
+	if f, ok := reader.(namedFile); ok {
+		if stat, err := f.Stat(); err == nil && stat.Mode().IsRegular() {
+			name = f.Name()
+		}
 	}
 
+	result, props, err := i.prepForIngestion(ctx, options, props, FromReader, name)
+	if err != nil || result.Skipped() {
+		return result, err
+	}
+
+	if name != "" {
+		props.Source.OriginalSource = name
+		if err := queued.CompleteFormatFromFileName(&props, name); err != nil {
+			return nil, err
+		}
+	}
 	if props.Ingestion.Additional.Format == DFUnknown {
 		props.Ingestion.Additional.Format = CSV
 	}
+	props.Source.Counts = &properties.ByteCounts{}
 
-	path, err := i.fs.Reader(ctx, reader, props)
+	release, err := i.limiter.acquire(ctx, i.cfg.spans)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
+
+	path, err := i.fs.Reader(ctx, reader, props)
+	if err != nil {
+		i.completeJournal(result, err)
+		return nil, i.missingResourceError(err)
+	}
 
 	result.record.IngestionSourcePath = path
-	result.putQueued(i.mgr)
+	result.blobName = path
+	result.putCounts(props.Source.Counts)
+	result.putQueued(i.statusTable, i.cfg.storageHTTPClient, i.poller)
+	i.completeJournal(result, nil)
 	return result, nil
 }
 
+// EnqueueError is the error of FromFile() and FromReader() when the data was uploaded to a blob, but the blob could
+// not be queued for ingestion. It is wrapped in an *errors.Error and can be found with errors.As(). Unless the
+// DeleteBlobOnEnqueueFailure() option was used, the blob is kept and RetryEnqueue() queues it again.
+type EnqueueError = queued.EnqueueError
+
+// RetryEnqueue queues the blob at blobURI, which FromFile() or FromReader() uploaded the data to but could not queue,
+// for ingestion, without uploading the data again. blobURI and size are those of the *EnqueueError, and options are
+// the options of the ingestion that are not about its source, such as the format and the mapping.
+func (i *Ingestion) RetryEnqueue(ctx context.Context, blobURI string, size int64, options ...FileOption) (*Result, error) {
+	return i.fromBlob(ctx, blobURI, size, options, i.newProp())
+}
+
 // Deprecated: Stream usea streaming ingest client instead - `ingest.NewStreaming`.
 // takes a payload that is encoded in format with a server stored mappingName, compresses it and uploads it to Kusto.
 // More information can be found here:
 // https://docs.microsoft.com/en-us/azure/kusto/management/create-ingestion-mapping-command
+// Use JSON as the format only if every record is on its own line, and MultiJSON for records that span lines or
+// for a sequence of concatenated JSON documents.
 // The context object can be used with a timeout or cancel to limit the request time.
+// A payload over the streaming limit after compression, 4 MiB unless changed with WithMaxStreamingSize(), is refused
+// with an error of Kind errors.KPayloadTooLarge before anything is sent.
 func (i *Ingestion) Stream(ctx context.Context, payload []byte, format DataFormat, mappingName string) error {
+	// The payload is in memory already, so compressing it first allows checking its size before sending it.
+	compressed, err := ioutil.ReadAll(gzip.CompressLevel(bytes.NewReader(payload), i.cfg.sourceOptions().GzipLevel()))
+	if err != nil {
+		return errors.E(errors.OpIngestStream, errors.KIO, err)
+	}
+	if limit := i.cfg.streamingLimit(); int64(len(compressed)) > limit {
+		return payloadTooLargeErr(limit)
+	}
+
+	_, err = i.StreamReader(ctx, bytes.NewReader(compressed), format, mappingName, Compression(CTGZip))
+	return err
+}
+
+// StreamReader is like Stream(), but reads the payload from reader, compressing it as it is sent instead of holding
+// it in memory. options are the FileOptions supported by the streaming client for FromReader(), and override format
+// and mappingName when they set them. Sending stops with an error of Kind errors.KPayloadTooLarge as soon as the
+// compressed payload goes over the streaming limit, 4 MiB unless changed with WithMaxStreamingSize().
+func (i *Ingestion) StreamReader(ctx context.Context, reader io.Reader, format DataFormat, mappingName string, options ...FileOption) (*Result, error) {
 	c, err := i.getStreamConn()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	props := properties.All{
@@ -209,27 +723,92 @@ func (i *Ingestion) Stream(ctx context.Context, payload []byte, format DataForma
 				IngestionMappingRef: mappingName,
 			},
 		},
+		Source: i.cfg.sourceOptions(),
+		Streaming: properties.Streaming{
+			ClientRequestId: "KGC.executeStreaming;" + uuid.New().String(),
+			MaxPayloadSize:  i.cfg.maxStreamingSize,
+		},
 	}
 
-	_, err = streamImpl(c, ctx, bytes.NewReader(payload), props)
+	for _, o := range options {
+		if err := o.Run(&props, StreamingClient, FromReader); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateStreamMapping(props); err != nil {
+		return nil, err
+	}
+	if err := validateStreamCompression(props); err != nil {
+		return nil, err
+	}
 
-	return err
+	if i.cfg.streamingRetry.Retries() {
+		return streamWithRetry(c, ctx, reader, props, i.cfg.streamingRetry)
+	}
+	return streamImpl(c, ctx, reader, props)
+}
+
+// RefreshResources fetches the ingestion resources and the authorization context again, instead of waiting for the
+// background refresh, such as after storage keys were rotated, a status table was added or ingestions failed because
+// the authorization context was refused. Concurrent calls share a single fetch.
+func (i *Ingestion) RefreshResources(ctx context.Context) error {
+	if err := i.mgr.Refresh(ctx); err != nil {
+		return errors.E(errors.OpFileIngest, errors.KOther, err)
+	}
+	return nil
 }
 
-func (i *Ingestion) getStreamConn() (*conn.Conn, error) {
+func (i *Ingestion) getStreamConn() (streamIngestor, error) {
+	if i.isClosed() {
+		return nil, ClientClosedErr
+	}
+	if i.parent != nil {
+		return i.parent.getStreamConn()
+	}
 	i.connMu.Lock()
 	defer i.connMu.Unlock()
 
 	if i.streamConn != nil {
-		return i.streamConn, nil
+		return limitConn(i.streamConn, i.limiter, i.cfg.spans), nil
 	}
 
-	sc, err := conn.New(i.client.Endpoint(), i.client.Auth())
+	sc, err := conn.New(i.client.Endpoint(), i.client.Auth(), i.cfg.connOptions()...)
 	if err != nil {
 		return nil, err
 	}
 	i.streamConn = sc
-	return i.streamConn, nil
+	return limitConn(i.streamConn, i.limiter, i.cfg.spans), nil
+}
+
+// isDMEndpoint reports if endpoint is the "ingest-" endpoint of the Data Management service of a cluster.
+func isDMEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err == nil && strings.HasPrefix(u.Hostname(), "ingest-")
+}
+
+// newDMClient creates the client used to talk to the Data Management endpoint set with WithIngestionEndpoint().
+// It reports if the client connects to the endpoint directly, or if Mgmt() calls need to be sent to the "ingest-" endpoint.
+// The client is made with options, see queryClientOptions().
+func newDMClient(endpoint string, auth kusto.Authorization, options ...kusto.Option) (resources.Mgmter, bool, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || !u.IsAbs() || u.Scheme != "https" || u.Host == "" {
+		return nil, false, errors.ES(errors.OpServConn, errors.KClientArgs, "WithIngestionEndpoint(%q): must be an absolute https URL", endpoint).SetNoRetry()
+	}
+
+	// kusto.Client adds the "ingest-" prefix itself and refuses endpoints that have it, so such an
+	// endpoint is reached by asking for the ingestion endpoint of the host without the prefix. The
+	// Manager then sends its commands with kusto.IngestionEndpoint(), which puts the prefix back.
+	direct := true
+	if isDMEndpoint(endpoint) {
+		u.Host = strings.TrimPrefix(u.Host, "ingest-")
+		direct = false
+	}
+
+	client, err := kusto.New(u.String(), auth, options...)
+	if err != nil {
+		return nil, false, err
+	}
+	return client, direct, nil
 }
 
 func (i *Ingestion) newProp() properties.All {
@@ -238,5 +817,6 @@ func (i *Ingestion) newProp() properties.All {
 			DatabaseName: i.db,
 			TableName:    i.table,
 		},
+		Source: i.cfg.sourceOptions(),
 	}
 }
@@ -2,13 +2,36 @@ package ingest
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	goErrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/data/table"
 	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/queued"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type mockClient struct {
@@ -150,3 +173,927 @@ func TestIngestion(t *testing.T) {
 		})
 	}
 }
+
+type recordingMgmt struct {
+	queries []string
+}
+
+func (r *recordingMgmt) Mgmt(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+	r.queries = append(r.queries, query.String())
+	if query.String() == ".get kusto identity token" {
+		return resources.NewFakeMgmt(
+			table.Columns{{Name: "AuthorizationContext", Type: types.String}},
+			[]value.Values{{value.String{Value: "token", Valid: true}}},
+			false,
+		).Mgmt(ctx, db, query, options...)
+	}
+	return resources.SuccessfulFakeResources().Mgmt(ctx, db, query, options...)
+}
+
+// dmServer fakes the Data Management service of a cluster, recording the hosts and commands it receives.
+type dmServer struct {
+	mu       sync.Mutex
+	hosts    []string
+	commands []string
+}
+
+func (d *dmServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	msg := struct {
+		CSL string `json:"csl"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d.mu.Lock()
+	d.hosts = append(d.hosts, r.Host)
+	d.commands = append(d.commands, msg.CSL)
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path != "/v1/rest/mgmt":
+		http.NotFound(w, r)
+	case msg.CSL == ".get kusto identity token":
+		fmt.Fprint(w, `{"Tables":[{"TableName":"Table_0","Columns":[{"ColumnName":"AuthorizationContext","DataType":"String","ColumnType":"string"}],"Rows":[["token"]]}]}`)
+	default:
+		fmt.Fprint(w, `{"Tables":[{"TableName":"Table_0","Columns":[{"ColumnName":"ResourceTypeName","DataType":"String","ColumnType":"string"},`+
+			`{"ColumnName":"StorageRoot","DataType":"String","ColumnType":"string"}],"Rows":[]}]}`)
+	}
+}
+
+// TestWithIngestionEndpoint cannot be parallel, as it points http.DefaultTransport, which kusto.Client uses,
+// at a fake Data Management server.
+func TestWithIngestionEndpoint(t *testing.T) {
+	dm := &dmServer{}
+	server := httptest.NewTLSServer(dm)
+	defer server.Close()
+
+	realTransport := http.DefaultTransport
+	defer func() { http.DefaultTransport = realTransport }()
+	http.DefaultTransport = &http.Transport{
+		// Every host is resolved to the fake server, the host that was asked for is checked with r.Host.
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	engine := mockClient{
+		endpoint: "https://test.kusto.windows.net",
+		auth:     kusto.Authorization{Authorizer: autorest.NullAuthorizer{}},
+		onMgmt: func(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+			t.Errorf("the engine client should not be used when an ingestion endpoint is set, got %q", query.String())
+			return nil, nil
+		},
+	}
+
+	tests := []struct {
+		desc     string
+		endpoint string
+		wantHost string
+	}{
+		{
+			desc:     "Endpoint without the ingest- prefix is used as is",
+			endpoint: "https://private-dm.test.kusto.windows.net",
+			wantHost: "private-dm.test.kusto.windows.net",
+		},
+		{
+			desc:     "Private Link endpoint with the ingest- prefix",
+			endpoint: "https://ingest-test.privatelink.westus.kusto.windows.net",
+			wantHost: "ingest-test.privatelink.westus.kusto.windows.net",
+		},
+	}
+
+	for _, test := range tests {
+		dm.mu.Lock()
+		dm.hosts, dm.commands = nil, nil
+		dm.mu.Unlock()
+
+		ingestion, err := New(engine, "db", "table", WithIngestionEndpoint(test.endpoint))
+		require.NoError(t, err, test.desc)
+
+		var gotAuth string
+		ingestion.fs = resources.FsMock{
+			OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+				gotAuth = props.Ingestion.Additional.AuthContext
+				return "", nil
+			},
+		}
+		_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"))
+		require.NoError(t, err, test.desc)
+		ingestion.mgr.Close()
+
+		assert.Equal(t, "token", gotAuth, test.desc)
+		dm.mu.Lock()
+		assert.Contains(t, dm.commands, ".get ingestion resources", test.desc)
+		assert.Contains(t, dm.commands, ".get kusto identity token", test.desc)
+		for _, host := range dm.hosts {
+			assert.Equal(t, test.wantHost, host, test.desc)
+		}
+		dm.mu.Unlock()
+	}
+}
+
+func TestNewDMClient(t *testing.T) {
+	t.Parallel()
+
+	auth := kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}
+
+	tests := []struct {
+		endpoint string
+		direct   bool
+		err      bool
+	}{
+		{endpoint: "https://private.test.kusto.windows.net", direct: true},
+		{endpoint: "https://ingest-test.privatelink.westus.kusto.windows.net", direct: false},
+		{endpoint: "http://ingest-test.kusto.windows.net", err: true},
+		{endpoint: "ingest-test.kusto.windows.net", err: true},
+		{endpoint: "https://", err: true},
+		{endpoint: ":bad", err: true},
+	}
+
+	for _, test := range tests {
+		client, direct, err := newDMClient(test.endpoint, auth)
+		if test.err {
+			require.Error(t, err, test.endpoint)
+			assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind, test.endpoint)
+			continue
+		}
+		require.NoError(t, err, test.endpoint)
+		assert.NotNil(t, client, test.endpoint)
+		assert.Equal(t, test.direct, direct, test.endpoint)
+	}
+}
+
+func TestResourcesEndpoint(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		endpoint string
+		// redirected is if the Mgmt() calls for the resources are sent to the "ingest-" endpoint of the client.
+		redirected bool
+	}{
+		{desc: "Engine endpoint", endpoint: "https://test.kusto.windows.net", redirected: true},
+		{desc: "Ingest endpoint", endpoint: "https://ingest-test.kusto.windows.net"},
+		{desc: "Custom domain", endpoint: "https://my-ingest-cluster.contoso.com", redirected: true},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var mu sync.Mutex
+			var optionCounts []int
+			client := mockClient{
+				endpoint: test.endpoint,
+				onMgmt: func(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					optionCounts = append(optionCounts, len(options))
+					return nil, nil
+				},
+			}
+
+			ingestion, err := New(client, "db", "table")
+			require.NoError(t, err)
+			require.NoError(t, ingestion.RefreshResources(context.Background()))
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.NotEmpty(t, optionCounts)
+			for _, n := range optionCounts {
+				assert.Equal(t, test.redirected, n > 0)
+			}
+		})
+	}
+}
+
+// TestClientsWithFake shows that all the ingestion clients can be built and used against a fake QueryClient,
+// without credentials or a cluster.
+func TestClientsWithFake(t *testing.T) {
+	t.Parallel()
+
+	fake := mockClient{
+		endpoint: "https://test.kusto.windows.net",
+		auth:     kusto.Authorization{Authorizer: autorest.NullAuthorizer{}},
+		onMgmt: func(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+			return (&recordingMgmt{}).Mgmt(ctx, db, query, options...)
+		},
+	}
+
+	queued, err := New(fake, "db", "table")
+	require.NoError(t, err)
+	var staged properties.All
+	queued.fs = resources.FsMock{
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			staged = props
+			return "blob", nil
+		},
+	}
+	_, err = queued.FromReader(context.Background(), strings.NewReader("a,b"))
+	require.NoError(t, err)
+	assert.Equal(t, "token", staged.Ingestion.Additional.AuthContext)
+
+	_, err = NewStreaming(fake, "db", "table")
+	require.NoError(t, err)
+
+	_, err = NewManaged(fake, "db", "table")
+	require.NoError(t, err)
+}
+
+func TestFromReaderFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, name := range []string{"data.json", "data.csv.gz"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("{}"), 0600))
+	}
+
+	tests := []struct {
+		desc       string
+		reader     func() io.Reader
+		options    []FileOption
+		wantFormat DataFormat
+		wantSource string
+	}{
+		{
+			desc:       "Plain reader",
+			reader:     func() io.Reader { return strings.NewReader("a,b") },
+			wantFormat: CSV,
+		},
+		{
+			desc: "File",
+			reader: func() io.Reader {
+				f, err := os.Open(filepath.Join(dir, "data.json"))
+				require.NoError(t, err)
+				t.Cleanup(func() { f.Close() })
+				return f
+			},
+			wantFormat: MultiJSON,
+			wantSource: filepath.Join(dir, "data.json"),
+		},
+		{
+			desc: "Compressed file",
+			reader: func() io.Reader {
+				f, err := os.Open(filepath.Join(dir, "data.csv.gz"))
+				require.NoError(t, err)
+				t.Cleanup(func() { f.Close() })
+				return f
+			},
+			wantFormat: CSV,
+			wantSource: filepath.Join(dir, "data.csv.gz"),
+		},
+		{
+			desc: "Options override the name",
+			reader: func() io.Reader {
+				f, err := os.Open(filepath.Join(dir, "data.json"))
+				require.NoError(t, err)
+				t.Cleanup(func() { f.Close() })
+				return f
+			},
+			options:    []FileOption{FileFormat(JSON), IngestionMappingRef("map", JSON)},
+			wantFormat: JSON,
+			wantSource: filepath.Join(dir, "data.json"),
+		},
+		{
+			desc: "Not a regular file",
+			reader: func() io.Reader {
+				f, err := os.Open(dir)
+				require.NoError(t, err)
+				t.Cleanup(func() { f.Close() })
+				return f
+			},
+			wantFormat: CSV,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			client := mockClient{endpoint: "https://test.kusto.windows.net"}
+			ingestion, err := New(client, "db", "table")
+			require.NoError(t, err)
+			var staged properties.All
+			ingestion.fs = resources.FsMock{
+				OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+					staged = props
+					return "blob", nil
+				},
+			}
+
+			_, err = ingestion.FromReader(context.Background(), test.reader(), test.options...)
+			require.NoError(t, err)
+			assert.Equal(t, test.wantFormat, staged.Ingestion.Additional.Format)
+			assert.Equal(t, test.wantSource, staged.Source.OriginalSource)
+		})
+	}
+}
+
+func TestBlobName(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile(t.TempDir(), "*.csv")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net"}
+	ingestion, err := New(client, "db", "table")
+	require.NoError(t, err)
+	var hints []string
+	ingestion.fs = resources.FsMock{
+		OnLocal: func(ctx context.Context, from string, props properties.All) (string, error) {
+			hints = append(hints, props.Source.BlobNameHint)
+			return "local-blob", nil
+		},
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			hints = append(hints, props.Source.BlobNameHint)
+			return "reader-blob", nil
+		},
+	}
+
+	result, err := ingestion.FromFile(context.Background(), f.Name(), BlobNameHint("customer"))
+	require.NoError(t, err)
+	assert.Equal(t, "local-blob", result.BlobName())
+
+	result, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"), BlobNameHint("customer"))
+	require.NoError(t, err)
+	assert.Equal(t, "reader-blob", result.BlobName())
+	assert.Equal(t, []string{"customer", "customer"}, hints)
+
+	result, err = ingestion.FromFile(context.Background(), "https://account.blob.core.windows.net/container/data.csv")
+	require.NoError(t, err)
+	assert.Empty(t, result.BlobName())
+
+	_, err = ingestion.FromFile(context.Background(), "https://account.blob.core.windows.net/container/data.csv", BlobNameHint("customer"))
+	assert.Error(t, err)
+}
+
+func TestBlobMetadataWarnings(t *testing.T) {
+	t.Parallel()
+
+	ingestion, err := New(mockClient{endpoint: "https://test.kusto.windows.net"}, "db", "table")
+	require.NoError(t, err)
+	defer ingestion.Close()
+	var staged []properties.SourceOptions
+	ingestion.fs = resources.FsMock{
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			staged = append(staged, props.Source)
+			return "reader-blob", nil
+		},
+		OnBlob: func(ctx context.Context, from string, fileSize int64, props properties.All) error {
+			return nil
+		},
+	}
+	options := []FileOption{WithBlobMetadata(map[string]string{"costCenter": "1234"}), WithBlobTier("Cool")}
+
+	result, err := ingestion.FromReader(context.Background(), strings.NewReader("a,b"), options...)
+	require.NoError(t, err)
+	assert.Nil(t, result.Warnings())
+	require.Len(t, staged, 1)
+	assert.Equal(t, map[string]string{"costCenter": "1234"}, staged[0].BlobMetadata)
+	assert.Equal(t, "Cool", staged[0].BlobTier)
+
+	// The client creates no blob for the ingestion of a blob URI.
+	result, err = ingestion.FromFile(context.Background(), "https://account.blob.core.windows.net/container/data.csv", options...)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"WithBlobMetadata() was ignored, as the blob of the caller is ingested",
+		"WithBlobTier() was ignored, as the blob of the caller is ingested",
+	}, result.Warnings())
+
+	result, err = ingestion.FromBlob(context.Background(), "https://account.blob.core.windows.net/container/data.csv", WithBlobTier("Hot"))
+	require.NoError(t, err)
+	assert.Len(t, result.Warnings(), 1)
+}
+
+func TestRetryEnqueue(t *testing.T) {
+	t.Parallel()
+
+	const blobURI = "https://account.blob.core.windows.net/container/db_table_blob.csv.gz?sig=secret"
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net"}
+	ingestion, err := New(client, "db", "table")
+	require.NoError(t, err)
+
+	var (
+		deleteBlob []bool
+		blobs      []string
+		sizes      []int64
+		formats    []DataFormat
+	)
+	ingestion.fs = resources.FsMock{
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			deleteBlob = append(deleteBlob, props.Source.DeleteBlobOnEnqueueFailure)
+			cause := errors.ES(errors.OpFileIngest, errors.KBlobstore, "queue unavailable")
+			return "db_table_blob.csv.gz", errors.E(errors.OpFileIngest, errors.KBlobstore, &EnqueueError{BlobURI: blobURI, Size: 3, AlreadyUploaded: true, Err: cause})
+		},
+		OnBlob: func(ctx context.Context, from string, fileSize int64, props properties.All) error {
+			blobs = append(blobs, from)
+			sizes = append(sizes, fileSize)
+			formats = append(formats, props.Ingestion.Additional.Format)
+			return nil
+		},
+	}
+
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"), FileFormat(JSON))
+	require.Error(t, err)
+	var enqueueErr *EnqueueError
+	require.True(t, goErrors.As(err, &enqueueErr))
+	assert.True(t, enqueueErr.AlreadyUploaded)
+
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"), DeleteBlobOnEnqueueFailure())
+	require.Error(t, err)
+	assert.Equal(t, []bool{false, true}, deleteBlob)
+
+	// The staged blob is queued as it is, without reading the data again.
+	result, err := ingestion.RetryEnqueue(context.Background(), enqueueErr.BlobURI, enqueueErr.Size, FileFormat(JSON))
+	require.NoError(t, err)
+	assert.Equal(t, blobURI, result.record.IngestionSourcePath)
+	assert.Equal(t, []string{blobURI}, blobs)
+	assert.Equal(t, []int64{3}, sizes)
+	assert.Equal(t, []DataFormat{JSON}, formats)
+
+	// Options about the source of the data are for the first attempt.
+	_, err = ingestion.RetryEnqueue(context.Background(), enqueueErr.BlobURI, enqueueErr.Size, DeleteBlobOnEnqueueFailure())
+	assert.Error(t, err)
+}
+
+func TestSkipIfAlreadySucceeded(t *testing.T) {
+	t.Parallel()
+
+	id := uuid.New()
+	client := mockClient{endpoint: "https://test.kusto.windows.net"}
+
+	tests := []struct {
+		desc    string
+		options []FileOption
+		// newOptions are the options of the client, and status and readErr are what reading the status table returns.
+		newOptions  []Option
+		status      StatusCode
+		readErr     error
+		wantRead    bool
+		wantSkipped bool
+	}{
+		{
+			desc:        "Succeeded before",
+			options:     []FileOption{SourceID(id), SkipIfAlreadySucceeded()},
+			status:      Succeeded,
+			wantRead:    true,
+			wantSkipped: true,
+		},
+		{desc: "Failed before", options: []FileOption{SourceID(id), SkipIfAlreadySucceeded()}, status: Failed, wantRead: true},
+		{desc: "Pending", options: []FileOption{SourceID(id), SkipIfAlreadySucceeded()}, status: Pending, wantRead: true},
+		{
+			desc:     "Lookup fails",
+			options:  []FileOption{SourceID(id), SkipIfAlreadySucceeded()},
+			readErr:  fmt.Errorf("the specified resource does not exist"),
+			wantRead: true,
+		},
+		{desc: "Without SourceID", options: []FileOption{SkipIfAlreadySucceeded()}, status: Succeeded},
+		{
+			desc:       "Without status reporting",
+			options:    []FileOption{SourceID(id), SkipIfAlreadySucceeded()},
+			newOptions: []Option{WithoutStatusReporting()},
+			status:     Succeeded,
+		},
+		{desc: "Without the option", options: []FileOption{SourceID(id)}, status: Succeeded},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ingestion, err := New(client, "db", "table", test.newOptions...)
+			require.NoError(t, err)
+			var reads []uuid.UUID
+			ingestion.statusReader = func(sourceID uuid.UUID) (map[string]interface{}, error) {
+				reads = append(reads, sourceID)
+				if test.readErr != nil {
+					return nil, test.readErr
+				}
+				return map[string]interface{}{"Status": string(test.status), "IngestionSourceId": sourceID.String()}, nil
+			}
+			var ingested []uuid.UUID
+			ingestion.fs = resources.FsMock{
+				OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+					ingested = append(ingested, props.Source.ID)
+					return "blob", nil
+				},
+				OnBlob: func(ctx context.Context, from string, fileSize int64, props properties.All) error {
+					ingested = append(ingested, props.Source.ID)
+					return nil
+				},
+			}
+
+			for _, ingest := range []func() (*Result, error){
+				func() (*Result, error) {
+					return ingestion.FromReader(context.Background(), strings.NewReader("a,b"), test.options...)
+				},
+				func() (*Result, error) {
+					return ingestion.FromFile(context.Background(), "https://account.blob.core.windows.net/container/data.csv", test.options...)
+				},
+			} {
+				result, err := ingest()
+				require.NoError(t, err)
+				assert.Equal(t, test.wantSkipped, result.Skipped())
+				if test.wantSkipped {
+					// A skipped ingestion is done.
+					assert.NoError(t, <-result.Wait(context.Background()))
+					assert.Empty(t, result.Method())
+				}
+			}
+
+			if test.wantRead {
+				assert.Equal(t, []uuid.UUID{id, id}, reads)
+			} else {
+				assert.Empty(t, reads)
+			}
+			if test.wantSkipped {
+				assert.Empty(t, ingested)
+			} else if assert.Len(t, ingested, 2) && len(test.options) > 1 {
+				assert.Equal(t, []uuid.UUID{id, id}, ingested)
+			}
+		})
+	}
+
+	ingestion, err := New(client, "db", "table")
+	require.NoError(t, err)
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"), SourceID(uuid.Nil))
+	assert.Error(t, err)
+}
+
+func TestByteCountsUnknownForBlobs(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net"}
+	ingestion, err := New(client, "db", "table")
+	require.NoError(t, err)
+	ingestion.fs = resources.FsMock{}
+
+	result, err := ingestion.FromFile(context.Background(), "https://account.blob.core.windows.net/container/data.csv")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), result.BytesRead())
+	assert.Equal(t, int64(-1), result.BytesUploaded())
+}
+
+func TestNewOptions(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net"}
+
+	tests := []struct {
+		desc    string
+		options []Option
+		err     bool
+	}{
+		{desc: "No options"},
+		{desc: "Buffer size", options: []Option{WithBufferSize(1024)}},
+		{desc: "Static buffer", options: []Option{WithStaticBuffer(1024, 2)}},
+		{desc: "Negative buffer size", options: []Option{WithBufferSize(-1)}, err: true},
+		{desc: "Negative number of buffers", options: []Option{WithStaticBuffer(1024, -1)}, err: true},
+		{desc: "Staging prefix", options: []Option{WithStagingPrefix("team/service/")}},
+		{desc: "Staging prefix with a leading slash", options: []Option{WithStagingPrefix("/team")}, err: true},
+		{desc: "Staging prefix with a backslash", options: []Option{WithStagingPrefix(`team\`)}, err: true},
+		{desc: "Staging prefix with a control character", options: []Option{WithStagingPrefix("team\n")}, err: true},
+		{desc: "Staging prefix too long", options: []Option{WithStagingPrefix(strings.Repeat("a", maxStagingPrefix+1))}, err: true},
+		{desc: "Without status reporting", options: []Option{WithoutStatusReporting()}},
+		{desc: "Max streaming size", options: []Option{WithMaxStreamingSize(10 * mb)}},
+		{desc: "Negative max streaming size", options: []Option{WithMaxStreamingSize(-1)}, err: true},
+		{desc: "Streaming endpoint", options: []Option{WithStreamingEndpoint("https://private.test.kusto.windows.net")}},
+		{desc: "Relative streaming endpoint", options: []Option{WithStreamingEndpoint("private.test.kusto.windows.net")}, err: true},
+		{desc: "Streaming connection limits", options: []Option{WithStreamingConnectionLimits(50, 20)}},
+		{desc: "Negative streaming connection limits", options: []Option{WithStreamingConnectionLimits(0, -1)}, err: true},
+		{desc: "Streaming connection timeouts", options: []Option{WithStreamingConnectionTimeouts(ConnectionTimeouts{ResponseHeader: time.Minute})}},
+		{desc: "Negative streaming connection timeouts", options: []Option{WithStreamingConnectionTimeouts(ConnectionTimeouts{TLSHandshake: -time.Second})}, err: true},
+		{desc: "Streaming connection timeouts with a client", options: []Option{WithStreamingHTTPClient(&http.Client{}), WithStreamingConnectionTimeouts(ConnectionTimeouts{Dial: time.Second})}, err: true},
+		{desc: "Compression level", options: []Option{WithCompressionLevel(9)}},
+		{desc: "Compression level too high", options: []Option{WithCompressionLevel(10)}, err: true},
+		{desc: "Compression level too low", options: []Option{WithCompressionLevel(-3)}, err: true},
+		{desc: "Status table", options: []Option{WithStatusTable("https://mine.table.core.windows.net/statuses?sig=secret")}},
+		{desc: "Status table without a signature", options: []Option{WithStatusTable("https://mine.table.core.windows.net/statuses")}, err: true},
+		{desc: "Status table that is not a table", options: []Option{WithStatusTable("https://mine.queue.core.windows.net/statuses?sig=secret")}, err: true},
+		{desc: "Status table without status reporting", options: []Option{WithStatusTable("https://mine.table.core.windows.net/statuses?sig=secret"), WithoutStatusReporting()}, err: true},
+		{desc: "Compression buffer size", options: []Option{WithCompressionBufferSize(256 * 1024)}},
+		{desc: "Compression buffer size too small", options: []Option{WithCompressionBufferSize(1024)}, err: true},
+		{desc: "Compression buffer size too large", options: []Option{WithCompressionBufferSize(8 * mb)}, err: true},
+		{desc: "Block size and parallelism", options: []Option{WithBlockSize(16 * mb), WithUploadParallelism(64)}},
+		{desc: "Block size too small", options: []Option{WithBlockSize(mb - 1)}, err: true},
+		{desc: "Block size too large", options: []Option{WithBlockSize(100*mb + 1)}, err: true},
+		{desc: "Zero parallelism is the default", options: []Option{WithUploadParallelism(0)}},
+		{desc: "Parallelism too high", options: []Option{WithUploadParallelism(65)}, err: true},
+		{desc: "Negative parallelism", options: []Option{WithUploadParallelism(-1)}, err: true},
+		{desc: "Block size with a static buffer", options: []Option{WithStaticBuffer(1024, 2), WithBlockSize(mb)}, err: true},
+		{desc: "Parallelism with a buffer size", options: []Option{WithBufferSize(mb), WithUploadParallelism(2)}, err: true},
+		{desc: "Resource refresh interval", options: []Option{WithResourceRefreshInterval(10 * time.Minute)}},
+		{desc: "Resource refresh interval too short", options: []Option{WithResourceRefreshInterval(time.Second)}, err: true},
+	}
+
+	for _, test := range tests {
+		ingestion, err := New(client, "db", "table", test.options...)
+		if test.err {
+			require.Error(t, err, test.desc)
+			assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind, test.desc)
+			continue
+		}
+		require.NoError(t, err, test.desc)
+		assert.NotNil(t, ingestion.fs, test.desc)
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net"}
+	var level int
+	fs := resources.FsMock{
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			level = props.Source.GzipLevel()
+			return "", nil
+		},
+	}
+
+	ingestion, err := New(client, "db", "table")
+	require.NoError(t, err)
+	ingestion.fs = fs
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"))
+	require.NoError(t, err)
+	assert.Equal(t, -1, level, "the default level should be kept")
+
+	ingestion, err = New(client, "db", "table", WithCompressionLevel(1))
+	require.NoError(t, err)
+	ingestion.fs = fs
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, level)
+
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"), CompressionLevel(0))
+	require.NoError(t, err)
+	assert.Equal(t, 0, level, "the FileOption should override the client level")
+
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"), CompressionLevel(12))
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind)
+
+	// Streaming sends the data compressed with the level.
+	var sizes []int
+	streaming := Streaming{
+		db:    "db",
+		table: "table",
+		streamConn: fakeStreamIngestor{
+			onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+				b, err := ioutil.ReadAll(payload)
+				sizes = append(sizes, len(b))
+				return err
+			},
+		},
+	}
+	data := strings.Repeat("a,b,c\n", 1000)
+	_, err = streaming.FromReader(context.Background(), strings.NewReader(data), FileFormat(CSV), CompressionLevel(9))
+	require.NoError(t, err)
+	_, err = streaming.FromReader(context.Background(), strings.NewReader(data), FileFormat(CSV), CompressionLevel(0))
+	require.NoError(t, err)
+	require.Len(t, sizes, 2)
+	assert.Less(t, sizes[0], sizes[1])
+	assert.Greater(t, sizes[1], len(data), "level 0 should store the data without compressing it")
+}
+
+func TestWithoutStatusReporting(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net"}
+	ingestion, err := New(client, "db", "table", WithoutStatusReporting())
+	require.NoError(t, err)
+	ingestion.fs = resources.FsMock{}
+
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"), ReportResultToTable())
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind)
+
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"))
+	assert.NoError(t, err)
+}
+
+// TestForTable is not parallel, as it counts the goroutines of the process.
+func TestForTable(t *testing.T) {
+	var mgmtCalls int32
+	client := mockClient{
+		endpoint: "https://test.kusto.windows.net",
+		onMgmt: func(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+			atomic.AddInt32(&mgmtCalls, 1)
+			return nil, nil
+		},
+	}
+	ingestion, err := New(client, "db", "table", WithMaxInFlight(4))
+	require.NoError(t, err)
+	defer ingestion.Close()
+
+	fs, ok := ingestion.ForTable("db", "other").fs.(*queued.Ingestion)
+	require.True(t, ok)
+	assert.NotSame(t, ingestion.fs, fs, "a handle stages its blobs with the names of its own table")
+
+	var mu sync.Mutex
+	targets := map[string]int{}
+	ingestion.fs = resources.FsMock{
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			targets[props.Ingestion.DatabaseName+"."+props.Ingestion.TableName]++
+			return "blob", nil
+		},
+	}
+
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"))
+	require.NoError(t, err)
+	calls := atomic.LoadInt32(&mgmtCalls)
+	before := runtime.NumGoroutine()
+
+	const count = 1000
+	handles := make([]*Ingestion, count)
+	for n := range handles {
+		handles[n] = ingestion.ForTable("db", fmt.Sprintf("table%d", n))
+		_, err := handles[n].FromReader(context.Background(), strings.NewReader("a,b"))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, calls, atomic.LoadInt32(&mgmtCalls), "the handles should share the ingestion resources")
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before+2, "the handles should not start goroutines")
+	assert.Len(t, targets, count+1)
+	assert.Equal(t, 1, targets["db.table7"])
+	for _, h := range handles {
+		assert.Same(t, ingestion.limiter, h.limiter)
+		assert.Same(t, ingestion.mgr, h.mgr)
+	}
+
+	// A handle of a handle is a handle of the client.
+	nested := handles[0].ForTable("db2", "table")
+	assert.Same(t, ingestion, nested.parent)
+
+	// Closing a handle only closes the handle.
+	require.NoError(t, handles[0].Close())
+	_, err = handles[0].FromReader(context.Background(), strings.NewReader("a,b"))
+	assert.Equal(t, ClientClosedErr, err)
+	_, err = handles[1].FromReader(context.Background(), strings.NewReader("a,b"))
+	assert.NoError(t, err)
+	_, err = nested.FromReader(context.Background(), strings.NewReader("a,b"))
+	assert.NoError(t, err)
+
+	// Closing the client closes all its handles.
+	require.NoError(t, ingestion.Close())
+	for _, h := range []*Ingestion{handles[1], handles[count-1], nested} {
+		_, err = h.FromReader(context.Background(), strings.NewReader("a,b"))
+		assert.Equal(t, ClientClosedErr, err)
+	}
+}
+
+// TestIngestorConformance checks that the clients behave the same through the Ingestor interface.
+func TestIngestorConformance(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+	dir := t.TempDir()
+	fPath := filepath.Join(dir, "data.csv")
+	require.NoError(t, ioutil.WriteFile(fPath, []byte("a,b\n"), 0644))
+	const blobURI = "https://account.blob.core.windows.net/container/data.csv?sig=secret"
+
+	// target records the database and table that each kind of client ingested into.
+	type target struct{ db, table string }
+	var mu sync.Mutex
+	var targets []target
+	record := func(db, table string) {
+		mu.Lock()
+		defer mu.Unlock()
+		targets = append(targets, target{db, table})
+	}
+	fs := resources.FsMock{
+		OnLocal: func(ctx context.Context, from string, props properties.All) (string, error) {
+			record(props.Ingestion.DatabaseName, props.Ingestion.TableName)
+			return "blob", nil
+		},
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			record(props.Ingestion.DatabaseName, props.Ingestion.TableName)
+			return "blob", nil
+		},
+		OnBlob: func(ctx context.Context, from string, fileSize int64, props properties.All) error {
+			record(props.Ingestion.DatabaseName, props.Ingestion.TableName)
+			return nil
+		},
+	}
+	stream := fakeStreamIngestor{
+		onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+			record(db, table)
+			return nil
+		},
+		onStreamIngestBlob: func(ctx context.Context, db, table string, blobURI string, format properties.DataFormat, mappingName string, clientRequestId string) error {
+			record(db, table)
+			return nil
+		},
+	}
+
+	tests := []struct {
+		desc string
+		new  func() Ingestor
+	}{
+		{
+			desc: "Queued",
+			new: func() Ingestor {
+				ingestion, err := New(client, "db", "table")
+				require.NoError(t, err)
+				ingestion.fs = fs
+				return ingestion
+			},
+		},
+		{
+			desc: "Streaming",
+			new: func() Ingestor {
+				streaming, err := NewStreaming(client, "db", "table")
+				require.NoError(t, err)
+				streaming.streamConn = stream
+				return streaming
+			},
+		},
+		{
+			desc: "Managed",
+			new: func() Ingestor {
+				managed, err := NewManaged(client, "db", "table")
+				require.NoError(t, err)
+				managed.queued.fs = fs
+				managed.streaming.streamConn = stream
+				return managed
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			ingestor := test.new()
+			ctx := context.Background()
+			mu.Lock()
+			targets = nil
+			mu.Unlock()
+
+			_, err := ingestor.FromReader(ctx, strings.NewReader("a,b\n"), FileFormat(CSV))
+			require.NoError(t, err)
+			_, err = ingestor.FromFile(ctx, fPath)
+			require.NoError(t, err)
+			_, err = ingestor.FromBlob(ctx, blobURI)
+			require.NoError(t, err)
+			_, err = ingestor.FromReader(ctx, strings.NewReader("a,b\n"), FileFormat(CSV), Table("other"))
+			require.NoError(t, err)
+			assert.Equal(t, []target{{"db", "table"}, {"db", "table"}, {"db", "table"}, {"db", "other"}}, targets)
+
+			// A path is not a blob.
+			_, err = ingestor.FromBlob(ctx, fPath)
+			require.Error(t, err)
+			assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+
+			require.NoError(t, ingestor.Close())
+			require.NoError(t, ingestor.Close())
+			_, err = ingestor.FromReader(ctx, strings.NewReader("a,b\n"))
+			assert.Equal(t, ClientClosedErr, err)
+			_, err = ingestor.FromBlob(ctx, blobURI)
+			assert.Equal(t, ClientClosedErr, err)
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+
+	ingestion, err := NewClient(client, "db", "table", QueuedClient)
+	require.NoError(t, err)
+	defer ingestion.Close()
+	assert.IsType(t, &Ingestion{}, ingestion)
+
+	managed, err := NewClient(client, "db", "table", ManagedClient, WithMaxInFlight(2))
+	require.NoError(t, err)
+	defer managed.Close()
+	assert.IsType(t, &Managed{}, managed)
+
+	ingestor, err := NewClient(client, "db", "table", StreamingClient, WithMaxStreamingSize(mb), WithMaxInFlight(2), WithStagingPrefix("team/"))
+	require.NoError(t, err)
+	defer ingestor.Close()
+	streaming, ok := ingestor.(*Streaming)
+	require.True(t, ok)
+	assert.Equal(t, "table", streaming.table)
+	assert.Equal(t, int64(mb), streaming.maxPayloadSize)
+	require.NotNil(t, streaming.limiter)
+	assert.Equal(t, 2, cap(streaming.limiter.slots))
+
+	for _, kind := range []ClientScope{0, QueuedClient | StreamingClient} {
+		_, err := NewClient(client, "db", "table", kind)
+		require.Error(t, err)
+		assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+	}
+	_, err = NewClient(client, "db", "table", StreamingClient, WithMaxStreamingSize(-1))
+	assert.Error(t, err, "the options are validated for all the kinds")
+}
@@ -0,0 +1,262 @@
+/*
+Package ingesttest provides fakes of the ingest.Ingestor interface for unit testing code that ingests data.
+
+FakeIngestor does not talk to Kusto, but it runs the FileOptions it is given through the same validation the real
+clients use, so options that the real client would reject make the fake fail as well. Every call is recorded,
+allowing a test to verify what would have been ingested:
+
+	fake := &ingesttest.FakeIngestor{DB: "db", Table: "table"}
+	err := myCode(fake)
+	...
+	calls := fake.Calls()
+	if len(calls) != 1 || calls[0].Format != ingest.JSON || calls[0].MappingRef != "mapping" {
+		t.Errorf("unexpected ingestion: %+v", calls)
+	}
+*/
+package ingesttest
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sync"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/queued"
+)
+
+// Method names recorded in Call.Method.
+const (
+	MethodFromFile   = "FromFile"
+	MethodFromReader = "FromReader"
+	MethodFromBlob   = "FromBlob"
+)
+
+// Call is a record of a call made to a FakeIngestor.
+type Call struct {
+	// Method is MethodFromFile, MethodFromReader or MethodFromBlob.
+	Method string
+	// Path is the path passed to FromFile, or the URI passed to FromBlob.
+	Path string
+	// Data is the content read from the reader passed to FromReader.
+	Data []byte
+	// Options are the FileOptions passed to the call.
+	Options []ingest.FileOption
+
+	// Database and Table are the destination of the ingestion, after the options were applied.
+	Database string
+	Table    string
+	// Format is the format of the data, after the options were applied and the defaults of the real client.
+	Format ingest.DataFormat
+	// MappingRef and MappingKind are the values set with IngestionMappingRef().
+	MappingRef  string
+	MappingKind ingest.DataFormat
+	// DontCompress is true if the data would not have been compressed.
+	DontCompress bool
+
+	// Err is the error that was returned to the caller, if any.
+	Err error
+}
+
+// Response is what the FakeIngestor returns for a call.
+type Response struct {
+	// Result is returned on success. If nil, an empty Result is returned.
+	Result *ingest.Result
+	// Err, if set, is returned instead of a Result.
+	Err error
+}
+
+// FakeIngestor is an ingest.Ingestor that records calls instead of ingesting. The zero value mimics a queued
+// client with no default database or table. A FakeIngestor must not be copied after first use.
+type FakeIngestor struct {
+	// DB and Table are the defaults, as passed to ingest.New().
+	DB    string
+	Table string
+	// Client is the kind of client to mimic when validating options. Defaults to ingest.QueuedClient.
+	Client ingest.ClientScope
+
+	// Responses are returned in order, one per call that passed validation. Once they are exhausted,
+	// calls succeed with an empty Result.
+	Responses []Response
+	// Err, if set, is returned by every call that passed validation, overriding Responses.
+	Err error
+
+	mu    sync.Mutex
+	calls []Call
+	next  int
+}
+
+var _ ingest.Ingestor = (*FakeIngestor)(nil)
+
+// FailingIngestor returns a FakeIngestor whose calls all fail with err once the options are validated.
+func FailingIngestor(db, table string, err error) *FakeIngestor {
+	return &FakeIngestor{DB: db, Table: table, Err: err}
+}
+
+// FromFile implements ingest.Ingestor.FromFile().
+func (f *FakeIngestor) FromFile(ctx context.Context, fPath string, options ...ingest.FileOption) (*ingest.Result, error) {
+	call := Call{Method: MethodFromFile, Path: fPath, Options: options}
+
+	local, err := queued.IsLocalPath(fPath)
+	if err != nil {
+		return f.record(call, err)
+	}
+
+	// Only the queued client validates options against the blob source, the others treat every path as a file.
+	source := ingest.FromFile
+	if !local && f.client() == ingest.QueuedClient {
+		source = ingest.FromBlob
+	}
+
+	props, err := f.runOptions(options, source)
+	if err != nil {
+		return f.record(call, err)
+	}
+
+	if !local && f.client() == ingest.StreamingClient {
+		return f.record(call, ingest.FileIsBlobErr)
+	}
+	if err := queued.CompleteFormatFromFileName(&props, fPath); err != nil {
+		return f.record(call, err)
+	}
+	queued.DiscoverCompression(&props, fPath)
+
+	return f.record(fromProps(call, props), nil)
+}
+
+// FromReader implements ingest.Ingestor.FromReader(). The reader is read to the end.
+func (f *FakeIngestor) FromReader(ctx context.Context, reader io.Reader, options ...ingest.FileOption) (*ingest.Result, error) {
+	call := Call{Method: MethodFromReader, Options: options}
+
+	props, err := f.runOptions(options, ingest.FromReader)
+	if err != nil {
+		return f.record(call, err)
+	}
+	if props.Ingestion.Additional.Format == properties.DFUnknown {
+		props.Ingestion.Additional.Format = properties.CSV
+	}
+
+	call.Data, err = ioutil.ReadAll(reader)
+	if err != nil {
+		return f.record(call, errors.E(errors.OpFileIngest, errors.KLocalFileSystem, err))
+	}
+
+	return f.record(fromProps(call, props), nil)
+}
+
+// FromBlob implements ingest.Ingestor.FromBlob().
+func (f *FakeIngestor) FromBlob(ctx context.Context, blobURI string, options ...ingest.FileOption) (*ingest.Result, error) {
+	call := Call{Method: MethodFromBlob, Path: blobURI, Options: options}
+
+	u, err := url.Parse(blobURI)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "abfss") {
+		return f.record(call, errors.ES(errors.OpFileIngest, errors.KClientArgs, "FromBlob(): %q is not a blob URI", blobURI).SetNoRetry())
+	}
+
+	props, err := f.runOptions(options, ingest.FromBlob)
+	if err != nil {
+		return f.record(call, err)
+	}
+	if err := queued.CompleteFormatFromFileName(&props, u.Path); err != nil {
+		return f.record(call, err)
+	}
+	queued.DiscoverCompression(&props, u.Path)
+
+	return f.record(fromProps(call, props), nil)
+}
+
+// Close implements ingest.Ingestor.Close(). The fake can still be called after it.
+func (f *FakeIngestor) Close() error {
+	return nil
+}
+
+// Calls returns the calls made so far, in order.
+func (f *FakeIngestor) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Call(nil), f.calls...)
+}
+
+// CallsTo returns the calls made so far to method, in order.
+func (f *FakeIngestor) CallsTo(method string) []Call {
+	var calls []Call
+	for _, c := range f.Calls() {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Reset forgets the recorded calls and starts returning Responses from the beginning.
+func (f *FakeIngestor) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = nil
+	f.next = 0
+}
+
+func (f *FakeIngestor) client() ingest.ClientScope {
+	if f.Client == 0 {
+		return ingest.QueuedClient
+	}
+	return f.Client
+}
+
+// runOptions applies the options the same way the real clients do.
+func (f *FakeIngestor) runOptions(options []ingest.FileOption, source ingest.SourceScope) (properties.All, error) {
+	props := properties.All{
+		Ingestion: properties.Ingestion{
+			DatabaseName: f.DB,
+			TableName:    f.Table,
+		},
+	}
+
+	for _, o := range options {
+		if err := o.Run(&props, f.client(), source); err != nil {
+			return properties.All{}, err
+		}
+	}
+	return props, nil
+}
+
+// record stores the call and returns the response for it. Calls that failed validation do not consume a Response.
+func (f *FakeIngestor) record(call Call, err error) (*ingest.Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var result *ingest.Result
+	switch {
+	case err != nil:
+	case f.Err != nil:
+		err = f.Err
+	case f.next < len(f.Responses):
+		result, err = f.Responses[f.next].Result, f.Responses[f.next].Err
+		f.next++
+	}
+	if err == nil && result == nil {
+		result = &ingest.Result{}
+	}
+	if err != nil {
+		result = nil
+	}
+
+	call.Err = err
+	f.calls = append(f.calls, call)
+	return result, err
+}
+
+func fromProps(call Call, props properties.All) Call {
+	call.Database = props.Ingestion.DatabaseName
+	call.Table = props.Ingestion.TableName
+	call.Format = props.Ingestion.Additional.Format
+	call.MappingRef = props.Ingestion.Additional.IngestionMappingRef
+	call.MappingKind = props.Ingestion.Additional.IngestionMappingType
+	call.DontCompress = !props.ShouldCompress()
+	return call
+}
@@ -0,0 +1,197 @@
+package ingesttest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeIngestorFromReader(t *testing.T) {
+	t.Parallel()
+
+	fake := &FakeIngestor{DB: "db", Table: "table"}
+
+	_, err := fake.FromReader(context.Background(), strings.NewReader("a,b"))
+	require.NoError(t, err)
+
+	_, err = fake.FromReader(context.Background(), strings.NewReader(`{"a":1}`),
+		ingest.FileFormat(ingest.JSON), ingest.IngestionMappingRef("map", ingest.JSON), ingest.Table("other"))
+	require.NoError(t, err)
+
+	calls := fake.CallsTo(MethodFromReader)
+	require.Len(t, calls, 2)
+
+	assert.Equal(t, []byte("a,b"), calls[0].Data)
+	assert.Equal(t, "db", calls[0].Database)
+	assert.Equal(t, "table", calls[0].Table)
+	assert.Equal(t, ingest.CSV, calls[0].Format, "the real client defaults to CSV")
+
+	assert.Equal(t, "other", calls[1].Table)
+	assert.Equal(t, ingest.JSON, calls[1].Format)
+	assert.Equal(t, "map", calls[1].MappingRef)
+	assert.Equal(t, ingest.JSON, calls[1].MappingKind)
+	assert.Len(t, calls[1].Options, 3)
+}
+
+func TestFakeIngestorFromFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	fPath := filepath.Join(dir, "data.json.gz")
+	require.NoError(t, ioutil.WriteFile(fPath, []byte("data"), 0644))
+
+	tests := []struct {
+		desc       string
+		client     ingest.ClientScope
+		path       string
+		options    []ingest.FileOption
+		wantErr    bool
+		wantFormat ingest.DataFormat
+	}{
+		{
+			desc:       "Local file format is discovered from the name",
+			path:       fPath,
+			wantFormat: ingest.MultiJSON,
+		},
+		{
+			desc:       "Blob with the queued client",
+			path:       "https://account.blob.core.windows.net/container/data.csv",
+			wantFormat: ingest.CSV,
+		},
+		{
+			desc:    "Blob with the streaming client",
+			client:  ingest.StreamingClient,
+			path:    "https://account.blob.core.windows.net/container/data.csv",
+			wantErr: true,
+		},
+		{
+			desc:    "Missing local file",
+			path:    filepath.Join(dir, "missing.csv"),
+			wantErr: true,
+		},
+		{
+			desc:    "Option not valid for the source",
+			path:    "https://account.blob.core.windows.net/container/data.csv",
+			options: []ingest.FileOption{ingest.DeleteSource()},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			fake := &FakeIngestor{DB: "db", Table: "table", Client: test.client}
+			_, err := fake.FromFile(context.Background(), test.path, test.options...)
+
+			calls := fake.Calls()
+			require.Len(t, calls, 1)
+			assert.Equal(t, MethodFromFile, calls[0].Method)
+			assert.Equal(t, test.path, calls[0].Path)
+			assert.Equal(t, err, calls[0].Err)
+
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.wantFormat, calls[0].Format)
+		})
+	}
+}
+
+func TestFakeIngestorFromBlob(t *testing.T) {
+	t.Parallel()
+
+	fake := &FakeIngestor{DB: "db", Table: "table"}
+
+	_, err := fake.FromBlob(context.Background(), "https://account.blob.core.windows.net/container/data.json.gz?sig=secret")
+	require.NoError(t, err)
+	_, err = fake.FromBlob(context.Background(), "data.csv")
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+
+	calls := fake.CallsTo(MethodFromBlob)
+	require.Len(t, calls, 2)
+	assert.Equal(t, "table", calls[0].Table)
+	assert.Equal(t, ingest.MultiJSON, calls[0].Format, "the format is found from the name of the blob")
+	assert.True(t, calls[0].DontCompress, "the blob is already compressed")
+	assert.Error(t, calls[1].Err)
+}
+
+func TestFakeIngestorValidation(t *testing.T) {
+	t.Parallel()
+
+	fake := &FakeIngestor{Client: ingest.StreamingClient}
+
+	// ReportResultToTable() is not supported by streaming ingestion.
+	_, err := fake.FromReader(context.Background(), strings.NewReader("a,b"), ingest.ReportResultToTable())
+	require.Error(t, err)
+	assert.Equal(t, errors.KOptionInvalid, err.(*errors.Error).Kind)
+
+	// An invalid mapping kind.
+	_, err = fake.FromReader(context.Background(), strings.NewReader("a,b"), ingest.IngestionMappingRef("map", ingest.Raw))
+	require.Error(t, err)
+
+	calls := fake.Calls()
+	require.Len(t, calls, 2)
+	assert.Error(t, calls[0].Err)
+	assert.Nil(t, calls[0].Data, "the reader should not be consumed when options are invalid")
+}
+
+func TestFakeIngestorResponses(t *testing.T) {
+	t.Parallel()
+
+	fail := fmt.Errorf("fail")
+	fake := &FakeIngestor{Responses: []Response{{Err: fail}, {}}}
+
+	_, err := fake.FromReader(context.Background(), strings.NewReader(""), ingest.DeleteSource())
+	require.Error(t, err, "invalid options should not consume a response")
+
+	_, err = fake.FromReader(context.Background(), strings.NewReader(""))
+	assert.Equal(t, fail, err)
+
+	res, err := fake.FromReader(context.Background(), strings.NewReader(""))
+	require.NoError(t, err)
+	assert.NotNil(t, res)
+
+	res, err = fake.FromReader(context.Background(), strings.NewReader(""))
+	require.NoError(t, err, "calls succeed once responses are exhausted")
+	assert.NotNil(t, res)
+	assert.NoError(t, <-res.Wait(context.Background()))
+
+	fake.Reset()
+	assert.Empty(t, fake.Calls())
+	_, err = fake.FromReader(context.Background(), strings.NewReader(""))
+	assert.Equal(t, fail, err, "Reset should restart the responses")
+}
+
+func TestFailingIngestor(t *testing.T) {
+	t.Parallel()
+
+	fail := fmt.Errorf("fail")
+	fake := FailingIngestor("db", "table", fail)
+
+	f, err := os.CreateTemp(t.TempDir(), "*.csv")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = fake.FromFile(context.Background(), f.Name())
+	assert.Equal(t, fail, err)
+	_, err = fake.FromReader(context.Background(), strings.NewReader("a,b"))
+	assert.Equal(t, fail, err)
+
+	calls := fake.Calls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, []byte("a,b"), calls[1].Data)
+}
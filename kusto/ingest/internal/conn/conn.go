@@ -4,19 +4,26 @@ package conn
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	goErrors "errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto"
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/trace"
 	"github.com/Azure/azure-kusto-go/kusto/internal/response"
 	"github.com/Azure/azure-kusto-go/kusto/internal/version"
 	"github.com/Azure/go-autorest/autorest"
@@ -39,12 +46,120 @@ type Conn struct {
 	reqHeaders  http.Header
 	headersPool chan http.Header
 	client      *http.Client
+	// endpoint is set by WithEndpoint(), to send the requests there instead of to the engine endpoint.
+	endpoint string
+	// tracer is set by WithTracer().
+	tracer kusto.Tracer
+	// spans is set by WithSpanTracer().
+	spans trace.Tracer
+	// app and user are set by WithTracingIdentity().
+	app, user string
+	// tlsConfig is set by WithTLSConfig().
+	tlsConfig *tls.Config
+
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	timeouts            Timeouts
 
 	inTest bool
 }
 
-// New returns a new Conn object.
-func New(endpoint string, auth kusto.Authorization) (*Conn, error) {
+// defaultMaxIdleConnsPerHost is how many idle connections to the service a Conn keeps by default. All the requests
+// go to the same host, so the default of net/http, 2, would close most connections when requests are concurrent.
+const defaultMaxIdleConnsPerHost = 100
+
+// The default timeouts of a Conn. The response header timeout stops a request whose connection stopped answering,
+// which without it would wait for as long as its context allows, with no limit for a context without a deadline.
+const (
+	defaultDialTimeout           = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 5 * time.Minute
+	defaultIdleConnTimeout       = 90 * time.Second
+)
+
+// Timeouts are the timeouts of the connections of a Conn. A field left at 0 keeps its default.
+type Timeouts struct {
+	// Dial is how long opening a connection can take. The default is 30 seconds.
+	Dial time.Duration
+	// TLSHandshake is how long the TLS handshake of a new connection can take. The default is 10 seconds.
+	TLSHandshake time.Duration
+	// ResponseHeader is how long the service can take to answer once the request was sent. The default is 5 minutes.
+	ResponseHeader time.Duration
+	// IdleConn is how long an idle connection is kept for reuse. The default is 90 seconds.
+	IdleConn time.Duration
+}
+
+// Option is an optional argument to New().
+type Option func(c *Conn)
+
+// WithHTTPClient makes the Conn send its requests with client, such as to go through a proxy or with custom TLS
+// settings. The timeout of client applies to each request. Authorization headers are still added to the requests.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Conn) {
+		if client != nil {
+			c.client = client
+		}
+	}
+}
+
+// WithConnectionLimits sets how many idle connections to the service are kept for reuse, and how many connections
+// can be open at the same time. 0 keeps the defaults of 100 idle connections and no limit on open connections.
+// When the limit is reached, requests wait for a connection. This has no effect with WithHTTPClient().
+func WithConnectionLimits(maxIdleConnsPerHost, maxConnsPerHost int) Option {
+	return func(c *Conn) {
+		c.maxIdleConnsPerHost = maxIdleConnsPerHost
+		c.maxConnsPerHost = maxConnsPerHost
+	}
+}
+
+// WithTimeouts sets the timeouts of the connections to the service. This has no effect with WithHTTPClient().
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(c *Conn) {
+		c.timeouts = timeouts
+	}
+}
+
+// WithEndpoint makes the Conn send its requests to endpoint as given, such as for a Private Link hostname that does
+// not follow the naming of the cluster endpoints. The endpoint passed to New() is still the audience of the tokens.
+func WithEndpoint(endpoint string) Option {
+	return func(c *Conn) {
+		c.endpoint = endpoint
+	}
+}
+
+// WithTLSConfig makes the Conn open its connections with config, see kusto.WithTLSConfig(). This has no effect with
+// WithHTTPClient().
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Conn) {
+		c.tlsConfig = config
+	}
+}
+
+// WithTracer makes the Conn call tracer around each of its requests, see kusto.WithTracer().
+func WithTracer(tracer kusto.Tracer) Option {
+	return func(c *Conn) {
+		c.tracer = tracer
+	}
+}
+
+// WithSpanTracer makes the Conn start a span with tracer around each of its requests.
+func WithSpanTracer(tracer trace.Tracer) Option {
+	return func(c *Conn) {
+		c.spans = tracer
+	}
+}
+
+// WithTracingIdentity makes the Conn send app and user as the x-ms-app and x-ms-user headers, if not empty, see
+// kusto.WithApplicationForTracing() and kusto.WithUserForTracing().
+func WithTracingIdentity(app, user string) Option {
+	return func(c *Conn) {
+		c.app, c.user = app, user
+	}
+}
+
+// New returns a new Conn object. endpoint can be the endpoint of the cluster engine or of its Data Management
+// service, the "ingest-" endpoint, as streaming ingestion requests are sent to the engine either way.
+func New(endpoint string, auth kusto.Authorization, options ...Option) (*Conn, error) {
 	if !validURL.MatchString(endpoint) {
 		return nil, errors.ES(
 			errors.OpServConn,
@@ -52,36 +167,70 @@ func New(endpoint string, auth kusto.Authorization) (*Conn, error) {
 			"endpoint is not valid(%s) for Kusto streaming ingestion", endpoint,
 		).SetNoRetry()
 	}
-	if err := auth.Validate(endpoint); err != nil {
+	engine, err := engineURL(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.Validate(engine.String()); err != nil {
 		return nil, err
 	}
 
-	return newWithoutValidation(endpoint, auth)
+	return newWithoutValidation(endpoint, auth, options...)
 }
 
-func newWithoutValidation(endpoint string, auth kusto.Authorization) (*Conn, error) {
-	headers := http.Header{}
-	headers.Add("Accept", "application/json")
-	headers.Add("Accept-Encoding", "gzip,deflate")
-	headers.Add("x-ms-client-version", "Kusto.Go.Client: "+version.Kusto)
-	headers.Add("Connection", "Keep-Alive")
-
-	// TODO(daniel/jdoak): Get rid of this Replace stuff. I mean, its just hacky.
-	u, err := url.Parse(strings.Replace(endpoint, "ingest-", "", 1))
+// engineURL returns the URL of the engine of the cluster at endpoint, which is endpoint without the "ingest-" prefix
+// of the host of the Data Management service, if it has one.
+func engineURL(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, errors.E(
 			errors.OpServConn,
 			errors.KClientArgs,
-			fmt.Errorf("could not parse the endpoint(%s): %s", endpoint, err),
+			fmt.Errorf("could not parse the endpoint(%s): %w", endpoint, err),
 		).SetNoRetry()
 	}
+	u.Host = strings.TrimPrefix(u.Host, "ingest-")
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}, nil
+}
+
+func newWithoutValidation(endpoint string, auth kusto.Authorization, options ...Option) (*Conn, error) {
+	headers := http.Header{}
+	headers.Add("Accept", "application/json")
+	headers.Add("Accept-Encoding", "gzip,deflate")
+	headers.Add("x-ms-client-version", version.Header)
+	headers.Add("Connection", "Keep-Alive")
 
 	c := &Conn{
 		auth:        auth,
-		baseURL:     &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/v1/rest/ingest/"},
 		reqHeaders:  headers,
 		headersPool: make(chan http.Header, 100),
-		client:      &http.Client{},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	if c.app != "" {
+		headers.Add("x-ms-app", c.app)
+	}
+	if c.user != "" {
+		headers.Add("x-ms-user", c.user)
+	}
+
+	u, err := engineURL(endpoint)
+	if c.endpoint != "" {
+		u, err = url.Parse(c.endpoint)
+		if err == nil && (!u.IsAbs() || u.Host == "") {
+			err = fmt.Errorf("not an absolute URL")
+		}
+		if err != nil {
+			return nil, errors.E(errors.OpServConn, errors.KClientArgs, fmt.Errorf("the streaming endpoint(%s) is not valid: %w", c.endpoint, err)).SetNoRetry()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.baseURL = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/v1/rest/ingest/"}
+	if c.client == nil {
+		c.client = &http.Client{Transport: c.newTransport()}
 	}
 
 	// Fills a pool of headers to alleviate header copying timing at request time.
@@ -96,9 +245,61 @@ func newWithoutValidation(endpoint string, auth kusto.Authorization) (*Conn, err
 
 var writeOp = errors.OpIngestStream
 
+const (
+	// timeoutSkew is taken off the time left before the context deadline when telling the service how long to
+	// work on a request, so that it gives up before the client does.
+	timeoutSkew = time.Second
+	// maxServerTimeout is the longest server timeout that the service accepts.
+	maxServerTimeout = time.Hour
+)
+
+// Response holds what the service returned for a successful streaming ingestion.
+type Response struct {
+	// ActivityID is the x-ms-activity-id header, which identifies the request in the service's logs.
+	ActivityID string
+	// ClientRequestID is the x-ms-client-request-id header the service echoed, or the one sent if it did not.
+	ClientRequestID string
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Elapsed is the time from sending the request to reading the whole response.
+	Elapsed time.Duration
+}
+
+// sizedReader is a payload whose size is known, see Sized().
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+// Sized returns payload, which returns size bytes, for StreamIngest() to send it with a Content-Length header instead
+// of with chunked transfer encoding, which some proxies refuse.
+func Sized(payload io.Reader, size int64) io.Reader {
+	return &sizedReader{Reader: payload, size: size}
+}
+
+// payloadSize returns the size of payload, or -1 if it is not known. The size of a payload of Sized() is known, as is
+// that of a payload with a Len() method, such as a *bytes.Buffer or a *bytes.Reader.
+func payloadSize(payload io.Reader) int64 {
+	switch p := payload.(type) {
+	case *sizedReader:
+		return p.size
+	case interface{ Len() int }:
+		return int64(p.Len())
+	}
+	return -1
+}
+
 // StreamIngest ingests into database "db", table "table" what is stored in "payload" which should be encoded in "format" and
-// have a server side data mapping reference named "mappingName".  "mappingName" can be nil.
-func (c *Conn) StreamIngest(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+// have a server side data mapping reference named "mappingName".  "mappingName" can be nil. "compression" is the
+// compression of payload: it is sent with a "Content-Encoding: gzip" header if it is properties.GZIP, and as it is
+// otherwise, such as ApacheAvro data, which is compressed internally. "additional" are extra query parameters of the
+// request, which do not replace the ones set from the other arguments.
+// The request has a Content-Length header when the size of payload is known, see Sized(), and is sent with chunked
+// transfer encoding otherwise. If the service rejects the token of the request with a 401, a new token is fetched,
+// and the request is sent again once if payload can be read again: a *bytes.Buffer, or a payload that implements
+// io.Seeker, such as a *bytes.Reader or a file, including as the payload of Sized().
+func (c *Conn) StreamIngest(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, compression properties.CompressionType, mappingName string, additional map[string]string, clientRequestId string) (Response, error) {
+	size := payloadSize(payload)
 	defer func() {
 		if buf, ok := payload.(*bytes.Buffer); ok {
 			buf.Reset()
@@ -106,6 +307,93 @@ func (c *Conn) StreamIngest(ctx context.Context, db, table string, payload io.Re
 		}
 	}()
 
+	body := payload
+	if buf, ok := payload.(*bytes.Buffer); ok {
+		// The bytes of a buffer can be sent again, unlike the buffer itself.
+		body = bytes.NewReader(buf.Bytes())
+	}
+
+	var closeablePayload io.ReadCloser
+	var ok bool
+	if closeablePayload, ok = payload.(io.ReadCloser); !ok {
+		closeablePayload = ioutil.NopCloser(body)
+	}
+
+	return c.post(ctx, db, table, closeablePayload, size, rewinder(body), format, compression == properties.GZIP, mappingName, additional, clientRequestId, false)
+}
+
+// rewinder returns a function that sets payload back to where it is now, to send it again, or nil if payload cannot
+// be sent again. A payload that implements io.Seeker, such as a *bytes.Reader or a file, can be, including when it is
+// the payload of Sized().
+func rewinder(payload io.Reader) func() error {
+	if p, ok := payload.(*sizedReader); ok {
+		payload = p.Reader
+	}
+	s, ok := payload.(io.Seeker)
+	if !ok {
+		return nil
+	}
+	offset, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	return func() error {
+		_, err := s.Seek(offset, io.SeekStart)
+		return err
+	}
+}
+
+// StreamIngestBlob ingests into database "db", table "table" the blob at blobURI, which should be encoded in "format"
+// and have a server side data mapping reference named "mappingName". The service reads the blob itself, so blobURI
+// must give it access, with a SAS token or the ";impersonate" suffix. "additional" are as with StreamIngest().
+func (c *Conn) StreamIngestBlob(ctx context.Context, db, table string, blobURI string, format properties.DataFormat, mappingName string, additional map[string]string, clientRequestId string) (Response, error) {
+	body, err := json.Marshal(struct {
+		SourceUri string
+	}{blobURI})
+	if err != nil {
+		return Response{}, errors.E(writeOp, errors.KInternal, err)
+	}
+
+	r := bytes.NewReader(body)
+	return c.post(ctx, db, table, ioutil.NopCloser(r), int64(len(body)), rewinder(r), format, false, mappingName, additional, clientRequestId, true)
+}
+
+// post sends a streaming ingestion request with body within the span of the request, see send().
+func (c *Conn) post(ctx context.Context, db, table string, body io.ReadCloser, size int64, rewind func() error, format properties.DataFormat, gzipped bool, mappingName string, additional map[string]string, clientRequestId string, fromBlob bool) (Response, error) {
+	if clientRequestId == "" {
+		clientRequestId = "KGC.execute;" + uuid.New().String()
+	}
+
+	ctx, span := trace.Start(ctx, c.spans, trace.Stream,
+		trace.String(trace.DBSystem, "kusto"),
+		trace.String(trace.DBNamespace, db),
+		trace.String(trace.DBCollection, table),
+		trace.String(trace.ServerAddress, c.baseURL.Host),
+		trace.String(trace.HTTPMethod, http.MethodPost),
+		trace.String(trace.ClientRequestID, clientRequestId),
+	)
+	resp, err := c.send(ctx, db, table, body, size, rewind, format, gzipped, mappingName, additional, clientRequestId, fromBlob)
+
+	var e *errors.Error
+	switch {
+	case err == nil:
+		span.SetAttributes(trace.Int64(trace.HTTPStatusCode, int64(resp.StatusCode)), trace.String(trace.ActivityID, resp.ActivityID))
+	case goErrors.As(err, &e) && e.StatusCode() != 0:
+		span.SetAttributes(trace.Int64(trace.HTTPStatusCode, int64(e.StatusCode())), trace.String(trace.ActivityID, e.ActivityId()))
+	}
+	span.End(err)
+	return resp, err
+}
+
+// send sends a streaming ingestion request with body, of size bytes, or -1 if that is not known. If fromBlob is set,
+// body is the JSON description of the blob to ingest, else it is the data, which is sent with a "Content-Encoding:
+// gzip" header if gzipped is set. The deadline of ctx, if any, is
+// sent as the server timeout, so the service stops working on the request when the client stops waiting for it.
+// A request that the service rejects with a 401 is sent again once, with a new token, if rewind, which sets body back
+// to its start, is not nil. Otherwise, or if it is rejected again, the error is of kind errors.KAuth.
+func (c *Conn) send(ctx context.Context, db, table string, body io.ReadCloser, size int64, rewind func() error, format properties.DataFormat, gzipped bool, mappingName string, additional map[string]string, clientRequestId string, fromBlob bool) (Response, error) {
+	defer body.Close()
+
 	switch {
 	case format == properties.DFUnknown:
 		format = properties.CSV
@@ -116,14 +404,16 @@ func (c *Conn) StreamIngest(ctx context.Context, db, table string, payload io.Re
 		c.headersPool <- copyHeaders(c.reqHeaders)
 	}()
 
-	if clientRequestId != "" {
-		headers.Add("x-ms-client-request-id", clientRequestId)
-	} else {
-		headers.Add("x-ms-client-request-id", "KGC.execute;"+uuid.New().String())
+	headers.Add("x-ms-client-request-id", clientRequestId)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		headers.Add("x-ms-servertimeout", value.Timespan{Valid: true, Value: serverTimeout(deadline, time.Now())}.Marshal())
 	}
 
 	headers.Add("Content-Type", "application/json; charset=utf-8")
-	headers.Add("Content-Encoding", "gzip")
+	if gzipped && !fromBlob {
+		headers.Add("Content-Encoding", "gzip")
+	}
 
 	u, _ := url.Parse(c.baseURL.String()) // Safe copy of a known good URL object
 	u.Path = path.Join(u.Path, db, table)
@@ -133,19 +423,84 @@ func (c *Conn) StreamIngest(ctx context.Context, db, table string, payload io.Re
 		qv.Add("mappingName", mappingName)
 	}
 	qv.Add("streamFormat", format.CamelCase())
+	if fromBlob {
+		qv.Add("sourceKind", "uri")
+	}
+	for k, v := range additional {
+		if _, ok := qv[k]; !ok {
+			qv.Set(k, v)
+		}
+	}
 	u.RawQuery = qv.Encode()
 
-	var closeablePayload io.ReadCloser
-	var ok bool
-	if closeablePayload, ok = payload.(io.ReadCloser); !ok {
-		closeablePayload = ioutil.NopCloser(payload)
+	for retried := false; ; retried = true {
+		a, err := c.do(ctx, u, headers, body, size, clientRequestId)
+		if err != nil {
+			return Response{}, err
+		}
+		if a.resp.StatusCode != http.StatusUnauthorized {
+			return c.response(a, clientRequestId)
+		}
+
+		// The token may have expired, or have been revoked, before the time the client had for it. A new one is
+		// fetched, and the request is sent again with it once, if its body can be sent again. A new token that is
+		// rejected too is not replaced.
+		var refreshed bool
+		if !retried {
+			refreshed, err = c.auth.Refresh(ctx, a.req.Header.Get("Authorization"))
+		}
+		if err == nil && refreshed && rewind != nil {
+			if err = rewind(); err == nil {
+				c.discard(a, clientRequestId)
+				continue
+			}
+			err = errors.E(writeOp, errors.KIO, fmt.Errorf("could not send the payload again: %w", err))
+		}
+		resp, respErr := c.response(a, clientRequestId)
+		var e *errors.Error
+		if !goErrors.As(respErr, &e) {
+			return resp, respErr
+		}
+		e.Kind = errors.KAuth
+		switch {
+		case err != nil:
+			var inner *errors.Error
+			if !goErrors.As(err, &inner) {
+				inner = errors.E(writeOp, errors.KAuth, err)
+			}
+			return Response{}, errors.W(inner, e)
+		case refreshed:
+			// The caller can send the request again with the new token.
+			e.SetTransient()
+		}
+		return Response{}, e
 	}
+}
 
-	req := &http.Request{
+// attempt is a streaming ingestion request that was sent, and its response.
+type attempt struct {
+	req   *http.Request
+	resp  *http.Response
+	call  kusto.TraceCall
+	start time.Time
+}
+
+// do sends a streaming ingestion request with body to u, signed with a token of the authorizer of c. The response is
+// to be read with response() or discard().
+func (c *Conn) do(ctx context.Context, u *url.URL, headers http.Header, body io.Reader, size int64, clientRequestId string) (attempt, error) {
+	req := (&http.Request{
 		Method: http.MethodPost,
 		URL:    u,
 		Header: headers,
-		Body:   closeablePayload,
+		// The body is closed by send(), as it may be sent again.
+		Body: &ctxReader{ctx: ctx, r: ioutil.NopCloser(body)},
+	}).WithContext(ctx)
+	switch {
+	case size == 0:
+		// A request with a body and no length is sent chunked.
+		req.Body = http.NoBody
+	case size > 0:
+		req.ContentLength = size
 	}
 
 	if !c.inTest {
@@ -153,22 +508,172 @@ func (c *Conn) StreamIngest(ctx context.Context, db, table string, payload io.Re
 		prep := c.auth.Authorizer.WithAuthorization()
 		req, err = prep(autorest.CreatePreparer()).Prepare(req)
 		if err != nil {
-			return errors.E(writeOp, errors.KInternal, err)
+			var e *errors.Error
+			if goErrors.As(err, &e) {
+				return attempt{}, e
+			}
+			return attempt{}, errors.E(writeOp, errors.KInternal, err)
 		}
 	}
 
-	resp, err := c.client.Do(req.WithContext(ctx))
+	var call kusto.TraceCall
+	if c.tracer != nil {
+		call = kusto.TraceCall{Op: writeOp, Endpoint: u.String(), ClientRequestID: clientRequestId, Start: time.Now()}
+		req = req.WithContext(c.tracer.TraceStart(req.Context(), call))
+	}
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
 	if err != nil {
-		return errors.E(writeOp, errors.KHTTPError, err)
+		e := errors.E(writeOp, errors.KHTTPError, err).SetRequestInfo("", clientRequestId, time.Since(start))
+		if c.tracer != nil {
+			c.traceEnd(req, call, nil, e)
+		}
+		return attempt{}, e
+	}
+	return attempt{req: req, resp: resp, call: call, start: start}, nil
+}
+
+// response reads the response of a and returns the error of the service if the request failed.
+func (c *Conn) response(a attempt, clientRequestId string) (Response, error) {
+	resp := a.resp
+	activityId := resp.Header.Get("x-ms-activity-id")
+	if echo := resp.Header.Get("x-ms-client-request-id"); echo != "" {
+		clientRequestId = echo
 	}
 
 	if resp.StatusCode != 200 {
 		body, err := response.TranslateBody(resp, writeOp)
 		if err != nil {
-			return err
+			if c.tracer != nil {
+				c.traceEnd(a.req, a.call, resp, err)
+			}
+			return Response{}, err
+		}
+		e := responseErr(errors.HTTP(writeOp, resp.Status, body, "streaming ingest issue"))
+		e.SetRetryAfter(response.RetryAfter(resp.Header.Get("Retry-After"), time.Now())).SetRequestInfo(activityId, clientRequestId, time.Since(a.start))
+		if c.tracer != nil {
+			c.traceEnd(a.req, a.call, resp, e)
 		}
-		return errors.HTTP(writeOp, resp.Status, body, "streaming ingest issue")
+		return Response{}, e
+	}
+	if c.tracer != nil {
+		c.traceEnd(a.req, a.call, resp, nil)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return Response{
+		ActivityID:      activityId,
+		ClientRequestID: clientRequestId,
+		StatusCode:      resp.StatusCode,
+		Elapsed:         time.Since(a.start),
+	}, nil
+}
+
+// discard reads the 401 response of a, whose request is sent again, and traces it as failed.
+func (c *Conn) discard(a attempt, clientRequestId string) {
+	_, _ = io.Copy(ioutil.Discard, a.resp.Body)
+	a.resp.Body.Close()
+	if c.tracer != nil {
+		e := errors.ES(writeOp, errors.KAuth, "the service rejected the token of the request(%s)", a.resp.Status).
+			SetRequestInfo(a.resp.Header.Get("x-ms-activity-id"), clientRequestId, time.Since(a.start))
+		c.traceEnd(a.req, a.call, a.resp, e)
+	}
+}
+
+// traceEnd calls TraceEnd of the tracer of c for call, which got resp, if any, or failed with err.
+func (c *Conn) traceEnd(req *http.Request, call kusto.TraceCall, resp *http.Response, err error) {
+	call.Duration = time.Since(call.Start)
+	call.Err = err
+	if resp != nil {
+		call.StatusCode = resp.StatusCode
+		call.ActivityID = resp.Header.Get("x-ms-activity-id")
+	}
+	c.tracer.TraceEnd(req.Context(), call)
+}
+
+// responseErr sets the Kind of e, the error for a failed response, from the error the service returned in the body.
+// An error the service reports as permanent is of Kind errors.KClientArgs if the request was wrong, such as its
+// mapping or its data, or errors.KInternal for a failure of the service. Other errors, including bodies that are not
+// a OneApiError, stay of Kind errors.KHTTPError.
+func responseErr(e *errors.Error) *errors.Error {
+	se, ok := e.ServiceError()
+	if !ok || !se.Permanent {
+		return e
+	}
+	e.Kind = errors.KInternal
+	if se.StatusCode >= 400 && se.StatusCode < 500 {
+		e.Kind = errors.KClientArgs
+	}
+	return e.SetNoRetry()
+}
+
+// newTransport returns the transport of the client of a Conn, which is shared by all its requests so that they
+// reuse connections.
+func (c *Conn) newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if c.maxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = c.maxIdleConnsPerHost
 	}
+	if t.MaxIdleConns < t.MaxIdleConnsPerHost {
+		t.MaxIdleConns = t.MaxIdleConnsPerHost
+	}
+	t.MaxConnsPerHost = c.maxConnsPerHost
+	if c.tlsConfig != nil {
+		t.TLSClientConfig = c.tlsConfig
+	}
+
+	dial := orDefault(c.timeouts.Dial, defaultDialTimeout)
+	t.DialContext = (&net.Dialer{Timeout: dial, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = orDefault(c.timeouts.TLSHandshake, defaultTLSHandshakeTimeout)
+	t.ResponseHeaderTimeout = orDefault(c.timeouts.ResponseHeader, defaultResponseHeaderTimeout)
+	t.IdleConnTimeout = orDefault(c.timeouts.IdleConn, defaultIdleConnTimeout)
+	return t
+}
+
+// orDefault returns d, or def if d is 0.
+func orDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// serverTimeout returns how long the service should work on a request whose context expires at deadline.
+func serverTimeout(deadline, now time.Time) time.Duration {
+	d := deadline.Sub(now) - timeoutSkew
+	switch {
+	case d < timeoutSkew:
+		return timeoutSkew
+	case d > maxServerTimeout:
+		return maxServerTimeout
+	}
+	return d
+}
+
+// ctxReader is a request body that stops being read once ctx is done, so that a canceled request does not go on
+// reading, and compressing, the rest of the payload.
+type ctxReader struct {
+	ctx context.Context
+	r   io.ReadCloser
+}
+
+func (c *ctxReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+func (c *ctxReader) Close() error {
+	return c.r.Close()
+}
+
+// Close closes the idle connections of the HTTP client. Requests in flight are not interrupted.
+func (c *Conn) Close() error {
+	c.client.CloseIdleConnections()
 	return nil
 }
 
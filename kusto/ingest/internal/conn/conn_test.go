@@ -7,16 +7,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto"
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/trace"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -54,6 +60,16 @@ func newFakeStreamService() *fakeStreamService {
 func (f *fakeStreamService) handleStream(res http.ResponseWriter, r *http.Request) {
 	f.req = r
 
+	if r.URL.Query().Get("sourceKind") == "uri" {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.out = b
+		res.WriteHeader(200)
+		return
+	}
+
 	zr, err := gzip.NewReader(r.Body)
 	if err != nil {
 		log.Fatal(err)
@@ -68,6 +84,13 @@ func (f *fakeStreamService) handleStream(res http.ResponseWriter, r *http.Reques
 		log.Fatal(err)
 	}
 	f.out = buf.Bytes()
+	res.Header().Set("x-ms-activity-id", "activity")
+
+	if strings.Contains(r.URL.Path, "throttled") {
+		res.Header().Set("Retry-After", "2")
+		res.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
 
 	if strings.Contains(r.URL.Path, "httpError") {
 
@@ -193,7 +216,7 @@ func TestStream(t *testing.T) {
 				db += ".gzip"
 			}
 
-			err = conn.StreamIngest(ctx, db, "table", &payload, properties.JSON, test.mappingName, "")
+			_, err = conn.StreamIngest(ctx, db, "table", &payload, properties.JSON, properties.GZIP, test.mappingName, nil, "")
 
 			if test.err != nil {
 				assert.Equal(t, test.err, err.(*errors.Error).Err)
@@ -219,3 +242,810 @@ func TestStream(t *testing.T) {
 		})
 	}
 }
+
+func TestStreamFormat(t *testing.T) {
+	t.Parallel()
+
+	server := newFakeStreamService()
+	go func() {
+		if err := server.start(); err != nil && err != http.ErrServerClosed {
+			t.Errorf("failed to start server: %v", err)
+		}
+	}()
+	defer server.serv.Close()
+
+	conn, err := newWithoutValidation(fmt.Sprintf("http://127.0.0.1:%d", server.port), kusto.Authorization{})
+	require.NoError(t, err)
+	conn.inTest = true
+
+	tests := []struct {
+		format properties.DataFormat
+		want   string
+	}{
+		{properties.DFUnknown, "Csv"},
+		{properties.CSV, "Csv"},
+		{properties.JSON, "Json"},
+		{properties.MultiJSON, "MultiJson"},
+		{properties.SingleJSON, "SingleJson"},
+		{properties.AVRO, "Avro"},
+		{properties.ApacheAVRO, "ApacheAvro"},
+		{properties.Parquet, "Parquet"},
+		{properties.ORC, "Orc"},
+		{properties.PSV, "Psv"},
+		{properties.Raw, "Raw"},
+		{properties.SCSV, "Scsv"},
+		{properties.SOHSV, "Sohsv"},
+		{properties.SStream, "SStream"},
+		{properties.TSV, "Tsv"},
+		{properties.TSVE, "Tsve"},
+		{properties.TXT, "Txt"},
+		{properties.W3CLogFile, "W3cLogFile"},
+	}
+
+	// The fake server keeps only the last request, so these cannot run in parallel.
+	for _, test := range tests {
+		var payload bytes.Buffer
+		zw := gzip.NewWriter(&payload)
+		_, err = zw.Write([]byte("{}"))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		resp, err := conn.StreamIngest(ctx, "database", "table", &payload, test.format, properties.GZIP, "", nil, "")
+		cancel()
+		require.NoError(t, err)
+		assert.Equal(t, "activity", resp.ActivityID)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.True(t, strings.HasPrefix(resp.ClientRequestID, "KGC.execute;"), resp.ClientRequestID)
+		assert.True(t, resp.Elapsed > 0)
+
+		assert.Equal(t, test.want, server.req.URL.Query().Get("streamFormat"), test.format.String())
+	}
+}
+
+func TestStreamThrottled(t *testing.T) {
+	t.Parallel()
+
+	server := newFakeStreamService()
+	go func() {
+		if err := server.start(); err != nil && err != http.ErrServerClosed {
+			t.Errorf("failed to start server: %v", err)
+		}
+	}()
+	defer server.serv.Close()
+
+	conn, err := newWithoutValidation(fmt.Sprintf("http://127.0.0.1:%d", server.port), kusto.Authorization{})
+	require.NoError(t, err)
+	conn.inTest = true
+
+	var payload bytes.Buffer
+	zw := gzip.NewWriter(&payload)
+	require.NoError(t, zw.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = conn.StreamIngest(ctx, "database", "throttled", &payload, properties.CSV, properties.GZIP, "", nil, "id")
+	require.Error(t, err)
+
+	e := err.(*errors.Error)
+	assert.Equal(t, http.StatusTooManyRequests, e.StatusCode())
+	assert.Equal(t, 2*time.Second, e.RetryAfter())
+	assert.Equal(t, "activity", e.ActivityId())
+	assert.Equal(t, "id", e.ClientRequestId())
+	assert.True(t, e.Elapsed() > 0)
+}
+
+func TestStreamIngestBlob(t *testing.T) {
+	t.Parallel()
+
+	server := newFakeStreamService()
+	go func() {
+		if err := server.start(); err != nil && err != http.ErrServerClosed {
+			t.Errorf("failed to start server: %v", err)
+		}
+	}()
+	defer server.serv.Close()
+
+	conn, err := newWithoutValidation(fmt.Sprintf("http://127.0.0.1:%d", server.port), kusto.Authorization{})
+	require.NoError(t, err)
+	conn.inTest = true
+
+	blob := "https://account.blob.core.windows.net/container/data.json?sp=r&sig=secret"
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	additional := map[string]string{"ignoreFirstRecord": "true", "sourceKind": "other"}
+	_, err = conn.StreamIngestBlob(ctx, "database", "table", blob, properties.MultiJSON, "mapping", additional, "id")
+	require.NoError(t, err)
+
+	assert.Equal(t, "/v1/rest/ingest/database/table", server.req.URL.Path)
+	query := server.req.URL.Query()
+	assert.Equal(t, "uri", query.Get("sourceKind"))
+	assert.Equal(t, "MultiJson", query.Get("streamFormat"))
+	assert.Equal(t, "mapping", query.Get("mappingName"))
+	assert.Equal(t, "true", query.Get("ignoreFirstRecord"))
+	assert.Equal(t, []string{"uri"}, query["sourceKind"])
+	assert.Equal(t, "", server.req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "id", server.req.Header.Get("x-ms-client-request-id"))
+
+	var body map[string]string
+	require.NoError(t, json.Unmarshal(server.out, &body))
+	assert.Equal(t, map[string]string{"SourceUri": blob}, body)
+}
+
+func TestStreamContentEncoding(t *testing.T) {
+	t.Parallel()
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, err := zw.Write([]byte("a,1\n"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	tests := []struct {
+		desc        string
+		payload     []byte
+		format      properties.DataFormat
+		compression properties.CompressionType
+		want        string
+	}{
+		{desc: "Gzipped", payload: gz.Bytes(), format: properties.CSV, compression: properties.GZIP, want: "gzip"},
+		{desc: "Sent as it is", payload: []byte("Obj\x01avro"), format: properties.ApacheAVRO, compression: properties.CTNone, want: ""},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var encoding string
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				encoding = r.Header.Get("Content-Encoding")
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			conn, err := newWithoutValidation(server.URL, kusto.Authorization{})
+			require.NoError(t, err)
+			conn.inTest = true
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			_, err = conn.StreamIngest(ctx, "database", "table", bytes.NewReader(test.payload), test.format, test.compression, "", nil, "")
+			require.NoError(t, err)
+
+			assert.Equal(t, test.want, encoding)
+			assert.Equal(t, test.payload, body)
+		})
+	}
+}
+
+func TestServerTimeout(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		left time.Duration
+		want time.Duration
+	}{
+		{left: time.Minute, want: time.Minute - timeoutSkew},
+		{left: 10 * time.Second, want: 9 * time.Second},
+		{left: timeoutSkew, want: timeoutSkew},
+		{left: -time.Second, want: timeoutSkew},
+		{left: 2 * time.Hour, want: maxServerTimeout},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, serverTimeout(now.Add(test.left), now), test.left.String())
+	}
+}
+
+// endlessReader never runs out of data, and counts how many times it was read.
+type endlessReader struct {
+	reads int64
+}
+
+func (e *endlessReader) Read(b []byte) (int, error) {
+	atomic.AddInt64(&e.reads, 1)
+	for i := range b {
+		b[i] = 'a'
+	}
+	return len(b), nil
+}
+
+func TestStreamDeadline(t *testing.T) {
+	t.Parallel()
+
+	headers := make(chan http.Header, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		// A slow service, that only answers once the client gave up.
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	conn, err := newWithoutValidation(server.URL, kusto.Authorization{})
+	require.NoError(t, err)
+	conn.inTest = true
+
+	payload := &endlessReader{}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err = conn.StreamIngest(ctx, "database", "table", payload, properties.CSV, properties.GZIP, "", nil, "")
+	require.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "the request should stop at the deadline")
+
+	h := <-headers
+	// Just under 2 seconds: the 3 seconds left, minus the time to send the request, minus the skew.
+	assert.True(t, strings.HasPrefix(h.Get("x-ms-servertimeout"), "00:00:01."), h.Get("x-ms-servertimeout"))
+
+	// Once the request was canceled, the payload is no longer read.
+	reads := atomic.LoadInt64(&payload.reads)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, reads, atomic.LoadInt64(&payload.reads))
+
+	// Without a deadline, the service default applies.
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.StreamIngestBlob(ctx, "database", "table", server.URL, properties.CSV, "", nil, "")
+		done <- err
+	}()
+	h = <-headers
+	assert.Empty(t, h.Get("x-ms-servertimeout"))
+	cancel()
+	assert.Error(t, <-done)
+}
+
+func TestConnectionReuse(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc      string
+		options   []Option
+		wantLimit int64
+	}{
+		{desc: "Default limits"},
+		{desc: "Limited connections", options: []Option{WithConnectionLimits(10, 10)}, wantLimit: 10},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var conns int64
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(ioutil.Discard, r.Body)
+				time.Sleep(5 * time.Millisecond)
+			}))
+			server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt64(&conns, 1)
+				}
+			}
+			server.Start()
+			defer server.Close()
+
+			conn, err := newWithoutValidation(server.URL, kusto.Authorization{}, test.options...)
+			require.NoError(t, err)
+			conn.inTest = true
+			defer conn.Close()
+
+			// Each round sends 100 concurrent streams.
+			round := func() {
+				var wg sync.WaitGroup
+				for i := 0; i < 100; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, err := conn.StreamIngest(context.Background(), "database", "table", strings.NewReader("a,b\n"), properties.CSV, properties.GZIP, "", nil, "")
+						assert.NoError(t, err)
+					}()
+				}
+				wg.Wait()
+			}
+
+			round()
+			first := atomic.LoadInt64(&conns)
+			round()
+			round()
+			total := atomic.LoadInt64(&conns)
+
+			if test.wantLimit > 0 {
+				assert.LessOrEqual(t, total, test.wantLimit)
+				return
+			}
+			// The connections of the first round are kept, so later rounds open few if any.
+			assert.LessOrEqual(t, total-first, int64(10), "got %d connections in the first round, then %d", first, total-first)
+		})
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	t.Parallel()
+
+	// The listener accepts connections and reads the requests, but never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(ioutil.Discard, c)
+			}()
+		}
+	}()
+
+	conn, err := newWithoutValidation("http://"+ln.Addr().String(), kusto.Authorization{}, WithTimeouts(Timeouts{ResponseHeader: 100 * time.Millisecond}))
+	require.NoError(t, err)
+	conn.inTest = true
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.StreamIngest(context.Background(), "database", "table", strings.NewReader("a,b\n"), properties.CSV, properties.GZIP, "", nil, "")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "timeout awaiting response headers")
+	case <-time.After(10 * time.Second):
+		t.Fatal("the request did not time out")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		timeouts Timeouts
+		want     Timeouts
+	}{
+		{
+			desc: "Defaults",
+			want: Timeouts{TLSHandshake: defaultTLSHandshakeTimeout, ResponseHeader: defaultResponseHeaderTimeout, IdleConn: defaultIdleConnTimeout},
+		},
+		{
+			desc:     "Set timeouts",
+			timeouts: Timeouts{TLSHandshake: time.Second, ResponseHeader: time.Hour},
+			want:     Timeouts{TLSHandshake: time.Second, ResponseHeader: time.Hour, IdleConn: defaultIdleConnTimeout},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			conn, err := newWithoutValidation("https://cluster.kusto.windows.net", kusto.Authorization{}, WithTimeouts(test.timeouts))
+			require.NoError(t, err)
+
+			tr := conn.client.Transport.(*http.Transport)
+			assert.Equal(t, test.want.TLSHandshake, tr.TLSHandshakeTimeout)
+			assert.Equal(t, test.want.ResponseHeader, tr.ResponseHeaderTimeout)
+			assert.Equal(t, test.want.IdleConn, tr.IdleConnTimeout)
+			assert.NotNil(t, tr.DialContext)
+		})
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		endpoint string
+		options  []Option
+		want     string
+		err      bool
+	}{
+		{desc: "Engine endpoint", endpoint: "https://test.westus.kusto.windows.net", want: "https://test.westus.kusto.windows.net/v1/rest/ingest/"},
+		{desc: "Ingest endpoint", endpoint: "https://ingest-test.westus.kusto.windows.net", want: "https://test.westus.kusto.windows.net/v1/rest/ingest/"},
+		{desc: "Endpoint with a path", endpoint: "https://ingest-test.westus.kusto.windows.net/ingest-db", want: "https://test.westus.kusto.windows.net/v1/rest/ingest/"},
+		{desc: "Custom domain", endpoint: "https://my-ingest-cluster.contoso.com", want: "https://my-ingest-cluster.contoso.com/v1/rest/ingest/"},
+		{
+			desc:     "Explicit endpoint",
+			endpoint: "https://ingest-test.westus.kusto.windows.net",
+			options:  []Option{WithEndpoint("https://ingest-private.contoso.com")},
+			want:     "https://ingest-private.contoso.com/v1/rest/ingest/",
+		},
+		{desc: "Relative explicit endpoint", endpoint: "https://test.westus.kusto.windows.net", options: []Option{WithEndpoint("private.contoso.com")}, err: true},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			conn, err := New(test.endpoint, kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}, test.options...)
+			if test.err {
+				require.Error(t, err)
+				assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, conn.baseURL.String())
+		})
+	}
+}
+
+func TestStreamServiceErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		fixture  string
+		status   int
+		wantKind errors.Kind
+		// want is the service error that should be parsed from the body, if any.
+		want  *errors.ServiceError
+		retry bool
+	}{
+		{
+			desc:     "Mapping not found",
+			fixture:  "mapping_not_found.json",
+			status:   http.StatusBadRequest,
+			wantKind: errors.KClientArgs,
+			want: &errors.ServiceError{
+				StatusCode: http.StatusBadRequest,
+				Code:       "BadRequest_MappingReferenceWasNotFound",
+				Message:    "Request is invalid and cannot be executed.",
+				Type:       "Kusto.Data.Exceptions.IngestionMappingNotFoundException",
+				Detail:     "Mapping reference 'missing_mapping' of type 'mappingReference' in database 'database' could not be found.",
+				Permanent:  true,
+			},
+		},
+		{
+			desc:     "Malformed record",
+			fixture:  "bad_record.json",
+			status:   http.StatusBadRequest,
+			wantKind: errors.KClientArgs,
+			want: &errors.ServiceError{
+				StatusCode: http.StatusBadRequest,
+				Code:       "BadRequest_DataCorruption",
+				Message:    "Request is invalid and cannot be executed.",
+				Type:       "Kusto.DataNode.Exceptions.StreamingIngestionRequestException",
+				Detail:     "Bad streaming ingestion request to database.table : Stream with id 'data' has a malformed Csv format, at record #1 (line 1, column 4): too many fields.",
+				Permanent:  true,
+			},
+		},
+		{
+			desc:     "Throttled",
+			fixture:  "throttled.json",
+			status:   http.StatusTooManyRequests,
+			wantKind: errors.KHTTPError,
+			want: &errors.ServiceError{
+				StatusCode: http.StatusTooManyRequests,
+				Code:       "TooManyRequests",
+				Message:    "Request is denied due to throttling.",
+				Type:       "Kusto.DataNode.Exceptions.ControlCommandThrottledException",
+				Detail:     "The control command was aborted due to throttling. Retrying after some backoff might succeed.",
+			},
+			retry: true,
+		},
+		{
+			desc:     "Permanent service failure",
+			fixture:  "internal.json",
+			status:   http.StatusInternalServerError,
+			wantKind: errors.KInternal,
+			want: &errors.ServiceError{
+				StatusCode: http.StatusInternalServerError,
+				Code:       "Internal service error",
+				Message:    "Request aborted due to an internal service error.",
+				Type:       "Kusto.DataNode.Exceptions.KustoDataStreamException",
+				Detail:     "The storage of the streaming ingestion could not be written to.",
+				Permanent:  true,
+			},
+		},
+		{
+			desc:     "Body that is not JSON",
+			fixture:  "bad_gateway.html",
+			status:   http.StatusBadGateway,
+			wantKind: errors.KHTTPError,
+			retry:    true,
+		},
+		{
+			// The request was refused, even if the service did not say so in a OneApiError.
+			desc:     "Truncated JSON body",
+			fixture:  "truncated.json",
+			status:   http.StatusBadRequest,
+			wantKind: errors.KHTTPError,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			body, err := ioutil.ReadFile("testdata/" + test.fixture)
+			require.NoError(t, err)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(ioutil.Discard, r.Body)
+				w.WriteHeader(test.status)
+				_, _ = w.Write(body)
+			}))
+			defer server.Close()
+
+			conn, err := newWithoutValidation(server.URL, kusto.Authorization{})
+			require.NoError(t, err)
+			conn.inTest = true
+			defer conn.Close()
+
+			_, err = conn.StreamIngest(context.Background(), "database", "table", strings.NewReader("a,b\n"), properties.CSV, properties.GZIP, "", nil, "")
+			require.Error(t, err)
+			e := err.(*errors.Error)
+
+			assert.Equal(t, test.wantKind, e.Kind)
+			assert.Equal(t, test.status, e.StatusCode())
+			assert.Equal(t, test.retry, errors.Retry(e))
+			// The raw body is always in the message.
+			assert.Contains(t, e.Error(), strings.TrimSpace(string(body)))
+
+			se, ok := e.ServiceError()
+			if test.want == nil {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			// The context of the error is pinned by the tests of the errors package.
+			se.Context = nil
+			assert.Equal(t, *test.want, se)
+		})
+	}
+}
+
+// recordingTracer records the calls that TraceEnd is called with.
+type recordingTracer struct {
+	mu     sync.Mutex
+	starts int
+	ends   []kusto.TraceCall
+}
+
+func (r *recordingTracer) TraceStart(ctx context.Context, call kusto.TraceCall) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.starts++
+	return ctx
+}
+
+func (r *recordingTracer) TraceEnd(ctx context.Context, call kusto.TraceCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ends = append(r.ends, call)
+}
+
+func TestTracer(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("x-ms-activity-id", "activity")
+		if atomic.AddInt32(&requests, 1) == 2 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":{"code":"TooManyRequests","message":"throttled"}}`))
+		}
+	}))
+	defer server.Close()
+
+	tracer := &recordingTracer{}
+	conn, err := newWithoutValidation(server.URL, kusto.Authorization{}, WithTracer(tracer))
+	require.NoError(t, err)
+	conn.inTest = true
+	defer conn.Close()
+
+	_, err = conn.StreamIngest(context.Background(), "database", "table", strings.NewReader("a,b\n"), properties.CSV, properties.GZIP, "", nil, "request1")
+	require.NoError(t, err)
+	_, err = conn.StreamIngest(context.Background(), "database", "table", strings.NewReader("a,b\n"), properties.CSV, properties.GZIP, "", nil, "request2")
+	require.Error(t, err)
+
+	assert.Equal(t, 2, tracer.starts)
+	require.Len(t, tracer.ends, 2)
+	for i, call := range tracer.ends {
+		assert.Equal(t, errors.OpIngestStream, call.Op)
+		assert.True(t, strings.HasPrefix(call.Endpoint, server.URL+"/v1/rest/ingest/database/table?"), call.Endpoint)
+		assert.Equal(t, fmt.Sprintf("request%d", i+1), call.ClientRequestID)
+		assert.Empty(t, call.CSLHash)
+		assert.Equal(t, "activity", call.ActivityID)
+		assert.Greater(t, int64(call.Duration), int64(0))
+	}
+	assert.Equal(t, http.StatusOK, tracer.ends[0].StatusCode)
+	assert.NoError(t, tracer.ends[0].Err)
+	assert.Equal(t, http.StatusTooManyRequests, tracer.ends[1].StatusCode)
+	assert.Equal(t, err, tracer.ends[1].Err)
+}
+
+func TestSpanTracer(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("x-ms-activity-id", fmt.Sprintf("activity%d", n))
+		if n == 2 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":{"code":"TooManyRequests","message":"throttled"}}`))
+		}
+	}))
+	defer server.Close()
+
+	rec := &trace.Recorder{}
+	conn, err := newWithoutValidation(server.URL, kusto.Authorization{}, WithSpanTracer(rec))
+	require.NoError(t, err)
+	conn.inTest = true
+	defer conn.Close()
+
+	ctx, root := rec.Root(context.Background(), "caller")
+	_, err = conn.StreamIngest(ctx, "database", "table", strings.NewReader("a,b\n"), properties.CSV, properties.GZIP, "", nil, "request1")
+	require.NoError(t, err)
+	_, err = conn.StreamIngest(ctx, "database", "table", strings.NewReader("a,b\n"), properties.CSV, properties.GZIP, "", nil, "request2")
+	require.Error(t, err)
+
+	spans := rec.Named(trace.Stream)
+	require.Len(t, spans, 2)
+	for i, span := range spans {
+		assert.Same(t, root, span.Parent)
+		assert.True(t, span.Ended)
+		assert.Equal(t, "database", span.Attrs[trace.DBNamespace])
+		assert.Equal(t, "table", span.Attrs[trace.DBCollection])
+		assert.Equal(t, http.MethodPost, span.Attrs[trace.HTTPMethod])
+		assert.Equal(t, strings.TrimPrefix(server.URL, "http://"), span.Attrs[trace.ServerAddress])
+		assert.Equal(t, fmt.Sprintf("request%d", i+1), span.Attrs[trace.ClientRequestID])
+		assert.Equal(t, fmt.Sprintf("activity%d", i+1), span.Attrs[trace.ActivityID])
+	}
+	assert.Equal(t, int64(http.StatusOK), spans[0].Attrs[trace.HTTPStatusCode])
+	assert.NoError(t, spans[0].Err)
+	assert.Equal(t, int64(http.StatusTooManyRequests), spans[1].Attrs[trace.HTTPStatusCode])
+	assert.Equal(t, err, spans[1].Err)
+}
+
+func TestContentLength(t *testing.T) {
+	t.Parallel()
+
+	type request struct {
+		length   int64
+		encoding []string
+		body     string
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		requests <- request{length: r.ContentLength, encoding: r.TransferEncoding, body: string(b)}
+	}))
+	defer server.Close()
+
+	conn, err := newWithoutValidation(server.URL, kusto.Authorization{})
+	require.NoError(t, err)
+	conn.inTest = true
+
+	tests := []struct {
+		desc       string
+		payload    io.Reader
+		wantLength int64
+	}{
+		{desc: "Sized", payload: Sized(io.MultiReader(strings.NewReader("a,b\n")), 4), wantLength: 4},
+		{desc: "Buffer", payload: bytes.NewBufferString("a,b\nc,d\n"), wantLength: 8},
+		{desc: "Reader with a length", payload: strings.NewReader("a,b\n"), wantLength: 4},
+		{desc: "Empty", payload: Sized(strings.NewReader(""), 0), wantLength: 0},
+		{desc: "Unknown size", payload: io.MultiReader(strings.NewReader("a,b\n")), wantLength: -1},
+	}
+
+	for _, test := range tests {
+		_, err := conn.StreamIngest(context.Background(), "database", "table", test.payload, properties.CSV, properties.GZIP, "", nil, "")
+		require.NoError(t, err, test.desc)
+		req := <-requests
+		assert.Equal(t, test.wantLength, req.length, test.desc)
+		if test.wantLength >= 0 {
+			assert.Empty(t, req.encoding, test.desc)
+		} else {
+			assert.Equal(t, []string{"chunked"}, req.encoding, test.desc)
+			assert.Equal(t, "a,b\n", req.body, test.desc)
+		}
+	}
+
+	_, err = conn.StreamIngestBlob(context.Background(), "database", "table", "https://account.blob.core.windows.net/container/data.csv?sig=secret", properties.CSV, "", nil, "")
+	require.NoError(t, err)
+	req := <-requests
+	assert.Equal(t, int64(len(req.body)), req.length)
+	assert.Empty(t, req.encoding)
+}
+
+// rotatingTokens is a kusto.TokenProvider whose tokens claim to be valid for an hour, and are numbered in the order
+// they are issued.
+type rotatingTokens struct {
+	mu     sync.Mutex
+	issued int
+}
+
+func (r *rotatingTokens) AcquireToken(ctx context.Context, resource string) (string, time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.issued++
+	return fmt.Sprintf("token-%d", r.issued), time.Now().Add(time.Hour), nil
+}
+
+func TestUnauthorized(t *testing.T) {
+	t.Parallel()
+
+	type request struct {
+		auth string
+		body string
+	}
+	var (
+		mu       sync.Mutex
+		accepted string
+		requests []request
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, request{auth: r.Header.Get("Authorization"), body: string(b)})
+		if r.Header.Get("Authorization") != "Bearer "+accepted {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	// accept makes the service only accept token, as when the ones before it expired or were revoked, and returns
+	// the requests it got since the last call.
+	accept := func(token string) []request {
+		mu.Lock()
+		defer mu.Unlock()
+		got := requests
+		accepted, requests = token, nil
+		return got
+	}
+
+	tokens := &rotatingTokens{}
+	auth := kusto.Authorization{TokenProvider: tokens}
+	require.NoError(t, auth.Validate(server.URL))
+	conn, err := newWithoutValidation(server.URL, auth)
+	require.NoError(t, err)
+
+	stream := func(payload io.Reader) error {
+		_, err := conn.StreamIngest(context.Background(), "database", "table", payload, properties.CSV, properties.GZIP, "", nil, "")
+		return err
+	}
+
+	accept("token-1")
+	require.NoError(t, stream(strings.NewReader("a,b\n")))
+
+	// The token expires while the client runs: the request is sent again, with its body, with a new token.
+	assert.Equal(t, []request{{auth: "Bearer token-1", body: "a,b\n"}}, accept("token-2"))
+	require.NoError(t, stream(Sized(strings.NewReader("c,d\n"), 4)))
+	assert.Equal(t, []request{{auth: "Bearer token-1", body: "c,d\n"}, {auth: "Bearer token-2", body: "c,d\n"}}, accept("token-3"))
+
+	// A payload that cannot be read again fails, and the next request has the new token.
+	err = stream(io.MultiReader(strings.NewReader("e,f\n")))
+	require.Error(t, err)
+	assert.Equal(t, errors.KAuth, errors.KindOf(err))
+	assert.Equal(t, http.StatusUnauthorized, err.(*errors.Error).StatusCode())
+	assert.True(t, errors.Retryable(err), "the request can be sent again with the new token")
+	require.NoError(t, stream(io.MultiReader(strings.NewReader("e,f\n"))))
+	assert.Equal(t, []request{{auth: "Bearer token-2", body: "e,f\n"}, {auth: "Bearer token-3", body: "e,f\n"}}, accept(""))
+
+	// A token that is rejected again is not refreshed in a loop.
+	err = stream(bytes.NewBufferString("g,h\n"))
+	require.Error(t, err)
+	assert.Equal(t, errors.KAuth, errors.KindOf(err))
+	assert.False(t, errors.Retryable(err))
+	assert.Equal(t, []request{{auth: "Bearer token-3", body: "g,h\n"}, {auth: "Bearer token-4", body: "g,h\n"}}, accept(""))
+	assert.Equal(t, 4, tokens.issued)
+}
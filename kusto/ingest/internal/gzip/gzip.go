@@ -4,30 +4,108 @@ package gzip
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"sync"
 	"sync/atomic"
 )
 
-var compressPool = &sync.Pool{
+// compressPools holds a pool of writers for each compression level, from gzip.HuffmanOnly to gzip.BestCompression.
+var compressPools [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+// copySize is the size of the buffers that data is read into before it is compressed, the same as io.Copy() uses.
+const copySize = 32 * 1024
+
+// MinBufferSize and MaxBufferSize are the sizes that a buffer set with NewLevelBuffer() can have.
+const (
+	MinBufferSize = 4 * 1024
+	MaxBufferSize = 4 * 1024 * 1024
+)
+
+// copyPool holds the buffers that data is read into before it is compressed. A buffer goes back to the pool once the
+// data was read to the end or the Streamer was closed, as the gzip writer copies what it compresses.
+var copyPool = sync.Pool{
 	New: func() interface{} {
-		return gzip.NewWriter(nil)
+		b := make([]byte, copySize)
+		return &b
 	},
 }
 
+// sizedPools holds the pools of the buffers of the sizes set with NewLevelBuffer() besides copySize, by size.
+var sizedPools sync.Map // map[int]*sync.Pool
+
+// bufferPool returns the pool of the buffers of size bytes.
+func bufferPool(size int) *sync.Pool {
+	if size == 0 || size == copySize {
+		return &copyPool
+	}
+	if pool, ok := sizedPools.Load(size); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := sizedPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		},
+	})
+	return pool.(*sync.Pool)
+}
+
+func init() {
+	for i := range compressPools {
+		level := i + gzip.HuffmanOnly
+		compressPools[i].New = func() interface{} {
+			zw, _ := gzip.NewWriterLevel(nil, level)
+			return zw
+		}
+	}
+}
+
+// ValidateLevel returns an error if level is not a compression level accepted by compress/gzip.
+func ValidateLevel(level int) error {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("compression level %d is not between %d and %d", level, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	return nil
+}
+
+// ValidateBufferSize returns an error if size is not 0, for the default, or between MinBufferSize and MaxBufferSize.
+func ValidateBufferSize(size int) error {
+	if size != 0 && (size < MinBufferSize || size > MaxBufferSize) {
+		return fmt.Errorf("buffer size %d is not between %d and %d", size, MinBufferSize, MaxBufferSize)
+	}
+	return nil
+}
+
 // Streamer implements an io.ReadCloser that converts data from a non-compressed stream to a compressed stream.
+// The data is compressed while it is read, without being buffered in full. If reading the non-compressed stream
+// fails, Read() returns that error instead of io.EOF, so a truncated stream is never mistaken for a complete one.
 type Streamer struct {
 	userInput   io.ReadCloser
 	outputRead  *io.PipeReader
 	outputWrite *io.PipeWriter
 	size        int64
+	level       int
+	bufferSize  int
 	err         atomic.Value // holds error
 }
 
-// New creates a new streamer object. Use Reset() to initialize it.
+// New creates a new streamer object that compresses with the default level. Use Reset() to initialize it.
 func New() *Streamer {
-	return &Streamer{}
+	return &Streamer{level: gzip.DefaultCompression}
+}
+
+// NewLevel is like New, but compresses with level, which must be valid according to ValidateLevel().
+func NewLevel(level int) *Streamer {
+	return &Streamer{level: level}
+}
+
+// NewLevelBuffer is like NewLevel, but reads the data in chunks of bufferSize bytes before it compresses them, which
+// must be valid according to ValidateBufferSize(). Larger chunks make fewer calls to the compressor for fast readers.
+// The buffers are pooled by size.
+func NewLevelBuffer(level, bufferSize int) *Streamer {
+	return &Streamer{level: level, bufferSize: bufferSize}
 }
 
 // Reset resets the streamer object to defaults and accepts the io.ReadCloser.
@@ -47,13 +125,26 @@ func (s *Streamer) InputSize() int64 {
 	return atomic.LoadInt64(&s.size)
 }
 
-func Compress(payload io.Reader) io.Reader {
+// Compress returns a reader of payload compressed with the default level.
+// Close it if it may not be read to the end, see Streamer.Close().
+func Compress(payload io.Reader) *Streamer {
+	return CompressLevel(payload, gzip.DefaultCompression)
+}
+
+// CompressLevel returns a reader of payload compressed with level, which must be valid according to ValidateLevel().
+// Close it if it may not be read to the end, see Streamer.Close().
+func CompressLevel(payload io.Reader, level int) *Streamer {
+	return CompressLevelBuffer(payload, level, 0)
+}
+
+// CompressLevelBuffer is like CompressLevel, but with the buffer size of NewLevelBuffer(), 0 for the default.
+func CompressLevelBuffer(payload io.Reader, level, bufferSize int) *Streamer {
 	var closer io.ReadCloser
 	var ok bool
 	if closer, ok = payload.(io.ReadCloser); !ok {
 		closer = ioutil.NopCloser(payload)
 	}
-	zw := New()
+	zw := NewLevelBuffer(level, bufferSize)
 	zw.Reset(closer)
 
 	return zw
@@ -61,19 +152,28 @@ func Compress(payload io.Reader) io.Reader {
 
 // run copies the file into a buffer that we stream back via our Read() call.
 func (s *Streamer) run() {
-	zw := compressPool.Get().(*gzip.Writer)
+	pool := &compressPools[s.level-gzip.HuffmanOnly]
+	zw := pool.Get().(*gzip.Writer)
 	zw.Reset(s.outputWrite)
 
+	buffers := bufferPool(s.bufferSize)
 	go func() {
-		defer compressPool.Put(zw)
-		defer s.outputWrite.Close()
-		defer zw.Close()
-		defer zw.Flush()
+		defer pool.Put(zw)
+		buf := buffers.Get().(*[]byte)
+		defer buffers.Put(buf)
 
-		_, err := io.Copy(zw, s.userInput)
+		_, err := io.CopyBuffer(zw, s.userInput, *buf)
+		if err == nil {
+			err = zw.Close()
+		}
 		if err != nil {
+			// The reader gets err instead of io.EOF. If the reader closed the Streamer, the writes above failed
+			// and this returns right away.
 			s.err.Store(err)
+			s.outputWrite.CloseWithError(err)
+			return
 		}
+		s.outputWrite.Close()
 	}()
 }
 
@@ -84,7 +184,9 @@ func (s *Streamer) Read(b []byte) (int, error) {
 	return amount, err
 }
 
-// Close implements io.Closer.
+// Close implements io.Closer. The gzip writer of the Streamer goes back to its pool once the compressed data was read
+// to the end or the Streamer was closed, so a Streamer that may not be read to the end, such as the body of a
+// request that can fail, must be closed. Close can be called after the data was read to the end.
 func (s *Streamer) Close() error {
 	return s.outputRead.Close()
 }
@@ -3,11 +3,17 @@ package gzip
 import (
 	"bytes"
 	"compress/gzip"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -62,3 +68,295 @@ func TestStreamer(t *testing.T) {
 		t.Fatalf("TestStreamer(input/output comparison): after compression/decompression the data was not the same")
 	}
 }
+
+func TestCompressLevel(t *testing.T) {
+	t.Parallel()
+
+	// Repeated words compress well enough for the levels to differ.
+	var b strings.Builder
+	for b.Len() < 1024*1024 {
+		b.WriteString(randStringBytes(8))
+		b.WriteString(" kusto ingestion payload\n")
+	}
+	str := b.String()
+
+	sizes := map[int]int{}
+	for level := gzip.HuffmanOnly; level <= gzip.BestCompression; level++ {
+		compressed, err := ioutil.ReadAll(CompressLevel(strings.NewReader(str), level))
+		if err != nil {
+			t.Fatalf("TestCompressLevel(%d): got err == %s, want err == nil", level, err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("TestCompressLevel(%d): gzip.NewReader() got err == %s, want err == nil", level, err)
+		}
+		got, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("TestCompressLevel(%d): decompressing got err == %s, want err == nil", level, err)
+		}
+		if string(got) != str {
+			t.Fatalf("TestCompressLevel(%d): after compression/decompression the data was not the same", level)
+		}
+		sizes[level] = len(compressed)
+	}
+
+	if sizes[gzip.BestCompression] >= sizes[gzip.BestSpeed] {
+		t.Errorf("TestCompressLevel: BestCompression gave %d bytes, want less than the %d of BestSpeed", sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+	}
+	if sizes[gzip.NoCompression] <= len(str) {
+		t.Errorf("TestCompressLevel: NoCompression gave %d bytes, want more than the %d of the input", sizes[gzip.NoCompression], len(str))
+	}
+}
+
+func TestValidateLevel(t *testing.T) {
+	t.Parallel()
+
+	for _, level := range []int{gzip.HuffmanOnly, gzip.DefaultCompression, gzip.NoCompression, gzip.BestSpeed, gzip.BestCompression} {
+		if err := ValidateLevel(level); err != nil {
+			t.Errorf("TestValidateLevel(%d): got err == %s, want err == nil", level, err)
+		}
+	}
+	for _, level := range []int{gzip.HuffmanOnly - 1, gzip.BestCompression + 1} {
+		if err := ValidateLevel(level); err == nil {
+			t.Errorf("TestValidateLevel(%d): got err == nil, want err != nil", level)
+		}
+	}
+}
+
+func TestCompressLevelBuffer(t *testing.T) {
+	t.Parallel()
+
+	str := randStringBytes(256*1024 + 7)
+	for _, size := range []int{0, MinBufferSize, copySize, 100 * 1024, MaxBufferSize} {
+		compressed, err := ioutil.ReadAll(CompressLevelBuffer(strings.NewReader(str), gzip.BestSpeed, size))
+		if err != nil {
+			t.Fatalf("TestCompressLevelBuffer(%d): got err == %s, want err == nil", size, err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("TestCompressLevelBuffer(%d): gzip.NewReader() got err == %s, want err == nil", size, err)
+		}
+		got, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("TestCompressLevelBuffer(%d): decompressing got err == %s, want err == nil", size, err)
+		}
+		if string(got) != str {
+			t.Fatalf("TestCompressLevelBuffer(%d): after compression/decompression the data was not the same", size)
+		}
+	}
+
+	if bufferPool(0) != bufferPool(copySize) || bufferPool(MinBufferSize) != bufferPool(MinBufferSize) {
+		t.Errorf("TestCompressLevelBuffer: the buffers of a size should share a pool")
+	}
+	if b := bufferPool(MinBufferSize).Get().(*[]byte); len(*b) != MinBufferSize {
+		t.Errorf("TestCompressLevelBuffer: got a buffer of %d bytes, want %d", len(*b), MinBufferSize)
+	}
+}
+
+func TestValidateBufferSize(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{0, MinBufferSize, MaxBufferSize} {
+		if err := ValidateBufferSize(size); err != nil {
+			t.Errorf("TestValidateBufferSize(%d): got err == %s, want err == nil", size, err)
+		}
+	}
+	for _, size := range []int{-1, 1, MinBufferSize - 1, MaxBufferSize + 1} {
+		if err := ValidateBufferSize(size); err == nil {
+			t.Errorf("TestValidateBufferSize(%d): got err == nil, want err != nil", size)
+		}
+	}
+}
+
+// jsonLines returns about size bytes of JSON lines like telemetry events, with repeated keys and varied values.
+func jsonLines(size int) string {
+	var sb strings.Builder
+	for i := 0; sb.Len() < size; i++ {
+		fmt.Fprintf(&sb, `{"timestamp":"2023-01-%02dT%02d:%02d:%02d.%03dZ","deviceId":"device-%04d","level":"info","message":"reading %s","temperature":%d.%d,"tags":["kusto","ingestion"]}`+"\n",
+			i%28+1, i%24, i%60, (i*7)%60, i%1000, i%500, randStringBytes(6), 15+i%20, i%10)
+	}
+	return sb.String()
+}
+
+// BenchmarkCompressLevelJSON compares the levels on JSON lines, the ratio being the size compressed over the size of
+// the data, and the buffer sizes at the default level.
+func BenchmarkCompressLevelJSON(b *testing.B) {
+	str := jsonLines(4 * 1024 * 1024)
+
+	bench := func(level, bufferSize int) func(b *testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(str)))
+			var size int64
+			for i := 0; i < b.N; i++ {
+				n, err := io.Copy(ioutil.Discard, CompressLevelBuffer(strings.NewReader(str), level, bufferSize))
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = n
+			}
+			b.ReportMetric(float64(size)/float64(len(str)), "ratio")
+		}
+	}
+
+	for _, level := range []struct {
+		name  string
+		level int
+	}{{"BestSpeed", gzip.BestSpeed}, {"Default", gzip.DefaultCompression}, {"BestCompression", gzip.BestCompression}} {
+		b.Run(level.name, bench(level.level, 0))
+	}
+	for _, size := range []int{MinBufferSize, copySize, 256 * 1024, MaxBufferSize} {
+		b.Run("Buffer"+strconv.Itoa(size), bench(gzip.DefaultCompression, size))
+	}
+}
+
+func BenchmarkCompressLevel(b *testing.B) {
+	var sb strings.Builder
+	for sb.Len() < 4*1024*1024 {
+		sb.WriteString(randStringBytes(8))
+		sb.WriteString(",kusto,ingestion,payload\n")
+	}
+	str := sb.String()
+
+	for _, level := range []int{gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		b.Run(strconv.Itoa(level), func(b *testing.B) {
+			b.SetBytes(int64(len(str)))
+			var size int64
+			for i := 0; i < b.N; i++ {
+				n, err := io.Copy(ioutil.Discard, CompressLevel(strings.NewReader(str), level))
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = n
+			}
+			b.ReportMetric(float64(size)/float64(len(str)), "ratio")
+		})
+	}
+}
+
+func TestStreamerConcurrent(t *testing.T) {
+	t.Parallel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			str := randStringBytes(64*1024 + i)
+			zr := Compress(strings.NewReader(str))
+			defer zr.Close()
+
+			// Every other reader is abandoned part way, as when a request fails, which returns its writer early.
+			if i%2 == 1 {
+				_, err := io.CopyN(ioutil.Discard, zr, 10)
+				if err != nil {
+					errs <- err
+				}
+				return
+			}
+
+			r, err := gzip.NewReader(zr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(got) != str {
+				errs <- fmt.Errorf("reader %d: after compression/decompression the data was not the same", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("TestStreamerConcurrent: got err == %s, want err == nil", err)
+	}
+}
+
+func TestStreamerCloseEarly(t *testing.T) {
+	// Not parallel, as it counts goroutines.
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		zr := Compress(strings.NewReader(randStringBytes(1024 * 1024)))
+		if _, err := io.CopyN(ioutil.Discard, zr, 10); err != nil {
+			t.Fatalf("TestStreamerCloseEarly: got err == %s, want err == nil", err)
+		}
+		zr.Close()
+	}
+
+	// The compressing goroutines stop, returning their writers to the pool, once their Streamer is closed.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("TestStreamerCloseEarly: got %d goroutines after closing, want %d as before", after, before)
+	}
+}
+
+// failingReader returns size bytes and then fails with err.
+type failingReader struct {
+	size int
+	err  error
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	if f.size == 0 {
+		return 0, f.err
+	}
+	if len(b) > f.size {
+		b = b[:f.size]
+	}
+	f.size -= len(b)
+	return len(b), nil
+}
+
+func TestStreamerReadError(t *testing.T) {
+	t.Parallel()
+
+	want := fmt.Errorf("disk failure")
+	zr := Compress(&failingReader{size: 1024 * 1024, err: want})
+	defer zr.Close()
+
+	_, err := io.Copy(ioutil.Discard, zr)
+	if err != want {
+		t.Errorf("TestStreamerReadError: got err == %v, want err == %s", err, want)
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	str := randStringBytes(64 * 1024)
+
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(str)))
+		for i := 0; i < b.N; i++ {
+			if _, err := io.Copy(ioutil.Discard, Compress(strings.NewReader(str))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// A new writer for each payload, as done before the writers were pooled.
+	b.Run("Unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(str)))
+		for i := 0; i < b.N; i++ {
+			zw := gzip.NewWriter(ioutil.Discard)
+			if _, err := io.Copy(zw, strings.NewReader(str)); err != nil {
+				b.Fatal(err)
+			}
+			if err := zw.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package properties
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// ByteCounts counts the bytes an ingestion read from its source and the bytes it sent to the service. It is held by
+// pointer in SourceOptions, so all copies of the properties of an ingestion update the same counts.
+// A nil *ByteCounts is valid and counts nothing. Methods are safe for concurrent use.
+type ByteCounts struct {
+	read     int64
+	uploaded int64
+}
+
+// CountRead returns a reader that adds what is read from r to Read().
+func (c *ByteCounts) CountRead(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return &countingReader{r: r, n: &c.read}
+}
+
+// CountUploaded returns a reader that adds what is read from r to Uploaded().
+func (c *ByteCounts) CountUploaded(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return &countingReader{r: r, n: &c.uploaded}
+}
+
+// Add adds to the counts, for transfers that don't go through a counting reader.
+func (c *ByteCounts) Add(read, uploaded int64) {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.read, read)
+	atomic.AddInt64(&c.uploaded, uploaded)
+}
+
+// Read is the number of bytes read from the source, before compression.
+func (c *ByteCounts) Read() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+// Uploaded is the number of bytes sent to the service, after compression.
+func (c *ByteCounts) Uploaded() int64 {
+	return atomic.LoadInt64(&c.uploaded)
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+// Read implements io.Reader.
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -3,6 +3,7 @@
 package properties
 
 import (
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -13,7 +14,7 @@ import (
 	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
-	"github.com/cenkalti/backoff/v4"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/retry"
 	"github.com/google/uuid"
 )
 
@@ -23,6 +24,8 @@ type CompressionType int8
 // String implements fmt.Stringer.
 func (c CompressionType) String() string {
 	switch c {
+	case CTNone:
+		return "none"
 	case GZIP:
 		return "gzip"
 	case ZIP:
@@ -69,9 +72,10 @@ const (
 	// CSV indicates the source is encoded in comma seperated values.
 	CSV DataFormat = 3
 	// JSON indicates the source is encoded as one or more lines, each containing a record in Javascript Object Notation.
+	// A record may not span more than one line.
 	JSON DataFormat = 4
 	// MultiJSON indicates the source is encoded in JSON-Array of individual records in Javascript Object Notation. Optionally,
-	//multiple documents can be concatenated.
+	// multiple documents can be concatenated, and records may span lines. This is the format detected for ".json" files.
 	MultiJSON DataFormat = 5
 	// ORC indicates the source is encoded in Apache Optimized Row Columnar format.
 	ORC DataFormat = 6
@@ -85,7 +89,8 @@ const (
 	SCSV DataFormat = 10
 	// SOHSV is a file containing SOH-separated values(ASCII codepoint 1).
 	SOHSV DataFormat = 11
-	// SStream indicats the source is encoded as a Microsoft Cosmos Structured Streams format
+	// SStream indicats the source is encoded as a Microsoft Cosmos Structured Streams format. It can only be ingested
+	// with queued ingestion.
 	SStream DataFormat = 12
 	// TSV is a file containing tab seperated values ("\t").
 	TSV DataFormat = 13
@@ -93,7 +98,8 @@ const (
 	TSVE DataFormat = 14
 	// TXT is a text file with lines delimited by "\n".
 	TXT DataFormat = 15
-	// W3CLogFile indicates the source is encoded using W3C Extended Log File format.
+	// W3CLogFile indicates the source is encoded using W3C Extended Log File format. This is the format detected for
+	// ".log" files.
 	W3CLogFile DataFormat = 16
 	// SingleJSON indicates the source is a single JSON value -- newlines are regular whitespace.
 	SingleJSON DataFormat = 17
@@ -102,29 +108,34 @@ const (
 type dfDescriptor struct {
 	camelName        string
 	jsonName         string
-	detectableExt    string
+	detectableExts   []string
 	validMappingKind bool
+	// compressible is if the client compresses data of the format with gzip. ApacheAvro and SStream data is compressed
+	// internally, so it is sent as it is.
+	compressible bool
+	// streamable is if the streaming ingestion endpoint takes data of the format, which otherwise must be queued.
+	streamable bool
 }
 
 var dfDescriptions = []dfDescriptor{
-	{"", "", "", false},
-	{"Avro", "avro", ".avro", true},
-	{"ApacheAvro", "avro", "", false},
-	{"Csv", "csv", ".csv", true},
-	{"Json", "json", ".json", true},
-	{"MultiJson", "multijson", "", false},
-	{"Orc", "orc", ".orc", true},
-	{"Parquet", "parquet", ".parquet", true},
-	{"Psv", "psv", ".psv", false},
-	{"Raw", "raw", ".raw", false},
-	{"Scsv", "scsv", ".scsv", false},
-	{"Sohsv", "sohsv", ".sohsv", false},
-	{"SStream", "sstream", ".ss", false},
-	{"Tsv", "tsv", ".tsv", false},
-	{"Tsve", "tsve", ".tsve", false},
-	{"Txt", "txt", ".txt", false},
-	{"W3cLogFile", "w3clogfile", ".w3clogfile", false},
-	{"SingleJson", "singlejson", "", false},
+	{"", "", nil, false, true, true},
+	{"Avro", "avro", []string{".avro"}, true, true, true},
+	{"ApacheAvro", "apacheavro", nil, false, false, true},
+	{"Csv", "csv", []string{".csv"}, true, true, true},
+	{"Json", "json", nil, true, true, true},
+	{"MultiJson", "multijson", []string{".json"}, false, true, true},
+	{"Orc", "orc", []string{".orc"}, true, true, true},
+	{"Parquet", "parquet", []string{".parquet"}, true, true, true},
+	{"Psv", "psv", []string{".psv"}, false, true, true},
+	{"Raw", "raw", []string{".raw"}, false, true, true},
+	{"Scsv", "scsv", []string{".scsv"}, false, true, true},
+	{"Sohsv", "sohsv", []string{".sohsv"}, false, true, true},
+	{"SStream", "sstream", []string{".ss"}, false, false, false},
+	{"Tsv", "tsv", []string{".tsv"}, false, true, true},
+	{"Tsve", "tsve", []string{".tsve"}, false, true, true},
+	{"Txt", "txt", []string{".txt"}, false, true, true},
+	{"W3cLogFile", "w3clogfile", []string{".w3clogfile", ".log"}, true, true, true},
+	{"SingleJson", "singlejson", nil, false, true, true},
 }
 
 // IngestionReportLevel defines which ingestion statuses are reported by the DM.
@@ -174,6 +185,29 @@ func (d DataFormat) CamelCase() string {
 	return ""
 }
 
+// dfAliases are the names that ParseDataFormat takes for formats besides the names the service uses.
+var dfAliases = map[string]DataFormat{
+	"jsonl":  MultiJSON,
+	"ndjson": MultiJSON,
+	"text":   TXT,
+}
+
+// ParseDataFormat returns the DataFormat named s. s is the name the service uses for the format, as String() returns
+// it, such as "csv" or "multijson", or one of the aliases "jsonl" and "ndjson" for MultiJSON and "text" for TXT.
+// Case is ignored, so the CamelCase names are taken too.
+func ParseDataFormat(s string) (DataFormat, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for i := 1; i < len(dfDescriptions); i++ {
+		if name == dfDescriptions[i].jsonName {
+			return DataFormat(i), nil
+		}
+	}
+	if d, ok := dfAliases[name]; ok {
+		return d, nil
+	}
+	return DFUnknown, errors.ES(errors.OpUnknown, errors.KClientArgs, "%q is not a data format", s).SetNoRetry()
+}
+
 // MarshalJSON implements json.Marshaler.MarshalJSON.
 func (d DataFormat) MarshalJSON() ([]byte, error) {
 	if d == 0 {
@@ -183,6 +217,39 @@ func (d DataFormat) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("%q", d.String())), nil
 }
 
+// UnmarshalJSON implements json.Unmarshaler.UnmarshalJSON. It takes the names ParseDataFormat takes.
+func (d *DataFormat) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("DataFormat must be a JSON string: %w", err)
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// MarshalText implements encoding.TextMarshaler.MarshalText, so that a DataFormat can be a value or a key in
+// configuration files of any encoding.
+func (d DataFormat) MarshalText() ([]byte, error) {
+	if d <= 0 || int(d) >= len(dfDescriptions) {
+		return nil, fmt.Errorf("DataFormat is an invalid encoding type")
+	}
+
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.UnmarshalText. It takes the names ParseDataFormat takes.
+func (d *DataFormat) UnmarshalText(b []byte) error {
+	f, err := ParseDataFormat(string(b))
+	if err != nil {
+		return err
+	}
+	*d = f
+	return nil
+}
+
 // IsValidMappingKind returns true if a dataformat can be used as a MappingKind.
 func (d DataFormat) IsValidMappingKind() bool {
 	if d > 0 && int(d) < len(dfDescriptions) {
@@ -192,6 +259,47 @@ func (d DataFormat) IsValidMappingKind() bool {
 	return false
 }
 
+// MappingKind returns the kind of ingestion mapping that data of this format is mapped with, or DFUnknown if the
+// format is not mapped with any of the supported kinds.
+func (d DataFormat) MappingKind() DataFormat {
+	switch d {
+	case CSV, PSV, SCSV, SOHSV, TSV, TSVE, TXT, Raw:
+		return CSV
+	case JSON, MultiJSON, SingleJSON:
+		return JSON
+	case AVRO, ApacheAVRO:
+		return AVRO
+	case ORC, Parquet, W3CLogFile:
+		return d
+	}
+	return DFUnknown
+}
+
+// IsCompressible returns true if the client compresses data of this format with gzip before sending it. ApacheAvro
+// and SStream data is compressed internally, so it is sent as it is.
+func (d DataFormat) IsCompressible() bool {
+	if d >= 0 && int(d) < len(dfDescriptions) {
+		return dfDescriptions[d].compressible
+	}
+
+	return true
+}
+
+// IsStreamable returns true if data of this format can be sent with streaming ingestion. SStream data can only be
+// queued.
+func (d DataFormat) IsStreamable() bool {
+	if d >= 0 && int(d) < len(dfDescriptions) {
+		return dfDescriptions[d].streamable
+	}
+
+	return false
+}
+
+// RequiresStreamingMapping returns true if streaming data of this format needs a reference to an ingestion mapping.
+func (d DataFormat) RequiresStreamingMapping() bool {
+	return d.MappingKind() == JSON || d.MappingKind() == AVRO
+}
+
 // DataFormatDiscovery looks at the file name and tries to discern what the file format is.
 func DataFormatDiscovery(fName string) DataFormat {
 	name := fName
@@ -208,8 +316,10 @@ func DataFormatDiscovery(fName string) DataFormat {
 	}
 
 	for i := 1; i < len(dfDescriptions); i++ {
-		if ext == dfDescriptions[i].detectableExt {
-			return DataFormat(i)
+		for _, e := range dfDescriptions[i].detectableExts {
+			if ext == e {
+				return DataFormat(i)
+			}
 		}
 	}
 
@@ -230,14 +340,19 @@ type All struct {
 
 // ManagedStreaming provides options that are used when doing an ingestion from a ManagedStreaming client.
 type ManagedStreaming struct {
-	// Backoff is the backoff strategy to use when retrying a transiently failed ingestion.
-	Backoff backoff.BackOff
+	// Retry is how a transiently failed streaming ingestion is retried before falling back to queued ingestion.
+	Retry retry.Policy
 }
 
 // Streaming provides options that are used when doing an ingestion from a stream.
 type Streaming struct {
 	// ClientRequestID is the client request ID to use for the ingestion.
 	ClientRequestId string
+	// MaxPayloadSize is the largest payload, after compression, that is sent. 0 means the default streaming limit.
+	MaxPayloadSize int64
+	// MaxBufferedSize is the largest source of known size, before compression, that is compressed in memory before it
+	// is sent, for the request to have a Content-Length. 0 means the default, and a negative size none.
+	MaxBufferedSize int64
 }
 
 // SourceOptions are options that the user provides about the source file that is going to be uploaded.
@@ -249,11 +364,46 @@ type SourceOptions struct {
 	// DeleteLocalSource indicates to delete the local file after it has been consumed.
 	DeleteLocalSource bool
 
+	// DeleteBlobOnEnqueueFailure indicates to delete the blob the data was staged in if it could not be queued for
+	// ingestion, instead of keeping it to be queued again.
+	DeleteBlobOnEnqueueFailure bool
+
 	// DontCompress indicates to not compress the file.
 	DontCompress bool
 
+	// Compression is the compression of the source, as set with the Compression() option or found from the name of
+	// the source. CTUnknown is a source that is taken as not compressed.
+	Compression CompressionType
+
+	// CompressionLevel is the gzip level the client compresses the data with, if CompressionLevelSet is true.
+	// Otherwise the default level is used.
+	CompressionLevel    int
+	CompressionLevelSet bool
+
 	// OriginalSource is the path to the original source file, used for deletion.
 	OriginalSource string
+
+	// BlobNameHint is added to the name of the blob that the data is staged in, once made safe for blob names.
+	BlobNameHint string
+
+	// BlobMetadata is the metadata of the blob that the data is staged in.
+	BlobMetadata map[string]string
+
+	// BlobTier is the access tier of the blob that the data is staged in, "" for the default tier of the account.
+	BlobTier string
+
+	// SplitSize is the size in bytes after which FromRowIterator() stages a new blob. 0 means no splitting.
+	SplitSize int64
+
+	// ValidateTarget indicates to check that the table and mapping reference exist before staging the data.
+	ValidateTarget bool
+
+	// SkipIfAlreadySucceeded indicates to not ingest the data if the status table says that an ingestion with the
+	// same ID succeeded.
+	SkipIfAlreadySucceeded bool
+
+	// Counts, if set, collects the number of bytes read from the source and uploaded.
+	Counts *ByteCounts
 }
 
 // Ingestion is a JSON serializable set of options that must be provided to the service.
@@ -266,27 +416,30 @@ type Ingestion struct {
 	DatabaseName string
 	// TableName is the name of the Kusto table the the data will ingest into.
 	TableName string
-	// RawDataSize is the size of the file on the filesystem, if it was provided.
-	RawDataSize int64 `json:",omitempty"`
-	// RetainBlobOnSuccess indicates if the source blob should be retained or deleted.
-	RetainBlobOnSuccess bool `json:",omitempty"`
+	// RawDataSize is the size of the file on the filesystem, or 0 if it is not known.
+	RawDataSize int64
+	// RetainBlobOnSuccess indicates if the source blob should be retained or deleted. The service has its own default
+	// for a message without it, so it is always sent.
+	RetainBlobOnSuccess bool
 	// Daniel:
 	// FlushImmediately ... I know what flushing means, but in terms of here, do we not return until the Kusto
 	// table is updated, does this mean we do....  This is really a duplicate comment on the options in ingest.go
-	FlushImmediately bool
+	FlushImmediately bool `json:",omitempty"`
 	// Daniel:
 	// IgnoreSizeLimit
 	IgnoreSizeLimit bool `json:",omitempty"`
-	// ReportLevel defines which if any ingestion states are reported.
-	ReportLevel IngestionReportLevel `json:",omitempty"`
-	// ReportMethod defines which mechanisms are used to report the ingestion status.
-	ReportMethod IngestionReportMethod `json:",omitempty"`
+	// ReportLevel defines which if any ingestion states are reported. It is sent even when it is FailuresOnly (0).
+	ReportLevel IngestionReportLevel
+	// ReportMethod defines which mechanisms are used to report the ingestion status. It is sent even when it is
+	// ReportStatusToQueue (0).
+	ReportMethod IngestionReportMethod
 	// SourceMessageCreationTime is when we created the blob.
-	SourceMessageCreationTime time.Time `json:",omitempty"`
+	SourceMessageCreationTime time.Time
 	// Additional (properties) is a set of extra properties added to the ingestion command.
 	Additional Additional `json:"AdditionalProperties"`
-	// TableEntryRef points to the staus table entry used to report the status of this ingestion.
-	TableEntryRef StatusTableDescription `json:"IngestionStatusInTable,omitempty"`
+	// TableEntryRef points to the staus table entry used to report the status of this ingestion, if it is reported
+	// to a table.
+	TableEntryRef *StatusTableDescription `json:"IngestionStatusInTable,omitempty"`
 }
 
 // Additional is additional properites.
@@ -302,16 +455,42 @@ type Additional struct {
 	// IngestionMappingType is what the mapping reference is encoded in: csv, json, avro, ...
 	IngestionMappingType DataFormat `json:"ingestionMappingType,omitempty"`
 	// ValidationPolicy is a JSON encoded string that tells our ingestion action what policies we want on the
-	// data being ingested and what to do when that is violated.
+	// data being ingested and what to do when that is violated. It is sent as a JSON object.
 	ValidationPolicy string     `json:"validationPolicy,omitempty"`
 	Format           DataFormat `json:"format,omitempty"`
-	// Tags is a list of tags to associated with the ingested data.
+	// Tags is a list of tags to associated with the ingested data. It is sent as a string of a JSON array.
 	Tags []string `json:"tags,omitempty"`
 	// IngestIfNotExists is a string value that, if specified, prevents ingestion from succeeding if the table already
 	// has data tagged with an ingest-by: tag with the same value. This ensures idempotent data ingestion.
+	// It is sent as a string of a JSON array of the tag.
 	IngestIfNotExists string `json:"ingestIfNotExists,omitempty"`
 	// CreationTime is used to override the time considered for retantion policies, which by default is the time of ingestion.
 	CreationTime time.Time `json:"creationTime,omitempty"`
+	// Extra are properties that the SDK has no field for, which are sent as they are. The fields above win over them.
+	Extra map[string]string `json:"-"`
+}
+
+// managedAdditional are the keys of the additional properties and streaming query parameters that the SDK sets itself.
+var managedAdditional = []string{
+	"authorizationContext",
+	"format",
+	"ingestionMapping",
+	"ingestionMappingReference",
+	"ingestionMappingType",
+	"streamFormat",
+	"mappingName",
+	"sourceKind",
+}
+
+// IsManagedAdditional reports if key, in any case, is an additional property or a streaming query parameter that the
+// SDK sets itself, so it cannot be set in Additional.Extra.
+func IsManagedAdditional(key string) bool {
+	for _, k := range managedAdditional {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
 }
 
 // StatusTableDescription is a reference to the table status entry used for this ingestion command.
@@ -324,17 +503,54 @@ type StatusTableDescription struct {
 	RowKey string `json:",omitempty"`
 }
 
+// GzipLevel returns the gzip level the client compresses the data with.
+func (s SourceOptions) GzipLevel() int {
+	if !s.CompressionLevelSet {
+		return gzip.DefaultCompression
+	}
+	return s.CompressionLevel
+}
+
+// Compressed reports if the source is compressed already, so it is sent as it is.
+func (s SourceOptions) Compressed() bool {
+	return s.Compression == GZIP || s.Compression == ZIP
+}
+
+// ShouldCompress reports if the client compresses the source with gzip before sending it.
+func (s SourceOptions) ShouldCompress() bool {
+	return !s.Compressed() && !s.DontCompress
+}
+
+// ShouldCompress reports if the client compresses the source with gzip before sending it. Unlike
+// SourceOptions.ShouldCompress, it takes the format into account, as ApacheAvro and SStream data is not compressed.
+func (p *All) ShouldCompress() bool {
+	return p.Source.ShouldCompress() && p.Ingestion.Additional.Format.IsCompressible()
+}
+
+// SentCompression returns the compression of the data that the client sends for the source.
+func (p *All) SentCompression() CompressionType {
+	switch {
+	case p.Source.Compressed():
+		return p.Source.Compression
+	case !p.ShouldCompress():
+		return CTNone
+	}
+	return GZIP
+}
+
 func (p *All) ApplyDeleteLocalSourceOption() error {
 	if p.Source.DeleteLocalSource && p.Source.OriginalSource != "" {
 		if err := os.Remove(p.Source.OriginalSource); err != nil {
-			return errors.ES(errors.OpFileIngest, errors.KLocalFileSystem, "file was uploaded successfully, but we could not delete the local file: %s",
-				err).SetNoRetry()
+			return errors.E(errors.OpFileIngest, errors.KLocalFileSystem, fmt.Errorf("file was uploaded successfully, but we could not delete the local file: %w",
+				err)).SetNoRetry()
 		}
 	}
 	return nil
 }
 
 // MarshalJSON implements json.Marshaller. This is for use only by the SDK and may be removed at any time.
+// Fields that are not set are left out, as the service treats an empty value differently from a missing one. The
+// keys are in sorted order, so the same properties always give the same message.
 func (a Additional) MarshalJSON() ([]byte, error) {
 	// TODO(daniel): Have the backend fixed.
 	// OK: This is here because in .Net DataFormat and IngestionMappingType are two different enumerators.
@@ -342,25 +558,63 @@ func (a Additional) MarshalJSON() ([]byte, error) {
 	// So you must use "csv" and "Csv". For the moment, until we can get a backend change, we have to encode these
 	// differently. I don't want to have two enumerators for the same thing, so I've done this hack to get around it.
 
-	type additional2 Additional
-
-	b, err := json.Marshal(additional2(a))
-	if err != nil {
-		return nil, err
+	m := map[string]interface{}{}
+	for k, v := range map[string]string{
+		"authorizationContext":      a.AuthContext,
+		"ingestionMapping":          a.IngestionMapping,
+		"ingestionMappingReference": a.IngestionMappingRef,
+		"ingestionMappingType":      a.IngestionMappingType.CamelCase(),
+		"format":                    a.Format.String(),
+	} {
+		if v != "" {
+			m[k] = v
+		}
 	}
 
-	m := map[string]interface{}{}
-	if err := json.Unmarshal(b, &m); err != nil {
-		return nil, err
+	if a.ValidationPolicy != "" {
+		if !json.Valid([]byte(a.ValidationPolicy)) {
+			return nil, fmt.Errorf("the validation policy is not valid JSON: %s", a.ValidationPolicy)
+		}
+		m["validationPolicy"] = json.RawMessage(a.ValidationPolicy)
+	}
+	// The service takes lists of tags as strings of JSON arrays.
+	if len(a.Tags) > 0 {
+		b, err := json.Marshal(a.Tags)
+		if err != nil {
+			return nil, err
+		}
+		m["tags"] = string(b)
+	}
+	if a.IngestIfNotExists != "" {
+		b, err := json.Marshal([]string{a.IngestIfNotExists})
+		if err != nil {
+			return nil, err
+		}
+		m["ingestIfNotExists"] = string(b)
+	}
+	if !a.CreationTime.IsZero() {
+		m["creationTime"] = a.CreationTime
 	}
 
-	if _, ok := m["ingestionMappingType"]; ok {
-		m["ingestionMappingType"] = a.IngestionMappingType.CamelCase()
+	for k, v := range a.Extra {
+		if !hasKeyFold(m, k) {
+			m[k] = v
+		}
 	}
 
 	return json.Marshal(m)
 }
 
+// hasKeyFold reports if m has key, in any case.
+func hasKeyFold(m map[string]interface{}, key string) bool {
+	for k := range m {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
 // MarshalJSONString will marshal Ingestion into a base64 encoded string.
 func (i Ingestion) MarshalJSONString() (base64String string, err error) {
 	i = i.defaults()
@@ -386,6 +640,12 @@ func (i Ingestion) defaults() Ingestion {
 		i.SourceMessageCreationTime = time.Now()
 	}
 
+	// The service needs the kind of any mapping, which a mapping name given without one gets from the format.
+	a := &i.Additional
+	if a.IngestionMappingType == DFUnknown && (a.IngestionMappingRef != "" || a.IngestionMapping != "") {
+		a.IngestionMappingType = a.Format.MappingKind()
+	}
+
 	return i
 }
 
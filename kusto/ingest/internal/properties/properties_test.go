@@ -0,0 +1,426 @@
+package properties
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatInMessage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		format DataFormat
+		want   string
+	}{
+		{AVRO, "avro"},
+		{ApacheAVRO, "apacheavro"},
+		{CSV, "csv"},
+		{JSON, "json"},
+		{MultiJSON, "multijson"},
+		{ORC, "orc"},
+		{Parquet, "parquet"},
+		{PSV, "psv"},
+		{Raw, "raw"},
+		{SCSV, "scsv"},
+		{SOHSV, "sohsv"},
+		{SStream, "sstream"},
+		{TSV, "tsv"},
+		{TSVE, "tsve"},
+		{TXT, "txt"},
+		{W3CLogFile, "w3clogfile"},
+		{SingleJSON, "singlejson"},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.want, func(t *testing.T) {
+			t.Parallel()
+
+			i := Ingestion{
+				ID:           uuid.New(),
+				BlobPath:     "https://account.blob.core.windows.net/container/blob",
+				DatabaseName: "db",
+				TableName:    "table",
+				Additional: Additional{
+					AuthContext: "auth",
+					Format:      test.format,
+				},
+			}
+
+			s, err := i.MarshalJSONString()
+			require.NoError(t, err)
+			b, err := base64.StdEncoding.DecodeString(s)
+			require.NoError(t, err)
+
+			msg := struct {
+				Additional map[string]interface{} `json:"AdditionalProperties"`
+			}{}
+			require.NoError(t, json.Unmarshal(b, &msg))
+			assert.Equal(t, test.want, msg.Additional["format"])
+		})
+	}
+}
+
+func TestDataFormatDiscovery(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input string
+		want  DataFormat
+	}{
+		{"file.json", MultiJSON},
+		{"file.json.gz", MultiJSON},
+		{"https://account.blob.core.windows.net/container/file.JSON.zip?sas", MultiJSON},
+		{"file.csv", CSV},
+		{"file.avro", AVRO},
+		{"file.txt", TXT},
+		{"file.raw", Raw},
+		{"file.ss", SStream},
+		{"u_ex220101.log", W3CLogFile},
+		{"file.w3clogfile.gz", W3CLogFile},
+		{"file", DFUnknown},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, DataFormatDiscovery(test.input), test.input)
+	}
+}
+
+func TestFormatClassification(t *testing.T) {
+	t.Parallel()
+
+	binary := map[DataFormat]bool{ApacheAVRO: true, SStream: true}
+	for d := DFUnknown; d <= SingleJSON; d++ {
+		assert.Equal(t, !binary[d], d.IsCompressible(), d.CamelCase())
+		assert.Equal(t, d != SStream, d.IsStreamable(), d.CamelCase())
+	}
+
+	p := All{}
+	p.Ingestion.Additional.Format = ApacheAVRO
+	assert.False(t, p.ShouldCompress())
+	assert.Equal(t, CTNone, p.SentCompression())
+	p.Ingestion.Additional.Format = W3CLogFile
+	assert.True(t, p.ShouldCompress())
+	assert.Equal(t, GZIP, p.SentCompression())
+	p.Source.Compression = ZIP
+	assert.Equal(t, ZIP, p.SentCompression())
+}
+
+func TestMappingTypeInMessage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc       string
+		additional Additional
+		want       interface{}
+	}{
+		{desc: "No mapping", additional: Additional{Format: JSON}, want: nil},
+		{desc: "Mapping kind set", additional: Additional{Format: JSON, IngestionMappingRef: "map", IngestionMappingType: JSON}, want: "Json"},
+		{desc: "Reference without a kind", additional: Additional{Format: MultiJSON, IngestionMappingRef: "map"}, want: "Json"},
+		{desc: "Inline mapping without a kind", additional: Additional{Format: PSV, IngestionMapping: "[]"}, want: "Csv"},
+		{desc: "Avro reference without a kind", additional: Additional{Format: ApacheAVRO, IngestionMappingRef: "map"}, want: "Avro"},
+		{desc: "W3CLogFile reference", additional: Additional{Format: W3CLogFile, IngestionMappingRef: "map", IngestionMappingType: W3CLogFile}, want: "W3cLogFile"},
+		{desc: "No format or kind", additional: Additional{IngestionMappingRef: "map"}, want: nil},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			test.additional.AuthContext = "auth"
+			i := Ingestion{
+				BlobPath:     "https://account.blob.core.windows.net/container/blob",
+				DatabaseName: "db",
+				TableName:    "table",
+				Additional:   test.additional,
+			}
+
+			s, err := i.MarshalJSONString()
+			require.NoError(t, err)
+			b, err := base64.StdEncoding.DecodeString(s)
+			require.NoError(t, err)
+
+			msg := struct {
+				Additional map[string]interface{} `json:"AdditionalProperties"`
+			}{}
+			require.NoError(t, json.Unmarshal(b, &msg))
+			assert.Equal(t, test.want, msg.Additional["ingestionMappingType"])
+		})
+	}
+}
+
+func TestMappingKind(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		format       DataFormat
+		want         DataFormat
+		needsMapping bool
+	}{
+		{format: DFUnknown, want: DFUnknown},
+		{format: AVRO, want: AVRO, needsMapping: true},
+		{format: ApacheAVRO, want: AVRO, needsMapping: true},
+		{format: CSV, want: CSV},
+		{format: JSON, want: JSON, needsMapping: true},
+		{format: MultiJSON, want: JSON, needsMapping: true},
+		{format: SingleJSON, want: JSON, needsMapping: true},
+		{format: ORC, want: ORC},
+		{format: Parquet, want: Parquet},
+		{format: PSV, want: CSV},
+		{format: Raw, want: CSV},
+		{format: SCSV, want: CSV},
+		{format: SOHSV, want: CSV},
+		{format: SStream, want: DFUnknown},
+		{format: TSV, want: CSV},
+		{format: TSVE, want: CSV},
+		{format: TXT, want: CSV},
+		{format: W3CLogFile, want: W3CLogFile},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, test.format.MappingKind(), test.format.CamelCase())
+		assert.Equal(t, test.needsMapping, test.format.RequiresStreamingMapping(), test.format.CamelCase())
+	}
+}
+
+func TestExtraInMessage(t *testing.T) {
+	t.Parallel()
+
+	i := Ingestion{
+		BlobPath:     "https://account.blob.core.windows.net/container/blob",
+		DatabaseName: "db",
+		TableName:    "table",
+		Additional: Additional{
+			AuthContext: "auth",
+			Format:      CSV,
+			Tags:        []string{"tag"},
+			Extra: map[string]string{
+				"zipPattern":        "*.csv",
+				"ignoreFirstRecord": "true",
+				"policy":            `{"a":1}`,
+				"Tags":              "ignored",
+			},
+		},
+	}
+
+	s, err := i.MarshalJSONString()
+	require.NoError(t, err)
+	b, err := base64.StdEncoding.DecodeString(s)
+	require.NoError(t, err)
+
+	msg := struct {
+		Additional map[string]interface{} `json:"AdditionalProperties"`
+	}{}
+	require.NoError(t, json.Unmarshal(b, &msg))
+	assert.Equal(t, "*.csv", msg.Additional["zipPattern"])
+	assert.Equal(t, "true", msg.Additional["ignoreFirstRecord"])
+	// Values are sent as the strings they are, not encoded again.
+	assert.Equal(t, `{"a":1}`, msg.Additional["policy"])
+	// The fields win over the extra properties.
+	assert.Equal(t, `["tag"]`, msg.Additional["tags"])
+	assert.NotContains(t, msg.Additional, "Tags")
+	assert.Equal(t, "csv", msg.Additional["format"])
+}
+
+func TestIsManagedAdditional(t *testing.T) {
+	t.Parallel()
+
+	for _, key := range []string{"format", "Format", "ingestionMappingReference", "authorizationContext", "streamFormat", "mappingName"} {
+		assert.True(t, IsManagedAdditional(key), key)
+	}
+	for _, key := range []string{"zipPattern", "tags", "ignoreFirstRecord"} {
+		assert.False(t, IsManagedAdditional(key), key)
+	}
+}
+
+// TestMessageGolden compares the queued ingestion message to the files in testdata, so changes to the message
+// schema are seen in review.
+func TestMessageGolden(t *testing.T) {
+	t.Parallel()
+
+	id := uuid.MustParse("4e2b9d3a-6c1f-4d8e-9b7a-2f5c8e1d0a63")
+	created := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+	base := func() Ingestion {
+		return Ingestion{
+			ID:                        id,
+			BlobPath:                  "https://account.blob.core.windows.net/container/data.csv.gz?sig=secret",
+			DatabaseName:              "db",
+			TableName:                 "table",
+			SourceMessageCreationTime: created,
+			Additional: Additional{
+				AuthContext: "auth",
+				Format:      CSV,
+			},
+		}
+	}
+
+	tests := []struct {
+		golden string
+		ing    func() Ingestion
+	}{
+		{
+			golden: "minimal.json",
+			ing:    base,
+		},
+		{
+			golden: "mapping.json",
+			ing: func() Ingestion {
+				i := base()
+				i.RawDataSize = 1024
+				i.RetainBlobOnSuccess = true
+				i.FlushImmediately = true
+				i.IgnoreSizeLimit = true
+				i.Additional.Format = MultiJSON
+				i.Additional.IngestionMappingRef = "map"
+				return i
+			},
+		},
+		{
+			golden: "inline_mapping.json",
+			ing: func() Ingestion {
+				i := base()
+				i.Additional.Format = JSON
+				i.Additional.IngestionMapping = `[{"column":"a","Properties":{"Path":"$.a"}}]`
+				i.Additional.IngestionMappingType = JSON
+				return i
+			},
+		},
+		{
+			golden: "tags_and_policy.json",
+			ing: func() Ingestion {
+				i := base()
+				i.Additional.Tags = []string{"ingest-by:a", "drop-by:b"}
+				i.Additional.IngestIfNotExists = "a"
+				i.Additional.CreationTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+				i.Additional.ValidationPolicy = `{"ValidationOptions":1,"ValidationImplications":0}`
+				return i
+			},
+		},
+		{
+			golden: "status_table.json",
+			ing: func() Ingestion {
+				i := base()
+				i.ReportLevel = FailureAndSuccess
+				i.ReportMethod = ReportStatusToTable
+				i.TableEntryRef = &StatusTableDescription{
+					TableConnectionString: "https://account.table.core.windows.net/status",
+					PartitionKey:          id.String(),
+					RowKey:                uuid.Nil.String(),
+				}
+				return i
+			},
+		},
+		{
+			golden: "extra.json",
+			ing: func() Ingestion {
+				i := base()
+				i.Additional.Extra = map[string]string{"zipPattern": "*.csv", "ignoreFirstRecord": "true"}
+				return i
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.golden, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := test.ing().MarshalJSONString()
+			require.NoError(t, err)
+			b, err := base64.StdEncoding.DecodeString(s)
+			require.NoError(t, err)
+
+			got := &bytes.Buffer{}
+			require.NoError(t, json.Indent(got, b, "", "  "))
+			got.WriteString("\n")
+
+			want, err := ioutil.ReadFile(filepath.Join("testdata", test.golden))
+			require.NoError(t, err)
+			assert.Equal(t, string(want), got.String())
+		})
+	}
+}
+
+func TestParseDataFormat(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input   string
+		want    DataFormat
+		wantErr bool
+	}{
+		{input: "csv", want: CSV},
+		{input: "CSV", want: CSV},
+		{input: "MultiJson", want: MultiJSON},
+		{input: "jsonl", want: MultiJSON},
+		{input: "NDJSON", want: MultiJSON},
+		{input: "text", want: TXT},
+		{input: "avro", want: AVRO},
+		{input: "ApacheAvro", want: ApacheAVRO},
+		{input: " w3clogfile ", want: W3CLogFile},
+		{input: "", wantErr: true},
+		{input: "xml", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseDataFormat(test.input)
+		if test.wantErr {
+			assert.Error(t, err, test.input)
+			continue
+		}
+		require.NoError(t, err, test.input)
+		assert.Equal(t, test.want, got, test.input)
+	}
+}
+
+func TestDataFormatRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	// Every constant must have a descriptor, so that its name is known.
+	require.Len(t, dfDescriptions, int(SingleJSON)+1)
+
+	for d := AVRO; d <= SingleJSON; d++ {
+		name := d.String()
+		require.NotEmpty(t, name, "DataFormat %d has no name", d)
+
+		got, err := ParseDataFormat(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, d, got, name)
+
+		got, err = ParseDataFormat(d.CamelCase())
+		require.NoError(t, err, name)
+		assert.Equal(t, d, got, name)
+
+		type config struct {
+			Format  DataFormat            `json:"format"`
+			Formats map[DataFormat]string `json:"formats"`
+		}
+		b, err := json.Marshal(config{Format: d, Formats: map[DataFormat]string{d: "x"}})
+		require.NoError(t, err, name)
+		assert.JSONEq(t, `{"format":"`+name+`","formats":{"`+name+`":"x"}}`, string(b))
+
+		var c config
+		require.NoError(t, json.Unmarshal(b, &c), name)
+		assert.Equal(t, d, c.Format, name)
+		assert.Equal(t, map[DataFormat]string{d: "x"}, c.Formats, name)
+	}
+
+	var c struct{ Format DataFormat }
+	assert.Error(t, json.Unmarshal([]byte(`{"Format":"xml"}`), &c))
+	assert.Error(t, json.Unmarshal([]byte(`{"Format":3}`), &c))
+	require.NoError(t, json.Unmarshal([]byte(`{"Format":null}`), &c))
+	assert.Equal(t, DFUnknown, c.Format)
+
+	_, err := DFUnknown.MarshalText()
+	assert.Error(t, err)
+}
@@ -4,23 +4,32 @@ package queued
 
 import (
 	"context"
+	goErrors "errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/gzip"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/retry"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/trace"
 	"github.com/google/uuid"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/Azure/azure-storage-queue-go/azqueue"
 )
@@ -37,9 +46,12 @@ const (
 	Concurrency = 50
 )
 
+// storageScope is the scope of the tokens that authenticate to Azure Storage.
+const storageScope = "https://storage.azure.com/.default"
+
 // Queued provides methods for taking data from various sources and ingesting it into Kusto using queued ingestion.
 type Queued interface {
-	Local(ctx context.Context, from string, props properties.All) error
+	Local(ctx context.Context, from string, props properties.All) (string, error)
 	Reader(ctx context.Context, reader io.Reader, props properties.All) (string, error)
 	Blob(ctx context.Context, from string, fileSize int64, props properties.All) error
 }
@@ -50,6 +62,13 @@ type uploadStream func(context.Context, io.Reader, azblob.BlockBlobClient, azblo
 // uploadBlob provides a type that mimics azblob.UploadFileToBlockBlob to allow fakes for test
 type uploadBlob func(context.Context, *os.File, azblob.BlockBlobClient, azblob.HighLevelUploadToBlockBlobOption) (*http.Response, error)
 
+// deleteBlob provides a type that mimics azblob.BlockBlobClient.Delete to allow fakes for testing.
+type deleteBlob func(context.Context, azblob.BlockBlobClient) error
+
+// deleteBlobTimeout is how long deleting a staged blob that could not be queued may take. It does not use the
+// context of the ingestion, which may be done already, as that can be why queueing failed.
+const deleteBlobTimeout = 30 * time.Second
+
 // Ingestion provides methods for taking data from a filesystem of some type and ingesting it into Kusto.
 // This object is scoped for a single database and table.
 type Ingestion struct {
@@ -57,12 +76,32 @@ type Ingestion struct {
 	table string
 	mgr   *resources.Manager
 
-	uploadStream    uploadStream
-	uploadBlob      uploadBlob
+	uploadStream uploadStream
+	uploadBlob   uploadBlob
+	deleteBlob   deleteBlob
+
+	// transferManager holds the buffers of block size that streams are staged in. It is shared by all uploads, so the
+	// buffers are reused across calls and go back to it once the upload staged their block.
 	transferManager azblob.TransferManager
 
-	bufferSize int
-	maxBuffers int
+	bufferSize  int
+	maxBuffers  int
+	parallelism int
+
+	prefix string
+	// cred authenticates to the containers and queues when set, instead of their shared access signatures.
+	cred azcore.TokenCredential
+	// httpClient sends the requests to the containers and queues when set, instead of the clients of the storage SDKs.
+	httpClient *http.Client
+	// spans starts the spans of the uploads and of the posts to the queues, nil if they are not traced.
+	spans trace.Tracer
+	// uploadRetry and enqueueRetry are how the uploads and the posts to the queues are retried, see WithRetryPolicies().
+	uploadRetry  retry.Policy
+	enqueueRetry retry.Policy
+	// compressBuffer is the size of the buffers that data is read into before it is compressed, 0 for the default.
+	compressBuffer int
+	// beforeEnqueue is called right before an ingestion message is posted, see WithBeforeEnqueue().
+	beforeEnqueue func(blobURI string, size int64, props properties.All) error
 }
 
 // Option is an optional argument to New().
@@ -76,6 +115,71 @@ func WithStaticBuffer(bufferSize int, maxBuffers int) Option {
 	}
 }
 
+// WithUploadParallelism sets how many blocks of a blob are uploaded at once, unless WithStaticBuffer() set a number
+// of buffers. 0 keeps the default of Concurrency.
+func WithUploadParallelism(parallelism int) Option {
+	return func(s *Ingestion) {
+		s.parallelism = parallelism
+	}
+}
+
+// WithStagingPrefix sets a prefix for the names of the blobs staged by Local() and Reader().
+func WithStagingPrefix(prefix string) Option {
+	return func(s *Ingestion) {
+		s.prefix = prefix
+	}
+}
+
+// WithTokenCredential authenticates the uploads to the containers and the posts to the queues with tokens from cred
+// instead of the shared access signatures of their URIs, which are removed. The URI of a blob in an ingestion
+// message keeps the shared access signature of its container, if any, for the service to read the blob.
+func WithTokenCredential(cred azcore.TokenCredential) Option {
+	return func(i *Ingestion) {
+		i.cred = cred
+	}
+}
+
+// WithHTTPClient makes the uploads to the containers and the posts to the queues go through client, such as one with
+// the TLS config of the kusto.Client. nil keeps the clients of the storage SDKs.
+func WithHTTPClient(client *http.Client) Option {
+	return func(i *Ingestion) {
+		i.httpClient = client
+	}
+}
+
+// WithSpanTracer makes the uploads to the containers and the posts to the queues start spans with tracer.
+func WithSpanTracer(tracer trace.Tracer) Option {
+	return func(i *Ingestion) {
+		i.spans = tracer
+	}
+}
+
+// WithRetryPolicies makes the uploads of files retried with upload, and the posts to the queues with enqueue. The
+// upload of a reader is not retried, as it cannot be read again. The zero retry.Policy, the default, does not retry.
+// The storage SDK does not retry the posts to the queues itself when enqueue does.
+func WithRetryPolicies(upload, enqueue retry.Policy) Option {
+	return func(i *Ingestion) {
+		i.uploadRetry = upload
+		i.enqueueRetry = enqueue
+	}
+}
+
+// WithCompressionBuffer sets the size of the buffers that the data of Reader() and Local() is read into before it is
+// compressed, which must be valid according to gzip.ValidateBufferSize(). It does not change the compressed data.
+func WithCompressionBuffer(size int) Option {
+	return func(i *Ingestion) {
+		i.compressBuffer = size
+	}
+}
+
+// WithBeforeEnqueue calls before with the blob URI, the size and the properties of each ingestion message right
+// before it is posted to a queue, such as to journal it. The message is not posted if before fails.
+func WithBeforeEnqueue(before func(blobURI string, size int64, props properties.All) error) Option {
+	return func(i *Ingestion) {
+		i.beforeEnqueue = before
+	}
+}
+
 // New is the constructor for Ingestion.
 func New(db, table string, mgr *resources.Manager, options ...Option) (*Ingestion, error) {
 	i := &Ingestion{
@@ -88,6 +192,10 @@ func New(db, table string, mgr *resources.Manager, options ...Option) (*Ingestio
 		uploadBlob: func(ctx context.Context, file *os.File, client azblob.BlockBlobClient, options azblob.HighLevelUploadToBlockBlobOption) (*http.Response, error) {
 			return client.UploadFileToBlockBlob(ctx, file, options)
 		},
+		deleteBlob: func(ctx context.Context, client azblob.BlockBlobClient) error {
+			_, err := client.Delete(ctx, nil)
+			return err
+		},
 	}
 
 	for _, opt := range options {
@@ -96,8 +204,8 @@ func New(db, table string, mgr *resources.Manager, options ...Option) (*Ingestio
 
 	var transferManager azblob.TransferManager
 	var err error
-	if i.bufferSize == 0 && i.maxBuffers == 0 {
-		transferManager, err = azblob.NewSyncPool(BlockSize, Concurrency)
+	if i.maxBuffers == 0 {
+		transferManager, err = newSyncPool(i.blockSize(), i.uploadParallelism())
 	} else {
 		transferManager, err = azblob.NewStaticBuffer(i.bufferSize, i.maxBuffers)
 		if err != nil {
@@ -112,40 +220,69 @@ func New(db, table string, mgr *resources.Manager, options ...Option) (*Ingestio
 	return i, nil
 }
 
-// Local ingests a local file into Kusto.
-func (i *Ingestion) Local(ctx context.Context, from string, props properties.All) error {
-	container, err := i.upstreamContainer()
+// ForTable returns an Ingestion into db and table that shares the manager, the options and the buffers of i.
+func (i *Ingestion) ForTable(db, table string) *Ingestion {
+	h := *i
+	h.db = db
+	h.table = table
+	return &h
+}
+
+// newSyncPool is azblob.NewSyncPool, replaced in tests.
+var newSyncPool = azblob.NewSyncPool
+
+// blockSize is the size of the blocks that blobs are uploaded in.
+func (i *Ingestion) blockSize() int {
+	if i.bufferSize != 0 {
+		return i.bufferSize
+	}
+	return BlockSize
+}
+
+// uploadParallelism is the number of blocks of a blob that are uploaded at once.
+func (i *Ingestion) uploadParallelism() int {
+	if i.parallelism != 0 {
+		return i.parallelism
+	}
+	return Concurrency
+}
+
+// Local ingests a local file into Kusto. It returns the name of the blob that the file was staged in.
+func (i *Ingestion) Local(ctx context.Context, from string, props properties.All) (string, error) {
+	container, storageURI, err := i.upstreamContainer()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	mgrResources, err := i.mgr.Resources()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// We want to check the queue size here so so we don't upload a file and then find we don't have a Kusto queue to stick
 	// it in. If we don't have a container, that is handled by containerQueue().
 	if len(mgrResources.Queues) == 0 {
-		return errors.ES(errors.OpFileIngest, errors.KBlobstore, "no Kusto queue resources are defined, there is no queue to upload to").SetNoRetry()
+		return "", errors.ES(errors.OpFileIngest, errors.KBlobstore, "no Kusto queue resources are defined, there is no queue to upload to").SetNoRetry()
 	}
 
-	blobURL, size, err := i.localToBlob(ctx, from, container, &props)
+	uploadCtx, span := i.startUpload(ctx)
+	blobName, blobURL, size, err := i.localToBlob(uploadCtx, from, container, &props)
+	endUpload(span, blobName, props, err)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if err := i.Blob(ctx, blobURL, size, props); err != nil {
-		return err
+	if err := i.enqueueStaged(ctx, container.NewBlockBlobClient(blobName), i.messageURL(blobURL, storageURI), size, props); err != nil {
+		return blobName, err
 	}
 
-	return nil
+	return blobName, props.ApplyDeleteLocalSourceOption()
 }
 
 // Reader uploads a file via an io.Reader.
 // If the function succeeds, it returns the path of the created blob.
 func (i *Ingestion) Reader(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
-	to, err := i.upstreamContainer()
+	to, storageURI, err := i.upstreamContainer()
 	if err != nil {
 		return "", err
 	}
@@ -161,67 +298,132 @@ func (i *Ingestion) Reader(ctx context.Context, reader io.Reader, props properti
 		return "", errors.ES(errors.OpFileIngest, errors.KBlobstore, "no Kusto queue resources are defined, there is no queue to upload to").SetNoRetry()
 	}
 
-	shouldCompress := true
-	if props.Source.OriginalSource != "" {
-		shouldCompress = CompressionDiscovery(props.Source.OriginalSource) == properties.CTNone
-	}
-	if props.Source.DontCompress {
-		shouldCompress = false
+	// A file is uploaded like one passed to Local(), which knows its size and can use the upload API of files.
+	if file, ok := unreadFile(reader); ok {
+		uploadCtx, span := i.startUpload(ctx)
+		blobName, blobURL, size, err := i.uploadFile(uploadCtx, file, to, &props)
+		endUpload(span, blobName, props, err)
+		if err != nil {
+			return "", err
+		}
+		if err := i.enqueueStaged(ctx, to.NewBlockBlobClient(blobName), i.messageURL(blobURL, storageURI), size, props); err != nil {
+			return blobName, err
+		}
+		return blobName, props.ApplyDeleteLocalSourceOption()
 	}
 
-	extension := "gz"
-	if !shouldCompress {
+	DiscoverCompression(&props, props.Source.OriginalSource)
+	shouldCompress := props.ShouldCompress()
+
+	var extension string
+	switch props.SentCompression() {
+	case properties.GZIP:
+		extension = "gz"
+	case properties.ZIP:
+		extension = "zip"
+	default:
 		if props.Source.OriginalSource != "" {
-			extension = filepath.Ext(props.Source.OriginalSource)
+			extension = strings.TrimPrefix(filepath.Ext(props.Source.OriginalSource), ".")
 		} else {
 			extension = props.Ingestion.Additional.Format.String() // Best effort
 		}
 	}
 
-	blobName := fmt.Sprintf("%s_%s_%s_%s.%s", i.db, i.table, nower(), filepath.Base(uuid.New().String()), extension)
+	blobName := fmt.Sprintf("%s%s_%s.%s", i.blobNamePrefix(props), nower(), filepath.Base(uuid.New().String()), extension)
 
 	// Here's how to upload a blob.
 	blobClient := to.NewBlockBlobClient(blobName)
 
 	size := int64(0)
 
+	source := &sourceReader{r: props.Source.Counts.CountRead(reader)}
+	reader = source
 	if shouldCompress {
-		reader = gzip.Compress(reader)
+		zr := gzip.CompressLevelBuffer(source, props.Source.GzipLevel(), i.compressBuffer)
+		defer zr.Close()
+		reader = zr
 	}
 
+	uploadCtx, span := i.startUpload(ctx)
 	_, err = i.uploadStream(
-		ctx,
-		reader,
+		uploadCtx,
+		props.Source.Counts.CountUploaded(reader),
 		blobClient,
-		azblob.UploadStreamToBlockBlobOptions{TransferManager: i.transferManager},
+		azblob.UploadStreamToBlockBlobOptions{
+			TransferManager: i.transferManager,
+			Metadata:        props.Source.BlobMetadata,
+			AccessTier:      blobTier(props),
+		},
 	)
 
 	if err != nil {
-		return blobName, errors.ES(errors.OpFileIngest, errors.KBlobstore, "problem uploading to Blob Storage: %s", err)
+		err = errors.E(errors.OpFileIngest, errors.KBlobstore, fmt.Errorf("problem uploading to Blob Storage: %w", err))
+		endUpload(span, blobName, props, err)
+		return blobName, err
 	}
+	endUpload(span, blobName, props, nil)
 
-	if gz, ok := reader.(*gzip.Streamer); ok {
-		size = gz.InputSize()
+	// The size of the data is only sent for data that is compressed here, and is the size before compression.
+	if shouldCompress {
+		size = source.size()
 	}
 
-	if err := i.Blob(ctx, blobClient.URL(), size, props); err != nil {
+	if err := i.enqueueStaged(ctx, blobClient, i.messageURL(blobClient.URL(), storageURI), size, props); err != nil {
 		return blobName, err
 	}
 
-	return blobName, nil
+	return blobName, props.ApplyDeleteLocalSourceOption()
 }
 
 // Blob ingests a file from Azure Blob Storage into Kusto.
 func (i *Ingestion) Blob(ctx context.Context, from string, fileSize int64, props properties.All) error {
+	if err := i.enqueue(ctx, from, fileSize, props); err != nil {
+		return err
+	}
+	return props.ApplyDeleteLocalSourceOption()
+}
+
+// enqueueStaged posts the ingestion message of blob, which the data was just uploaded to and whose URI in the message
+// is from. If that fails, the error wraps an *EnqueueError, and blob is deleted if props say so.
+func (i *Ingestion) enqueueStaged(ctx context.Context, blob azblob.BlockBlobClient, from string, fileSize int64, props properties.All) error {
+	err := i.enqueue(ctx, from, fileSize, props)
+	if err == nil {
+		return nil
+	}
+
+	enqueueErr := &EnqueueError{BlobURI: from, Size: fileSize, AlreadyUploaded: true, Err: err}
+	if props.Source.DeleteBlobOnEnqueueFailure {
+		deleteCtx, cancel := context.WithTimeout(context.Background(), deleteBlobTimeout)
+		defer cancel()
+		if err := i.deleteBlob(deleteCtx, blob); err == nil {
+			enqueueErr.AlreadyUploaded = false
+		}
+	}
+	return errors.E(errors.OpFileIngest, errors.KindOf(err), enqueueErr)
+}
+
+// enqueue posts the ingestion message of the blob from to the queue.
+func (i *Ingestion) enqueue(ctx context.Context, from string, fileSize int64, props properties.All) (err error) {
+	ctx, span := trace.Start(ctx, i.spans, trace.Enqueue,
+		trace.String(trace.MessagingSystem, "azure_storage_queue"),
+		trace.String(trace.MessagingOperation, "send"),
+		trace.String(trace.DBNamespace, i.db),
+		trace.String(trace.DBCollection, i.table),
+	)
+	defer func() { span.End(err) }()
+
 	// To learn more about ingestion properties, go to:
 	// https://docs.microsoft.com/en-us/azure/kusto/management/data-ingestion/#ingestion-properties
 	// To learn more about ingestion methods go to:
 	// https://docs.microsoft.com/en-us/azure/data-explorer/ingest-data-overview#ingestion-methods
 
-	to, err := i.upstreamQueue()
+	to, err := i.upstreamQueue(ctx)
 	if err != nil {
 		return err
 	}
+	// The URL of the messages of a queue is https://<account>.queue.core.windows.net/<queue>/messages.
+	u := to.URL()
+	span.SetAttributes(trace.String(trace.ServerAddress, u.Host), trace.String(trace.MessagingDestination, path.Base(path.Dir(u.Path))))
 
 	props.Ingestion.BlobPath = from
 	if fileSize != 0 {
@@ -237,19 +439,54 @@ func (i *Ingestion) Blob(ctx context.Context, from string, fileSize int64, props
 
 	j, err := props.Ingestion.MarshalJSONString()
 	if err != nil {
-		return errors.ES(errors.OpFileIngest, errors.KInternal, "could not marshal the ingestion blob info: %s", err).SetNoRetry()
+		return errors.E(errors.OpFileIngest, errors.KInternal, fmt.Errorf("could not marshal the ingestion blob info: %w", err)).SetNoRetry()
 	}
 
-	if _, err := to.Enqueue(ctx, j, 0, 0); err != nil {
-		return errors.E(errors.OpFileIngest, errors.KBlobstore, err)
+	if i.beforeEnqueue != nil {
+		if err := i.beforeEnqueue(from, fileSize, props); err != nil {
+			return errors.E(errors.OpFileIngest, errors.KOther, fmt.Errorf("the ingestion message was not posted: %w", err)).SetNoRetry()
+		}
 	}
 
-	err = props.ApplyDeleteLocalSourceOption()
-	if err != nil {
-		return err
+	return retry.Retrier{Policy: i.enqueueRetry}.Do(ctx, func(ctx context.Context) error {
+		if _, err := to.Enqueue(ctx, j, 0, 0); err != nil {
+			return errors.E(errors.OpFileIngest, errors.KBlobstore, err)
+		}
+		return nil
+	})
+}
+
+// EnqueueError is the error of Local() and Reader() when the data was uploaded to a blob, but the blob could not be
+// queued for ingestion, so it is not ingested. It is wrapped in an *errors.Error and can be found with errors.As().
+type EnqueueError struct {
+	// BlobURI is the URI of the blob as the ingestion message holds it, with the shared access signature that the
+	// service reads it with, if any.
+	BlobURI string
+	// Size is the size of the data before compression, or 0 if it is not known.
+	Size int64
+	// AlreadyUploaded is true if the blob is kept, so that it can be queued again without uploading the data again.
+	// It is false if the blob was deleted after the failure.
+	AlreadyUploaded bool
+	// Err is the error of queueing the blob.
+	Err error
+}
+
+// Error implements error. The shared access signature of the blob is left out.
+func (e *EnqueueError) Error() string {
+	blob := e.BlobURI
+	if u, err := url.Parse(blob); err == nil {
+		u.RawQuery = ""
+		blob = u.String()
+	}
+	if e.AlreadyUploaded {
+		return fmt.Sprintf("the data was uploaded to blob %s, but it could not be queued for ingestion: %s", blob, e.Err)
 	}
+	return fmt.Sprintf("the data was uploaded to blob %s, which was deleted as it could not be queued for ingestion: %s", blob, e.Err)
+}
 
-	return nil
+// Unwrap returns the error of queueing the blob.
+func (e *EnqueueError) Unwrap() error {
+	return e.Err
 }
 
 func CompleteFormatFromFileName(props *properties.All, from string) error {
@@ -268,102 +505,230 @@ func CompleteFormatFromFileName(props *properties.All, from string) error {
 	return nil
 }
 
+// missingError is the error of an ingestion that needs a kind of ingestion resource that the Manager has none of.
+type missingError struct {
+	resource string
+	err      error
+}
+
+func (m missingError) Error() string {
+	return m.err.Error()
+}
+
+// MissingResource returns the kind of ingestion resource, "containers" or "queues", that err says there are none of,
+// or "" if err is about something else.
+func MissingResource(err error) string {
+	var m missingError
+	if goErrors.As(err, &m) {
+		return m.resource
+	}
+	return ""
+}
+
 // upstreamContainer randomly selects a container queue in which to upload our file to blobstore.
-func (i *Ingestion) upstreamContainer() (azblob.ContainerClient, error) {
+func (i *Ingestion) upstreamContainer() (azblob.ContainerClient, *resources.URI, error) {
 	mgrResources, err := i.mgr.Resources()
 	if err != nil {
-		return azblob.ContainerClient{}, errors.E(errors.OpFileIngest, errors.KBlobstore, err)
+		return azblob.ContainerClient{}, nil, errors.E(errors.OpFileIngest, errors.KBlobstore, missingError{resource: "containers", err: err}).SetNoRetry()
 	}
 
 	if len(mgrResources.Containers) == 0 {
-		return azblob.ContainerClient{}, errors.ES(
+		return azblob.ContainerClient{}, nil, errors.E(
 			errors.OpFileIngest,
 			errors.KBlobstore,
-			"no Blob Storage container resources are defined, there is no container to upload to",
+			missingError{resource: "containers", err: goErrors.New("no Blob Storage container resources are defined, there is no container to upload to")},
 		).SetNoRetry()
 	}
 
 	storageURI := mgrResources.Containers[rand.Intn(len(mgrResources.Containers))]
-	serviceURL := fmt.Sprintf("https://%s.blob.core.windows.net?%s", storageURI.Account(), storageURI.SAS().Encode())
 
-	service, err := azblob.NewServiceClientWithNoCredential(serviceURL, nil)
+	var options *azblob.ClientOptions
+	if i.httpClient != nil {
+		options = &azblob.ClientOptions{Transporter: i.httpClient}
+	}
+	var service azblob.ServiceClient
+	if i.cred != nil {
+		service, err = azblob.NewServiceClient(storageURI.ServiceURL(), i.cred, options)
+	} else {
+		serviceURL := fmt.Sprintf("%s?%s", storageURI.ServiceURL(), storageURI.SAS().Encode())
+		service, err = azblob.NewServiceClientWithNoCredential(serviceURL, options)
+	}
 	if err != nil {
-		return azblob.ContainerClient{}, errors.E(errors.OpFileIngest, errors.KBlobstore, err)
+		return azblob.ContainerClient{}, nil, errors.E(errors.OpFileIngest, errors.KBlobstore, err)
 	}
 
-	return service.NewContainerClient(storageURI.ObjectName()), nil
+	return service.NewContainerClient(storageURI.ObjectName()), storageURI, nil
+}
+
+// messageURL returns the URI of the blob at blobURL, in the container at storageURI, for the ingestion message. When
+// the blob was uploaded with a token credential, the shared access signature of the container is added back for the
+// service to read the blob. Without one, the service reads the blob with its own identity, which must be allowed to.
+func (i *Ingestion) messageURL(blobURL string, storageURI *resources.URI) string {
+	if i.cred == nil || len(storageURI.SAS()) == 0 {
+		return blobURL
+	}
+	return blobURL + "?" + storageURI.SAS().Encode()
 }
 
-func (i *Ingestion) upstreamQueue() (azqueue.MessagesURL, error) {
+func (i *Ingestion) upstreamQueue(ctx context.Context) (azqueue.MessagesURL, error) {
 	mgrResources, err := i.mgr.Resources()
 	if err != nil {
-		return azqueue.MessagesURL{}, err
+		return azqueue.MessagesURL{}, errors.E(errors.OpFileIngest, errors.KBlobstore, missingError{resource: "queues", err: err}).SetNoRetry()
 	}
 
 	if len(mgrResources.Queues) == 0 {
-		return azqueue.MessagesURL{}, errors.ES(
+		return azqueue.MessagesURL{}, errors.E(
 			errors.OpFileIngest,
 			errors.KBlobstore,
-			"no Kusto queue resources are defined, there is no queue to upload to",
+			missingError{resource: "queues", err: goErrors.New("no Kusto queue resources are defined, there is no queue to upload to")},
 		).SetNoRetry()
 	}
 
 	queue := mgrResources.Queues[rand.Intn(len(mgrResources.Queues))]
-	service, _ := url.Parse(fmt.Sprintf("https://%s.queue.core.windows.net?%s", queue.Account(), queue.SAS().Encode()))
+	service, _ := url.Parse(fmt.Sprintf("%s?%s", queue.ServiceURL(), queue.SAS().Encode()))
 
 	creds := azqueue.NewAnonymousCredential()
-	p := azqueue.NewPipeline(creds, azqueue.PipelineOptions{})
+	if i.cred != nil {
+		// The credential caches its tokens, so this only gets a new one when the last one is about to expire.
+		token, err := i.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{storageScope}})
+		if err != nil {
+			return azqueue.MessagesURL{}, errors.E(errors.OpFileIngest, errors.KBlobstore, fmt.Errorf("could not get a token for the queue %s: %w", queue.ServiceURL(), err))
+		}
+		service, _ = url.Parse(queue.ServiceURL())
+		creds = azqueue.NewTokenCredential(token.Token, nil)
+	}
+
+	return azqueue.NewServiceURL(*service, i.queuePipeline(creds)).NewQueueURL(queue.ObjectName()).NewMessagesURL(), nil
+}
 
-	return azqueue.NewServiceURL(*service, p).NewQueueURL(queue.ObjectName()).NewMessagesURL(), nil
+// queuePipeline returns the pipeline that the posts to the queues go through. It is the one of azqueue.NewPipeline(),
+// which has no option to send the requests with another client than its own, sending them with httpClient if set.
+func (i *Ingestion) queuePipeline(creds azqueue.Credential) pipeline.Pipeline {
+	// The posts are retried with the enqueue policy instead of by the pipeline when it retries.
+	var retryOptions azqueue.RetryOptions
+	if i.enqueueRetry.Retries() {
+		retryOptions.MaxTries = 1
+	}
+	if i.httpClient == nil {
+		return azqueue.NewPipeline(creds, azqueue.PipelineOptions{Retry: retryOptions})
+	}
+
+	factories := []pipeline.Factory{
+		azqueue.NewTelemetryPolicyFactory(azqueue.TelemetryOptions{}),
+		azqueue.NewUniqueRequestIDPolicyFactory(),
+		azqueue.NewRetryPolicyFactory(retryOptions),
+		creds,
+		azqueue.NewRequestLogPolicyFactory(azqueue.RequestLogOptions{}),
+		pipeline.MethodFactoryMarker(),
+	}
+	client := i.httpClient
+	sender := pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			resp, err := client.Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(resp), err
+		}
+	})
+	return pipeline.NewPipeline(factories, pipeline.Options{HTTPSender: sender})
 }
 
 var nower = time.Now
 
-// localToBlob copies from a local to to an Azure Blobstore blob. It returns the URL of the Blob, the local file info and an
-// error if there was one.
-func (i *Ingestion) localToBlob(ctx context.Context, from string, container azblob.ContainerClient, props *properties.All) (string, int64, error) {
-	compression := CompressionDiscovery(from)
-	blobName := fmt.Sprintf("%s_%s_%s_%s_%s", i.db, i.table, nower(), filepath.Base(uuid.New().String()), filepath.Base(from))
-	if compression == properties.CTNone {
-		blobName = blobName + ".gz"
-	}
+// startUpload starts the span of an upload to a blob.
+func (i *Ingestion) startUpload(ctx context.Context) (context.Context, trace.Span) {
+	return trace.Start(ctx, i.spans, trace.Upload, trace.String(trace.DBNamespace, i.db), trace.String(trace.DBCollection, i.table))
+}
 
-	// Here's how to upload a blob.
-	blobClient := container.NewBlockBlobClient(blobName)
+// endUpload ends the span of the upload of the data of props to the blob blobName, which failed with err if not nil.
+func endUpload(span trace.Span, blobName string, props properties.All, err error) {
+	if blobName != "" {
+		span.SetAttributes(trace.String(trace.BlobName, blobName))
+	}
+	if props.Source.Counts != nil {
+		span.SetAttributes(trace.Int64(trace.BlobBytes, props.Source.Counts.Uploaded()))
+	}
+	span.End(err)
+}
 
+// localToBlob copies from a local to to an Azure Blobstore blob. It returns the name and the URL of the Blob, the size
+// of the file and an error if there was one. Files that are not compressed are compressed while they are uploaded,
+// without a temporary copy.
+func (i *Ingestion) localToBlob(ctx context.Context, from string, container azblob.ContainerClient, props *properties.All) (string, string, int64, error) {
 	file, err := os.Open(from)
 	if err != nil {
-		return "", 0, errors.ES(
+		return "", "", 0, errors.ES(
 			errors.OpFileIngest,
 			errors.KLocalFileSystem,
 			"problem retrieving source file %q: %s", from, err,
 		).SetNoRetry()
 	}
+	defer file.Close()
+
+	return i.uploadFile(ctx, file, container, props)
+}
+
+// uploadFile uploads file like fileToBlob(), retrying the uploads that failed with the upload policy. Each attempt
+// uploads file from its start to a new blob, and only the bytes of the last one are counted.
+func (i *Ingestion) uploadFile(ctx context.Context, file *os.File, container azblob.ContainerClient, props *properties.All) (blobName, blobURL string, size int64, err error) {
+	if !i.uploadRetry.Retries() {
+		return i.fileToBlob(ctx, file, container, props)
+	}
+
+	counts := props.Source.Counts
+	err = retry.Retrier{Policy: i.uploadRetry}.Do(ctx, func(ctx context.Context) error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return errors.E(errors.OpFileIngest, errors.KLocalFileSystem, fmt.Errorf("could not rewind the file(%s): %w", file.Name(), err)).SetNoRetry()
+		}
+		attempt := *props
+		attempt.Source.Counts = &properties.ByteCounts{}
+
+		var err error
+		blobName, blobURL, size, err = i.fileToBlob(ctx, file, container, &attempt)
+		if err != nil {
+			return err
+		}
+		counts.Add(attempt.Source.Counts.Read(), attempt.Source.Counts.Uploaded())
+		attempt.Source.Counts = counts
+		*props = attempt
+		return nil
+	})
+	if err != nil {
+		return "", "", 0, err
+	}
+	return blobName, blobURL, size, nil
+}
+
+// fileToBlob uploads file, from its start, to a blob in container, like localToBlob(). It returns the name and the URL
+// of the blob and the size of file.
+func (i *Ingestion) fileToBlob(ctx context.Context, file *os.File, container azblob.ContainerClient, props *properties.All) (string, string, int64, error) {
+	from := file.Name()
+	DiscoverCompression(props, from)
+	blobName := fmt.Sprintf("%s%s_%s_%s", i.blobNamePrefix(*props), nower(), filepath.Base(uuid.New().String()), filepath.Base(from))
+	// The service finds the compression of the blob from its extension.
+	if ext := compressionExt(props.SentCompression()); ext != "" && CompressionDiscovery(blobName) != props.SentCompression() {
+		blobName = blobName + ext
+	}
+
+	// Here's how to upload a blob.
+	blobClient := container.NewBlockBlobClient(blobName)
 
 	stat, err := file.Stat()
 	if err != nil {
-		return "", 0, errors.ES(
+		return "", "", 0, errors.ES(
 			errors.OpFileIngest,
 			errors.KLocalFileSystem,
 			"could not Stat the file(%s): %s", from, err,
 		).SetNoRetry()
 	}
 
-	if compression == properties.CTNone && !props.Source.DontCompress {
-		gstream := gzip.New()
-		gstream.Reset(file)
-
-		_, err = i.uploadStream(
-			ctx,
-			gstream,
-			blobClient,
-			azblob.UploadStreamToBlockBlobOptions{TransferManager: i.transferManager},
-		)
-
+	if props.ShouldCompress() {
+		size, err := i.compressToBlob(ctx, file, blobClient, props)
 		if err != nil {
-			return "", 0, errors.ES(errors.OpFileIngest, errors.KBlobstore, "problem uploading to Blob Storage: %s", err)
+			return "", "", 0, err
 		}
-		return blobClient.URL(), gstream.InputSize(), nil
+		return blobName, blobClient.URL(), size, nil
 	}
 
 	// The high-level API UploadFileToBlockBlob function uploads blocks in parallel for optimal performance, and can handle large files as well.
@@ -373,16 +738,142 @@ func (i *Ingestion) localToBlob(ctx context.Context, from string, container azbl
 		file,
 		blobClient,
 		azblob.HighLevelUploadToBlockBlobOption{
-			BlockSize:   BlockSize,
-			Parallelism: Concurrency,
+			BlockSize:   int64(i.blockSize()),
+			Parallelism: uint16(i.uploadParallelism()),
+			Metadata:    props.Source.BlobMetadata,
+			AccessTier:  blobTier(*props),
+		},
+	)
+
+	if err != nil {
+		return "", "", 0, errors.E(errors.OpFileIngest, errors.KBlobstore, fmt.Errorf("problem uploading to Blob Storage: %w", err))
+	}
+	props.Source.Counts.Add(stat.Size(), stat.Size())
+
+	return blobName, blobClient.URL(), stat.Size(), nil
+}
+
+// blobTier returns the access tier of the blob that the data of props is staged in, nil for the default tier.
+func blobTier(props properties.All) *azblob.AccessTier {
+	if props.Source.BlobTier == "" {
+		return nil
+	}
+	tier := azblob.AccessTier(props.Source.BlobTier)
+	return &tier
+}
+
+// maxBlobNameHint is the longest part that BlobNameHint adds to a blob name.
+const maxBlobNameHint = 128
+
+// blobNamePrefix returns the start of the name of the blob that the data of props is staged in, which is followed by
+// the time and a UUID that make the name unique.
+func (i *Ingestion) blobNamePrefix(props properties.All) string {
+	name := fmt.Sprintf("%s%s_%s_", i.prefix, i.db, i.table)
+	if hint := sanitizeBlobNameHint(props.Source.BlobNameHint); hint != "" {
+		name += hint + "_"
+	}
+	return name
+}
+
+// sanitizeBlobNameHint returns hint with the characters that are not ASCII letters, digits, '-', '.' or '_' replaced
+// with '_', cut to maxBlobNameHint characters. Any hint then makes a valid blob name, without virtual directories.
+func sanitizeBlobNameHint(hint string) string {
+	var b strings.Builder
+	for _, r := range hint {
+		if b.Len() == maxBlobNameHint {
+			break
+		}
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// unreadFile returns reader as an *os.File if it is a regular file that was not read from, which fileToBlob() can
+// upload. Files that were read from are not, as the upload API reads files from their start.
+func unreadFile(reader io.Reader) (*os.File, bool) {
+	file, ok := reader.(*os.File)
+	if !ok {
+		return nil, false
+	}
+	stat, err := file.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		return nil, false
+	}
+	if offset, err := file.Seek(0, io.SeekCurrent); err != nil || offset != 0 {
+		return nil, false
+	}
+	return file, true
+}
+
+// compressToBlob uploads src to blobClient gzip compressed and returns the number of bytes read from src. The data is compressed while
+// it is uploaded, so no compressed copy of src is kept in memory or written to disk. If reading src fails, the upload
+// is abandoned and the error is of Kind errors.KLocalFileSystem. If the upload fails, src is not read further.
+func (i *Ingestion) compressToBlob(ctx context.Context, src io.Reader, blobClient azblob.BlockBlobClient, props *properties.All) (int64, error) {
+	source := &sourceReader{r: props.Source.Counts.CountRead(src)}
+	gstream := gzip.NewLevelBuffer(props.Source.GzipLevel(), i.compressBuffer)
+	gstream.Reset(ioutil.NopCloser(source))
+	// Closing the stream stops the compression if the upload returned before reading it to the end.
+	defer gstream.Close()
+
+	_, err := i.uploadStream(
+		ctx,
+		props.Source.Counts.CountUploaded(gstream),
+		blobClient,
+		azblob.UploadStreamToBlockBlobOptions{
+			TransferManager: i.transferManager,
+			Metadata:        props.Source.BlobMetadata,
+			AccessTier:      blobTier(*props),
 		},
 	)
 
+	if readErr := source.err(); readErr != nil {
+		return 0, errors.E(errors.OpFileIngest, errors.KLocalFileSystem, fmt.Errorf("problem reading the source: %w", readErr)).SetNoRetry()
+	}
 	if err != nil {
-		return "", 0, errors.ES(errors.OpFileIngest, errors.KBlobstore, "problem uploading to Blob Storage: %s", err)
+		return 0, errors.E(errors.OpFileIngest, errors.KBlobstore, fmt.Errorf("problem uploading to Blob Storage: %w", err))
 	}
+	return source.size(), nil
+}
 
-	return blobClient.URL(), stat.Size(), nil
+// sourceReader records the error of the reader it wraps, to tell failures to read the source from failures to upload,
+// and how much was read.
+type sourceReader struct {
+	r io.Reader
+
+	mu      sync.Mutex
+	read    int64
+	readErr error
+}
+
+// Read implements io.Reader.
+func (s *sourceReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	s.mu.Lock()
+	s.read += int64(n)
+	if err != nil && err != io.EOF {
+		s.readErr = err
+	}
+	s.mu.Unlock()
+	return n, err
+}
+
+// size returns the number of bytes read.
+func (s *sourceReader) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read
+}
+
+// err returns the error that reading failed with, if any.
+func (s *sourceReader) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readErr
 }
 
 // CompressionDiscovery looks at the file extension. If it is one we support, we return that
@@ -405,34 +896,94 @@ func CompressionDiscovery(fName string) properties.CompressionType {
 	return properties.CTNone
 }
 
+// DiscoverCompression sets the compression of the source of props from the extension of name, the name of the
+// source, unless it was set with the Compression() option. A source without a name is taken as not compressed.
+func DiscoverCompression(props *properties.All, name string) {
+	if props.Source.Compression == properties.CTUnknown && name != "" {
+		props.Source.Compression = CompressionDiscovery(name)
+	}
+}
+
+// compressionExt returns the extension of blobs of compression c, or "" for blobs that are not compressed.
+func compressionExt(c properties.CompressionType) string {
+	switch c {
+	case properties.GZIP:
+		return ".gz"
+	case properties.ZIP:
+		return ".zip"
+	}
+	return ""
+}
+
 // This allows mocking the stat func later on
 var statFunc = os.Stat
 
+// drivePrefix matches a path from the root of a Windows drive in a file URI, such as /C:/data/file.csv.
+var drivePrefix = regexp.MustCompile(`^/[a-zA-Z]:`)
+
 // IsLocalPath detects whether a path points to a file system accessiable file
 // If this file requires another protocol http protocol it will return false
 // If the file requires another protocol(ftp, https, etc) it will return an error
 func IsLocalPath(s string) (bool, error) {
-	u, err := url.Parse(s)
-	if err == nil {
+	_, local, err := LocalPath(s)
+	return local, err
+}
+
+// LocalPath detects whether s points to a local file or to a blob, like IsLocalPath(). For a local file, it also
+// returns the path to open, which is s translated from a URI if s is a file:// URI.
+// http, https and abfss URIs point to blobs. Other URIs are refused, except for file:// URIs, and so are relative paths
+// that look like one. Windows paths with a drive letter, such as C:\data\file.csv, and UNC paths, such as
+// \\server\share\file.csv, are local paths.
+func LocalPath(s string) (path string, local bool, err error) {
+	if s == "" {
+		return "", false, fmt.Errorf("the path is empty")
+	}
+
+	path = s
+	// A single letter scheme is a drive letter. UNC paths do not parse with a scheme.
+	if u, err := url.Parse(s); err == nil && len(u.Scheme) > 1 {
 		switch u.Scheme {
 		// With this we know it SHOULD be a blobstore path.  It might not be, but I think that is a fine assumption to make.
-		case "http", "https":
-			return false, nil
+		case "http", "https", "abfss":
+			return s, false, nil
+		case "file":
+			path, err = fileURIPath(u)
+			if err != nil {
+				return "", false, fmt.Errorf("%q is not a valid file URI: %w", s, err)
+			}
+		default:
+			return "", false, fmt.Errorf("%q has the unsupported scheme %q, only local paths and http, https and abfss URIs can be ingested; for a local file whose name has a colon, start the path with ./", s, u.Scheme)
 		}
 	}
 
 	// By this point, we know its not blobstore, so it needs to be something that gets resolved to a file.
 	// So we are going to Stat() the file and see if it exists and is not a directory.
-	// In your tests, this would fail "file://" which we don't support.  Also, because of this method, your tests
-	// are going to be broken.   Again, fileystems, blah....
-	stat, err := statFunc(s)
+	stat, err := statFunc(path)
 	if err != nil {
-		return false, fmt.Errorf("It is not a valid local file path (could not stat file) and not a valid blob path")
+		return "", false, fmt.Errorf("%q is not a valid local file path (could not stat file: %w) and not a valid blob path", s, err)
 	}
 
 	if stat.IsDir() {
-		return false, fmt.Errorf("path is a local directory and not a valid file")
+		return "", false, fmt.Errorf("%q is a local directory and not a valid file", s)
 	}
 
-	return true, nil
+	return path, true, nil
+}
+
+// fileURIPath returns the local path of the file URI u. A URI with a host other than localhost is a UNC path.
+func fileURIPath(u *url.URL) (string, error) {
+	if u.Opaque != "" || u.Path == "" {
+		return "", fmt.Errorf("the URI has no absolute path, it must be like file:///path/to/file")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("the URI has a query or a fragment, which local files cannot have")
+	}
+
+	switch {
+	case u.Host != "" && u.Host != "localhost":
+		return filepath.FromSlash("//" + u.Host + u.Path), nil
+	case drivePrefix.MatchString(u.Path):
+		return filepath.FromSlash(u.Path[1:]), nil
+	}
+	return filepath.FromSlash(u.Path), nil
 }
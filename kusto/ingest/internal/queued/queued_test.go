@@ -4,17 +4,33 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	goErrors "errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/retry"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/trace"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 )
 
@@ -28,7 +44,8 @@ func TestFormatDiscovery(t *testing.T) {
 		{".avro.zip", properties.AVRO},
 		{".AVRO.GZ", properties.AVRO},
 		{".csv", properties.CSV},
-		{".json", properties.JSON},
+		{".json", properties.MultiJSON},
+		{".JSON.gz", properties.MultiJSON},
 		{".orc", properties.ORC},
 		{".parquet", properties.Parquet},
 		{".psv", properties.PSV},
@@ -79,21 +96,45 @@ func TestCompressionDiscovery(t *testing.T) {
 }
 
 type fakeBlobstore struct {
-	out       *bytes.Buffer
-	shouldErr bool
+	out         *bytes.Buffer
+	shouldErr   bool
+	blockSize   int64
+	parallelism uint16
+	// failures is the number of uploads that read their data and fail, before the others succeed.
+	failures int
+	uploads  int
+	// metadata and tier are the ones of the last upload.
+	metadata map[string]string
+	tier     *azblob.AccessTier
+}
+
+// fail reports if the upload of reader fails, after reading it.
+func (f *fakeBlobstore) fail(reader io.Reader) bool {
+	f.uploads++
+	if f.uploads > f.failures {
+		return false
+	}
+	io.Copy(ioutil.Discard, reader)
+	return true
 }
 
 func (f *fakeBlobstore) uploadBlobStream(_ context.Context, reader io.Reader, _ azblob.BlockBlobClient,
-	_ azblob.UploadStreamToBlockBlobOptions) (azblob.BlockBlobCommitBlockListResponse, error) {
-	if f.shouldErr {
+	o azblob.UploadStreamToBlockBlobOptions) (azblob.BlockBlobCommitBlockListResponse, error) {
+	f.metadata = o.Metadata
+	f.tier = o.AccessTier
+	if f.shouldErr || f.fail(reader) {
 		return azblob.BlockBlobCommitBlockListResponse{}, fmt.Errorf("error")
 	}
 	_, err := io.Copy(f.out, reader)
 	return azblob.BlockBlobCommitBlockListResponse{}, err
 }
 
-func (f *fakeBlobstore) uploadBlobFile(_ context.Context, fi *os.File, _ azblob.BlockBlobClient, _ azblob.HighLevelUploadToBlockBlobOption) (*http.Response, error) {
-	if f.shouldErr {
+func (f *fakeBlobstore) uploadBlobFile(_ context.Context, fi *os.File, _ azblob.BlockBlobClient, o azblob.HighLevelUploadToBlockBlobOption) (*http.Response, error) {
+	f.blockSize = o.BlockSize
+	f.parallelism = o.Parallelism
+	f.metadata = o.Metadata
+	f.tier = o.AccessTier
+	if f.shouldErr || f.fail(fi) {
 		return nil, fmt.Errorf("error")
 	}
 	_, err := io.Copy(f.out, fi)
@@ -199,7 +240,8 @@ func TestLocalToBlob(t *testing.T) {
 			uploadBlob:   fbs.uploadBlobFile,
 		}
 
-		_, _, err := in.localToBlob(context.Background(), test.from, to, &properties.All{})
+		counts := &properties.ByteCounts{}
+		_, _, _, err := in.localToBlob(context.Background(), test.from, to, &properties.All{Source: properties.SourceOptions{Counts: counts}})
 		switch {
 		case err == nil && test.err:
 			t.Errorf("TestLocalToBlob(%s): got err == nil, want err != nil", test.desc)
@@ -211,6 +253,17 @@ func TestLocalToBlob(t *testing.T) {
 			continue
 		}
 
+		stat, err := os.Stat(test.from)
+		if err != nil {
+			panic(err)
+		}
+		if counts.Read() != stat.Size() {
+			t.Errorf("TestLocalToBlob(%s): got %d bytes read, want %d", test.desc, counts.Read(), stat.Size())
+		}
+		if counts.Uploaded() != int64(fbs.out.Len()) {
+			t.Errorf("TestLocalToBlob(%s): got %d bytes uploaded, want %d", test.desc, counts.Uploaded(), fbs.out.Len())
+		}
+
 		gotBuf := &bytes.Buffer{}
 		zr, err := gzip.NewReader(fbs.out)
 		if err != nil {
@@ -227,6 +280,591 @@ func TestLocalToBlob(t *testing.T) {
 	}
 }
 
+// failingReader returns size bytes and then fails with err.
+type failingReader struct {
+	size int
+	err  error
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	if f.size == 0 {
+		return 0, f.err
+	}
+	if len(b) > f.size {
+		b = b[:f.size]
+	}
+	for i := range b {
+		b[i] = 'a'
+	}
+	f.size -= len(b)
+	return len(b), nil
+}
+
+func TestCompressToBlobErrors(t *testing.T) {
+	// Not parallel, as it counts goroutines.
+
+	to, err := azblob.NewContainerClientWithNoCredential("https://account.blob.core.windows.net/container", nil)
+	if err != nil {
+		panic(err)
+	}
+	readErr := fmt.Errorf("disk failure")
+	uploadErr := fmt.Errorf("connection reset")
+
+	tests := []struct {
+		desc   string
+		src    io.Reader
+		upload uploadStream
+		want   errors.Kind
+		// cause is the error that the error returned wraps.
+		cause error
+	}{
+		{
+			desc: "Source fails mid-read",
+			src:  &failingReader{size: 4 * _1MiB, err: readErr},
+			upload: func(_ context.Context, reader io.Reader, _ azblob.BlockBlobClient, _ azblob.UploadStreamToBlockBlobOptions) (azblob.BlockBlobCommitBlockListResponse, error) {
+				_, err := io.Copy(ioutil.Discard, reader)
+				return azblob.BlockBlobCommitBlockListResponse{}, err
+			},
+			want:  errors.KLocalFileSystem,
+			cause: readErr,
+		},
+		{
+			desc: "Upload fails mid-upload",
+			// The source is never read to the end if the upload stops reading.
+			src: &failingReader{size: 1 << 40, err: io.EOF},
+			upload: func(_ context.Context, reader io.Reader, _ azblob.BlockBlobClient, _ azblob.UploadStreamToBlockBlobOptions) (azblob.BlockBlobCommitBlockListResponse, error) {
+				if _, err := io.CopyN(ioutil.Discard, reader, 64*1024); err != nil {
+					return azblob.BlockBlobCommitBlockListResponse{}, err
+				}
+				return azblob.BlockBlobCommitBlockListResponse{}, uploadErr
+			},
+			want:  errors.KBlobstore,
+			cause: uploadErr,
+		},
+	}
+
+	for _, test := range tests {
+		before := runtime.NumGoroutine()
+		in := &Ingestion{db: "database", table: "table", uploadStream: test.upload}
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := in.compressToBlob(context.Background(), test.src, to.NewBlockBlobClient("blob"), &properties.All{})
+			done <- err
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("TestCompressToBlobErrors(%s): did not return", test.desc)
+		}
+		if err == nil {
+			t.Errorf("TestCompressToBlobErrors(%s): got err == nil, want err != nil", test.desc)
+			continue
+		}
+		if got := err.(*errors.Error).Kind; got != test.want {
+			t.Errorf("TestCompressToBlobErrors(%s): got Kind %s, want %s: %s", test.desc, got, test.want, err)
+		}
+		if !goErrors.Is(err, test.cause) {
+			t.Errorf("TestCompressToBlobErrors(%s): got err %s, want it to wrap %q", test.desc, err, test.cause)
+		}
+
+		// The compressing goroutine stops once the upload returned.
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if after := runtime.NumGoroutine(); after > before {
+			t.Errorf("TestCompressToBlobErrors(%s): got %d goroutines after returning, want %d as before", test.desc, after, before)
+		}
+	}
+}
+
+func TestCompressToBlobConcurrent(t *testing.T) {
+	t.Parallel()
+
+	to, err := azblob.NewContainerClientWithNoCredential("https://account.blob.core.windows.net/container", nil)
+	if err != nil {
+		panic(err)
+	}
+	shared, err := New("database", "table", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	// Each upload checks its data while the other uploads reuse the buffers of the ones that finished.
+	var wg sync.WaitGroup
+	for n := 0; n < 32; n++ {
+		n := n
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			src := bytes.Repeat([]byte(fmt.Sprintf("%d,row\n", n)), 16*1024+n)
+			var got []byte
+			in := *shared
+			in.uploadStream = func(_ context.Context, reader io.Reader, _ azblob.BlockBlobClient, _ azblob.UploadStreamToBlockBlobOptions) (azblob.BlockBlobCommitBlockListResponse, error) {
+				zr, err := gzip.NewReader(reader)
+				if err != nil {
+					return azblob.BlockBlobCommitBlockListResponse{}, err
+				}
+				got, err = ioutil.ReadAll(zr)
+				return azblob.BlockBlobCommitBlockListResponse{}, err
+			}
+
+			_, err := in.compressToBlob(context.Background(), ioutil.NopCloser(bytes.NewReader(src)), to.NewBlockBlobClient("blob"), &properties.All{})
+			if err != nil {
+				t.Errorf("TestCompressToBlobConcurrent(%d): got err == %s, want err == nil", n, err)
+				return
+			}
+			if !bytes.Equal(got, src) {
+				t.Errorf("TestCompressToBlobConcurrent(%d): the uploaded data is not the source", n)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkCompressToBlob(b *testing.B) {
+	to, err := azblob.NewContainerClientWithNoCredential("https://account.blob.core.windows.net/container", nil)
+	if err != nil {
+		panic(err)
+	}
+	in, err := New("database", "table", nil)
+	if err != nil {
+		panic(err)
+	}
+	in.uploadStream = func(_ context.Context, reader io.Reader, _ azblob.BlockBlobClient, _ azblob.UploadStreamToBlockBlobOptions) (azblob.BlockBlobCommitBlockListResponse, error) {
+		_, err := io.Copy(ioutil.Discard, reader)
+		return azblob.BlockBlobCommitBlockListResponse{}, err
+	}
+	src := bytes.Repeat([]byte("a,kusto,ingestion,payload\n"), 4*1024)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(src)))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			// NopCloser hides bytes.Reader.WriteTo, as the readers of callers do.
+			if _, err := in.compressToBlob(context.Background(), ioutil.NopCloser(bytes.NewReader(src)), to.NewBlockBlobClient("blob"), &properties.All{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestUnreadFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "data.csv")
+	if err := ioutil.WriteFile(name, []byte("a,1\n"), 0600); err != nil {
+		panic(err)
+	}
+	open := func(name string) *os.File {
+		f, err := os.Open(name)
+		if err != nil {
+			panic(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+
+	read := open(name)
+	if _, err := read.Read(make([]byte, 1)); err != nil {
+		panic(err)
+	}
+
+	tests := []struct {
+		desc   string
+		reader io.Reader
+		want   bool
+	}{
+		{desc: "Unread file", reader: open(name), want: true},
+		{desc: "File that was read from", reader: read},
+		{desc: "Directory", reader: open(dir)},
+		{desc: "Not a file", reader: strings.NewReader("a,1\n")},
+	}
+
+	for _, test := range tests {
+		_, got := unreadFile(test.reader)
+		if got != test.want {
+			t.Errorf("TestUnreadFile(%s): got %t, want %t", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestFileToBlobSize(t *testing.T) {
+	t.Parallel()
+
+	to, err := azblob.NewContainerClientWithNoCredential("https://account.blob.core.windows.net/container", nil)
+	if err != nil {
+		panic(err)
+	}
+	content := bytes.Repeat([]byte("a,kusto,ingestion,payload\n"), 1024)
+	dir := t.TempDir()
+
+	for _, name := range []string{"data.csv", "data.csv.gz"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			panic(err)
+		}
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			panic(err)
+		}
+
+		fbs := &fakeBlobstore{out: &bytes.Buffer{}}
+		in := &Ingestion{db: "database", table: "table", uploadStream: fbs.uploadBlobStream, uploadBlob: fbs.uploadBlobFile}
+		blobName, _, size, err := in.fileToBlob(context.Background(), f, to, &properties.All{})
+		f.Close()
+		if err != nil {
+			t.Fatalf("TestFileToBlobSize(%s): got err == %s, want err == nil", name, err)
+		}
+		// The size is the one of the file, before compression.
+		if size != int64(len(content)) {
+			t.Errorf("TestFileToBlobSize(%s): got size %d, want %d", name, size, len(content))
+		}
+		if !strings.HasSuffix(blobName, "_data.csv.gz") {
+			t.Errorf("TestFileToBlobSize(%s): got blob name %q, want it to end with _data.csv.gz", name, blobName)
+		}
+	}
+}
+
+func TestStagingPrefix(t *testing.T) {
+	t.Parallel()
+
+	to, err := azblob.NewContainerClientWithNoCredential("https://account.blob.core.windows.net/container", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "*.csv")
+	if err != nil {
+		panic(err)
+	}
+	_ = f.Close()
+
+	fbs := &fakeBlobstore{out: &bytes.Buffer{}}
+	in, err := New("database", "table", nil, WithStagingPrefix("team/"))
+	if err != nil {
+		panic(err)
+	}
+	in.uploadStream = fbs.uploadBlobStream
+
+	_, got, _, err := in.localToBlob(context.Background(), f.Name(), to, &properties.All{})
+	if err != nil {
+		t.Fatalf("TestStagingPrefix: got err == %s, want err == nil", err)
+	}
+	assert.Contains(t, got, "/container/team/database_table_")
+}
+
+func TestBlobNameHint(t *testing.T) {
+	t.Parallel()
+
+	to, err := azblob.NewContainerClientWithNoCredential("https://account.blob.core.windows.net/container", nil)
+	if err != nil {
+		panic(err)
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"data.csv", "data.csv.gz"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("a,1\n"), 0600); err != nil {
+			panic(err)
+		}
+	}
+
+	tests := []struct {
+		desc string
+		hint string
+		from string
+		want *regexp.Regexp
+	}{
+		{
+			desc: "No hint",
+			from: "data.csv",
+			want: regexp.MustCompile(`^team/database_table_[^_]+_[0-9a-f-]{36}_data\.csv\.gz$`),
+		},
+		{
+			desc: "Hint",
+			hint: "customer-x_14.02",
+			from: "data.csv",
+			want: regexp.MustCompile(`^team/database_table_customer-x_14\.02_[^_]+_[0-9a-f-]{36}_data\.csv\.gz$`),
+		},
+		{
+			desc: "Compressed file keeps its extension",
+			hint: "customer",
+			from: "data.csv.gz",
+			want: regexp.MustCompile(`^team/database_table_customer_[^_]+_[0-9a-f-]{36}_data\.csv\.gz$`),
+		},
+		{
+			desc: "Slashes do not make directories",
+			hint: "../customer/x\\y",
+			from: "data.csv",
+			want: regexp.MustCompile(`^team/database_table_\.\._customer_x_y_[^_]+_[0-9a-f-]{36}_data\.csv\.gz$`),
+		},
+		{
+			desc: "Unicode and control characters",
+			hint: "клиент 客户\n?#%",
+			from: "data.csv",
+			want: regexp.MustCompile(`^team/database_table_` + strings.Repeat("_", 13) + `_[^_]+_[0-9a-f-]{36}_data\.csv\.gz$`),
+		},
+		{
+			desc: "Long hint is cut",
+			hint: strings.Repeat("a", 2000),
+			from: "data.csv",
+			want: regexp.MustCompile(`^team/database_table_a{128}_[^_]+_[0-9a-f-]{36}_data\.csv\.gz$`),
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			fbs := &fakeBlobstore{out: &bytes.Buffer{}}
+			in, err := New("database", "table", nil, WithStagingPrefix("team/"))
+			if err != nil {
+				panic(err)
+			}
+			in.uploadStream = fbs.uploadBlobStream
+			in.uploadBlob = fbs.uploadBlobFile
+			props := &properties.All{Source: properties.SourceOptions{BlobNameHint: test.hint}}
+			got, _, _, err := in.localToBlob(context.Background(), filepath.Join(dir, test.from), to, props)
+			if err != nil {
+				t.Fatalf("TestBlobNameHint(%s): got err == %s, want err == nil", test.desc, err)
+			}
+			if !test.want.MatchString(got) {
+				t.Errorf("TestBlobNameHint(%s): got blob name %q, want it to match %s", test.desc, got, test.want)
+			}
+			if len(got) > 1024 {
+				t.Errorf("TestBlobNameHint(%s): got a blob name of %d characters, want at most 1024", test.desc, len(got))
+			}
+		})
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	t.Parallel()
+
+	to, err := azblob.NewContainerClientWithNoCredential("https://account.blob.core.windows.net/container", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "*.csv.gz")
+	if err != nil {
+		panic(err)
+	}
+	_ = f.Close()
+
+	for _, test := range []struct {
+		options         []Option
+		want            int64
+		wantParallelism uint16
+	}{
+		{want: BlockSize, wantParallelism: Concurrency},
+		{options: []Option{WithStaticBuffer(1024, 0)}, want: 1024, wantParallelism: Concurrency},
+		{options: []Option{WithStaticBuffer(16*_1MiB, 0), WithUploadParallelism(4)}, want: 16 * _1MiB, wantParallelism: 4},
+	} {
+		fbs := &fakeBlobstore{out: &bytes.Buffer{}}
+		in, err := New("database", "table", nil, test.options...)
+		if err != nil {
+			panic(err)
+		}
+		in.uploadBlob = fbs.uploadBlobFile
+
+		if _, _, _, err := in.localToBlob(context.Background(), f.Name(), to, &properties.All{}); err != nil {
+			t.Fatalf("TestBlockSize: got err == %s, want err == nil", err)
+		}
+		assert.Equal(t, test.want, fbs.blockSize)
+		assert.Equal(t, test.wantParallelism, fbs.parallelism)
+	}
+}
+
+func TestStreamTransferManager(t *testing.T) {
+	var gotSize, gotConcurrency int
+	newSyncPool = func(size, concurrency int) (azblob.TransferManager, error) {
+		gotSize, gotConcurrency = size, concurrency
+		return azblob.NewSyncPool(size, concurrency)
+	}
+	t.Cleanup(func() {
+		newSyncPool = azblob.NewSyncPool
+	})
+
+	if _, err := New("database", "table", nil); err != nil {
+		t.Fatalf("TestStreamTransferManager: New(): %s", err)
+	}
+	assert.Equal(t, BlockSize, gotSize)
+	assert.Equal(t, Concurrency, gotConcurrency)
+
+	if _, err := New("database", "table", nil, WithStaticBuffer(2*_1MiB, 0), WithUploadParallelism(8)); err != nil {
+		t.Fatalf("TestStreamTransferManager: New(): %s", err)
+	}
+	assert.Equal(t, 2*_1MiB, gotSize)
+	assert.Equal(t, 8, gotConcurrency)
+}
+
+// fakeCredential returns token, or fails with err, recording the scopes it was asked for.
+type fakeCredential struct {
+	token  string
+	err    error
+	scopes []string
+}
+
+func (f *fakeCredential) GetToken(_ context.Context, options policy.TokenRequestOptions) (*azcore.AccessToken, error) {
+	f.scopes = options.Scopes
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &azcore.AccessToken{Token: f.token, ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// fakeManager returns a resources.Manager with a container and a queue, with sas as their shared access signature.
+func fakeManager(t *testing.T, sas string) *resources.Manager {
+	var rows []value.Values
+	for _, r := range [][2]string{
+		{"TempStorage", "https://account.blob.core.windows.net/container" + sas},
+		{"SecuredReadyForAggregationQueue", "https://account.queue.core.windows.net/queue" + sas},
+	} {
+		rows = append(rows, value.Values{value.String{Value: r[0], Valid: true}, value.String{Value: r[1], Valid: true}})
+	}
+	mgr, err := resources.New(resources.FakeResources(rows, false), resources.WithoutStatusTables())
+	if err != nil {
+		t.Fatalf("resources.New(): %s", err)
+	}
+	t.Cleanup(mgr.Close)
+	return mgr
+}
+
+func TestTokenCredential(t *testing.T) {
+	t.Parallel()
+
+	const blobURL = "https://account.blob.core.windows.net/container/blob.csv.gz"
+
+	tests := []struct {
+		desc string
+		sas  string
+		cred *fakeCredential
+		// wantContainer and wantQueue are the URLs that the clients are made with, wantMessage is the blob URI in the
+		// ingestion message. Without a credential, the container only needs to have the SAS.
+		wantContainer string
+		wantQueue     string
+		wantMessage   string
+		err           bool
+	}{
+		{
+			desc:        "SAS for upload and message",
+			sas:         "?sig=secret",
+			wantQueue:   "https://account.queue.core.windows.net/queue/messages?sig=secret",
+			wantMessage: blobURL,
+		},
+		{
+			desc:          "Token for upload, SAS for message",
+			sas:           "?sig=secret",
+			cred:          &fakeCredential{token: "token"},
+			wantContainer: "https://account.blob.core.windows.net/container",
+			wantQueue:     "https://account.queue.core.windows.net/queue/messages",
+			wantMessage:   blobURL + "?sig=secret",
+		},
+		{
+			desc:          "Token without SAS",
+			cred:          &fakeCredential{token: "token"},
+			wantContainer: "https://account.blob.core.windows.net/container",
+			wantQueue:     "https://account.queue.core.windows.net/queue/messages",
+			wantMessage:   blobURL,
+		},
+		{
+			desc: "Token failure",
+			sas:  "?sig=secret",
+			cred: &fakeCredential{err: fmt.Errorf("no identity")},
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var options []Option
+			if test.cred != nil {
+				options = append(options, WithTokenCredential(test.cred))
+			}
+			in, err := New("database", "table", fakeManager(t, test.sas), options...)
+			if err != nil {
+				panic(err)
+			}
+
+			queue, err := in.upstreamQueue(context.Background())
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			gotQueue := queue.URL()
+			assert.Equal(t, test.wantQueue, gotQueue.String())
+
+			container, storageURI, err := in.upstreamContainer()
+			assert.NoError(t, err)
+			if test.cred == nil {
+				assert.Contains(t, container.URL(), "sig=secret")
+			} else {
+				assert.Equal(t, test.wantContainer, container.URL())
+				assert.Equal(t, []string{storageScope}, test.cred.scopes)
+			}
+			assert.Equal(t, test.wantMessage, in.messageURL(blobURL, storageURI))
+		})
+	}
+}
+
+// roundTripFunc is a function that implements http.RoundTripper.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu   sync.Mutex
+		reqs []*http.Request
+	)
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		body := `<?xml version="1.0" encoding="utf-8"?><QueueMessagesList><QueueMessage><MessageId>id</MessageId>` +
+			`<PopReceipt>receipt</PopReceipt></QueueMessage></QueueMessagesList>`
+		return &http.Response{
+			StatusCode: http.StatusCreated,
+			Status:     "201 Created",
+			Header:     http.Header{"Content-Type": []string{"application/xml"}},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})}
+
+	in, err := New("database", "table", fakeManager(t, "?sig=secret"), WithHTTPClient(client))
+	if err != nil {
+		panic(err)
+	}
+
+	// The posts to the queue are sent with the client.
+	queue, err := in.upstreamQueue(context.Background())
+	assert.NoError(t, err)
+	_, err = queue.Enqueue(context.Background(), "message", 0, 0)
+	assert.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, reqs, 1) {
+		assert.Equal(t, "account.queue.core.windows.net", reqs[0].URL.Host)
+		assert.Equal(t, "/queue/messages", reqs[0].URL.Path)
+		assert.Equal(t, "secret", reqs[0].URL.Query().Get("sig"))
+	}
+}
+
 type fileInfo struct {
 	os.FileInfo
 	isDir bool
@@ -236,10 +874,24 @@ func (f fileInfo) IsDir() bool {
 	return f.isDir
 }
 
+// localFiles are the files that fakeStat finds, with either path separator.
+var localFiles = []string{
+	"c:\\dir\\file",
+	"C:/data/x.csv",
+	"c:x.csv",
+	`\\fileserver\share\data\x.csv`,
+	"//fileserver/share/data/x.csv",
+	"/mnt/data/x.csv",
+	"./data:x.csv",
+}
+
 func fakeStat(name string) (os.FileInfo, error) {
+	for _, f := range localFiles {
+		if filepath.ToSlash(f) == filepath.ToSlash(name) {
+			return fileInfo{}, nil
+		}
+	}
 	switch name {
-	case "c:\\dir\\file":
-		return fileInfo{}, nil
 	case "/mnt/dir/":
 		return fileInfo{isDir: true}, nil
 	}
@@ -253,14 +905,25 @@ func TestIsLocalPath(t *testing.T) {
 	})
 
 	tests := []struct {
-		desc string
-		path string
-		err  bool
-		want bool
+		desc     string
+		path     string
+		err      bool
+		want     bool
+		wantPath string
 	}{
 		{
 			desc: "error: valid path to local dir",
-			path: "/mnt/dir",
+			path: "/mnt/dir/",
+			err:  true,
+		},
+		{
+			desc: "error: missing local file",
+			path: "/mnt/data/missing.csv",
+			err:  true,
+		},
+		{
+			desc: "error: empty path",
+			path: "",
 			err:  true,
 		},
 		{
@@ -268,6 +931,21 @@ func TestIsLocalPath(t *testing.T) {
 			path: "ftp://some.ftp.com",
 			err:  true,
 		},
+		{
+			desc: "error: unsupported scheme that could be a relative path",
+			path: "data:x.csv",
+			err:  true,
+		},
+		{
+			desc: "error: relative file URI",
+			path: "file:data/x.csv",
+			err:  true,
+		},
+		{
+			desc: "error: file URI with a query",
+			path: "file:///mnt/data/x.csv?version=1",
+			err:  true,
+		},
 		{
 			desc: "success: valid http path",
 			path: "http://some.http.com/path",
@@ -279,9 +957,74 @@ func TestIsLocalPath(t *testing.T) {
 			want: false,
 		},
 		{
-			desc: "success: valid path to local file",
-			path: "c:\\dir\\file",
-			want: true,
+			desc: "success: upper case https path",
+			path: "HTTPS://some.https.com/path",
+			want: false,
+		},
+		{
+			desc: "success: valid abfss path",
+			path: "abfss://container@account.dfs.core.windows.net/path/x.csv",
+			want: false,
+		},
+		{
+			desc:     "success: valid path to local file",
+			path:     "c:\\dir\\file",
+			want:     true,
+			wantPath: "c:\\dir\\file",
+		},
+		{
+			desc:     "success: drive letter with forward slashes",
+			path:     "C:/data/x.csv",
+			want:     true,
+			wantPath: "C:/data/x.csv",
+		},
+		{
+			desc:     "success: drive relative path",
+			path:     "c:x.csv",
+			want:     true,
+			wantPath: "c:x.csv",
+		},
+		{
+			desc:     "success: UNC path",
+			path:     `\\fileserver\share\data\x.csv`,
+			want:     true,
+			wantPath: `\\fileserver\share\data\x.csv`,
+		},
+		{
+			desc:     "success: POSIX path",
+			path:     "/mnt/data/x.csv",
+			want:     true,
+			wantPath: "/mnt/data/x.csv",
+		},
+		{
+			desc:     "success: relative path with a colon",
+			path:     "./data:x.csv",
+			want:     true,
+			wantPath: "./data:x.csv",
+		},
+		{
+			desc:     "success: file URI with a drive letter",
+			path:     "file:///C:/data/x.csv",
+			want:     true,
+			wantPath: filepath.FromSlash("C:/data/x.csv"),
+		},
+		{
+			desc:     "success: file URI with a POSIX path",
+			path:     "file:///mnt/data/x.csv",
+			want:     true,
+			wantPath: filepath.FromSlash("/mnt/data/x.csv"),
+		},
+		{
+			desc:     "success: file URI on localhost",
+			path:     "file://localhost/mnt/data/x.csv",
+			want:     true,
+			wantPath: filepath.FromSlash("/mnt/data/x.csv"),
+		},
+		{
+			desc:     "success: file URI with a host is a UNC path",
+			path:     "file://fileserver/share/data/x.csv",
+			want:     true,
+			wantPath: filepath.FromSlash("//fileserver/share/data/x.csv"),
 		},
 	}
 
@@ -291,15 +1034,516 @@ func TestIsLocalPath(t *testing.T) {
 			t.Parallel()
 
 			got, err := IsLocalPath(test.path)
+			gotPath, gotLocal, pathErr := LocalPath(test.path)
 
 			if test.err {
 				assert.Error(t, err)
+				assert.Error(t, pathErr)
 				return
 			}
 
 			assert.NoError(t, err)
+			assert.NoError(t, pathErr)
 
 			assert.Equal(t, test.want, got)
+			assert.Equal(t, test.want, gotLocal)
+			if test.want {
+				assert.Equal(t, test.wantPath, gotPath)
+			}
+		})
+	}
+}
+
+// queueTransport answers the posts to the queue, with 403 Forbidden while fail is set. The first unavailable posts
+// are answered with 503 Service Unavailable.
+type queueTransport struct {
+	mu          sync.Mutex
+	fail        bool
+	unavailable int
+	posts       int
+	messages    []string
+}
+
+func (q *queueTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.posts++; q.posts <= q.unavailable {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Status:     "503 Service Unavailable",
+			Header:     http.Header{"Content-Type": []string{"application/xml"}, "X-Ms-Error-Code": []string{"ServerBusy"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`<?xml version="1.0" encoding="utf-8"?><Error><Code>ServerBusy</Code></Error>`)),
+			Request:    req,
+		}, nil
+	}
+	if q.fail {
+		return &http.Response{
+			StatusCode: http.StatusForbidden,
+			Status:     "403 Forbidden",
+			Header:     http.Header{"Content-Type": []string{"application/xml"}, "X-Ms-Error-Code": []string{"AuthorizationFailure"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`<?xml version="1.0" encoding="utf-8"?><Error><Code>AuthorizationFailure</Code></Error>`)),
+			Request:    req,
+		}, nil
+	}
+	q.messages = append(q.messages, string(body))
+	return &http.Response{
+		StatusCode: http.StatusCreated,
+		Status:     "201 Created",
+		Header:     http.Header{"Content-Type": []string{"application/xml"}},
+		Body: ioutil.NopCloser(strings.NewReader(`<?xml version="1.0" encoding="utf-8"?><QueueMessagesList><QueueMessage>` +
+			`<MessageId>id</MessageId><PopReceipt>receipt</PopReceipt></QueueMessage></QueueMessagesList>`)),
+		Request: req,
+	}, nil
+}
+
+// ingestionMessage returns the ingestion properties in the XML body of a post to the queue.
+func ingestionMessage(t *testing.T, body string) map[string]interface{} {
+	t.Helper()
+
+	m := regexp.MustCompile(`<MessageText>(.*)</MessageText>`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("no MessageText in %q", body)
+	}
+	j, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		t.Fatalf("MessageText is not base64: %s", err)
+	}
+	msg := map[string]interface{}{}
+	if err := json.Unmarshal(j, &msg); err != nil {
+		t.Fatalf("MessageText is not JSON: %s", err)
+	}
+	return msg
+}
+
+func TestEnqueueFailure(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		// deleteBlob is set for the DeleteBlobOnEnqueueFailure() option, and deleteErr is the error of deleting the blob.
+		deleteBlob   bool
+		deleteErr    error
+		wantUploaded bool
+	}{
+		{desc: "Blob kept", wantUploaded: true},
+		{desc: "Blob deleted", deleteBlob: true},
+		{desc: "Blob could not be deleted", deleteBlob: true, deleteErr: fmt.Errorf("delete failed"), wantUploaded: true},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			queue := &queueTransport{fail: true}
+			in, err := New("database", "table", fakeManager(t, "?sig=secret"), WithHTTPClient(&http.Client{Transport: queue}))
+			if err != nil {
+				panic(err)
+			}
+			fbs := &fakeBlobstore{out: &bytes.Buffer{}}
+			in.uploadStream = fbs.uploadBlobStream
+			var deleted []string
+			in.deleteBlob = func(_ context.Context, client azblob.BlockBlobClient) error {
+				deleted = append(deleted, client.URL())
+				return test.deleteErr
+			}
+
+			props := properties.All{
+				Ingestion: properties.Ingestion{
+					DatabaseName: "database",
+					TableName:    "table",
+					Additional:   properties.Additional{Format: properties.CSV, AuthContext: "authorization_context"},
+				},
+				Source: properties.SourceOptions{DeleteBlobOnEnqueueFailure: test.deleteBlob, Counts: &properties.ByteCounts{}},
+			}
+			blobName, err := in.Reader(context.Background(), strings.NewReader("a,b\n"), props)
+			if !assert.Error(t, err) {
+				return
+			}
+			assert.NotEmpty(t, fbs.out.Bytes(), "the data should be uploaded before the post to the queue")
+
+			assert.Equal(t, errors.KBlobstore, err.(*errors.Error).Kind)
+			assert.False(t, errors.Retryable(err), "a 403 of the queue is not transient")
+
+			var enqueueErr *EnqueueError
+			if !assert.True(t, goErrors.As(err, &enqueueErr), "got %T: %s", err, err) {
+				return
+			}
+			assert.Equal(t, test.wantUploaded, enqueueErr.AlreadyUploaded)
+			blobURI, err := url.Parse(enqueueErr.BlobURI)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "/container/"+blobName, blobURI.Path)
+			}
+			assert.Contains(t, enqueueErr.BlobURI, "sig=secret", "the service needs the SAS to read the blob")
+			assert.NotContains(t, (&EnqueueError{BlobURI: enqueueErr.BlobURI, Err: fmt.Errorf("failed")}).Error(), "sig=secret")
+			if test.deleteBlob {
+				assert.Equal(t, []string{enqueueErr.BlobURI}, deleted)
+			} else {
+				assert.Empty(t, deleted)
+			}
+			if !enqueueErr.AlreadyUploaded {
+				return
+			}
+
+			// The blob is queued again without uploading the data again.
+			queue.mu.Lock()
+			queue.fail = false
+			queue.mu.Unlock()
+			uploaded := fbs.out.Len()
+			assert.NoError(t, in.Blob(context.Background(), enqueueErr.BlobURI, enqueueErr.Size, props))
+			assert.Equal(t, uploaded, fbs.out.Len())
+			if assert.Len(t, queue.messages, 1) {
+				msg := ingestionMessage(t, queue.messages[0])
+				assert.Equal(t, enqueueErr.BlobURI, msg["BlobPath"])
+			}
+		})
+	}
+}
+
+func TestSpans(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc      string
+		failQueue bool
+	}{
+		{desc: "Success"},
+		{desc: "Post to the queue fails", failQueue: true},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "data.csv")
+			if err := ioutil.WriteFile(path, []byte("a,b\nc,d\n"), 0644); err != nil {
+				panic(err)
+			}
+
+			rec := &trace.Recorder{}
+			queue := &queueTransport{fail: test.failQueue}
+			in, err := New("database", "table", fakeManager(t, "?sig=secret"), WithHTTPClient(&http.Client{Transport: queue}), WithSpanTracer(rec))
+			if err != nil {
+				panic(err)
+			}
+			fbs := &fakeBlobstore{out: &bytes.Buffer{}}
+			in.uploadStream = fbs.uploadBlobStream
+
+			props := properties.All{
+				Ingestion: properties.Ingestion{
+					DatabaseName: "database",
+					TableName:    "table",
+					Additional:   properties.Additional{Format: properties.CSV, AuthContext: "authorization_context"},
+				},
+				Source: properties.SourceOptions{Counts: &properties.ByteCounts{}},
+			}
+			ctx, root := rec.Root(context.Background(), "caller")
+			blobName, err := in.Local(ctx, path, props)
+			if test.failQueue {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			spans := rec.Spans()
+			if !assert.Len(t, spans, 3) {
+				return
+			}
+			upload, enqueue := spans[1], spans[2]
+
+			assert.Equal(t, trace.Upload, upload.Name)
+			assert.Same(t, root, upload.Parent)
+			assert.True(t, upload.Ended)
+			assert.NoError(t, upload.Err)
+			assert.Equal(t, blobName, upload.Attrs[trace.BlobName])
+			assert.Equal(t, int64(fbs.out.Len()), upload.Attrs[trace.BlobBytes])
+			assert.Equal(t, "database", upload.Attrs[trace.DBNamespace])
+
+			assert.Equal(t, trace.Enqueue, enqueue.Name)
+			assert.Same(t, root, enqueue.Parent, "the post to the queue is not part of the upload")
+			assert.True(t, enqueue.Ended)
+			assert.Equal(t, "queue", enqueue.Attrs[trace.MessagingDestination])
+			assert.Equal(t, "account.queue.core.windows.net", enqueue.Attrs[trace.ServerAddress])
+			if test.failQueue {
+				assert.Error(t, enqueue.Err)
+			} else {
+				assert.NoError(t, enqueue.Err)
+			}
+		})
+	}
+}
+
+func TestRetryPolicies(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("a,b\nc,d\n")
+	retries := retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3}
+
+	tests := []struct {
+		desc           string
+		upload         retry.Policy
+		enqueue        retry.Policy
+		uploadFailures int
+		unavailable    int
+		err            bool
+		wantUploads    int
+		wantPosts      int
+	}{
+		{desc: "No retries by default", uploadFailures: 1, err: true, wantUploads: 1},
+		{desc: "Upload retried", upload: retries, uploadFailures: 2, wantUploads: 3, wantPosts: 1},
+		{desc: "Upload gives up", upload: retries, uploadFailures: 3, err: true, wantUploads: 3},
+		{desc: "Post to the queue retried", enqueue: retries, unavailable: 2, wantUploads: 1, wantPosts: 3},
+		{desc: "Post to the queue gives up", enqueue: retries, unavailable: 3, err: true, wantUploads: 1, wantPosts: 3},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "data.csv")
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				panic(err)
+			}
+
+			queue := &queueTransport{unavailable: test.unavailable}
+			in, err := New("database", "table", fakeManager(t, "?sig=secret"), WithHTTPClient(&http.Client{Transport: queue}), WithRetryPolicies(test.upload, test.enqueue))
+			if err != nil {
+				panic(err)
+			}
+			fbs := &fakeBlobstore{out: &bytes.Buffer{}, failures: test.uploadFailures}
+			in.uploadStream = fbs.uploadBlobStream
+
+			counts := &properties.ByteCounts{}
+			props := properties.All{
+				Ingestion: properties.Ingestion{
+					DatabaseName: "database",
+					TableName:    "table",
+					Additional:   properties.Additional{Format: properties.CSV, AuthContext: "authorization_context"},
+				},
+				Source: properties.SourceOptions{Counts: counts},
+			}
+			_, err = in.Local(context.Background(), path, props)
+			if test.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.wantUploads, fbs.uploads)
+			assert.Equal(t, test.wantPosts, queue.posts, "the storage SDK should not retry the posts itself")
+
+			if test.err {
+				return
+			}
+			// The upload that succeeded read the file from its start, and only its bytes are counted.
+			zr, err := gzip.NewReader(bytes.NewReader(fbs.out.Bytes()))
+			if assert.NoError(t, err) {
+				got, err := ioutil.ReadAll(zr)
+				assert.NoError(t, err)
+				assert.Equal(t, data, got)
+			}
+			assert.Equal(t, int64(len(data)), counts.Read())
+			assert.Equal(t, int64(fbs.out.Len()), counts.Uploaded())
 		})
 	}
 }
+
+func TestBeforeEnqueue(t *testing.T) {
+	t.Parallel()
+
+	props := properties.All{
+		Ingestion: properties.Ingestion{
+			DatabaseName: "database",
+			TableName:    "table",
+			Additional:   properties.Additional{Format: properties.CSV, AuthContext: "authorization_context"},
+		},
+	}
+
+	for _, fail := range []bool{false, true} {
+		queue := &queueTransport{}
+		var before []string
+		in, err := New("database", "table", fakeManager(t, "?sig=secret"), WithHTTPClient(&http.Client{Transport: queue}),
+			WithBeforeEnqueue(func(blobURI string, size int64, props properties.All) error {
+				before = append(before, blobURI)
+				assert.Equal(t, int64(10), size)
+				assert.Equal(t, "table", props.Ingestion.TableName)
+				assert.Equal(t, 0, queue.posts, "the hook is called before the post")
+				if fail {
+					return fmt.Errorf("journal full")
+				}
+				return nil
+			}),
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		err = in.Blob(context.Background(), "https://account.blob.core.windows.net/container/data.csv?sig=secret", 10, props)
+		assert.Equal(t, []string{"https://account.blob.core.windows.net/container/data.csv?sig=secret"}, before)
+		if fail {
+			assert.Error(t, err)
+			assert.False(t, errors.Retryable(err))
+			assert.Equal(t, 0, queue.posts, "the message is not posted when the hook fails")
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, 1, queue.posts)
+		}
+	}
+}
+
+func TestReaderCompression(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte(`{"deviceId":"device-1","level":"info","temperature":21.5}`+"\n"), 4*1024)
+	props := func(level int) properties.All {
+		return properties.All{
+			Ingestion: properties.Ingestion{
+				DatabaseName: "database",
+				TableName:    "table",
+				Additional:   properties.Additional{Format: properties.JSON, AuthContext: "authorization_context"},
+			},
+			Source: properties.SourceOptions{CompressionLevel: level, CompressionLevelSet: true},
+		}
+	}
+
+	var messages []map[string]interface{}
+	sizes := map[int]int{}
+	for _, test := range []struct {
+		level  int
+		buffer int
+	}{{gzip.BestSpeed, 0}, {gzip.DefaultCompression, 0}, {gzip.BestCompression, 0}, {gzip.BestCompression, 4 * 1024}} {
+		queue := &queueTransport{}
+		in, err := New("database", "table", fakeManager(t, "?sig=secret"), WithHTTPClient(&http.Client{Transport: queue}), WithCompressionBuffer(test.buffer))
+		if err != nil {
+			panic(err)
+		}
+		fbs := &fakeBlobstore{out: &bytes.Buffer{}}
+		in.uploadStream = fbs.uploadBlobStream
+
+		blobName, err := in.Reader(context.Background(), ioutil.NopCloser(bytes.NewReader(data)), props(test.level))
+		if err != nil {
+			t.Fatalf("TestReaderCompression(%d): got err == %s, want err == nil", test.level, err)
+		}
+		assert.Regexp(t, `^database_table_.+_[0-9a-f-]{36}\.gz$`, blobName, "the level does not change the name of the blob")
+
+		zr, err := gzip.NewReader(bytes.NewReader(fbs.out.Bytes()))
+		if err != nil {
+			t.Fatalf("TestReaderCompression(%d): gzip.NewReader() got err == %s, want err == nil", test.level, err)
+		}
+		got, err := ioutil.ReadAll(zr)
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+		if test.buffer == 0 {
+			sizes[test.level] = fbs.out.Len()
+		} else {
+			assert.Equal(t, sizes[test.level], fbs.out.Len(), "the buffer size does not change the compressed data")
+		}
+
+		if !assert.Len(t, queue.messages, 1) {
+			return
+		}
+		msg := ingestionMessage(t, queue.messages[0])
+		for _, key := range []string{"Id", "BlobPath", "SourceMessageCreationTime"} {
+			delete(msg, key)
+		}
+		messages = append(messages, msg)
+	}
+
+	assert.Less(t, sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+	for _, msg := range messages[1:] {
+		assert.Equal(t, messages[0], msg, "the level does not change the ingestion message")
+	}
+}
+
+func TestBlobMetadata(t *testing.T) {
+	t.Parallel()
+
+	to, err := azblob.NewContainerClientWithNoCredential("https://account.blob.core.windows.net/container", nil)
+	if err != nil {
+		panic(err)
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"data.csv", "data.csv.gz"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("a,b\n"), 0600); err != nil {
+			panic(err)
+		}
+	}
+
+	metadata := map[string]string{"costCenter": "1234", "classification": "confidential"}
+	source := properties.SourceOptions{BlobMetadata: metadata, BlobTier: "Cool"}
+	cool := azblob.AccessTierCool
+
+	// A file that is compressed while it is uploaded, and one that is uploaded as it is.
+	for _, name := range []string{"data.csv", "data.csv.gz"} {
+		for _, test := range []struct {
+			source       properties.SourceOptions
+			wantMetadata map[string]string
+			wantTier     *azblob.AccessTier
+		}{
+			{source: source, wantMetadata: metadata, wantTier: &cool},
+			{},
+		} {
+			fbs := &fakeBlobstore{out: &bytes.Buffer{}}
+			in, err := New("database", "table", nil)
+			if err != nil {
+				panic(err)
+			}
+			in.uploadStream = fbs.uploadBlobStream
+			in.uploadBlob = fbs.uploadBlobFile
+
+			props := &properties.All{Source: test.source}
+			if _, _, _, err := in.localToBlob(context.Background(), filepath.Join(dir, name), to, props); err != nil {
+				t.Fatalf("TestBlobMetadata(%s): got err == %s, want err == nil", name, err)
+			}
+			assert.Equal(t, test.wantMetadata, fbs.metadata, name)
+			assert.Equal(t, test.wantTier, fbs.tier, name)
+		}
+	}
+
+	// The data of a reader, whose queue message is the same as without the options.
+	var messages []map[string]interface{}
+	for _, test := range []struct {
+		source       properties.SourceOptions
+		wantMetadata map[string]string
+		wantTier     *azblob.AccessTier
+	}{
+		{source: source, wantMetadata: metadata, wantTier: &cool},
+		{},
+	} {
+		queue := &queueTransport{}
+		in, err := New("database", "table", fakeManager(t, "?sig=secret"), WithHTTPClient(&http.Client{Transport: queue}))
+		if err != nil {
+			panic(err)
+		}
+		fbs := &fakeBlobstore{out: &bytes.Buffer{}}
+		in.uploadStream = fbs.uploadBlobStream
+
+		props := properties.All{
+			Ingestion: properties.Ingestion{
+				DatabaseName: "database",
+				TableName:    "table",
+				Additional:   properties.Additional{Format: properties.CSV, AuthContext: "authorization_context"},
+			},
+			Source: test.source,
+		}
+		if _, err := in.Reader(context.Background(), ioutil.NopCloser(strings.NewReader("a,b\n")), props); err != nil {
+			t.Fatalf("TestBlobMetadata(reader): got err == %s, want err == nil", err)
+		}
+		assert.Equal(t, test.wantMetadata, fbs.metadata)
+		assert.Equal(t, test.wantTier, fbs.tier)
+
+		if !assert.Len(t, queue.messages, 1) {
+			return
+		}
+		msg := ingestionMessage(t, queue.messages[0])
+		for _, key := range []string{"Id", "BlobPath", "SourceMessageCreationTime"} {
+			delete(msg, key)
+		}
+		messages = append(messages, msg)
+	}
+	assert.Equal(t, messages[1], messages[0], "the metadata and the tier are not sent to Kusto")
+}
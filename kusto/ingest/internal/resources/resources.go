@@ -13,11 +13,14 @@ import (
 	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto"
+	kustoErrors "github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/retry"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/trace"
 )
 
-// mgmter is a private interface that allows us to write hermetic tests against the kusto.Client.Mgmt() method.
-type mgmter interface {
+// Mgmter is an interface that allows us to write hermetic tests against the kusto.Client.Mgmt() method.
+type Mgmter interface {
 	Mgmt(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error)
 }
 
@@ -36,9 +39,14 @@ type URI struct {
 
 // parse parses a string representing a Kutso resource URI.
 func parse(uri string) (*URI, error) {
-	// Regex representing URI that is expected:
-	// https://(\w+).(queue|blob|table).core.windows.net/([\w,-]+)\?(.*)
+	return parseAs(uri, "")
+}
 
+// parseAs parses a string representing a Kusto resource URI, which is of objectType if its host does not say.
+// The URI is expected to be https://<account>.[<labels>.]<queue|blob|table>.<domain>/<object name>?<SAS>, where the
+// domain can be that of any cloud, such as core.windows.net or core.chinacloudapi.cn, and labels can be
+// "privatelink". A custom domain without the object type, https://<account>.<domain>/<object name>, is also accepted.
+func parseAs(uri string, objectType string) (*URI, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
@@ -48,20 +56,22 @@ func parse(uri string) (*URI, error) {
 		return nil, fmt.Errorf("URI scheme must be 'https', was '%s'", u.Scheme)
 	}
 
-	if !strings.HasSuffix(u.Hostname(), ".core.windows.net") {
-		return nil, fmt.Errorf("URI hostname does not end with '.core.windows.net'")
-	}
-
 	hostSplit := strings.Split(u.Hostname(), ".")
-	if len(hostSplit) != 5 {
-		return nil, fmt.Errorf("URI(%s) is invalid: had incorrect URL path before '.core.windows.net'", uri)
+	if len(hostSplit) < 2 {
+		return nil, fmt.Errorf("URI(%s) is invalid: the hostname must start with the account name, followed by a domain", uri)
+	}
+	for _, label := range hostSplit[1:] {
+		if objectTypes[label] {
+			objectType = label
+			break
+		}
 	}
 
 	v := &URI{
 		u:          u,
 		account:    hostSplit[0],
-		objectType: hostSplit[1],
-		objectName: strings.TrimLeft(u.EscapedPath(), "/"),
+		objectType: objectType,
+		objectName: strings.SplitN(strings.TrimLeft(u.EscapedPath(), "/"), "/", 2)[0],
 		sas:        u.Query(),
 	}
 
@@ -72,6 +82,23 @@ func parse(uri string) (*URI, error) {
 	return v, nil
 }
 
+// ParseStatusTable parses the URI of a table that ingestion statuses are reported to, other than the status tables of
+// the ingestion resources. It must be https://<account>.table.<domain>/<table name>?<SAS>, with a shared access
+// signature that can add, read and delete rows.
+func ParseStatusTable(uri string) (*URI, error) {
+	u, err := parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.objectType != "table" {
+		return nil, fmt.Errorf("URI(%s) is not of a table: the hostname must be <account>.table.<domain>", u.ServiceURL())
+	}
+	if u.sas.Get("sig") == "" {
+		return nil, fmt.Errorf("URI(%s/%s) has no shared access signature", u.ServiceURL(), u.objectName)
+	}
+	return u, nil
+}
+
 // validate validates that the URI was valid.
 // TODO(Daniel): You could add deep validation of each value we have split to give better diagnostic info on an error.
 // I put in the most basic evalutation, but you might want to put checks for the account format or objectName foramt.
@@ -110,6 +137,11 @@ func (u *URI) SAS() url.Values {
 	return u.sas
 }
 
+// ServiceURL returns the URL of the storage service of the object, which is the URI without its path and SAS.
+func (u *URI) ServiceURL() string {
+	return u.u.Scheme + "://" + u.u.Host
+}
+
 // String implements fmt.Stringer.
 func (u *URI) String() string {
 	return u.u.String()
@@ -125,25 +157,121 @@ type token struct {
 	AuthContext string `kusto:"AuthorizationContext"`
 }
 
+const (
+	// DefaultRefreshInterval is how often the Manager refreshes the ingestion resources, unless set by WithRefreshInterval().
+	DefaultRefreshInterval = 1 * time.Hour
+	// MinRefreshInterval is the shortest interval allowed by WithRefreshInterval().
+	MinRefreshInterval = 1 * time.Minute
+
+	// authContextLifetime is how long an authorization context is used before it is fetched again.
+	authContextLifetime = 1 * time.Hour
+	// authContextRenewal is how long before it expires that an authorization context in use is renewed in the
+	// background, so that ingestions don't wait for the fetch.
+	authContextRenewal = 5 * time.Minute
+)
+
 // Manager manages Kusto resources.
 type Manager struct {
-	client                    mgmter
+	client                    Mgmter
+	mgmtOptions               []kusto.MgmtOption
 	done                      chan struct{}
+	closeOnce                 sync.Once
 	resources                 atomic.Value // Stores Ingestion
 	kustoToken                token
 	kustoTokenCacheExpiration time.Time
 	authLock                  sync.Mutex
+	renewingAuth              bool
 	fetchLock                 sync.Mutex
+	skipStatusTables          bool
+	refreshInterval           time.Duration
+	retry                     retry.Policy
+	// spans starts the spans of the fetches of the resources, nil if they are not traced.
+	spans trace.Tracer
+
+	// lastFetch is when the resources were last fetched, and lastFetchErr the error of the fetches that failed since.
+	lastFetch    time.Time
+	lastFetchErr error
+	statusLock   sync.Mutex
+
+	// clock returns the current time, and is replaced in tests. A nil clock is time.Now.
+	clock func() time.Time
+
+	// refreshing is the Refresh() call in progress, which later calls wait for instead of starting their own.
+	refreshing  *refreshCall
+	refreshLock sync.Mutex
+}
+
+// defaultRetry is how fetches that failed are retried. It rides out the throttling of many clients starting at
+// once, with full jitter so that clients throttled together don't retry together.
+var defaultRetry = retry.Policy{
+	InitialInterval: 1 * time.Second,
+	Multiplier:      2,
+	Jitter:          1,
+	MaxInterval:     30 * time.Second,
+	MaxElapsed:      2 * time.Minute,
+}
+
+// refreshCall is a Refresh() in progress. err is set before done is closed.
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// Option is an optional argument to New().
+type Option func(m *Manager)
+
+// DirectMgmt indicates that the client passed to New() already connects to the Data Management endpoint,
+// so Mgmt() calls must not be redirected to the "ingest-" endpoint.
+func DirectMgmt() Option {
+	return func(m *Manager) {
+		m.mgmtOptions = nil
+	}
+}
+
+// WithoutStatusTables makes the Manager ignore the ingestion status tables in the resources it fetches.
+func WithoutStatusTables() Option {
+	return func(m *Manager) {
+		m.skipStatusTables = true
+	}
+}
+
+// WithRefreshInterval sets how often the Manager refreshes the ingestion resources in the background.
+// The interval cannot be shorter than MinRefreshInterval. The default is DefaultRefreshInterval.
+func WithRefreshInterval(d time.Duration) Option {
+	return func(m *Manager) {
+		m.refreshInterval = d
+	}
+}
+
+// WithSpanTracer makes the Manager start a span with tracer around each fetch of the resources. The fetches in the
+// background are spans without a parent.
+func WithSpanTracer(tracer trace.Tracer) Option {
+	return func(m *Manager) {
+		m.spans = tracer
+	}
 }
 
 // New is the constructor for Manager.
-func New(client mgmter) (*Manager, error) {
-	m := &Manager{client: client, done: make(chan struct{})}
-	if err := m.fetch(context.Background()); err != nil {
+func New(client Mgmter, options ...Option) (*Manager, error) {
+	m := &Manager{
+		client:          client,
+		done:            make(chan struct{}),
+		mgmtOptions:     []kusto.MgmtOption{kusto.IngestionEndpoint()},
+		refreshInterval: DefaultRefreshInterval,
+		retry:           defaultRetry,
+	}
+	for _, o := range options {
+		o(m)
+	}
+	if m.refreshInterval < MinRefreshInterval {
+		return nil, fmt.Errorf("refresh interval(%s) cannot be shorter than %s", m.refreshInterval, MinRefreshInterval)
+	}
+
+	if err := m.withRetry(context.Background(), m.fetch); err != nil {
 		return nil, err
 	}
 
-	m.kustoTokenCacheExpiration = time.Now().UTC()
+	m.kustoTokenCacheExpiration = m.now()
 	go m.renewResources()
 
 	m.authLock = sync.Mutex{}
@@ -152,13 +280,13 @@ func New(client mgmter) (*Manager, error) {
 	return m, nil
 }
 
-// Close closes the manager. This stops any token refreshes.
+// Close closes the manager. This stops any token refreshes. Close can be called more than once.
 func (m *Manager) Close() {
-	close(m.done)
+	m.closeOnce.Do(func() { close(m.done) })
 }
 
 func (m *Manager) renewResources() {
-	tick := time.NewTicker(1 * time.Hour)
+	tick := time.NewTicker(m.refreshInterval)
 	for {
 		select {
 		case <-tick.C:
@@ -170,18 +298,86 @@ func (m *Manager) renewResources() {
 	}
 }
 
+func (m *Manager) now() time.Time {
+	if m.clock == nil {
+		return time.Now()
+	}
+	return m.clock()
+}
+
 // AuthContext returns a string representing the authorization context. This auth token is a temporary token
 // that can be used to write a message via ingestion.  This is different than the ADAL token.
+// The authorization context is cached for an hour, and renewed in the background shortly before it expires.
 func (m *Manager) AuthContext(ctx context.Context) (string, error) {
 	m.authLock.Lock()
 	defer m.authLock.Unlock()
-	if m.kustoTokenCacheExpiration.After(time.Now().UTC()) {
+
+	now := m.now()
+	if m.kustoTokenCacheExpiration.After(now) {
+		if !m.renewingAuth && m.kustoTokenCacheExpiration.Sub(now) <= authContextRenewal {
+			m.renewingAuth = true
+			go m.renewAuthContext()
+		}
 		return m.kustoToken.AuthContext, nil
 	}
 
-	rows, err := m.client.Mgmt(ctx, "NetDefaultDB", kusto.NewStmt(".get kusto identity token"), kusto.IngestionEndpoint())
+	return m.updateAuthContext(ctx)
+}
+
+// InvalidateAuthContext drops the cached authorization context, so that the next AuthContext() fetches a new one,
+// such as after an ingestion failed because Kusto refused the authorization context.
+func (m *Manager) InvalidateAuthContext() {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+	m.kustoTokenCacheExpiration = time.Time{}
+}
+
+// updateAuthContext fetches an authorization context and caches it. m.authLock must be held.
+func (m *Manager) updateAuthContext(ctx context.Context) (string, error) {
+	t, err := m.fetchAuthContextRetry(ctx)
 	if err != nil {
-		return "", fmt.Errorf("problem getting authorization context from Kusto via Mgmt: %s", err)
+		return "", err
+	}
+
+	m.kustoToken = t
+	m.kustoTokenCacheExpiration = m.now().Add(authContextLifetime)
+	return t.AuthContext, nil
+}
+
+// renewAuthContext replaces the cached authorization context with a new one, without holding m.authLock while it is
+// fetched, so that AuthContext() keeps returning the cached one meanwhile. If the fetch fails, the next AuthContext()
+// renews it again.
+func (m *Manager) renewAuthContext() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	t, err := m.fetchAuthContextRetry(ctx)
+
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+	m.renewingAuth = false
+	if err != nil {
+		return
+	}
+	m.kustoToken = t
+	m.kustoTokenCacheExpiration = m.now().Add(authContextLifetime)
+}
+
+// fetchAuthContextRetry calls fetchAuthContext() with the retries of withRetry().
+func (m *Manager) fetchAuthContextRetry(ctx context.Context) (token, error) {
+	var t token
+	err := m.withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		t, err = m.fetchAuthContext(ctx)
+		return err
+	})
+	return t, err
+}
+
+// fetchAuthContext gets a new authorization context from Kusto.
+func (m *Manager) fetchAuthContext(ctx context.Context) (token, error) {
+	rows, err := m.client.Mgmt(ctx, "NetDefaultDB", kusto.NewStmt(".get kusto identity token"), m.mgmtOptions...)
+	if err != nil {
+		return token{}, fmt.Errorf("problem getting authorization context from Kusto via Mgmt: %w", err)
 	}
 
 	count := 0
@@ -195,13 +391,7 @@ func (m *Manager) AuthContext(ctx context.Context) (string, error) {
 			return r.ToStruct(&token)
 		},
 	)
-	if err != nil {
-		return "", err
-	}
-
-	m.kustoToken = token
-	m.kustoTokenCacheExpiration = time.Now().UTC().Add(time.Hour)
-	return token.AuthContext, nil
+	return token, err
 }
 
 // ingestResc represents a kusto Mgmt() record about a resource
@@ -220,14 +410,32 @@ type Ingestion struct {
 	Containers []*URI
 	// Tables contains URIs for table resources.
 	Tables []*URI
+	// ReportQueues contains URIs for the queues that ingestion results are reported to.
+	ReportQueues []*URI
 }
 
 var errDoNotCare = errors.New("don't care about this")
 
+// statusTableType is the ResourceTypeName of the tables ingestion statuses are reported to.
+const statusTableType = "IngestionsStatusTable"
+
+// resourceObjectTypes are the storage object types of the resource types that are used.
+var resourceObjectTypes = map[string]string{
+	"TempStorage":                     "blob",
+	"SecuredReadyForAggregationQueue": "queue",
+	statusTableType:                   "table",
+	"SuccessfulIngestionsQueue":       "queue",
+	"FailedIngestionsQueue":           "queue",
+}
+
 func (i *Ingestion) importRec(rec ingestResc) error {
-	u, err := parse(rec.Root)
+	objectType, ok := resourceObjectTypes[rec.Type]
+	if !ok {
+		return errDoNotCare
+	}
+	u, err := parseAs(rec.Root, objectType)
 	if err != nil {
-		return fmt.Errorf("the StorageRoot URI received(%s) has an error: %s", rec.Root, err)
+		return fmt.Errorf("the StorageRoot URI received(%s) has an error: %w", rec.Root, err)
 	}
 
 	switch rec.Type {
@@ -235,10 +443,10 @@ func (i *Ingestion) importRec(rec ingestResc) error {
 		i.Containers = append(i.Containers, u)
 	case "SecuredReadyForAggregationQueue":
 		i.Queues = append(i.Queues, u)
-	case "IngestionsStatusTable":
+	case statusTableType:
 		i.Tables = append(i.Tables, u)
-	default:
-		return errDoNotCare
+	case "SuccessfulIngestionsQueue", "FailedIngestionsQueue":
+		i.ReportQueues = append(i.ReportQueues, u)
 	}
 	return nil
 }
@@ -247,9 +455,26 @@ func (i *Ingestion) importRec(rec ingestResc) error {
 func (m *Manager) fetch(ctx context.Context) error {
 	m.fetchLock.Lock()
 	defer m.fetchLock.Unlock()
-	rows, err := m.client.Mgmt(ctx, "NetDefaultDB", kusto.NewStmt(".get ingestion resources"), kusto.IngestionEndpoint())
+
+	ctx, span := trace.Start(ctx, m.spans, trace.RefreshResources, trace.String(trace.DBSystem, "kusto"))
+	err := m.fetchResources(ctx)
+	span.End(err)
+
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	if err != nil {
+		m.lastFetchErr = err
+		return err
+	}
+	m.lastFetch = time.Now()
+	m.lastFetchErr = nil
+	return nil
+}
+
+func (m *Manager) fetchResources(ctx context.Context) error {
+	rows, err := m.client.Mgmt(ctx, "NetDefaultDB", kusto.NewStmt(".get ingestion resources"), m.mgmtOptions...)
 	if err != nil {
-		return fmt.Errorf("problem getting ingestion resources from Kusto: %s", err)
+		return fmt.Errorf("problem getting ingestion resources from Kusto: %w", err)
 	}
 
 	ingest := Ingestion{}
@@ -259,6 +484,9 @@ func (m *Manager) fetch(ctx context.Context) error {
 			if err := r.ToStruct(&rec); err != nil {
 				return err
 			}
+			if m.skipStatusTables && rec.Type == statusTableType {
+				return nil
+			}
 			if err := ingest.importRec(rec); err != nil && err != errDoNotCare {
 				return err
 			}
@@ -266,7 +494,7 @@ func (m *Manager) fetch(ctx context.Context) error {
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("problem reading ingestion resources from Kusto: %s", err)
+		return fmt.Errorf("problem reading ingestion resources from Kusto: %w", err)
 	}
 
 	m.resources.Store(ingest)
@@ -274,26 +502,96 @@ func (m *Manager) fetch(ctx context.Context) error {
 	return nil
 }
 
+// fetchRetry fetches the resources in the background until it succeeds or the Manager is closed. The resources
+// fetched last are used until then.
 func (m *Manager) fetchRetry(ctx context.Context) {
-	attempts := 0
+	b := m.retry.Backoff()
 	for {
-		select {
-		case <-m.done:
-			return
-		default:
-		}
-
 		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 		err := m.fetch(ctx)
 		cancel()
-		if err != nil {
-			attempts++
-			//log.Printf("problem fetching the resources from Kusto Mgmt(attempt %d): %s", attempts, err)
-			time.Sleep(10 * time.Second)
-			continue
+		if err == nil {
+			return
 		}
-		return
+
+		if m.sleep(ctx, b.Next(err)) != nil {
+			return
+		}
+	}
+}
+
+// errClosed is the error of a wait cut short by the Manager being closed.
+var errClosed = errors.New("the Manager is closed")
+
+// sleep waits for d, and returns an error if ctx is done or the Manager is closed first.
+func (m *Manager) sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.done:
+		return errClosed
+	}
+}
+
+// transient reports if a fetch that failed with err can succeed when retried, see kustoErrors.Retryable(). Requests
+// that the service refused for another reason than throttling, such as a missing permission, fail the same way again.
+func transient(err error) bool {
+	return kustoErrors.Retryable(err)
+}
+
+// withRetry calls f until it succeeds, fails with an error that is not transient, such as a missing permission,
+// or the retry policy gives up. The zero policy doesn't retry.
+func (m *Manager) withRetry(ctx context.Context, f func(ctx context.Context) error) error {
+	return retry.Retrier{Policy: m.retry, Retryable: transient, Sleep: m.sleep}.Do(ctx, f)
+}
+
+// Refresh fetches the ingestion resources and the authorization context from Kusto, replacing the cached ones,
+// such as after storage keys were rotated. A Refresh() called while another is in progress waits for that one
+// and returns its result instead of fetching again.
+func (m *Manager) Refresh(ctx context.Context) error {
+	m.refreshLock.Lock()
+	if call := m.refreshing; call != nil {
+		m.refreshLock.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	m.refreshing = call
+	m.refreshLock.Unlock()
+
+	call.err = m.refresh(ctx)
+
+	m.refreshLock.Lock()
+	m.refreshing = nil
+	m.refreshLock.Unlock()
+	close(call.done)
+	return call.err
+}
+
+func (m *Manager) refresh(ctx context.Context) error {
+	if err := m.withRetry(ctx, m.fetch); err != nil {
+		return err
 	}
+
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+	_, err := m.updateAuthContext(ctx)
+	return err
+}
+
+// LastFetch returns when the resources were last fetched, and the error of the last fetch if it failed since.
+func (m *Manager) LastFetch() (time.Time, error) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	return m.lastFetch, m.lastFetchErr
 }
 
 // Resources returns information about the ingestion resources. This will used cached information instead
@@ -2,13 +2,21 @@ package resources
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kylelemons/godebug/pretty"
 
+	"github.com/Azure/azure-kusto-go/kusto"
+	kustoErrors "github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/data/table"
 	"github.com/Azure/azure-kusto-go/kusto/data/types"
 	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/retry"
 )
 
 func TestParse(t *testing.T) {
@@ -17,10 +25,13 @@ func TestParse(t *testing.T) {
 	tests := []struct {
 		desc           string
 		url            string
+		objectType     string
 		err            bool
 		wantAccount    string
 		wantObjectType string
 		wantObjectName string
+		wantService    string
+		wantSAS        string
 	}{
 		{
 			desc: "account is missing, but has leading dot",
@@ -38,13 +49,23 @@ func TestParse(t *testing.T) {
 			err:  true,
 		},
 		{
-			desc: "invalid domain",
-			url:  "https://account.blob.core.invalid.net/objectname",
+			desc: "no object name provided",
+			url:  "https://account.invalid.core.windows.net/",
 			err:  true,
 		},
 		{
-			desc: "no object name provided",
-			url:  "https://account.invalid.core.windows.net/",
+			desc: "no object name provided with a valid type",
+			url:  "https://account.queue.core.windows.net/",
+			err:  true,
+		},
+		{
+			desc: "no domain",
+			url:  "https://account/objectname",
+			err:  true,
+		},
+		{
+			desc: "custom domain without an object type",
+			url:  "https://storage.contoso.com/objectname",
 			err:  true,
 		},
 		{
@@ -58,11 +79,75 @@ func TestParse(t *testing.T) {
 			wantAccount:    "account",
 			wantObjectType: "table",
 			wantObjectName: "objectname",
+			wantService:    "https://account.table.core.windows.net",
+		},
+		{
+			desc:           "public cloud with SAS",
+			url:            "https://account.blob.core.windows.net/container?sv=2020-08-04&sig=abc%2Bdef",
+			wantAccount:    "account",
+			wantObjectType: "blob",
+			wantObjectName: "container",
+			wantService:    "https://account.blob.core.windows.net",
+			wantSAS:        "sig=abc%2Bdef&sv=2020-08-04",
+		},
+		{
+			desc:           "China",
+			url:            "https://account.queue.core.chinacloudapi.cn/readyforaggregation?sig=s",
+			wantAccount:    "account",
+			wantObjectType: "queue",
+			wantObjectName: "readyforaggregation",
+			wantService:    "https://account.queue.core.chinacloudapi.cn",
+			wantSAS:        "sig=s",
+		},
+		{
+			desc:           "Government",
+			url:            "https://account.table.core.usgovcloudapi.net/status?sig=s",
+			wantAccount:    "account",
+			wantObjectType: "table",
+			wantObjectName: "status",
+			wantService:    "https://account.table.core.usgovcloudapi.net",
+			wantSAS:        "sig=s",
+		},
+		{
+			desc:           "Germany",
+			url:            "https://account.blob.core.cloudapi.de/container?sig=s",
+			wantAccount:    "account",
+			wantObjectType: "blob",
+			wantObjectName: "container",
+			wantService:    "https://account.blob.core.cloudapi.de",
+			wantSAS:        "sig=s",
+		},
+		{
+			desc:           "private endpoint",
+			url:            "https://account.privatelink.blob.core.windows.net/container?sig=s",
+			wantAccount:    "account",
+			wantObjectType: "blob",
+			wantObjectName: "container",
+			wantService:    "https://account.privatelink.blob.core.windows.net",
+			wantSAS:        "sig=s",
+		},
+		{
+			desc:           "custom domain with the object type of the resource",
+			url:            "https://storage.contoso.com/container?sig=s",
+			objectType:     "blob",
+			wantAccount:    "storage",
+			wantObjectType: "blob",
+			wantObjectName: "container",
+			wantService:    "https://storage.contoso.com",
+			wantSAS:        "sig=s",
+		},
+		{
+			desc:           "object name is the first path segment",
+			url:            "https://account.blob.core.windows.net/container/blob",
+			wantAccount:    "account",
+			wantObjectType: "blob",
+			wantObjectName: "container",
+			wantService:    "https://account.blob.core.windows.net",
 		},
 	}
 
 	for _, test := range tests {
-		got, err := parse(test.url)
+		got, err := parseAs(test.url, test.objectType)
 		switch {
 		case err == nil && test.err:
 			t.Errorf("TestParse(%s): got err == nil, want err != nil", test.desc)
@@ -86,6 +171,12 @@ func TestParse(t *testing.T) {
 		if got.String() != test.url {
 			t.Errorf("TestParse(%s): String(): got %s, want %s", test.desc, got.String(), test.url)
 		}
+		if got.ServiceURL() != test.wantService {
+			t.Errorf("TestParse(%s): ServiceURL(): got %s, want %s", test.desc, got.ServiceURL(), test.wantService)
+		}
+		if got.SAS().Encode() != test.wantSAS {
+			t.Errorf("TestParse(%s): SAS(): got %s, want %s", test.desc, got.SAS().Encode(), test.wantSAS)
+		}
 	}
 }
 
@@ -101,6 +192,36 @@ func FakeAuthContext(rows []value.Values, setErr bool) *FakeMgmt {
 	return fm
 }
 
+func TestParseStatusTable(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		uri  string
+		err  bool
+	}{
+		{desc: "success", uri: "https://mine.table.core.windows.net/statuses?sv=2020&sig=secret"},
+		{desc: "other cloud", uri: "https://mine.table.core.chinacloudapi.cn/statuses?sig=secret"},
+		{desc: "no shared access signature", uri: "https://mine.table.core.windows.net/statuses", err: true},
+		{desc: "not a table", uri: "https://mine.blob.core.windows.net/statuses?sig=secret", err: true},
+		{desc: "custom domain", uri: "https://mine.contoso.com/statuses?sig=secret", err: true},
+		{desc: "no table name", uri: "https://mine.table.core.windows.net/?sig=secret", err: true},
+		{desc: "not https", uri: "http://mine.table.core.windows.net/statuses?sig=secret", err: true},
+	}
+
+	for _, test := range tests {
+		_, err := ParseStatusTable(test.uri)
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestParseStatusTable(%s): got err == nil, want err != nil", test.desc)
+		case err != nil && !test.err:
+			t.Errorf("TestParseStatusTable(%s): got err == %s, want err == nil", test.desc, err)
+		case err != nil && strings.Contains(err.Error(), "secret"):
+			t.Errorf("TestParseStatusTable(%s): the error has the shared access signature: %s", test.desc, err)
+		}
+	}
+}
+
 func TestAuthContext(t *testing.T) {
 	t.Parallel()
 
@@ -198,6 +319,7 @@ func TestResources(t *testing.T) {
 	tests := []struct {
 		desc     string
 		fakeMgmt *FakeMgmt
+		options  []Option
 		err      bool
 		want     Ingestion
 	}{
@@ -236,10 +358,39 @@ func TestResources(t *testing.T) {
 				Containers: []*URI{mustParse("https://account.blob.core.windows.net/storageroot0")},
 			},
 		},
+		{
+			desc:     "Status table",
+			fakeMgmt: FakeResources([]value.Values{statusTableRow()}, false),
+			want: Ingestion{
+				Tables: []*URI{mustParse("https://account.table.core.windows.net/statustable")},
+			},
+		},
+		{
+			desc: "Report queues",
+			fakeMgmt: FakeResources([]value.Values{
+				{value.String{Valid: true, Value: "SuccessfulIngestionsQueue"}, value.String{Valid: true, Value: "https://account.queue.core.windows.net/success"}},
+				{value.String{Valid: true, Value: "FailedIngestionsQueue"}, value.String{Valid: true, Value: "https://account.queue.core.windows.net/failure"}},
+			}, false),
+			want: Ingestion{
+				ReportQueues: []*URI{
+					mustParse("https://account.queue.core.windows.net/success"),
+					mustParse("https://account.queue.core.windows.net/failure"),
+				},
+			},
+		},
+		{
+			desc:     "Status table is skipped WithoutStatusTables",
+			fakeMgmt: FakeResources([]value.Values{statusTableRow()}, false),
+			options:  []Option{WithoutStatusTables()},
+			want:     Ingestion{},
+		},
 	}
 
 	for _, test := range tests {
 		manager := &Manager{client: test.fakeMgmt}
+		for _, o := range test.options {
+			o(manager)
+		}
 
 		err := manager.fetch(context.Background())
 
@@ -264,3 +415,354 @@ func TestResources(t *testing.T) {
 		}
 	}
 }
+
+func statusTableRow() value.Values {
+	return value.Values{
+		value.String{Valid: true, Value: "IngestionsStatusTable"},
+		value.String{Valid: true, Value: "https://account.table.core.windows.net/statustable"},
+	}
+}
+
+// countingMgmt answers the resources and auth context commands, counting them. Calls wait for release, if set.
+type countingMgmt struct {
+	mu        sync.Mutex
+	resources int
+	auth      int
+	release   chan struct{}
+}
+
+func (c *countingMgmt) Mgmt(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+	if c.release != nil {
+		<-c.release
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if query.String() == ".get kusto identity token" {
+		c.auth++
+		return FakeAuthContext([]value.Values{{value.String{Valid: true, Value: fmt.Sprintf("authtoken%d", c.auth)}}}, false).Mgmt(ctx, db, query, options...)
+	}
+	c.resources++
+	return SuccessfulFakeResources().Mgmt(ctx, db, query, options...)
+}
+
+func (c *countingMgmt) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resources, c.auth
+}
+
+func TestRefresh(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mgmt := &countingMgmt{}
+	manager, err := New(mgmt)
+	if err != nil {
+		t.Fatalf("TestRefresh: New(): %s", err)
+	}
+	defer manager.Close()
+
+	if _, err := manager.AuthContext(ctx); err != nil {
+		t.Fatalf("TestRefresh: AuthContext(): %s", err)
+	}
+	if err := manager.Refresh(ctx); err != nil {
+		t.Fatalf("TestRefresh: Refresh(): %s", err)
+	}
+	if res, auth := mgmt.counts(); res != 2 || auth != 2 {
+		t.Errorf("TestRefresh: got %d resource and %d auth context fetches, want 2 and 2", res, auth)
+	}
+	got, err := manager.AuthContext(ctx)
+	if err != nil {
+		t.Fatalf("TestRefresh: AuthContext(): %s", err)
+	}
+	if got != "authtoken2" {
+		t.Errorf("TestRefresh: got auth context %q, want the refreshed %q", got, "authtoken2")
+	}
+
+	// Calls made while a Refresh() is in progress share it. The first call holds the fetch until all are made.
+	mgmt.release = make(chan struct{})
+	const callers = 10
+	errs := make(chan error, callers)
+	go func() { errs <- manager.Refresh(ctx) }()
+	for {
+		manager.refreshLock.Lock()
+		started := manager.refreshing != nil
+		manager.refreshLock.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	started := sync.WaitGroup{}
+	for i := 1; i < callers; i++ {
+		started.Add(1)
+		go func() {
+			started.Done()
+			errs <- manager.Refresh(ctx)
+		}()
+	}
+	started.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(mgmt.release)
+
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("TestRefresh: concurrent Refresh(): %s", err)
+		}
+	}
+	if res, auth := mgmt.counts(); res != 3 || auth != 3 {
+		t.Errorf("TestRefresh: got %d resource and %d auth context fetches for %d concurrent calls, want 3 and 3", res, auth, callers)
+	}
+}
+
+func TestRefreshInterval(t *testing.T) {
+	t.Parallel()
+
+	manager, err := New(&countingMgmt{})
+	if err != nil {
+		t.Fatalf("TestRefreshInterval: New(): %s", err)
+	}
+	manager.Close()
+	if manager.refreshInterval != DefaultRefreshInterval {
+		t.Errorf("TestRefreshInterval: got interval %s, want the default %s", manager.refreshInterval, DefaultRefreshInterval)
+	}
+
+	manager, err = New(&countingMgmt{}, WithRefreshInterval(10*time.Minute))
+	if err != nil {
+		t.Fatalf("TestRefreshInterval: New(): %s", err)
+	}
+	manager.Close()
+	// Closing again, as when an ingestion client is closed with the kusto.Client it was made from, does nothing.
+	manager.Close()
+	select {
+	case <-manager.done:
+	default:
+		t.Errorf("TestRefreshInterval: the manager was not closed")
+	}
+	if manager.refreshInterval != 10*time.Minute {
+		t.Errorf("TestRefreshInterval: got interval %s, want %s", manager.refreshInterval, 10*time.Minute)
+	}
+
+	if _, err := New(&countingMgmt{}, WithRefreshInterval(time.Second)); err == nil {
+		t.Errorf("TestRefreshInterval: got err == nil for an interval under %s, want err != nil", MinRefreshInterval)
+	}
+}
+
+// throttledMgmt fails the first throttled calls with a 429, then answers like countingMgmt.
+type throttledMgmt struct {
+	countingMgmt
+	throttled  int
+	retryAfter time.Duration
+	calls      []time.Time
+}
+
+func (th *throttledMgmt) Mgmt(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+	th.mu.Lock()
+	th.calls = append(th.calls, time.Now())
+	throttle := len(th.calls) <= th.throttled
+	th.mu.Unlock()
+
+	if throttle {
+		e := kustoErrors.HTTP(kustoErrors.OpMgmt, "429 Too Many Requests", ioutil.NopCloser(strings.NewReader("throttled")), "")
+		return nil, e.SetRetryAfter(th.retryAfter)
+	}
+	return th.countingMgmt.Mgmt(ctx, db, query, options...)
+}
+
+func TestNewRetriesThrottling(t *testing.T) {
+	t.Parallel()
+
+	policy := retry.Policy{InitialInterval: 10 * time.Millisecond, Multiplier: 2, Jitter: 1, MaxInterval: 40 * time.Millisecond, MaxElapsed: time.Second}
+	withPolicy := func(m *Manager) { m.retry = policy }
+
+	tests := []struct {
+		desc       string
+		retryAfter time.Duration
+		throttled  int
+		err        bool
+		wantCalls  int
+	}{
+		{desc: "Throttled a few times", throttled: 3, wantCalls: 4},
+		{desc: "Retry-After is honored", throttled: 1, retryAfter: 100 * time.Millisecond, wantCalls: 2},
+		{desc: "Gives up after the total wait", throttled: 1000, retryAfter: 400 * time.Millisecond, err: true, wantCalls: 3},
+	}
+
+	for _, test := range tests {
+		mgmt := &throttledMgmt{throttled: test.throttled, retryAfter: test.retryAfter}
+		start := time.Now()
+		manager, err := New(mgmt, withPolicy)
+		elapsed := time.Since(start)
+
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestNewRetriesThrottling(%s): got err == nil, want err != nil", test.desc)
+		case err != nil && !test.err:
+			t.Errorf("TestNewRetriesThrottling(%s): got err == %s, want err == nil", test.desc, err)
+		}
+		if manager != nil {
+			manager.Close()
+		}
+
+		if len(mgmt.calls) != test.wantCalls {
+			t.Errorf("TestNewRetriesThrottling(%s): got %d calls, want %d", test.desc, len(mgmt.calls), test.wantCalls)
+		}
+		for i := 1; i < len(mgmt.calls); i++ {
+			if wait := mgmt.calls[i].Sub(mgmt.calls[i-1]); wait < test.retryAfter {
+				t.Errorf("TestNewRetriesThrottling(%s): call %d came %s after the one before, want at least the Retry-After of %s", test.desc, i, wait, test.retryAfter)
+			}
+		}
+		if elapsed > 2*policy.MaxElapsed {
+			t.Errorf("TestNewRetriesThrottling(%s): took %s, want under %s", test.desc, elapsed, 2*policy.MaxElapsed)
+		}
+	}
+}
+
+func TestNewDoesNotRetryPermanentErrors(t *testing.T) {
+	t.Parallel()
+
+	mgmt := SuccessfulFakeResources().SetMgmtErr()
+	withPolicy := func(m *Manager) { m.retry = retry.Policy{InitialInterval: time.Hour, MaxElapsed: time.Hour} }
+	if _, err := New(mgmt, withPolicy); err == nil {
+		t.Errorf("TestNewDoesNotRetryPermanentErrors: got err == nil, want err != nil")
+	}
+}
+
+func TestLastFetch(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	manager := &Manager{client: SuccessfulFakeResources()}
+	if last, err := manager.LastFetch(); !last.IsZero() || err != nil {
+		t.Errorf("TestLastFetch: before a fetch got (%s, %v), want a zero time and no error", last, err)
+	}
+
+	before := time.Now()
+	if err := manager.fetch(ctx); err != nil {
+		t.Fatalf("TestLastFetch: fetch(): %s", err)
+	}
+	last, err := manager.LastFetch()
+	if last.Before(before) || err != nil {
+		t.Errorf("TestLastFetch: after a fetch got (%s, %v), want a time after %s and no error", last, err, before)
+	}
+
+	// A failed fetch keeps the resources and the time of the last successful one.
+	manager.client = SuccessfulFakeResources().SetMgmtErr()
+	if err := manager.fetch(ctx); err == nil {
+		t.Fatalf("TestLastFetch: fetch(): got err == nil, want err != nil")
+	}
+	failedLast, err := manager.LastFetch()
+	if !failedLast.Equal(last) || err == nil {
+		t.Errorf("TestLastFetch: after a failed fetch got (%s, %v), want (%s, an error)", failedLast, err, last)
+	}
+	if res, err := manager.Resources(); err != nil || len(res.Containers) != 1 {
+		t.Errorf("TestLastFetch: after a failed fetch got resources %v (%v), want the ones fetched before", res, err)
+	}
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Add(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestAuthContextCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	mgmt := &countingMgmt{}
+	manager := &Manager{client: mgmt, clock: clock.Now}
+
+	authContext := func(want string, wantFetches int) {
+		t.Helper()
+		got, err := manager.AuthContext(ctx)
+		if err != nil {
+			t.Fatalf("TestAuthContextCache: AuthContext(): %s", err)
+		}
+		if got != want {
+			t.Errorf("TestAuthContextCache: got auth context %q, want %q", got, want)
+		}
+		if _, auth := mgmt.counts(); auth != wantFetches {
+			t.Errorf("TestAuthContextCache: got %d fetches, want %d", auth, wantFetches)
+		}
+	}
+
+	authContext("authtoken1", 1)
+	clock.Add(30 * time.Minute)
+	authContext("authtoken1", 1)
+
+	// Shortly before it expires, the cached one is returned while it is renewed in the background.
+	clock.Add(authContextLifetime - 30*time.Minute - authContextRenewal + time.Second)
+	if got, err := manager.AuthContext(ctx); err != nil || got != "authtoken1" {
+		t.Errorf("TestAuthContextCache: before expiry got (%q, %v), want the cached authtoken1", got, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		manager.authLock.Lock()
+		renewing := manager.renewingAuth
+		manager.authLock.Unlock()
+		if !renewing || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	authContext("authtoken2", 2)
+
+	// Once expired, it is fetched before being returned, once for all the concurrent callers.
+	clock.Add(authContextLifetime)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := manager.AuthContext(ctx); err != nil || got != "authtoken3" {
+				t.Errorf("TestAuthContextCache: concurrent AuthContext(): got (%q, %v), want authtoken3", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	authContext("authtoken3", 3)
+
+	manager.InvalidateAuthContext()
+	authContext("authtoken4", 4)
+}
+
+func TestTransient(t *testing.T) {
+	t.Parallel()
+
+	httpErr := func(status string) error {
+		return fmt.Errorf("problem getting ingestion resources from Kusto: %w", kustoErrors.HTTP(kustoErrors.OpMgmt, status, ioutil.NopCloser(strings.NewReader("")), ""))
+	}
+
+	tests := []struct {
+		desc string
+		err  error
+		want bool
+	}{
+		{desc: "Throttled", err: httpErr("429 Too Many Requests"), want: true},
+		{desc: "Unavailable", err: httpErr("503 Service Unavailable"), want: true},
+		{desc: "Network", err: kustoErrors.ES(kustoErrors.OpMgmt, kustoErrors.KHTTPError, "connection refused"), want: true},
+		{desc: "Forbidden", err: httpErr("403 Forbidden"), want: false},
+		{desc: "Unauthorized", err: httpErr("401 Unauthorized"), want: false},
+		{desc: "Not a Kusto error", err: fmt.Errorf("some error"), want: false},
+	}
+
+	for _, test := range tests {
+		if got := transient(test.err); got != test.want {
+			t.Errorf("TestTransient(%s): got %t, want %t", test.desc, got, test.want)
+		}
+	}
+}
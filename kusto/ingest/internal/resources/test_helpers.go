@@ -120,16 +120,16 @@ func SuccessfulFakeResources() *FakeMgmt {
 }
 
 type FsMock struct {
-	OnLocal  func(ctx context.Context, from string, props properties.All) error
+	OnLocal  func(ctx context.Context, from string, props properties.All) (string, error)
 	OnReader func(ctx context.Context, reader io.Reader, props properties.All) (string, error)
 	OnBlob   func(ctx context.Context, from string, fileSize int64, props properties.All) error
 }
 
-func (f FsMock) Local(ctx context.Context, from string, props properties.All) error {
+func (f FsMock) Local(ctx context.Context, from string, props properties.All) (string, error) {
 	if f.OnLocal != nil {
 		return f.OnLocal(ctx, from, props)
 	}
-	return nil
+	return "", nil
 }
 
 func (f FsMock) Reader(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
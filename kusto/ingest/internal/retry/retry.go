@@ -0,0 +1,178 @@
+// Package retry holds the policy that the ingestion clients retry the operations that failed with, such as uploads,
+// posts to the queues, streaming requests and fetches of the ingestion resources, and the Retrier that applies it.
+package retry
+
+import (
+	"context"
+	goErrors "errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+)
+
+// Defaults of the fields of a Policy that are left at 0.
+const (
+	DefaultInitialInterval = 500 * time.Millisecond
+	DefaultMultiplier      = 1.5
+	DefaultMaxInterval     = 60 * time.Second
+)
+
+// Policy is how an operation that failed with an error that can be retried is retried: the waits between the
+// attempts grow exponentially from InitialInterval by Multiplier, up to MaxInterval, until MaxAttempts attempts were
+// made or the next wait would end after MaxElapsed. The zero Policy does not retry.
+type Policy struct {
+	// InitialInterval is the wait before the first retry. 0 is DefaultInitialInterval.
+	InitialInterval time.Duration
+	// Multiplier is what each wait is multiplied by to get the next one. It cannot be under 1. 0 is
+	// DefaultMultiplier.
+	Multiplier float64
+	// Jitter is the part of each wait, from 0 to 1, that is random: a wait w lasts between w*(1-Jitter) and w, so
+	// that clients that failed together don't retry together. 0 waits exactly w, 1 between 0 and w.
+	Jitter float64
+	// MaxInterval is the longest wait, unless the service asks for a longer one with a Retry-After header.
+	// 0 is DefaultMaxInterval.
+	MaxInterval time.Duration
+	// MaxAttempts is the most attempts made, the first one included. 0 is no limit other than MaxElapsed.
+	MaxAttempts int
+	// MaxElapsed is how long after the first attempt the operation is retried: there is no retry whose wait would
+	// end after it. 0 is no limit other than MaxAttempts.
+	MaxElapsed time.Duration
+}
+
+// Validate checks the fields of p.
+func (p Policy) Validate() error {
+	switch {
+	case p.InitialInterval < 0 || p.MaxInterval < 0 || p.MaxElapsed < 0:
+		return fmt.Errorf("intervals cannot be negative")
+	case p.MaxAttempts < 0:
+		return fmt.Errorf("MaxAttempts(%d) cannot be negative", p.MaxAttempts)
+	case p.Multiplier != 0 && p.Multiplier < 1:
+		return fmt.Errorf("Multiplier(%g) cannot be under 1", p.Multiplier)
+	case p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("Jitter(%g) must be between 0 and 1", p.Jitter)
+	}
+	return nil
+}
+
+// Retries reports if p retries at all.
+func (p Policy) Retries() bool {
+	if p.MaxAttempts == 0 {
+		return p.MaxElapsed > 0
+	}
+	return p.MaxAttempts > 1
+}
+
+// Backoff returns the waits between the attempts of p.
+func (p Policy) Backoff() *Backoff {
+	return &Backoff{policy: p}
+}
+
+// Backoff returns the waits between the attempts of a Policy, in turn. It does not stop after the attempts of the
+// Policy, which is up to the caller.
+type Backoff struct {
+	policy Policy
+	next   time.Duration
+}
+
+// Next returns the wait before the next attempt, after one that failed with err. The wait is no shorter than the
+// Retry-After of err, if it has one.
+func (b *Backoff) Next(err error) time.Duration {
+	p := b.policy
+	max := p.MaxInterval
+	if max == 0 {
+		max = DefaultMaxInterval
+	}
+	if b.next == 0 {
+		b.next = p.InitialInterval
+		if b.next == 0 {
+			b.next = DefaultInitialInterval
+		}
+		if b.next > max {
+			b.next = max
+		}
+	}
+
+	d := b.next
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+		if d <= 0 {
+			d = 1
+		}
+	}
+
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = DefaultMultiplier
+	}
+	if b.next = time.Duration(float64(b.next) * multiplier); b.next > max {
+		b.next = max
+	}
+
+	var e *errors.Error
+	if goErrors.As(err, &e) && e.RetryAfter() > d {
+		d = e.RetryAfter()
+	}
+	return d
+}
+
+// Retrier calls a func until it succeeds, fails with an error that cannot be retried or Policy gives up.
+type Retrier struct {
+	Policy Policy
+	// Retryable reports if an attempt that failed with err can succeed when made again. nil is errors.Retryable(),
+	// for which requests that the service refused for another reason than throttling or a failure on its side, such
+	// as a missing permission, fail the same way again.
+	Retryable func(err error) bool
+	// Sleep waits for d, and returns an error if it could not, such as when ctx is done first. nil is a timer.
+	Sleep func(ctx context.Context, d time.Duration) error
+	// Now returns the current time, which MaxElapsed is counted with. nil is time.Now.
+	Now func() time.Time
+}
+
+// Do calls f until it succeeds, and returns the error of the last attempt if it does not. The attempts stop when f
+// fails with an error that cannot be retried, ctx is done, the Policy gives up or a wait is cut short.
+func (r Retrier) Do(ctx context.Context, f func(ctx context.Context) error) error {
+	retryable, sleep, now := r.Retryable, r.Sleep, r.Now
+	if retryable == nil {
+		retryable = errors.Retryable
+	}
+	if sleep == nil {
+		sleep = Sleep
+	}
+	if now == nil {
+		now = time.Now
+	}
+
+	start := now()
+	b := r.Policy.Backoff()
+	for attempt := 1; ; attempt++ {
+		err := f(ctx)
+		if err == nil || ctx.Err() != nil || !retryable(err) || !r.Policy.Retries() {
+			return err
+		}
+		if r.Policy.MaxAttempts > 0 && attempt >= r.Policy.MaxAttempts {
+			return err
+		}
+
+		d := b.Next(err)
+		if r.Policy.MaxElapsed > 0 && now().Add(d).Sub(start) > r.Policy.MaxElapsed {
+			return err
+		}
+		if sleep(ctx, d) != nil {
+			return err
+		}
+	}
+}
+
+// Sleep waits for d, or returns the error of ctx if it is done first.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
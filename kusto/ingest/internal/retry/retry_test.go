@@ -0,0 +1,233 @@
+package retry
+
+import (
+	"context"
+	goErrors "errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock whose time only moves when something sleeps.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func (c *fakeClock) retrier(p Policy) Retrier {
+	return Retrier{Policy: p, Sleep: c.Sleep, Now: c.Now}
+}
+
+func throttled(retryAfter time.Duration) error {
+	e := errors.HTTP(errors.OpIngestStream, "429 Too Many Requests", ioutil.NopCloser(strings.NewReader("")), "throttled")
+	return e.SetRetryAfter(retryAfter)
+}
+
+// failing returns a func that fails with errs, in order, and then succeeds, and the number of its calls.
+func failing(errs ...error) (func(context.Context) error, *int) {
+	calls := 0
+	return func(context.Context) error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}, &calls
+}
+
+func TestDo(t *testing.T) {
+	t.Parallel()
+
+	unavailable := errors.HTTP(errors.OpIngestStream, "503 Service Unavailable", ioutil.NopCloser(strings.NewReader("")), "unavailable")
+	forbidden := errors.HTTP(errors.OpIngestStream, "403 Forbidden", ioutil.NopCloser(strings.NewReader("")), "forbidden")
+	boom := goErrors.New("boom")
+
+	tests := []struct {
+		desc       string
+		policy     Policy
+		errs       []error
+		wantErr    error
+		wantCalls  int
+		wantSleeps []time.Duration
+	}{
+		{
+			desc:      "The zero Policy does not retry",
+			errs:      []error{unavailable},
+			wantErr:   unavailable,
+			wantCalls: 1,
+		},
+		{
+			desc:       "Succeeds after retries",
+			policy:     Policy{InitialInterval: time.Second, Multiplier: 2, MaxInterval: 4 * time.Second, MaxAttempts: 5},
+			errs:       []error{unavailable, unavailable, unavailable, unavailable},
+			wantCalls:  5,
+			wantSleeps: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second},
+		},
+		{
+			desc:       "Gives up after MaxAttempts",
+			policy:     Policy{InitialInterval: time.Second, Multiplier: 2, MaxAttempts: 3},
+			errs:       []error{unavailable, unavailable, unavailable, unavailable},
+			wantErr:    unavailable,
+			wantCalls:  3,
+			wantSleeps: []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			desc:       "Gives up before a wait that would end after MaxElapsed",
+			policy:     Policy{InitialInterval: time.Second, Multiplier: 2, MaxInterval: 4 * time.Second, MaxElapsed: 10 * time.Second},
+			errs:       []error{unavailable, unavailable, unavailable, unavailable, unavailable},
+			wantErr:    unavailable,
+			wantCalls:  4,
+			wantSleeps: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			desc:      "An error that cannot be retried is returned at once",
+			policy:    Policy{MaxAttempts: 5},
+			errs:      []error{forbidden},
+			wantErr:   forbidden,
+			wantCalls: 1,
+		},
+		{
+			desc:      "An error that is not an *errors.Error is not retried",
+			policy:    Policy{MaxAttempts: 5},
+			errs:      []error{boom},
+			wantErr:   boom,
+			wantCalls: 1,
+		},
+		{
+			desc:       "Retry-After is honored",
+			policy:     Policy{InitialInterval: time.Second, Multiplier: 2, MaxAttempts: 3},
+			errs:       []error{throttled(3 * time.Second), throttled(0)},
+			wantCalls:  3,
+			wantSleeps: []time.Duration{3 * time.Second, 2 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			clock := &fakeClock{now: time.Unix(0, 0)}
+			f, calls := failing(test.errs...)
+			err := clock.retrier(test.policy).Do(context.Background(), f)
+
+			assert.Equal(t, test.wantErr, err)
+			assert.Equal(t, test.wantCalls, *calls)
+			assert.Equal(t, test.wantSleeps, clock.sleeps)
+		})
+	}
+}
+
+func TestDoContext(t *testing.T) {
+	t.Parallel()
+
+	policy := Policy{InitialInterval: time.Second, MaxAttempts: 10}
+	unavailable := throttled(0)
+
+	// A wait cut short by ctx returns the error of the last attempt.
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Retrier{Policy: policy}.Do(ctx, func(context.Context) error {
+		calls++
+		cancel()
+		return unavailable
+	})
+	assert.Equal(t, unavailable, err)
+	assert.Equal(t, 1, calls)
+
+	// So does a wait cut short by Sleep.
+	stopped := goErrors.New("stopped")
+	calls = 0
+	r := Retrier{Policy: policy, Sleep: func(context.Context, time.Duration) error { return stopped }}
+	err = r.Do(context.Background(), func(context.Context) error {
+		calls++
+		return unavailable
+	})
+	assert.Equal(t, unavailable, err)
+	assert.Equal(t, 1, calls)
+
+	// The real Sleep returns the error of ctx.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, Sleep(ctx, time.Hour))
+	assert.NoError(t, Sleep(context.Background(), time.Millisecond))
+}
+
+func TestDoRetryable(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	r := clock.retrier(Policy{MaxAttempts: 3})
+	r.Retryable = func(err error) bool { return true }
+
+	f, calls := failing(goErrors.New("boom"), goErrors.New("boom"))
+	require.NoError(t, r.Do(context.Background(), f))
+	assert.Equal(t, 3, *calls)
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := Policy{InitialInterval: 10 * time.Millisecond, Multiplier: 2, Jitter: 1, MaxInterval: 40 * time.Millisecond}.Backoff()
+	for i, limit := range []time.Duration{10, 20, 40, 40, 40} {
+		limit *= time.Millisecond
+		if got := b.Next(nil); got <= 0 || got > limit {
+			t.Errorf("TestBackoff: wait %d: got %s, want in (0, %s]", i, got, limit)
+		}
+	}
+
+	b = Policy{InitialInterval: 100 * time.Millisecond, Multiplier: 1, Jitter: 0.25}.Backoff()
+	for i := 0; i < 10; i++ {
+		if got := b.Next(nil); got < 75*time.Millisecond || got > 100*time.Millisecond {
+			t.Errorf("TestBackoff: with a Jitter of 0.25, got %s, want in [75ms, 100ms]", got)
+		}
+	}
+
+	if got := b.Next(throttled(time.Minute)); got != time.Minute {
+		t.Errorf("TestBackoff: got %s, want the Retry-After of %s", got, time.Minute)
+	}
+
+	defaults := Policy{}.Backoff()
+	assert.Equal(t, DefaultInitialInterval, defaults.Next(nil))
+	assert.Equal(t, time.Duration(float64(DefaultInitialInterval)*DefaultMultiplier), defaults.Next(nil))
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	valid := []Policy{{}, {InitialInterval: time.Second, Multiplier: 1, Jitter: 1, MaxInterval: time.Minute, MaxAttempts: 3, MaxElapsed: time.Hour}}
+	for _, p := range valid {
+		assert.NoError(t, p.Validate(), "%+v", p)
+	}
+
+	invalid := []Policy{
+		{InitialInterval: -1},
+		{MaxInterval: -1},
+		{MaxElapsed: -1},
+		{MaxAttempts: -1},
+		{Multiplier: 0.5},
+		{Jitter: -0.1},
+		{Jitter: 1.5},
+	}
+	for _, p := range invalid {
+		assert.Error(t, p.Validate(), "%+v", p)
+	}
+}
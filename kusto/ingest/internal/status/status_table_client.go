@@ -1,6 +1,12 @@
 package status
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
 	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/google/uuid"
@@ -19,12 +25,15 @@ type TableClient struct {
 	table    *storage.Table
 }
 
-// NewTableClient Creates an azure table client.
-func NewTableClient(uri resources.URI) (*TableClient, error) {
+// NewTableClient Creates an azure table client, which sends its requests with httpClient if it is not nil.
+func NewTableClient(uri resources.URI, httpClient *http.Client) (*TableClient, error) {
 	c, err := storage.NewAccountSASClientFromEndpointToken(uri.URL().String(), uri.SAS().Encode())
 	if err != nil {
 		return nil, err
 	}
+	if httpClient != nil {
+		c.HTTPClient = httpClient
+	}
 
 	ts := c.GetTableService()
 
@@ -36,6 +45,11 @@ func NewTableClient(uri resources.URI) (*TableClient, error) {
 	}, nil
 }
 
+// URI returns the URI of the table of the client.
+func (c *TableClient) URI() *resources.URI {
+	return &c.tableURI
+}
+
 // Read reads a table record cotaining ingestion status.
 func (c *TableClient) Read(ingestionSourceID string) (map[string]interface{}, error) {
 	var emptyID = uuid.Nil.String()
@@ -49,6 +63,84 @@ func (c *TableClient) Read(ingestionSourceID string) (map[string]interface{}, er
 	return entity.Properties, nil
 }
 
+// ReadMany reads the records of the ingestions with the ids ingestionSourceIDs in a single query, and returns them
+// by id. Ids that have no record are not in the returned map.
+func (c *TableClient) ReadMany(ingestionSourceIDs []string) (map[string]map[string]interface{}, error) {
+	filters := make([]string, 0, len(ingestionSourceIDs))
+	for _, id := range ingestionSourceIDs {
+		filters = append(filters, fmt.Sprintf("PartitionKey eq '%s'", strings.ReplaceAll(id, "'", "''")))
+	}
+
+	res, err := c.table.QueryEntities(defaultTimeoutMsec, fullMetadata, &storage.QueryOptions{Filter: strings.Join(filters, " or ")})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]map[string]interface{}, len(ingestionSourceIDs))
+	for res != nil {
+		for _, entity := range res.Entities {
+			records[entity.PartitionKey] = entity.Properties
+		}
+		if res.NextLink == nil {
+			break
+		}
+		if res, err = res.NextResults(nil); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// Entry is a row of the status table.
+type Entry struct {
+	PartitionKey string
+	RowKey       string
+	// Timestamp is when the row was last written.
+	Timestamp time.Time
+	// Properties are the columns of the row that were selected.
+	Properties map[string]interface{}
+}
+
+// List pages through the rows of the table that were last written before "before", calling fn with each page. Only
+// the Status column of the rows is read, as the rows written by other clients may have other columns. It stops at
+// the first error fn returns, or when ctx is done.
+func (c *TableClient) List(ctx context.Context, before time.Time, fn func(entries []Entry) error) error {
+	res, err := c.table.QueryEntities(defaultTimeoutMsec, fullMetadata, &storage.QueryOptions{
+		Filter: fmt.Sprintf("Timestamp lt datetime'%s'", before.UTC().Format(time.RFC3339)),
+		Select: []string{"PartitionKey", "RowKey", "Timestamp", "Status"},
+	})
+	for {
+		if err != nil {
+			return err
+		}
+		if res == nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entries := make([]Entry, 0, len(res.Entities))
+		for _, e := range res.Entities {
+			entries = append(entries, Entry{PartitionKey: e.PartitionKey, RowKey: e.RowKey, Timestamp: e.TimeStamp, Properties: e.Properties})
+		}
+		if err := fn(entries); err != nil {
+			return err
+		}
+
+		if res.NextLink == nil {
+			return nil
+		}
+		res, err = res.NextResults(nil)
+	}
+}
+
+// Delete deletes the row of the table, whatever was written to it since it was read.
+func (c *TableClient) Delete(entry Entry) error {
+	entity := c.table.GetEntityReference(entry.PartitionKey, entry.RowKey)
+	return entity.Delete(true, &storage.EntityOptions{Timeout: defaultTimeoutMsec})
+}
+
 // Write reads a table record cotaining ingestion status.
 func (c *TableClient) Write(ingestionSourceID string, data map[string]interface{}) error {
 	var emptyID = uuid.Nil.String()
@@ -0,0 +1,176 @@
+// Package trace holds the spans that the ingestion clients start around the phases of an ingestion. The spans are
+// started with a Tracer that the caller passes to the clients, which adapts them to a tracing library such as
+// OpenTelemetry, so that this module does not depend on one.
+package trace
+
+import (
+	"context"
+	"sync"
+)
+
+// Names of the spans.
+const (
+	// Prepare is the span of the preparation of an ingestion: running its options and getting the authorization
+	// context and the status table.
+	Prepare = "kusto.ingest.prepare"
+	// Upload is the span of the upload of the data to a blob of the ingestion storage.
+	Upload = "kusto.ingest.upload"
+	// Enqueue is the span of the post of the ingestion message to a queue of the ingestion storage.
+	Enqueue = "kusto.ingest.enqueue"
+	// Stream is the span of a streaming ingestion request. Each attempt of a request that is retried has its own.
+	Stream = "kusto.ingest.stream"
+	// RefreshResources is the span of a fetch of the ingestion resources.
+	RefreshResources = "kusto.ingest.refresh_resources"
+	// RateLimit is the span of the wait of an operation held back by the limits of a client.
+	RateLimit = "kusto.ingest.rate_limit"
+)
+
+// Keys of the attributes of the spans. Those of the OpenTelemetry semantic conventions are used where there is one.
+const (
+	// DBSystem is "kusto".
+	DBSystem = "db.system"
+	// DBNamespace is the database that data is ingested into.
+	DBNamespace = "db.namespace"
+	// DBCollection is the table that data is ingested into.
+	DBCollection = "db.collection.name"
+	// ServerAddress is the host that a request is sent to.
+	ServerAddress = "server.address"
+	// HTTPMethod is the method of an HTTP request.
+	HTTPMethod = "http.request.method"
+	// HTTPStatusCode is the status of the response to an HTTP request, when there was one.
+	HTTPStatusCode = "http.response.status_code"
+	// MessagingSystem is "azure_storage_queue".
+	MessagingSystem = "messaging.system"
+	// MessagingDestination is the name of the queue that an ingestion message is posted to.
+	MessagingDestination = "messaging.destination.name"
+	// MessagingOperation is "send".
+	MessagingOperation = "messaging.operation.type"
+	// BlobName is the name of the blob that data is uploaded to.
+	BlobName = "kusto.ingest.blob.name"
+	// BlobBytes is the number of bytes uploaded to a blob, after compression.
+	BlobBytes = "kusto.ingest.blob.bytes"
+	// ClientRequestID is the x-ms-client-request-id header of a request to the service.
+	ClientRequestID = "kusto.client_request_id"
+	// ActivityID is the x-ms-activity-id header of the response of the service, which identifies the request in the
+	// logs of the service.
+	ActivityID = "kusto.activity_id"
+)
+
+// Attr is an attribute of a span. Value is a string, an int64 or a bool.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns an attribute with a string value.
+func String(key, value string) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Int64 returns an attribute with an int64 value.
+func Int64(key string, value int64) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttributes adds attributes to the span, replacing those with the same keys.
+	SetAttributes(attrs ...Attr)
+	// End ends the span. When err is not nil, the phase of the span failed with it, and the status of the span must
+	// be set to an error.
+	End(err error)
+}
+
+// Tracer starts spans. A Tracer must be safe for concurrent use.
+type Tracer interface {
+	// Start starts the span called name, as a child of the span of ctx if there is one, and returns a context that
+	// holds the new span. The spans started with the returned context are children of the new span.
+	Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span)
+}
+
+// noSpan is the Span of a nil Tracer.
+type noSpan struct{}
+
+func (noSpan) SetAttributes(...Attr) {}
+func (noSpan) End(error)             {}
+
+// Start starts the span called name with tracer. When tracer is nil, it returns ctx and a Span that does nothing.
+func Start(ctx context.Context, tracer Tracer, name string, attrs ...Attr) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, noSpan{}
+	}
+	return tracer.Start(ctx, name, attrs...)
+}
+
+// Recorder is a Tracer that records the spans it starts, for tests.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+// RecordedSpan is a span started by a Recorder.
+type RecordedSpan struct {
+	rec *Recorder
+
+	Name string
+	// Parent is the span that the span is a child of, nil for a span without a parent.
+	Parent *RecordedSpan
+	Attrs  map[string]interface{}
+	Ended  bool
+	Err    error
+}
+
+type recorderKey struct{}
+
+// Start implements Tracer.Start().
+func (r *Recorder) Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span) {
+	parent, _ := ctx.Value(recorderKey{}).(*RecordedSpan)
+	s := &RecordedSpan{rec: r, Name: name, Parent: parent, Attrs: map[string]interface{}{}}
+	s.SetAttributes(attrs...)
+
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+	return context.WithValue(ctx, recorderKey{}, s), s
+}
+
+// Spans returns the spans that were started, in the order they were.
+func (r *Recorder) Spans() []*RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*RecordedSpan(nil), r.spans...)
+}
+
+// Named returns the spans called name.
+func (r *Recorder) Named(name string) []*RecordedSpan {
+	var spans []*RecordedSpan
+	for _, s := range r.Spans() {
+		if s.Name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+// SetAttributes implements Span.SetAttributes().
+func (s *RecordedSpan) SetAttributes(attrs ...Attr) {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+	for _, a := range attrs {
+		s.Attrs[a.Key] = a.Value
+	}
+}
+
+// End implements Span.End().
+func (s *RecordedSpan) End(err error) {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+	s.Ended = true
+	s.Err = err
+}
+
+// Root starts a span called name with r, for the spans of the code under test to be children of.
+func (r *Recorder) Root(ctx context.Context, name string) (context.Context, *RecordedSpan) {
+	ctx, s := r.Start(ctx, name)
+	return ctx, s.(*RecordedSpan)
+}
@@ -0,0 +1,458 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/google/uuid"
+)
+
+// Journal keeps the queued ingestions whose outcome is not known yet, so that Recover() can follow or resume the
+// ingestions of a client that stopped, such as when its process crashed between queueing an ingestion and recording
+// its Result. A client made WithJournal() records each ingestion right before its message is posted to the ingestion
+// queue, and completes it when its outcome is known: once it failed to be queued, once it was queued when its status
+// is not reported to a table, or else once its final status is observed with Result.Wait(), StatusChan() or
+// WatchStatus(). The methods are called concurrently.
+type Journal interface {
+	// Record records entry as pending. An entry with the ID of a pending one replaces it.
+	Record(entry PendingIngestion) error
+	// Complete records that the ingestion with id reached the status final, so that it is no longer pending. An id
+	// that is not pending is ignored.
+	Complete(id uuid.UUID, final StatusRecord) error
+	// Pending returns the entries that were recorded and not completed, in the order they were first recorded.
+	Pending() ([]PendingIngestion, error)
+}
+
+// PendingIngestion is an ingestion that a Journal records before its message is posted to the ingestion queue. It
+// holds what Recover() needs to queue the blob again: other ingestion properties, such as tags, are not kept.
+type PendingIngestion struct {
+	// ID is the SourceID() of the ingestion, which its row in the status table is keyed by. The client generates one
+	// for an ingestion without it.
+	ID uuid.UUID
+	// BlobURI is the URI of the blob as the ingestion message holds it, and Size the size of its data before
+	// compression, or 0 if it is not known.
+	BlobURI string
+	Size    int64
+	// Database and Table are where the data is ingested.
+	Database string
+	Table    string
+	// Format, MappingRef and MappingKind are the format and the mapping of the data, DFUnknown and "" when unset.
+	Format      DataFormat `json:",omitempty"`
+	MappingRef  string     `json:",omitempty"`
+	MappingKind DataFormat `json:",omitempty"`
+	// ReportToTable is true if the status of the ingestion is reported to the status table, see ReportResultToTable().
+	ReportToTable bool
+	// RecordedOn is when the entry was recorded.
+	RecordedOn time.Time
+}
+
+// options returns the FileOptions that the blob of p is queued again with.
+func (p PendingIngestion) options() []FileOption {
+	options := []FileOption{SourceID(p.ID), Database(p.Database), Table(p.Table)}
+	if p.Format != DFUnknown {
+		options = append(options, FileFormat(p.Format))
+	}
+	if p.MappingRef != "" {
+		options = append(options, IngestionMappingRef(p.MappingRef, p.MappingKind))
+	}
+	if p.ReportToTable {
+		options = append(options, ReportResultToTable())
+	}
+	return options
+}
+
+// WithJournal makes the client record its queued ingestions in journal, see Journal. An ingestion is not queued if
+// it cannot be recorded. A client without a journal does not record anything.
+func WithJournal(journal Journal) Option {
+	return func(s *Ingestion) {
+		s.cfg.journal = journal
+	}
+}
+
+// recordPending returns the hook that records each ingestion in journal before its message is posted.
+func recordPending(journal Journal) func(blobURI string, size int64, props properties.All) error {
+	return func(blobURI string, size int64, props properties.All) error {
+		report := props.Ingestion.ReportMethod
+		return journal.Record(PendingIngestion{
+			ID:            props.Source.ID,
+			BlobURI:       blobURI,
+			Size:          size,
+			Database:      props.Ingestion.DatabaseName,
+			Table:         props.Ingestion.TableName,
+			Format:        props.Ingestion.Additional.Format,
+			MappingRef:    props.Ingestion.Additional.IngestionMappingRef,
+			MappingKind:   props.Ingestion.Additional.IngestionMappingType,
+			ReportToTable: report == properties.ReportStatusToTable || report == properties.ReportStatusToQueueAndTable,
+			RecordedOn:    time.Now(),
+		})
+	}
+}
+
+// completeJournal completes the entry of the ingestion of result in the journal of WithJournal() when its outcome is
+// known once it was queued: err, the failure to queue it, or Queued when its status is not reported to a table. An
+// ingestion whose status is reported to a table is completed once its final status is observed, see observed().
+// An entry that cannot be completed stays pending, for Recover() to find it.
+func (i *Ingestion) completeJournal(result *Result, err error) {
+	journal := i.cfg.journal
+	if journal == nil {
+		return
+	}
+
+	rec := result.record
+	switch {
+	case err != nil:
+		rec.Status = Failed
+		rec.FailureStatus = Permanent
+		if errors.Retryable(err) {
+			rec.FailureStatus = Transient
+		}
+		rec.Details = err.Error()
+	case result.reportToTable:
+		result.journal = journal
+		return
+	}
+	_ = journal.Complete(rec.IngestionSourceID, rec)
+}
+
+// observed completes the entry of the ingestion in the journal of the Result, if it has one, when rec is the final
+// status of the ingestion. Failing to read the status is not one.
+func (r *Result) observed(rec statusRecord) {
+	if r.journal == nil || !rec.Status.IsFinal() || rec.Status == StatusRetrievalFailed || rec.Status == StatusRetrievalCanceled {
+		return
+	}
+	_ = r.journal.Complete(rec.IngestionSourceID, rec)
+}
+
+// Recover returns a Result for each ingestion that journal has pending, such as after the process that ingested
+// with a client made WithJournal() crashed. For an ingestion with a row in the status table, the Result follows that
+// row, and the entry is completed once its status is final. For one without, the blob is queued again with
+// ingestion, with the options of the entry, unless the blob is known to no longer exist, for which the Result is a
+// failure. As the message of an ingestion without a row may have been posted before the crash, an ingestion can be
+// queued twice: give it a SourceID() and an IngestIfNotExists() tag when that matters.
+// The entries that cannot be recovered, such as when the status table cannot be read, stay pending and have no
+// Result, and the error returned tells how many there are and why the first one failed.
+func Recover(ctx context.Context, ingestion *Ingestion, journal Journal) ([]*Result, error) {
+	if ingestion.isClosed() {
+		return nil, ClientClosedErr
+	}
+	entries, err := journal.Pending()
+	if err != nil {
+		return nil, errors.E(errors.OpFileIngest, errors.KOther, fmt.Errorf("could not read the pending ingestions of the journal: %w", err))
+	}
+
+	var results []*Result
+	var first error
+	failed := 0
+	for _, entry := range entries {
+		result, err := ingestion.recoverEntry(ctx, journal, entry)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+			continue
+		}
+		results = append(results, result)
+	}
+	if first != nil {
+		return results, errors.E(errors.OpFileIngest, errors.KOther, fmt.Errorf("%d of the %d pending ingestions could not be recovered, the first one because: %w", failed, len(entries), first))
+	}
+	return results, nil
+}
+
+// recoverEntry returns the Result of the pending ingestion entry, see Recover().
+func (i *Ingestion) recoverEntry(ctx context.Context, journal Journal, entry PendingIngestion) (*Result, error) {
+	if entry.ReportToTable {
+		rec, found, err := i.lookupStatus(entry.ID)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			result := newResult()
+			result.record = rec
+			result.reportToTable = true
+			result.method = QueuedIngestion
+			result.poller = i.poller
+			result.journal = journal
+			if i.statusReader == nil {
+				if result.tableClient, err = i.statusTableClient(entry.ID); err != nil {
+					return nil, err
+				}
+			}
+			result.observed(rec)
+			return result, nil
+		}
+	}
+
+	if i.blobGone(ctx, entry.BlobURI) {
+		result := newResult()
+		result.method = QueuedIngestion
+		result.record.IngestionSourceID = entry.ID
+		result.record.IngestionSourcePath = entry.BlobURI
+		result.record.Database = entry.Database
+		result.record.Table = entry.Table
+		result.record.Status = Failed
+		result.record.FailureStatus = Permanent
+		result.record.ErrorCode = "Download_SourceNotFound"
+		result.record.Details = "the blob of the pending ingestion no longer exists, it cannot be queued again"
+		result.record.UpdatedOn = time.Now()
+		if err := journal.Complete(entry.ID, result.record); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	return i.RetryEnqueue(ctx, entry.BlobURI, entry.Size, entry.options()...)
+}
+
+// lookupStatus returns the row of the status table for the ingestion with sourceID, and false if there is none.
+func (i *Ingestion) lookupStatus(sourceID uuid.UUID) (statusRecord, bool, error) {
+	var data map[string]interface{}
+	if i.statusReader != nil {
+		var err error
+		if data, err = i.statusReader(sourceID); err != nil {
+			return statusRecord{}, false, err
+		}
+	} else {
+		client, err := i.statusTableClient(sourceID)
+		if err != nil {
+			return statusRecord{}, false, err
+		}
+		rows, err := client.ReadMany([]string{sourceID.String()})
+		if err != nil {
+			return statusRecord{}, false, errors.E(errors.OpFileIngest, errors.KBlobstore, err)
+		}
+		data = rows[sourceID.String()]
+	}
+	if data == nil {
+		return statusRecord{}, false, nil
+	}
+
+	rec := newStatusRecord()
+	rec.FromMap(data)
+	return rec, true, nil
+}
+
+// blobGone reports if the blob at blobURI is known to no longer exist: a request made with its shared access
+// signature found no blob. It is false when that cannot be told, such as for a blob without a shared access
+// signature, for which blob storage answers that it does not exist when it is not allowed to tell.
+func (i *Ingestion) blobGone(ctx context.Context, blobURI string) bool {
+	u, err := url.Parse(blobURI)
+	if err != nil || u.Query().Get("sig") == "" {
+		return false
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, blobURI, nil)
+	if err != nil {
+		return false
+	}
+	client := i.cfg.storageHTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNotFound
+}
+
+// FileJournal is a Journal kept in a file, which each Record() and Complete() appends a line of JSON to and syncs to
+// disk before returning. NewFileJournal() compacts the file to the pending entries.
+type FileJournal struct {
+	mu      sync.Mutex
+	file    *os.File
+	pending map[uuid.UUID]PendingIngestion
+	// order are the ids of pending, in the order they were first recorded.
+	order []uuid.UUID
+}
+
+var _ Journal = (*FileJournal)(nil)
+
+// journalLine is a line of the file of a FileJournal: an entry that was recorded, or the id of one that was completed
+// with its final status.
+type journalLine struct {
+	Entry     *PendingIngestion `json:",omitempty"`
+	Completed *uuid.UUID        `json:",omitempty"`
+	Status    StatusCode        `json:",omitempty"`
+}
+
+// NewFileJournal opens the FileJournal in the file at path, which is created if it does not exist. The entries that
+// the file has pending are kept, and a last line that was cut short, as by a crash while it was written, is left out.
+func NewFileJournal(path string) (*FileJournal, error) {
+	j := &FileJournal{pending: map[uuid.UUID]PendingIngestion{}}
+
+	if err := j.load(path); err != nil {
+		return nil, errors.E(errors.OpFileIngest, errors.KLocalFileSystem, fmt.Errorf("could not read the journal %s: %w", path, err))
+	}
+	if err := j.compact(path); err != nil {
+		return nil, errors.E(errors.OpFileIngest, errors.KLocalFileSystem, fmt.Errorf("could not write the journal %s: %w", path, err))
+	}
+	return j, nil
+}
+
+// load reads the entries that the file at path has pending.
+func (j *FileJournal) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	var bad error
+	for scanner.Scan() {
+		if bad != nil {
+			// Only the last line can have been cut short.
+			return bad
+		}
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var line journalLine
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			bad = fmt.Errorf("a line is not valid: %w", err)
+			continue
+		}
+		j.apply(line)
+	}
+	return scanner.Err()
+}
+
+// apply applies line to the pending entries.
+func (j *FileJournal) apply(line journalLine) {
+	switch {
+	case line.Entry != nil:
+		if _, ok := j.pending[line.Entry.ID]; !ok {
+			j.order = append(j.order, line.Entry.ID)
+		}
+		j.pending[line.Entry.ID] = *line.Entry
+	case line.Completed != nil:
+		if _, ok := j.pending[*line.Completed]; !ok {
+			return
+		}
+		delete(j.pending, *line.Completed)
+		for n, id := range j.order {
+			if id == *line.Completed {
+				j.order = append(j.order[:n], j.order[n+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// compact replaces the file at path with one that only has the pending entries, and opens it to append to.
+func (j *FileJournal) compact(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, id := range j.order {
+		entry := j.pending[id]
+		b, err := json.Marshal(journalLine{Entry: &entry})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	j.file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+// write appends line to the file and applies it to the pending entries.
+func (j *FileJournal) write(line journalLine) error {
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "the journal is closed").SetNoRetry()
+	}
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		return errors.E(errors.OpFileIngest, errors.KLocalFileSystem, err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return errors.E(errors.OpFileIngest, errors.KLocalFileSystem, err)
+	}
+	j.apply(line)
+	return nil
+}
+
+// Record implements Journal.Record().
+func (j *FileJournal) Record(entry PendingIngestion) error {
+	return j.write(journalLine{Entry: &entry})
+}
+
+// Complete implements Journal.Complete().
+func (j *FileJournal) Complete(id uuid.UUID, final StatusRecord) error {
+	j.mu.Lock()
+	_, ok := j.pending[id]
+	j.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return j.write(journalLine{Completed: &id, Status: final.Status})
+}
+
+// Pending implements Journal.Pending().
+func (j *FileJournal) Pending() ([]PendingIngestion, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := make([]PendingIngestion, 0, len(j.order))
+	for _, id := range j.order {
+		entries = append(entries, j.pending[id])
+	}
+	return entries, nil
+}
+
+// Close closes the file of the journal. Later calls of Record() and Complete() fail.
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,246 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileJournal(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := NewFileJournal(path)
+	require.NoError(t, err)
+
+	first, second, third := uuid.New(), uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{first, second, third} {
+		require.NoError(t, j.Record(PendingIngestion{ID: id, BlobURI: "https://account.blob.core.windows.net/container/" + id.String(), Database: "db", Table: "table", Format: CSV}))
+	}
+	// Recording an entry again replaces it, and completing an unknown one does nothing.
+	require.NoError(t, j.Record(PendingIngestion{ID: first, BlobURI: "https://account.blob.core.windows.net/container/replaced", Format: JSON}))
+	require.NoError(t, j.Complete(second, StatusRecord{Status: Succeeded}))
+	require.NoError(t, j.Complete(uuid.New(), StatusRecord{Status: Failed}))
+	require.NoError(t, j.Close())
+	assert.Error(t, j.Record(PendingIngestion{ID: uuid.New()}), "a closed journal cannot record")
+
+	// A crash while a line is written leaves it cut short.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"Entry":{"ID":"` + uuid.New().String())
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	j, err = NewFileJournal(path)
+	require.NoError(t, err)
+	defer j.Close()
+
+	pending, err := j.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, first, pending[0].ID)
+	assert.Equal(t, "https://account.blob.core.windows.net/container/replaced", pending[0].BlobURI)
+	assert.Equal(t, JSON, pending[0].Format)
+	assert.Equal(t, third, pending[1].ID)
+	assert.Equal(t, "table", pending[1].Table)
+
+	// The file was compacted to the pending entries.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(b), "\n"))
+	assert.NotContains(t, string(b), second.String())
+
+	// A line that is not valid before the last one is not a crash.
+	bad := filepath.Join(t.TempDir(), "journal")
+	require.NoError(t, os.WriteFile(bad, []byte("{\n{}\n"), 0600))
+	_, err = NewFileJournal(bad)
+	assert.Error(t, err)
+}
+
+// fakeJournal is a Journal in memory.
+type fakeJournal struct {
+	mu        sync.Mutex
+	recorded  []PendingIngestion
+	completed map[uuid.UUID]StatusRecord
+}
+
+func (j *fakeJournal) Record(entry PendingIngestion) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.recorded = append(j.recorded, entry)
+	return nil
+}
+
+func (j *fakeJournal) Complete(id uuid.UUID, final StatusRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.completed == nil {
+		j.completed = map[uuid.UUID]StatusRecord{}
+	}
+	j.completed[id] = final
+	return nil
+}
+
+func (j *fakeJournal) Pending() ([]PendingIngestion, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var pending []PendingIngestion
+	for _, entry := range j.recorded {
+		if _, ok := j.completed[entry.ID]; !ok {
+			pending = append(pending, entry)
+		}
+	}
+	return pending, nil
+}
+
+func TestJournalQueued(t *testing.T) {
+	t.Parallel()
+
+	journal := &fakeJournal{}
+	ingestion, err := New(mockClient{endpoint: "https://test.kusto.windows.net"}, "db", "table", WithJournal(journal))
+	require.NoError(t, err)
+	defer ingestion.Close()
+
+	queueErr := errors.ES(errors.OpFileIngest, errors.KBlobstore, "queue unavailable")
+	record := recordPending(journal)
+	ingestion.fs = resources.FsMock{
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			// The queued client records the message right before it is posted.
+			require.NoError(t, record("https://account.blob.core.windows.net/container/reader.csv", 3, props))
+			return "reader.csv", nil
+		},
+		OnBlob: func(ctx context.Context, from string, fileSize int64, props properties.All) error {
+			require.NoError(t, record(from, fileSize, props))
+			return queueErr
+		},
+	}
+
+	result, err := ingestion.FromReader(context.Background(), strings.NewReader("a,b"), IngestionMappingRef("mapping", CSV))
+	require.NoError(t, err)
+	_, err = ingestion.FromFile(context.Background(), "https://account.blob.core.windows.net/container/blob.csv", FileFormat(JSON))
+	require.Error(t, err)
+
+	require.Len(t, journal.recorded, 2)
+	reader, blob := journal.recorded[0], journal.recorded[1]
+	assert.NotEqual(t, uuid.Nil, reader.ID, "an ingestion without a SourceID() is given one")
+	assert.Equal(t, result.record.IngestionSourceID, reader.ID)
+	assert.Equal(t, PendingIngestion{
+		ID:          reader.ID,
+		BlobURI:     "https://account.blob.core.windows.net/container/reader.csv",
+		Size:        3,
+		Database:    "db",
+		Table:       "table",
+		Format:      CSV,
+		MappingRef:  "mapping",
+		MappingKind: CSV,
+		RecordedOn:  reader.RecordedOn,
+	}, reader)
+	assert.Equal(t, JSON, blob.Format)
+
+	pending, err := journal.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending, "a queued ingestion whose status is not reported to a table is done")
+	assert.Equal(t, Queued, journal.completed[reader.ID].Status)
+	assert.Equal(t, Failed, journal.completed[blob.ID].Status)
+	assert.Equal(t, Transient, journal.completed[blob.ID].FailureStatus, "the failure to post to the queue can be retried")
+	assert.Contains(t, journal.completed[blob.ID].Details, "queue unavailable")
+}
+
+func TestRecover(t *testing.T) {
+	t.Parallel()
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		if strings.HasPrefix(r.URL.Path, "/container/gone") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer storage.Close()
+
+	succeeded, pending, gone, unsigned, kept, unreadable := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	journal := &fakeJournal{recorded: []PendingIngestion{
+		{ID: succeeded, BlobURI: storage.URL + "/container/succeeded.csv?sig=secret", Database: "db", Table: "table", ReportToTable: true},
+		{ID: pending, BlobURI: storage.URL + "/container/pending.csv?sig=secret", Database: "db", Table: "table", ReportToTable: true},
+		{ID: gone, BlobURI: storage.URL + "/container/gone.csv?sig=secret", Database: "db", Table: "table"},
+		// Without a signature, a 404 does not tell that the blob is gone.
+		{ID: unsigned, BlobURI: storage.URL + "/container/gone-unsigned.csv", Size: 10, Database: "db", Table: "other"},
+		{ID: kept, BlobURI: storage.URL + "/container/kept.csv?sig=secret", Size: 20, Database: "db", Table: "table", Format: JSON, MappingRef: "mapping", MappingKind: JSON},
+		{ID: unreadable, BlobURI: storage.URL + "/container/unreadable.csv?sig=secret", Database: "db", Table: "table", ReportToTable: true},
+	}}
+
+	ingestion, err := New(mockClient{endpoint: "https://test.kusto.windows.net"}, "db", "table", WithJournal(journal))
+	require.NoError(t, err)
+	defer ingestion.Close()
+
+	readErr := goErrors.New("table unavailable")
+	ingestion.statusReader = func(sourceID uuid.UUID) (map[string]interface{}, error) {
+		switch sourceID {
+		case succeeded:
+			return map[string]interface{}{"Status": string(Succeeded), "IngestionSourceId": sourceID.String()}, nil
+		case pending:
+			return map[string]interface{}{"Status": string(Pending), "IngestionSourceId": sourceID.String()}, nil
+		case unreadable:
+			return nil, readErr
+		}
+		return nil, nil
+	}
+	var mu sync.Mutex
+	queued := map[string]properties.All{}
+	ingestion.fs = resources.FsMock{
+		OnBlob: func(ctx context.Context, from string, fileSize int64, props properties.All) error {
+			mu.Lock()
+			defer mu.Unlock()
+			queued[from] = props
+			return nil
+		},
+	}
+
+	results, err := Recover(context.Background(), ingestion, journal)
+	require.Error(t, err)
+	assert.True(t, goErrors.Is(err, readErr))
+	assert.Contains(t, err.Error(), "1 of the 6")
+	require.Len(t, results, 5)
+
+	assert.Equal(t, Succeeded, results[0].record.Status)
+	assert.Equal(t, Pending, results[1].record.Status)
+	assert.Equal(t, Failed, results[2].record.Status)
+	assert.Equal(t, "Download_SourceNotFound", results[2].record.ErrorCode)
+	assert.Equal(t, errors.KBlobstore, errors.KindOf(results[2].record.Err()))
+
+	// The blobs without a status are queued again, with their id and options.
+	require.Len(t, queued, 2)
+	props := queued[storage.URL+"/container/gone-unsigned.csv"]
+	assert.Equal(t, unsigned, props.Source.ID)
+	assert.Equal(t, "other", props.Ingestion.TableName)
+	props = queued[storage.URL+"/container/kept.csv?sig=secret"]
+	assert.Equal(t, kept, props.Source.ID)
+	assert.Equal(t, JSON, props.Ingestion.Additional.Format)
+	assert.Equal(t, "mapping", props.Ingestion.Additional.IngestionMappingRef)
+
+	// The ingestion that is still pending, and the one whose status could not be read, stay in the journal.
+	left, err := journal.Pending()
+	require.NoError(t, err)
+	var ids []uuid.UUID
+	for _, entry := range left {
+		ids = append(ids, entry.ID)
+	}
+	assert.Equal(t, []uuid.UUID{pending, unreadable}, ids)
+
+	// The pending one is completed once its final status is observed.
+	results[1].observed(StatusRecord{IngestionSourceID: pending, Status: PartiallySucceeded})
+	assert.Equal(t, PartiallySucceeded, journal.completed[pending].Status)
+}
@@ -3,6 +3,7 @@ package ingest
 import (
 	"bytes"
 	"context"
+	goErrors "errors"
 	"fmt"
 	"io"
 	"time"
@@ -10,18 +11,24 @@ import (
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/gzip"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
-	"github.com/cenkalti/backoff/v4"
 	"github.com/google/uuid"
 )
 
 const (
-	mb                     = 1024 * 1024
-	maxStreamingSize       = 4 * mb
-	defaultInitialInterval = 1 * time.Second
-	defaultMultiplier      = 2
-	retryCount             = 2
+	mb               = 1024 * 1024
+	maxStreamingSize = 4 * mb
 )
 
+// defaultManagedRetry is how a Managed client retries a transiently failed streaming ingestion, unless
+// WithRetryPolicy() set a streaming policy that retries.
+var defaultManagedRetry = BackoffPolicy{InitialInterval: 1 * time.Second, Multiplier: 2, Jitter: 0.5, MaxAttempts: 3}
+
+// Managed ingests data with streaming ingestion when possible, and falls back to queued ingestion otherwise.
+// Payloads larger than the streaming limit after compression, 4 MiB unless changed with WithMaxStreamingSize(), and
+// blob URIs are always queued, as are JSON and Avro payloads without a reference to an ingestion mapping. Transient
+// streaming failures are retried with a backoff and then queued, as are payloads sent to a table whose streaming
+// ingestion policy is disabled. Other permanent failures, such as a bad format or mapping, are returned, as queued
+// ingestion would fail the same way. Result.Method() reports which path was used.
 type Managed struct {
 	queued    *Ingestion
 	streaming *Streaming
@@ -33,7 +40,7 @@ func NewManaged(client QueryClient, db, table string, options ...Option) (*Manag
 	if err != nil {
 		return nil, err
 	}
-	streaming, err := NewStreaming(client, db, table)
+	streaming, err := NewStreaming(client, db, table, append(queued.cfg.streamingOptions(), withLimiter(queued.limiter))...)
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +66,22 @@ func (m *Managed) FromFile(ctx context.Context, fPath string, options ...FileOpt
 	return m.managedStreamImpl(ctx, file, props)
 }
 
+// FromBlob ingests the blob at blobURI with the queued client, as FromFile() does with a blob URI, see
+// Ingestion.FromBlob(). This method is thread-safe.
+func (m *Managed) FromBlob(ctx context.Context, blobURI string, options ...FileOption) (*Result, error) {
+	if err := validateBlobURI(blobURI); err != nil {
+		return nil, err
+	}
+
+	props := m.newProp()
+	for _, option := range options {
+		if err := option.Run(&props, ManagedClient, FromBlob); err != nil {
+			return nil, err
+		}
+	}
+	return m.queued.fromBlob(ctx, blobURI, 0, nil, props)
+}
+
 func (m *Managed) FromReader(ctx context.Context, reader io.Reader, options ...FileOption) (*Result, error) {
 	props := m.newProp()
 
@@ -73,22 +96,45 @@ func (m *Managed) FromReader(ctx context.Context, reader io.Reader, options ...F
 }
 
 func (m *Managed) managedStreamImpl(ctx context.Context, payload io.Reader, props properties.All) (*Result, error) {
-	compress := !props.Source.DontCompress
-	if compress {
-		payload = gzip.Compress(payload)
-		props.Source.DontCompress = true
+	if m.queued.isClosed() {
+		return nil, ClientClosedErr
+	}
+	if props.Source.ValidateTarget {
+		if err := m.queued.validateTarget(ctx, props); err != nil {
+			return nil, err
+		}
 	}
-	maxSize := maxStreamingSize
+	a := props.Ingestion.Additional
+	if err := checkMappingKind(errors.OpFileIngest, a.Format, a.IngestionMappingType); err != nil {
+		return nil, err
+	}
+	// Queued ingestion takes JSON and Avro data without a reference to a mapping, zip data and data of formats that
+	// cannot be streamed, which streaming does not.
+	if (a.IngestionMappingRef == "" && a.Format.RequiresStreamingMapping()) || validateStreamCompression(props) != nil || validateStreamFormat(props) != nil {
+		return m.queued.fromReader(ctx, payload, []FileOption{}, props)
+	}
+
+	// The paths below only see the compressed payload, so the bytes read from the source are counted here.
+	counts := &properties.ByteCounts{}
+	payload = counts.CountRead(payload)
 
-	buf, err := io.ReadAll(io.LimitReader(payload, int64(maxSize+1)))
+	if props.ShouldCompress() {
+		zr := gzip.CompressLevel(payload, props.Source.GzipLevel())
+		defer zr.Close()
+		payload = zr
+		props.Source.Compression = properties.GZIP
+	}
+	maxSize := m.queued.cfg.streamingLimit()
+
+	buf, err := io.ReadAll(io.LimitReader(payload, maxSize+1))
 	if err != nil {
 		return nil, err
 	}
 
 	// If the payload is larger than the max size for streaming, we fall back to queued by combining what we read with the rest of the payload
-	if len(buf) > maxSize {
+	if int64(len(buf)) > maxSize {
 		combinedBuf := io.MultiReader(bytes.NewReader(buf), payload)
-		return m.queued.fromReader(ctx, combinedBuf, []FileOption{}, props)
+		return withBytesRead(counts)(m.queued.fromReader(ctx, combinedBuf, []FileOption{}, props))
 	}
 
 	var result *Result
@@ -97,44 +143,50 @@ func (m *Managed) managedStreamImpl(ctx context.Context, payload io.Reader, prop
 	i := 0
 	managedUuid := uuid.New().String()
 
-	actualBackoff := backoff.WithContext(backoff.WithMaxRetries(props.ManagedStreaming.Backoff, retryCount), ctx)
-
-	err = backoff.Retry(func() error {
+	err = Retrier{Policy: props.ManagedStreaming.Retry}.Do(ctx, func(ctx context.Context) error {
 		if !hasCustomId {
 			props.Streaming.ClientRequestId = fmt.Sprintf("KGC.executeManagedStreamingIngest;%s;%d", managedUuid, i)
 		}
-		result, err = streamImpl(m.streaming.streamConn, ctx, bytes.NewReader(buf), props)
+		var err error
+		result, err = streamImpl(m.streaming.conn(), ctx, bytes.NewReader(buf), props)
 		i++
-		if err != nil {
-			if e, ok := err.(*errors.Error); ok {
-				if errors.Retry(e) {
-					return err
-				} else {
-					return backoff.Permanent(err)
-				}
-			} else {
-				return backoff.Permanent(err)
-			}
-		}
-		return nil
-	}, actualBackoff)
+		return err
+	})
 
 	if err == nil {
-		return result, nil
+		return withBytesRead(counts)(result, nil)
 	}
 
 	// Fallback to queued
-	if errors.Retry(err) {
-		return m.queued.fromReader(ctx, bytes.NewReader(buf), []FileOption{}, props)
+	if errors.Retryable(err) || isStreamingDisabled(err) || isPayloadTooLarge(err) {
+		return withBytesRead(counts)(m.queued.fromReader(ctx, bytes.NewReader(buf), []FileOption{}, props))
 	}
 
 	return nil, err
 }
 
+// isPayloadTooLarge reports if err is the error returned when a payload is over the streaming limit.
+func isPayloadTooLarge(err error) bool {
+	var e *errors.Error
+	return goErrors.As(err, &e) && e.Kind == errors.KPayloadTooLarge
+}
+
+// withBytesRead returns a function that replaces the number of bytes read on a successful Result with the number in
+// counts, as the ingestion it comes from only saw the compressed payload.
+func withBytesRead(counts *properties.ByteCounts) func(*Result, error) (*Result, error) {
+	return func(result *Result, err error) (*Result, error) {
+		if err == nil {
+			result.bytesRead = counts.Read()
+		}
+		return result, err
+	}
+}
+
 func (m *Managed) newProp() properties.All {
-	exp := backoff.NewExponentialBackOff()
-	exp.InitialInterval = defaultInitialInterval
-	exp.Multiplier = defaultMultiplier
+	policy := defaultManagedRetry
+	if m.queued.cfg.streamingRetry.Retries() {
+		policy = m.queued.cfg.streamingRetry
+	}
 
 	return properties.All{
 		Ingestion: properties.Ingestion{
@@ -142,7 +194,21 @@ func (m *Managed) newProp() properties.All {
 			TableName:    m.streaming.table,
 		},
 		ManagedStreaming: properties.ManagedStreaming{
-			Backoff: exp,
+			Retry: policy,
 		},
+		Source: m.queued.cfg.sourceOptions(),
+		Streaming: properties.Streaming{
+			MaxPayloadSize: m.queued.cfg.maxStreamingSize,
+		},
+	}
+}
+
+// Close closes the queued and streaming clients of the Managed client, see Ingestion.Close() and Streaming.Close().
+// The client is closed with the kusto.Client it was made from. Close can be called more than once.
+func (m *Managed) Close() error {
+	err := m.queued.Close()
+	if serr := m.streaming.Close(); err == nil {
+		err = serr
 	}
+	return err
 }
@@ -16,12 +16,13 @@ import (
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/gzip"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
-	"github.com/cenkalti/backoff/v4"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+const streamingDisabledBody = `{"error":{"code":"BadRequest_StreamingIngestionPolicyNotEnabled","message":"Request is invalid and cannot be executed.","@type":"Kusto.DataNode.Exceptions.StreamingIngestionPolicyNotEnabledException","@permanent":true}}`
+
 type testMgmtFunc func(t *testing.T, ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error)
 
 func failIfQueuedCalled(t *testing.T, _ context.Context, _ string, query kusto.Stmt, _ ...kusto.MgmtOption) (*kusto.RowIterator, error) {
@@ -49,6 +50,7 @@ func TestManaged(t *testing.T) {
 
 	tests := []struct {
 		name            string
+		ingestOptions   []Option
 		options         []FileOption
 		onStreamIngest  testStreamIngestFunc
 		onMgmt          testMgmtFunc
@@ -109,6 +111,7 @@ func TestManaged(t *testing.T) {
 			name: "TestManagedStreamingWithFormat",
 			options: []FileOption{
 				FileFormat(properties.JSON),
+				IngestionMappingRef("mapping", properties.JSON),
 			},
 			onStreamIngest: func(t *testing.T, ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string,
 				clientRequestId string) error {
@@ -118,7 +121,7 @@ func TestManaged(t *testing.T) {
 				assert.NoError(t, err)
 				assert.Equal(t, compressedBytes, payloadBytes)
 				assert.Equal(t, properties.JSON, format)
-				assert.Equal(t, "", mappingName)
+				assert.Equal(t, "mapping", mappingName)
 				parts := strings.Split(clientRequestId, ";")
 				assert.Equal(t, "KGC.executeManagedStreamingIngest", parts[0])
 				_, err = uuid.Parse(parts[1])
@@ -258,6 +261,128 @@ func TestManaged(t *testing.T) {
 			expectedCounter: 4,
 			expectedStatus:  Queued,
 		},
+		{
+			name:    "TestStreamingPolicyDisabled",
+			options: []FileOption{},
+			onStreamIngest: func(t *testing.T, ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string,
+				clientRequestId string) error {
+				return errors.HTTP(errors.OpIngestStream, "400 Bad Request", ioutil.NopCloser(strings.NewReader(streamingDisabledBody)), "")
+			},
+			onMgmt: func(t *testing.T, ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+				// .get ingestion resources is always called in the ctor
+				if query.String() == ".get ingestion resources" {
+					return resources.SuccessfulFakeResources().Mgmt(ctx, db, query, options...)
+				}
+				if query.String() == ".get kusto identity token" {
+					return nil, nil
+				}
+
+				require.Fail(t, "Unexpected queued ingest call")
+				return nil, nil
+			},
+			onReader: func(t *testing.T, ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+				counter++
+				all, err := ioutil.ReadAll(reader)
+				assert.NoError(t, err)
+				assert.Equal(t, compressedBytes, all)
+				return "", nil
+			},
+			expectedCounter: 2,
+			expectedStatus:  Queued,
+		},
+		{
+			name:    "TestPayloadTooLarge",
+			options: []FileOption{},
+			onStreamIngest: func(t *testing.T, ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string,
+				clientRequestId string) error {
+				return payloadTooLargeErr(maxStreamingSize)
+			},
+			onMgmt: func(t *testing.T, ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+				// .get ingestion resources is always called in the ctor
+				if query.String() == ".get ingestion resources" {
+					return resources.SuccessfulFakeResources().Mgmt(ctx, db, query, options...)
+				}
+				if query.String() == ".get kusto identity token" {
+					return nil, nil
+				}
+
+				require.Fail(t, "Unexpected queued ingest call")
+				return nil, nil
+			},
+			onReader: func(t *testing.T, ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+				counter++
+				all, err := ioutil.ReadAll(reader)
+				assert.NoError(t, err)
+				assert.Equal(t, compressedBytes, all)
+				return "", nil
+			},
+			expectedCounter: 2,
+			expectedStatus:  Queued,
+		},
+		{
+			name:    "TestJSONWithoutMappingIsQueued",
+			options: []FileOption{FileFormat(properties.JSON)},
+			onStreamIngest: func(t *testing.T, ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string,
+				clientRequestId string) error {
+				require.Fail(t, "JSON without a mapping reference shouldn't try to stream")
+				return nil
+			},
+			onReader: func(t *testing.T, ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+				counter++
+				assert.Equal(t, properties.JSON, props.Ingestion.Additional.Format)
+				return "", nil
+			},
+			expectedCounter: 1,
+			expectedStatus:  Queued,
+		},
+		{
+			name:    "TestSStreamIsQueued",
+			options: []FileOption{FileFormat(properties.SStream)},
+			onStreamIngest: func(t *testing.T, ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string,
+				clientRequestId string) error {
+				require.Fail(t, "SStream data cannot be streamed")
+				return nil
+			},
+			onReader: func(t *testing.T, ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+				counter++
+				assert.Equal(t, properties.SStream, props.Ingestion.Additional.Format)
+				assert.False(t, props.ShouldCompress(), "SStream data should not be compressed")
+				return "", nil
+			},
+			expectedCounter: 1,
+			expectedStatus:  Queued,
+		},
+		{
+			name:          "TestMaxStreamingSize",
+			ingestOptions: []Option{WithMaxStreamingSize(10)},
+			options:       []FileOption{},
+			onStreamIngest: func(t *testing.T, ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string,
+				clientRequestId string) error {
+				require.Fail(t, "A payload over the configured limit shouldn't try to stream")
+				return nil
+			},
+			onMgmt: func(t *testing.T, ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+				// .get ingestion resources is always called in the ctor
+				if query.String() == ".get ingestion resources" {
+					return resources.SuccessfulFakeResources().Mgmt(ctx, db, query, options...)
+				}
+				if query.String() == ".get kusto identity token" {
+					return nil, nil
+				}
+
+				require.Fail(t, "Unexpected queued ingest call")
+				return nil, nil
+			},
+			onReader: func(t *testing.T, ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+				counter++
+				all, err := ioutil.ReadAll(reader)
+				assert.NoError(t, err)
+				assert.Equal(t, compressedBytes, all)
+				return "", nil
+			},
+			expectedCounter: 1,
+			expectedStatus:  Queued,
+		},
 		{
 			name:      "TestBigFile",
 			options:   []FileOption{},
@@ -344,13 +469,13 @@ func TestManaged(t *testing.T) {
 				},
 			}
 
-			ingestion, err := New(mockClient, "defaultDb", "defaultTable")
+			ingestion, err := New(mockClient, "defaultDb", "defaultTable", test.ingestOptions...)
 			ingestion.fs = resources.FsMock{
-				OnLocal: func(ctx context.Context, from string, props properties.All) error {
+				OnLocal: func(ctx context.Context, from string, props properties.All) (string, error) {
 					if test.onLocal == nil {
-						return nil
+						return "", nil
 					}
-					return test.onLocal(t, ctx, from, props)
+					return "", test.onLocal(t, ctx, from, props)
 				},
 				OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
 					if test.onReader == nil {
@@ -376,9 +501,9 @@ func TestManaged(t *testing.T) {
 				},
 			}
 
-			off := backoff.NewExponentialBackOff()
-			off.InitialInterval = time.Millisecond
-			test.options = append([]FileOption{backOff(off)}, test.options...)
+			policy := defaultManagedRetry
+			policy.InitialInterval = time.Millisecond
+			test.options = append([]FileOption{backOff(policy)}, test.options...)
 
 			counter = 0
 
@@ -386,6 +511,7 @@ func TestManaged(t *testing.T) {
 				result, err := managed.FromFile(ctx, test.blobPath, test.options...)
 				assert.NoError(t, err)
 				assert.Equal(t, result.record.Status, test.expectedStatus)
+				assert.Equal(t, QueuedIngestion, result.Method())
 				return
 			}
 
@@ -409,6 +535,7 @@ func TestManaged(t *testing.T) {
 					test.expectedStatus = "Success"
 				}
 				assert.Equal(t, result.record.Status, test.expectedStatus)
+				assert.Equal(t, expectedMethod(test.expectedStatus), result.Method())
 			}
 
 			assert.Equal(t, test.expectedCounter, counter)
@@ -424,6 +551,7 @@ func TestManaged(t *testing.T) {
 					test.expectedStatus = "Success"
 				}
 				assert.Equal(t, result.record.Status, test.expectedStatus)
+				assert.Equal(t, expectedMethod(test.expectedStatus), result.Method())
 			}
 			assert.Equal(t, test.expectedCounter, counter)
 
@@ -432,6 +560,14 @@ func TestManaged(t *testing.T) {
 
 }
 
+// expectedMethod returns the ingestion method that leads to status.
+func expectedMethod(status StatusCode) IngestionMethod {
+	if status == Queued {
+		return QueuedIngestion
+	}
+	return StreamingIngestion
+}
+
 func initFile(t *testing.T, reader *bytes.Reader) ([]byte, []byte) {
 	data, err := ioutil.ReadAll(reader)
 
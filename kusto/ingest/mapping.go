@@ -0,0 +1,240 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/unsafe"
+)
+
+// MappingColumn maps one column of a table to a value in the ingested data. It is used with CreateOrAlterMapping()
+// and returned by GetMapping().
+// For more details, see: https://docs.microsoft.com/en-us/azure/data-explorer/kusto/management/mappings
+type MappingColumn struct {
+	// Column is the name of the column in the table.
+	Column string
+	// DataType is the type of the column. It is optional, and only used when the column does not exist yet.
+	DataType types.Column
+	// Path is the path of the value in the record, such as "$.a.b", for JSON, Avro, Parquet and ORC mappings.
+	Path string
+	// Ordinal is the position of the value in the record, starting at 0, for CSV mappings.
+	Ordinal int
+	// Field is the name of the field of the record, for W3CLogFile mappings, and for Avro mappings, where Path is
+	// preferred, as Field is a legacy form of it.
+	Field string
+	// ConstValue is a constant value ingested into the column instead of a value from the record.
+	ConstValue string
+	// Transform is a transformation applied to the value, such as "SourceLocation" or "DateTimeFromUnixSeconds".
+	Transform string
+}
+
+// mappingColumnJSON is the JSON of a MappingColumn in a mapping, where all properties are strings.
+type mappingColumnJSON struct {
+	Column     string            `json:"column"`
+	DataType   string            `json:"datatype,omitempty"`
+	Properties map[string]string `json:"Properties"`
+}
+
+// CreateOrAlterMapping creates the ingestion mapping "name" of kind "kind" for table "tableName" in database "db", or
+// replaces its columns if it already exists. kind can only be: CSV, JSON, AVRO, Parquet, ORC or W3CLogFile.
+// It returns an error of kind errors.KTableNotExist if the table does not exist, and of kind errors.KMappingInvalid if
+// the columns are not a valid mapping of that kind.
+func CreateOrAlterMapping(ctx context.Context, client QueryClient, db, tableName, name string, kind DataFormat, columns []MappingColumn) error {
+	if err := checkMappingArgs(tableName, name, kind); err != nil {
+		return err
+	}
+	body, err := encodeMapping(kind, columns)
+	if err != nil {
+		return err
+	}
+
+	stmt := kusto.NewStmt(".create-or-alter table ", kusto.UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).
+		UnsafeAdd(quoteName(tableName)).
+		Add(" ingestion ").
+		UnsafeAdd(kind.String()).
+		Add(" mapping ").
+		UnsafeAdd(quoteString(name) + " " + quoteString(body))
+
+	rows, err := mgmtDo(ctx, client, db, stmt)
+	if err != nil {
+		return mappingErr(err, db, tableName, name)
+	}
+
+	recs, err := mappingRecs(rows)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if rec.Name == name {
+			return nil
+		}
+	}
+	return errors.ES(errors.OpMgmt, errors.KInternal, "creating ingestion mapping %q of table %q did not return the mapping", name, tableName)
+}
+
+// GetMapping returns the columns of the ingestion mapping "name" of kind "kind" of table "tableName" in database "db".
+// It returns an error of kind errors.KTableNotExist if the table does not exist, and of kind errors.KMappingNotExist
+// if the table has no mapping of that name and kind.
+func GetMapping(ctx context.Context, client QueryClient, db, tableName, name string, kind DataFormat) ([]MappingColumn, error) {
+	if err := checkMappingArgs(tableName, name, kind); err != nil {
+		return nil, err
+	}
+
+	rows, err := mgmtDo(ctx, client, db, showTableStmt(tableName).Add(" ingestion ").UnsafeAdd(kind.String()).Add(" mappings"))
+	if err != nil {
+		return nil, mappingErr(err, db, tableName, name)
+	}
+
+	recs, err := mappingRecs(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range recs {
+		if rec.Name == name {
+			return decodeMapping(rec.Mapping)
+		}
+	}
+	return nil, errors.ES(errors.OpMgmt, errors.KMappingNotExist, "table %q has no %s ingestion mapping named %q", tableName, kind.CamelCase(), name).SetNoRetry()
+}
+
+// DeleteMapping drops the ingestion mapping "name" of kind "kind" of table "tableName" in database "db".
+// It returns an error of kind errors.KTableNotExist if the table does not exist, and of kind errors.KMappingNotExist
+// if the table has no mapping of that name and kind.
+func DeleteMapping(ctx context.Context, client QueryClient, db, tableName, name string, kind DataFormat) error {
+	if err := checkMappingArgs(tableName, name, kind); err != nil {
+		return err
+	}
+
+	stmt := kusto.NewStmt(".drop table ", kusto.UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).
+		UnsafeAdd(quoteName(tableName)).
+		Add(" ingestion ").
+		UnsafeAdd(kind.String()).
+		Add(" mapping ").
+		UnsafeAdd(quoteString(name))
+
+	if _, err := mgmtDo(ctx, client, db, stmt); err != nil {
+		return mappingErr(err, db, tableName, name)
+	}
+	return nil
+}
+
+func checkMappingArgs(tableName, name string, kind DataFormat) error {
+	if tableName == "" || name == "" {
+		return errors.ES(errors.OpMgmt, errors.KClientArgs, "the table and the mapping name must be set").SetNoRetry()
+	}
+	if !kind.IsValidMappingKind() {
+		return errors.ES(errors.OpMgmt, errors.KClientArgs, "%v is not a kind of ingestion mapping", kind).SetNoRetry()
+	}
+	return nil
+}
+
+// mappingErr converts the errors the service returns for mapping commands to errors of the kind of the problem.
+func mappingErr(err error, db, tableName, name string) error {
+	switch {
+	case isEntityNotFound(err):
+		if se, ok := errors.AsServiceError(err); ok && strings.Contains(se.Detail, "of kind 'Table'") {
+			return errors.E(errors.OpMgmt, errors.KTableNotExist, fmt.Errorf("table %q does not exist in database %q: %w", tableName, db, err)).SetNoRetry()
+		}
+		return errors.E(errors.OpMgmt, errors.KMappingNotExist, fmt.Errorf("table %q has no ingestion mapping named %q: %w", tableName, name, err)).SetNoRetry()
+	case hasErrorCode(err, "MappingInvalid"), hasErrorCode(err, "InvalidMapping"):
+		return errors.E(errors.OpMgmt, errors.KMappingInvalid, fmt.Errorf("ingestion mapping %q is invalid: %w", name, err)).SetNoRetry()
+	}
+	return err
+}
+
+// mappingRec is a row of the result of the mapping commands.
+type mappingRec struct {
+	Name    string `kusto:"Name"`
+	Kind    string `kusto:"Kind"`
+	Mapping string `kusto:"Mapping"`
+}
+
+func mappingRecs(rows []*table.Row) ([]mappingRec, error) {
+	recs := make([]mappingRec, 0, len(rows))
+	for _, row := range rows {
+		rec := mappingRec{}
+		if err := row.ToStruct(&rec); err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// encodeMapping returns the JSON of a mapping of kind "kind" with the columns.
+func encodeMapping(kind DataFormat, columns []MappingColumn) (string, error) {
+	if len(columns) == 0 {
+		return "", errors.ES(errors.OpMgmt, errors.KMappingInvalid, "an ingestion mapping must have at least one column").SetNoRetry()
+	}
+
+	mapping := make([]mappingColumnJSON, 0, len(columns))
+	for _, col := range columns {
+		if col.Column == "" {
+			return "", errors.ES(errors.OpMgmt, errors.KMappingInvalid, "an ingestion mapping column must have a name").SetNoRetry()
+		}
+
+		props := map[string]string{}
+		switch {
+		case col.ConstValue != "":
+			props["ConstValue"] = col.ConstValue
+		case kind == CSV:
+			if col.Ordinal < 0 {
+				return "", errors.ES(errors.OpMgmt, errors.KMappingInvalid, "column %q has a negative Ordinal", col.Column).SetNoRetry()
+			}
+			props["Ordinal"] = strconv.Itoa(col.Ordinal)
+		case col.Path != "":
+			props["Path"] = col.Path
+		case col.Field != "" && (kind == AVRO || kind == W3CLogFile):
+			props["Field"] = col.Field
+		default:
+			return "", errors.ES(errors.OpMgmt, errors.KMappingInvalid, "column %q of a %s ingestion mapping must have a Path or a ConstValue", col.Column, kind.CamelCase()).SetNoRetry()
+		}
+		if col.Transform != "" {
+			props["Transform"] = col.Transform
+		}
+
+		mapping = append(mapping, mappingColumnJSON{Column: col.Column, DataType: string(col.DataType), Properties: props})
+	}
+
+	b, err := json.Marshal(mapping)
+	if err != nil {
+		return "", errors.E(errors.OpMgmt, errors.KInternal, fmt.Errorf("could not encode the ingestion mapping: %w", err)).SetNoRetry()
+	}
+	return string(b), nil
+}
+
+// decodeMapping returns the columns of the JSON of a mapping, as the service returns it.
+func decodeMapping(s string) ([]MappingColumn, error) {
+	var mapping []mappingColumnJSON
+	if err := json.Unmarshal([]byte(s), &mapping); err != nil {
+		return nil, errors.E(errors.OpMgmt, errors.KInternal, fmt.Errorf("could not decode the ingestion mapping: %w", err))
+	}
+
+	columns := make([]MappingColumn, 0, len(mapping))
+	for _, m := range mapping {
+		col := MappingColumn{
+			Column:     m.Column,
+			DataType:   types.Column(m.DataType),
+			Path:       m.Properties["Path"],
+			Field:      m.Properties["Field"],
+			ConstValue: m.Properties["ConstValue"],
+			Transform:  m.Properties["Transform"],
+		}
+		if o, ok := m.Properties["Ordinal"]; ok {
+			ordinal, err := strconv.Atoi(o)
+			if err != nil {
+				return nil, errors.E(errors.OpMgmt, errors.KInternal, fmt.Errorf("column %q has an invalid Ordinal: %w", m.Column, err))
+			}
+			col.Ordinal = ordinal
+		}
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
@@ -0,0 +1,290 @@
+package ingest
+
+import (
+	"context"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	mappingNotFoundBody = `{"error":{"code":"BadRequest_EntityNotFound","message":"Request is invalid and cannot be executed.",` +
+		`"@type":"Kusto.Data.Exceptions.EntityNotFoundException","@message":"Entity ID 'map' of kind 'Mapping' was not found."}}`
+	mappingInvalidBody = `{"error":{"code":"BadRequest","message":"Request is invalid and cannot be executed.",` +
+		`"@type":"Kusto.Data.Exceptions.IngestionMappingInvalidException","@message":"Transform 'Unknown' is not supported."}}`
+)
+
+var (
+	createMappingRE = regexp.MustCompile(`^\.create-or-alter table \["(\w+)"\] ingestion (\w+) mapping ("(?:[^"\\]|\\.)*") ("(?:[^"\\]|\\.)*")$`)
+	showMappingsRE  = regexp.MustCompile(`^\.show table \["(\w+)"\] ingestion (\w+) mappings$`)
+	dropMappingRE   = regexp.MustCompile(`^\.drop table \["(\w+)"\] ingestion (\w+) mapping ("(?:[^"\\]|\\.)*")$`)
+)
+
+// mappingMgmt is a fake of the mapping commands of the service, which keeps the mappings of one table.
+type mappingMgmt struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	table    string
+	mappings map[string]mappingRec
+	commands []string
+}
+
+func (m *mappingMgmt) onMgmt(_ context.Context, _ string, query kusto.Stmt, _ ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := query.String()
+	m.commands = append(m.commands, q)
+
+	var recs []mappingRec
+	switch {
+	case createMappingRE.MatchString(q):
+		match := createMappingRE.FindStringSubmatch(q)
+		if match[1] != m.table {
+			return nil, serviceErr(entityNotFoundBody)
+		}
+		name, body := m.unquote(match[3]), m.unquote(match[4])
+		if strings.Contains(body, `"Transform":"Unknown"`) {
+			return nil, serviceErr(mappingInvalidBody)
+		}
+		rec := mappingRec{Name: name, Kind: match[2], Mapping: body}
+		m.mappings[match[2]+"/"+name] = rec
+		recs = append(recs, rec)
+	case showMappingsRE.MatchString(q):
+		match := showMappingsRE.FindStringSubmatch(q)
+		if match[1] != m.table {
+			return nil, serviceErr(entityNotFoundBody)
+		}
+		for _, rec := range m.mappings {
+			if rec.Kind == match[2] {
+				recs = append(recs, rec)
+			}
+		}
+	case dropMappingRE.MatchString(q):
+		match := dropMappingRE.FindStringSubmatch(q)
+		if match[1] != m.table {
+			return nil, serviceErr(entityNotFoundBody)
+		}
+		key := match[2] + "/" + m.unquote(match[3])
+		if _, ok := m.mappings[key]; !ok {
+			return nil, serviceErr(mappingNotFoundBody)
+		}
+		delete(m.mappings, key)
+	default:
+		m.t.Errorf("unexpected command %q", q)
+		return nil, nil
+	}
+
+	mock, err := kusto.NewMockRows(table.Columns{{Name: "Name", Type: types.String}, {Name: "Kind", Type: types.String}, {Name: "Mapping", Type: types.String}})
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range recs {
+		row := value.Values{
+			value.String{Value: rec.Name, Valid: true},
+			value.String{Value: rec.Kind, Valid: true},
+			value.String{Value: rec.Mapping, Valid: true},
+		}
+		if err := mock.Row(row); err != nil {
+			return nil, err
+		}
+	}
+	iter := &kusto.RowIterator{}
+	if err := iter.Mock(mock); err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+func (m *mappingMgmt) unquote(s string) string {
+	u, err := strconv.Unquote(s)
+	require.NoError(m.t, err, "%s is not a valid string literal", s)
+	return u
+}
+
+func serviceErr(body string) error {
+	return errors.HTTP(errors.OpMgmt, "400 Bad Request", ioutil.NopCloser(strings.NewReader(body)), "")
+}
+
+func TestMappingRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		kind    DataFormat
+		columns []MappingColumn
+		wantCmd string
+	}{
+		{
+			desc: "JSON",
+			kind: JSON,
+			columns: []MappingColumn{
+				{Column: "Name", Path: `$.name "quoted" \ path`},
+				{Column: "When", DataType: types.DateTime, Path: "$.ts", Transform: "DateTimeFromUnixSeconds"},
+				{Column: "Source", ConstValue: "line1\nline2"},
+			},
+			wantCmd: `.create-or-alter table ["Events"] ingestion json mapping "map" "[` +
+				`{\"column\":\"Name\",\"Properties\":{\"Path\":\"$.name \\\"quoted\\\" \\\\ path\"}},` +
+				`{\"column\":\"When\",\"datatype\":\"datetime\",\"Properties\":{\"Path\":\"$.ts\",\"Transform\":\"DateTimeFromUnixSeconds\"}},` +
+				`{\"column\":\"Source\",\"Properties\":{\"ConstValue\":\"line1\\nline2\"}}]"`,
+		},
+		{
+			desc: "CSV",
+			kind: CSV,
+			columns: []MappingColumn{
+				{Column: "Name", Ordinal: 0},
+				{Column: "Count", DataType: types.Long, Ordinal: 3},
+			},
+			wantCmd: `.create-or-alter table ["Events"] ingestion csv mapping "map" "[` +
+				`{\"column\":\"Name\",\"Properties\":{\"Ordinal\":\"0\"}},` +
+				`{\"column\":\"Count\",\"datatype\":\"long\",\"Properties\":{\"Ordinal\":\"3\"}}]"`,
+		},
+		{
+			desc: "Avro",
+			kind: AVRO,
+			columns: []MappingColumn{
+				{Column: "Name", Field: "name"},
+				{Column: "Count", Path: "$.count"},
+			},
+			wantCmd: `.create-or-alter table ["Events"] ingestion avro mapping "map" "[` +
+				`{\"column\":\"Name\",\"Properties\":{\"Field\":\"name\"}},` +
+				`{\"column\":\"Count\",\"Properties\":{\"Path\":\"$.count\"}}]"`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			mgmt := &mappingMgmt{t: t, table: "Events", mappings: map[string]mappingRec{}}
+			client := mockClient{endpoint: "https://test.kusto.windows.net", onMgmt: mgmt.onMgmt}
+			ctx := context.Background()
+
+			require.NoError(t, CreateOrAlterMapping(ctx, client, "db", "Events", "map", test.kind, test.columns))
+			require.NotEmpty(t, mgmt.commands)
+			assert.Equal(t, test.wantCmd, mgmt.commands[0])
+
+			got, err := GetMapping(ctx, client, "db", "Events", "map", test.kind)
+			require.NoError(t, err)
+			assert.Equal(t, test.columns, got)
+
+			require.NoError(t, DeleteMapping(ctx, client, "db", "Events", "map", test.kind))
+			assert.Equal(t, `.drop table ["Events"] ingestion `+test.kind.String()+` mapping "map"`, mgmt.commands[len(mgmt.commands)-1])
+
+			_, err = GetMapping(ctx, client, "db", "Events", "map", test.kind)
+			require.Error(t, err)
+			assert.Equal(t, errors.KMappingNotExist, err.(*errors.Error).Kind)
+		})
+	}
+}
+
+func TestMappingErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cols := []MappingColumn{{Column: "Name", Path: "$.name"}}
+
+	tests := []struct {
+		desc     string
+		do       func(client QueryClient) error
+		wantKind errors.Kind
+		wantCmds int
+	}{
+		{
+			desc:     "Create on a missing table",
+			do:       func(c QueryClient) error { return CreateOrAlterMapping(ctx, c, "db", "Other", "map", JSON, cols) },
+			wantKind: errors.KTableNotExist,
+			wantCmds: 1,
+		},
+		{
+			desc:     "Get on a missing table",
+			do:       func(c QueryClient) error { _, err := GetMapping(ctx, c, "db", "Other", "map", JSON); return err },
+			wantKind: errors.KTableNotExist,
+			wantCmds: 1,
+		},
+		{
+			desc:     "Delete on a missing table",
+			do:       func(c QueryClient) error { return DeleteMapping(ctx, c, "db", "Other", "map", JSON) },
+			wantKind: errors.KTableNotExist,
+			wantCmds: 1,
+		},
+		{
+			desc:     "Delete a missing mapping",
+			do:       func(c QueryClient) error { return DeleteMapping(ctx, c, "db", "Events", "map", JSON) },
+			wantKind: errors.KMappingNotExist,
+			wantCmds: 1,
+		},
+		{
+			desc: "Mapping rejected by the service",
+			do: func(c QueryClient) error {
+				return CreateOrAlterMapping(ctx, c, "db", "Events", "map", JSON, []MappingColumn{{Column: "Name", Path: "$.name", Transform: "Unknown"}})
+			},
+			wantKind: errors.KMappingInvalid,
+			wantCmds: 1,
+		},
+		{
+			desc: "Column without a path",
+			do: func(c QueryClient) error {
+				return CreateOrAlterMapping(ctx, c, "db", "Events", "map", JSON, []MappingColumn{{Column: "Name"}})
+			},
+			wantKind: errors.KMappingInvalid,
+		},
+		{
+			desc: "Column without a name",
+			do: func(c QueryClient) error {
+				return CreateOrAlterMapping(ctx, c, "db", "Events", "map", CSV, []MappingColumn{{Ordinal: 1}})
+			},
+			wantKind: errors.KMappingInvalid,
+		},
+		{
+			desc:     "No columns",
+			do:       func(c QueryClient) error { return CreateOrAlterMapping(ctx, c, "db", "Events", "map", CSV, nil) },
+			wantKind: errors.KMappingInvalid,
+		},
+		{
+			desc:     "Format that is not a mapping kind",
+			do:       func(c QueryClient) error { return CreateOrAlterMapping(ctx, c, "db", "Events", "map", TSV, cols) },
+			wantKind: errors.KClientArgs,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			mgmt := &mappingMgmt{t: t, table: "Events", mappings: map[string]mappingRec{}}
+			client := mockClient{endpoint: "https://test.kusto.windows.net", onMgmt: mgmt.onMgmt}
+
+			err := test.do(client)
+			require.Error(t, err)
+			assert.Equal(t, test.wantKind, err.(*errors.Error).Kind)
+			assert.Len(t, mgmt.commands, test.wantCmds)
+		})
+	}
+}
+
+func TestDecodeMapping(t *testing.T) {
+	t.Parallel()
+
+	// The service returns the mapping with the name of the column capitalized.
+	got, err := decodeMapping(`[{"Column":"a","DataType":"","Properties":{"Ordinal":"2","Transform":null}}]`)
+	require.NoError(t, err)
+	assert.Equal(t, []MappingColumn{{Column: "a", Ordinal: 2}}, got)
+
+	_, err = decodeMapping(`[{"column":"a","Properties":{"Ordinal":"x"}}]`)
+	assert.Error(t, err)
+}
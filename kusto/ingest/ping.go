@@ -0,0 +1,283 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	goErrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/conn"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/unsafe"
+	"github.com/google/uuid"
+)
+
+// PingCheck is a check of Ping().
+type PingCheck int
+
+const (
+	// PingCluster checks that the cluster answers a command from the principal of the client, with ".show version".
+	PingCluster PingCheck = iota
+	// PingResources checks that the client has the containers and queues of queued ingestion, see Ready().
+	PingResources
+	// PingAuthContext checks that the client has the authorization context that queued ingestions are sent with.
+	PingAuthContext
+	// PingStreamingPolicy checks that streaming ingestion is enabled on the table of the client or on its database.
+	PingStreamingPolicy
+	// PingStreamingEndpoint checks that the streaming endpoint, the one of WithEndpoint() if it was set, answers a
+	// streaming ingestion request from the principal of the client.
+	PingStreamingEndpoint
+)
+
+// String implements fmt.Stringer.
+func (c PingCheck) String() string {
+	switch c {
+	case PingCluster:
+		return "cluster"
+	case PingResources:
+		return "ingestion resources"
+	case PingAuthContext:
+		return "authorization context"
+	case PingStreamingPolicy:
+		return "streaming ingestion policy"
+	case PingStreamingEndpoint:
+		return "streaming endpoint"
+	}
+	return fmt.Sprintf("PingCheck(%d)", int(c))
+}
+
+// PingError is returned by Ping() for the check that failed. It is wrapped in an *errors.Error of the Kind of its
+// cause, such as errors.KHTTPError for a cluster that could not be reached, and can be found with errors.As().
+type PingError struct {
+	// Check is the check that failed.
+	Check PingCheck
+	// Hint is how the configuration of the client or of the cluster can be fixed for the check to pass.
+	Hint string
+	// Cause is the error of the check, which wraps a *ResourcesError for PingResources.
+	Cause error
+}
+
+// Error implements error.
+func (e *PingError) Error() string {
+	return fmt.Sprintf("the %s check failed: %s; %s", e.Check, e.Cause, e.Hint)
+}
+
+// Unwrap returns the cause of the error.
+func (e *PingError) Unwrap() error {
+	return e.Cause
+}
+
+// Pinger is an ingestion client whose Ping() checks that it can ingest, such as an *Ingestion or a *Streaming.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// ReadinessHandler returns an http.Handler for the readiness probe of a service that ingests with p, such as the
+// httpGet readinessProbe of a Kubernetes pod. It answers 200 if p.Ping() succeeds, and 503 with the error, which
+// holds its hint, otherwise. Every request pings the cluster, so the period of the probe is how often it is called.
+func ReadinessHandler(p Pinger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := p.Ping(r.Context()); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, err.Error()+"\n")
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// Ping checks that the client can queue ingestions, so that a wrong endpoint, credentials or role are found before
+// the first ingestion fails: that the cluster answers the principal of the client (PingCluster), that it returned
+// the containers and queues of queued ingestion (PingResources), and the authorization context (PingAuthContext).
+// The first check that fails returns an error that wraps a *PingError, with a hint to fix it. The resources and the
+// authorization context are only fetched again if the client does not have them, so Ping can back a readiness probe.
+// It does not check that the table exists, see ValidateTarget() for that.
+func (i *Ingestion) Ping(ctx context.Context) error {
+	if i.isClosed() {
+		return ClientClosedErr
+	}
+
+	if err := pingCluster(ctx, i.client, i.db); err != nil {
+		return pingError(errors.OpFileIngest, PingCluster, i.db, i.table, err)
+	}
+	if err := i.Ready(ctx); err != nil {
+		return pingError(errors.OpFileIngest, PingResources, i.db, i.table, err)
+	}
+	if _, err := i.mgr.AuthContext(ctx); err != nil {
+		return pingError(errors.OpFileIngest, PingAuthContext, i.db, i.table, err)
+	}
+	return nil
+}
+
+// Ping checks that the client can stream data to its table without sending any: that the cluster answers the
+// principal of the client (PingCluster), that streaming ingestion is enabled on the table or, if the table has no
+// streaming ingestion policy, on its database (PingStreamingPolicy), and that the streaming endpoint, the one of
+// WithEndpoint() if it was set, answers a streaming ingestion request with no data, which ingests nothing
+// (PingStreamingEndpoint). A cluster on which streaming ingestion is disabled fails that request with
+// PingStreamingPolicy. The first check that fails returns an error that wraps a *PingError, with a hint to fix it, as
+// Ingestion.Ping() does.
+func (i *Streaming) Ping(ctx context.Context) error {
+	if i.isClosed() {
+		return ClientClosedErr
+	}
+
+	if err := pingCluster(ctx, i.client, i.db); err != nil {
+		return pingError(errors.OpIngestStream, PingCluster, i.db, i.table, err)
+	}
+	enabled, err := streamingPolicyEnabled(ctx, i.client, i.db, i.table)
+	if err != nil {
+		return pingError(errors.OpIngestStream, PingStreamingPolicy, i.db, i.table, err)
+	}
+	if !enabled {
+		err := errors.ES(errors.OpIngestStream, errors.KStreamingPolicyDisabled, "streaming ingestion is not enabled on table %q of database %q", i.table, i.db).SetNoRetry()
+		return pingError(errors.OpIngestStream, PingStreamingPolicy, i.db, i.table, err)
+	}
+	if check, err := i.pingStreamingEndpoint(ctx); err != nil {
+		return pingError(errors.OpIngestStream, check, i.db, i.table, err)
+	}
+	return nil
+}
+
+// pingStreamingEndpoint sends a streaming ingestion request with no data to the table of the client, straight to its
+// connection so that the limits of WithRateLimit() do not apply. The service answers it with an error once it has
+// authenticated the principal and found the table, so only an error of the connection, of the credentials, of the
+// service itself or of streaming ingestion being disabled fails the check that is returned with it.
+func (i *Streaming) pingStreamingEndpoint(ctx context.Context) (PingCheck, error) {
+	_, err := i.streamConn.StreamIngest(ctx, i.db, i.table, conn.Sized(bytes.NewReader(nil), 0), properties.CSV, properties.CTNone,
+		"", nil, "KGC.executeStreaming;"+uuid.New().String())
+	if err == nil {
+		return PingStreamingEndpoint, nil
+	}
+
+	var e *errors.Error
+	if !goErrors.As(err, &e) {
+		return PingStreamingEndpoint, errors.E(errors.OpIngestStream, errors.KHTTPError, err)
+	}
+	switch {
+	case isStreamingDisabled(e):
+		return PingStreamingPolicy, errors.W(e, errors.ES(errors.OpIngestStream, errors.KStreamingPolicyDisabled, "streaming ingestion is not enabled on table %q of database %q", i.table, i.db).SetNoRetry())
+	case isStreamingUnsupported(e):
+		return PingStreamingPolicy, errors.W(e, errors.ES(errors.OpIngestStream, errors.KStreamingPolicyDisabled, "streaming ingestion is not enabled on the cluster").SetNoRetry())
+	case failureReason(e) != ReasonUnknown, isEntityNotFound(e), e.StatusCode() >= http.StatusInternalServerError:
+		return PingStreamingEndpoint, e
+	}
+	return PingStreamingEndpoint, nil
+}
+
+// pingCluster runs ".show version" in db, which any principal with a role on db can run.
+func pingCluster(ctx context.Context, client QueryClient, db string) error {
+	iter, err := client.Mgmt(ctx, db, kusto.NewStmt(".show version"))
+	if err != nil {
+		return err
+	}
+	iter.Stop()
+	return nil
+}
+
+// streamingPolicy is the streaming ingestion policy of a table or a database.
+type streamingPolicy struct {
+	IsEnabled bool
+}
+
+// streamingPolicyEnabled reports if streaming ingestion is enabled on tableName, or on db if the table has no
+// streaming ingestion policy.
+func streamingPolicyEnabled(ctx context.Context, client QueryClient, db, tableName string) (bool, error) {
+	policy, err := showStreamingPolicy(ctx, client, db, showTableStmt(tableName))
+	if err != nil || policy != nil {
+		return policy != nil && policy.IsEnabled, err
+	}
+
+	stmt := kusto.NewStmt(".show database ", kusto.UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).UnsafeAdd(quoteName(db))
+	policy, err = showStreamingPolicy(ctx, client, db, stmt)
+	return policy != nil && policy.IsEnabled, err
+}
+
+// showStreamingPolicy returns the streaming ingestion policy of the entity of show, the ".show table" or
+// ".show database" command of a table or a database, or nil if it has none.
+func showStreamingPolicy(ctx context.Context, client QueryClient, db string, show kusto.Stmt) (*streamingPolicy, error) {
+	rows, err := mgmtDo(ctx, client, db, show.Add(" policy streamingingestion"))
+	if err != nil {
+		return nil, err
+	}
+
+	type policyRec struct {
+		Policy string `kusto:"Policy"`
+	}
+	for _, row := range rows {
+		rec := policyRec{}
+		if err := row.ToStruct(&rec); err != nil {
+			return nil, err
+		}
+		if p := strings.TrimSpace(rec.Policy); p == "" || p == "null" {
+			continue
+		}
+		policy := &streamingPolicy{}
+		if err := json.Unmarshal([]byte(rec.Policy), policy); err != nil {
+			return nil, errors.E(errors.OpMgmt, errors.KInternal, fmt.Errorf("could not decode the streaming ingestion policy: %w", err))
+		}
+		return policy, nil
+	}
+	return nil, nil
+}
+
+// pingError returns the error of Ping() for check, which failed with cause, for the table tableName of db.
+func pingError(op errors.Op, check PingCheck, db, tableName string, cause error) error {
+	pe := &PingError{Check: check, Hint: pingHint(check, db, tableName, cause), Cause: cause}
+
+	kind := errors.KOther
+	var e *errors.Error
+	if goErrors.As(cause, &e) {
+		kind = e.Kind
+	}
+	err := errors.E(op, kind, pe)
+	if !errors.Retryable(cause) {
+		return err.SetNoRetry()
+	}
+	return err
+}
+
+// pingHint returns how the failure of check with cause can be fixed.
+func pingHint(check PingCheck, db, tableName string, cause error) string {
+	var e *errors.Error
+	switch {
+	case goErrors.As(cause, &e) && e.Kind == errors.KStreamingPolicyDisabled && isStreamingUnsupported(cause):
+		return "enable streaming ingestion in the configuration of the cluster, or use queued ingestion"
+	case goErrors.As(cause, &e) && e.Kind == errors.KStreamingPolicyDisabled:
+		return fmt.Sprintf("enable it with \".alter table %s policy streamingingestion enable\", or use queued ingestion", quoteName(tableName))
+	case isEntityNotFound(cause):
+		return fmt.Sprintf("check that database %q and its table %q exist, and that the client was made for them", db, tableName)
+	}
+
+	reason := failureReason(cause)
+	var re *ResourcesError
+	if goErrors.As(cause, &re) {
+		reason = re.Reason
+	}
+	switch reason {
+	case ReasonUnreachable:
+		if check == PingStreamingEndpoint {
+			return "check the endpoint of WithEndpoint(), or of the client if it was not set, and that the network allows it: streaming ingestion uses the endpoint of the engine of the cluster, without the \"ingest-\" prefix"
+		}
+		return "check the endpoint of the client and that the network allows it: queued ingestion uses the ingestion endpoint of the cluster, whose host starts with \"ingest-\", and streaming ingestion uses the one of the engine"
+	case ReasonUnauthenticated:
+		return "check the credentials of the client, such as the tenant, the application id and its secret, and that the principal is of the tenant of the cluster"
+	case ReasonForbidden:
+		if check == PingCluster || check == PingStreamingPolicy {
+			return fmt.Sprintf("grant the principal of the client a role on database %q, such as Database Ingestor with \".add database %s ingestors ('aadapp=<application id>;<tenant>')\"", db, quoteName(db))
+		}
+		return fmt.Sprintf("grant the principal of the client the Database Ingestor role with \".add database %s ingestors ('aadapp=<application id>;<tenant>')\"", quoteName(db))
+	case ReasonNotProvided:
+		return "the endpoint of the client may be the one of the engine, queued ingestion needs the ingestion endpoint of the cluster, whose host starts with \"ingest-\""
+	}
+	if errors.Retryable(cause) {
+		return "the failure may be transient, the check may pass if it is retried later"
+	}
+	return "see the cause of the error"
+}
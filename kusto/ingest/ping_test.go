@@ -0,0 +1,315 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/kustotest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pingHTTPErr(status string) error {
+	return errors.HTTP(errors.OpMgmt, status, ioutil.NopCloser(strings.NewReader("")), "")
+}
+
+// streamHTTPErr is the error of a streaming ingestion request that the service answered with status and body.
+func streamHTTPErr(status, body string) error {
+	return errors.HTTP(errors.OpIngestStream, status, ioutil.NopCloser(strings.NewReader(body)), "streaming ingest issue")
+}
+
+// pingStreamConn returns a connection that answers the streaming ingestion requests with err, and counts them in
+// probes after checking that they hold no data.
+func pingStreamConn(t *testing.T, probes *int32, err error) streamIngestor {
+	return fakeStreamIngestor{
+		onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+			atomic.AddInt32(probes, 1)
+			assert.Equal(t, "db", db)
+			assert.Equal(t, "table", table)
+			data, readErr := ioutil.ReadAll(payload)
+			assert.NoError(t, readErr)
+			assert.Empty(t, data, "the probe should not hold data")
+			return err
+		},
+	}
+}
+
+func TestIngestionPing(t *testing.T) {
+	t.Parallel()
+
+	const (
+		container = "https://account.blob.core.windows.net/container?sig=s"
+		queue     = "https://account.queue.core.windows.net/queue?sig=s"
+	)
+
+	tests := []struct {
+		desc string
+		// setup registers the results that fail a check, before those of a client that is ready.
+		setup     func(fake *kustotest.Client)
+		wantCheck PingCheck
+		wantKind  errors.Kind
+		wantHint  string
+	}{
+		{desc: "Ready", setup: func(fake *kustotest.Client) {}},
+		{
+			desc: "Cluster unreachable",
+			setup: func(fake *kustotest.Client) {
+				fake.OnCSL(".show version").Error(errors.E(errors.OpMgmt, errors.KHTTPError, goErrors.New("dial tcp: no such host")))
+			},
+			wantCheck: PingCluster,
+			wantKind:  errors.KHTTPError,
+			wantHint:  "check the endpoint of the client",
+		},
+		{
+			desc: "Cluster refused the credentials",
+			setup: func(fake *kustotest.Client) {
+				fake.OnCSL(".show version").Error(pingHTTPErr("401 Unauthorized"))
+			},
+			wantCheck: PingCluster,
+			wantKind:  errors.KHTTPError,
+			wantHint:  "check the credentials of the client",
+		},
+		{
+			desc: "Not an ingestor",
+			setup: func(fake *kustotest.Client) {
+				// The first fetch, by New(), returns no resources, and the fetch of Ping() is refused.
+				var fetches int32
+				fake.On(func(call kustotest.Call) bool {
+					return call.CSL == ".get ingestion resources" && atomic.AddInt32(&fetches, 1) == 1
+				}).Columns("ResourceTypeName:string, StorageRoot:string")
+				fake.OnCSL(".get ingestion resources").Error(pingHTTPErr("403 Forbidden"))
+			},
+			wantCheck: PingResources,
+			wantKind:  errors.KHTTPError,
+			wantHint:  `.add database ["db"] ingestors`,
+		},
+		{
+			desc: "Engine endpoint",
+			setup: func(fake *kustotest.Client) {
+				fake.OnCSL(".get ingestion resources").Columns("ResourceTypeName:string, StorageRoot:string")
+			},
+			wantCheck: PingResources,
+			wantKind:  errors.KBlobstore,
+			wantHint:  `whose host starts with "ingest-"`,
+		},
+		{
+			desc: "No authorization context",
+			setup: func(fake *kustotest.Client) {
+				fake.OnCSL(".get kusto identity token").Error(pingHTTPErr("403 Forbidden"))
+			},
+			wantCheck: PingAuthContext,
+			wantKind:  errors.KHTTPError,
+			wantHint:  "Database Ingestor role",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			fake := kustotest.New()
+			test.setup(fake)
+			fake.OnCSL(".show version").Columns("BuildVersion:string").Row("1.0")
+			fake.OnIngestionResources().Row("TempStorage", container).Row("SecuredReadyForAggregationQueue", queue)
+			ingestion, err := New(fake, "db", "table")
+			require.NoError(t, err)
+			defer ingestion.Close()
+
+			err = ingestion.Ping(context.Background())
+			if test.wantHint == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Equal(t, test.wantKind, errors.KindOf(err))
+			var pe *PingError
+			require.True(t, goErrors.As(err, &pe), "got %v", err)
+			assert.Equal(t, test.wantCheck, pe.Check)
+			assert.Contains(t, pe.Hint, test.wantHint)
+			assert.Contains(t, err.Error(), pe.Hint)
+		})
+	}
+}
+
+func TestStreamingPing(t *testing.T) {
+	t.Parallel()
+
+	const policyColumns = "PolicyName:string, EntityName:string, Policy:string, ChildEntities:dynamic, EntityType:string"
+
+	tests := []struct {
+		desc        string
+		tablePolicy interface{}
+		dbPolicy    interface{}
+		versionErr  error
+		// streamErr is the error of the request sent to the streaming endpoint.
+		streamErr     error
+		wantCheck     PingCheck
+		wantKind      errors.Kind
+		wantHint      string
+		wantDBChecked bool
+		// wantProbed is if a request is sent to the streaming endpoint.
+		wantProbed bool
+		// wantRetry is if the failure may pass when it is retried.
+		wantRetry bool
+	}{
+		{desc: "Enabled on the table", tablePolicy: `{"IsEnabled": true, "HintAllocatedRate": null}`, wantProbed: true},
+		{desc: "Enabled on the database", tablePolicy: nil, dbPolicy: `{"IsEnabled": true}`, wantDBChecked: true, wantProbed: true},
+		{
+			desc:        "Empty request refused",
+			tablePolicy: `{"IsEnabled": true}`,
+			streamErr:   streamHTTPErr("400 Bad Request", `{"error":{"code":"BadRequest_EmptyArchive","message":"The input stream is empty"}}`),
+			wantProbed:  true,
+		},
+		{
+			desc:        "Streaming endpoint unreachable",
+			tablePolicy: `{"IsEnabled": true}`,
+			streamErr:   errors.E(errors.OpIngestStream, errors.KHTTPError, goErrors.New("dial tcp: no such host")),
+			wantCheck:   PingStreamingEndpoint,
+			wantKind:    errors.KHTTPError,
+			wantHint:    "check the endpoint of WithEndpoint()",
+			wantProbed:  true,
+			wantRetry:   true,
+		},
+		{
+			desc:        "Streaming endpoint refused the credentials",
+			tablePolicy: `{"IsEnabled": true}`,
+			streamErr:   streamHTTPErr("401 Unauthorized", ""),
+			wantCheck:   PingStreamingEndpoint,
+			wantKind:    errors.KHTTPError,
+			wantHint:    "check the credentials of the client",
+			wantProbed:  true,
+		},
+		{
+			desc:        "Not an ingestor",
+			tablePolicy: `{"IsEnabled": true}`,
+			streamErr:   streamHTTPErr("403 Forbidden", ""),
+			wantCheck:   PingStreamingEndpoint,
+			wantKind:    errors.KHTTPError,
+			wantHint:    "the Database Ingestor role",
+			wantProbed:  true,
+		},
+		{
+			desc:        "Disabled on the cluster",
+			tablePolicy: `{"IsEnabled": true}`,
+			streamErr: streamHTTPErr("400 Bad Request", `{"error":{"code":"BadRequest_StreamingIngestionDisabledForCluster","message":"Streaming ingestion is disabled for the cluster",`+
+				`"@type":"Kusto.DataNode.Exceptions.StreamingIngestionDisabledForClusterException","@permanent":true}}`),
+			wantCheck:  PingStreamingPolicy,
+			wantKind:   errors.KStreamingPolicyDisabled,
+			wantHint:   "in the configuration of the cluster",
+			wantProbed: true,
+		},
+		{
+			desc:        "Disabled on the table",
+			tablePolicy: `{"IsEnabled": false}`,
+			dbPolicy:    `{"IsEnabled": true}`,
+			wantCheck:   PingStreamingPolicy,
+			wantKind:    errors.KStreamingPolicyDisabled,
+			wantHint:    `.alter table ["table"] policy streamingingestion enable`,
+		},
+		{
+			desc:          "No policy",
+			tablePolicy:   "null",
+			dbPolicy:      nil,
+			wantCheck:     PingStreamingPolicy,
+			wantKind:      errors.KStreamingPolicyDisabled,
+			wantHint:      "or use queued ingestion",
+			wantDBChecked: true,
+		},
+		{
+			desc:       "Forbidden",
+			versionErr: pingHTTPErr("403 Forbidden"),
+			wantCheck:  PingCluster,
+			wantKind:   errors.KHTTPError,
+			wantHint:   `grant the principal of the client a role on database "db"`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			fake := kustotest.New()
+			version := fake.OnCSL(".show version").Columns("BuildVersion:string").Row("1.0")
+			if test.versionErr != nil {
+				version.Error(test.versionErr)
+			}
+			fake.OnCSL(`.show table ["table"] policy streamingingestion`).Columns(policyColumns).
+				Row("StreamingIngestionPolicy", "[db].[table]", test.tablePolicy, nil, "Table")
+			fake.OnCSL(`.show database ["db"] policy streamingingestion`).Columns(policyColumns).
+				Row("StreamingIngestionPolicy", "[db]", test.dbPolicy, nil, "Database")
+
+			streaming, err := NewStreaming(fake, "db", "table")
+			require.NoError(t, err)
+			defer streaming.Close()
+			var probes int32
+			streaming.streamConn = pingStreamConn(t, &probes, test.streamErr)
+
+			err = streaming.Ping(context.Background())
+			dbChecked := false
+			for _, call := range fake.Calls() {
+				dbChecked = dbChecked || strings.HasPrefix(call.CSL, ".show database")
+			}
+			assert.Equal(t, test.wantDBChecked, dbChecked)
+			wantProbes := int32(0)
+			if test.wantProbed {
+				wantProbes = 1
+			}
+			assert.Equal(t, wantProbes, atomic.LoadInt32(&probes))
+
+			if test.wantHint == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Equal(t, test.wantKind, errors.KindOf(err))
+			assert.Equal(t, test.wantRetry, errors.Retryable(err))
+			var pe *PingError
+			require.True(t, goErrors.As(err, &pe), "got %v", err)
+			assert.Equal(t, test.wantCheck, pe.Check)
+			assert.Contains(t, pe.Hint, test.wantHint)
+		})
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	t.Parallel()
+
+	fake := kustotest.New()
+	fake.OnCSL(".show version").Error(pingHTTPErr("401 Unauthorized"))
+	streaming, err := NewStreaming(fake, "db", "table")
+	require.NoError(t, err)
+	defer streaming.Close()
+
+	rec := httptest.NewRecorder()
+	ReadinessHandler(streaming).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "the cluster check failed")
+	assert.Contains(t, rec.Body.String(), "check the credentials of the client")
+
+	fake = kustotest.New()
+	fake.OnCSL(".show version").Columns("BuildVersion:string").Row("1.0")
+	fake.On(kustotest.CSLPrefix(".show table")).Columns("Policy:string").Row(`{"IsEnabled": true}`)
+	streaming, err = NewStreaming(fake, "db", "table")
+	require.NoError(t, err)
+	defer streaming.Close()
+	var probes int32
+	streaming.streamConn = pingStreamConn(t, &probes, nil)
+
+	rec = httptest.NewRecorder()
+	ReadinessHandler(streaming).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ok\n", rec.Body.String())
+}
@@ -0,0 +1,172 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/status"
+)
+
+// PurgeOption is an optional argument to PurgeStatuses().
+type PurgeOption func(p *purgeOptions)
+
+type purgeOptions struct {
+	finalOnly bool
+	dryRun    bool
+}
+
+// PurgeFinalOnly only purges the rows of ingestions whose status is final. Rows of ingestions that are still Pending,
+// and rows whose status cannot be read, such as rows written by other clients without a Status column, are kept.
+func PurgeFinalOnly() PurgeOption {
+	return func(p *purgeOptions) {
+		p.finalOnly = true
+	}
+}
+
+// PurgeDryRun only counts the rows that would be purged, without deleting them.
+func PurgeDryRun() PurgeOption {
+	return func(p *purgeOptions) {
+		p.dryRun = true
+	}
+}
+
+// purgeConcurrency is the number of rows of the status table that are deleted at the same time. The table service
+// only deletes rows of the same partition in a batch, and each ingestion has its own partition.
+const purgeConcurrency = 16
+
+// statusRows is the part of status.TableClient that PurgeStatuses() uses.
+type statusRows interface {
+	List(ctx context.Context, before time.Time, fn func(entries []status.Entry) error) error
+	Delete(entry status.Entry) error
+}
+
+// PurgeStatuses deletes the rows of the status tables of the ingestion resources, or of the table of WithStatusTable(),
+// that were last written more than olderThan ago, and returns the number of rows it deleted. The status table gets a row for each ingestion that uses
+// ReportResultToTable(), which the service never deletes, and the rows of all the clients of the cluster slow its
+// queries down as they add up. Rows are only selected by the time they were written, so rows written by other
+// clients are purged too.
+//
+// When ctx is done, PurgeStatuses stops and returns the number of rows it deleted so far with the error of ctx.
+// When rows cannot be deleted, it returns the first error after it tried to delete the rest of the page of rows.
+func (i *Ingestion) PurgeStatuses(ctx context.Context, olderThan time.Duration, options ...PurgeOption) (int, error) {
+	opts := purgeOptions{}
+	for _, o := range options {
+		o(&opts)
+	}
+	if olderThan < 0 {
+		return 0, errors.ES(errors.OpFileIngest, errors.KClientArgs, "PurgeStatuses() cannot purge rows newer than now").SetNoRetry()
+	}
+
+	tables := []statusRows{i.purgeRows}
+	if i.purgeRows == nil {
+		uris, err := i.statusTables()
+		if err != nil {
+			return 0, err
+		}
+		tables = tables[:0]
+		for _, uri := range uris {
+			client, err := status.NewTableClient(*uri, i.cfg.storageHTTPClient)
+			if err != nil {
+				return 0, errors.E(errors.OpFileIngest, errors.KBlobstore, err)
+			}
+			tables = append(tables, client)
+		}
+	}
+
+	purged := 0
+	for _, rows := range tables {
+		n, err := purgeTable(ctx, rows, olderThan, opts)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// purgeTable purges the rows of a status table, see PurgeStatuses().
+func purgeTable(ctx context.Context, rows statusRows, olderThan time.Duration, opts purgeOptions) (int, error) {
+	purged := 0
+	err := rows.List(ctx, time.Now().Add(-olderThan), func(entries []status.Entry) error {
+		if opts.finalOnly {
+			final := entries[:0]
+			for _, e := range entries {
+				if isFinalEntry(e) {
+					final = append(final, e)
+				}
+			}
+			entries = final
+		}
+
+		if opts.dryRun {
+			purged += len(entries)
+			return nil
+		}
+		n, err := deleteEntries(ctx, rows, entries)
+		purged += n
+		return err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return purged, ctx.Err()
+		}
+		if _, ok := err.(*errors.Error); ok {
+			return purged, err
+		}
+		return purged, errors.E(errors.OpFileIngest, errors.KBlobstore, fmt.Errorf("could not purge the status table: %w", err))
+	}
+	return purged, nil
+}
+
+// isFinalEntry reports if the row of the status table is of an ingestion whose status is final.
+func isFinalEntry(e status.Entry) bool {
+	s, ok := e.Properties["Status"].(string)
+	return ok && s != "" && StatusCode(s).IsFinal()
+}
+
+// deleteEntries deletes the rows with purgeConcurrency goroutines, and returns the number of rows that were deleted.
+func deleteEntries(ctx context.Context, rows statusRows, entries []status.Entry) (int, error) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		deleted int
+		err     error
+	)
+
+	work := make(chan status.Entry)
+	for w := 0; w < purgeConcurrency && w < len(entries); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				dErr := rows.Delete(e)
+				mu.Lock()
+				if dErr == nil {
+					deleted++
+				} else if err == nil {
+					err = errors.E(errors.OpFileIngest, errors.KBlobstore, fmt.Errorf("could not delete the status of ingestion %s: %w", e.PartitionKey, dErr))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, e := range entries {
+		select {
+		case <-ctx.Done():
+			break feed
+		case work <- e:
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return deleted, ctx.Err()
+	}
+	return deleted, err
+}
@@ -0,0 +1,182 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStatusRows is a status table that lists its rows in pages.
+type fakeStatusRows struct {
+	pageSize int
+	// onDelete is called before each row is deleted, and its error is returned by Delete.
+	onDelete func(e status.Entry) error
+
+	mu      sync.Mutex
+	entries []status.Entry
+	deleted map[string]bool
+}
+
+func (f *fakeStatusRows) List(ctx context.Context, before time.Time, fn func(entries []status.Entry) error) error {
+	var page []status.Entry
+	for _, e := range f.entries {
+		if !e.Timestamp.Before(before) {
+			continue
+		}
+		page = append(page, e)
+		if len(page) == f.pageSize {
+			if err := fn(page); err != nil {
+				return err
+			}
+			page = nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if len(page) > 0 {
+		return fn(page)
+	}
+	return nil
+}
+
+func (f *fakeStatusRows) Delete(e status.Entry) error {
+	if f.onDelete != nil {
+		if err := f.onDelete(e); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted[e.PartitionKey] = true
+	return nil
+}
+
+func TestPurgeStatuses(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+
+	// Rows of this client, and of other clients with other columns.
+	var entries []status.Entry
+	for n := 0; n < 100; n++ {
+		entries = append(entries, status.Entry{PartitionKey: fmt.Sprintf("succeeded-%d", n), Timestamp: old, Properties: map[string]interface{}{"Status": "Succeeded"}})
+	}
+	entries = append(entries,
+		status.Entry{PartitionKey: "pending", Timestamp: old, Properties: map[string]interface{}{"Status": "Pending"}},
+		status.Entry{PartitionKey: "failed", Timestamp: old, Properties: map[string]interface{}{"Status": "Failed"}},
+		status.Entry{PartitionKey: "no-status", Timestamp: old, Properties: map[string]interface{}{"State": "Done"}},
+		status.Entry{PartitionKey: "int-status", Timestamp: old, Properties: map[string]interface{}{"Status": 2}},
+		status.Entry{PartitionKey: "recent", Timestamp: now, Properties: map[string]interface{}{"Status": "Succeeded"}},
+	)
+
+	tests := []struct {
+		desc        string
+		options     []PurgeOption
+		wantPurged  int
+		wantDeleted int
+		wantKept    []string
+	}{
+		{
+			desc:        "All old rows",
+			wantPurged:  104,
+			wantDeleted: 104,
+			wantKept:    []string{"recent"},
+		},
+		{
+			desc:        "Final rows only",
+			options:     []PurgeOption{PurgeFinalOnly()},
+			wantPurged:  101,
+			wantDeleted: 101,
+			wantKept:    []string{"pending", "no-status", "int-status", "recent"},
+		},
+		{
+			desc:       "Dry run",
+			options:    []PurgeOption{PurgeDryRun(), PurgeFinalOnly()},
+			wantPurged: 101,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			rows := &fakeStatusRows{pageSize: 30, entries: append([]status.Entry(nil), entries...), deleted: map[string]bool{}}
+			ingestion := &Ingestion{purgeRows: rows}
+
+			purged, err := ingestion.PurgeStatuses(context.Background(), 24*time.Hour, test.options...)
+			require.NoError(t, err)
+			assert.Equal(t, test.wantPurged, purged)
+			assert.Len(t, rows.deleted, test.wantDeleted)
+			for _, k := range test.wantKept {
+				assert.False(t, rows.deleted[k], "%s should not be purged", k)
+			}
+		})
+	}
+}
+
+func TestPurgeStatusesCancel(t *testing.T) {
+	t.Parallel()
+
+	var entries []status.Entry
+	for n := 0; n < 1000; n++ {
+		entries = append(entries, status.Entry{PartitionKey: fmt.Sprint(n), Timestamp: time.Now().Add(-time.Hour)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rows := &fakeStatusRows{pageSize: 100, entries: entries, deleted: map[string]bool{}}
+	var count int
+	var mu sync.Mutex
+	rows.onDelete = func(status.Entry) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if count++; count == 150 {
+			cancel()
+		}
+		return nil
+	}
+
+	purged, err := (&Ingestion{purgeRows: rows}).PurgeStatuses(ctx, 0)
+	assert.True(t, goErrors.Is(err, context.Canceled))
+	assert.Equal(t, len(rows.deleted), purged)
+	assert.Less(t, purged, 300, "the purge should stop soon after ctx is done")
+}
+
+func TestPurgeStatusesDeleteError(t *testing.T) {
+	t.Parallel()
+
+	var entries []status.Entry
+	for n := 0; n < 50; n++ {
+		entries = append(entries, status.Entry{PartitionKey: fmt.Sprint(n), Timestamp: time.Now().Add(-time.Hour)})
+	}
+
+	rows := &fakeStatusRows{pageSize: 20, entries: entries, deleted: map[string]bool{}}
+	rows.onDelete = func(e status.Entry) error {
+		if e.PartitionKey == "5" {
+			return goErrors.New("server busy")
+		}
+		return nil
+	}
+
+	purged, err := (&Ingestion{purgeRows: rows}).PurgeStatuses(context.Background(), 0)
+	require.Error(t, err)
+	assert.Equal(t, errors.KBlobstore, errors.KindOf(err))
+	assert.Contains(t, err.Error(), "server busy")
+	assert.Equal(t, 19, purged, "the rest of the page should be deleted")
+
+	_, err = (&Ingestion{purgeRows: rows}).PurgeStatuses(context.Background(), -time.Hour)
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+}
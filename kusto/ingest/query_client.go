@@ -2,13 +2,96 @@ package ingest
 
 import (
 	"context"
+	"crypto/tls"
+	"net/http"
 
 	"github.com/Azure/azure-kusto-go/kusto"
 )
 
+// QueryClient is the part of *kusto.Client that the ingestion clients use. Accepting an interface allows New(),
+// NewStreaming() and NewManaged() to be used with a fake in tests, or with a wrapper that adds instrumentation.
 type QueryClient interface {
+	// Auth returns the Authorization used to connect to the cluster, used by streaming ingestion.
 	Auth() kusto.Authorization
+	// Endpoint returns the cluster endpoint, used by streaming ingestion.
 	Endpoint() string
 	Query(ctx context.Context, db string, query kusto.Stmt, options ...kusto.QueryOption) (*kusto.RowIterator, error)
+	// Mgmt runs management commands, such as the ones that fetch the ingestion resources.
 	Mgmt(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error)
 }
+
+var _ QueryClient = (*kusto.Client)(nil)
+
+// closeWithClient makes client call close when it is closed, if it can like a *kusto.Client. The returned function
+// stops that, for when what close closes was closed on its own.
+func closeWithClient(client QueryClient, close func()) (unregister func()) {
+	if c, ok := client.(interface{ OnClose(func()) func() }); ok {
+		return c.OnClose(close)
+	}
+	return func() {}
+}
+
+// queryTracingIdentity returns the application and the user for tracing of client, if it has them like a
+// *kusto.Client, which the ingestion requests are sent with too.
+func queryTracingIdentity(client QueryClient) (app, user string) {
+	if c, ok := client.(interface {
+		ApplicationForTracing() string
+		UserForTracing() string
+	}); ok {
+		return c.ApplicationForTracing(), c.UserForTracing()
+	}
+	return "", ""
+}
+
+// queryTracer returns the kusto.Tracer of client, if it has one like a *kusto.Client made WithTracer(), or else nil.
+// Streaming ingestion requests are traced with it.
+func queryTracer(client QueryClient) kusto.Tracer {
+	if c, ok := client.(interface{ Tracer() kusto.Tracer }); ok {
+		return c.Tracer()
+	}
+	return nil
+}
+
+// queryHTTPClient returns the *http.Client that client sends its requests with, if it has one like a *kusto.Client
+// made WithHTTPClient(), or else nil. The ingestion clients send their requests with it, unless given their own.
+func queryHTTPClient(client QueryClient) *http.Client {
+	if c, ok := client.(interface{ HTTPClient() *http.Client }); ok {
+		return c.HTTPClient()
+	}
+	return nil
+}
+
+// queryTLSConfig returns the TLS config of client, if it has one like a *kusto.Client made WithTLSConfig(), or else
+// nil. The connections that the ingestion clients open use it, unless they are given their own *http.Client.
+func queryTLSConfig(client QueryClient) *tls.Config {
+	if c, ok := client.(interface{ TLSConfig() *tls.Config }); ok {
+		return c.TLSConfig()
+	}
+	return nil
+}
+
+// queryClientOptions returns the options that make a kusto.Client send its requests as client does: with its
+// *http.Client or TLS config, Tracer and identity for tracing.
+func queryClientOptions(client QueryClient) []kusto.Option {
+	var options []kusto.Option
+	if hc := queryHTTPClient(client); hc != nil {
+		options = append(options, kusto.WithHTTPClient(hc))
+	}
+	if config := queryTLSConfig(client); config != nil {
+		options = append(options, kusto.WithTLSConfig(config))
+		if config.InsecureSkipVerify {
+			options = append(options, kusto.WithInsecureSkipTLSVerify())
+		}
+	}
+	if tracer := queryTracer(client); tracer != nil {
+		options = append(options, kusto.WithTracer(tracer))
+	}
+	app, user := queryTracingIdentity(client)
+	if app != "" {
+		options = append(options, kusto.WithApplicationForTracing(app, ""))
+	}
+	if user != "" {
+		options = append(options, kusto.WithUserForTracing(user))
+	}
+	return options
+}
@@ -0,0 +1,282 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	goErrors "errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/unsafe"
+	"github.com/google/uuid"
+)
+
+// SetMode is how FromQuery() writes the result of the query to the table.
+type SetMode int
+
+const (
+	// SetOrAppend appends the result to the table, which is created with the schema of the result if it does not
+	// exist. It is the ".set-or-append" command.
+	SetOrAppend SetMode = iota
+	// SetOrReplace replaces the data of the table with the result, and creates the table if it does not exist. It is
+	// the ".set-or-replace" command.
+	SetOrReplace
+)
+
+// String implements fmt.Stringer.
+func (m SetMode) String() string {
+	switch m {
+	case SetOrAppend:
+		return ".set-or-append"
+	case SetOrReplace:
+		return ".set-or-replace"
+	}
+	return fmt.Sprintf("SetMode(%d)", int(m))
+}
+
+// QueryIngestOption is an optional argument to FromQuery().
+type QueryIngestOption func(o *queryIngest) error
+
+type queryIngest struct {
+	extendSchema, recreateSchema, distributed bool
+	tags                                      []string
+	creationTime                              time.Time
+	wait                                      []kusto.WaitOption
+}
+
+// ExtendSchema lets FromQuery() add the columns of the result that the table does not have to the table.
+func ExtendSchema() QueryIngestOption {
+	return func(o *queryIngest) error {
+		o.extendSchema = true
+		return nil
+	}
+}
+
+// RecreateSchema lets FromQuery() with SetOrReplace change the schema of the table to the one of the result.
+func RecreateSchema() QueryIngestOption {
+	return func(o *queryIngest) error {
+		o.recreateSchema = true
+		return nil
+	}
+}
+
+// Distributed makes the service write the result from all the nodes that run the query, rather than from one,
+// which is faster for large results. The service may refuse it for small ones.
+func Distributed() QueryIngestOption {
+	return func(o *queryIngest) error {
+		o.distributed = true
+		return nil
+	}
+}
+
+// ExtentTags sets the tags of the extents that FromQuery() creates, such as "ingest-by:..." or "drop-by:...".
+func ExtentTags(tags ...string) QueryIngestOption {
+	return func(o *queryIngest) error {
+		for _, tag := range tags {
+			if tag == "" {
+				return errors.ES(errors.OpFileIngest, errors.KClientArgs, "ExtentTags(): a tag cannot be empty").SetNoRetry()
+			}
+		}
+		o.tags = append(o.tags, tags...)
+		return nil
+	}
+}
+
+// ExtentCreationTime sets the creation time of the extents that FromQuery() creates, which the retention policy of
+// the table is applied from, such as to backfill data. It is the time of the ingestion by default.
+func ExtentCreationTime(t time.Time) QueryIngestOption {
+	return func(o *queryIngest) error {
+		if t.IsZero() {
+			return errors.ES(errors.OpFileIngest, errors.KClientArgs, "ExtentCreationTime(): the time cannot be zero").SetNoRetry()
+		}
+		o.creationTime = t
+		return nil
+	}
+}
+
+// QueryIngestPollInterval sets the interval between the polls of the operation of FromQuery(), as
+// kusto.WaitPollInterval() does.
+func QueryIngestPollInterval(initial, max time.Duration) QueryIngestOption {
+	return func(o *queryIngest) error {
+		o.wait = append(o.wait, kusto.WaitPollInterval(initial, max))
+		return nil
+	}
+}
+
+// queryIngestOperation is the row of the async commands of FromQuery().
+type queryIngestOperation struct {
+	OperationID uuid.UUID `kusto:"OperationId"`
+}
+
+// queryIngestExtent is a row of the details of the operation of FromQuery(), an extent that it created.
+type queryIngestExtent struct {
+	ExtentID uuid.UUID `kusto:"ExtentId"`
+}
+
+// FromQuery writes the result of query, which is run in the database of the client, to its table, as mode says. The
+// service runs the query and writes its result itself with the async variant of the command of mode, so no data goes
+// through the client, and FromQuery polls the operation of the command until it finishes or ctx is done. The Result
+// has the id of the operation and the ids of the extents that were created.
+//
+// query is a Stmt, so that the command is built as safely as the query is. It cannot have Definitions or
+// Parameters, as commands cannot. An operation that fails returns an error that holds the *kusto.OperationError,
+// whose Status is the detail of the failure. The user of the client must be an admin or an ingestor of the table, and
+// an admin of the database to create the table.
+func (i *Ingestion) FromQuery(ctx context.Context, query kusto.Stmt, mode SetMode, options ...QueryIngestOption) (*Result, error) {
+	if i.isClosed() {
+		return nil, ClientClosedErr
+	}
+
+	o := queryIngest{}
+	for _, option := range options {
+		if err := option(&o); err != nil {
+			return nil, err
+		}
+	}
+
+	stmt, err := o.stmt(i.table, query, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := i.client.Mgmt(ctx, i.db, stmt)
+	if err != nil {
+		return nil, err
+	}
+	var op queryIngestOperation
+	err = iter.Do(func(row *table.Row) error {
+		return row.ToStruct(&op)
+	})
+	iter.Stop()
+	if err != nil {
+		return nil, errors.E(errors.OpFileIngest, errors.KInternal, fmt.Errorf("FromQuery(): could not read the operation of %s: %w", mode, err))
+	}
+	if op.OperationID == uuid.Nil {
+		return nil, errors.ES(errors.OpFileIngest, errors.KInternal, "FromQuery(): %s returned no operation", mode)
+	}
+
+	result := newResult()
+	result.method = QueryIngestion
+	result.record.Database = i.db
+	result.record.Table = i.table
+	result.record.OperationID = op.OperationID
+
+	operation, err := kusto.WaitForOperation(ctx, i.client, i.db, op.OperationID, o.wait...)
+	if err != nil {
+		var opErr *kusto.OperationError
+		if !goErrors.As(err, &opErr) {
+			return nil, err
+		}
+		e := errors.E(errors.OpFileIngest, errors.KOther, fmt.Errorf("FromQuery(): %w", opErr))
+		if opErr.Retry() {
+			return nil, e.SetTransient()
+		}
+		return nil, e.SetNoRetry()
+	}
+
+	result.record.Status = Succeeded
+	result.record.ActivityID = operation.RootActivityID
+	result.record.UpdatedOn = operation.LastUpdatedOn
+	result.extentIDs, err = i.queryIngestExtents(ctx, op.OperationID)
+	if err != nil {
+		result.warnings = append(result.warnings, fmt.Sprintf("the extents of operation %s could not be listed: %s", op.OperationID, err))
+	}
+	return result, nil
+}
+
+// queryIngestExtents returns the ids of the extents that the operation of FromQuery() created, from its details.
+func (i *Ingestion) queryIngestExtents(ctx context.Context, operationID uuid.UUID) ([]uuid.UUID, error) {
+	stmt := kusto.NewStmt(".show operation ", kusto.UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).
+		UnsafeAdd(operationID.String()).
+		Add(" details")
+	rows, err := mgmtDo(ctx, i.client, i.db, stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uuid.UUID
+	for _, row := range rows {
+		var extent queryIngestExtent
+		if err := row.ToStruct(&extent); err != nil {
+			return nil, err
+		}
+		ids = append(ids, extent.ExtentID)
+	}
+	return ids, nil
+}
+
+// stmt returns the async command of mode that writes the result of query to table, with the properties of o.
+func (o queryIngest) stmt(table string, query kusto.Stmt, mode SetMode) (kusto.Stmt, error) {
+	text := query.String()
+	if strings.TrimSpace(text) == "" {
+		return kusto.Stmt{}, errors.ES(errors.OpFileIngest, errors.KClientArgs, "FromQuery(): the query cannot be empty").SetNoRetry()
+	}
+	if strings.HasPrefix(text, "declare query_parameters(") {
+		return kusto.Stmt{}, errors.ES(errors.OpFileIngest, errors.KClientArgs, "FromQuery(): the query cannot have Definitions or Parameters, as commands cannot").SetNoRetry()
+	}
+
+	unsafeAdd := kusto.UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})
+	var stmt kusto.Stmt
+	switch mode {
+	case SetOrAppend:
+		if o.recreateSchema {
+			return kusto.Stmt{}, errors.ES(errors.OpFileIngest, errors.KClientArgs, "FromQuery(): RecreateSchema() can only be used with SetOrReplace").SetNoRetry()
+		}
+		stmt = kusto.NewStmt(".set-or-append async ", unsafeAdd)
+	case SetOrReplace:
+		stmt = kusto.NewStmt(".set-or-replace async ", unsafeAdd)
+	default:
+		return kusto.Stmt{}, errors.ES(errors.OpFileIngest, errors.KClientArgs, "FromQuery(): %s is not a SetMode", mode).SetNoRetry()
+	}
+
+	stmt, err := stmt.AddTable(table)
+	if err != nil {
+		return kusto.Stmt{}, errors.E(errors.OpFileIngest, errors.KClientArgs, err).SetNoRetry()
+	}
+
+	var props []func(s kusto.Stmt) (kusto.Stmt, error)
+	if o.extendSchema {
+		props = append(props, func(s kusto.Stmt) (kusto.Stmt, error) { return s.Add("extend_schema=true"), nil })
+	}
+	if o.recreateSchema {
+		props = append(props, func(s kusto.Stmt) (kusto.Stmt, error) { return s.Add("recreate_schema=true"), nil })
+	}
+	if o.distributed {
+		props = append(props, func(s kusto.Stmt) (kusto.Stmt, error) { return s.Add("distributed=true"), nil })
+	}
+	if len(o.tags) > 0 {
+		b, err := json.Marshal(o.tags)
+		if err != nil {
+			return kusto.Stmt{}, errors.E(errors.OpFileIngest, errors.KClientArgs, err).SetNoRetry()
+		}
+		props = append(props, func(s kusto.Stmt) (kusto.Stmt, error) {
+			return s.Add("tags=").AddLiteral(types.String, string(b))
+		})
+	}
+	if !o.creationTime.IsZero() {
+		props = append(props, func(s kusto.Stmt) (kusto.Stmt, error) {
+			return s.Add("creationTime=").AddLiteral(types.String, o.creationTime.UTC().Format(time.RFC3339Nano))
+		})
+	}
+	for n, prop := range props {
+		if n == 0 {
+			stmt = stmt.Add(" with (")
+		} else {
+			stmt = stmt.Add(", ")
+		}
+		if stmt, err = prop(stmt); err != nil {
+			return kusto.Stmt{}, errors.E(errors.OpFileIngest, errors.KClientArgs, err).SetNoRetry()
+		}
+	}
+	if len(props) > 0 {
+		stmt = stmt.Add(")")
+	}
+
+	// The query was built with the protections of a Stmt, so its text is added as it is.
+	return stmt.Add(" <| ").UnsafeAdd(text), nil
+}
@@ -0,0 +1,187 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/kustotest"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// operationColumns are the columns of ".show operations" that FromQuery() reads.
+const operationColumns = "OperationId:guid, Operation:string, State:string, Status:string, ShouldRetry:bool, LastUpdatedOn:datetime, RootActivityId:guid"
+
+// fakeQueryIngest returns a fake that answers the command of FromQuery() with op, lists op as in progress on the
+// first poll and then as state, and lists extents in its details.
+func fakeQueryIngest(op uuid.UUID, state, status string, extents ...uuid.UUID) *kustotest.Client {
+	fake := kustotest.New()
+	fake.OnIngestionResources()
+	fake.On(kustotest.CSLPrefix(".set-or-")).Columns("OperationId:guid").Row(op)
+
+	show := ".show operations " + op.String()
+	var polls int32
+	fake.On(func(call kustotest.Call) bool {
+		return call.CSL == show && atomic.AddInt32(&polls, 1) == 1
+	}).Columns(operationColumns).Row(op, "TableSetOrAppend", kusto.OperationInProgress, "", false, time.Now(), op)
+	fake.OnCSL(show).Columns(operationColumns).Row(op, "TableSetOrAppend", state, status, false, time.Now(), op)
+
+	details := fake.OnCSL(".show operation " + op.String() + " details").Columns("ExtentId:guid, OriginalSize:real")
+	for _, extent := range extents {
+		details.Row(extent, 10.0)
+	}
+	return fake
+}
+
+func TestFromQuery(t *testing.T) {
+	t.Parallel()
+
+	op := uuid.New()
+	extents := []uuid.UUID{uuid.New(), uuid.New()}
+	fake := fakeQueryIngest(op, kusto.OperationCompleted, "", extents...)
+
+	ingestion, err := New(fake, "db", "table")
+	require.NoError(t, err)
+	defer ingestion.Close()
+
+	result, err := ingestion.FromQuery(context.Background(), kusto.NewStmt("Events | take 10"), SetOrAppend, QueryIngestPollInterval(time.Millisecond, time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, QueryIngestion, result.Method())
+	assert.Equal(t, op, result.OperationID())
+	assert.Equal(t, extents, result.ExtentIDs())
+	assert.Empty(t, result.Warnings())
+	require.NoError(t, <-result.Wait(context.Background()))
+
+	var cmds []string
+	for _, call := range fake.Calls() {
+		if call.Mgmt && call.DB == "db" && !strings.HasPrefix(call.CSL, ".get ") {
+			cmds = append(cmds, call.CSL)
+		}
+	}
+	assert.Equal(t, []string{
+		`.set-or-append async ["table"] <| Events | take 10`,
+		".show operations " + op.String(),
+		".show operations " + op.String(),
+		".show operation " + op.String() + " details",
+	}, cmds)
+}
+
+func TestFromQueryStmt(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(2023, 1, 2, 3, 4, 5, 600, time.FixedZone("", 3600))
+
+	tests := []struct {
+		desc    string
+		table   string
+		query   kusto.Stmt
+		mode    SetMode
+		options []QueryIngestOption
+		want    string
+		err     bool
+	}{
+		{
+			desc:  "Append",
+			table: "table",
+			query: kusto.NewStmt("Events"),
+			mode:  SetOrAppend,
+			want:  `.set-or-append async ["table"] <| Events`,
+		},
+		{
+			desc:    "Replace with every option",
+			table:   "my table",
+			query:   kusto.NewStmt("Events | where Level == 'Error'"),
+			mode:    SetOrReplace,
+			options: []QueryIngestOption{ExtendSchema(), RecreateSchema(), Distributed(), ExtentTags("ingest-by:a", `drop-by:"b"`), ExtentCreationTime(created)},
+			want: `.set-or-replace async ["my table"] with (extend_schema=true, recreate_schema=true, distributed=true, ` +
+				`tags="[\"ingest-by:a\",\"drop-by:\\\"b\\\"\"]", creationTime="2023-01-02T02:04:05.0000006Z") <| Events | where Level == 'Error'`,
+		},
+		{
+			desc:    "RecreateSchema needs SetOrReplace",
+			table:   "table",
+			query:   kusto.NewStmt("Events"),
+			mode:    SetOrAppend,
+			options: []QueryIngestOption{RecreateSchema()},
+			err:     true,
+		},
+		{
+			desc:  "Parameters",
+			table: "table",
+			query: kusto.NewStmt("Events | where Name == name").MustDefinitions(
+				kusto.NewDefinitions().Must(kusto.ParamTypes{"name": kusto.ParamType{Type: "string"}}),
+			),
+			mode: SetOrAppend,
+			err:  true,
+		},
+		{
+			desc:  "Empty query",
+			table: "table",
+			query: kusto.NewStmt(" "),
+			mode:  SetOrAppend,
+			err:   true,
+		},
+		{
+			desc:  "Unknown mode",
+			table: "table",
+			query: kusto.NewStmt("Events"),
+			mode:  SetMode(2),
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			o := queryIngest{}
+			for _, option := range test.options {
+				require.NoError(t, option(&o))
+			}
+			stmt, err := o.stmt(test.table, test.query, test.mode)
+			if test.err {
+				assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, stmt.String())
+		})
+	}
+}
+
+func TestFromQueryFailure(t *testing.T) {
+	t.Parallel()
+
+	op := uuid.New()
+	fake := fakeQueryIngest(op, kusto.OperationFailed, "Query execution has exceeded the allowed limits")
+
+	ingestion, err := New(fake, "db", "table")
+	require.NoError(t, err)
+	defer ingestion.Close()
+
+	result, err := ingestion.FromQuery(context.Background(), kusto.NewStmt("Events"), SetOrReplace, QueryIngestPollInterval(time.Millisecond, time.Millisecond))
+	require.Error(t, err)
+	assert.Nil(t, result)
+
+	var opErr *kusto.OperationError
+	require.True(t, goErrors.As(err, &opErr))
+	assert.Equal(t, op, opErr.Result.ID)
+	assert.Equal(t, "Query execution has exceeded the allowed limits", opErr.Result.Status)
+	assert.Contains(t, err.Error(), "Query execution has exceeded the allowed limits")
+	assert.False(t, errors.Retry(err))
+
+	// The options are checked before the command is run.
+	_, err = ingestion.FromQuery(context.Background(), kusto.NewStmt("Events"), SetOrAppend, ExtentTags(""))
+	assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+
+	ingestion.Close()
+	_, err = ingestion.FromQuery(context.Background(), kusto.NewStmt("Events"), SetOrAppend)
+	assert.Equal(t, ClientClosedErr, err)
+}
@@ -0,0 +1,170 @@
+package ingest
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/conn"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/trace"
+)
+
+// limiter holds back the operations of a client made with a rate limit or a limit of operations in flight, see
+// WithRateLimit() and WithMaxInFlight(). It is shared by all the goroutines that use the client. A nil *limiter
+// limits nothing.
+type limiter struct {
+	// rate is the number of operations started per second, 0 for no limit, and burst how many can start at once.
+	rate  float64
+	burst float64
+	// slots holds a value for each operation in flight, nil for no limit.
+	slots chan struct{}
+
+	mu sync.Mutex
+	// tokens is the number of operations that can start now. It is negative when operations wait for their turn.
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter of rate operations per second, burst of which can start at once, and of maxInFlight
+// operations in flight. A rate or a maxInFlight of 0 is no limit. It returns nil when there is no limit at all.
+func newLimiter(rate float64, burst int, maxInFlight int) *limiter {
+	if rate == 0 && maxInFlight == 0 {
+		return nil
+	}
+	l := &limiter{rate: rate, burst: float64(burst), last: time.Now()}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	l.tokens = l.burst
+	if maxInFlight > 0 {
+		l.slots = make(chan struct{}, maxInFlight)
+	}
+	return l
+}
+
+// validateLimits checks the arguments of the options that set a limiter, which are named in the errors.
+func validateLimits(op errors.Op, rateOption, inFlightOption string, rate float64, burst int, maxInFlight int) error {
+	if rate < 0 || burst < 0 {
+		return errors.ES(op, errors.KClientArgs, "%s(%g, %d): arguments cannot be negative", rateOption, rate, burst).SetNoRetry()
+	}
+	if maxInFlight < 0 {
+		return errors.ES(op, errors.KClientArgs, "%s(%d): cannot be negative", inFlightOption, maxInFlight).SetNoRetry()
+	}
+	return nil
+}
+
+// reserve takes the turn of an operation, and returns how long the operation must wait for it.
+func (l *limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// unreserve gives back the turn taken by reserve() for an operation that did not start.
+func (l *limiter) unreserve() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tokens++; l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// acquire waits until an operation can start, and returns the func to call once it is done. When it has to wait,
+// the wait is a "kusto.ingest.rate_limit" span of spans. When ctx is done before the operation can start, it returns
+// the error of ctx.
+func (l *limiter) acquire(ctx context.Context, spans trace.Tracer) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	var span trace.Span
+	waiting := func() {
+		if span == nil {
+			_, span = trace.Start(ctx, spans, trace.RateLimit)
+		}
+	}
+	defer func() {
+		if span != nil {
+			span.End(err)
+		}
+	}()
+
+	release = func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			waiting()
+			select {
+			case l.slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		release = func() { <-l.slots }
+	}
+
+	if l.rate > 0 {
+		if d := l.reserve(); d > 0 {
+			waiting()
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				l.unreserve()
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return release, nil
+}
+
+// limitedConn is a streamIngestor whose requests are held back by a limiter.
+type limitedConn struct {
+	streamIngestor
+	limiter *limiter
+	spans   trace.Tracer
+}
+
+// limitConn returns c with its requests held back by l, or c if l is nil.
+func limitConn(c streamIngestor, l *limiter, spans trace.Tracer) streamIngestor {
+	if l == nil {
+		return c
+	}
+	return limitedConn{streamIngestor: c, limiter: l, spans: spans}
+}
+
+func (c limitedConn) StreamIngest(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, compression properties.CompressionType, mappingName string, additional map[string]string, clientRequestId string) (conn.Response, error) {
+	release, err := c.limiter.acquire(ctx, c.spans)
+	if err != nil {
+		return conn.Response{}, err
+	}
+	defer release()
+	return c.streamIngestor.StreamIngest(ctx, db, table, payload, format, compression, mappingName, additional, clientRequestId)
+}
+
+func (c limitedConn) StreamIngestBlob(ctx context.Context, db, table string, blobURI string, format properties.DataFormat, mappingName string, additional map[string]string, clientRequestId string) (conn.Response, error) {
+	release, err := c.limiter.acquire(ctx, c.spans)
+	if err != nil {
+		return conn.Response{}, err
+	}
+	defer release()
+	return c.streamIngestor.StreamIngestBlob(ctx, db, table, blobURI, format, mappingName, additional, clientRequestId)
+}
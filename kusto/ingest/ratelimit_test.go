@@ -0,0 +1,223 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/trace"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inFlight counts the operations that run at the same time.
+type inFlight struct {
+	mu       sync.Mutex
+	now, max int
+}
+
+func (f *inFlight) run(d time.Duration) {
+	f.mu.Lock()
+	if f.now++; f.now > f.max {
+		f.max = f.now
+	}
+	f.mu.Unlock()
+
+	time.Sleep(d)
+
+	f.mu.Lock()
+	f.now--
+	f.mu.Unlock()
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	const count = 10
+
+	rec := &trace.Recorder{}
+	ingestion, err := New(mockClient{endpoint: "https://test.kusto.windows.net"}, "db", "table", WithRateLimit(20, 2), WithSpanTracer(rec))
+	require.NoError(t, err)
+	defer ingestion.Close()
+
+	var mu sync.Mutex
+	var starts []time.Time
+	ingestion.fs = resources.FsMock{
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			starts = append(starts, time.Now())
+			return "blob", nil
+		},
+	}
+
+	begin := time.Now()
+	var wg sync.WaitGroup
+	for n := 0; n < count; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ingestion.FromReader(context.Background(), strings.NewReader("a,b"))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// The burst starts at once, and the others one every 50ms.
+	require.Len(t, starts, count)
+	elapsed := time.Since(begin)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(time.Duration(count-2)*50*time.Millisecond-10*time.Millisecond))
+	assert.Less(t, int64(elapsed), int64(2*time.Second))
+
+	waits := rec.Named(trace.RateLimit)
+	assert.Len(t, waits, count-2, "the ingestions that waited should report it")
+	for _, w := range waits {
+		assert.True(t, w.Ended)
+		assert.NoError(t, w.Err)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	t.Parallel()
+
+	ingestion, err := New(mockClient{endpoint: "https://test.kusto.windows.net"}, "db", "table", WithMaxInFlight(3))
+	require.NoError(t, err)
+	defer ingestion.Close()
+
+	flight := &inFlight{}
+	ingestion.fs = resources.FsMock{
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			flight.run(10 * time.Millisecond)
+			return "blob", nil
+		},
+		OnBlob: func(ctx context.Context, from string, fileSize int64, props properties.All) error {
+			flight.run(10 * time.Millisecond)
+			return nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 30; n++ {
+		n := n
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if n%2 == 0 {
+				_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"))
+			} else {
+				_, err = ingestion.FromFile(context.Background(), "https://account.blob.core.windows.net/container/data.csv")
+			}
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 3, flight.max)
+	assert.Equal(t, 0, len(ingestion.limiter.slots), "all the slots should be released")
+}
+
+func TestRateLimitCancel(t *testing.T) {
+	t.Parallel()
+
+	ingestion, err := New(mockClient{endpoint: "https://test.kusto.windows.net"}, "db", "table", WithMaxInFlight(1))
+	require.NoError(t, err)
+	defer ingestion.Close()
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	ingestion.fs = resources.FsMock{
+		OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+			close(started)
+			<-unblock
+			return "blob", nil
+		},
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := ingestion.FromReader(context.Background(), strings.NewReader("a,b"))
+		done <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = ingestion.FromReader(ctx, strings.NewReader("a,b"))
+	assert.True(t, goErrors.Is(err, context.DeadlineExceeded), "got %v", err)
+
+	close(unblock)
+	require.NoError(t, <-done)
+	assert.Equal(t, 0, len(ingestion.limiter.slots), "a canceled ingestion should not hold a slot")
+}
+
+func TestStreamingMaxInFlight(t *testing.T) {
+	t.Parallel()
+
+	flight := &inFlight{}
+	var requests int32
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+	streaming, err := NewStreaming(client, "db", "table", WithStreamingMaxInFlight(2))
+	require.NoError(t, err)
+	defer streaming.Close()
+	streaming.streamConn = fakeStreamIngestor{
+		onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+			atomic.AddInt32(&requests, 1)
+			flight.run(10 * time.Millisecond)
+			return nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 12; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(12), atomic.LoadInt32(&requests))
+	assert.Equal(t, 2, flight.max)
+}
+
+func TestRateLimitOptions(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+
+	ingestion, err := New(client, "db", "table")
+	require.NoError(t, err)
+	assert.Nil(t, ingestion.limiter, "there is no limit by default")
+	ingestion.Close()
+
+	for _, option := range []Option{WithRateLimit(-1, 1), WithRateLimit(1, -1), WithMaxInFlight(-1)} {
+		_, err := New(client, "db", "table", option)
+		require.Error(t, err)
+		assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+	}
+	for _, option := range []StreamingOption{WithStreamingRateLimit(-1, 1), WithStreamingMaxInFlight(-1)} {
+		_, err := NewStreaming(client, "db", "table", option)
+		require.Error(t, err)
+		assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+	}
+
+	// A Managed client holds back its streaming and its queued ingestions with the same limiter.
+	managed, err := NewManaged(client, "db", "table", WithMaxInFlight(2))
+	require.NoError(t, err)
+	defer managed.Close()
+	require.NotNil(t, managed.queued.limiter)
+	assert.Same(t, managed.queued.limiter, managed.streaming.limiter)
+}
@@ -0,0 +1,148 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/queued"
+)
+
+// ResourcesReason is why the ingestion resources that a client needs are missing.
+type ResourcesReason int
+
+const (
+	// ReasonUnknown means the resources could not be fetched, for a reason that is not one of the others.
+	ReasonUnknown ResourcesReason = iota
+	// ReasonNotProvided means the resources were fetched, but the cluster did not return any of them.
+	ReasonNotProvided
+	// ReasonUnauthenticated means the cluster refused the credentials of the client.
+	ReasonUnauthenticated
+	// ReasonForbidden means the principal of the client does not have a role that ingestion needs, such as
+	// Database Ingestor.
+	ReasonForbidden
+	// ReasonUnreachable means the cluster could not be reached, such as because of a network failure.
+	ReasonUnreachable
+)
+
+// String implements fmt.Stringer.
+func (r ResourcesReason) String() string {
+	switch r {
+	case ReasonNotProvided:
+		return "the cluster returned none"
+	case ReasonUnauthenticated:
+		return "the cluster refused the credentials"
+	case ReasonForbidden:
+		return "the principal is not allowed to ingest, it may lack the Database Ingestor role"
+	case ReasonUnreachable:
+		return "the cluster could not be reached"
+	}
+	return "the resources could not be fetched"
+}
+
+// ResourcesError describes ingestion resources that a client is missing, as returned by Ready() and by ingestions
+// that need them. It is wrapped in an *errors.Error and can be found with errors.As().
+type ResourcesError struct {
+	// Missing are the kinds of resources that are missing: "containers", "queues" or "status tables".
+	Missing []string
+	// Reason is why they are missing.
+	Reason ResourcesReason
+	// Cause is the error of the last attempt to fetch the resources, if it failed.
+	Cause error
+}
+
+// Error implements error.
+func (e *ResourcesError) Error() string {
+	msg := fmt.Sprintf("the ingestion resources have no %s: %s", strings.Join(e.Missing, ", "), e.Reason)
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the cause of the error.
+func (e *ResourcesError) Unwrap() error {
+	return e.Cause
+}
+
+// Ready checks that the client has the containers and queues that queued ingestion needs, fetching them again if
+// not. If they are still missing, the error wraps a *ResourcesError that tells which are missing and why.
+func (i *Ingestion) Ready(ctx context.Context) error {
+	if len(i.missingResources()) == 0 {
+		return nil
+	}
+
+	// The last fetch may have failed or returned only part of the resources.
+	cause := i.mgr.Refresh(ctx)
+	if missing := i.missingResources(); len(missing) > 0 {
+		if cause == nil {
+			_, cause = i.mgr.LastFetch()
+		}
+		return resourcesError(cause, missing...)
+	}
+	return nil
+}
+
+// missingResources returns the kinds of resources that queued ingestion needs and that the client has none of.
+func (i *Ingestion) missingResources() []string {
+	res, err := i.mgr.Resources()
+	if err != nil {
+		return []string{"containers", "queues"}
+	}
+
+	var missing []string
+	if len(res.Containers) == 0 {
+		missing = append(missing, "containers")
+	}
+	if len(res.Queues) == 0 {
+		missing = append(missing, "queues")
+	}
+	return missing
+}
+
+// missingResourceError returns the error for an ingestion that failed with err, which is a *ResourcesError if the
+// ingestion failed because resources are missing, or err otherwise.
+func (i *Ingestion) missingResourceError(err error) error {
+	missing := queued.MissingResource(err)
+	if missing == "" {
+		return err
+	}
+	_, cause := i.mgr.LastFetch()
+	return resourcesError(cause, missing)
+}
+
+// resourcesError returns the error for missing resources, after a fetch that failed with cause, if not nil.
+func resourcesError(cause error, missing ...string) *errors.Error {
+	re := &ResourcesError{Missing: missing, Cause: cause, Reason: ReasonNotProvided}
+	if cause != nil {
+		re.Reason = failureReason(cause)
+	}
+
+	switch re.Reason {
+	case ReasonUnknown, ReasonUnreachable:
+		return errors.E(errors.OpFileIngest, errors.KHTTPError, re)
+	case ReasonUnauthenticated, ReasonForbidden:
+		return errors.E(errors.OpFileIngest, errors.KHTTPError, re).SetNoRetry()
+	}
+	return errors.E(errors.OpFileIngest, errors.KBlobstore, re).SetNoRetry()
+}
+
+// failureReason returns why a request to the cluster failed with err, which is ReasonUnknown if it is for none of the
+// other reasons.
+func failureReason(err error) ResourcesReason {
+	var e *errors.Error
+	if goErrors.As(err, &e) {
+		switch code := e.StatusCode(); {
+		case code == http.StatusUnauthorized:
+			return ReasonUnauthenticated
+		case code == http.StatusForbidden:
+			return ReasonForbidden
+		case code == 0 && e.Kind == errors.KHTTPError:
+			return ReasonUnreachable
+		}
+	}
+	return ReasonUnknown
+}
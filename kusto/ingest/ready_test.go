@@ -0,0 +1,147 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resourcesMgmt serves the ingestion resources of rows to the first fetch, and then fails the fetches with err, if set.
+type resourcesMgmt struct {
+	mu      sync.Mutex
+	rows    []value.Values
+	err     error
+	fetches int
+}
+
+func (r *resourcesMgmt) client() mockClient {
+	return mockClient{
+		endpoint: "https://test.kusto.windows.net",
+		onMgmt: func(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+			if query.String() != ".get ingestion resources" {
+				return nil, nil
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.fetches++
+			if r.fetches > 1 && r.err != nil {
+				return nil, r.err
+			}
+			return resources.FakeResources(r.rows, false).Mgmt(ctx, db, query, options...)
+		},
+	}
+}
+
+func resourceRow(typ, uri string) value.Values {
+	return value.Values{value.String{Value: typ, Valid: true}, value.String{Value: uri, Valid: true}}
+}
+
+func TestReady(t *testing.T) {
+	t.Parallel()
+
+	container := resourceRow("TempStorage", "https://account.blob.core.windows.net/container?sig=s")
+	queue := resourceRow("SecuredReadyForAggregationQueue", "https://account.queue.core.windows.net/queue?sig=s")
+	httpErr := func(status string) error {
+		return errors.HTTP(errors.OpMgmt, status, ioutil.NopCloser(strings.NewReader("")), "")
+	}
+
+	tests := []struct {
+		desc        string
+		rows        []value.Values
+		err         error
+		wantMissing []string
+		wantReason  ResourcesReason
+		wantKind    errors.Kind
+	}{
+		{desc: "Ready", rows: []value.Values{container, queue}},
+		{
+			desc:        "No resources returned",
+			wantMissing: []string{"containers", "queues"},
+			wantReason:  ReasonNotProvided,
+			wantKind:    errors.KBlobstore,
+		},
+		{
+			desc:        "No queues returned",
+			rows:        []value.Values{container},
+			wantMissing: []string{"queues"},
+			wantReason:  ReasonNotProvided,
+			wantKind:    errors.KBlobstore,
+		},
+		{
+			desc:        "Forbidden",
+			err:         httpErr("403 Forbidden"),
+			wantMissing: []string{"containers", "queues"},
+			wantReason:  ReasonForbidden,
+			wantKind:    errors.KHTTPError,
+		},
+		{
+			desc:        "Unauthenticated",
+			err:         httpErr("401 Unauthorized"),
+			wantMissing: []string{"containers", "queues"},
+			wantReason:  ReasonUnauthenticated,
+			wantKind:    errors.KHTTPError,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			mgmt := &resourcesMgmt{rows: test.rows, err: test.err}
+			ingestion, err := New(mgmt.client(), "db", "table")
+			require.NoError(t, err)
+
+			err = ingestion.Ready(context.Background())
+			if test.wantMissing == nil {
+				assert.NoError(t, err)
+				assert.Equal(t, 1, mgmt.fetches, "a ready client should not fetch the resources again")
+				return
+			}
+
+			require.Error(t, err)
+			assert.Equal(t, test.wantKind, err.(*errors.Error).Kind)
+			var re *ResourcesError
+			require.True(t, goErrors.As(err, &re))
+			assert.Equal(t, test.wantMissing, re.Missing)
+			assert.Equal(t, test.wantReason, re.Reason)
+			assert.Equal(t, 2, mgmt.fetches, "Ready() should fetch the missing resources again")
+			if test.err != nil {
+				assert.True(t, goErrors.Is(err, test.err))
+			}
+		})
+	}
+}
+
+func TestMissingResourcesOnIngestion(t *testing.T) {
+	t.Parallel()
+
+	mgmt := &resourcesMgmt{}
+	ingestion, err := New(mgmt.client(), "db", "table")
+	require.NoError(t, err)
+
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"))
+	var re *ResourcesError
+	require.True(t, goErrors.As(err, &re), "got %v", err)
+	assert.Equal(t, []string{"containers"}, re.Missing)
+	assert.Equal(t, ReasonNotProvided, re.Reason)
+
+	_, err = ingestion.FromFile(context.Background(), "https://account.blob.core.windows.net/container/blob.csv")
+	require.True(t, goErrors.As(err, &re), "got %v", err)
+	assert.Equal(t, []string{"queues"}, re.Missing)
+
+	_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"), ReportResultToTable())
+	require.True(t, goErrors.As(err, &re), "got %v", err)
+	assert.Equal(t, []string{"status tables"}, re.Missing)
+}
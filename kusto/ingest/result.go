@@ -2,26 +2,67 @@ package ingest
 
 import (
 	"context"
+	goErrors "errors"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"time"
 
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/conn"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/status"
+	"github.com/google/uuid"
+)
+
+// IngestionMethod is the way the data of an ingestion was sent to Kusto.
+type IngestionMethod string
+
+const (
+	// QueuedIngestion means the data was staged in blob storage and queued for ingestion.
+	QueuedIngestion IngestionMethod = "Queued"
+	// StreamingIngestion means the data was sent directly to the engine.
+	StreamingIngestion IngestionMethod = "Streaming"
+	// QueryIngestion means the data was the result of a query that the service wrote to the table, see FromQuery().
+	QueryIngestion IngestionMethod = "Query"
 )
 
 // Result provides a way for users track the state of ingestion jobs.
 type Result struct {
 	record        statusRecord
 	tableClient   *status.TableClient
+	poller        *statusPoller
 	reportToTable bool
 	reportToQueue bool
+	method        IngestionMethod
+
+	bytesRead     int64
+	bytesUploaded int64
+
+	chunks []*Result
+	// journal is the Journal that the final status of the ingestion is recorded in once it is observed, nil if it
+	// has none or it was completed already, see observed().
+	journal Journal
+
+	blobName    string
+	compression properties.CompressionType
+	skipped     bool
+	// queuedOn is when the ingestion was queued, zero for other ingestions.
+	queuedOn time.Time
+	// warnings are about options that had no effect on the ingestion, see Warnings().
+	warnings []string
+	// extentIDs are the extents that FromQuery() created.
+	extentIDs []uuid.UUID
+
+	clientRequestId string
+	activityId      string
+	statusCode      int
+	elapsed         time.Duration
 }
 
 // newResult creates an initial ingestion status record.
 func newResult() *Result {
-	ret := &Result{}
+	ret := &Result{bytesRead: -1, bytesUploaded: -1}
 
 	ret.record = newStatusRecord()
 	return ret
@@ -31,10 +72,130 @@ func newResult() *Result {
 func (r *Result) putProps(props properties.All) {
 	r.reportToTable = props.Ingestion.ReportMethod == properties.ReportStatusToTable || props.Ingestion.ReportMethod == properties.ReportStatusToQueueAndTable
 	r.record.FromProps(props)
+	r.compression = props.SentCompression()
+}
+
+// putCounts records the byte counts of the ingestion.
+func (r *Result) putCounts(counts *properties.ByteCounts) {
+	if counts == nil {
+		return
+	}
+	r.bytesRead = counts.Read()
+	r.bytesUploaded = counts.Uploaded()
 }
 
-// putQueued sets the initial success status depending on status reporting state
-func (r *Result) putQueued(mgr *resources.Manager) {
+// putResponse records the ids, status and duration of a streaming ingestion.
+func (r *Result) putResponse(clientRequestId string, resp conn.Response) {
+	r.clientRequestId = clientRequestId
+	if resp.ClientRequestID != "" {
+		r.clientRequestId = resp.ClientRequestID
+	}
+	r.activityId = resp.ActivityID
+	r.statusCode = resp.StatusCode
+	r.elapsed = resp.Elapsed
+}
+
+// ClientRequestId returns the client request id that a streaming ingestion was sent with, either the one set with
+// the ClientRequestId() option or the one the client generated. Use it to find the request in the service logs.
+// It is empty for queued ingestions.
+func (r *Result) ClientRequestId() string {
+	return r.clientRequestId
+}
+
+// ActivityId returns the activity id that the service returned for a streaming ingestion, which identifies the
+// request in the service logs. It is empty for queued ingestions and when the service did not return one.
+func (r *Result) ActivityId() string {
+	return r.activityId
+}
+
+// StatusCode returns the HTTP status code of the response to a streaming ingestion. It is 0 for queued ingestions.
+// A failed streaming ingestion returns an errors.Error, which has the same details as a Result, StatusCode(),
+// ActivityId(), ClientRequestId() and Elapsed().
+func (r *Result) StatusCode() int {
+	return r.statusCode
+}
+
+// Elapsed returns how long the request of a streaming ingestion took, from sending it to reading the whole response.
+// It is 0 for queued ingestions.
+func (r *Result) Elapsed() time.Duration {
+	return r.elapsed
+}
+
+// BytesRead returns the number of bytes read from the source, before any compression done by the client.
+// It is -1 when the client did not read the data itself, such as when ingesting from a blob URI.
+func (r *Result) BytesRead() int64 {
+	return r.bytesRead
+}
+
+// BytesUploaded returns the number of bytes uploaded to blob storage or streamed to the service, after compression.
+// It is -1 when the client did not upload the data itself, such as when ingesting from a blob URI.
+func (r *Result) BytesUploaded() int64 {
+	return r.bytesUploaded
+}
+
+// Chunks returns the Result of each request when the data was split in chunks, as Streaming does with
+// WithAutoChunking(). The Result it is called on then sums their byte counts. It is nil otherwise.
+func (r *Result) Chunks() []*Result {
+	return r.chunks
+}
+
+// BlobName returns the name of the blob that FromFile() or FromReader() staged the data in for queued ingestion, which
+// can be set in part with the BlobNameHint() option. It is empty for other ingestions.
+func (r *Result) BlobName() string {
+	return r.blobName
+}
+
+// Warnings returns notes about options that were ignored for the ingestion, such as WithBlobMetadata() for the
+// ingestion of a blob URI. The ingestion was performed as if they were not given. It is nil if there are none.
+func (r *Result) Warnings() []string {
+	return r.warnings
+}
+
+// OperationID returns the id of the operation of the ingestion, as the service reported it. It is uuid.Nil until
+// the service reported one, such as for a queued ingestion whose status is not reported to a table.
+func (r *Result) OperationID() uuid.UUID {
+	return r.record.OperationID
+}
+
+// ExtentIDs returns the ids of the extents that FromQuery() created, as listed in the details of its operation. It is
+// nil for other ingestions.
+func (r *Result) ExtentIDs() []uuid.UUID {
+	return r.extentIDs
+}
+
+// Compression returns the compression of the data as it was sent to Kusto: CTGZip for data that the client compressed,
+// or the compression of a source that was sent as it is. For ingestions from a blob URI, it is the compression of
+// the blob, as set with Compression() or found from its name.
+func (r *Result) Compression() CompressionType {
+	return r.compression
+}
+
+// Method returns how the data was sent to Kusto. This is how Managed reports if it fell back to queued ingestion.
+func (r *Result) Method() IngestionMethod {
+	return r.method
+}
+
+// putSkipped records that the ingestion was skipped, as rec, the row of the status table for its id, says an
+// ingestion with the id already succeeded.
+func (r *Result) putSkipped(rec statusRecord) {
+	r.skipped = true
+	r.record = rec
+}
+
+// Skipped tells if the ingestion was skipped without sending anything, as SkipIfAlreadySucceeded() found that an
+// ingestion with the same SourceID() already succeeded. The ingestion was performed if it is false.
+func (r *Result) Skipped() bool {
+	return r.skipped
+}
+
+// putQueued sets the initial success status depending on status reporting state. The status table of the ingestion
+// is returned by table, and accessed with httpClient, or the default client of the storage SDK if it is nil, and
+// followed by poller for StatusChan(), whose client of the table the Result shares with the others of the table.
+func (r *Result) putQueued(table func(sourceID uuid.UUID) (*resources.URI, error), httpClient *http.Client, poller *statusPoller) {
+	r.method = QueuedIngestion
+	r.poller = poller
+	r.queuedOn = time.Now()
+
 	// If not checking status, just return queued
 	if !r.reportToTable {
 		r.record.Status = Queued
@@ -42,7 +203,7 @@ func (r *Result) putQueued(mgr *resources.Manager) {
 	}
 
 	// Get table URI
-	managerResources, err := mgr.Resources()
+	tableURI, err := table(r.record.IngestionSourceID)
 	if err != nil {
 		r.record.Status = StatusRetrievalFailed
 		r.record.FailureStatus = Permanent
@@ -50,15 +211,8 @@ func (r *Result) putQueued(mgr *resources.Manager) {
 		return
 	}
 
-	if len(managerResources.Tables) == 0 {
-		r.record.Status = StatusRetrievalFailed
-		r.record.FailureStatus = Permanent
-		r.record.Details = "Ingestion resources do not include a status table URI: " + err.Error()
-		return
-	}
-
-	// create a table client
-	client, err := status.NewTableClient(*managerResources.Tables[0])
+	// get the shared table client
+	client, err := poller.tableClient(tableURI, httpClient)
 	if err != nil {
 		r.record.Status = StatusRetrievalFailed
 		r.record.FailureStatus = Permanent
@@ -68,7 +222,7 @@ func (r *Result) putQueued(mgr *resources.Manager) {
 
 	// StreamIngest initial record
 	r.record.Status = Pending
-	err = client.Write(r.record.IngestionSourceID.String(), r.record.ToMap())
+	err = poller.writeStatus(client, r.record.IngestionSourceID.String(), r.record.ToMap())
 	if err != nil {
 		r.record.Status = StatusRetrievalFailed
 		r.record.FailureStatus = Permanent
@@ -81,6 +235,8 @@ func (r *Result) putQueued(mgr *resources.Manager) {
 
 // Wait returns a channel that can be checked for ingestion results.
 // In order to check actual status please use the ReportResultToTable option when ingesting data.
+// An ingestion that did not succeed receives the error of StatusRecord.Err(), an *errors.Error whose Kind is chosen
+// from the error code of the failure, which holds the StatusRecord.
 func (r *Result) Wait(ctx context.Context) chan error {
 	ch := make(chan error, 1)
 
@@ -93,8 +249,9 @@ func (r *Result) Wait(ctx context.Context) chan error {
 		defer close(ch)
 
 		r.poll(ctx)
-		if !r.record.Status.IsSuccess() {
-			ch <- r.record
+		r.observed(r.record)
+		if err := r.record.Err(); err != nil {
+			ch <- err
 		}
 	}()
 
@@ -144,15 +301,22 @@ func (r *Result) poll(ctx context.Context) {
 	}
 }
 
+// asStatusRecord returns the status record that err is or holds, see StatusRecord.Err().
+func asStatusRecord(err error) (statusRecord, bool) {
+	var s statusRecord
+	ok := goErrors.As(err, &s)
+	return s, ok
+}
+
 // IsStatusRecord verifies that the given error is a status record.
 func IsStatusRecord(err error) bool {
-	_, ok := err.(statusRecord)
+	_, ok := asStatusRecord(err)
 	return ok
 }
 
 // GetIngestionStatus extracts the ingestion status code from an ingestion error
 func GetIngestionStatus(err error) (StatusCode, error) {
-	if s, ok := err.(statusRecord); ok {
+	if s, ok := asStatusRecord(err); ok {
 		return s.Status, nil
 	}
 
@@ -161,7 +325,7 @@ func GetIngestionStatus(err error) (StatusCode, error) {
 
 // GetIngestionFailureStatus extracts the ingestion failure code from an ingestion error
 func GetIngestionFailureStatus(err error) (FailureStatusCode, error) {
-	if s, ok := err.(statusRecord); ok {
+	if s, ok := asStatusRecord(err); ok {
 		return s.FailureStatus, nil
 	}
 
@@ -170,7 +334,7 @@ func GetIngestionFailureStatus(err error) (FailureStatusCode, error) {
 
 // GetErrorCode extracts the error code from an ingestion error
 func GetErrorCode(err error) (string, error) {
-	if s, ok := err.(statusRecord); ok {
+	if s, ok := asStatusRecord(err); ok {
 		return s.ErrorCode, nil
 	}
 
@@ -179,7 +343,7 @@ func GetErrorCode(err error) (string, error) {
 
 // IsRetryable indicates whether there's any merit in retying ingestion
 func IsRetryable(err error) bool {
-	if s, ok := err.(statusRecord); ok {
+	if s, ok := asStatusRecord(err); ok {
 		return s.FailureStatus.IsRetryable()
 	}
 
@@ -0,0 +1,76 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/gzip"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/retry"
+)
+
+// BackoffPolicy is how an operation that failed with an error that can be retried, see errors.Retryable(), is
+// retried: the waits between the attempts grow exponentially from InitialInterval by Multiplier, with Jitter, up to
+// MaxInterval, until MaxAttempts attempts were made or the next wait would end after MaxElapsed. A wait is never
+// shorter than what the service asked for with a Retry-After header. The fields left at 0 keep their defaults, and
+// the zero BackoffPolicy does not retry. It is set with WithRetryPolicy() and WithStreamingRetryPolicy().
+type BackoffPolicy = retry.Policy
+
+// Retrier calls a func with the retries of a BackoffPolicy until it succeeds, fails with an error that cannot be
+// retried or ctx is done. Sleep and Now can be replaced, such as for deterministic tests.
+type Retrier = retry.Retrier
+
+// sendFunc sends a payload in a single streaming request.
+type sendFunc func(ctx context.Context, payload io.Reader, props properties.All) (*Result, error)
+
+// defaultStreamingRetry is how streaming ingestions are retried with WithStreamingRetries(), which sets the attempts
+// and the time allowed.
+var defaultStreamingRetry = BackoffPolicy{Jitter: 0.5}
+
+// streamWithRetry streams payload like streamImpl(), but retries transient failures according to policy.
+func streamWithRetry(c streamIngestor, ctx context.Context, payload io.Reader, props properties.All, policy BackoffPolicy) (*Result, error) {
+	counts := &properties.ByteCounts{}
+	payload = counts.CountRead(payload)
+
+	if props.ShouldCompress() {
+		zr := gzip.CompressLevel(payload, props.Source.GzipLevel())
+		defer zr.Close()
+		payload = zr
+		props.Source.Compression = properties.GZIP
+	}
+
+	limit := props.Streaming.MaxPayloadSize
+	if limit == 0 {
+		limit = maxStreamingSize
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(payload, limit+1))
+	if err != nil {
+		return nil, errors.E(errors.OpIngestStream, errors.KIO, err)
+	}
+	if int64(len(buf)) > limit {
+		return nil, payloadTooLargeErr(limit)
+	}
+
+	var result *Result
+	err = Retrier{Policy: policy, Retryable: isTransientStreamErr}.Do(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = streamImpl(c, ctx, bytes.NewReader(buf), props)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.bytesRead = counts.Read()
+	return result, nil
+}
+
+// isTransientStreamErr reports if a streaming ingestion that failed with err may succeed if sent again, see
+// errors.Retryable(). Streaming ingestion is sent again whether the service may have ingested the data or not, as
+// the managed client falls back to queued ingestion in that case anyway.
+func isTransientStreamErr(err error) bool {
+	return errors.Retryable(err)
+}
@@ -0,0 +1,168 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/gzip"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func httpErr(status string) error {
+	return errors.HTTP(errors.OpIngestStream, status, ioutil.NopCloser(strings.NewReader("")), "streaming ingest issue")
+}
+
+// flakyStreaming returns a Streaming whose service fails with errs, in order, and then succeeds.
+func flakyStreaming(attempts int, payloads *[][]byte, errs ...error) *Streaming {
+	return &Streaming{
+		db:    "db",
+		table: "table",
+		retry: BackoffPolicy{InitialInterval: time.Millisecond, MaxAttempts: attempts},
+		streamConn: fakeStreamIngestor{
+			onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+				b, err := ioutil.ReadAll(payload)
+				if err != nil {
+					return err
+				}
+				*payloads = append(*payloads, b)
+				if len(*payloads) <= len(errs) {
+					return errs[len(*payloads)-1]
+				}
+				return nil
+			},
+		},
+	}
+}
+
+func TestStreamingRetries(t *testing.T) {
+	t.Parallel()
+
+	data := "a,b\nc,d\n"
+	compressed, err := ioutil.ReadAll(gzip.Compress(strings.NewReader(data)))
+	require.NoError(t, err)
+
+	network := errors.E(errors.OpIngestStream, errors.KHTTPError, goErrors.New("connection reset by peer"))
+
+	tests := []struct {
+		desc     string
+		attempts int
+		errs     []error
+		wantSent int
+		err      bool
+	}{
+		{desc: "Succeeds on the third attempt", attempts: 3, errs: []error{httpErr("503 Service Unavailable"), network}, wantSent: 3},
+		{desc: "Gives up after the last attempt", attempts: 2, errs: []error{httpErr("429 Too Many Requests"), httpErr("504 Gateway Timeout")}, wantSent: 2, err: true},
+		{desc: "Bad request is permanent", attempts: 3, errs: []error{httpErr("400 Bad Request")}, wantSent: 1, err: true},
+		{desc: "Forbidden is permanent", attempts: 3, errs: []error{httpErr("403 Forbidden")}, wantSent: 1, err: true},
+		{desc: "No retries by default", errs: []error{httpErr("503 Service Unavailable")}, wantSent: 1, err: true},
+	}
+
+	for _, test := range tests {
+		var payloads [][]byte
+		streaming := flakyStreaming(test.attempts, &payloads, test.errs...)
+
+		result, err := streaming.FromReader(context.Background(), strings.NewReader(data), FileFormat(CSV))
+		require.Len(t, payloads, test.wantSent, test.desc)
+		for _, p := range payloads {
+			assert.Equal(t, compressed, p, test.desc)
+		}
+		if test.err {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		require.NoError(t, err, test.desc)
+		assert.Equal(t, int64(len(data)), result.BytesRead(), test.desc)
+	}
+}
+
+func TestStreamingRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	const wait = 50 * time.Millisecond
+	var payloads [][]byte
+	throttled := httpErr("429 Too Many Requests").(*errors.Error).SetRetryAfter(wait)
+	streaming := flakyStreaming(2, &payloads, throttled)
+
+	start := time.Now()
+	_, err := streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), wait)
+
+	// A wait that would go over the time allowed for retries gives up instead.
+	payloads = nil
+	throttled.SetRetryAfter(time.Hour)
+	streaming.retry.MaxElapsed = time.Second
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+	require.Error(t, err)
+	assert.Len(t, payloads, 1)
+}
+
+func TestWithStreamingRetries(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+
+	streaming, err := NewStreaming(client, "db", "table", WithStreamingRetries(3, time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, BackoffPolicy{Jitter: 0.5, MaxAttempts: 3, MaxElapsed: time.Minute}, streaming.retry)
+
+	_, err = NewStreaming(client, "db", "table", WithStreamingRetries(-1, 0))
+	assert.Error(t, err)
+
+	policy := BackoffPolicy{InitialInterval: time.Second, Multiplier: 2, MaxAttempts: 5}
+	streaming, err = NewStreaming(client, "db", "table", WithStreamingRetryPolicy(policy))
+	require.NoError(t, err)
+	assert.Equal(t, policy, streaming.retry)
+
+	_, err = NewStreaming(client, "db", "table", WithStreamingRetryPolicy(BackoffPolicy{Multiplier: 0.5}))
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+}
+
+func TestWithRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+	policy := BackoffPolicy{InitialInterval: time.Millisecond, Multiplier: 2, MaxAttempts: 3}
+
+	// Stream() and StreamReader() retry with the streaming policy.
+	ingestion, err := New(client, "db", "table", WithRetryPolicy(BackoffPolicy{}, BackoffPolicy{}, policy))
+	require.NoError(t, err)
+	defer ingestion.Close()
+	var payloads [][]byte
+	ingestion.streamConn = flakyStreaming(0, &payloads, httpErr("503 Service Unavailable"), httpErr("503 Service Unavailable")).streamConn
+	require.NoError(t, ingestion.Stream(context.Background(), []byte("a,b\n"), CSV, ""))
+	assert.Len(t, payloads, 3)
+
+	// A Managed client retries its streaming ingestions with it instead of its own policy.
+	managed, err := NewManaged(client, "db", "table", WithRetryPolicy(BackoffPolicy{}, BackoffPolicy{}, policy))
+	require.NoError(t, err)
+	defer managed.Close()
+	assert.Equal(t, policy, managed.newProp().ManagedStreaming.Retry)
+	assert.Equal(t, policy, managed.streaming.retry)
+
+	managed, err = NewManaged(client, "db", "table")
+	require.NoError(t, err)
+	defer managed.Close()
+	assert.Equal(t, defaultManagedRetry, managed.newProp().ManagedStreaming.Retry)
+
+	for _, option := range []Option{
+		WithRetryPolicy(BackoffPolicy{MaxAttempts: -1}, BackoffPolicy{}, BackoffPolicy{}),
+		WithRetryPolicy(BackoffPolicy{}, BackoffPolicy{Jitter: 2}, BackoffPolicy{}),
+		WithRetryPolicy(BackoffPolicy{}, BackoffPolicy{}, BackoffPolicy{InitialInterval: -time.Second}),
+	} {
+		_, err := New(client, "db", "table", option)
+		require.Error(t, err)
+		assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+	}
+}
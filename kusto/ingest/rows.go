@@ -0,0 +1,346 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+)
+
+// FromRowIterator ingests the rows of a query result, usually from another cluster, into the Ingestion's table.
+// Rows are serialized according to their column types in the format set with FileFormat(), which may be CSV
+// (the default), JSON or MultiJSON, and are staged through the same path as FromReader().
+// If the iterator yields an error (including an inline error frame), ingestion stops and that error is returned.
+// Unlike the other From methods, this returns a slice of Results, as a large result may be staged as several blobs.
+// Without SplitSize() all rows are staged in a single blob and a single Result is returned. With SplitSize(),
+// a new blob is staged every time the serialized (uncompressed) data reaches the size, and a Result is returned
+// for each. If an error occurs after some blobs were queued, the Results for those blobs are returned along with the error.
+// The iterator is consumed but not stopped, the caller still owns the call to iter.Stop().
+func (i *Ingestion) FromRowIterator(ctx context.Context, iter *kusto.RowIterator, options ...FileOption) ([]*Result, error) {
+	props := i.newProp()
+	for _, o := range options {
+		if err := o.Run(&props, QueuedClient, FromReader); err != nil {
+			return nil, err
+		}
+	}
+
+	var enc rowEncoder
+	switch props.Ingestion.Additional.Format {
+	case DFUnknown, CSV:
+		enc = newCSVRowEncoder()
+	case JSON, MultiJSON:
+		enc = jsonRowEncoder{}
+	default:
+		return nil, errors.ES(
+			errors.OpFileIngest,
+			errors.KClientArgs,
+			"FromRowIterator() only supports CSV, JSON or MultiJSON formats, not %q", props.Ingestion.Additional.Format,
+		).SetNoRetry()
+	}
+
+	reader := &rowReader{iter: iter, enc: enc, limit: props.Source.SplitSize}
+
+	var results []*Result
+	for {
+		more, err := reader.more()
+		if err != nil {
+			return results, err
+		}
+		if !more {
+			return results, nil
+		}
+
+		result, err := i.fromReader(ctx, reader, options, i.newProp())
+		if err != nil {
+			// Errors from the iterator or serialization are more useful than the upload error they caused.
+			if reader.err != nil {
+				return results, reader.err
+			}
+			return results, err
+		}
+		results = append(results, result)
+	}
+}
+
+// rowEncoder serializes a row into a buffer, including any record separator.
+type rowEncoder interface {
+	encode(buf *bytes.Buffer, row *table.Row) error
+}
+
+// rowReader is an io.Reader that pulls rows from a RowIterator on demand and serializes them.
+// When limit is set, it returns io.EOF after at least limit bytes were read. more() then tells
+// if another chunk can be read.
+type rowReader struct {
+	iter  *kusto.RowIterator
+	enc   rowEncoder
+	limit int64
+
+	buf     bytes.Buffer
+	pending *table.Row
+	read    int64
+	done    bool
+	err     error
+}
+
+// more resets the chunk size accounting and reports if there are rows left to read.
+func (r *rowReader) more() (bool, error) {
+	r.read = 0
+	if r.buf.Len() > 0 || r.pending != nil {
+		return true, nil
+	}
+	row, err := r.next()
+	if err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	r.pending = row
+	return true, nil
+}
+
+// next returns the next row, either the one we peeked at in more() or one from the iterator.
+func (r *rowReader) next() (*table.Row, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.done {
+		return nil, io.EOF
+	}
+	if r.pending != nil {
+		row := r.pending
+		r.pending = nil
+		return row, nil
+	}
+
+	row, inlineErr, err := r.iter.NextRowOrError()
+	switch {
+	case err == io.EOF:
+		r.done = true
+		return nil, io.EOF
+	case err != nil:
+		r.err = err
+		return nil, err
+	case inlineErr != nil:
+		r.err = inlineErr
+		return nil, inlineErr
+	}
+	return row, nil
+}
+
+// Read implements io.Reader.
+func (r *rowReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.limit > 0 && r.read >= r.limit {
+			return 0, io.EOF
+		}
+
+		row, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+
+		if err := r.enc.encode(&r.buf, row); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+
+	n, _ := r.buf.Read(p)
+	r.read += int64(n)
+	return n, nil
+}
+
+// csvRowEncoder encodes rows as RFC 4180 CSV records. Null values are written as empty fields.
+type csvRowEncoder struct {
+	line []string
+}
+
+func newCSVRowEncoder() *csvRowEncoder {
+	return &csvRowEncoder{}
+}
+
+func (c *csvRowEncoder) encode(buf *bytes.Buffer, row *table.Row) error {
+	c.line = c.line[:0]
+	for _, v := range row.Values {
+		s, err := csvField(v)
+		if err != nil {
+			return err
+		}
+		c.line = append(c.line, s)
+	}
+
+	w := csv.NewWriter(buf)
+	if err := w.Write(c.line); err != nil {
+		return errors.E(errors.OpFileIngest, errors.KInternal, fmt.Errorf("could not encode row as CSV: %w", err)).SetNoRetry()
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func csvField(v value.Kusto) (string, error) {
+	switch v := v.(type) {
+	case value.Real:
+		if !v.Valid {
+			return "", nil
+		}
+		return formatReal(v.Value), nil
+	case value.DateTime:
+		if !v.Valid {
+			return "", nil
+		}
+		return v.Value.UTC().Format(time.RFC3339Nano), nil
+	case value.Timespan:
+		if !v.Valid {
+			return "", nil
+		}
+		return v.Marshal(), nil
+	case value.Bool, value.Int, value.Long, value.Decimal, value.String, value.GUID, value.Dynamic:
+		return v.String(), nil
+	}
+	return "", errors.ES(errors.OpFileIngest, errors.KClientArgs, "cannot serialize value of type %T", v).SetNoRetry()
+}
+
+// jsonRowEncoder encodes rows as JSON objects keyed by column name, one per line. The output
+// is valid for both the JSON and MultiJSON formats.
+type jsonRowEncoder struct{}
+
+func (jsonRowEncoder) encode(buf *bytes.Buffer, row *table.Row) error {
+	if len(row.Values) != len(row.ColumnTypes) {
+		return errors.ES(errors.OpFileIngest, errors.KClientArgs, "row has %d values for %d columns", len(row.Values), len(row.ColumnTypes)).SetNoRetry()
+	}
+
+	buf.WriteByte('{')
+	for idx, v := range row.Values {
+		if idx > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(row.ColumnTypes[idx].Name)
+		if err != nil {
+			return errors.E(errors.OpFileIngest, errors.KInternal, fmt.Errorf("could not encode column name: %w", err)).SetNoRetry()
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+
+		b, err := jsonField(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	buf.WriteString("}\n")
+	return nil
+}
+
+// isJSONNumber determines if s can be written as is as a JSON number.
+func isJSONNumber(s string) bool {
+	// A valid JSON value that starts with a digit or a minus sign can only be a number.
+	return s != "" && (s[0] == '-' || (s[0] >= '0' && s[0] <= '9')) && json.Valid([]byte(s))
+}
+
+func jsonField(v value.Kusto) ([]byte, error) {
+	var i interface{}
+	switch v := v.(type) {
+	case value.Bool:
+		if v.Valid {
+			i = v.Value
+		}
+	case value.Int:
+		if v.Valid {
+			i = v.Value
+		}
+	case value.Long:
+		if v.Valid {
+			i = v.Value
+		}
+	case value.Real:
+		if v.Valid {
+			if math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+				i = formatReal(v.Value)
+			} else {
+				i = v.Value
+			}
+		}
+	case value.Decimal:
+		// Decimals are written as JSON numbers to keep their full precision, or as strings if they are not
+		// valid JSON numbers.
+		if v.Valid {
+			if isJSONNumber(v.Value) {
+				return []byte(v.Value), nil
+			}
+			i = v.Value
+		}
+	case value.String:
+		if v.Valid {
+			i = v.Value
+		}
+	case value.GUID:
+		if v.Valid {
+			i = v.Value.String()
+		}
+	case value.DateTime:
+		if v.Valid {
+			i = v.Value.UTC().Format(time.RFC3339Nano)
+		}
+	case value.Timespan:
+		if v.Valid {
+			i = v.Marshal()
+		}
+	case value.Dynamic:
+		if v.Valid {
+			if json.Valid(v.Value) {
+				return v.Value, nil
+			}
+			i = string(v.Value)
+		}
+	default:
+		return nil, errors.ES(errors.OpFileIngest, errors.KClientArgs, "cannot serialize value of type %T", v).SetNoRetry()
+	}
+
+	b, err := json.Marshal(i)
+	if err != nil {
+		return nil, errors.E(errors.OpFileIngest, errors.KInternal, fmt.Errorf("could not encode value as JSON: %w", err)).SetNoRetry()
+	}
+	return b, nil
+}
+
+// formatReal formats a float the way Kusto parses reals, including its names for the special values.
+func formatReal(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// SplitSize makes FromRowIterator() stage a new blob every time the serialized data reaches size bytes,
+// so a large result is ingested as several blobs. It has no effect on other ingestion methods.
+func SplitSize(size int64) FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			if size <= 0 {
+				return errors.ES(errors.OpFileIngest, errors.KClientArgs, "SplitSize() must be a positive number, was %d", size).SetNoRetry()
+			}
+			p.Source.SplitSize = size
+			return nil
+		},
+		clientScopes: QueuedClient,
+		sourceScope:  FromReader,
+		name:         "SplitSize",
+	}
+}
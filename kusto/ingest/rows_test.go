@@ -0,0 +1,219 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var rowsTestColumns = table.Columns{
+	{Name: "Bool", Type: types.Bool},
+	{Name: "Int", Type: types.Int},
+	{Name: "Long", Type: types.Long},
+	{Name: "Real", Type: types.Real},
+	{Name: "Decimal", Type: types.Decimal},
+	{Name: "String", Type: types.String},
+	{Name: "GUID", Type: types.GUID},
+	{Name: "DateTime", Type: types.DateTime},
+	{Name: "Timespan", Type: types.Timespan},
+	{Name: "Dynamic", Type: types.Dynamic},
+}
+
+func rowsTestValues() []value.Values {
+	return []value.Values{
+		{
+			value.Bool{Value: true, Valid: true},
+			value.Int{Value: -3, Valid: true},
+			value.Long{Value: 9007199254740993, Valid: true},
+			value.Real{Value: 1.5, Valid: true},
+			value.Decimal{Value: "123456789012345678901234.5", Valid: true},
+			value.String{Value: "hello, \"world\"\nbye", Valid: true},
+			value.GUID{Value: uuid.MustParse("6d2b6e9b-6e0e-4a38-a6a1-1f2a39c1ef41"), Valid: true},
+			value.DateTime{Value: time.Date(2021, 3, 4, 5, 6, 7, 800000000, time.FixedZone("", 3600)), Valid: true},
+			value.Timespan{Value: 26*time.Hour + 3*time.Minute + 500*time.Millisecond, Valid: true},
+			value.Dynamic{Value: []byte(`{"a":[1,2]}`), Valid: true},
+		},
+		{
+			value.Bool{},
+			value.Int{},
+			value.Long{},
+			value.Real{Value: math.NaN(), Valid: true},
+			value.Decimal{},
+			value.String{},
+			value.GUID{},
+			value.DateTime{},
+			value.Timespan{},
+			value.Dynamic{},
+		},
+	}
+}
+
+func newRowsTestIterator(t *testing.T, rows []value.Values, iterErr error) *kusto.RowIterator {
+	mock, err := kusto.NewMockRows(rowsTestColumns)
+	require.NoError(t, err)
+	for _, row := range rows {
+		require.NoError(t, mock.Row(row))
+	}
+	if iterErr != nil {
+		require.NoError(t, mock.Error(iterErr))
+	}
+
+	iter := &kusto.RowIterator{}
+	require.NoError(t, iter.Mock(mock))
+	return iter
+}
+
+func TestFromRowIterator(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		rows     []value.Values
+		iterErr  error
+		options  []FileOption
+		want     []string
+		wantFmt  DataFormat
+		err      bool
+		nResults int
+	}{
+		{
+			desc: "CSV is the default",
+			rows: rowsTestValues(),
+			want: []string{
+				"true,-3,9007199254740993,1.5,123456789012345678901234.5,\"hello, \"\"world\"\"\nbye\"," +
+					"6d2b6e9b-6e0e-4a38-a6a1-1f2a39c1ef41,2021-03-04T04:06:07.8Z,1.02:03:00.5,\"{\"\"a\"\":[1,2]}\"\n" +
+					",,,NaN,,,,,,\n",
+			},
+			wantFmt:  CSV,
+			nResults: 1,
+		},
+		{
+			desc:    "MultiJSON",
+			rows:    rowsTestValues(),
+			options: []FileOption{FileFormat(MultiJSON)},
+			want: []string{
+				`{"Bool":true,"Int":-3,"Long":9007199254740993,"Real":1.5,"Decimal":123456789012345678901234.5,"String":"hello, \"world\"\nbye",` +
+					`"GUID":"6d2b6e9b-6e0e-4a38-a6a1-1f2a39c1ef41","DateTime":"2021-03-04T04:06:07.8Z","Timespan":"1.02:03:00.5","Dynamic":{"a":[1,2]}}` + "\n" +
+					`{"Bool":null,"Int":null,"Long":null,"Real":"NaN","Decimal":null,"String":null,"GUID":null,"DateTime":null,"Timespan":null,"Dynamic":null}` + "\n",
+			},
+			wantFmt:  MultiJSON,
+			nResults: 1,
+		},
+		{
+			desc:    "Unsupported format",
+			rows:    rowsTestValues(),
+			options: []FileOption{FileFormat(Parquet)},
+			err:     true,
+		},
+		{
+			desc:     "Empty result stages nothing",
+			wantFmt:  CSV,
+			nResults: 0,
+		},
+		{
+			desc: "SplitSize stages several blobs",
+			rows: []value.Values{
+				rowsTestValues()[1],
+				rowsTestValues()[1],
+				rowsTestValues()[1],
+			},
+			options:  []FileOption{SplitSize(20)},
+			want:     []string{",,,NaN,,,,,,\n,,,NaN,,,,,,\n", ",,,NaN,,,,,,\n"},
+			wantFmt:  CSV,
+			nResults: 2,
+		},
+		{
+			desc:     "Iterator error stops the ingestion",
+			rows:     rowsTestValues(),
+			iterErr:  fmt.Errorf("shard failure"),
+			wantFmt:  CSV,
+			err:      true,
+			nResults: 0,
+		},
+		{
+			desc: "Iterator error after a split keeps the earlier results",
+			rows: []value.Values{
+				rowsTestValues()[1],
+				rowsTestValues()[1],
+			},
+			iterErr:  fmt.Errorf("shard failure"),
+			options:  []FileOption{SplitSize(10)},
+			want:     []string{",,,NaN,,,,,,\n", ",,,NaN,,,,,,\n"},
+			wantFmt:  CSV,
+			err:      true,
+			nResults: 2,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ingestion, err := New(mockClient{endpoint: "https://test.kusto.windows.net"}, "db", "table")
+			require.NoError(t, err)
+
+			var got []string
+			ingestion.fs = resources.FsMock{
+				OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+					b, err := ioutil.ReadAll(reader)
+					if err != nil {
+						return "", err
+					}
+					assert.Equal(t, test.wantFmt, props.Ingestion.Additional.Format)
+					got = append(got, string(b))
+					return fmt.Sprintf("blob%d", len(got)), nil
+				},
+			}
+
+			results, err := ingestion.FromRowIterator(context.Background(), newRowsTestIterator(t, test.rows, test.iterErr), test.options...)
+			if test.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Len(t, results, test.nResults)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestJSONFieldDecimal(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "1.5", want: `1.5`},
+		{in: "-123456789012345678901234.5", want: `-123456789012345678901234.5`},
+		{in: "1e-5", want: `1e-5`},
+		{in: "NaN", want: `"NaN"`},
+		{in: "1.5.5", want: `"1.5.5"`},
+		{in: "01", want: `"01"`},
+		{in: "-", want: `"-"`},
+		{in: "1 2", want: `"1 2"`},
+	}
+
+	for _, test := range tests {
+		got, err := jsonField(value.Decimal{Value: test.in, Valid: true})
+		require.NoError(t, err, test.in)
+		assert.Equal(t, test.want, string(got), test.in)
+		assert.True(t, json.Valid(got), test.in)
+	}
+}
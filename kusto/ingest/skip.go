@@ -0,0 +1,72 @@
+package ingest
+
+import (
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/google/uuid"
+)
+
+// SourceID sets the id of the ingestion of the source, which its row in the status table of ReportResultToTable()
+// is keyed by. Without it, an id is generated for each ingestion. Give the same id to every ingestion of the same
+// data, such as one made from the name of the file, for SkipIfAlreadySucceeded() to find the ingestions before it.
+func SourceID(id uuid.UUID) FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			if id == uuid.Nil {
+				return errors.ES(errors.OpFileIngest, errors.KClientArgs, "SourceID(): the id cannot be the nil UUID").SetNoRetry()
+			}
+			p.Source.ID = id
+			return nil
+		},
+		clientScopes: QueuedClient | ManagedClient,
+		sourceScope:  FromFile | FromReader | FromBlob,
+		name:         "SourceID",
+	}
+}
+
+// SkipIfAlreadySucceeded makes a queued ingestion with a SourceID() first look up the row of that id in the status
+// table, and if an ingestion with the id already succeeded, return a Result whose Skipped() is true without
+// uploading or queueing anything. Only ingestions made with ReportResultToTable() have a row to be found.
+// The check fails open: without a SourceID(), for a client made WithoutStatusReporting(), without status tables or
+// if the lookup fails, the data is ingested. Two ingestions of the same id that run at the same time can both find
+// no row and both ingest the data, so this does not replace the ingest-by tags of IfNotExists() when that matters.
+func SkipIfAlreadySucceeded() FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			p.Source.SkipIfAlreadySucceeded = true
+			return nil
+		},
+		clientScopes: QueuedClient | ManagedClient,
+		sourceScope:  FromFile | FromReader | FromBlob,
+		name:         "SkipIfAlreadySucceeded",
+	}
+}
+
+// alreadySucceeded returns the row of the status table for the ingestion with sourceID if it says the ingestion
+// succeeded. It returns false if there is no such row or it cannot be read.
+func (i *Ingestion) alreadySucceeded(sourceID uuid.UUID) (statusRecord, bool) {
+	if sourceID == uuid.Nil || i.cfg.noStatusReporting {
+		return statusRecord{}, false
+	}
+
+	data, err := i.readStatus(sourceID)
+	if err != nil {
+		return statusRecord{}, false
+	}
+	rec := newStatusRecord()
+	rec.FromMap(data)
+	return rec, rec.Status == Succeeded
+}
+
+// readStatus reads the row of the status table for the ingestion with sourceID.
+func (i *Ingestion) readStatus(sourceID uuid.UUID) (map[string]interface{}, error) {
+	if i.statusReader != nil {
+		return i.statusReader(sourceID)
+	}
+
+	client, err := i.statusTableClient(sourceID)
+	if err != nil {
+		return nil, err
+	}
+	return client.Read(sourceID.String())
+}
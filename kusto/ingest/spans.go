@@ -0,0 +1,61 @@
+package ingest
+
+import (
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/trace"
+)
+
+// SpanTracer starts the spans of the phases of the ingestions of a client made WithSpanTracer() or
+// WithStreamingSpanTracer(), such as by adapting an OpenTelemetry trace.Tracer, which this package does not depend
+// on. The spans are children of the span in the context passed to the methods of the client:
+//   - "kusto.ingest.prepare": running the options and getting the authorization context of a queued ingestion.
+//   - "kusto.ingest.upload": uploading the data to a blob, with the name of the blob and the bytes uploaded.
+//   - "kusto.ingest.enqueue": posting the ingestion message to a queue, with the name of the queue.
+//   - "kusto.ingest.stream": a streaming ingestion request, with its client request id, and its activity id and
+//     HTTP status once it got a response. Each attempt of a request that is retried has its own span.
+//   - "kusto.ingest.refresh_resources": fetching the ingestion resources. The fetches of the background refresh are
+//     spans without a parent.
+//   - "kusto.ingest.rate_limit": waiting for the limits of WithRateLimit() or WithMaxInFlight(), only when an
+//     operation had to wait.
+//
+// The keys of the attributes of the spans follow the OpenTelemetry semantic conventions where there is one, such as
+// "db.namespace" for the database and "server.address" for the host that a request is sent to. A span whose phase
+// failed is ended with the error, for the SpanTracer to set the status of the span.
+//
+// An adapter of an OpenTelemetry tracer could be:
+//
+//	type otelTracer struct{ t trace.Tracer }
+//
+//	func (o otelTracer) Start(ctx context.Context, name string, attrs ...ingest.SpanAttr) (context.Context, ingest.Span) {
+//		ctx, span := o.t.Start(ctx, name)
+//		s := otelSpan{span}
+//		s.SetAttributes(attrs...)
+//		return ctx, s
+//	}
+//
+//	type otelSpan struct{ span trace.Span }
+//
+//	func (s otelSpan) SetAttributes(attrs ...ingest.SpanAttr) {
+//		for _, a := range attrs {
+//			switch v := a.Value.(type) {
+//			case string:
+//				s.span.SetAttributes(attribute.String(a.Key, v))
+//			case int64:
+//				s.span.SetAttributes(attribute.Int64(a.Key, v))
+//			}
+//		}
+//	}
+//
+//	func (s otelSpan) End(err error) {
+//		if err != nil {
+//			s.span.RecordError(err)
+//			s.span.SetStatus(codes.Error, err.Error())
+//		}
+//		s.span.End()
+//	}
+type SpanTracer = trace.Tracer
+
+// Span is a span started by a SpanTracer. End is called once, with the error of the phase of the span if it failed.
+type Span = trace.Span
+
+// SpanAttr is an attribute of a Span. Value is a string, an int64 or a bool.
+type SpanAttr = trace.Attr
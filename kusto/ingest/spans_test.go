@@ -0,0 +1,70 @@
+package ingest
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpanTracer(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile(t.TempDir(), "*.csv")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	rec := &trace.Recorder{}
+	ingestion, err := New(mockClient{endpoint: "https://test.kusto.windows.net"}, "db", "table", WithSpanTracer(rec))
+	require.NoError(t, err)
+	defer ingestion.Close()
+
+	// The resources fetched by New() have no caller.
+	fetches := rec.Named(trace.RefreshResources)
+	require.Len(t, fetches, 1)
+	assert.Nil(t, fetches[0].Parent)
+	assert.True(t, fetches[0].Ended)
+
+	// The spans of the upload and of the post to the queue are started with the context that the queued ingestion
+	// gets, so they are children of the span of the caller, as is the span of the preparation.
+	ingestion.fs = resources.FsMock{
+		OnLocal: func(ctx context.Context, from string, props properties.All) (string, error) {
+			_, span := trace.Start(ctx, rec, trace.Upload)
+			span.End(nil)
+			return "blob", nil
+		},
+	}
+
+	ctx, root := rec.Root(context.Background(), "caller")
+	_, err = ingestion.FromFile(ctx, f.Name())
+	require.NoError(t, err)
+
+	var tree []string
+	for _, s := range rec.Spans() {
+		if s.Parent == root {
+			tree = append(tree, s.Name)
+		}
+		if s.Parent != nil && s.Parent != root {
+			assert.Fail(t, "span is not a child of the caller", "%s is a child of %s", s.Name, s.Parent.Name)
+		}
+	}
+	assert.Equal(t, []string{trace.Prepare, trace.Upload}, tree)
+
+	prepare := rec.Named(trace.Prepare)[0]
+	assert.True(t, prepare.Ended)
+	assert.NoError(t, prepare.Err)
+	assert.Equal(t, "db", prepare.Attrs[trace.DBNamespace])
+	assert.Equal(t, "table", prepare.Attrs[trace.DBCollection])
+
+	// A failed phase ends its span with the error.
+	_, err = ingestion.FromFile(ctx, f.Name(), FileFormat(JSON), IngestionMappingRef("map", CSV))
+	require.Error(t, err)
+	prepares := rec.Named(trace.Prepare)
+	require.Len(t, prepares, 2)
+	assert.Equal(t, err, prepares[1].Err)
+}
@@ -2,8 +2,10 @@ package ingest
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
 	storageuid "github.com/gofrs/uuid"
 	"github.com/google/uuid"
@@ -247,6 +249,75 @@ func (r statusRecord) Error() string {
 	}
 }
 
+// Err returns the record of an ingestion that did not succeed as an *errors.Error, or nil for one that did. The Kind of
+// the error is chosen from the family of the ErrorCode, such as errors.KDataFormat for the "Stream_" errors of data
+// that does not match its format, and the error is errors.Retryable() when the FailureStatus is. A failure of an
+// update policy is of Kind errors.KUpdatePolicy and never retryable: the data was ingested into the table, so
+// ingesting it again would duplicate it. The record can be found in the error with errors.As() and a StatusRecord.
+func (r statusRecord) Err() error {
+	if r.Status.IsSuccess() {
+		return nil
+	}
+
+	e := errors.E(errors.OpFileIngest, r.errKind(), r)
+	if r.FailureStatus.IsRetryable() && !r.OriginatesFromUpdatePolicy {
+		return e.SetTransient()
+	}
+	return e.SetNoRetry()
+}
+
+// statusErrorKinds are the Kinds of the error codes of ingestion failures that are not found from their family.
+var statusErrorKinds = map[string]errors.Kind{
+	"BadRequest_DatabaseNotExist":                 errors.KDBNotExist,
+	"BadRequest_TableNotExist":                    errors.KTableNotExist,
+	"BadRequest_EntityNotFound":                   errors.KTableNotExist,
+	"BadRequest_MappingReferenceWasNotFound":      errors.KMappingNotExist,
+	"BadRequest_InvalidMapping":                   errors.KMappingInvalid,
+	"BadRequest_InvalidMappingReference":          errors.KMappingInvalid,
+	"BadRequest_InconsistentMapping":              errors.KMappingInvalid,
+	"BadRequest_DuplicateMapping":                 errors.KMappingInvalid,
+	"BadRequest_EmptyMappingReference":            errors.KMappingInvalid,
+	"BadRequest_NoRecordsOrWrongFormat":           errors.KDataFormat,
+	"BadRequest_FormatNotSupported":               errors.KDataFormat,
+	"BadRequest_UnexpectedCharacterInInputStream": errors.KDataFormat,
+	"BadRequest_InvalidBlob":                      errors.KDataFormat,
+	"BadRequest_EmptyBlob":                        errors.KDataFormat,
+	"BadRequest_EmptyArchive":                     errors.KDataFormat,
+	"BadRequest_InvalidArchive":                   errors.KDataFormat,
+	"BadRequest_FileTooLarge":                     errors.KPayloadTooLarge,
+	"General_ThrottledIngestion":                  errors.KLimitsExceeded,
+}
+
+// errKind returns the Kind of the error of r, see Err().
+func (r statusRecord) errKind() errors.Kind {
+	if r.OriginatesFromUpdatePolicy {
+		return errors.KUpdatePolicy
+	}
+	switch r.Status {
+	case StatusRetrievalFailed:
+		return errors.KIO
+	case StatusRetrievalCanceled:
+		return errors.KTimeout
+	}
+
+	if kind, ok := statusErrorKinds[r.ErrorCode]; ok {
+		return kind
+	}
+	switch {
+	case strings.HasSuffix(r.ErrorCode, "TooLarge"):
+		return errors.KPayloadTooLarge
+	case strings.HasPrefix(r.ErrorCode, "Stream_"):
+		return errors.KDataFormat
+	case strings.HasPrefix(r.ErrorCode, "BadRequest_"):
+		return errors.KClientArgs
+	case strings.HasPrefix(r.ErrorCode, "Download_"):
+		return errors.KBlobstore
+	case strings.HasPrefix(r.ErrorCode, "General_"):
+		return errors.KInternal
+	}
+	return errors.KOther
+}
+
 func getTimeFromInterface(x interface{}) (time.Time, error) {
 	switch x.(type) {
 	case string:
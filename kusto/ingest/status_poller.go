@@ -0,0 +1,323 @@
+package ingest
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/status"
+)
+
+// StatusRecord is the status of an ingestion as it is in the status table, which StatusChan() and WatchStatus()
+// deliver. It is also the error that Wait() returns for an ingestion that did not succeed.
+type StatusRecord = statusRecord
+
+const (
+	// statusPollInterval is how often the poller reads the status table.
+	statusPollInterval = 10 * time.Second
+	// statusCheckInterval is how often the poller looks for watches whose context is done.
+	statusCheckInterval = time.Second
+	// maxStatusIDsPerQuery is the number of ingestions whose status is read in one query, which keeps the filter of
+	// the query under the limits of the table service.
+	maxStatusIDsPerQuery = 50
+	// maxStatusReadFailures is the number of reads of the status of an ingestion that can fail in a row before it is
+	// delivered as StatusRetrievalFailed.
+	maxStatusReadFailures = 3
+)
+
+// statusWatch is a Result that the statusPoller reads the status of until it is final.
+type statusWatch struct {
+	ctx    context.Context
+	client *status.TableClient
+	// table is the status table of client, see statusTableKey().
+	table    string
+	rec      statusRecord
+	failures int
+	deliver  func(StatusRecord)
+}
+
+// statusPoller reads the status of all the Results of an Ingestion that are watched with StatusChan() or
+// WatchStatus(), so that any number of them are followed by a single goroutine, which reads the status of many
+// ingestions in each query of the status table. It also holds the clients of the status tables, which the Results of
+// a table share, see tableClient().
+type statusPoller struct {
+	pollInterval  time.Duration
+	checkInterval time.Duration
+	// read reads the records of the ingestions with the ids from the status table of client.
+	read func(client *status.TableClient, ids []string) (map[string]map[string]interface{}, error)
+	// write writes the record of the ingestion with the id to the status table of client.
+	write func(client *status.TableClient, id string, data map[string]interface{}) error
+
+	mu sync.Mutex
+	// clients are the clients of the status tables, by statusTableKey().
+	clients map[string]*status.TableClient
+	watches map[*statusWatch]struct{}
+	started bool
+	closed  bool
+	done    chan struct{}
+}
+
+func newStatusPoller() *statusPoller {
+	return &statusPoller{
+		pollInterval:  statusPollInterval,
+		checkInterval: statusCheckInterval,
+		read: func(client *status.TableClient, ids []string) (map[string]map[string]interface{}, error) {
+			return client.ReadMany(ids)
+		},
+		write: func(client *status.TableClient, id string, data map[string]interface{}) error {
+			return client.Write(id, data)
+		},
+		clients: map[string]*status.TableClient{},
+		watches: map[*statusWatch]struct{}{},
+		done:    make(chan struct{}),
+	}
+}
+
+// tableClient returns the client of the status table uri. The Results of a table share its client, which is made
+// again when the shared access signature of uri changes, as it does when the resources are fetched again.
+func (p *statusPoller) tableClient(uri *resources.URI, httpClient *http.Client) (*status.TableClient, error) {
+	if p == nil {
+		return status.NewTableClient(*uri, httpClient)
+	}
+
+	key := statusTableKey(uri)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if client, ok := p.clients[key]; ok && client.URI().String() == uri.String() {
+		return client, nil
+	}
+	client, err := status.NewTableClient(*uri, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[key] = client
+	return client, nil
+}
+
+// writeStatus writes the record of the ingestion with the id to the status table of client.
+func (p *statusPoller) writeStatus(client *status.TableClient, id string, data map[string]interface{}) error {
+	if p == nil {
+		return client.Write(id, data)
+	}
+	return p.write(client, id, data)
+}
+
+// watch calls deliver once with the final status of the ingestion of r, starting the poller if it is not running.
+func (p *statusPoller) watch(ctx context.Context, r *Result, deliver func(StatusRecord)) {
+	w := &statusWatch{ctx: ctx, client: r.tableClient, table: statusTableKey(r.tableClient.URI()), rec: r.record, deliver: deliver}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		deliver(closedRecord(w.rec))
+		return
+	}
+	p.watches[w] = struct{}{}
+	if !p.started {
+		p.started = true
+		go p.run()
+	}
+	p.mu.Unlock()
+}
+
+// close stops the poller, delivering StatusRetrievalCanceled to all the watches that are not done.
+func (p *statusPoller) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	watches := p.watches
+	p.watches = map[*statusWatch]struct{}{}
+	p.mu.Unlock()
+
+	for w := range watches {
+		w.deliver(closedRecord(w.rec))
+	}
+}
+
+func (p *statusPoller) run() {
+	ticker := time.NewTicker(p.checkInterval)
+	defer ticker.Stop()
+
+	nextPoll := time.Now().Add(p.pollInterval)
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.cancelDone()
+			if time.Now().Before(nextPoll) {
+				continue
+			}
+			p.poll()
+			nextPoll = time.Now().Add(p.pollInterval)
+		}
+	}
+}
+
+// cancelDone delivers StatusRetrievalCanceled to the watches whose context is done.
+func (p *statusPoller) cancelDone() {
+	var canceled []*statusWatch
+	p.mu.Lock()
+	for w := range p.watches {
+		if w.ctx.Err() != nil {
+			delete(p.watches, w)
+			canceled = append(canceled, w)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, w := range canceled {
+		rec := w.rec
+		rec.Status = StatusRetrievalCanceled
+		rec.FailureStatus = Transient
+		w.deliver(rec)
+	}
+}
+
+// poll reads the status of all the watches, in batches of the watches of the same status table, and delivers the
+// ones that are final. A batch is read with the current client of its table, so that the watches of a table are read
+// together even if their Results have clients with different shared access signatures.
+func (p *statusPoller) poll() {
+	batches := map[string][]*statusWatch{}
+	clients := map[string]*status.TableClient{}
+	p.mu.Lock()
+	for w := range p.watches {
+		batches[w.table] = append(batches[w.table], w)
+		if clients[w.table] == nil {
+			clients[w.table] = w.client
+			if client, ok := p.clients[w.table]; ok {
+				clients[w.table] = client
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	for table, watches := range batches {
+		client := clients[table]
+		for len(watches) > 0 {
+			n := len(watches)
+			if n > maxStatusIDsPerQuery {
+				n = maxStatusIDsPerQuery
+			}
+			p.pollBatch(client, watches[:n])
+			watches = watches[n:]
+
+			select {
+			case <-p.done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+func (p *statusPoller) pollBatch(client *status.TableClient, watches []*statusWatch) {
+	ids := make([]string, 0, len(watches))
+	for _, w := range watches {
+		ids = append(ids, w.rec.IngestionSourceID.String())
+	}
+
+	records, err := p.read(client, ids)
+
+	var final []*statusWatch
+	p.mu.Lock()
+	for n, w := range watches {
+		if _, ok := p.watches[w]; !ok {
+			continue // Canceled or closed while reading.
+		}
+		if err != nil {
+			w.failures++
+			if w.failures < maxStatusReadFailures {
+				continue
+			}
+			w.rec.Status = StatusRetrievalFailed
+			w.rec.FailureStatus = Transient
+			w.rec.Details = "Failed reading from Status Table: " + err.Error()
+		} else {
+			w.failures = 0
+			data, ok := records[ids[n]]
+			if !ok {
+				continue
+			}
+			w.rec.FromMap(data)
+			if !w.rec.Status.IsFinal() {
+				continue
+			}
+		}
+		delete(p.watches, w)
+		final = append(final, w)
+	}
+	p.mu.Unlock()
+
+	for _, w := range final {
+		w.deliver(w.rec)
+	}
+}
+
+// closedRecord is rec delivered to a watch when the Ingestion is closed before the ingestion is done.
+func closedRecord(rec statusRecord) statusRecord {
+	rec.Status = StatusRetrievalCanceled
+	rec.FailureStatus = Transient
+	rec.Details = "the ingestion client was closed before the ingestion was done"
+	return rec
+}
+
+// StatusChan returns a channel that receives the final status of the ingestion and is then closed. It is an
+// alternative to Wait() that does not use a goroutine for each ingestion: the Ingestion the Result is from follows
+// all the watched ingestions with a single goroutine, reading the status of many of them in each query of the status
+// table. The status is only read from the service when the ReportResultToTable() option was used, otherwise the
+// current status, such as Queued, is received at once.
+//
+// When ctx is done before the ingestion is, the channel receives the status StatusRetrievalCanceled, within about a
+// second. So does it when the Ingestion is closed. The channel has room for the status, so it is never lost when it
+// is not read right away.
+func (r *Result) StatusChan(ctx context.Context) <-chan StatusRecord {
+	ch := make(chan StatusRecord, 1)
+	r.WatchStatus(ctx, func(rec StatusRecord) {
+		ch <- rec
+		close(ch)
+	})
+	return ch
+}
+
+// WatchStatus calls fn once with the final status of the ingestion, the same way that StatusChan() delivers it.
+// fn may be called before WatchStatus returns, when the status is already final. Otherwise it is called from the
+// goroutine that follows the ingestions, one after the other, so a slow fn delays the status of the other ingestions:
+// hand the status over to other goroutines when there is much to do with it.
+func (r *Result) WatchStatus(ctx context.Context, fn func(StatusRecord)) {
+	if r.journal != nil {
+		deliver := fn
+		fn = func(rec StatusRecord) {
+			r.observed(rec)
+			deliver(rec)
+		}
+	}
+	if r.record.Status.IsFinal() || !r.reportToTable || r.tableClient == nil {
+		fn(r.record)
+		return
+	}
+	if ctx.Err() != nil {
+		rec := r.record
+		rec.Status = StatusRetrievalCanceled
+		rec.FailureStatus = Transient
+		fn(rec)
+		return
+	}
+
+	if r.poller == nil {
+		// The Result is not from an Ingestion, follow it on its own like Wait() does.
+		rec := *r
+		go func() {
+			rec.poll(ctx)
+			fn(rec.record)
+		}()
+		return
+	}
+	r.poller.watch(ctx, r, fn)
+}
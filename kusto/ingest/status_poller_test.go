@@ -0,0 +1,253 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/status"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStatusTable is a status table whose records become final after they were read a number of times.
+type fakeStatusTable struct {
+	mu        sync.Mutex
+	final     map[string]StatusCode
+	reads     map[string]int
+	pending   int
+	err       error
+	queries   int
+	maxPerQry int
+	// tables are the status tables that the records were written to, by id.
+	tables map[string]string
+	// misread are the ids that were read from another table than the one they were written to.
+	misread []string
+}
+
+func newFakeStatusTable(pending int) *fakeStatusTable {
+	return &fakeStatusTable{final: map[string]StatusCode{}, reads: map[string]int{}, pending: pending, tables: map[string]string{}}
+}
+
+func (f *fakeStatusTable) write(client *status.TableClient, id string, _ map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tables[id] = statusTableKey(client.URI())
+	return nil
+}
+
+func (f *fakeStatusTable) read(client *status.TableClient, ids []string) (map[string]map[string]interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.queries++
+	if len(ids) > f.maxPerQry {
+		f.maxPerQry = len(ids)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	records := map[string]map[string]interface{}{}
+	for _, id := range ids {
+		if table, ok := f.tables[id]; ok && table != statusTableKey(client.URI()) {
+			f.misread = append(f.misread, id)
+		}
+		f.reads[id]++
+		s := Pending
+		if f.reads[id] > f.pending {
+			s = f.final[id]
+		}
+		records[id] = map[string]interface{}{"Status": string(s), "IngestionSourceId": id}
+	}
+	return records, nil
+}
+
+// testStatusTable returns the URI of the status table name, with a shared access signature sig.
+func testStatusTable(name, sig string) *resources.URI {
+	u, err := resources.ParseStatusTable("https://account.table.core.windows.net/" + name + "?sig=" + sig)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// testTableClient returns a client of the status table name, which sends no request until it is used.
+func testTableClient(name string) *status.TableClient {
+	client, err := status.NewTableClient(*testStatusTable(name, "sig"), nil)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+func testPoller(read func(*status.TableClient, []string) (map[string]map[string]interface{}, error)) *statusPoller {
+	p := newStatusPoller()
+	p.pollInterval = 5 * time.Millisecond
+	p.checkInterval = time.Millisecond
+	p.read = read
+	return p
+}
+
+func pendingResult(p *statusPoller, client *status.TableClient) *Result {
+	r := newResult()
+	r.reportToTable = true
+	r.record.Status = Pending
+	r.record.IngestionSourceID = uuid.New()
+	r.tableClient = client
+	r.poller = p
+	return r
+}
+
+// receiveOnce receives the status from ch and checks that the channel is then closed.
+func receiveOnce(t *testing.T, ch <-chan StatusRecord) StatusRecord {
+	select {
+	case rec, ok := <-ch:
+		require.True(t, ok, "the channel was closed without a status")
+		_, ok = <-ch
+		require.False(t, ok, "the channel received more than one status")
+		return rec
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "no status was received")
+	}
+	return StatusRecord{}
+}
+
+func TestStatusChanStress(t *testing.T) {
+	t.Parallel()
+
+	const count = 3000
+
+	table := newFakeStatusTable(2)
+	p := testPoller(table.read)
+	p.write = table.write
+	defer p.close()
+
+	// The results are queued to two status tables, whose shared access signature changes halfway through, as it does
+	// when the resources are fetched again.
+	tables := func(i int) func(uuid.UUID) (*resources.URI, error) {
+		return func(uuid.UUID) (*resources.URI, error) {
+			return testStatusTable(fmt.Sprintf("status%d", i%2), fmt.Sprintf("sig%d", i*2/count)), nil
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	results := make([]*Result, count)
+	chans := make([]<-chan StatusRecord, count)
+	for i := range results {
+		results[i] = newResult()
+		results[i].reportToTable = true
+		results[i].record.IngestionSourceID = uuid.New()
+		results[i].putQueued(tables(i), nil, p)
+		require.Equal(t, Pending, results[i].record.Status, results[i].record.Details)
+		id := results[i].record.IngestionSourceID.String()
+		table.mu.Lock()
+		if i%2 == 0 {
+			table.final[id] = Succeeded
+		} else {
+			table.final[id] = Failed
+		}
+		table.mu.Unlock()
+
+		watchCtx := context.Background()
+		if i%10 == 0 {
+			watchCtx = ctx
+		}
+		chans[i] = results[i].StatusChan(watchCtx)
+	}
+	cancel()
+
+	for i, ch := range chans {
+		rec := receiveOnce(t, ch)
+		assert.Equal(t, results[i].record.IngestionSourceID, rec.IngestionSourceID)
+		switch {
+		case i%10 == 0:
+			// Canceled before or after it was final.
+			assert.Contains(t, []StatusCode{StatusRetrievalCanceled, Succeeded}, rec.Status, "result %d", i)
+		case i%2 == 0:
+			assert.Equal(t, Succeeded, rec.Status, "result %d", i)
+		default:
+			assert.Equal(t, Failed, rec.Status, "result %d", i)
+		}
+	}
+
+	// The results of a table share its client until its shared access signature changes.
+	assert.Same(t, results[0].tableClient, results[2].tableClient)
+	assert.NotSame(t, results[0].tableClient, results[1].tableClient)
+	assert.NotSame(t, results[0].tableClient, results[count-2].tableClient)
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	assert.Len(t, table.tables, count)
+	assert.Empty(t, table.misread)
+	assert.LessOrEqual(t, table.maxPerQry, maxStatusIDsPerQuery)
+	assert.Less(t, table.queries, count/10, "the status of many ingestions should be read in each query")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	assert.Empty(t, p.watches)
+	assert.Len(t, p.clients, 2)
+}
+
+func TestStatusChanReadFailure(t *testing.T) {
+	t.Parallel()
+
+	table := newFakeStatusTable(0)
+	table.err = goErrors.New("table unavailable")
+	p := testPoller(table.read)
+	defer p.close()
+
+	rec := receiveOnce(t, pendingResult(p, testTableClient("status")).StatusChan(context.Background()))
+	assert.Equal(t, StatusRetrievalFailed, rec.Status)
+	assert.Equal(t, Transient, rec.FailureStatus)
+	assert.Contains(t, rec.Details, "table unavailable")
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	assert.Equal(t, maxStatusReadFailures, table.queries)
+}
+
+func TestStatusChanClose(t *testing.T) {
+	t.Parallel()
+
+	table := newFakeStatusTable(1 << 30)
+	p := testPoller(table.read)
+
+	ch := pendingResult(p, testTableClient("status")).StatusChan(context.Background())
+	var got []StatusRecord
+	pendingResult(p, testTableClient("status")).WatchStatus(context.Background(), func(rec StatusRecord) { got = append(got, rec) })
+
+	p.close()
+	assert.Equal(t, StatusRetrievalCanceled, receiveOnce(t, ch).Status)
+	require.Len(t, got, 1)
+	assert.Equal(t, StatusRetrievalCanceled, got[0].Status)
+
+	// Watching after the poller was closed is done at once.
+	ch = pendingResult(p, testTableClient("status")).StatusChan(context.Background())
+	assert.Equal(t, StatusRetrievalCanceled, receiveOnce(t, ch).Status)
+	p.close()
+}
+
+func TestStatusChanFinal(t *testing.T) {
+	t.Parallel()
+
+	p := testPoller(func(*status.TableClient, []string) (map[string]map[string]interface{}, error) {
+		t.Error("the status table should not be read")
+		return nil, nil
+	})
+	defer p.close()
+
+	queued := newResult()
+	queued.putQueued(nil, nil, p)
+	assert.Equal(t, Queued, receiveOnce(t, queued.StatusChan(context.Background())).Status)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, StatusRetrievalCanceled, receiveOnce(t, pendingResult(p, testTableClient("status")).StatusChan(ctx)).Status)
+}
@@ -0,0 +1,76 @@
+package ingest
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/status"
+	"github.com/google/uuid"
+)
+
+// statusTable returns the table that the status of the ingestion with sourceID is reported to, which is the table of
+// WithStatusTable(), or one of the status tables of the ingestion resources.
+func (i *Ingestion) statusTable(sourceID uuid.UUID) (*resources.URI, error) {
+	tables, err := i.statusTables()
+	if err != nil {
+		return nil, err
+	}
+	return pickStatusTable(tables, sourceID), nil
+}
+
+// statusTables returns the tables that the statuses of the ingestions are reported to.
+func (i *Ingestion) statusTables() ([]*resources.URI, error) {
+	if i.cfg.statusTable != "" {
+		// New() validated it.
+		u, err := resources.ParseStatusTable(i.cfg.statusTable)
+		if err != nil {
+			return nil, err
+		}
+		return []*resources.URI{u}, nil
+	}
+
+	res, err := i.mgr.Resources()
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Tables) == 0 {
+		_, cause := i.mgr.LastFetch()
+		return nil, resourcesError(cause, "status tables")
+	}
+	return res.Tables, nil
+}
+
+// pickStatusTable returns the table of tables for the ingestion with sourceID. The table only depends on sourceID
+// and the names of the tables, not on their order or their shared access signatures, which change when the
+// resources are fetched again, so that the status of an ingestion is read from the table it was written to.
+func pickStatusTable(tables []*resources.URI, sourceID uuid.UUID) *resources.URI {
+	if len(tables) == 1 {
+		return tables[0]
+	}
+
+	sorted := make([]*resources.URI, len(tables))
+	copy(sorted, tables)
+	sort.Slice(sorted, func(a, b int) bool {
+		return statusTableKey(sorted[a]) < statusTableKey(sorted[b])
+	})
+
+	h := fnv.New32a()
+	h.Write(sourceID[:])
+	return sorted[h.Sum32()%uint32(len(sorted))]
+}
+
+// statusTableKey identifies the status table u, whatever its shared access signature is.
+func statusTableKey(u *resources.URI) string {
+	return u.ServiceURL() + "/" + u.ObjectName()
+}
+
+// statusTableClient returns the client of the status table of the ingestion with sourceID, which is shared with the
+// other Results of the table.
+func (i *Ingestion) statusTableClient(sourceID uuid.UUID) (*status.TableClient, error) {
+	table, err := i.statusTable(sourceID)
+	if err != nil {
+		return nil, err
+	}
+	return i.poller.tableClient(table, i.cfg.storageHTTPClient)
+}
@@ -0,0 +1,146 @@
+package ingest
+
+import (
+	"context"
+	goErrors "errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusTable(t *testing.T) {
+	t.Parallel()
+
+	const override = "https://mine.table.core.windows.net/statuses?sv=2020&sig=secret"
+	container := resourceRow("TempStorage", "https://account.blob.core.windows.net/container?sig=s")
+	queue := resourceRow("SecuredReadyForAggregationQueue", "https://account.queue.core.windows.net/queue?sig=s")
+	clusterTable := resourceRow("IngestionsStatusTable", "https://account.table.core.windows.net/status?sig=s")
+
+	tests := []struct {
+		desc        string
+		rows        []value.Values
+		statusTable string
+		// want is the URI of the status table of the ingestions, "" if there is none.
+		want string
+	}{
+		{
+			desc: "Status table of the cluster",
+			rows: []value.Values{container, queue, clusterTable},
+			want: "https://account.table.core.windows.net/status?sig=s",
+		},
+		{
+			desc:        "Override",
+			rows:        []value.Values{container, queue, clusterTable},
+			statusTable: override,
+			want:        override,
+		},
+		{
+			desc:        "Override without status tables in the resources",
+			rows:        []value.Values{container, queue},
+			statusTable: override,
+			want:        override,
+		},
+		{
+			desc: "No status tables",
+			rows: []value.Values{container, queue},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			mgmt := &resourcesMgmt{rows: test.rows}
+			var options []Option
+			if test.statusTable != "" {
+				options = append(options, WithStatusTable(test.statusTable))
+			}
+			ingestion, err := New(mgmt.client(), "db", "table", options...)
+			require.NoError(t, err)
+			defer ingestion.Close()
+
+			// The status rows are written to the table without reaching a storage account.
+			ingestion.cfg.storageHTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusNoContent, Body: ioutil.NopCloser(strings.NewReader("")), Header: http.Header{}, Request: req}, nil
+			})}
+			var got *properties.StatusTableDescription
+			ingestion.fs = resources.FsMock{
+				OnReader: func(ctx context.Context, reader io.Reader, props properties.All) (string, error) {
+					got = props.Ingestion.TableEntryRef
+					return "blob", nil
+				},
+			}
+
+			id := uuid.New()
+			result, err := ingestion.FromReader(context.Background(), strings.NewReader("a,b"), ReportResultToTable(), SourceID(id))
+			if test.want == "" {
+				var re *ResourcesError
+				require.True(t, goErrors.As(err, &re), "got %v", err)
+				assert.Equal(t, []string{"status tables"}, re.Missing)
+
+				_, err = ingestion.statusTableClient(id)
+				assert.True(t, goErrors.As(err, &re), "the status of an ingestion cannot be read without a table")
+				return
+			}
+			require.NoError(t, err)
+
+			require.NotNil(t, got)
+			assert.Equal(t, test.want, got.TableConnectionString)
+			assert.Equal(t, id.String(), got.PartitionKey)
+			assert.NotEqual(t, StatusRetrievalFailed, result.record.Status, result.record.Details)
+
+			// The status is read from the table it was written to.
+			table, err := ingestion.statusTable(id)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, table.String())
+			diag, err := ingestion.Diagnostics(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, []string{strings.Split(test.want, "?")[0]}, diag.StatusTables)
+		})
+	}
+}
+
+func TestPickStatusTable(t *testing.T) {
+	t.Parallel()
+
+	parse := func(uris ...string) []*resources.URI {
+		var tables []*resources.URI
+		for _, uri := range uris {
+			u, err := resources.ParseStatusTable(uri)
+			require.NoError(t, err)
+			tables = append(tables, u)
+		}
+		return tables
+	}
+	tables := parse(
+		"https://account1.table.core.windows.net/status?sig=a",
+		"https://account2.table.core.windows.net/status?sig=a",
+		"https://account3.table.core.windows.net/status?sig=a",
+	)
+	// The resources fetched again list the tables in another order, with other signatures.
+	refreshed := parse(
+		"https://account3.table.core.windows.net/status?sig=b",
+		"https://account1.table.core.windows.net/status?sig=b",
+		"https://account2.table.core.windows.net/status?sig=b",
+	)
+
+	used := map[string]int{}
+	for n := 0; n < 300; n++ {
+		id := uuid.New()
+		table := pickStatusTable(tables, id)
+		used[table.Account()]++
+		assert.Equal(t, table.Account(), pickStatusTable(refreshed, id).Account(), "the table of an ingestion should not change")
+		assert.Same(t, table, pickStatusTable(tables, id))
+	}
+	assert.Len(t, used, 3, "the ingestions should be spread over the tables")
+}
@@ -0,0 +1,97 @@
+package ingest
+
+import (
+	goErrors "errors"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusRecordErr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc          string
+		status        StatusCode
+		code          string
+		failure       FailureStatusCode
+		updatePolicy  bool
+		wantKind      errors.Kind
+		wantRetryable bool
+	}{
+		{desc: "Wrong number of fields", code: "Stream_WrongNumberOfFields", failure: Permanent, wantKind: errors.KDataFormat},
+		{desc: "Closing quote missing", code: "Stream_ClosingQuoteMissing", failure: Permanent, wantKind: errors.KDataFormat},
+		{desc: "No records or wrong format", code: "BadRequest_NoRecordsOrWrongFormat", failure: Permanent, wantKind: errors.KDataFormat},
+		{desc: "Empty blob", code: "BadRequest_EmptyBlob", failure: Permanent, wantKind: errors.KDataFormat},
+		{desc: "Input stream too large", code: "Stream_InputStreamTooLarge", failure: Permanent, wantKind: errors.KPayloadTooLarge},
+		{desc: "File too large", code: "BadRequest_FileTooLarge", failure: Permanent, wantKind: errors.KPayloadTooLarge},
+		{desc: "Database does not exist", code: "BadRequest_DatabaseNotExist", failure: Permanent, wantKind: errors.KDBNotExist},
+		{desc: "Table does not exist", code: "BadRequest_EntityNotFound", failure: Permanent, wantKind: errors.KTableNotExist},
+		{desc: "Mapping not found", code: "BadRequest_MappingReferenceWasNotFound", failure: Permanent, wantKind: errors.KMappingNotExist},
+		{desc: "Invalid mapping", code: "BadRequest_InvalidMapping", failure: Permanent, wantKind: errors.KMappingInvalid},
+		{desc: "Other bad request", code: "BadRequest_SyntaxError", failure: Permanent, wantKind: errors.KClientArgs},
+		{desc: "Source not found", code: "Download_SourceNotFound", failure: Permanent, wantKind: errors.KBlobstore},
+		{desc: "Download failed transiently", code: "Download_UnknownError", failure: Transient, wantKind: errors.KBlobstore, wantRetryable: true},
+		{desc: "Internal error", code: "General_InternalServerError", failure: Transient, wantKind: errors.KInternal, wantRetryable: true},
+		{desc: "Retries exhausted", code: "General_AbandonedIngestion", failure: Exhausted, wantKind: errors.KInternal, wantRetryable: true},
+		{desc: "Throttled", code: "General_ThrottledIngestion", failure: Transient, wantKind: errors.KLimitsExceeded, wantRetryable: true},
+		{desc: "Unknown code", code: "Misc", failure: Unknown, wantKind: errors.KOther},
+		{desc: "Update policy", code: "General_InternalServerError", failure: Transient, updatePolicy: true, wantKind: errors.KUpdatePolicy},
+		{desc: "Status could not be read", status: StatusRetrievalFailed, code: unknownString, failure: Transient, wantKind: errors.KIO, wantRetryable: true},
+		{desc: "Wait for the status canceled", status: StatusRetrievalCanceled, code: unknownString, failure: Transient, wantKind: errors.KTimeout, wantRetryable: true},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			rec := newStatusRecord()
+			if test.status != "" {
+				rec.Status = test.status
+			}
+			rec.ErrorCode = test.code
+			rec.FailureStatus = test.failure
+			rec.Details = "details of the failure"
+			rec.OriginatesFromUpdatePolicy = test.updatePolicy
+
+			err := rec.Err()
+			require.Error(t, err)
+			var e *errors.Error
+			require.True(t, goErrors.As(err, &e))
+			assert.Equal(t, errors.OpFileIngest, e.Op)
+			assert.Equal(t, test.wantKind, e.Kind)
+			assert.Equal(t, test.wantRetryable, errors.Retryable(err))
+
+			var got StatusRecord
+			require.True(t, goErrors.As(err, &got), "the record should be found in the error")
+			assert.Equal(t, rec, got)
+
+			// The helpers that predate the errors find the record in them.
+			assert.True(t, IsStatusRecord(err))
+			code, cerr := GetErrorCode(err)
+			assert.NoError(t, cerr)
+			assert.Equal(t, test.code, code)
+			status, serr := GetIngestionStatus(err)
+			assert.NoError(t, serr)
+			assert.Equal(t, rec.Status, status)
+		})
+	}
+}
+
+func TestStatusRecordErrSuccess(t *testing.T) {
+	t.Parallel()
+
+	for _, status := range []StatusCode{Succeeded, Queued} {
+		rec := newStatusRecord()
+		rec.Status = status
+		assert.NoError(t, rec.Err(), status)
+	}
+	for _, status := range []StatusCode{Failed, PartiallySucceeded, Skipped} {
+		rec := newStatusRecord()
+		rec.Status = status
+		assert.Error(t, rec.Err(), status)
+	}
+}
@@ -1,10 +1,22 @@
 package ingest
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	goErrors "errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Azure/azure-kusto-go/kusto"
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/conn"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/gzip"
@@ -14,7 +26,8 @@ import (
 )
 
 type streamIngestor interface {
-	StreamIngest(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error
+	StreamIngest(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, compression properties.CompressionType, mappingName string, additional map[string]string, clientRequestId string) (conn.Response, error)
+	StreamIngestBlob(ctx context.Context, db, table string, blobURI string, format properties.DataFormat, mappingName string, additional map[string]string, clientRequestId string) (conn.Response, error)
 }
 
 // Streaming provides data ingestion from external sources into Kusto.
@@ -23,43 +36,387 @@ type Streaming struct {
 	table      string
 	client     QueryClient
 	streamConn streamIngestor
+
+	maxPayloadSize  int64
+	maxBufferedSize int64
+	chunkSize       int64
+	retry           BackoffPolicy
+	httpClient      *http.Client
+	// tracer is the kusto.Tracer of the QueryClient, see queryTracer().
+	tracer kusto.Tracer
+	// spans is set by WithStreamingSpanTracer().
+	spans SpanTracer
+	// rateLimit, rateBurst and maxInFlight are set by WithStreamingRateLimit() and WithStreamingMaxInFlight(), and
+	// limiter holds back the requests with them. A Managed client shares the limiter of its queued client.
+	rateLimit   float64
+	rateBurst   int
+	maxInFlight int
+	limiter     *limiter
+	// app and user are the application and the user for tracing of the QueryClient, see queryTracingIdentity().
+	app, user string
+	// tlsConfig is the TLS config of the QueryClient, see queryTLSConfig().
+	tlsConfig *tls.Config
+
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	timeouts            ConnectionTimeouts
+	endpoint            string
+
+	closed int32
+	// unregister stops the QueryClient from closing the client, see closeWithClient().
+	unregister func()
+	closeMu    sync.Mutex
+}
+
+var FileIsBlobErr = errors.ES(errors.OpIngestStream, errors.KClientArgs, "blobstore paths are not supported for streaming, use FromBlob()")
+
+// ClientClosedErr is returned by the methods of an Ingestion, Streaming or Managed client after Close() was called,
+// or after the kusto.Client it was made from was closed.
+var ClientClosedErr = errors.ES(errors.OpIngestStream, errors.KClientArgs, "the ingestion client is closed").SetNoRetry()
+
+// StreamingOption is an optional argument to NewStreaming(). The values set by options are validated by NewStreaming().
+type StreamingOption func(s *Streaming)
+
+// WithStreamingSizeLimit sets the largest payload, after compression, that the client sends, for clusters where the
+// streaming ingestion limit was raised. 0 keeps the default of 4 MiB. Sending stops as soon as a payload goes over
+// the limit, and the ingestion fails with an error of Kind errors.KPayloadTooLarge.
+func WithStreamingSizeLimit(size int64) StreamingOption {
+	return func(s *Streaming) {
+		s.maxPayloadSize = size
+	}
+}
+
+// WithBufferedCompression sets the largest source, before compression, that FromFile() and FromReader() compress in
+// memory before sending it, when the size of the source is known, such as for a file or a *bytes.Reader. The request
+// then has a Content-Length header instead of being sent with chunked transfer encoding, which some proxies refuse.
+// A larger source is compressed as it is sent, in a chunked request. Sources that are compressed already, and
+// whose size is known, are always sent with a Content-Length. The default is 4 MiB, and a negative size never
+// compresses in memory.
+func WithBufferedCompression(size int64) StreamingOption {
+	return func(s *Streaming) {
+		s.maxBufferedSize = size
+	}
+}
+
+// WithAutoChunking makes FromFile() and FromReader() split payloads on record boundaries into chunks that are at most
+// maxCompressedBytes once compressed, and stream the chunks one after the other. This is supported for the delimited
+// text formats, JSON and MultiJSON, and for uncompressed sources only. The Result then lists the Result of each
+// chunk in Result.Chunks(). If a chunk fails, the chunks before it were ingested. A record over maxCompressedBytes by
+// itself fails with an error of Kind errors.KPayloadTooLarge that gives its position.
+func WithAutoChunking(maxCompressedBytes int64) StreamingOption {
+	return func(s *Streaming) {
+		s.chunkSize = maxCompressedBytes
+	}
+}
+
+// WithStreamingRetries makes the client retry a streaming ingestion that fails with a transient error: a response of
+// 429, 502, 503 or 504, or a network failure. It makes at most maxAttempts attempts, and gives up once maxElapsed has
+// passed if it is not 0. A maxAttempts of 0 is no limit other than maxElapsed. The wait between attempts grows
+// exponentially with jitter, unless the service asks for a wait with a Retry-After header. Other errors, such as a 400
+// or a 403, are returned right away. See WithStreamingRetryPolicy() to set the waits too.
+// The payload of a reader can only be read once, so the compressed payload is buffered in memory to be sent again.
+// It is at most the streaming size limit.
+func WithStreamingRetries(maxAttempts int, maxElapsed time.Duration) StreamingOption {
+	return func(s *Streaming) {
+		s.retry.MaxAttempts = maxAttempts
+		s.retry.MaxElapsed = maxElapsed
+	}
+}
+
+// WithStreamingRetryPolicy makes the client retry a streaming ingestion that fails with a transient error with
+// policy, like WithStreamingRetries() does with the default waits. The zero BackoffPolicy does not retry, which is
+// the default.
+func WithStreamingRetryPolicy(policy BackoffPolicy) StreamingOption {
+	return func(s *Streaming) {
+		s.retry = policy
+	}
+}
+
+// WithHTTPClient makes the client send streaming ingestion requests with client, such as to go through a proxy, use
+// custom TLS settings or tune the connection pool. The timeout of client applies to each request. By default, the
+// requests are sent with the client of the QueryClient if it was made with kusto.WithHTTPClient(), unless
+// WithConnectionLimits() or WithConnectionTimeouts() are passed.
+func WithHTTPClient(client *http.Client) StreamingOption {
+	return func(s *Streaming) {
+		s.httpClient = client
+	}
+}
+
+// WithConnectionLimits sets how many idle connections to the service the client keeps for reuse, and how many
+// connections it opens at most, for clients used by many goroutines at once. 0 keeps the defaults of 100 idle
+// connections and no limit on open connections. Once maxConnsPerHost connections are open, requests wait for one of
+// them. It cannot be used with WithHTTPClient(), whose transport sets its own limits.
+func WithConnectionLimits(maxIdleConnsPerHost, maxConnsPerHost int) StreamingOption {
+	return func(s *Streaming) {
+		s.maxIdleConnsPerHost = maxIdleConnsPerHost
+		s.maxConnsPerHost = maxConnsPerHost
+	}
 }
 
-var FileIsBlobErr = errors.ES(errors.OpIngestStream, errors.KClientArgs, "blobstore paths are not supported for streaming")
+// ConnectionTimeouts are the timeouts of the connections that streaming ingestion opens to the service. A field left
+// at 0 keeps its default.
+// Before these defaults, a request whose connection stopped answering waited for as long as its context allowed, with
+// no limit for a context without a deadline. It now fails once ResponseHeader has passed, which must be raised for
+// ingestions that the service may take longer than 5 minutes to answer.
+type ConnectionTimeouts struct {
+	// Dial is how long opening a connection can take. The default is 30 seconds.
+	Dial time.Duration
+	// TLSHandshake is how long the TLS handshake of a new connection can take. The default is 10 seconds.
+	TLSHandshake time.Duration
+	// ResponseHeader is how long the service can take to answer once a request was sent. The default is 5 minutes.
+	ResponseHeader time.Duration
+	// IdleConn is how long an idle connection is kept for reuse. The default is 90 seconds.
+	IdleConn time.Duration
+}
+
+// validate checks the timeouts set by option, which is named in the error.
+func (t ConnectionTimeouts) validate(op errors.Op, option string) error {
+	if t.Dial < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.IdleConn < 0 {
+		return errors.ES(op, errors.KClientArgs, "%s(%+v): timeouts cannot be negative", option, t).SetNoRetry()
+	}
+	return nil
+}
+
+func (t ConnectionTimeouts) conn() conn.Timeouts {
+	return conn.Timeouts{Dial: t.Dial, TLSHandshake: t.TLSHandshake, ResponseHeader: t.ResponseHeader, IdleConn: t.IdleConn}
+}
+
+// WithConnectionTimeouts sets the timeouts of the connections to the service. It cannot be used with
+// WithHTTPClient(), whose transport sets its own timeouts.
+func WithConnectionTimeouts(timeouts ConnectionTimeouts) StreamingOption {
+	return func(s *Streaming) {
+		s.timeouts = timeouts
+	}
+}
+
+// WithEndpoint makes the client send streaming ingestion requests to endpoint, an absolute https URL, for when the
+// engine of the cluster is not reached at the endpoint of the QueryClient, as can be the case with Private Link.
+// Without it, the requests go to the endpoint of the QueryClient, without the "ingest-" prefix of the Data Management
+// endpoint if it has one.
+func WithEndpoint(endpoint string) StreamingOption {
+	return func(s *Streaming) {
+		s.endpoint = endpoint
+	}
+}
+
+// WithStreamingSpanTracer makes the client start a span with tracer around each streaming ingestion request, see
+// SpanTracer.
+func WithStreamingSpanTracer(tracer SpanTracer) StreamingOption {
+	return func(s *Streaming) {
+		s.spans = tracer
+	}
+}
+
+// WithStreamingRateLimit makes the client send at most opsPerSecond streaming ingestion requests per second, burst of
+// which can be sent at once. Each attempt of a request that is retried counts, as does each chunk of
+// WithAutoChunking(). Requests over the limit wait for their turn, or fail with the error of their context when it is
+// done first. The limit is shared by all the goroutines that use the client. There is no limit by default.
+func WithStreamingRateLimit(opsPerSecond float64, burst int) StreamingOption {
+	return func(s *Streaming) {
+		s.rateLimit = opsPerSecond
+		s.rateBurst = burst
+	}
+}
+
+// WithStreamingMaxInFlight makes the client send at most n streaming ingestion requests at once, see
+// WithStreamingRateLimit(). Requests over the limit wait for one to be done. There is no limit by default.
+func WithStreamingMaxInFlight(n int) StreamingOption {
+	return func(s *Streaming) {
+		s.maxInFlight = n
+	}
+}
+
+// withLimiter makes the client share l, the limiter of the queued client of a Managed client.
+func withLimiter(l *limiter) StreamingOption {
+	return func(s *Streaming) {
+		s.limiter = l
+	}
+}
+
+// validateStreamingEndpoint checks an endpoint set by option, which is named in the error.
+func validateStreamingEndpoint(op errors.Op, option, endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || !u.IsAbs() || u.Scheme != "https" || u.Host == "" {
+		return errors.ES(op, errors.KClientArgs, "%s(%q): must be an absolute https URL", option, endpoint).SetNoRetry()
+	}
+	return nil
+}
+
+// connOptions returns the options for the connection to the service.
+func (i *Streaming) connOptions() []conn.Option {
+	options := []conn.Option{
+		conn.WithHTTPClient(i.httpClient),
+		conn.WithConnectionLimits(i.maxIdleConnsPerHost, i.maxConnsPerHost),
+		conn.WithTimeouts(i.timeouts.conn()),
+		conn.WithTracer(i.tracer),
+		conn.WithSpanTracer(i.spans),
+		conn.WithTracingIdentity(i.app, i.user),
+		conn.WithTLSConfig(i.tlsConfig),
+	}
+	if i.endpoint != "" {
+		options = append(options, conn.WithEndpoint(i.endpoint))
+	}
+	return options
+}
 
 // NewStreaming is the constructor for Streaming.
 // More information can be found here:
 // https://docs.microsoft.com/en-us/azure/kusto/management/create-ingestion-mapping-command
-func NewStreaming(client QueryClient, db, table string) (*Streaming, error) {
-	streamConn, err := conn.New(client.Endpoint(), client.Auth())
-	if err != nil {
+func NewStreaming(client QueryClient, db, table string, options ...StreamingOption) (*Streaming, error) {
+	i := &Streaming{
+		db:     db,
+		table:  table,
+		client: client,
+		retry:  defaultStreamingRetry,
+	}
+
+	for _, option := range options {
+		option(i)
+	}
+	if i.maxPayloadSize < 0 {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "WithStreamingSizeLimit(%d): size cannot be negative", i.maxPayloadSize).SetNoRetry()
+	}
+	if i.retry.MaxAttempts < 0 || i.retry.MaxElapsed < 0 {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "WithStreamingRetries(%d, %s): arguments cannot be negative", i.retry.MaxAttempts, i.retry.MaxElapsed).SetNoRetry()
+	}
+	if err := i.retry.Validate(); err != nil {
+		return nil, errors.E(errors.OpIngestStream, errors.KClientArgs, fmt.Errorf("WithStreamingRetryPolicy(): %w", err)).SetNoRetry()
+	}
+	if i.chunkSize < 0 || (i.maxPayloadSize > 0 && i.chunkSize > i.maxPayloadSize) {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "WithAutoChunking(%d): size cannot be negative or over the streaming size limit", i.chunkSize).SetNoRetry()
+	}
+
+	if i.maxIdleConnsPerHost < 0 || i.maxConnsPerHost < 0 {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "WithConnectionLimits(%d, %d): limits cannot be negative", i.maxIdleConnsPerHost, i.maxConnsPerHost).SetNoRetry()
+	}
+	if i.httpClient != nil && (i.maxIdleConnsPerHost > 0 || i.maxConnsPerHost > 0) {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "WithConnectionLimits() cannot be used with WithHTTPClient(), set the limits on the transport of the client").SetNoRetry()
+	}
+	if err := i.timeouts.validate(errors.OpIngestStream, "WithConnectionTimeouts"); err != nil {
 		return nil, err
 	}
+	if i.httpClient != nil && i.timeouts != (ConnectionTimeouts{}) {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "WithConnectionTimeouts() cannot be used with WithHTTPClient(), set the timeouts on the client").SetNoRetry()
+	}
 
-	i := &Streaming{
-		db:         db,
-		table:      table,
-		client:     client,
-		streamConn: streamConn,
+	if err := validateStreamingEndpoint(errors.OpIngestStream, "WithEndpoint", i.endpoint); err != nil {
+		return nil, err
 	}
+	if err := validateLimits(errors.OpIngestStream, "WithStreamingRateLimit", "WithStreamingMaxInFlight", i.rateLimit, i.rateBurst, i.maxInFlight); err != nil {
+		return nil, err
+	}
+	if i.limiter == nil {
+		i.limiter = newLimiter(i.rateLimit, i.rateBurst, i.maxInFlight)
+	}
+
+	if i.httpClient == nil && i.maxIdleConnsPerHost == 0 && i.maxConnsPerHost == 0 && i.timeouts == (ConnectionTimeouts{}) {
+		i.httpClient = queryHTTPClient(client)
+	}
+	i.tracer = queryTracer(client)
+	i.app, i.user = queryTracingIdentity(client)
+	i.tlsConfig = queryTLSConfig(client)
+
+	streamConn, err := conn.New(client.Endpoint(), client.Auth(), i.connOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	i.streamConn = streamConn
+
+	unregister := closeWithClient(client, func() { i.Close() })
+	i.closeMu.Lock()
+	i.unregister = unregister
+	i.closeMu.Unlock()
 
 	return i, nil
 }
 
 // FromFile allows uploading a data file for Kusto from either a local path or a blobstore URI path.
-// This method is thread-safe.
+// The format of the data is detected from the extension of the file name, such as ".json" or ".csv.gz", unless it is
+// set with the FileFormat() option. A *FormatError is returned if it is neither. This method is thread-safe.
 func (i *Streaming) FromFile(ctx context.Context, fPath string, options ...FileOption) (*Result, error) {
+	if i.isClosed() {
+		return nil, ClientClosedErr
+	}
 	props := i.newProp()
 	file, err := prepFileAndProps(fPath, &props, options, StreamingClient)
 	if err != nil {
 		return nil, err
 	}
 
-	return streamImpl(i.streamConn, ctx, file, props)
+	return i.stream(ctx, file, props)
+}
+
+// FromBlob streams the blob at blobURI, which the service reads itself instead of the client sending the data. This
+// suits small blobs that are already in storage, as the data does not go through the ingestion queues. blobURI must
+// give the service access to the blob, with a SAS token or the ";impersonate" suffix. The streaming size limit
+// applies to the blob. This method is thread-safe.
+func (i *Streaming) FromBlob(ctx context.Context, blobURI string, options ...FileOption) (*Result, error) {
+	if i.isClosed() {
+		return nil, ClientClosedErr
+	}
+	u, err := validateStreamBlobURI(blobURI)
+	if err != nil {
+		return nil, err
+	}
+
+	props := i.newProp()
+	for _, option := range options {
+		if err := option.Run(&props, StreamingClient, FromBlob); err != nil {
+			return nil, err
+		}
+	}
+	if err := queued.CompleteFormatFromFileName(&props, u.Path); err != nil {
+		return nil, err
+	}
+	queued.DiscoverCompression(&props, u.Path)
+	if err := validateStreamMapping(props); err != nil {
+		return nil, err
+	}
+	if err := validateStreamFormat(props); err != nil {
+		return nil, err
+	}
+	defaultClientRequestId(&props)
+
+	resp, err := i.conn().StreamIngestBlob(ctx, props.Ingestion.DatabaseName, props.Ingestion.TableName, blobURI, props.Ingestion.Additional.Format,
+		props.Ingestion.Additional.IngestionMappingRef, props.Ingestion.Additional.Extra, props.Streaming.ClientRequestId)
+	if err != nil {
+		e, ok := err.(*errors.Error)
+		if !ok {
+			return nil, errors.E(errors.OpIngestStream, errors.KClientArgs, err)
+		}
+		if e.StatusCode() == http.StatusRequestEntityTooLarge {
+			return nil, errors.W(e, errors.ES(errors.OpIngestStream, errors.KPayloadTooLarge, "blob %s is larger than the streaming ingestion limit", u.Host+u.Path).SetNoRetry())
+		}
+		return nil, classifyStreamErr(e, props)
+	}
+
+	result := newResult()
+	result.putProps(props)
+	// The service reads the blob as it is.
+	result.compression = props.Source.Compression
+	result.putResponse(props.Streaming.ClientRequestId, resp)
+	result.method = StreamingIngestion
+	result.record.Status = "Success"
+	return result, nil
+}
+
+// validateStreamBlobURI checks that blobURI is an https URL that carries the access the service needs to read it.
+func validateStreamBlobURI(blobURI string) (*url.URL, error) {
+	u, err := url.Parse(blobURI)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "FromBlob(): %q is not an https blob URI", blobURI).SetNoRetry()
+	}
+	if u.Query().Get("sig") == "" && !strings.HasSuffix(blobURI, ";impersonate") {
+		return nil, errors.ES(errors.OpIngestStream, errors.KClientArgs, "FromBlob(): the blob URI needs a SAS token or the \";impersonate\" suffix for the service to read it").SetNoRetry()
+	}
+	return u, nil
 }
 
 func prepFileAndProps(fPath string, props *properties.All, options []FileOption, client ClientScope) (*os.File, error) {
-	local, err := queued.IsLocalPath(fPath)
+	path, local, err := queued.LocalPath(fPath)
 	if err != nil {
 		return nil, err
 	}
@@ -75,19 +432,20 @@ func prepFileAndProps(fPath string, props *properties.All, options []FileOption,
 		return nil, FileIsBlobErr
 	}
 
-	props.Source.OriginalSource = fPath
+	props.Source.OriginalSource = path
+	queued.DiscoverCompression(props, path)
 
-	compression := queued.CompressionDiscovery(fPath)
-	if compression != properties.CTNone {
-		props.Source.DontCompress = true
+	if client == StreamingClient && props.Ingestion.Additional.Format == DFUnknown && properties.DataFormatDiscovery(path) == DFUnknown {
+		// The queued and managed clients fall back to CSV, which the service ingests, while a stream of another format
+		// fails with a parse error of the engine.
+		return nil, formatError(FromFile, path)
 	}
-
-	err = queued.CompleteFormatFromFileName(props, fPath)
+	err = queued.CompleteFormatFromFileName(props, path)
 	if err != nil {
 		return nil, err
 	}
 
-	file, err := os.Open(fPath)
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -96,8 +454,12 @@ func prepFileAndProps(fPath string, props *properties.All, options []FileOption,
 
 // FromReader allows uploading a data file for Kusto from an io.Reader. The content is uploaded to Blobstore and
 // ingested after all data in the reader is processed. Content should not use compression as the content will be
-// compressed with gzip. This method is thread-safe.
+// compressed with gzip. The format of the data must be set with the FileFormat() option, as a reader has no name to
+// detect it from, or a *FormatError is returned. This method is thread-safe.
 func (i *Streaming) FromReader(ctx context.Context, reader io.Reader, options ...FileOption) (*Result, error) {
+	if i.isClosed() {
+		return nil, ClientClosedErr
+	}
 	props := i.newProp()
 
 	for _, prop := range options {
@@ -106,27 +468,129 @@ func (i *Streaming) FromReader(ctx context.Context, reader io.Reader, options ..
 			return nil, err
 		}
 	}
+	if props.Ingestion.Additional.Format == DFUnknown {
+		return nil, formatError(FromReader, "")
+	}
 
-	return streamImpl(i.streamConn, ctx, reader, props)
+	return i.stream(ctx, reader, props)
+}
+
+// Close closes the idle connections of the HTTP client that the requests are sent with, which is the one set with
+// WithHTTPClient() if any. Ingestions in flight finish, but later calls fail with ClientClosedErr. Close can be called
+// more than once. The client is closed with the kusto.Client it was made from.
+func (i *Streaming) Close() error {
+	if !atomic.CompareAndSwapInt32(&i.closed, 0, 1) {
+		return nil
+	}
+	i.closeMu.Lock()
+	if i.unregister != nil {
+		i.unregister()
+	}
+	i.closeMu.Unlock()
+	if c, ok := i.streamConn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// conn returns the connection that the requests are sent with, held back by the limiter of the client.
+func (i *Streaming) conn() streamIngestor {
+	return limitConn(i.streamConn, i.limiter, i.spans)
+}
+
+func (i *Streaming) isClosed() bool {
+	return atomic.LoadInt32(&i.closed) == 1
+}
+
+// send streams payload in a single request, retrying it if WithStreamingRetries() or WithStreamingRetryPolicy() was
+// set.
+func (i *Streaming) send(ctx context.Context, payload io.Reader, props properties.All) (*Result, error) {
+	if !i.retry.Retries() {
+		return streamImpl(i.conn(), ctx, payload, props)
+	}
+	return streamWithRetry(i.conn(), ctx, payload, props, i.retry)
+}
+
+// stream streams payload, in chunks if WithAutoChunking() was set.
+func (i *Streaming) stream(ctx context.Context, payload io.Reader, props properties.All) (*Result, error) {
+	if err := validateStreamMapping(props); err != nil {
+		return nil, err
+	}
+	if err := validateStreamCompression(props); err != nil {
+		return nil, err
+	}
+	if err := validateStreamFormat(props); err != nil {
+		return nil, err
+	}
+	if i.chunkSize == 0 {
+		return i.send(ctx, payload, props)
+	}
+	return streamChunks(i.send, ctx, payload, props, i.chunkSize)
 }
 
 func streamImpl(c streamIngestor, ctx context.Context, payload io.Reader, props properties.All) (*Result, error) {
-	compress := !props.Source.DontCompress
-	if compress {
-		payload = gzip.Compress(payload)
+	limit := props.Streaming.MaxPayloadSize
+	if limit == 0 {
+		limit = maxStreamingSize
+	}
+	buffered := props.Streaming.MaxBufferedSize
+	if buffered == 0 {
+		buffered = maxStreamingSize
+	}
+
+	size, known := sourceSize(payload)
+	counts := &properties.ByteCounts{}
+	payload = counts.CountRead(payload)
+
+	switch {
+	case !props.ShouldCompress():
+	case known && size <= buffered:
+		// Compressing first gives the size of the request.
+		compressed, err := ioutil.ReadAll(gzip.CompressLevel(payload, props.Source.GzipLevel()))
+		if err != nil {
+			return nil, errors.E(errors.OpIngestStream, errors.KIO, err)
+		}
+		payload, size = bytes.NewReader(compressed), int64(len(compressed))
+	default:
+		zr := gzip.CompressLevel(payload, props.Source.GzipLevel())
+		defer zr.Close()
+		payload = zr
+		known = false
+	}
+	if known && size > limit {
+		return nil, payloadTooLargeErr(limit)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var limited *limitedReader
+	if compressed, ok := payload.(*bytes.Reader); ok {
+		// The compressed data is within the limit, and is sent as it is for StreamIngest() to be able to send it again,
+		// such as with a new token after the service rejected the one it was sent with.
+		payload = conn.Sized(compressed, size)
+	} else {
+		limited = &limitedReader{r: payload, limit: limit, cancel: cancel}
+		payload = counts.CountUploaded(limited)
+		if known {
+			payload = conn.Sized(payload, size)
+		}
 	}
 
 	if props.Ingestion.Additional.Format == DFUnknown {
 		props.Ingestion.Additional.Format = CSV
 	}
+	defaultClientRequestId(&props)
 
-	err := c.StreamIngest(ctx, props.Ingestion.DatabaseName, props.Ingestion.TableName, payload, props.Ingestion.Additional.Format,
-		props.Ingestion.Additional.IngestionMappingRef,
+	resp, err := c.StreamIngest(ctx, props.Ingestion.DatabaseName, props.Ingestion.TableName, payload, props.Ingestion.Additional.Format,
+		props.SentCompression(), props.Ingestion.Additional.IngestionMappingRef, props.Ingestion.Additional.Extra,
 		props.Streaming.ClientRequestId)
 
+	if limited != nil && limited.exceeded() {
+		return nil, payloadTooLargeErr(limit)
+	}
 	if err != nil {
 		if e, ok := err.(*errors.Error); ok {
-			return nil, e
+			return nil, classifyStreamErr(e, props)
 		}
 		return nil, errors.E(errors.OpIngestStream, errors.KClientArgs, err)
 	}
@@ -136,13 +600,118 @@ func streamImpl(c streamIngestor, ctx context.Context, payload io.Reader, props
 		return nil, err
 	}
 
+	if limited == nil {
+		counts.Add(0, size)
+	}
 	result := newResult()
 	result.putProps(props)
+	result.putCounts(counts)
+	result.putResponse(props.Streaming.ClientRequestId, resp)
+	result.method = StreamingIngestion
 	result.record.Status = "Success"
 
 	return result, nil
 }
 
+// validateStreamMapping checks that the mapping of a streaming ingestion suits its format, as the service only reports
+// a mismatch once the data is processed. JSON and Avro data can only be streamed with a reference to a mapping.
+func validateStreamMapping(props properties.All) error {
+	a := props.Ingestion.Additional
+	if a.IngestionMappingRef == "" && a.Format.RequiresStreamingMapping() {
+		return errors.ES(
+			errors.OpIngestStream,
+			errors.KMappingInvalid,
+			"streaming data of format %s needs a reference to an ingestion mapping of kind %s, set it with IngestionMappingRef()", a.Format.CamelCase(), a.Format.MappingKind().CamelCase(),
+		).SetNoRetry()
+	}
+	return checkMappingKind(errors.OpIngestStream, a.Format, a.IngestionMappingType)
+}
+
+// validateStreamCompression checks that the source of a streaming ingestion is not a zip archive, as the service only
+// takes gzip data.
+func validateStreamCompression(props properties.All) error {
+	if props.Source.Compression == properties.ZIP {
+		return errors.ES(errors.OpIngestStream, errors.KClientArgs, "zip data cannot be streamed, only data compressed with gzip, use queued ingestion instead").SetNoRetry()
+	}
+	return nil
+}
+
+// validateStreamFormat checks that the service takes data of the format of a streaming ingestion, as some formats
+// can only be queued.
+// FormatError is the error of a streaming ingestion whose data format was not set with the FileFormat() option and
+// could not be detected from the extension of the file name, such as "data.json" or "data.csv.gz". It is wrapped in an
+// *errors.Error of Kind errors.KClientArgs and can be found with errors.As().
+type FormatError struct {
+	// Source is the ingestion method, FromFile or FromReader.
+	Source SourceScope
+	// Name is the name of the file, "" for FromReader().
+	Name string
+}
+
+// Error implements error.
+func (e *FormatError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("%s(): the format of the data must be set with the FileFormat() option, as it cannot be detected without a file name", e.Source)
+	}
+	return fmt.Sprintf("%s(): the format of the data of %q could not be detected from its extension, set it with the FileFormat() option", e.Source, e.Name)
+}
+
+// formatError returns the error of the ingestion from source, of the file name, whose format is not known.
+func formatError(source SourceScope, name string) error {
+	return errors.E(errors.OpIngestStream, errors.KClientArgs, &FormatError{Source: source, Name: name}).SetNoRetry()
+}
+
+func validateStreamFormat(props properties.All) error {
+	if f := props.Ingestion.Additional.Format; !f.IsStreamable() {
+		return errors.ES(errors.OpIngestStream, errors.KClientArgs, "data of format %s cannot be streamed, use queued ingestion instead", f.CamelCase()).SetNoRetry()
+	}
+	return nil
+}
+
+// classifyStreamErr wraps e in an error of Kind errors.KStreamingPolicyDisabled if the service refused the ingestion
+// because streaming ingestion is not enabled, and returns e otherwise.
+func classifyStreamErr(e *errors.Error, props properties.All) error {
+	switch {
+	case isStreamingDisabled(e):
+		return errors.W(e, errors.ES(
+			errors.OpIngestStream,
+			errors.KStreamingPolicyDisabled,
+			"streaming ingestion is not enabled on table %q of database %q, enable it with \".alter table %s policy streamingingestion enable\" or use queued ingestion",
+			props.Ingestion.TableName, props.Ingestion.DatabaseName, quoteName(props.Ingestion.TableName),
+		).SetNoRetry())
+	case isStreamingUnsupported(e):
+		return errors.W(e, errors.ES(
+			errors.OpIngestStream,
+			errors.KStreamingPolicyDisabled,
+			"streaming ingestion is not enabled on the cluster, enable it in the cluster configuration or use queued ingestion",
+		).SetNoRetry())
+	}
+	return e
+}
+
+// isStreamingDisabled reports if err is the service refusing a streaming ingestion because the streaming ingestion
+// policy is not enabled on the table or database. Retrying will not help, but queued ingestion will succeed.
+func isStreamingDisabled(err error) bool {
+	var e *errors.Error
+	if goErrors.As(err, &e) && e.Kind == errors.KStreamingPolicyDisabled {
+		return true
+	}
+	return hasErrorCode(err, "StreamingIngestionPolicyNotEnabled")
+}
+
+// isStreamingUnsupported reports if err is the service refusing a streaming ingestion because streaming ingestion is
+// disabled on the cluster.
+func isStreamingUnsupported(err error) bool {
+	return hasErrorCode(err, "StreamingIngestionDisabledForCluster")
+}
+
+// defaultClientRequestId sets the client request id of the ingestion to one of the canonical form if none was set.
+func defaultClientRequestId(props *properties.All) {
+	if props.Streaming.ClientRequestId == "" {
+		props.Streaming.ClientRequestId = "KGC.executeStreaming;" + uuid.New().String()
+	}
+}
+
 func (i *Streaming) newProp() properties.All {
 	return properties.All{
 		Ingestion: properties.Ingestion{
@@ -151,6 +720,63 @@ func (i *Streaming) newProp() properties.All {
 		},
 		Streaming: properties.Streaming{
 			ClientRequestId: "KGC.executeStreaming;" + uuid.New().String(),
+			MaxPayloadSize:  i.maxPayloadSize,
+			MaxBufferedSize: i.maxBufferedSize,
 		},
 	}
 }
+
+// sourceSize returns the number of bytes left to read from payload, if that is known: for a reader with a Len()
+// method, such as a *bytes.Reader, and for a regular file.
+func sourceSize(payload io.Reader) (int64, bool) {
+	switch p := payload.(type) {
+	case interface{ Len() int }:
+		return int64(p.Len()), true
+	case *os.File:
+		info, err := p.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, false
+		}
+		offset, err := p.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		return info.Size() - offset, true
+	}
+	return 0, false
+}
+
+// payloadTooLargeErr is the error returned when a streaming payload goes over limit.
+func payloadTooLargeErr(limit int64) error {
+	return errors.ES(
+		errors.OpIngestStream,
+		errors.KPayloadTooLarge,
+		"the payload is larger than the streaming ingestion limit of %d bytes after compression, use queued ingestion instead", limit,
+	).SetNoRetry()
+}
+
+// limitedReader fails reads once more than limit bytes were read, and cancels the request sending them so
+// that the upload stops right away.
+type limitedReader struct {
+	r      io.Reader
+	limit  int64
+	n      int64
+	cancel context.CancelFunc
+	over   int32
+}
+
+// Read implements io.Reader.
+func (l *limitedReader) Read(b []byte) (int, error) {
+	n, err := l.r.Read(b)
+	l.n += int64(n)
+	if l.n > l.limit {
+		atomic.StoreInt32(&l.over, 1)
+		l.cancel()
+		return 0, payloadTooLargeErr(l.limit)
+	}
+	return n, err
+}
+
+func (l *limitedReader) exceeded() bool {
+	return atomic.LoadInt32(&l.over) == 1
+}
@@ -2,18 +2,32 @@ package ingest
 
 import (
 	"bytes"
+	stdgzip "compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	goErrors "errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto"
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/conn"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/gzip"
 	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -24,11 +38,29 @@ type testStreamIngestFunc func(t *testing.T, ctx context.Context, db, table stri
 	clientRequestId string) error
 
 type fakeStreamIngestor struct {
-	onStreamIngest streamIngestFunc
+	onStreamIngest     streamIngestFunc
+	onStreamIngestBlob func(ctx context.Context, db, table string, blobURI string, format properties.DataFormat, mappingName string, clientRequestId string) error
+	// onAdditional, if set, gets the additional query parameters of each request.
+	onAdditional func(additional map[string]string)
+	// onCompression, if set, gets the compression of the payload of each request.
+	onCompression func(compression properties.CompressionType)
 }
 
-func (f fakeStreamIngestor) StreamIngest(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
-	return f.onStreamIngest(ctx, db, table, payload, format, mappingName, clientRequestId)
+func (f fakeStreamIngestor) StreamIngest(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, compression properties.CompressionType, mappingName string, additional map[string]string, clientRequestId string) (conn.Response, error) {
+	if f.onAdditional != nil {
+		f.onAdditional(additional)
+	}
+	if f.onCompression != nil {
+		f.onCompression(compression)
+	}
+	return conn.Response{ActivityID: "activity", StatusCode: 200, Elapsed: time.Millisecond}, f.onStreamIngest(ctx, db, table, payload, format, mappingName, clientRequestId)
+}
+
+func (f fakeStreamIngestor) StreamIngestBlob(ctx context.Context, db, table string, blobURI string, format properties.DataFormat, mappingName string, additional map[string]string, clientRequestId string) (conn.Response, error) {
+	if f.onAdditional != nil {
+		f.onAdditional(additional)
+	}
+	return conn.Response{ActivityID: "activity", StatusCode: 200, Elapsed: time.Millisecond}, f.onStreamIngestBlob(ctx, db, table, blobURI, format, mappingName, clientRequestId)
 }
 
 func bigCsvFileAndReader() (string, *bytes.Reader) {
@@ -137,6 +169,7 @@ func TestStreaming(t *testing.T) {
 			name: "TestStreamingWithFormat",
 			options: []FileOption{
 				FileFormat(properties.JSON),
+				IngestionMappingRef("mapping", properties.JSON),
 			},
 			onStreamIngest: func(t *testing.T, ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string,
 				clientRequestId string) error {
@@ -146,7 +179,7 @@ func TestStreaming(t *testing.T) {
 				assert.NoError(t, err)
 				assert.Equal(t, compressedBytes, payloadBytes)
 				assert.Equal(t, properties.JSON, format)
-				assert.Equal(t, "", mappingName)
+				assert.Equal(t, "mapping", mappingName)
 				parts := strings.Split(clientRequestId, ";")
 				assert.Equal(t, "KGC.executeStreaming", parts[0])
 				_, err = uuid.Parse(parts[1])
@@ -174,7 +207,7 @@ func TestStreaming(t *testing.T) {
 		},
 		{
 			name:    "TestStreamFailure",
-			options: []FileOption{},
+			options: []FileOption{FileFormat(CSV)},
 			onStreamIngest: func(t *testing.T, ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string,
 				clientRequestId string) error {
 				return errors.E(errors.OpIngestStream, errors.KHTTPError, fmt.Errorf("error"))
@@ -207,7 +240,8 @@ func TestStreaming(t *testing.T) {
 				assert.Equal(t, result.record.Status, StatusCode("Success"))
 			}
 
-			result, err = streaming.FromReader(ctx, bytes.NewReader(data), test.options...)
+			// A reader has no name to detect the format from, so it is set, to the one of the file unless the options do.
+			result, err = streaming.FromReader(ctx, bytes.NewReader(data), append([]FileOption{FileFormat(CSV)}, test.options...)...)
 			if test.expectedError != nil {
 				assert.Equal(t, test.expectedError, err)
 				assert.Nil(t, result)
@@ -220,3 +254,1080 @@ func TestStreaming(t *testing.T) {
 	}
 
 }
+
+func TestStreamingByteCounts(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(strings.Repeat("a,b,c\n", 1000))
+
+	for _, dontCompress := range []bool{false, true} {
+		sent := &bytes.Buffer{}
+		streaming := Streaming{
+			db:    "db",
+			table: "table",
+			streamConn: fakeStreamIngestor{
+				onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+					_, err := io.Copy(sent, payload)
+					return err
+				},
+			},
+		}
+
+		options := []FileOption{FileFormat(CSV)}
+		if dontCompress {
+			options = append(options, DontCompress())
+		}
+
+		result, err := streaming.FromReader(context.Background(), bytes.NewReader(data), options...)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), result.BytesRead())
+		assert.Equal(t, int64(sent.Len()), result.BytesUploaded())
+		if dontCompress {
+			assert.Equal(t, result.BytesRead(), result.BytesUploaded())
+		} else {
+			assert.Less(t, result.BytesUploaded(), result.BytesRead())
+		}
+	}
+}
+
+func TestNewStreamingOptions(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+
+	var got *Streaming
+	streaming, err := NewStreaming(client, "db", "table", func(s *Streaming) { got = s })
+	require.NoError(t, err)
+	assert.Same(t, streaming, got, "options should be applied to the client being built")
+
+	tests := []struct {
+		desc    string
+		options []StreamingOption
+		err     bool
+	}{
+		{desc: "Connection limits", options: []StreamingOption{WithConnectionLimits(50, 20)}},
+		{desc: "Idle connection limit only", options: []StreamingOption{WithConnectionLimits(50, 0)}},
+		{desc: "Negative connection limits", options: []StreamingOption{WithConnectionLimits(-1, 0)}, err: true},
+		{desc: "Connection limits with a client", options: []StreamingOption{WithConnectionLimits(50, 20), WithHTTPClient(&http.Client{})}, err: true},
+		{desc: "Connection timeouts", options: []StreamingOption{WithConnectionTimeouts(ConnectionTimeouts{ResponseHeader: time.Minute})}},
+		{desc: "Negative connection timeouts", options: []StreamingOption{WithConnectionTimeouts(ConnectionTimeouts{Dial: -1})}, err: true},
+		{desc: "Endpoint", options: []StreamingOption{WithEndpoint("https://private.test.kusto.windows.net")}},
+		{desc: "Endpoint that is not https", options: []StreamingOption{WithEndpoint("http://private.test.kusto.windows.net")}, err: true},
+		{desc: "Connection timeouts with a client", options: []StreamingOption{WithConnectionTimeouts(ConnectionTimeouts{IdleConn: time.Minute}), WithHTTPClient(&http.Client{})}, err: true},
+	}
+
+	for _, test := range tests {
+		_, err := NewStreaming(client, "db", "table", test.options...)
+		if test.err {
+			require.Error(t, err, test.desc)
+			assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind, test.desc)
+			continue
+		}
+		require.NoError(t, err, test.desc)
+	}
+}
+
+func TestStreamReader(t *testing.T) {
+	t.Parallel()
+
+	data := "a,b\nc,d\n"
+	compressed, err := ioutil.ReadAll(gzip.Compress(strings.NewReader(data)))
+	require.NoError(t, err)
+
+	var got struct {
+		db, table, mapping, requestID string
+		format                        properties.DataFormat
+		payload                       []byte
+	}
+	ingestion := &Ingestion{
+		db:    "db",
+		table: "table",
+		streamConn: fakeStreamIngestor{
+			onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+				var err error
+				got.payload, err = ioutil.ReadAll(payload)
+				require.NoError(t, err)
+				got.db, got.table, got.mapping, got.requestID, got.format = db, table, mappingName, clientRequestId, format
+				return nil
+			},
+		},
+	}
+
+	result, err := ingestion.StreamReader(context.Background(), strings.NewReader(data), JSON, "map", Table("other"), ClientRequestId("id"))
+	require.NoError(t, err)
+	assert.Equal(t, StreamingIngestion, result.Method())
+	assert.Equal(t, int64(len(data)), result.BytesRead())
+	assert.Equal(t, compressed, got.payload)
+	assert.Equal(t, "db", got.db)
+	assert.Equal(t, "other", got.table)
+	assert.Equal(t, "map", got.mapping)
+	assert.Equal(t, "id", got.requestID)
+	assert.Equal(t, JSON, got.format)
+
+	require.NoError(t, ingestion.Stream(context.Background(), []byte(data), CSV, ""))
+	assert.Equal(t, compressed, got.payload)
+	assert.Equal(t, "table", got.table)
+	assert.Equal(t, CSV, got.format)
+	assert.True(t, strings.HasPrefix(got.requestID, "KGC.executeStreaming;"))
+
+	_, err = ingestion.StreamReader(context.Background(), strings.NewReader(data), CSV, "", ReportResultToTable())
+	assert.Error(t, err, "options not supported by streaming should be rejected")
+}
+
+func TestStreamingSizeLimit(t *testing.T) {
+	t.Parallel()
+
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+
+	_, err := NewStreaming(client, "db", "table", WithStreamingSizeLimit(-1))
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind)
+
+	// Random data does not compress, so the size sent is the size of the data.
+	data := make([]byte, 64*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		desc  string
+		limit int64
+		err   bool
+	}{
+		{desc: "Over the limit", limit: 1024, err: true},
+		{desc: "Raised limit", limit: int64(2 * len(data))},
+	} {
+		streaming, err := NewStreaming(client, "db", "table", WithStreamingSizeLimit(test.limit))
+		require.NoError(t, err, test.desc)
+
+		sent := 0
+		streaming.streamConn = fakeStreamIngestor{
+			onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+				b := make([]byte, 512)
+				for {
+					n, err := payload.Read(b)
+					sent += n
+					if err == io.EOF {
+						return nil
+					}
+					if err != nil {
+						assert.Error(t, ctx.Err(), "the request should be canceled once the payload is over the limit")
+						return err
+					}
+				}
+			},
+		}
+
+		_, err = streaming.FromReader(context.Background(), bytes.NewReader(data), FileFormat(CSV), DontCompress())
+		if !test.err {
+			require.NoError(t, err, test.desc)
+			assert.Equal(t, len(data), sent, test.desc)
+			continue
+		}
+		require.Error(t, err, test.desc)
+		assert.Equal(t, errors.KPayloadTooLarge, err.(*errors.Error).Kind, test.desc)
+		assert.False(t, errors.Retry(err), test.desc)
+		assert.LessOrEqual(t, int64(sent), test.limit, "%s: the upload should stop at the limit", test.desc)
+	}
+}
+
+func TestStreamPayloadTooLarge(t *testing.T) {
+	t.Parallel()
+
+	data := make([]byte, 4*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	called := false
+	ingestion := &Ingestion{
+		db:    "db",
+		table: "table",
+		cfg:   config{maxStreamingSize: 1024},
+		streamConn: fakeStreamIngestor{
+			onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+				called = true
+				_, err := io.Copy(ioutil.Discard, payload)
+				return err
+			},
+		},
+	}
+
+	err = ingestion.Stream(context.Background(), data, CSV, "")
+	require.Error(t, err)
+	assert.Equal(t, errors.KPayloadTooLarge, err.(*errors.Error).Kind)
+	assert.False(t, called, "an oversized payload should be refused before it is sent")
+
+	ingestion.cfg.maxStreamingSize = 0
+	require.NoError(t, ingestion.Stream(context.Background(), data, CSV, ""))
+	assert.True(t, called)
+}
+
+func TestStreamingFromFileCompression(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	csvData := []byte("a,b\nc,d\n")
+	jsonData := []byte(`{"a":1}` + "\n")
+	compress := func(b []byte) []byte {
+		z, err := ioutil.ReadAll(gzip.Compress(bytes.NewReader(b)))
+		require.NoError(t, err)
+		return z
+	}
+
+	tests := []struct {
+		name       string
+		content    []byte
+		wantFormat DataFormat
+	}{
+		{name: "data.csv", content: csvData, wantFormat: CSV},
+		{name: "data.csv.gz", content: compress(csvData), wantFormat: CSV},
+		{name: "data.json", content: jsonData, wantFormat: MultiJSON},
+		{name: "data.json.gz", content: compress(jsonData), wantFormat: MultiJSON},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		require.NoError(t, ioutil.WriteFile(path, test.content, 0600))
+
+		var sent []byte
+		var format DataFormat
+		streaming := Streaming{
+			db:    "db",
+			table: "table",
+			streamConn: fakeStreamIngestor{
+				onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, f properties.DataFormat, mappingName string, clientRequestId string) error {
+					var err error
+					sent, err = ioutil.ReadAll(payload)
+					format = f
+					return err
+				},
+			},
+		}
+
+		_, err := streaming.FromFile(context.Background(), path, IngestionMappingRef("mapping", test.wantFormat.MappingKind()))
+		require.NoError(t, err, test.name)
+		assert.Equal(t, test.wantFormat, format, test.name)
+
+		// The payload is always sent gzipped exactly once.
+		zr, err := stdgzip.NewReader(bytes.NewReader(sent))
+		require.NoError(t, err, test.name)
+		plain, err := ioutil.ReadAll(zr)
+		require.NoError(t, err, test.name)
+		if strings.HasSuffix(test.name, ".gz") {
+			assert.Equal(t, test.content, sent, "%s: an already compressed file should be sent untouched", test.name)
+		} else {
+			assert.Equal(t, test.content, plain, test.name)
+		}
+	}
+}
+
+func TestStreamingFromBlob(t *testing.T) {
+	t.Parallel()
+
+	var got struct {
+		blob, mapping string
+		format        DataFormat
+	}
+	var fail error
+	streaming := Streaming{
+		db:    "db",
+		table: "table",
+		streamConn: fakeStreamIngestor{
+			onStreamIngestBlob: func(ctx context.Context, db, table string, blobURI string, format properties.DataFormat, mappingName string, clientRequestId string) error {
+				got.blob, got.mapping, got.format = blobURI, mappingName, format
+				return fail
+			},
+		},
+	}
+
+	blob := "https://account.blob.core.windows.net/container/data.json?sp=r&sig=secret"
+	result, err := streaming.FromBlob(context.Background(), blob, IngestionMappingRef("mapping", JSON))
+	require.NoError(t, err)
+	assert.Equal(t, StreamingIngestion, result.Method())
+	assert.Equal(t, blob, got.blob)
+	assert.Equal(t, MultiJSON, got.format, "the format should be detected from the blob name")
+
+	_, err = streaming.FromBlob(context.Background(), blob, FileFormat(JSON), IngestionMappingRef("mapping", JSON))
+	require.NoError(t, err)
+	assert.Equal(t, "mapping", got.mapping)
+	assert.Equal(t, JSON, got.format)
+
+	impersonate := "https://account.blob.core.windows.net/container/data.csv;impersonate"
+	_, err = streaming.FromBlob(context.Background(), impersonate)
+	require.NoError(t, err)
+	assert.Equal(t, CSV, got.format)
+
+	for _, bad := range []string{"https://account.blob.core.windows.net/container/data.csv", "http://account/data.csv?sig=secret", "data.csv"} {
+		_, err = streaming.FromBlob(context.Background(), bad)
+		require.Error(t, err, bad)
+		assert.Equal(t, errors.KClientArgs, err.(*errors.Error).Kind, bad)
+	}
+
+	fail = errors.HTTP(errors.OpIngestStream, "413 Request Entity Too Large", ioutil.NopCloser(strings.NewReader(`{"error":{"message":"blob is too large"}}`)), "streaming ingest issue")
+	_, err = streaming.FromBlob(context.Background(), blob, IngestionMappingRef("mapping", JSON))
+	require.Error(t, err)
+	assert.Equal(t, errors.KPayloadTooLarge, err.(*errors.Error).Kind)
+	assert.Contains(t, err.Error(), "blob is too large")
+	assert.NotContains(t, err.Error(), "secret")
+}
+
+func TestStreamingRequestIds(t *testing.T) {
+	t.Parallel()
+
+	var sentID string
+	send := func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+		sentID = clientRequestId
+		_, err := io.Copy(ioutil.Discard, payload)
+		return err
+	}
+	streaming := Streaming{db: "db", table: "table", streamConn: fakeStreamIngestor{onStreamIngest: send}}
+
+	result, err := streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(result.ClientRequestId(), "KGC.executeStreaming;"), result.ClientRequestId())
+	assert.Equal(t, sentID, result.ClientRequestId())
+	assert.Equal(t, "activity", result.ActivityId())
+	assert.Equal(t, 200, result.StatusCode())
+	assert.Equal(t, time.Millisecond, result.Elapsed())
+
+	result, err = streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV), ClientRequestId("mine"))
+	require.NoError(t, err)
+	assert.Equal(t, "mine", result.ClientRequestId())
+	assert.Equal(t, "mine", sentID)
+
+	// An ingestion built without an id still gets one of the canonical form.
+	result, err = streamImpl(streaming.streamConn, context.Background(), strings.NewReader("a,b\n"), properties.All{})
+	require.NoError(t, err)
+	_, err = uuid.Parse(strings.TrimPrefix(result.ClientRequestId(), "KGC.executeStreaming;"))
+	assert.NoError(t, err)
+	assert.Equal(t, sentID, result.ClientRequestId())
+}
+
+// recordingTransport is an http.RoundTripper that records the requests it gets and answers them with a 200.
+type recordingTransport struct {
+	mu   sync.Mutex
+	reqs []*http.Request
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_, _ = io.Copy(ioutil.Discard, req.Body)
+		_ = req.Body.Close()
+	}
+	r.mu.Lock()
+	r.reqs = append(r.reqs, req)
+	r.mu.Unlock()
+	return &http.Response{StatusCode: 200, Status: "200 OK", Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestStreamingHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	auth := kusto.Authorization{Authorizer: autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"Authorization": "Bearer token"})}
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: auth}
+
+	transport := &recordingTransport{}
+	httpClient := &http.Client{Transport: transport}
+
+	streaming, err := NewStreaming(client, "db", "table", WithHTTPClient(httpClient))
+	require.NoError(t, err)
+	result, err := streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, result.StatusCode())
+
+	ingestion, err := New(client, "db", "table", WithStreamingHTTPClient(httpClient))
+	require.NoError(t, err)
+	_, err = ingestion.StreamReader(context.Background(), strings.NewReader("a,b\n"), CSV, "")
+	require.NoError(t, err)
+
+	require.Len(t, transport.reqs, 2)
+	for _, req := range transport.reqs {
+		assert.Equal(t, "test.kusto.windows.net", req.URL.Host)
+		assert.Equal(t, "/v1/rest/ingest/db/table", req.URL.Path)
+		assert.Equal(t, "Bearer token", req.Header.Get("Authorization"), "authorization should still be added")
+	}
+}
+
+// fakeKustoClient returns a *kusto.Client that sends its requests to the returned recordingTransport, where the
+// queries and the commands of the resource manager get results. The client is made with options too.
+func fakeKustoClient(t *testing.T, options ...kusto.Option) (*kusto.Client, *recordingTransport) {
+	const v2Response = `[
+		{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0"},
+		{"FrameType":"DataTable","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+			"Columns":[{"ColumnName":"x","ColumnType":"long"}],"Rows":[[1]]},
+		{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}
+	]`
+	const v1Response = `{"Tables":[{"TableName":"Table_0","Columns":[{"ColumnName":"ResourceTypeName","DataType":"String","ColumnType":"string"},` +
+		`{"ColumnName":"StorageRoot","DataType":"String","ColumnType":"string"}],"Rows":[]}]}`
+
+	transport := &recordingTransport{}
+	roundTrip := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := transport.RoundTrip(req)
+		switch {
+		case err != nil:
+		case req.URL.Path == "/v2/rest/query":
+			resp.Body = ioutil.NopCloser(strings.NewReader(v2Response))
+		case req.URL.Path == "/v1/rest/mgmt":
+			resp.Body = ioutil.NopCloser(strings.NewReader(v1Response))
+		}
+		return resp, err
+	})
+	httpClient := &http.Client{Transport: roundTrip}
+
+	auth := kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}
+	client, err := kusto.New("https://test.kusto.windows.net", auth, append([]kusto.Option{kusto.WithHTTPClient(httpClient)}, options...)...)
+	require.NoError(t, err)
+	return client, transport
+}
+
+func TestQueryClientHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	client, transport := fakeKustoClient(t)
+
+	iter, err := client.Query(context.Background(), "db", kusto.NewStmt("T"))
+	require.NoError(t, err)
+	iter.Stop()
+
+	streaming, err := NewStreaming(client, "db", "table")
+	require.NoError(t, err)
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+	require.NoError(t, err)
+
+	ingestion, err := New(client, "db", "table", WithoutStatusReporting())
+	require.NoError(t, err)
+	_, err = ingestion.StreamReader(context.Background(), strings.NewReader("a,b\n"), CSV, "")
+	require.NoError(t, err)
+
+	// paths returns the paths of the requests that transport got, which the resource manager may add to at any time.
+	paths := func() []string {
+		transport.mu.Lock()
+		defer transport.mu.Unlock()
+		var paths []string
+		for _, req := range transport.reqs {
+			paths = append(paths, req.URL.Path)
+		}
+		return paths
+	}
+	ingests := func() (n int) {
+		for _, p := range paths() {
+			if p == "/v1/rest/ingest/db/table" {
+				n++
+			}
+		}
+		return n
+	}
+
+	got := paths()
+	assert.Equal(t, "/v2/rest/query", got[0])
+	assert.Equal(t, "/v1/rest/ingest/db/table", got[1])
+	assert.Contains(t, got[2:], "/v1/rest/mgmt", "the resource manager should send its commands with the client")
+	assert.Equal(t, 2, ingests())
+
+	// A client of its own, or connection settings, replace the client of the QueryClient.
+	own := &recordingTransport{}
+	streaming, err = NewStreaming(client, "db", "table", WithHTTPClient(&http.Client{Transport: own}))
+	require.NoError(t, err)
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+	require.NoError(t, err)
+	assert.Len(t, own.reqs, 1)
+	assert.Equal(t, 2, ingests())
+
+	streaming, err = NewStreaming(client, "db", "table", WithConnectionLimits(1, 1))
+	require.NoError(t, err)
+	assert.NotSame(t, client.HTTPClient(), streaming.httpClient)
+}
+
+// nopTracer is a kusto.Tracer that does nothing.
+type nopTracer struct{}
+
+func (nopTracer) TraceStart(ctx context.Context, call kusto.TraceCall) context.Context { return ctx }
+func (nopTracer) TraceEnd(ctx context.Context, call kusto.TraceCall)                   {}
+
+func TestQueryClientTracer(t *testing.T) {
+	t.Parallel()
+
+	tracer := nopTracer{}
+	client, _ := fakeKustoClient(t, kusto.WithTracer(tracer))
+
+	// The streaming ingestion requests are traced with the Tracer of the client.
+	streaming, err := NewStreaming(client, "db", "table")
+	require.NoError(t, err)
+	assert.Equal(t, tracer, streaming.tracer)
+
+	ingestion, err := New(client, "db", "table", WithoutStatusReporting())
+	require.NoError(t, err)
+	defer ingestion.Close()
+	assert.Equal(t, tracer, ingestion.cfg.tracer)
+}
+
+func TestQueryClientTracingIdentity(t *testing.T) {
+	t.Parallel()
+
+	client, transport := fakeKustoClient(t, kusto.WithApplicationForTracing("MyApp", "1.2"), kusto.WithUserForTracing("jdoe"))
+
+	// The streaming ingestion requests tell who sends them as the requests of the client do.
+	streaming, err := NewStreaming(client, "db", "table")
+	require.NoError(t, err)
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+	require.NoError(t, err)
+	ingestion, err := New(client, "db", "table", WithoutStatusReporting())
+	require.NoError(t, err)
+	defer ingestion.Close()
+	_, err = ingestion.StreamReader(context.Background(), strings.NewReader("a,b\n"), CSV, "")
+	require.NoError(t, err)
+
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	ingests := 0
+	for _, req := range transport.reqs {
+		if req.URL.Path != "/v1/rest/ingest/db/table" {
+			continue
+		}
+		ingests++
+		assert.Equal(t, "MyApp:1.2", req.Header.Get("x-ms-app"))
+		assert.Equal(t, "jdoe", req.Header.Get("x-ms-user"))
+		assert.True(t, strings.HasPrefix(req.Header.Get("x-ms-client-version"), "Kusto.Go.Client:"), req.Header.Get("x-ms-client-version"))
+	}
+	assert.Equal(t, 2, ingests)
+}
+
+func TestQueryClientTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	const v2Response = `[
+		{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0"},
+		{"FrameType":"DataTable","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+			"Columns":[{"ColumnName":"x","ColumnType":"long"}],"Rows":[[1]]},
+		{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}
+	]`
+	const v1Response = `{"Tables":[{"TableName":"Table_0","Columns":[{"ColumnName":"ResourceTypeName","DataType":"String","ColumnType":"string"},` +
+		`{"ColumnName":"StorageRoot","DataType":"String","ColumnType":"string"}],"Rows":[]}]}`
+
+	// The server presents a self-signed certificate, which only the TLS config of the client trusts.
+	var mu sync.Mutex
+	ingests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/rest/query":
+			io.WriteString(w, v2Response)
+		case "/v1/rest/mgmt":
+			io.WriteString(w, v1Response)
+		case "/v1/rest/ingest/db/table":
+			mu.Lock()
+			ingests++
+			mu.Unlock()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	client, err := kusto.New(server.URL, kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}, kusto.WithTLSConfig(&tls.Config{RootCAs: roots}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	streaming, err := NewStreaming(client, "db", "table")
+	require.NoError(t, err)
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+	require.NoError(t, err)
+
+	// The Data Management client, which gets the ingestion resources, connects with it too.
+	ingestion, err := New(client, "db", "table", WithoutStatusReporting(), WithIngestionEndpoint(server.URL))
+	require.NoError(t, err)
+	defer ingestion.Close()
+	_, err = ingestion.StreamReader(context.Background(), strings.NewReader("a,b\n"), CSV, "")
+	require.NoError(t, err)
+	mu.Lock()
+	assert.Equal(t, 2, ingests)
+	mu.Unlock()
+
+	// So do the storage clients.
+	require.NotNil(t, ingestion.cfg.storageHTTPClient)
+	assert.Same(t, client.TLSConfig(), ingestion.cfg.storageHTTPClient.Transport.(*http.Transport).TLSClientConfig)
+}
+
+// roundTripFunc is a function that implements http.RoundTripper.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestStreamingHTTPClientTimeout(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	// The streaming endpoint must be https, so requests are sent to the test server whatever their address.
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+	streaming, err := NewStreaming(client, "db", "table", WithHTTPClient(&http.Client{Transport: &schemeTransport{transport}, Timeout: 50 * time.Millisecond}))
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a,b\n"))
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second, "the timeout of the client should apply")
+}
+
+// schemeTransport sends https requests as plain http, for test servers.
+type schemeTransport struct {
+	http.RoundTripper
+}
+
+func (s *schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	return s.RoundTripper.RoundTrip(req)
+}
+
+func TestStreamingClose(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer server.Close()
+
+	// The streaming endpoint must be a Kusto host, so requests are sent to the test server whatever their address.
+	newHTTPClient := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+	}
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+
+	cycle := func() {
+		streaming, err := NewStreaming(client, "db", "table", WithHTTPClient(newHTTPClient()))
+		require.NoError(t, err)
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		require.NoError(t, streaming.Close())
+		require.NoError(t, streaming.Close())
+		_, err = streaming.FromReader(context.Background(), strings.NewReader("a,b\n"))
+		assert.Equal(t, ClientClosedErr, err)
+	}
+
+	cycle()
+	time.Sleep(100 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		cycle()
+	}
+
+	// The connections are closed in the background, so give them some time.
+	var after int
+	for wait := 0; wait < 50; wait++ {
+		if after = runtime.NumGoroutine(); after <= before+2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, after, before+2, "closing the clients should release their connections")
+}
+
+func TestStreamingFormatDetection(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	var format DataFormat
+	streaming := Streaming{
+		db:    "db",
+		table: "table",
+		streamConn: fakeStreamIngestor{
+			onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, f properties.DataFormat, mappingName string, clientRequestId string) error {
+				format = f
+				_, err := io.Copy(ioutil.Discard, payload)
+				return err
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		options []FileOption
+		want    DataFormat
+		// err is if the format cannot be detected.
+		err bool
+	}{
+		{name: "data.json", options: []FileOption{IngestionMappingRef("mapping", JSON)}, want: MultiJSON},
+		{name: "data.JSON.gz", options: []FileOption{IngestionMappingRef("mapping", JSON)}, want: MultiJSON},
+		{name: "data.tsv", want: TSV},
+		{name: "data.parquet", want: Parquet},
+		{name: "data.psv", want: PSV},
+		{name: "data.json", options: []FileOption{FileFormat(JSON), IngestionMappingRef("mapping", JSON)}, want: JSON},
+		{name: "data.unknown", options: []FileOption{FileFormat(CSV)}, want: CSV},
+		{name: "data.unknown", err: true},
+		{name: "data", err: true},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		require.NoError(t, ioutil.WriteFile(path, []byte("{}"), 0600))
+
+		format = DFUnknown
+		_, err := streaming.FromFile(context.Background(), path, test.options...)
+		if test.err {
+			require.Error(t, err, test.name)
+			assert.Equal(t, errors.KClientArgs, errors.KindOf(err), test.name)
+			assert.False(t, errors.Retryable(err), test.name)
+			var fe *FormatError
+			require.True(t, goErrors.As(err, &fe), "got %v", err)
+			assert.Equal(t, FromFile, fe.Source, test.name)
+			assert.Equal(t, path, fe.Name, test.name)
+			assert.Equal(t, DFUnknown, format, "nothing should be streamed for %s", test.name)
+			continue
+		}
+		require.NoError(t, err, test.name)
+		assert.Equal(t, test.want, format, test.name)
+	}
+
+	// A reader has no name to detect the format from, so it must be set.
+	format = DFUnknown
+	_, err := streaming.FromReader(context.Background(), strings.NewReader("a,b\n"))
+	var fe *FormatError
+	require.True(t, goErrors.As(err, &fe), "got %v", err)
+	assert.Equal(t, FromReader, fe.Source)
+	assert.Equal(t, "", fe.Name)
+	assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+	assert.Equal(t, DFUnknown, format)
+
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a\tb\n"), FileFormat(TSV))
+	require.NoError(t, err)
+	assert.Equal(t, TSV, format)
+}
+
+func TestStreamingMappingValidation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		options []FileOption
+		wantErr bool
+	}{
+		{desc: "CSV without a mapping", options: []FileOption{FileFormat(CSV)}},
+		{desc: "CSV with a Csv mapping", options: []FileOption{FileFormat(CSV), IngestionMappingRef("map", CSV)}},
+		{desc: "TSV with a Csv mapping", options: []FileOption{FileFormat(TSV), IngestionMappingRef("map", CSV)}},
+		{desc: "Parquet without a mapping", options: []FileOption{FileFormat(Parquet)}},
+		{desc: "Parquet with a Parquet mapping", options: []FileOption{FileFormat(Parquet), IngestionMappingRef("map", Parquet)}},
+		{desc: "JSON with a Json mapping", options: []FileOption{FileFormat(JSON), IngestionMappingRef("map", JSON)}},
+		{desc: "MultiJSON with a Json mapping", options: []FileOption{FileFormat(MultiJSON), IngestionMappingRef("map", JSON)}},
+		{desc: "SingleJSON with a Json mapping", options: []FileOption{IngestionMappingRef("map", JSON), FileFormat(SingleJSON)}},
+		{desc: "ApacheAvro with an Avro mapping", options: []FileOption{FileFormat(ApacheAVRO), IngestionMappingRef("map", AVRO)}},
+		{desc: "W3CLogFile with a W3CLogFile mapping", options: []FileOption{FileFormat(W3CLogFile), IngestionMappingRef("map", W3CLogFile)}},
+		{desc: "JSON without a mapping", options: []FileOption{FileFormat(JSON)}, wantErr: true},
+		{desc: "MultiJSON without a mapping", options: []FileOption{FileFormat(MultiJSON)}, wantErr: true},
+		{desc: "SingleJSON without a mapping", options: []FileOption{FileFormat(SingleJSON)}, wantErr: true},
+		{desc: "Avro without a mapping", options: []FileOption{FileFormat(AVRO)}, wantErr: true},
+		{desc: "JSON with a Csv mapping", options: []FileOption{FileFormat(JSON), IngestionMappingRef("map", CSV)}, wantErr: true},
+		{desc: "Csv mapping before the JSON format", options: []FileOption{IngestionMappingRef("map", CSV), FileFormat(JSON)}, wantErr: true},
+		{desc: "Avro with a Json mapping", options: []FileOption{FileFormat(AVRO), IngestionMappingRef("map", JSON)}, wantErr: true},
+		{desc: "Parquet with an Orc mapping", options: []FileOption{FileFormat(Parquet), IngestionMappingRef("map", ORC)}, wantErr: true},
+		{desc: "W3CLogFile with a Csv mapping", options: []FileOption{FileFormat(W3CLogFile), IngestionMappingRef("map", CSV)}, wantErr: true},
+		{desc: "CSV with a W3CLogFile mapping", options: []FileOption{FileFormat(CSV), IngestionMappingRef("map", W3CLogFile)}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			sent := false
+			streaming := Streaming{
+				db:    "db",
+				table: "table",
+				streamConn: fakeStreamIngestor{
+					onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+						sent = true
+						return nil
+					},
+				},
+			}
+
+			_, err := streaming.FromReader(context.Background(), strings.NewReader("a\n"), test.options...)
+			if !test.wantErr {
+				require.NoError(t, err)
+				assert.True(t, sent)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, errors.KMappingInvalid, err.(*errors.Error).Kind)
+			assert.False(t, errors.Retry(err))
+			assert.False(t, sent, "the payload shouldn't be sent")
+		})
+	}
+
+	// The format detected from a file name is checked against the mapping too.
+	path := filepath.Join(t.TempDir(), "data.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("{}"), 0600))
+	streaming := Streaming{db: "db", table: "table", streamConn: fakeStreamIngestor{}}
+	_, err := streaming.FromFile(context.Background(), path, IngestionMappingRef("map", CSV))
+	require.Error(t, err)
+	assert.Equal(t, errors.KMappingInvalid, err.(*errors.Error).Kind)
+	assert.Contains(t, err.Error(), "needs an ingestion mapping of kind Json, but the mapping is of kind Csv")
+}
+
+func TestStreamingPolicyDisabled(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		body     string
+		wantKind errors.Kind
+		wantMsg  string
+	}{
+		{
+			desc:     "Table policy disabled",
+			body:     `{"error":{"code":"BadRequest_StreamingIngestionPolicyNotEnabled","message":"Request is invalid and cannot be executed.","@type":"Kusto.DataNode.Exceptions.StreamingIngestionPolicyNotEnabledException","@permanent":true}}`,
+			wantKind: errors.KStreamingPolicyDisabled,
+			wantMsg:  `.alter table ["table"] policy streamingingestion enable`,
+		},
+		{
+			desc:     "Cluster disabled",
+			body:     `{"error":{"code":"BadRequest_StreamingIngestionDisabledForCluster","message":"Streaming ingestion is disabled for the cluster","@type":"Kusto.DataNode.Exceptions.StreamingIngestionDisabledForClusterException","@permanent":true}}`,
+			wantKind: errors.KStreamingPolicyDisabled,
+			wantMsg:  "not enabled on the cluster",
+		},
+		{
+			desc:     "Other bad request",
+			body:     `{"error":{"code":"BadRequest_SyntaxError","message":"Streaming ingestion is disabled in this text, but not in the code"}}`,
+			wantKind: errors.KHTTPError,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			fail := func() error {
+				return errors.HTTP(errors.OpIngestStream, "400 Bad Request", ioutil.NopCloser(strings.NewReader(test.body)), "streaming ingest issue")
+			}
+			streaming := Streaming{
+				db:    "db",
+				table: "table",
+				streamConn: fakeStreamIngestor{
+					onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+						return fail()
+					},
+					onStreamIngestBlob: func(ctx context.Context, db, table string, blobURI string, format properties.DataFormat, mappingName string, clientRequestId string) error {
+						return fail()
+					},
+				},
+			}
+
+			_, err := streaming.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+			require.Error(t, err)
+			_, blobErr := streaming.FromBlob(context.Background(), "https://account.blob.core.windows.net/container/data.csv?sig=secret")
+			require.Error(t, blobErr)
+
+			for _, err := range []error{err, blobErr} {
+				e := err.(*errors.Error)
+				assert.Equal(t, test.wantKind, e.Kind)
+				assert.Contains(t, e.Error(), test.wantMsg)
+				assert.Equal(t, test.wantKind == errors.KStreamingPolicyDisabled, isStreamingDisabled(e))
+				if test.wantKind == errors.KStreamingPolicyDisabled {
+					assert.False(t, errors.Retry(e))
+					assert.Equal(t, 400, goErrors.Unwrap(e).(*errors.Error).StatusCode(), "the service error should be wrapped")
+				}
+			}
+		})
+	}
+}
+
+func TestCloseWithClient(t *testing.T) {
+	t.Parallel()
+
+	client, _ := fakeKustoClient(t)
+
+	streaming, err := NewStreaming(client, "db", "table")
+	require.NoError(t, err)
+	queued, err := New(client, "db", "table", WithoutStatusReporting())
+	require.NoError(t, err)
+	managed, err := NewManaged(client, "db", "table")
+	require.NoError(t, err)
+
+	// A client that was closed on its own is not closed again by the kusto.Client.
+	own, err := NewStreaming(client, "db", "table")
+	require.NoError(t, err)
+	require.NoError(t, own.Close())
+
+	require.NoError(t, client.Close())
+
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a,b\n"))
+	assert.Equal(t, ClientClosedErr, err)
+	_, err = queued.FromReader(context.Background(), strings.NewReader("a,b\n"))
+	assert.Equal(t, ClientClosedErr, err)
+	_, err = queued.StreamReader(context.Background(), strings.NewReader("a,b\n"), CSV, "")
+	assert.Equal(t, ClientClosedErr, err)
+	_, err = managed.FromReader(context.Background(), strings.NewReader("a,b\n"))
+	assert.Equal(t, ClientClosedErr, err)
+
+	require.NoError(t, queued.Close())
+	require.NoError(t, managed.Close())
+
+	// A client made from a closed kusto.Client is closed at once.
+	streaming, err = NewStreaming(client, "db", "table")
+	require.NoError(t, err)
+	_, err = streaming.FromReader(context.Background(), strings.NewReader("a,b\n"))
+	assert.Equal(t, ClientClosedErr, err)
+}
+
+func TestStreamingContentLength(t *testing.T) {
+	t.Parallel()
+
+	// requests are the length, the transfer encoding and the data of the requests the server got.
+	type request struct {
+		length   int64
+		encoding []string
+		data     string
+	}
+	var mu sync.Mutex
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{length: r.ContentLength, encoding: r.TransferEncoding}
+		if zr, err := stdgzip.NewReader(r.Body); err == nil {
+			b, _ := ioutil.ReadAll(zr)
+			req.data = string(b)
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}
+	httpClient := &http.Client{Transport: &schemeTransport{transport}}
+	client := mockClient{endpoint: "https://test.kusto.windows.net", auth: kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}}
+
+	path := filepath.Join(t.TempDir(), "data.csv")
+	require.NoError(t, ioutil.WriteFile(path, []byte("a,b\nc,d\n"), 0600))
+	var compressed bytes.Buffer
+	zw := stdgzip.NewWriter(&compressed)
+	zw.Write([]byte("e,f\n"))
+	zw.Close()
+
+	tests := []struct {
+		desc    string
+		options []StreamingOption
+		ingest  func(s *Streaming) (*Result, error)
+		want    string
+		// wantSized is true if the request should have a Content-Length, and be chunked otherwise.
+		wantSized bool
+	}{
+		{
+			desc: "Reader of known size",
+			ingest: func(s *Streaming) (*Result, error) {
+				return s.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+			},
+			want:      "a,b\n",
+			wantSized: true,
+		},
+		{
+			desc: "Reader of unknown size",
+			ingest: func(s *Streaming) (*Result, error) {
+				return s.FromReader(context.Background(), io.MultiReader(strings.NewReader("a,"), strings.NewReader("b\n")), FileFormat(CSV))
+			},
+			want: "a,b\n",
+		},
+		{
+			desc:      "File",
+			ingest:    func(s *Streaming) (*Result, error) { return s.FromFile(context.Background(), path) },
+			want:      "a,b\nc,d\n",
+			wantSized: true,
+		},
+		{
+			desc:    "File over the buffered size",
+			options: []StreamingOption{WithBufferedCompression(4)},
+			ingest:  func(s *Streaming) (*Result, error) { return s.FromFile(context.Background(), path) },
+			want:    "a,b\nc,d\n",
+		},
+		{
+			desc:    "No buffered compression",
+			options: []StreamingOption{WithBufferedCompression(-1)},
+			ingest: func(s *Streaming) (*Result, error) {
+				return s.FromReader(context.Background(), strings.NewReader("a,b\n"), FileFormat(CSV))
+			},
+			want: "a,b\n",
+		},
+		{
+			desc:    "Compressed reader of known size",
+			options: []StreamingOption{WithBufferedCompression(-1)},
+			ingest: func(s *Streaming) (*Result, error) {
+				return s.FromReader(context.Background(), bytes.NewReader(compressed.Bytes()), FileFormat(CSV), Compression(CTGZip))
+			},
+			want:      "e,f\n",
+			wantSized: true,
+		},
+		{
+			desc:    "Retried",
+			options: []StreamingOption{WithStreamingRetries(2, 0)},
+			ingest: func(s *Streaming) (*Result, error) {
+				return s.FromReader(context.Background(), io.MultiReader(strings.NewReader("a,b\n")), FileFormat(CSV))
+			},
+			want:      "a,b\n",
+			wantSized: true,
+		},
+	}
+
+	for _, test := range tests {
+		mu.Lock()
+		requests = nil
+		mu.Unlock()
+
+		streaming, err := NewStreaming(client, "db", "table", append([]StreamingOption{WithHTTPClient(httpClient)}, test.options...)...)
+		require.NoError(t, err, test.desc)
+		_, err = test.ingest(streaming)
+		require.NoError(t, err, test.desc)
+
+		mu.Lock()
+		require.Len(t, requests, 1, test.desc)
+		req := requests[0]
+		mu.Unlock()
+		assert.Equal(t, test.want, req.data, test.desc)
+		if test.wantSized {
+			assert.Greater(t, req.length, int64(0), test.desc)
+			assert.Empty(t, req.encoding, test.desc)
+		} else {
+			assert.Equal(t, int64(-1), req.length, test.desc)
+			assert.Equal(t, []string{"chunked"}, req.encoding, test.desc)
+		}
+	}
+
+	// A source of known size over the limit is refused before anything is sent.
+	mu.Lock()
+	requests = nil
+	mu.Unlock()
+	streaming, err := NewStreaming(client, "db", "table", WithHTTPClient(httpClient), WithStreamingSizeLimit(10))
+	require.NoError(t, err)
+	_, err = streaming.FromReader(context.Background(), strings.NewReader(strings.Repeat("a,b\n", 100)), FileFormat(CSV), Compression(CTGZip))
+	require.Error(t, err)
+	assert.Equal(t, errors.KPayloadTooLarge, errors.KindOf(err))
+	assert.Empty(t, requests)
+}
@@ -0,0 +1,171 @@
+package ingest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/unsafe"
+)
+
+// targetValidationTTL is how long a successful ValidateTarget() check is trusted before it is done again.
+const targetValidationTTL = 5 * time.Minute
+
+// ValidateTarget makes the ingestion check that the destination table exists, and that the mapping set with
+// IngestionMappingRef() exists with the matching kind, before any data is staged. A missing table returns an
+// error of Kind errors.KTableNotExist and a missing mapping one of Kind errors.KMappingNotExist.
+// Successful checks are cached by the Ingestion for a few minutes, use ResetTargetValidation() after changing the
+// table schema or mappings to force a new check.
+func ValidateTarget() FileOption {
+	return option{
+		run: func(p *properties.All) error {
+			p.Source.ValidateTarget = true
+			return nil
+		},
+		clientScopes: QueuedClient | ManagedClient,
+		sourceScope:  FromFile | FromReader | FromBlob,
+		name:         "ValidateTarget",
+	}
+}
+
+// targetCache remembers which destinations were successfully validated, and until when.
+type targetCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func (c *targetCache) valid(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.expires[key].After(time.Now())
+}
+
+func (c *targetCache) put(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.expires == nil {
+		c.expires = map[string]time.Time{}
+	}
+	c.expires[key] = time.Now().Add(targetValidationTTL)
+}
+
+func (c *targetCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expires = nil
+}
+
+// ResetTargetValidation discards the cached results of ValidateTarget(), so the next ingestion using it checks
+// the destination again. Call this after a schema or mapping change.
+func (i *Ingestion) ResetTargetValidation() {
+	i.targets.reset()
+}
+
+// validateTarget performs the checks requested by ValidateTarget().
+func (i *Ingestion) validateTarget(ctx context.Context, props properties.All) error {
+	db := props.Ingestion.DatabaseName
+	tableName := props.Ingestion.TableName
+	mapping := props.Ingestion.Additional.IngestionMappingRef
+	kind := props.Ingestion.Additional.IngestionMappingType
+
+	key := strings.Join([]string{db, tableName, mapping, kind.String()}, "\x00")
+	if i.targets.valid(key) {
+		return nil
+	}
+
+	iter, err := i.client.Mgmt(ctx, db, showTableStmt(tableName).Add(" schema"))
+	if err != nil {
+		if isEntityNotFound(err) {
+			return errors.ES(errors.OpFileIngest, errors.KTableNotExist, "table %q does not exist in database %q", tableName, db).SetNoRetry()
+		}
+		return err
+	}
+	iter.Stop()
+
+	if mapping != "" {
+		if err := i.validateMapping(ctx, db, tableName, mapping, kind); err != nil {
+			return err
+		}
+	}
+
+	i.targets.put(key)
+	return nil
+}
+
+func (i *Ingestion) validateMapping(ctx context.Context, db, tableName, mapping string, kind DataFormat) error {
+	iter, err := i.client.Mgmt(ctx, db, showTableStmt(tableName).Add(" ingestion mappings"))
+	if err != nil {
+		if isEntityNotFound(err) {
+			return errors.ES(errors.OpFileIngest, errors.KTableNotExist, "table %q does not exist in database %q", tableName, db).SetNoRetry()
+		}
+		return err
+	}
+	defer iter.Stop()
+
+	type mappingRec struct {
+		Name string `kusto:"Name"`
+		Kind string `kusto:"Kind"`
+	}
+
+	var kinds []string
+	err = iter.Do(
+		func(row *table.Row) error {
+			rec := mappingRec{}
+			if err := row.ToStruct(&rec); err != nil {
+				return err
+			}
+			if rec.Name == mapping {
+				kinds = append(kinds, rec.Kind)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if len(kinds) == 0 {
+		return errors.ES(errors.OpFileIngest, errors.KMappingNotExist, "table %q has no ingestion mapping named %q", tableName, mapping).SetNoRetry()
+	}
+	for _, k := range kinds {
+		if strings.EqualFold(k, kind.String()) {
+			return nil
+		}
+	}
+	return errors.ES(
+		errors.OpFileIngest,
+		errors.KMappingNotExist,
+		"table %q has an ingestion mapping named %q, but it is of kind %s, not %s", tableName, mapping, strings.Join(kinds, ", "), kind.CamelCase(),
+	).SetNoRetry()
+}
+
+// showTableStmt builds the ".show table <name>" prefix of a command, with the table name quoted.
+// Management commands do not support query parameters, so the quoted name is added as is.
+func showTableStmt(tableName string) kusto.Stmt {
+	return kusto.NewStmt(".show table ", kusto.UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).UnsafeAdd(quoteName(tableName))
+}
+
+// quoteName returns name as a bracketed Kusto identifier, which allows any character in the name.
+func quoteName(name string) string {
+	return `["` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"]`
+}
+
+// isEntityNotFound determines if the service rejected a command because the entity it refers to does not exist.
+func isEntityNotFound(err error) bool {
+	return hasErrorCode(err, "EntityNotFound")
+}
+
+// hasErrorCode reports if err is an error returned by the service whose code or type, or those of its inner errors,
+// contains code.
+func hasErrorCode(err error, code string) bool {
+	se, ok := errors.AsServiceError(err)
+	return ok && se.Is(code)
+}
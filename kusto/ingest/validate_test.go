@@ -0,0 +1,225 @@
+package ingest
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/properties"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/internal/resources"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const entityNotFoundBody = `{"error":{"code":"BadRequest_EntityNotFound","message":"Request is invalid and cannot be executed.",` +
+	`"@type":"Kusto.Data.Exceptions.EntityNotFoundException","@message":"Entity ID 'table' of kind 'Table' was not found."}}`
+
+type validateMgmt struct {
+	mu       sync.Mutex
+	commands []string
+
+	noTable  bool
+	mappings []value.Values
+}
+
+func (v *validateMgmt) onMgmt(_ context.Context, _ string, query kusto.Stmt, _ ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+	q := query.String()
+	if !strings.HasPrefix(q, ".show table") {
+		return nil, nil
+	}
+
+	v.mu.Lock()
+	v.commands = append(v.commands, q)
+	v.mu.Unlock()
+
+	if v.noTable {
+		return nil, errors.HTTP(errors.OpMgmt, "400 Bad Request", ioutil.NopCloser(strings.NewReader(entityNotFoundBody)), "")
+	}
+
+	var cols table.Columns
+	var rows []value.Values
+	if strings.HasSuffix(q, " schema") {
+		cols = table.Columns{{Name: "TableName", Type: types.String}, {Name: "Schema", Type: types.String}}
+	} else {
+		cols = table.Columns{{Name: "Name", Type: types.String}, {Name: "Kind", Type: types.String}, {Name: "Mapping", Type: types.String}}
+		rows = v.mappings
+	}
+
+	mock, err := kusto.NewMockRows(cols)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if err := mock.Row(row); err != nil {
+			return nil, err
+		}
+	}
+	iter := &kusto.RowIterator{}
+	if err := iter.Mock(mock); err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+func mappingRow(name, kind string) value.Values {
+	return value.Values{
+		value.String{Value: name, Valid: true},
+		value.String{Value: kind, Valid: true},
+		value.String{Value: "[]", Valid: true},
+	}
+}
+
+func TestValidateTarget(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		mgmt     *validateMgmt
+		options  []FileOption
+		wantKind errors.Kind
+		wantCmds []string
+	}{
+		{
+			desc:     "Table exists",
+			mgmt:     &validateMgmt{},
+			wantCmds: []string{`.show table ["my\"table"] schema`},
+		},
+		{
+			desc:     "Table does not exist",
+			mgmt:     &validateMgmt{noTable: true},
+			wantKind: errors.KTableNotExist,
+			wantCmds: []string{`.show table ["my\"table"] schema`},
+		},
+		{
+			desc:     "Mapping exists",
+			mgmt:     &validateMgmt{mappings: []value.Values{mappingRow("other", "Csv"), mappingRow("map", "Json")}},
+			options:  []FileOption{IngestionMappingRef("map", JSON)},
+			wantCmds: []string{`.show table ["my\"table"] schema`, `.show table ["my\"table"] ingestion mappings`},
+		},
+		{
+			desc:     "Mapping does not exist",
+			mgmt:     &validateMgmt{mappings: []value.Values{mappingRow("other", "Json")}},
+			options:  []FileOption{IngestionMappingRef("map", JSON)},
+			wantKind: errors.KMappingNotExist,
+			wantCmds: []string{`.show table ["my\"table"] schema`, `.show table ["my\"table"] ingestion mappings`},
+		},
+		{
+			desc:     "Mapping is of the wrong kind",
+			mgmt:     &validateMgmt{mappings: []value.Values{mappingRow("map", "Csv")}},
+			options:  []FileOption{IngestionMappingRef("map", JSON)},
+			wantKind: errors.KMappingNotExist,
+			wantCmds: []string{`.show table ["my\"table"] schema`, `.show table ["my\"table"] ingestion mappings`},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			client := mockClient{endpoint: "https://test.kusto.windows.net", onMgmt: test.mgmt.onMgmt}
+			ingestion, err := New(client, "db", `my"table`)
+			require.NoError(t, err)
+			ingestion.fs = resources.FsMock{}
+
+			options := append([]FileOption{ValidateTarget()}, test.options...)
+			_, err = ingestion.FromReader(context.Background(), strings.NewReader("a,b"), options...)
+			if test.wantKind != errors.KOther {
+				require.Error(t, err)
+				e, ok := err.(*errors.Error)
+				require.True(t, ok)
+				assert.Equal(t, test.wantKind, e.Kind)
+				assert.False(t, errors.Retry(err))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.wantCmds, test.mgmt.commands)
+		})
+	}
+}
+
+func TestValidateTargetCache(t *testing.T) {
+	t.Parallel()
+
+	mgmt := &validateMgmt{}
+	client := mockClient{endpoint: "https://test.kusto.windows.net", onMgmt: mgmt.onMgmt}
+	ingestion, err := New(client, "db", "table")
+	require.NoError(t, err)
+	ingestion.fs = resources.FsMock{}
+
+	ingest := func(options ...FileOption) {
+		_, err := ingestion.FromReader(context.Background(), strings.NewReader("a,b"), options...)
+		require.NoError(t, err)
+	}
+
+	ingest()
+	assert.Len(t, mgmt.commands, 0, "validation must be opt-in")
+
+	ingest(ValidateTarget())
+	ingest(ValidateTarget())
+	assert.Len(t, mgmt.commands, 1, "a successful validation should be cached")
+
+	ingest(ValidateTarget(), Table("other"))
+	assert.Len(t, mgmt.commands, 2, "the cache is per table")
+
+	ingestion.ResetTargetValidation()
+	ingest(ValidateTarget())
+	assert.Len(t, mgmt.commands, 3, "ResetTargetValidation should bypass the cache")
+}
+
+func TestValidateTargetManaged(t *testing.T) {
+	t.Parallel()
+
+	mgmt := &validateMgmt{noTable: true}
+	client := mockClient{endpoint: "https://test.kusto.windows.net", onMgmt: mgmt.onMgmt}
+	queued, err := New(client, "db", "table")
+	require.NoError(t, err)
+	queued.fs = resources.FsMock{}
+
+	managed := Managed{
+		queued: queued,
+		streaming: &Streaming{
+			db:    "db",
+			table: "table",
+			streamConn: fakeStreamIngestor{
+				onStreamIngest: func(ctx context.Context, db, table string, payload io.Reader, format properties.DataFormat, mappingName string, clientRequestId string) error {
+					if mgmt.noTable {
+						t.Errorf("nothing should be streamed when the table does not exist")
+					}
+					return nil
+				},
+			},
+		},
+	}
+
+	_, err = managed.FromReader(context.Background(), strings.NewReader("a,b"), ValidateTarget())
+	require.Error(t, err)
+	assert.Equal(t, errors.KTableNotExist, err.(*errors.Error).Kind)
+	assert.Len(t, mgmt.commands, 1)
+
+	mgmt.noTable = false
+	_, err = managed.FromReader(context.Background(), strings.NewReader("a,b"), ValidateTarget())
+	require.NoError(t, err)
+	_, err = managed.FromReader(context.Background(), strings.NewReader("a,b"), ValidateTarget())
+	require.NoError(t, err)
+	assert.Len(t, mgmt.commands, 2, "a successful validation should be cached")
+}
+
+func TestIsEntityNotFound(t *testing.T) {
+	t.Parallel()
+
+	notFound := errors.HTTP(errors.OpMgmt, "400 Bad Request", ioutil.NopCloser(strings.NewReader(entityNotFoundBody)), "")
+	assert.True(t, isEntityNotFound(notFound))
+
+	other := errors.HTTP(errors.OpMgmt, "400 Bad Request", ioutil.NopCloser(strings.NewReader(`{"error":{"code":"BadRequest","message":"EntityNotFound in a message"}}`)), "")
+	assert.False(t, isEntityNotFound(other))
+	assert.False(t, isEntityNotFound(errors.ES(errors.OpMgmt, errors.KOther, "EntityNotFound")))
+}
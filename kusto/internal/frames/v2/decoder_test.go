@@ -218,7 +218,7 @@ func TestNormalDecode(t *testing.T) {
 
 	for _, want := range wantFrames {
 		got := <-ch
-		require.EqualValues(t, want, got)
+		requireFrame(t, want, got)
 	}
 }
 
@@ -453,7 +453,7 @@ func TestErrorDecode(t *testing.T) {
 
 	for _, want := range wantFrames {
 		got := <-ch
-		require.EqualValues(t, want, got)
+		requireFrame(t, want, got)
 	}
 }
 
@@ -464,3 +464,29 @@ func timeMustParse(layout string, p string) time.Time {
 	}
 	return t
 }
+
+// requireFrame requires got to be the frame want. The errors of the rows are compared by what they say, as they also
+// hold the OneApiError that they were made from.
+func requireFrame(t *testing.T, want, got interface{}) {
+	t.Helper()
+
+	w, ok := want.(DataTable)
+	if !ok || len(w.RowErrors) == 0 {
+		require.EqualValues(t, want, got)
+		return
+	}
+	g, ok := got.(DataTable)
+	require.True(t, ok, "got %T, want DataTable", got)
+	require.Len(t, g.RowErrors, len(w.RowErrors))
+	for i := range w.RowErrors {
+		require.Equal(t, w.RowErrors[i].Op, g.RowErrors[i].Op)
+		require.Equal(t, w.RowErrors[i].Kind, g.RowErrors[i].Kind)
+		require.Equal(t, w.RowErrors[i].Error(), g.RowErrors[i].Error())
+		se, ok := g.RowErrors[i].ServiceError()
+		require.True(t, ok)
+		require.Equal(t, "LimitsExceeded", se.Code)
+		require.NotEmpty(t, se.Context["activityId"])
+	}
+	w.RowErrors, g.RowErrors = nil, nil
+	require.EqualValues(t, w, g)
+}
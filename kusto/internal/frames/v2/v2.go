@@ -84,8 +84,8 @@ type DataSetCompletion struct {
 	HasErrors bool
 	// Cancelled indicates that the request was cancelled.
 	Cancelled bool
-	// OneAPIErrors is a list of errors encountered.
-	OneAPIErrors []string `json:"OneApiErrors"`
+	// OneAPIErrors is a list of errors encountered, such as the partial failures of a query.
+	OneAPIErrors []interface{} `json:"OneApiErrors"`
 
 	Op errors.Op `json:"-"`
 }
@@ -98,6 +98,21 @@ func (d *DataSetCompletion) UnmarshalRaw(raw json.RawMessage) error {
 	return json.Unmarshal(raw, &d)
 }
 
+// Err returns the error that the DataSetCompletion reports, such as the partial failure of a query, or nil if the
+// stream completed without errors.
+func (d DataSetCompletion) Err() *errors.Error {
+	if !d.HasErrors && !d.Cancelled {
+		return nil
+	}
+	if err := errors.OneToErr(map[string]interface{}{"OneApiErrors": d.OneAPIErrors}, d.Op); err != nil {
+		return err
+	}
+	if d.Cancelled {
+		return errors.ES(d.Op, errors.KOther, "the service cancelled the request after it sent part of the results")
+	}
+	return errors.ES(d.Op, errors.KOther, "the service reported errors after it sent part of the results")
+}
+
 // TableHeader indicates that instead of receiving a dataTable, we will receive a
 // stream of table information. This structure holds the base information, but none
 // of the row information.
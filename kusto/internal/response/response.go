@@ -6,16 +6,20 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto/data/errors"
 )
 
+// TranslateBody returns the body of resp, decompressed as its Content-Encoding header tells. Closing it closes the
+// body of resp.
 func TranslateBody(resp *http.Response, op errors.Op) (io.ReadCloser, error) {
-	body := resp.Body
+	var body io.ReadCloser
 	switch enc := strings.ToLower(resp.Header.Get("Content-Encoding")); enc {
 	case "":
-		return body, nil
+		return resp.Body, nil
 	case "gzip":
 		var err error
 		body, err = gzip.NewReader(resp.Body)
@@ -27,5 +31,34 @@ func TranslateBody(resp *http.Response, op errors.Op) (io.ReadCloser, error) {
 	default:
 		return nil, errors.ES(op, errors.KInternal, "Content-Encoding was unrecognized: %s", enc)
 	}
-	return body, nil
+	return decompressed{ReadCloser: body, raw: resp.Body}, nil
+}
+
+// decompressed is the decompressing reader of a body, whose Close also closes the body, which the gzip and flate
+// readers do not.
+type decompressed struct {
+	io.ReadCloser
+	raw io.Closer
+}
+
+func (d decompressed) Close() error {
+	err := d.ReadCloser.Close()
+	if rerr := d.raw.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// RetryAfter returns the wait asked for by a Retry-After header, which holds either seconds or an HTTP date.
+func RetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
 }
@@ -0,0 +1,90 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-1", 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, RetryAfter(test.header, now), test.header)
+	}
+}
+
+// closeRecorder records if it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTranslateBody(t *testing.T) {
+	t.Parallel()
+
+	var buff bytes.Buffer
+	zw := gzip.NewWriter(&buff)
+	zw.Write([]byte("hello"))
+	zw.Close()
+
+	tests := []struct {
+		desc     string
+		encoding string
+		body     []byte
+		err      bool
+	}{
+		{desc: "Identity", body: []byte("hello")},
+		{desc: "Gzip", encoding: "gzip", body: buff.Bytes()},
+		{desc: "Bad gzip", encoding: "gzip", body: []byte("hello"), err: true},
+		{desc: "Unknown", encoding: "br", body: []byte("hello"), err: true},
+	}
+
+	for _, test := range tests {
+		raw := &closeRecorder{Reader: bytes.NewReader(test.body)}
+		resp := &http.Response{Header: http.Header{}, Body: raw}
+		if test.encoding != "" {
+			resp.Header.Set("Content-Encoding", test.encoding)
+		}
+
+		body, err := TranslateBody(resp, errors.OpQuery)
+		if test.err {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		require.NoError(t, err, test.desc)
+		b, err := ioutil.ReadAll(body)
+		require.NoError(t, err, test.desc)
+		assert.Equal(t, "hello", string(b), test.desc)
+
+		// Closing the body closes the body of the response too.
+		require.NoError(t, body.Close(), test.desc)
+		assert.True(t, raw.closed, test.desc)
+	}
+}
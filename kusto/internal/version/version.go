@@ -1,5 +1,11 @@
 // Package version keeps the internal version number of the client.
 package version
 
+import "runtime"
+
 // Kusto is the version of this client package that is communicated to the server.
 const Kusto = "0.6.0"
+
+// Header is the x-ms-client-version header of the requests, which tells the service the client and the Go runtime
+// that sent them, in the format that the Kusto SDKs of other languages share.
+var Header = "Kusto.Go.Client:" + Kusto + "|Runtime.Go:" + runtime.Version()
@@ -2,6 +2,8 @@ package kusto
 
 import (
 	"context"
+	"crypto/tls"
+	"net/http"
 	"net/url"
 	"reflect"
 	"strings"
@@ -22,8 +24,8 @@ type queryer interface {
 	mgmt(ctx context.Context, db string, query Stmt, options *mgmtOptions) (execResp, error)
 }
 
-// Authorization provides the ADAL authorizer needed to access the resource. You can set Authorizer or
-// Config, but not both.
+// Authorization provides the ADAL authorizer needed to access the resource. You can set one of Authorizer,
+// Config, ManagedIdentity, AzCli, DeviceCode or TokenProvider.
 type Authorization struct {
 	// Authorizer provides an authorizer to use when talking to Kusto. If this is set, the
 	// Authorizer must have its Resource (also called Resource ID) set to the endpoint passed
@@ -33,6 +35,17 @@ type Authorization struct {
 	// Config provides the authorizer's config that can create the authorizer. We recommending setting
 	// this instead of Authorizer, as we will automatically set the Resource ID with the endpoint passed.
 	Config auth.AuthorizerConfig
+	// ManagedIdentity signs in as a managed identity of the Azure host the client runs on. The client gets the
+	// tokens for the endpoint from the Azure Instance Metadata Service, and gets a new one before each expires.
+	ManagedIdentity *ManagedIdentityConfig
+	// AzCli signs in as the user that is logged in to the Azure CLI. The client gets the tokens for the endpoint
+	// from the Azure CLI, and gets a new one before each expires.
+	AzCli *AzCliConfig
+	// DeviceCode signs a user in with a device code, which is given to them to enter at a page of the identity
+	// service. The client does so with the first call, and keeps the sign in for the life of the Client.
+	DeviceCode *DeviceCodeConfig
+	// TokenProvider provides the tokens for the endpoint, for credential sources that the others do not cover.
+	TokenProvider TokenProvider
 }
 
 // Validate validates the Authorization object against the endpoint an preps it for use.
@@ -40,17 +53,38 @@ type Authorization struct {
 func (a *Authorization) Validate(endpoint string) error {
 	const rescField = "Resource"
 
-	if strings.Contains(strings.ToLower(endpoint), ".azuresynapse") {
-		endpoint = "https://kusto.kusto.windows.net"
-	}
+	endpoint = tokenResource(endpoint)
 
-	if a.Authorizer != nil && a.Config != nil {
-		return errors.ES(errors.OpServConn, errors.KClientArgs, "cannot set Authoriztion.Authorizer and Authorizer.Config")
+	set := 0
+	for _, isSet := range []bool{a.Authorizer != nil, a.Config != nil, a.ManagedIdentity != nil, a.AzCli != nil, a.DeviceCode != nil, a.TokenProvider != nil} {
+		if isSet {
+			set++
+		}
 	}
-	if a.Authorizer == nil && a.Config == nil {
+	if set > 1 {
+		return errors.ES(errors.OpServConn, errors.KClientArgs, "only one of Authorization.Authorizer, Config, ManagedIdentity, AzCli, DeviceCode and TokenProvider can be set")
+	}
+	if set == 0 {
 		return errors.ES(errors.OpServConn, errors.KClientArgs, "cannot leave all Authoriztion fields as zero values")
 	}
-	if a.Authorizer != nil {
+
+	switch {
+	case a.Authorizer != nil:
+		return nil
+	case a.ManagedIdentity != nil:
+		if err := a.ManagedIdentity.validate(); err != nil {
+			return err
+		}
+		a.Authorizer = newTokenAuthorizer(endpoint, a.ManagedIdentity.fetchToken)
+		return nil
+	case a.AzCli != nil:
+		a.Authorizer = newTokenAuthorizer(endpoint, a.AzCli.fetchToken)
+		return nil
+	case a.DeviceCode != nil:
+		a.Authorizer = newTokenAuthorizer(endpoint, a.DeviceCode.fetchToken)
+		return nil
+	case a.TokenProvider != nil:
+		a.Authorizer = newTokenAuthorizer(endpoint, providerFetch(a.TokenProvider))
 		return nil
 	}
 
@@ -82,6 +116,9 @@ func (a *Authorization) Validate(endpoint string) error {
 		case auth.ClientCredentialsConfig:
 			t.Resource = endpoint
 			a.Config = t
+		case auth.ClientCertificateConfig:
+			t.Resource = endpoint
+			a.Config = t
 		case auth.DeviceFlowConfig:
 			t.Resource = endpoint
 			a.Config = t
@@ -103,17 +140,62 @@ func (a *Authorization) Validate(endpoint string) error {
 	return nil
 }
 
+// tokenResource returns the resource that the tokens for endpoint are for.
+func tokenResource(endpoint string) string {
+	if strings.Contains(strings.ToLower(endpoint), ".azuresynapse") {
+		return "https://kusto.kusto.windows.net"
+	}
+	return endpoint
+}
+
 // Client is a client to a Kusto instance.
 type Client struct {
 	conn, ingestConn queryer
 	endpoint         string
 	auth             Authorization
-	mu               sync.Mutex
+	retry            retryPolicy
+	// httpClient is the client of WithHTTPClient(), nil for the default.
+	httpClient *http.Client
+	// tracer and traceCSL are set by WithTracer() and WithTraceCSL().
+	tracer   Tracer
+	traceCSL bool
+	// app and user are the x-ms-app and x-ms-user headers, see WithApplicationForTracing().
+	app, user string
+	// compression is how the bodies of the requests are compressed, see WithRequestCompressionThreshold().
+	compression compression
+	// consistency is set by WithQueryConsistency(), "" for the service default.
+	consistency QueryConsistency
+	// tlsConfig and insecureSkipVerify are set by WithTLSConfig() and WithInsecureSkipTLSVerify(), and transport is
+	// the transport that the connections are opened with if either is.
+	tlsConfig          *tls.Config
+	insecureSkipVerify bool
+	transport          *http.Transport
+	mu                 sync.Mutex
+
+	// closed is set by Close(), which calls the functions of onClose, by the ids that OnClose() returned them with.
+	closed      bool
+	onClose     map[int]func()
+	onCloseNext int
 }
 
+// ClientClosedErr is returned by the calls of a Client after Close() was called.
+var ClientClosedErr = errors.ES(errors.OpServConn, errors.KClientArgs, "the client is closed").SetNoRetry()
+
 // Option is an optional argument type for New().
 type Option func(c *Client)
 
+// WithHTTPClient makes the client send its requests with client, such as to go through a proxy, trust custom TLS
+// roots or use an instrumented transport. The ingestion clients made from the Client send their requests with it
+// too, unless they are given their own. client is not changed, so it can be shared.
+// The Timeout of client limits each attempt of a call, including reading its results, so it must be longer than the
+// calls take; a call that must end sooner should set a deadline on its context instead. The servertimeout request
+// property is set from whichever ends first, so that the service gives up before the client does.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = client
+	}
+}
+
 // New returns a new Client. endpoint is the Kusto endpoint to use, example: https://somename.westus.kusto.windows.net .
 func New(endpoint string, auth Authorization, options ...Option) (*Client, error) {
 	u, err := url.Parse(endpoint)
@@ -129,16 +211,32 @@ func New(endpoint string, auth Authorization, options ...Option) (*Client, error
 		)
 	}
 
-	client := &Client{auth: auth, endpoint: endpoint}
+	client := &Client{auth: auth, endpoint: endpoint, retry: defaultRetryPolicy, compression: compression{enabled: true, threshold: defaultCompressThreshold}}
 	for _, o := range options {
 		o(client)
 	}
+	if err := client.retry.validate(); err != nil {
+		return nil, err
+	}
+	if err := client.compression.validate(); err != nil {
+		return nil, err
+	}
+	if err := client.consistency.validate(); err != nil {
+		return nil, err
+	}
+	if err := client.setupTLS(); err != nil {
+		return nil, err
+	}
 
 	if err := auth.Validate(endpoint); err != nil {
 		return nil, err
 	}
 
-	conn, err := newConn(endpoint, auth)
+	if client.app == "" {
+		client.app = processName()
+	}
+
+	conn, err := client.connect(endpoint, auth)
 	if err != nil {
 		return nil, err
 	}
@@ -147,6 +245,23 @@ func New(endpoint string, auth Authorization, options ...Option) (*Client, error
 	return client, nil
 }
 
+// connect returns the conn of the client for endpoint.
+func (c *Client) connect(endpoint string, auth Authorization) (*conn, error) {
+	httpClient := c.httpClient
+	if httpClient == nil && c.transport != nil {
+		httpClient = &http.Client{Transport: c.transport}
+	}
+	conn, err := newConn(endpoint, auth, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	conn.retry = c.retry
+	conn.tracer, conn.traceCSL = c.tracer, c.traceCSL
+	conn.app, conn.user = c.app, c.user
+	conn.compression = c.compression
+	return conn, nil
+}
+
 // QueryOption is an option type for a call to Query().
 type QueryOption func(q *queryOptions) error
 
@@ -167,6 +282,65 @@ func (c *Client) Endpoint() string {
 	return c.endpoint
 }
 
+// HTTPClient returns the *http.Client passed to WithHTTPClient(), or nil if New() was not passed one.
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// Close closes the client: calls made after it return ClientClosedErr, the idle connections of the client are closed
+// and the ingestion clients made from it are closed too. Calls in progress, and the RowIterators they returned, are
+// not interrupted. The connections of a client passed to WithHTTPClient() are left to its owner. Tokens are only
+// fetched by calls, so no token refresh runs after Close. Calling Close again does nothing.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	onClose := c.onClose
+	c.onClose = nil
+	conns := []queryer{c.conn, c.ingestConn}
+	c.mu.Unlock()
+
+	for _, f := range onClose {
+		f()
+	}
+	if c.httpClient == nil {
+		for _, q := range conns {
+			if cn, ok := q.(*conn); ok {
+				cn.client.CloseIdleConnections()
+			}
+		}
+	}
+	return nil
+}
+
+// OnClose registers f to be called by Close(), so that what is made from the Client, such as an ingestion client, is
+// closed with it. f is called at once if the Client is already closed. The returned function unregisters f, for
+// when what it closes was closed on its own.
+func (c *Client) OnClose(f func()) (unregister func()) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		f()
+		return func() {}
+	}
+	if c.onClose == nil {
+		c.onClose = map[int]func(){}
+	}
+	id := c.onCloseNext
+	c.onCloseNext++
+	c.onClose[id] = f
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.onClose, id)
+	}
+}
+
 type callType int8
 
 const (
@@ -178,11 +352,16 @@ const (
 // Query queries Kusto for data. context can set a timeout or cancel the query.
 // query is a injection safe Stmt object. Queries cannot take longer than 5 minutes by default and have row/size limitations.
 // Note that the server has a timeout of 4 minutes for a query by default unless the context deadline is set. Queries can
-// take a maximum of 1 hour.
+// take a maximum of 1 hour. The client sets the servertimeout request property to the time left to the deadline, less
+// a second so that the service gives up first, unless it is set with QueryRequestProperties().
 func (c *Client) Query(ctx context.Context, db string, query Stmt, options ...QueryOption) (*RowIterator, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.closed {
+		return nil, ClientClosedErr
+	}
+
 	ctx, cancel, err := c.contextSetup(ctx, false) // Note: cancel is called when *RowIterator has Stop() called.
 	if err != nil {
 		return nil, err
@@ -200,6 +379,7 @@ func (c *Client) Query(ctx context.Context, db string, query Stmt, options ...Qu
 
 	execResp, err := conn.query(ctx, db, query, opts)
 	if err != nil {
+		err = annotateTimeout(ctx, err, opts.timeoutNote)
 		cancel()
 		return nil, err
 	}
@@ -220,11 +400,12 @@ func (c *Client) Query(ctx context.Context, db string, query Stmt, options ...Qu
 	var sm stateMachine
 	if header.IsProgressive {
 		sm = &progressiveSM{
-			op:   errors.OpQuery,
-			iter: iter,
-			in:   execResp.frameCh,
-			ctx:  ctx,
-			wg:   &sync.WaitGroup{},
+			op:         errors.OpQuery,
+			iter:       iter,
+			in:         execResp.frameCh,
+			ctx:        ctx,
+			onProgress: opts.onProgress,
+			wg:         &sync.WaitGroup{},
 		}
 	} else {
 		sm = &nonProgressiveSM{
@@ -246,11 +427,32 @@ func (c *Client) Query(ctx context.Context, db string, query Stmt, options ...Qu
 // Details can be found at: https://docs.microsoft.com/en-us/azure/kusto/management/
 // Mgmt accepts a Stmt, but that Stmt cannot have any query parameters attached at this time.
 // Note that the server has a timeout of 10 minutes for a management call by default unless the context deadline is set.
-// There is a maximum of 1 hour.
+// There is a maximum of 1 hour. The client sets the servertimeout request property from the deadline as Query() does,
+// unless it is set with MgmtRequestProperties().
+// db cannot be empty, a command of the cluster such as ".show databases" is run with MgmtCluster().
 func (c *Client) Mgmt(ctx context.Context, db string, query Stmt, options ...MgmtOption) (*RowIterator, error) {
+	if db == "" {
+		return nil, errors.ES(errors.OpMgmt, errors.KClientArgs, "a Mgmt() call must have a database, use MgmtCluster() for a command of the cluster").SetNoRetry()
+	}
+	return c.mgmt(ctx, db, query, options...)
+}
+
+// MgmtCluster is Mgmt() for the commands that are not run in a database, such as ".show cluster", ".show databases"
+// or ".show capacity". The request has no database, so the command is run at the scope of the cluster. A command
+// that needs a database fails with the error of the service, rather than running in a database that was not chosen.
+func (c *Client) MgmtCluster(ctx context.Context, query Stmt, options ...MgmtOption) (*RowIterator, error) {
+	return c.mgmt(ctx, "", query, options...)
+}
+
+// mgmt runs the command query in db, or at the scope of the cluster if db is empty.
+func (c *Client) mgmt(ctx context.Context, db string, query Stmt, options ...MgmtOption) (*RowIterator, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.closed {
+		return nil, ClientClosedErr
+	}
+
 	if !query.params.IsZero() || !query.defs.IsZero() {
 		return nil, errors.ES(errors.OpMgmt, errors.KClientArgs, "a Mgmt() call cannot accept a Stmt object that has Definitions or Parameters attached")
 	}
@@ -272,6 +474,7 @@ func (c *Client) Mgmt(ctx context.Context, db string, query Stmt, options ...Mgm
 
 	execResp, err := conn.mgmt(ctx, db, query, opts)
 	if err != nil {
+		err = annotateTimeout(ctx, err, opts.timeoutNote)
 		cancel()
 		return nil, err
 	}
@@ -299,12 +502,15 @@ func (c *Client) setQueryOptions(ctx context.Context, op errors.Op, query Stmt,
 	}
 
 	// Match our server deadline to our context.Deadline. This should be set from withing kusto.Query() to always have a value.
-	deadline, ok := ctx.Deadline()
-	if ok {
-		options = append(
-			options,
-			queryServerTimeout(deadline.Sub(nower())),
-		)
+	// It goes first, so that a server timeout set with QueryRequestProperties() wins.
+	var derived time.Duration
+	if deadline, ok := c.callDeadline(ctx); ok {
+		if derived = deadlineServerTimeout(deadline); derived > 0 {
+			options = append(
+				[]QueryOption{queryServerTimeout(derived)},
+				options...,
+			)
+		}
 	}
 
 	opt := &queryOptions{
@@ -318,12 +524,28 @@ func (c *Client) setQueryOptions(ctx context.Context, op errors.Op, query Stmt,
 		// do not support it.
 		opt.requestProperties.Options["results_progressive_enabled"] = true
 	}
+	// It goes before the options, so that a QueryConsistency set with QueryRequestProperties() wins.
+	if c.consistency != "" {
+		opt.requestProperties.Options[queryConsistencyOption] = string(c.consistency)
+	}
 
 	for _, o := range options {
 		if err := o(opt); err != nil {
 			return nil, errors.ES(op, errors.KClientArgs, "QueryValues in the the Stmt were incorrect: %s", err).SetNoRetry()
 		}
 	}
+
+	if opt.params != nil {
+		if query.defs.IsZero() {
+			return nil, errors.ES(op, errors.KClientArgs, "QueryParameters() was passed, but the Stmt has no Definitions").SetNoRetry()
+		}
+		params, err := opt.params.validate(query.defs)
+		if err != nil {
+			return nil, errors.ES(op, errors.KClientArgs, "QueryParameters() were incorrect: %s", err).SetNoRetry()
+		}
+		opt.requestProperties.Parameters = params.outM
+	}
+	opt.timeoutNote = serverTimeoutNote(ctx, opt.requestProperties, derived)
 	return opt, nil
 }
 
@@ -334,12 +556,15 @@ func (c *Client) setMgmtOptions(ctx context.Context, op errors.Op, query Stmt, o
 	}
 
 	// Match our server deadline to our context.Deadline. This should be set from withing kusto.Query() to always have a value.
-	deadline, ok := ctx.Deadline()
-	if ok {
-		options = append(
-			options,
-			mgmtServerTimeout(deadline.Sub(nower())),
-		)
+	// It goes first, so that a server timeout set with MgmtRequestProperties() wins.
+	var derived time.Duration
+	if deadline, ok := c.callDeadline(ctx); ok {
+		if derived = deadlineServerTimeout(deadline); derived > 0 {
+			options = append(
+				[]MgmtOption{mgmtServerTimeout(derived)},
+				options...,
+			)
+		}
 	}
 
 	opt := &mgmtOptions{
@@ -359,6 +584,7 @@ func (c *Client) setMgmtOptions(ctx context.Context, op errors.Op, query Stmt, o
 			return nil, errors.ES(op, errors.KClientArgs, "QueryValues in the the Stmt were incorrect: %s", err).SetNoRetry()
 		}
 	}
+	opt.timeoutNote = serverTimeoutNote(ctx, opt.requestProperties, derived)
 	return opt, nil
 }
 
@@ -379,7 +605,7 @@ func (c *Client) getConn(callType callType, options connOptions) (queryer, error
 			if err := auth.Validate(u.String()); err != nil {
 				return nil, err
 			}
-			iconn, err := newConn(u.String(), auth)
+			iconn, err := c.connect(u.String(), auth)
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,325 @@
+package kusto
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/internal/version"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTransport records the requests it gets and answers them with body.
+type recordingTransport struct {
+	body string
+
+	mu   sync.Mutex
+	reqs []*http.Request
+	// props are the request properties of the requests, in order.
+	props []map[string]interface{}
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var msg struct {
+		Properties map[string]interface{} `json:"properties"`
+	}
+	if req.Body != nil {
+		b, _ := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		_ = json.Unmarshal(b, &msg)
+	}
+
+	r.mu.Lock()
+	r.reqs = append(r.reqs, req)
+	r.props = append(r.props, msg.Properties)
+	r.mu.Unlock()
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(r.body)),
+		Request:    req,
+	}, nil
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	transport := &recordingTransport{body: retryV2Response}
+	httpClient := &http.Client{Transport: transport, Timeout: 90 * time.Second}
+
+	client, err := New("https://mycluster.kusto.windows.net", Authorization{Authorizer: autorest.NullAuthorizer{}}, WithHTTPClient(httpClient))
+	require.NoError(t, err)
+	assert.Same(t, httpClient, client.HTTPClient())
+
+	iter, err := client.Query(context.Background(), "db", NewStmt("T"))
+	require.NoError(t, err)
+	iter.Stop()
+
+	// A deadline that comes before the end of the Timeout of the client sets the server timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	iter, err = client.Query(ctx, "db", NewStmt("T"))
+	require.NoError(t, err)
+	iter.Stop()
+
+	transport.body = retryV1Response
+	iter, err = client.Mgmt(context.Background(), "db", NewStmt(".show ingestion resources"), IngestionEndpoint())
+	require.NoError(t, err)
+	iter.Stop()
+
+	require.Len(t, transport.reqs, 3)
+	assert.Equal(t, "mycluster.kusto.windows.net", transport.reqs[0].URL.Host)
+	assert.Equal(t, "/v2/rest/query", transport.reqs[0].URL.Path)
+	assert.Equal(t, "ingest-mycluster.kusto.windows.net", transport.reqs[2].URL.Host)
+	assert.Equal(t, "/v1/rest/mgmt", transport.reqs[2].URL.Path)
+
+	// The server timeout is set from whichever ends first, the Timeout of the client or the deadline.
+	st := transport.props[0]["Options"].(map[string]interface{})["servertimeout"].(string)
+	assert.True(t, strings.HasPrefix(st, "00:01:28"), st)
+	st = transport.props[1]["Options"].(map[string]interface{})["servertimeout"].(string)
+	assert.True(t, strings.HasPrefix(st, "00:00:28"), st)
+
+	// The client is not changed.
+	assert.Same(t, transport, httpClient.Transport)
+	assert.Equal(t, 90*time.Second, httpClient.Timeout)
+	assert.Nil(t, httpClient.Jar)
+	assert.Nil(t, httpClient.CheckRedirect)
+
+	// Without the option, the client has its own.
+	client, err = New("https://mycluster.kusto.windows.net", Authorization{Authorizer: autorest.NullAuthorizer{}})
+	require.NoError(t, err)
+	assert.Nil(t, client.HTTPClient())
+	assert.NotNil(t, client.conn.(*conn).client)
+}
+
+func TestClientClose(t *testing.T) {
+	t.Parallel()
+
+	transport := &recordingTransport{body: retryV2Response}
+	client, err := New("https://mycluster.kusto.windows.net", Authorization{Authorizer: autorest.NullAuthorizer{}}, WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	var closed, unregistered int
+	client.OnClose(func() { closed++ })
+	unregister := client.OnClose(func() { unregistered++ })
+	unregister()
+
+	iter, err := client.Query(context.Background(), "db", NewStmt("T"))
+	require.NoError(t, err)
+	iter.Stop()
+
+	require.NoError(t, client.Close())
+	assert.Equal(t, 1, closed)
+	assert.Equal(t, 0, unregistered)
+
+	// Calls made after Close fail without a request.
+	_, err = client.Query(context.Background(), "db", NewStmt("T"))
+	assert.Equal(t, ClientClosedErr, err)
+	_, err = client.Mgmt(context.Background(), "db", NewStmt(".show tables"))
+	assert.Equal(t, ClientClosedErr, err)
+	assert.Len(t, transport.reqs, 1)
+
+	// Closing again does nothing, and what is registered after Close is closed at once.
+	require.NoError(t, client.Close())
+	assert.Equal(t, 1, closed)
+	client.OnClose(func() { closed++ })
+	assert.Equal(t, 2, closed)
+}
+
+// showDatabasesResponse is the response of the service to ".show databases".
+const showDatabasesResponse = `{"Tables":[{"TableName":"Table_0","Columns":[
+	{"ColumnName":"DatabaseName","DataType":"String","ColumnType":"string"},
+	{"ColumnName":"PersistentStorage","DataType":"String","ColumnType":"string"},
+	{"ColumnName":"Version","DataType":"String","ColumnType":"string"},
+	{"ColumnName":"IsCurrent","DataType":"Boolean","ColumnType":"bool"},
+	{"ColumnName":"DatabaseAccessMode","DataType":"String","ColumnType":"string"},
+	{"ColumnName":"PrettyName","DataType":"String","ColumnType":"string"},
+	{"ColumnName":"ReservedSlot1","DataType":"Boolean","ColumnType":"bool"},
+	{"ColumnName":"DatabaseId","DataType":"Guid","ColumnType":"guid"},
+	{"ColumnName":"InTransitionTo","DataType":"String","ColumnType":"string"}],
+	"Rows":[
+	["Samples","https://account.blob.core.windows.net/md","v13.2",false,"ReadWrite",null,null,"0ac6a0f2-f1f9-4d87-9e2a-f9a9a5f5c6a1",""],
+	["Telemetry","https://account.blob.core.windows.net/md2","v7.0",false,"ReadOnly","Product telemetry",null,"b6b1c5b2-5c4f-4a0e-8a43-3f6a0f5d6b41",""]]}]}`
+
+func TestMgmtCluster(t *testing.T) {
+	t.Parallel()
+
+	service := &fakeQueryService{status: http.StatusOK, body: showDatabasesResponse}
+	client := service.client(t)
+
+	iter, err := client.MgmtCluster(context.Background(), NewStmt(".show databases"))
+	require.NoError(t, err)
+	defer iter.Stop()
+
+	// The command is sent without a database, to run at the scope of the cluster.
+	assert.Equal(t, ".show databases", service.msg["csl"])
+	assert.NotContains(t, service.msg, "db")
+
+	type database struct {
+		DatabaseName       string
+		PersistentStorage  string
+		IsCurrent          bool
+		DatabaseAccessMode string
+		PrettyName         string
+		DatabaseID         uuid.UUID `kusto:"DatabaseId"`
+	}
+	var got []database
+	err = iter.DoOnRowOrError(func(row *table.Row, e *errors.Error) error {
+		if e != nil {
+			return e
+		}
+		var d database
+		if err := row.ToStruct(&d); err != nil {
+			return err
+		}
+		got = append(got, d)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []database{
+		{DatabaseName: "Samples", PersistentStorage: "https://account.blob.core.windows.net/md", DatabaseAccessMode: "ReadWrite", DatabaseID: uuid.MustParse("0ac6a0f2-f1f9-4d87-9e2a-f9a9a5f5c6a1")},
+		{DatabaseName: "Telemetry", PersistentStorage: "https://account.blob.core.windows.net/md2", DatabaseAccessMode: "ReadOnly", PrettyName: "Product telemetry", DatabaseID: uuid.MustParse("b6b1c5b2-5c4f-4a0e-8a43-3f6a0f5d6b41")},
+	}, got)
+
+	// A command of a database is sent with it.
+	iter, err = client.Mgmt(context.Background(), "Samples", NewStmt(".show tables"))
+	require.NoError(t, err)
+	iter.Stop()
+	assert.Equal(t, "Samples", service.msg["db"])
+
+	// Mgmt() does not run a command at the scope of the cluster when the database is missing.
+	_, err = client.Mgmt(context.Background(), "", NewStmt(".show tables"))
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+	assert.Contains(t, err.Error(), "MgmtCluster()")
+}
+
+func TestClientCloseIdleConnections(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	states := map[net.Conn]http.ConnState{}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, retryV2Response)
+	}))
+	server.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states[c] = s
+	}
+	server.Start()
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	client := &Client{
+		endpoint: server.URL,
+		conn: &conn{
+			auth:     autorest.NullAuthorizer{},
+			endQuery: &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/v2/rest/query"},
+			endMgmt:  &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/v1/rest/mgmt"},
+			client:   server.Client(),
+		},
+	}
+	iter, err := client.Query(context.Background(), "db", NewStmt("T"))
+	require.NoError(t, err)
+	require.NoError(t, iter.Do(func(*table.Row) error { return nil }))
+
+	require.NoError(t, client.Close())
+
+	// The connection the query was sent on is closed, rather than kept for the next call.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(states) == 0 {
+			return false
+		}
+		for _, s := range states {
+			if s != http.StateClosed {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestTracingHeaders(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		options  []Option
+		wantApp  string
+		wantUser string
+	}{
+		{desc: "Defaults", wantApp: filepath.Base(os.Args[0])},
+		{desc: "Application", options: []Option{WithApplicationForTracing("MyApp", "")}, wantApp: "MyApp"},
+		{
+			desc:     "Application version and user",
+			options:  []Option{WithApplicationForTracing("MyApp", "1.2.3"), WithUserForTracing("jdoe")},
+			wantApp:  "MyApp:1.2.3",
+			wantUser: "jdoe",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			transport := &recordingTransport{body: retryV2Response}
+			options := append([]Option{WithHTTPClient(&http.Client{Transport: transport})}, test.options...)
+			client, err := New("https://mycluster.kusto.windows.net", Authorization{Authorizer: autorest.NullAuthorizer{}}, options...)
+			require.NoError(t, err)
+			assert.Equal(t, test.wantApp, client.ApplicationForTracing())
+			assert.Equal(t, test.wantUser, client.UserForTracing())
+
+			iter, err := client.Query(context.Background(), "db", NewStmt("T"))
+			require.NoError(t, err)
+			iter.Stop()
+			transport.body = retryV1Response
+			iter, err = client.Mgmt(context.Background(), "db", NewStmt(".show tables"))
+			require.NoError(t, err)
+			iter.Stop()
+			iter, err = client.Mgmt(context.Background(), "db", NewStmt(".show ingestion resources"), IngestionEndpoint())
+			require.NoError(t, err)
+			iter.Stop()
+
+			require.Len(t, transport.reqs, 3)
+			for _, req := range transport.reqs {
+				assert.Equal(t, "Kusto.Go.Client:"+version.Kusto+"|Runtime.Go:"+runtime.Version(), req.Header.Get("x-ms-client-version"))
+				assert.Equal(t, test.wantApp, req.Header.Get("x-ms-app"))
+				assert.Equal(t, test.wantUser, req.Header.Get("x-ms-user"))
+				_, ok := req.Header["X-Ms-User"]
+				assert.Equal(t, test.wantUser != "", ok)
+			}
+		})
+	}
+
+	// The connection string sets them, and the options win.
+	kcsb, err := NewConnectionStringBuilder("Data Source=https://mycluster.kusto.windows.net;User Token=token;Application Name for Tracing=MyApp;User Name for Tracing=jdoe")
+	require.NoError(t, err)
+	client, err := NewFromConnectionString(kcsb, WithUserForTracing("other"))
+	require.NoError(t, err)
+	assert.Equal(t, "MyApp", client.ApplicationForTracing())
+	assert.Equal(t, "other", client.UserForTracing())
+}
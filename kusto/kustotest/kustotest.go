@@ -0,0 +1,338 @@
+// Package kustotest provides a fake of the kusto.Client, for the unit tests of code that runs queries and commands.
+//
+// The Client is given the results of the calls it will get with On(), as columns and rows of Go values, and
+// returns a kusto.RowIterator over them, whose rows can be decoded with ToStruct() as those of the service. It records
+// the calls it got, with the request properties that their options set, for the tests to check them with Calls().
+//
+//	fake := kustotest.New()
+//	fake.OnCSL("Events | take 2").
+//		Columns("Name:string, Count:long").
+//		Row("a", 1).
+//		Row("b", nil)
+//
+//	iter, err := fake.Query(ctx, "db", kusto.NewStmt("Events | take 2"))
+//
+// The RowIterators of the Client are mocks, see kusto.RowIterator.Mock(), so the Client can only be used in tests.
+package kustotest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// DefaultEndpoint is the endpoint of a Client, unless set by WithEndpoint().
+const DefaultEndpoint = "https://fake.kusto.windows.net"
+
+// Call is a Query() or Mgmt() call that the Client got.
+type Call struct {
+	// Mgmt is set for Mgmt() and MgmtCluster() calls.
+	Mgmt bool
+	// DB is the database of the call, "" for MgmtCluster().
+	DB string
+	// CSL is the text of the query or command.
+	CSL string
+	// Properties are what the call sends to the service besides CSL, such as its request properties.
+	Properties kusto.CallProperties
+}
+
+// Matcher reports whether a Result is the result of call.
+type Matcher func(call Call) bool
+
+// CSL matches the calls whose query or command is text, without the spaces around them.
+func CSL(text string) Matcher {
+	text = strings.TrimSpace(text)
+	return func(call Call) bool {
+		return strings.TrimSpace(call.CSL) == text
+	}
+}
+
+// CSLPrefix matches the calls whose query or command starts with prefix, such as ".show table".
+func CSLPrefix(prefix string) Matcher {
+	return func(call Call) bool {
+		return strings.HasPrefix(strings.TrimSpace(call.CSL), prefix)
+	}
+}
+
+// Client is a fake of the Query() and Mgmt() calls of a kusto.Client. It satisfies ingest.QueryClient, so the
+// ingestion clients can be made with it. It is safe to use concurrently.
+type Client struct {
+	endpoint string
+
+	mu      sync.Mutex
+	results []*Result
+	calls   []Call
+}
+
+// Option is an optional argument to New().
+type Option func(c *Client)
+
+// WithEndpoint sets the endpoint that Endpoint() returns, which is DefaultEndpoint by default.
+func WithEndpoint(endpoint string) Option {
+	return func(c *Client) {
+		c.endpoint = endpoint
+	}
+}
+
+// New returns a Client without results.
+func New(options ...Option) *Client {
+	c := &Client{endpoint: DefaultEndpoint}
+	for _, o := range options {
+		o(c)
+	}
+	return c
+}
+
+// Auth returns a kusto.Authorization that adds no credentials, as the Client does not authenticate. It lets the
+// streaming ingestion clients be made with the Client.
+func (c *Client) Auth() kusto.Authorization {
+	return kusto.Authorization{Authorizer: autorest.NullAuthorizer{}}
+}
+
+// Endpoint returns the endpoint of WithEndpoint(), or DefaultEndpoint.
+func (c *Client) Endpoint() string {
+	return c.endpoint
+}
+
+// On registers a Result for the calls that match, and returns it to be given columns and rows. A call gets the
+// first Result registered that matches it. A call that no Result matches fails.
+func (c *Client) On(match Matcher) *Result {
+	r := &Result{match: match}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results = append(c.results, r)
+	return r
+}
+
+// OnCSL is On(CSL(text)).
+func (c *Client) OnCSL(text string) *Result {
+	return c.On(CSL(text))
+}
+
+// OnIngestionResources registers the results of the commands that the ingestion clients run for their resources,
+// ".get ingestion resources" and ".get kusto identity token". It returns the Result of ".get ingestion resources",
+// which is given a Row() per resource, such as:
+//
+//	fake.OnIngestionResources().
+//		Row("TempStorage", "https://account.blob.core.windows.net/container?sig=secret").
+//		Row("SecuredReadyForAggregationQueue", "https://account.queue.core.windows.net/queue?sig=secret")
+func (c *Client) OnIngestionResources() *Result {
+	c.OnCSL(".get kusto identity token").Columns("AuthorizationContext:string").Row("fake-authorization-context")
+	return c.OnCSL(".get ingestion resources").Columns("ResourceTypeName:string, StorageRoot:string")
+}
+
+// Calls returns the calls that the Client got, in order.
+func (c *Client) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	calls := make([]Call, len(c.calls))
+	copy(calls, c.calls)
+	return calls
+}
+
+// Query returns a RowIterator over the Result of the call. It fails as kusto.Client.Query() does when its options
+// are not valid.
+func (c *Client) Query(ctx context.Context, db string, query kusto.Stmt, options ...kusto.QueryOption) (*kusto.RowIterator, error) {
+	props, err := kusto.MockQueryProperties(ctx, query, options...)
+	if err != nil {
+		return nil, err
+	}
+	return c.call(errors.OpQuery, Call{DB: db, CSL: query.String(), Properties: props})
+}
+
+// Mgmt returns a RowIterator over the Result of the call. It fails as kusto.Client.Mgmt() does when db is empty or
+// its options are not valid.
+func (c *Client) Mgmt(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+	if db == "" {
+		return nil, errors.ES(errors.OpMgmt, errors.KClientArgs, "a Mgmt() call must have a database, use MgmtCluster() for a command of the cluster").SetNoRetry()
+	}
+	return c.mgmt(ctx, db, query, options...)
+}
+
+// MgmtCluster is Mgmt() for the commands of the cluster, whose Call has no DB.
+func (c *Client) MgmtCluster(ctx context.Context, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+	return c.mgmt(ctx, "", query, options...)
+}
+
+func (c *Client) mgmt(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+	props, err := kusto.MockMgmtProperties(ctx, query, options...)
+	if err != nil {
+		return nil, err
+	}
+	return c.call(errors.OpMgmt, Call{Mgmt: true, DB: db, CSL: query.String(), Properties: props})
+}
+
+// call records call and returns a RowIterator over its Result.
+func (c *Client) call(op errors.Op, call Call) (*kusto.RowIterator, error) {
+	c.mu.Lock()
+	c.calls = append(c.calls, call)
+	var result *Result
+	for _, r := range c.results {
+		if r.match(call) {
+			result = r
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if result == nil {
+		return nil, errors.ES(op, errors.KClientArgs, "kustotest: no Result was registered for %q", call.CSL).SetNoRetry()
+	}
+	return result.iterator()
+}
+
+// Result is the result of the calls that a Matcher matches: the columns and the rows of the primary result, and the
+// errors that the calls fail with. A Result is set up with its methods, which can be chained, before the calls that
+// get it, and panic when they are given a value that is not valid, as a test cannot go on with it.
+type Result struct {
+	match Matcher
+
+	columns table.Columns
+	// playback are the rows, the inline errors and the error at the end of the rows, in order.
+	playback []interface{}
+	// err is the error that the calls return, see Error().
+	err error
+}
+
+// inlineError is an error within the rows, see InlineError().
+type inlineError struct {
+	err *errors.Error
+}
+
+// endError is the error that ends the rows, see FailAfterRows().
+type endError struct {
+	err error
+}
+
+// Columns sets the columns of the result, as a Kusto schema such as "Name:string, Count:long", which is the name
+// and the type of each column. They must be set before the rows.
+func (r *Result) Columns(schema string) *Result {
+	var cols table.Columns
+	for _, col := range strings.Split(strings.Trim(strings.TrimSpace(schema), "()"), ",") {
+		parts := strings.Split(col, ":")
+		if len(parts) != 2 {
+			panic(fmt.Sprintf("kustotest: the column %q is not name:type", strings.TrimSpace(col)))
+		}
+		cols = append(cols, table.Column{
+			Name: strings.TrimSpace(parts[0]),
+			Type: types.Column(strings.ToLower(strings.TrimSpace(parts[1]))),
+		})
+	}
+	if err := cols.Validate(); err != nil {
+		panic(fmt.Sprintf("kustotest: the columns %q are not valid: %s", schema, err))
+	}
+	r.columns = cols
+	return r
+}
+
+// Row adds a row of Go values, in the order of the columns. A value is of a type that a struct field of the column
+// can have, such as a string, a time.Time for a datetime column or a value.Kusto of the column type, or an int for
+// an int or a long column. nil is a null value.
+func (r *Result) Row(values ...interface{}) *Result {
+	if r.columns == nil {
+		panic("kustotest: Row() was called before Columns()")
+	}
+	values = append([]interface{}(nil), values...)
+	for i, v := range values {
+		n, ok := v.(int)
+		if !ok || i >= len(r.columns) {
+			continue
+		}
+		switch r.columns[i].Type {
+		case types.Int:
+			values[i] = int32(n)
+		case types.Long:
+			values[i] = int64(n)
+		}
+	}
+	// The row is checked now, rather than by the calls.
+	if err := r.mockRows([]interface{}{values}); err != nil {
+		panic(fmt.Sprintf("kustotest: the row %v is not valid: %s", values, err))
+	}
+	r.playback = append(r.playback, values)
+	return r
+}
+
+// InlineError adds err within the rows, as the service sends when a part of a query failed but the rest of the
+// rows are sent. kusto.RowIterator.NextRowOrError() returns it as its inlineError, and the rows after it.
+func (r *Result) InlineError(err *errors.Error) *Result {
+	if err == nil {
+		panic("kustotest: InlineError() was called with a nil error")
+	}
+	r.playback = append(r.playback, inlineError{err: err})
+	return r
+}
+
+// FailAfterRows ends the rows with err, as the service does when a query fails after it sent rows. The
+// kusto.RowIterator returns err once the rows before it were read.
+func (r *Result) FailAfterRows(err error) *Result {
+	if err == nil {
+		panic("kustotest: FailAfterRows() was called with a nil error")
+	}
+	r.playback = append(r.playback, endError{err: err})
+	return r
+}
+
+// Error makes the calls fail with err, without a kusto.RowIterator, as when the service refuses a query.
+func (r *Result) Error(err error) *Result {
+	r.err = err
+	return r
+}
+
+// iterator returns a RowIterator over r.
+func (r *Result) iterator() (*kusto.RowIterator, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.columns == nil {
+		return nil, errors.ES(errors.OpQuery, errors.KClientArgs, "kustotest: the Result has no Columns()").SetNoRetry()
+	}
+
+	m, err := kusto.NewMockRows(r.columns)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.playbackTo(m, r.playback); err != nil {
+		return nil, err
+	}
+	iter := &kusto.RowIterator{}
+	if err := iter.Mock(m); err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+// mockRows checks that playback can be replayed with the columns of r.
+func (r *Result) mockRows(playback []interface{}) error {
+	m, err := kusto.NewMockRows(r.columns)
+	if err != nil {
+		return err
+	}
+	return r.playbackTo(m, playback)
+}
+
+// playbackTo adds playback to m.
+func (r *Result) playbackTo(m *kusto.MockRows, playback []interface{}) error {
+	for _, p := range playback {
+		var err error
+		switch p := p.(type) {
+		case []interface{}:
+			err = m.Values(p...)
+		case inlineError:
+			err = m.InlineError(p.err)
+		case endError:
+			err = m.Error(p.err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package kustotest
+
+import (
+	"context"
+	goErrors "errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ ingest.QueryClient = (*Client)(nil)
+
+type event struct {
+	Name     string
+	Count    *int64
+	Level    int32
+	Ratio    float64
+	When     time.Time
+	Took     time.Duration
+	ID       uuid.UUID `kusto:"Id"`
+	Tags     []string
+	Verified bool
+}
+
+func TestQuery(t *testing.T) {
+	t.Parallel()
+
+	when := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	id := uuid.New()
+	fake := New()
+	fake.OnCSL("Events | take 2").
+		Columns("(Name:string, Count:long, Level:int, Ratio:real, When:datetime, Took:timespan, Id:guid, Tags:dynamic, Verified:bool)").
+		Row("a", 1, 2, 0.5, when, time.Minute, id, []string{"x", "y"}, true).
+		Row("b", nil, nil, nil, nil, nil, nil, nil, nil)
+
+	// A call gets the first Result that matches it.
+	fake.On(CSLPrefix("Events")).Error(goErrors.New("not this one"))
+
+	var got []event
+	for i := 0; i < 2; i++ {
+		iter, err := fake.Query(context.Background(), "db", kusto.NewStmt("Events | take 2 "))
+		require.NoError(t, err)
+		got = nil
+		err = iter.DoOnRowOrError(func(row *table.Row, e *errors.Error) error {
+			require.Nil(t, e)
+			var ev event
+			if err := row.ToStruct(&ev); err != nil {
+				return err
+			}
+			got = append(got, ev)
+			return nil
+		})
+		require.NoError(t, err)
+		iter.Stop()
+	}
+
+	one := int64(1)
+	assert.Equal(t, []event{
+		{Name: "a", Count: &one, Level: 2, Ratio: 0.5, When: when, Took: time.Minute, ID: id, Tags: []string{"x", "y"}, Verified: true},
+		{Name: "b"},
+	}, got, "every call replays the rows")
+
+	_, err := fake.Query(context.Background(), "db", kusto.NewStmt("Events | count"))
+	assert.EqualError(t, err, "not this one")
+
+	_, err = fake.Query(context.Background(), "db", kusto.NewStmt("Other"))
+	assert.Equal(t, errors.KClientArgs, errors.KindOf(err), "a call without a Result fails")
+
+	calls := fake.Calls()
+	require.Len(t, calls, 4)
+	assert.Equal(t, "db", calls[0].DB)
+	assert.Equal(t, "Events | take 2 ", calls[0].CSL)
+	assert.False(t, calls[0].Mgmt)
+	assert.Equal(t, "Other", calls[3].CSL)
+}
+
+func TestPartialFailures(t *testing.T) {
+	t.Parallel()
+
+	shardErr := errors.ES(errors.OpQuery, errors.KInternal, "a shard failed")
+	queryErr := errors.ES(errors.OpQuery, errors.KLimitsExceeded, "the query ran out of memory")
+	fake := New()
+	fake.OnCSL("T").
+		Columns("x:long").
+		Row(1).
+		InlineError(shardErr).
+		Row(2).
+		FailAfterRows(queryErr)
+
+	iter, err := fake.Query(context.Background(), "db", kusto.NewStmt("T"))
+	require.NoError(t, err)
+	defer iter.Stop()
+
+	cols, err := iter.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, table.Columns{{Name: "x", Type: types.Long}}, cols)
+
+	var rows int
+	var inline []*errors.Error
+	for {
+		row, inlineErr, err := iter.NextRowOrError()
+		if err != nil {
+			assert.True(t, goErrors.Is(err, queryErr))
+			break
+		}
+		if inlineErr != nil {
+			inline = append(inline, inlineErr)
+			continue
+		}
+		rows++
+		assert.NotNil(t, row)
+	}
+	assert.Equal(t, 2, rows)
+	assert.Equal(t, []*errors.Error{shardErr}, inline)
+
+	// Next() fails on the error within the rows.
+	iter, err = fake.Query(context.Background(), "db", kusto.NewStmt("T"))
+	require.NoError(t, err)
+	defer iter.Stop()
+	_, err = iter.Next()
+	require.NoError(t, err)
+	_, err = iter.Next()
+	assert.True(t, goErrors.Is(err, shardErr))
+}
+
+func TestCallProperties(t *testing.T) {
+	t.Parallel()
+
+	fake := New()
+	fake.On(func(call Call) bool { return true }).Columns("x:long")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	defs, err := kusto.NewDefinitions().With(kusto.ParamTypes{"name": kusto.ParamType{Type: types.String}})
+	require.NoError(t, err)
+	params, err := kusto.NewParameters().With(kusto.QueryValues{"name": "a"})
+	require.NoError(t, err)
+	props := kusto.NewClientRequestProperties().SetNoTruncation().SetClientRequestID("my-id")
+	stmt, err := kusto.NewStmt("T | where Name == name").WithDefinitions(defs)
+	require.NoError(t, err)
+
+	_, err = fake.Query(ctx, "db", stmt, kusto.QueryParameters(params), kusto.QueryRequestProperties(props))
+	require.NoError(t, err)
+	_, err = fake.Mgmt(context.Background(), "db", kusto.NewStmt(".show tables"), kusto.IngestionEndpoint())
+	require.NoError(t, err)
+	_, err = fake.MgmtCluster(context.Background(), kusto.NewStmt(".show databases"))
+	require.NoError(t, err)
+
+	// The calls fail as those of a kusto.Client do.
+	_, err = fake.Mgmt(context.Background(), "", kusto.NewStmt(".show tables"))
+	assert.Error(t, err)
+	_, err = fake.Mgmt(context.Background(), "db", stmt)
+	assert.Error(t, err)
+	_, err = fake.Query(context.Background(), "db", stmt, kusto.QueryRequestProperties(kusto.NewClientRequestProperties().SetServerTimeout(2*time.Hour)))
+	assert.Error(t, err)
+
+	calls := fake.Calls()
+	require.Len(t, calls, 3)
+	query := calls[0].Properties
+	assert.Equal(t, map[string]string{"name": "a"}, query.Parameters)
+	assert.Equal(t, "my-id", query.ClientRequestID)
+	assert.Equal(t, true, query.Options["notruncation"])
+	assert.Contains(t, query.Options, "servertimeout", "the server timeout is set from the deadline")
+	assert.False(t, query.IngestionEndpoint)
+
+	assert.Equal(t, Call{Mgmt: true, DB: "db", CSL: ".show tables", Properties: calls[1].Properties}, calls[1])
+	assert.True(t, calls[1].Properties.IngestionEndpoint)
+	assert.Equal(t, "", calls[2].DB)
+	assert.True(t, calls[2].Mgmt)
+}
+
+func TestColumnsAndRows(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc  string
+		setup func(r *Result)
+	}{
+		{desc: "Not name:type", setup: func(r *Result) { r.Columns("x") }},
+		{desc: "Unknown type", setup: func(r *Result) { r.Columns("x:table") }},
+		{desc: "Row before Columns", setup: func(r *Result) { r.Row(1) }},
+		{desc: "Too few values", setup: func(r *Result) { r.Columns("x:long, y:string").Row(1) }},
+		{desc: "Wrong type", setup: func(r *Result) { r.Columns("x:long").Row("1") }},
+		{desc: "Nil inline error", setup: func(r *Result) { r.Columns("x:long").InlineError(nil) }},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Panics(t, func() { test.setup(New().OnCSL("T")) })
+		})
+	}
+}
+
+func TestIngestionResources(t *testing.T) {
+	t.Parallel()
+
+	fake := New()
+	fake.OnIngestionResources().
+		Row("TempStorage", "https://account.blob.core.windows.net/container?sig=secret").
+		Row("SecuredReadyForAggregationQueue", "https://account.queue.core.windows.net/queue?sig=secret")
+
+	ingestion, err := ingest.New(fake, "db", "table")
+	require.NoError(t, err)
+	defer ingestion.Close()
+
+	require.NoError(t, ingestion.RefreshResources(context.Background()))
+	diag, err := ingestion.Diagnostics(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://account.blob.core.windows.net/container"}, diag.Containers)
+	assert.Equal(t, []string{"https://account.queue.core.windows.net/queue"}, diag.Queues)
+
+	var commands []string
+	for _, call := range fake.Calls() {
+		assert.True(t, call.Mgmt)
+		commands = append(commands, call.CSL)
+	}
+	assert.Contains(t, commands, ".get ingestion resources")
+}
+
+func TestRowsAreStopped(t *testing.T) {
+	t.Parallel()
+
+	fake := New()
+	fake.OnCSL("T").Columns("x:long").Row(1)
+	iter, err := fake.Query(context.Background(), "db", kusto.NewStmt("T"))
+	require.NoError(t, err)
+	iter.Stop()
+	_, _, err = iter.NextRowOrError()
+	assert.True(t, goErrors.Is(err, context.Canceled))
+	assert.NotEqual(t, io.EOF, err)
+}
@@ -0,0 +1,96 @@
+package kusto
+
+// managed_identity.go holds the sign in as a managed identity, with tokens from the Azure Instance Metadata Service.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+)
+
+// imdsTokenEndpoint is the endpoint of the Azure Instance Metadata Service that gives the tokens of managed identities.
+const imdsTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// imdsClient is the client for the requests to the Azure Instance Metadata Service, which is local to the host
+// and answers quickly if it is there at all.
+var imdsClient = &http.Client{Timeout: 30 * time.Second}
+
+// ManagedIdentityConfig signs in as a managed identity of the Azure VM, AKS pod or other Azure host the client runs
+// on. Leave the fields empty to use the system-assigned identity, or set ClientID or ResourceID, but not both, to use
+// a user-assigned one.
+type ManagedIdentityConfig struct {
+	// ClientID is the client id of a user-assigned identity.
+	ClientID string
+	// ResourceID is the Azure resource id of a user-assigned identity, such as
+	// "/subscriptions/<sub>/resourceGroups/<group>/providers/Microsoft.ManagedIdentity/userAssignedIdentities/<name>".
+	ResourceID string
+
+	// endpoint replaces imdsTokenEndpoint in tests.
+	endpoint string
+}
+
+func (c *ManagedIdentityConfig) validate() error {
+	if c.ClientID != "" && c.ResourceID != "" {
+		return errors.ES(errors.OpServConn, errors.KClientArgs, "ManagedIdentityConfig can set ClientID or ResourceID, but not both").SetNoRetry()
+	}
+	return nil
+}
+
+// fetchToken implements fetchToken with a request to the Azure Instance Metadata Service. Failures are of kind
+// errors.KAuth.
+func (c *ManagedIdentityConfig) fetchToken(ctx context.Context, resource string) (string, time.Time, error) {
+	endpoint := imdsTokenEndpoint
+	if c.endpoint != "" {
+		endpoint = c.endpoint
+	}
+
+	qv := url.Values{}
+	qv.Set("api-version", "2018-02-01")
+	qv.Set("resource", resource)
+	if c.ClientID != "" {
+		qv.Set("client_id", c.ClientID)
+	}
+	if c.ResourceID != "" {
+		qv.Set("msi_res_id", c.ResourceID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+qv.Encode(), nil)
+	if err != nil {
+		return "", time.Time{}, errors.E(errors.OpServConn, errors.KAuth, err)
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := imdsClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, errors.E(errors.OpServConn, errors.KAuth, fmt.Errorf("could not get a managed identity token, the client may not run on Azure: %w", err))
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, errors.E(errors.OpServConn, errors.KAuth, fmt.Errorf("could not read the managed identity token: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "could not get a managed identity token, the metadata service returned %s: %s", resp.Status, body)
+	}
+
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresOn   json.Number `json:"expires_on"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "the metadata service returned a managed identity token that could not be read")
+	}
+	secs, err := strconv.ParseInt(token.ExpiresOn.String(), 10, 64)
+	if err != nil {
+		return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "the metadata service returned a managed identity token with a bad expires_on(%s)", token.ExpiresOn)
+	}
+	return token.AccessToken, time.Unix(secs, 0), nil
+}
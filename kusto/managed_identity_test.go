@@ -0,0 +1,130 @@
+package kusto
+
+import (
+	"context"
+	goErrors "errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIMDS serves managed identity tokens that expire after the next of lifetimes, and records the requests it got.
+type fakeIMDS struct {
+	lifetimes []time.Duration
+	status    int
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (f *fakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r)
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		fmt.Fprint(w, `{"error":"invalid_request","error_description":"Identity not found"}`)
+		return
+	}
+	n := len(f.requests)
+	lifetime := f.lifetimes[len(f.lifetimes)-1]
+	if n <= len(f.lifetimes) {
+		lifetime = f.lifetimes[n-1]
+	}
+	fmt.Fprintf(w, `{"access_token":"token%d","expires_on":"%d","resource":%q,"token_type":"Bearer"}`, n, time.Now().Add(lifetime).Unix(), r.URL.Query().Get("resource"))
+}
+
+func TestManagedIdentity(t *testing.T) {
+	t.Parallel()
+
+	// The first token is about to expire, so the client gets a new one for the next call and keeps it.
+	imds := &fakeIMDS{lifetimes: []time.Duration{time.Minute, time.Hour}}
+	imdsServer := httptest.NewServer(imds)
+	defer imdsServer.Close()
+
+	var (
+		mu      sync.Mutex
+		headers []string
+	)
+	client := testClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Write([]byte(retryV2Response))
+	}))
+
+	a := Authorization{ManagedIdentity: &ManagedIdentityConfig{ClientID: "client", endpoint: imdsServer.URL}}
+	require.NoError(t, a.Validate("https://mycluster.kusto.windows.net"))
+	client.conn.(*conn).auth = a.Authorizer
+
+	for i := 0; i < 3; i++ {
+		iter, err := client.Query(context.Background(), "db", NewStmt("T"))
+		require.NoError(t, err)
+		iter.Stop()
+	}
+
+	assert.Equal(t, []string{"Bearer token1", "Bearer token2", "Bearer token2"}, headers)
+	require.Len(t, imds.requests, 2)
+	for _, r := range imds.requests {
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		assert.Equal(t, "https://mycluster.kusto.windows.net", r.URL.Query().Get("resource"))
+		assert.Equal(t, "client", r.URL.Query().Get("client_id"))
+		assert.Empty(t, r.URL.Query().Get("msi_res_id"))
+	}
+}
+
+func TestManagedIdentityErrors(t *testing.T) {
+	t.Parallel()
+
+	imds := &fakeIMDS{status: http.StatusBadRequest}
+	imdsServer := httptest.NewServer(imds)
+	defer imdsServer.Close()
+
+	client := testClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the call was sent without a token")
+	}))
+	a := Authorization{ManagedIdentity: &ManagedIdentityConfig{ResourceID: "/identity", endpoint: imdsServer.URL}}
+	require.NoError(t, a.Validate("https://mycluster.kusto.windows.net"))
+	client.conn.(*conn).auth = a.Authorizer
+
+	_, err := client.Query(context.Background(), "db", NewStmt("T"))
+	require.Error(t, err)
+	var e *errors.Error
+	require.True(t, goErrors.As(err, &e))
+	assert.Equal(t, errors.KAuth, e.Kind)
+	assert.Contains(t, err.Error(), "Identity not found")
+	assert.Equal(t, "/identity", imds.requests[0].URL.Query().Get("msi_res_id"))
+
+	// The metadata service cannot be reached.
+	imdsServer.Close()
+	_, _, err = (&ManagedIdentityConfig{endpoint: imdsServer.URL}).fetchToken(context.Background(), "https://mycluster.kusto.windows.net")
+	require.True(t, goErrors.As(err, &e))
+	assert.Equal(t, errors.KAuth, e.Kind)
+
+	a = Authorization{ManagedIdentity: &ManagedIdentityConfig{ClientID: "client", ResourceID: "/identity"}}
+	assert.Error(t, a.Validate("https://mycluster.kusto.windows.net"))
+	a = Authorization{ManagedIdentity: &ManagedIdentityConfig{}, Authorizer: client.conn.(*conn).auth}
+	assert.Error(t, a.Validate("https://mycluster.kusto.windows.net"))
+}
+
+func TestManagedIdentityClientAuth(t *testing.T) {
+	t.Parallel()
+
+	// The ingest package makes its own connections from Client.Auth(), which must sign in for their endpoint.
+	client, err := New("https://mycluster.kusto.windows.net", Authorization{ManagedIdentity: &ManagedIdentityConfig{}})
+	require.NoError(t, err)
+
+	a := client.Auth()
+	require.NotNil(t, a.ManagedIdentity)
+	require.NoError(t, a.Validate("https://ingest-mycluster.kusto.windows.net"))
+	assert.Equal(t, "https://ingest-mycluster.kusto.windows.net", a.Authorizer.(*tokenAuthorizer).resource)
+	assert.Equal(t, "https://mycluster.kusto.windows.net", client.conn.(*conn).auth.(*tokenAuthorizer).resource)
+}
@@ -11,6 +11,8 @@ type mgmtOptions struct {
 	requestProperties *requestProperties
 	canWrite          bool
 	queryIngestion    bool
+	// timeoutNote is added to the error of a call that timed out, see serverTimeoutNote().
+	timeoutNote string
 }
 
 // AllowWrite allows a query that attempts to modify data in a table.
@@ -30,6 +32,14 @@ func IngestionEndpoint() MgmtOption {
 	}
 }
 
+// MgmtRequestProperties sets the ClientRequestProperties of the Mgmt() call. They win over the server timeout that
+// the client sets from the deadline of the context.
+func MgmtRequestProperties(p *ClientRequestProperties) MgmtOption {
+	return func(m *mgmtOptions) error {
+		return p.apply(m.requestProperties)
+	}
+}
+
 // mgmtServerTimeout is the amount of time the server will allow a call to take.
 // NOTE: I have made the serverTimeout private. For the moment, I'm going to use the context.Context timer
 // to set timeouts via this private method.
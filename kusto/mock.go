@@ -64,13 +64,27 @@ func NewMockRows(columns table.Columns) (*MockRows, error) {
 	return &MockRows{columns: columns}, nil
 }
 
+// inlineError is an error within the rows of MockRows, see InlineError().
+type inlineError struct {
+	err *errors.Error
+}
+
 func (m *MockRows) nextRow() (*table.Row, error) {
+	row, inlineErr, err := m.nextRowOrError()
+	if inlineErr != nil {
+		return nil, inlineErr
+	}
+	return row, err
+}
+
+// nextRowOrError returns the next row, or the next error within the rows, as RowIterator.NextRowOrError() does.
+func (m *MockRows) nextRowOrError() (*table.Row, *errors.Error, error) {
 	if m.err != nil {
-		return nil, m.err
+		return nil, nil, m.err
 	}
 
 	if m.position > len(m.playback)-1 {
-		return nil, io.EOF
+		return nil, nil, io.EOF
 	}
 
 	defer func() { m.position++ }()
@@ -82,10 +96,12 @@ func (m *MockRows) nextRow() (*table.Row, error) {
 			ColumnTypes: m.columns,
 			Values:      value.Values(t),
 			Op:          errors.OpQuery,
-		}, nil
+		}, nil, nil
+	case inlineError:
+		return nil, t.err, nil
 	case error:
 		m.err = t
-		return nil, t
+		return nil, nil, t
 	default:
 		panic(fmt.Sprintf("bug, received a playback type we don't support: %T", v))
 	}
@@ -122,6 +138,41 @@ func (m *MockRows) Struct(p interface{}) error {
 	return m.Row(row)
 }
 
+// Values adds a row of Go values, in the order of the columns, that will be replayed in a RowIterator. A value
+// is of a type that a struct field of the column can have with Struct(), such as an int64 for a long column, a
+// time.Time for a datetime column, or a value.Kusto of the column type. nil is a null value.
+func (m *MockRows) Values(values ...interface{}) error {
+	if len(values) != len(m.columns) {
+		return fmt.Errorf("the length of columns(%d) is not the same as the length of the values(%d)", len(m.columns), len(values))
+	}
+
+	row, err := defaultRow(m.columns)
+	if err != nil {
+		return err
+	}
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		if err := fieldConvert(columnData{column: m.columns[i], position: i}, reflect.ValueOf(v), row); err != nil {
+			return fmt.Errorf("column %q: %w", m.columns[i].Name, err)
+		}
+	}
+
+	return m.Row(row)
+}
+
+// InlineError adds an error within the rows, as the service sends when a part of a query failed but the rest of
+// the rows are sent, such as with ClientRequestProperties.SetDeferPartialQueryFailures().
+// RowIterator.NextRowOrError() returns it as its inlineError, and the rows after it are replayed.
+func (m *MockRows) InlineError(err *errors.Error) error {
+	if err == nil {
+		return fmt.Errorf("cannot add a nil error")
+	}
+	m.playback = append(m.playback, inlineError{err: err})
+	return nil
+}
+
 // Error adds an error into the result stream. Nothing else added to this stream will matter
 // once this is called.
 func (m *MockRows) Error(err error) error {
@@ -159,3 +210,47 @@ func NewMockClient() *Client {
 		mu:         sync.Mutex{},
 	}
 }
+
+// CallProperties are what a Query() or Mgmt() call sends to the service besides its query, as set by its options and
+// the deadline of its context. Fakes of the Client record them, such as the Client of the kustotest package.
+type CallProperties struct {
+	// Options are the request properties by name, such as "servertimeout", with durations as Kusto timespans.
+	Options map[string]interface{}
+	// Parameters are the values of the query parameters by name, as Kusto literals, such as long(1), except that
+	// strings are their text.
+	Parameters map[string]string
+	// ClientRequestID is the id of ClientRequestProperties.SetClientRequestID(), "" if it was not set.
+	ClientRequestID string
+	// IngestionEndpoint is set if the command is sent to the ingestion endpoint, see IngestionEndpoint().
+	IngestionEndpoint bool
+}
+
+// MockQueryProperties returns the CallProperties that Query() sends for query in ctx with options, or the error
+// that Query() returns if they are not valid. It is for fakes of the Client.
+func MockQueryProperties(ctx context.Context, query Stmt, options ...QueryOption) (CallProperties, error) {
+	opts, err := (&Client{}).setQueryOptions(ctx, errors.OpQuery, query, options...)
+	if err != nil {
+		return CallProperties{}, err
+	}
+	return callProperties(opts.requestProperties), nil
+}
+
+// MockMgmtProperties returns the CallProperties that Mgmt() sends for query in ctx with options, or the error that
+// Mgmt() returns if they are not valid. It is for fakes of the Client.
+func MockMgmtProperties(ctx context.Context, query Stmt, options ...MgmtOption) (CallProperties, error) {
+	if !query.params.IsZero() || !query.defs.IsZero() {
+		return CallProperties{}, errors.ES(errors.OpMgmt, errors.KClientArgs, "a Mgmt() call cannot accept a Stmt object that has Definitions or Parameters attached")
+	}
+	opts, err := (&Client{}).setMgmtOptions(ctx, errors.OpMgmt, query, options...)
+	if err != nil {
+		return CallProperties{}, err
+	}
+	props := callProperties(opts.requestProperties)
+	props.IngestionEndpoint = opts.queryIngestion
+	return props, nil
+}
+
+// callProperties returns the CallProperties of rp.
+func callProperties(rp *requestProperties) CallProperties {
+	return CallProperties{Options: rp.Options, Parameters: rp.Parameters, ClientRequestID: rp.ClientRequestID}
+}
@@ -187,3 +187,54 @@ func TestRow(t *testing.T) {
 		}
 	}
 }
+
+func TestValues(t *testing.T) {
+	cols := table.Columns{{Name: "s", Type: types.String}, {Name: "l", Type: types.Long}, {Name: "d", Type: types.Dynamic}}
+
+	tests := []struct {
+		desc   string
+		values []interface{}
+		want   value.Values
+		err    bool
+	}{
+		{
+			desc:   "Go values",
+			values: []interface{}{"a", int64(1), map[string]int{"x": 1}},
+			want:   value.Values{value.String{Value: "a", Valid: true}, value.Long{Value: 1, Valid: true}, value.Dynamic{Value: []byte(`{"x":1}`), Valid: true}},
+		},
+		{
+			desc:   "Nulls and Kusto values",
+			values: []interface{}{nil, value.Long{Value: 2, Valid: true}, nil},
+			want:   value.Values{value.String{}, value.Long{Value: 2, Valid: true}, value.Dynamic{}},
+		},
+		{desc: "Too few values", values: []interface{}{"a"}, err: true},
+		{desc: "Wrong type", values: []interface{}{"a", "1", nil}, err: true},
+	}
+
+	for _, test := range tests {
+		m, err := NewMockRows(cols)
+		if err != nil {
+			panic(err)
+		}
+		err = m.Values(test.values...)
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestValues(%s): got err == nil, want err != nil", test.desc)
+			continue
+		case err != nil && !test.err:
+			t.Errorf("TestValues(%s): got err == %s, want err == nil", test.desc, err)
+			continue
+		case err != nil:
+			continue
+		}
+
+		r, err := m.nextRow()
+		if err != nil {
+			t.Errorf("TestValues(%s): nextRow() got err == %s, want err == nil", test.desc, err)
+			continue
+		}
+		if diff := pretty.Compare(test.want, r.Values); diff != "" {
+			t.Errorf("TestValues(%s): -want/+got:\n%s", test.desc, diff)
+		}
+	}
+}
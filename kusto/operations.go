@@ -0,0 +1,185 @@
+package kusto
+
+// operations.go holds the waiting for the async operations of management commands, such as ".export async".
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/unsafe"
+	"github.com/google/uuid"
+)
+
+// The states of an operation, as the State column of ".show operations" holds them.
+const (
+	OperationInProgress         = "InProgress"
+	OperationScheduled          = "Scheduled"
+	OperationCompleted          = "Completed"
+	OperationPartiallySucceeded = "PartiallySucceeded"
+	OperationFailed             = "Failed"
+	OperationBadInput           = "BadInput"
+	OperationThrottled          = "Throttled"
+	OperationAbandoned          = "Abandoned"
+	OperationCanceled           = "Canceled"
+)
+
+// The default intervals between the polls of WaitForOperation().
+const (
+	defaultOperationPoll    = time.Second
+	defaultOperationMaxPoll = 30 * time.Second
+)
+
+// OperationResult is the row of ".show operations" for an operation.
+type OperationResult struct {
+	// ID is the id of the operation, which the async command returned.
+	ID uuid.UUID `kusto:"OperationId"`
+	// Operation is the name of the command, such as "DataExportToFile".
+	Operation string
+	// State is the state of the operation, such as OperationCompleted.
+	State string
+	// Status is the status of the operation, which holds the detail of its failure if it failed.
+	Status string
+	// ShouldRetry tells if the operation failed in a way that running the command again can succeed.
+	ShouldRetry bool
+	// Duration is how long the operation ran.
+	Duration time.Duration
+	// StartedOn and LastUpdatedOn are when the operation started and when its state last changed.
+	StartedOn     time.Time
+	LastUpdatedOn time.Time
+	// Database is the database that the operation ran in.
+	Database string
+	// RootActivityID is the activity id of the command, which identifies it in the service's logs.
+	RootActivityID uuid.UUID `kusto:"RootActivityId"`
+}
+
+// Done tells if the operation finished, whether it succeeded or not.
+func (o OperationResult) Done() bool {
+	return o.State != "" && o.State != OperationInProgress && o.State != OperationScheduled
+}
+
+// Succeeded tells if the operation completed.
+func (o OperationResult) Succeeded() bool {
+	return o.State == OperationCompleted
+}
+
+// OperationError is returned by WaitForOperation() for an operation that finished in a state other than
+// OperationCompleted.
+type OperationError struct {
+	// Result is the row of the operation, whose Status holds the detail of the failure.
+	Result OperationResult
+}
+
+// Error implements error.
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("operation %s(%s) finished as %s: %s", e.Result.ID, e.Result.Operation, e.Result.State, e.Result.Status)
+}
+
+// Retry tells if running the command again can succeed, as the ShouldRetry column of the operation tells.
+func (e *OperationError) Retry() bool {
+	return e.Result.ShouldRetry
+}
+
+// Mgmter runs management commands, such as a *Client does.
+type Mgmter interface {
+	Mgmt(ctx context.Context, db string, query Stmt, options ...MgmtOption) (*RowIterator, error)
+}
+
+type waitOptions struct {
+	poll, maxPoll time.Duration
+}
+
+// WaitOption is an optional argument to WaitForOperation().
+type WaitOption func(w *waitOptions) error
+
+// WaitPollInterval sets the interval between the polls of WaitForOperation(), which starts at initial and doubles
+// after each poll up to max. The defaults are 1 and 30 seconds.
+func WaitPollInterval(initial, max time.Duration) WaitOption {
+	return func(w *waitOptions) error {
+		if initial <= 0 || max < initial {
+			return errors.ES(errors.OpMgmt, errors.KClientArgs, "WaitPollInterval(%s, %s): initial must be positive, and max at least initial", initial, max).SetNoRetry()
+		}
+		w.poll, w.maxPoll = initial, max
+		return nil
+	}
+}
+
+// WaitForOperation polls ".show operations" for the operation operationID, which an async command such as
+// ".export async" returned, until it finishes or ctx is done. It returns the row of the operation, and an
+// *OperationError if the operation finished in a state other than OperationCompleted, such as OperationFailed. When
+// ctx is done, it returns an error of Kind errors.KTimeout that wraps ctx.Err(), even if a poll was in flight.
+func WaitForOperation(ctx context.Context, client Mgmter, db string, operationID uuid.UUID, options ...WaitOption) (OperationResult, error) {
+	opts := waitOptions{poll: defaultOperationPoll, maxPoll: defaultOperationMaxPoll}
+	for _, o := range options {
+		if err := o(&opts); err != nil {
+			return OperationResult{}, err
+		}
+	}
+
+	stmt := NewStmt(".show operations ", UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).UnsafeAdd(operationID.String())
+	poll := opts.poll
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return OperationResult{}, waitCanceled(ctx, operationID)
+		case <-timer.C:
+		}
+
+		result, err := showOperation(ctx, client, db, stmt)
+		if err != nil {
+			// The poll fails with the error of its request when ctx is done while it is in flight.
+			if ctx.Err() != nil {
+				return OperationResult{}, waitCanceled(ctx, operationID)
+			}
+			return OperationResult{}, err
+		}
+		if result.Done() {
+			if !result.Succeeded() {
+				return result, &OperationError{Result: result}
+			}
+			return result, nil
+		}
+
+		// The operation is in progress, or not listed yet right after the command.
+		timer.Reset(poll)
+		if poll *= 2; poll > opts.maxPoll {
+			poll = opts.maxPoll
+		}
+	}
+}
+
+// waitCanceled returns the error of WaitForOperation() when ctx is done.
+func waitCanceled(ctx context.Context, operationID uuid.UUID) error {
+	return errors.E(errors.OpMgmt, errors.KTimeout, fmt.Errorf("stopped waiting for operation %s: %w", operationID, ctx.Err()))
+}
+
+// showOperation runs stmt, the ".show operations" command of an operation, and returns the row of the operation,
+// or a zero OperationResult if it is not listed.
+func showOperation(ctx context.Context, client Mgmter, db string, stmt Stmt) (OperationResult, error) {
+	iter, err := client.Mgmt(ctx, db, stmt)
+	if err != nil {
+		return OperationResult{}, err
+	}
+	defer iter.Stop()
+
+	// If the operation has more than one row, the one updated last is the current one.
+	var result OperationResult
+	err = iter.DoOnRowOrError(func(row *table.Row, e *errors.Error) error {
+		if e != nil {
+			return e
+		}
+		var r OperationResult
+		if err := row.ToStruct(&r); err != nil {
+			return err
+		}
+		if result.LastUpdatedOn.IsZero() || !r.LastUpdatedOn.Before(result.LastUpdatedOn) {
+			result = r
+		}
+		return nil
+	})
+	return result, err
+}
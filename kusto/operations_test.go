@@ -0,0 +1,146 @@
+package kusto
+
+import (
+	"context"
+	goErrors "errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// operationsService answers ".show operations" with the states, one per poll, and then with the last one.
+type operationsService struct {
+	states []string
+	status string
+
+	polls int32
+}
+
+func (o *operationsService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := int(atomic.AddInt32(&o.polls, 1))
+	state := o.states[len(o.states)-1]
+	if n <= len(o.states) {
+		state = o.states[n-1]
+	}
+	var rows string
+	if state != "" {
+		rows = fmt.Sprintf(`["3f6a0f5d-6b41-4a0e-8a43-b6b1c5b25c4f","DataExportToFile","KNode","2021-03-04T05:06:07Z","2021-03-04T05:06:09Z","00:00:02","%s","%s","b6b1c5b2-5c4f-4a0e-8a43-3f6a0f5d6b41",%t,"db"]`,
+			state, o.status, state == OperationThrottled)
+	}
+	fmt.Fprintf(w, `{"Tables":[{"TableName":"Table_0","Columns":[
+		{"ColumnName":"OperationId","DataType":"Guid","ColumnType":"guid"},
+		{"ColumnName":"Operation","DataType":"String","ColumnType":"string"},
+		{"ColumnName":"NodeId","DataType":"String","ColumnType":"string"},
+		{"ColumnName":"StartedOn","DataType":"DateTime","ColumnType":"datetime"},
+		{"ColumnName":"LastUpdatedOn","DataType":"DateTime","ColumnType":"datetime"},
+		{"ColumnName":"Duration","DataType":"TimeSpan","ColumnType":"timespan"},
+		{"ColumnName":"State","DataType":"String","ColumnType":"string"},
+		{"ColumnName":"Status","DataType":"String","ColumnType":"string"},
+		{"ColumnName":"RootActivityId","DataType":"Guid","ColumnType":"guid"},
+		{"ColumnName":"ShouldRetry","DataType":"Boolean","ColumnType":"bool"},
+		{"ColumnName":"Database","DataType":"String","ColumnType":"string"}],
+		"Rows":[%s]}]}`, rows)
+}
+
+func TestWaitForOperation(t *testing.T) {
+	t.Parallel()
+
+	id := uuid.MustParse("3f6a0f5d-6b41-4a0e-8a43-b6b1c5b25c4f")
+	poll := WaitPollInterval(time.Millisecond, 4*time.Millisecond)
+
+	tests := []struct {
+		desc      string
+		states    []string
+		status    string
+		wantState string
+		wantPolls int32
+		wantRetry bool
+	}{
+		{desc: "Completed", states: []string{OperationInProgress, OperationInProgress, OperationCompleted}, wantState: OperationCompleted, wantPolls: 3},
+		{desc: "Not listed yet", states: []string{"", OperationCompleted}, wantState: OperationCompleted, wantPolls: 2},
+		{desc: "Failed", states: []string{OperationInProgress, OperationFailed}, status: "The blob could not be written", wantState: OperationFailed, wantPolls: 2},
+		{desc: "Throttled", states: []string{OperationThrottled}, status: "Too many exports", wantState: OperationThrottled, wantPolls: 1, wantRetry: true},
+		{desc: "Abandoned", states: []string{OperationScheduled, OperationAbandoned}, wantState: OperationAbandoned, wantPolls: 2},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			service := &operationsService{states: test.states, status: test.status}
+			client := testClient(t, service)
+
+			result, err := WaitForOperation(context.Background(), client, "db", id, poll)
+			assert.Equal(t, test.wantPolls, atomic.LoadInt32(&service.polls))
+			assert.Equal(t, test.wantState, result.State)
+			assert.Equal(t, id, result.ID)
+			assert.Equal(t, "DataExportToFile", result.Operation)
+			assert.Equal(t, 2*time.Second, result.Duration)
+			assert.Equal(t, time.Date(2021, 3, 4, 5, 6, 9, 0, time.UTC), result.LastUpdatedOn)
+			assert.Equal(t, "db", result.Database)
+			assert.True(t, result.Done())
+
+			if test.wantState == OperationCompleted {
+				require.NoError(t, err)
+				assert.True(t, result.Succeeded())
+				return
+			}
+			var oe *OperationError
+			require.True(t, goErrors.As(err, &oe))
+			assert.Equal(t, result, oe.Result)
+			assert.Equal(t, test.wantRetry, oe.Retry())
+			assert.Contains(t, err.Error(), test.status)
+			assert.Contains(t, err.Error(), test.wantState)
+		})
+	}
+}
+
+func TestWaitForOperationCanceled(t *testing.T) {
+	t.Parallel()
+
+	service := &operationsService{states: []string{OperationInProgress}}
+	client := testClient(t, service)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := WaitForOperation(ctx, client, "db", uuid.New(), WaitPollInterval(time.Millisecond, 10*time.Millisecond))
+	require.Error(t, err)
+	assert.True(t, goErrors.Is(err, context.DeadlineExceeded))
+	var e *errors.Error
+	require.True(t, goErrors.As(err, &e))
+	assert.Equal(t, errors.KTimeout, e.Kind)
+	assert.Greater(t, atomic.LoadInt32(&service.polls), int32(1))
+
+	// The deadline expires while a poll is in flight, which then fails with the error of its request.
+	ctx, cancel = context.WithCancel(context.Background())
+	inFlight := cancelingMgmter{cancel: cancel, err: errors.ES(errors.OpMgmt, errors.KHTTPError, "connection reset")}
+	_, err = WaitForOperation(ctx, inFlight, "db", uuid.New())
+	require.Error(t, err)
+	assert.True(t, goErrors.Is(err, context.Canceled))
+	assert.Equal(t, errors.KTimeout, errors.KindOf(err))
+
+	_, err = WaitForOperation(context.Background(), client, "db", uuid.New(), WaitPollInterval(time.Second, time.Millisecond))
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "WaitPollInterval"))
+}
+
+// cancelingMgmter cancels the context of the polls of WaitForOperation() while they are in flight, and fails them
+// with err.
+type cancelingMgmter struct {
+	cancel context.CancelFunc
+	err    error
+}
+
+func (c cancelingMgmter) Mgmt(ctx context.Context, db string, query Stmt, options ...MgmtOption) (*RowIterator, error) {
+	c.cancel()
+	return nil, c.err
+}
@@ -0,0 +1,251 @@
+package kusto
+
+// paged.go holds the reading of large results page by page, through a stored query result.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/unsafe"
+	"github.com/google/uuid"
+)
+
+const (
+	// pagedRowNum is the column that numbers the rows of the stored query result, which the pages are read by.
+	pagedRowNum = "KGC_RowNum"
+	// defaultPagedExpiry is how long the stored query result is kept if the PagedIterator is not closed.
+	defaultPagedExpiry = time.Hour
+)
+
+type pagedOptions struct {
+	expiresAfter time.Duration
+	queryOptions []QueryOption
+}
+
+// PagedOption is an optional argument to QueryPaged().
+type PagedOption func(p *pagedOptions) error
+
+// PagedExpiresAfter sets how long the service keeps the stored query result, which is how long the pages can be
+// read for. It is dropped sooner by PagedIterator.Close(). The default is 1 hour.
+func PagedExpiresAfter(d time.Duration) PagedOption {
+	return func(p *pagedOptions) error {
+		if d <= 0 {
+			return errors.ES(errors.OpQuery, errors.KClientArgs, "PagedExpiresAfter(%s): must be positive", d).SetNoRetry()
+		}
+		p.expiresAfter = d
+		return nil
+	}
+}
+
+// PagedQueryOptions sets the options of the queries that read the pages.
+func PagedQueryOptions(options ...QueryOption) PagedOption {
+	return func(p *pagedOptions) error {
+		p.queryOptions = append(p.queryOptions, options...)
+		return nil
+	}
+}
+
+// QueryPaged runs query once into a stored query result, and returns a PagedIterator that reads its rows a page of
+// pageSize rows at a time. This suits results that are too large to read with a single query, even with
+// NoTruncation(). The stored query result has a generated name that is unique to the call, and is kept until the
+// PagedIterator is closed or it expires, see PagedExpiresAfter(). The rows are read in the order that query returns
+// them. query cannot have Definitions or Parameters attached, as the stored query result is set with a Mgmt() call.
+func (c *Client) QueryPaged(ctx context.Context, db string, query Stmt, pageSize int, options ...PagedOption) (*PagedIterator, error) {
+	if pageSize <= 0 {
+		return nil, errors.ES(errors.OpQuery, errors.KClientArgs, "QueryPaged(): pageSize(%d) must be positive", pageSize).SetNoRetry()
+	}
+	if !query.params.IsZero() || !query.defs.IsZero() {
+		return nil, errors.ES(errors.OpQuery, errors.KClientArgs, "QueryPaged() cannot accept a Stmt object that has Definitions or Parameters attached").SetNoRetry()
+	}
+	opts := pagedOptions{expiresAfter: defaultPagedExpiry}
+	for _, o := range options {
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &PagedIterator{
+		client:   c,
+		ctx:      ctx,
+		db:       db,
+		name:     "KGC_Paged_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		pageSize: int64(pageSize),
+		options:  opts.queryOptions,
+	}
+
+	// The rows are numbered as query returns them, so that the pages can be read by their numbers. The new line
+	// ends a comment that query may end with.
+	set := NewStmt(".set stored_query_result ", UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).
+		UnsafeAdd(fmt.Sprintf("%s with (previewCount = 0, expiresAfter = time(%s)) <| ", p.name, value.Timespan{Value: opts.expiresAfter, Valid: true}.Marshal())).
+		UnsafeAdd(query.String()).
+		UnsafeAdd(fmt.Sprintf("\n| serialize %s = row_number()", pagedRowNum))
+	iter, err := c.Mgmt(ctx, db, set, AllowWrite())
+	if err != nil {
+		return nil, err
+	}
+	if err := drain(iter); err != nil {
+		p.Close(ctx)
+		return nil, err
+	}
+
+	if err := p.query(); err != nil {
+		p.Close(ctx)
+		return nil, err
+	}
+	return p, nil
+}
+
+// PagedIterator reads the rows of QueryPaged() a page at a time. When reading a page fails, Resume() continues after
+// the last row that was returned, so no row is returned twice. Close() drops the stored query result. A
+// PagedIterator is not safe for concurrent use.
+type PagedIterator struct {
+	client   *Client
+	ctx      context.Context
+	db, name string
+	pageSize int64
+	options  []QueryOption
+
+	// iter reads the current page, which ends at row number pageEnd. It is nil between pages.
+	iter    *RowIterator
+	pageEnd int64
+	columns table.Columns
+	// position is the number of rows that were returned.
+	position int64
+	done     bool
+	err      error
+	closed   bool
+}
+
+// query starts reading the page that comes after the last row that was returned.
+func (p *PagedIterator) query() error {
+	from := p.position + 1
+	p.pageEnd = p.position + p.pageSize
+	stmt := NewStmt("stored_query_result(", UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).
+		UnsafeAdd(quoteString(p.name)).
+		UnsafeAdd(fmt.Sprintf(") | where %s between (%d .. %d) | order by %s asc | project-away %s", pagedRowNum, from, p.pageEnd, pagedRowNum, pagedRowNum))
+
+	iter, err := p.client.Query(p.ctx, p.db, stmt, p.options...)
+	if err != nil {
+		return err
+	}
+	cols, err := iter.Columns()
+	if err != nil {
+		iter.Stop()
+		return err
+	}
+	p.iter, p.columns = iter, cols
+	return nil
+}
+
+// Name returns the name of the stored query result.
+func (p *PagedIterator) Name() string {
+	return p.name
+}
+
+// Position returns the number of rows that were returned.
+func (p *PagedIterator) Position() int64 {
+	return p.position
+}
+
+// Columns returns the columns of the rows, see RowIterator.Columns().
+func (p *PagedIterator) Columns() (table.Columns, error) {
+	return p.columns, nil
+}
+
+// Next returns the next row, reading the next page when the current one was read. It returns io.EOF after the last
+// row. Once Next returns another error, it keeps returning it until Resume() is called.
+func (p *PagedIterator) Next() (*table.Row, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.closed {
+		return nil, errors.ES(errors.OpQuery, errors.KClientArgs, "the PagedIterator is closed").SetNoRetry()
+	}
+
+	for {
+		if p.iter == nil {
+			if p.done {
+				return nil, io.EOF
+			}
+			if err := p.query(); err != nil {
+				p.err = err
+				return nil, err
+			}
+		}
+
+		row, err := p.iter.Next()
+		switch {
+		case err == nil:
+			p.position++
+			return row, nil
+		case err == io.EOF:
+			p.iter.Stop()
+			p.iter = nil
+			// A page that is not full is the last one.
+			p.done = p.position < p.pageEnd
+		default:
+			p.iter.Stop()
+			p.iter = nil
+			p.err = err
+			return nil, err
+		}
+	}
+}
+
+// Do calls f for every row, see Next(). If f returns a non-nil error, iteration stops.
+func (p *PagedIterator) Do(f func(r *table.Row) error) error {
+	for {
+		row, err := p.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := f(row); err != nil {
+			return err
+		}
+	}
+}
+
+// Resume clears the error that Next() returned, so that the next call reads the rows after the last one that was
+// returned, with ctx. ctx replaces the context passed to QueryPaged(), such as when that one is done.
+func (p *PagedIterator) Resume(ctx context.Context) {
+	p.ctx = ctx
+	p.err = nil
+}
+
+// Close stops reading the rows and drops the stored query result. Calling Close again does nothing.
+func (p *PagedIterator) Close(ctx context.Context) error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.iter != nil {
+		p.iter.Stop()
+		p.iter = nil
+	}
+
+	drop := NewStmt(".drop stored_query_result ", UnsafeStmt(unsafe.Stmt{Add: true, SuppressWarning: true})).UnsafeAdd(p.name)
+	iter, err := p.client.Mgmt(ctx, p.db, drop)
+	if err != nil {
+		return err
+	}
+	return drain(iter)
+}
+
+// drain reads the rows of iter, which are not needed, to return the error of the command if any.
+func drain(iter *RowIterator) error {
+	return iter.DoOnRowOrError(func(_ *table.Row, e *errors.Error) error {
+		if e != nil {
+			return e
+		}
+		return nil
+	})
+}
@@ -0,0 +1,200 @@
+package kusto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storedResults serves stored query results of rows numbered 1 to rows, with the column x holding the number.
+type storedResults struct {
+	rows int
+	// fail makes the first read of the page that starts at that row fail after its first row.
+	fail int
+
+	mu      sync.Mutex
+	sets    []string
+	names   []string
+	pages   [][2]int
+	dropped []string
+}
+
+var pageRE = regexp.MustCompile(`^stored_query_result\("([^"]+)"\) \| where KGC_RowNum between \((\d+) \.\. (\d+)\)`)
+
+func (s *storedResults) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var msg struct {
+		CSL string `json:"csl"`
+	}
+	json.NewDecoder(r.Body).Decode(&msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(msg.CSL, ".set stored_query_result "):
+		s.sets = append(s.sets, msg.CSL)
+		s.names = append(s.names, strings.Fields(msg.CSL)[2])
+		w.Write([]byte(retryV1Response))
+	case strings.HasPrefix(msg.CSL, ".drop stored_query_result "):
+		s.dropped = append(s.dropped, strings.TrimPrefix(msg.CSL, ".drop stored_query_result "))
+		w.Write([]byte(retryV1Response))
+	default:
+		m := pageRE.FindStringSubmatch(msg.CSL)
+		if m == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		from, _ := strconv.Atoi(m[2])
+		to, _ := strconv.Atoi(m[3])
+		s.pages = append(s.pages, [2]int{from, to})
+		if to > s.rows {
+			to = s.rows
+		}
+
+		var rows []string
+		for i := from; i <= to; i++ {
+			rows = append(rows, fmt.Sprintf("[%d]", i))
+		}
+		completion := `{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}`
+		if from == s.fail {
+			s.fail = 0
+			rows = rows[:1]
+			completion = `{"FrameType":"DataSetCompletion","HasErrors":true,"Cancelled":false,
+				"OneApiErrors":[{"error":{"code":"LimitsExceeded","message":"Request is invalid and cannot be executed."}}]}`
+		}
+		fmt.Fprintf(w, `[{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0"},
+			{"FrameType":"DataTable","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+				"Columns":[{"ColumnName":"x","ColumnType":"long"}],"Rows":[%s]},%s]`, strings.Join(rows, ","), completion)
+	}
+}
+
+func TestQueryPaged(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc      string
+		rows      int
+		pageSize  int
+		wantPages [][2]int
+	}{
+		{desc: "Last page is not full", rows: 7, pageSize: 3, wantPages: [][2]int{{1, 3}, {4, 6}, {7, 9}}},
+		{desc: "Last page is full", rows: 6, pageSize: 3, wantPages: [][2]int{{1, 3}, {4, 6}, {7, 9}}},
+		{desc: "No rows", rows: 0, pageSize: 3, wantPages: [][2]int{{1, 3}}},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			service := &storedResults{rows: test.rows}
+			client := testClient(t, service)
+
+			iter, err := client.QueryPaged(context.Background(), "db", NewStmt("T | where x > 0"), test.pageSize)
+			require.NoError(t, err)
+			cols, err := iter.Columns()
+			require.NoError(t, err)
+			assert.Equal(t, table.Columns{{Name: "x", Type: types.Long}}, cols)
+
+			var got []int64
+			require.NoError(t, iter.Do(func(r *table.Row) error {
+				got = append(got, r.Values[0].(value.Long).Value)
+				return nil
+			}))
+			assert.Len(t, got, test.rows)
+			for i, x := range got {
+				assert.Equal(t, int64(i+1), x)
+			}
+			assert.Equal(t, int64(test.rows), iter.Position())
+			assert.Equal(t, test.wantPages, service.pages)
+
+			require.NoError(t, iter.Close(context.Background()))
+			require.NoError(t, iter.Close(context.Background()))
+			assert.Equal(t, []string{iter.Name()}, service.dropped)
+			require.Len(t, service.sets, 1)
+			assert.Equal(t, ".set stored_query_result "+iter.Name()+" with (previewCount = 0, expiresAfter = time(01:00:00)) <| T | where x > 0\n| serialize KGC_RowNum = row_number()", service.sets[0])
+		})
+	}
+}
+
+func TestQueryPagedResume(t *testing.T) {
+	t.Parallel()
+
+	// The second page fails after its first row.
+	service := &storedResults{rows: 7, fail: 4}
+	client := testClient(t, service)
+
+	iter, err := client.QueryPaged(context.Background(), "db", NewStmt("T"), 3)
+	require.NoError(t, err)
+	defer iter.Close(context.Background())
+
+	var got []int64
+	read := func(r *table.Row) error {
+		got = append(got, r.Values[0].(value.Long).Value)
+		return nil
+	}
+	err = iter.Do(read)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "LimitsExceeded")
+	assert.Equal(t, []int64{1, 2, 3, 4}, got)
+	// The error is kept until Resume.
+	_, err = iter.Next()
+	require.Error(t, err)
+
+	iter.Resume(context.Background())
+	require.NoError(t, iter.Do(read))
+	assert.Equal(t, []int64{1, 2, 3, 4, 5, 6, 7}, got)
+	assert.Equal(t, [][2]int{{1, 3}, {4, 6}, {5, 7}, {8, 10}}, service.pages)
+}
+
+func TestQueryPagedNames(t *testing.T) {
+	t.Parallel()
+
+	service := &storedResults{}
+	client := testClient(t, service)
+
+	// Concurrent callers get stored query results of their own.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			iter, err := client.QueryPaged(context.Background(), "db", NewStmt("T"), 10)
+			if assert.NoError(t, err) {
+				iter.Close(context.Background())
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, name := range service.names {
+		assert.Regexp(t, `^KGC_Paged_[0-9a-f]{32}$`, name)
+		assert.False(t, seen[name], "the name %s was used twice", name)
+		seen[name] = true
+	}
+	assert.Len(t, seen, 10)
+
+	// Bad arguments.
+	_, err := client.QueryPaged(context.Background(), "db", NewStmt("T"), 0)
+	assert.Error(t, err)
+	_, err = client.QueryPaged(context.Background(), "db", NewStmt("T"), 10, PagedExpiresAfter(0))
+	assert.Error(t, err)
+	stmt := NewStmt("T | where x == v").MustDefinitions(NewDefinitions().Must(ParamTypes{"v": ParamType{Type: types.Long}})).
+		MustParameters(NewParameters().Must(QueryValues{"v": int64(1)}))
+	_, err = client.QueryPaged(context.Background(), "db", stmt, 10)
+	assert.Error(t, err)
+	assert.Len(t, service.names, 10)
+}
@@ -8,11 +8,15 @@ These provide injection safe querying for data retrieval and insertion.
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/big"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/Azure/azure-kusto-go/kusto/data/types"
 	"github.com/Azure/azure-kusto-go/kusto/data/value"
@@ -60,7 +64,8 @@ type ParamType struct {
 	// CTReal must be an float64
 	// CTString must be a string
 	// CTTimespan must be a time.Duration
-	// CTDecimal must be a string or *big.Float representing a decimal value
+	// CTDecimal must be a string, *big.Float, *big.Int or value.Decimal representing a decimal value
+	// It is put in the declaration as a literal of the type, such as long(1).
 	Default interface{}
 
 	name string
@@ -73,140 +78,164 @@ func (p ParamType) validate() error {
 	if p.Default == nil {
 		return nil
 	}
+	switch d := p.Default.(type) {
+	case *big.Float:
+		if d == nil {
+			return fmt.Errorf("*big.Float type cannot be set to the nil value")
+		}
+	case *big.Int:
+		if d == nil {
+			return fmt.Errorf("*big.Int type cannot be set to the nil value")
+		}
+	}
+	if p.Type == types.Dynamic {
+		return fmt.Errorf("the .Type was %s, but Dynamic types cannot have default values", p.Type)
+	}
+	if _, err := literal(p.Type, p.Default); err != nil {
+		return fmt.Errorf("the .Type was %s, but the value was %s", p.Type, err)
+	}
+	return nil
+}
+
+func (p ParamType) string() string {
+	if p.Default == nil {
+		return fmt.Sprintf("%s:%s", p.name, p.Type)
+	}
+
+	lit, err := literal(p.Type, p.Default)
+	if err != nil {
+		panic("internal bug: ParamType.string() called without a call to .validate()")
+	}
+	// Unlike parameter values, a string default is in the query text, so it must be a quoted literal.
+	if p.Type == types.String {
+		lit = quoteString(lit)
+	}
+	return fmt.Sprintf("%s:%s = %s", p.name, p.Type, lit)
+}
 
-	switch p.Type {
+// literal returns v as the Kusto literal of column type t, such as "long(1)", which is how parameter values are
+// sent. A nil v is the null of t, except for a string, which has no null and is empty. A string is returned as it is,
+// as the service takes string parameter values without quotes.
+func literal(t types.Column, v interface{}) (string, error) {
+	if v == nil {
+		if t == types.String {
+			return "", nil
+		}
+		return fmt.Sprintf("%s(null)", t), nil
+	}
+
+	switch t {
 	case types.Bool:
-		if _, ok := p.Default.(bool); !ok {
-			return fmt.Errorf("the .Type was %s, but the value was a %T", p.Type, p.Default)
+		b, ok := v.(bool)
+		if !ok {
+			return "", fmt.Errorf("a %T, which is not a bool", v)
 		}
-		return nil
+		return fmt.Sprintf("bool(%t)", b), nil
 	case types.DateTime:
-		if _, ok := p.Default.(time.Time); !ok {
-			return fmt.Errorf("the .Type was %s, but the value was a %T", p.Type, p.Default)
+		tm, ok := v.(time.Time)
+		if !ok {
+			return "", fmt.Errorf("a %T, which is not a time.Time", v)
 		}
-		return nil
+		tm = tm.UTC()
+		if tm.Year() < 1 || tm.Year() > 9999 {
+			return "", fmt.Errorf("%s, which is outside the datetime range of years 1 to 9999", tm)
+		}
+		// Kusto keeps datetimes to the tick, 100 nanoseconds.
+		return fmt.Sprintf("datetime(%s)", tm.Format("2006-01-02T15:04:05.9999999Z07:00")), nil
 	case types.Dynamic:
-		return fmt.Errorf("the .Type was %s, but Dynamic types cannot have default values", p.Type)
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", fmt.Errorf("a %T, which could not be marshalled into JSON, err: %s", v, err)
+		}
+		return fmt.Sprintf("dynamic(%s)", string(b)), nil
 	case types.GUID:
-		if _, ok := p.Default.(uuid.UUID); !ok {
-			return fmt.Errorf("the .Type was %s, but the value was a %T", p.Type, p.Default)
+		u, ok := v.(uuid.UUID)
+		if !ok {
+			return "", fmt.Errorf("a %T, which is not a uuid.UUID", v)
 		}
-		return nil
+		return fmt.Sprintf("guid(%s)", u.String()), nil
 	case types.Int:
-		if _, ok := p.Default.(int32); !ok {
-			return fmt.Errorf("the .Type was %s, but the value was a %T", p.Type, p.Default)
+		i, ok := v.(int32)
+		if !ok {
+			return "", fmt.Errorf("a %T, which is not an int32", v)
 		}
-		return nil
+		return fmt.Sprintf("int(%d)", i), nil
 	case types.Long:
-		if _, ok := p.Default.(int64); !ok {
-			return fmt.Errorf("the .Type was %s, but the value was a %T", p.Type, p.Default)
+		i, ok := v.(int64)
+		if !ok {
+			return "", fmt.Errorf("a %T, which is not an int64", v)
 		}
-		return nil
+		return fmt.Sprintf("long(%d)", i), nil
 	case types.Real:
-		if _, ok := p.Default.(float64); !ok {
-			return fmt.Errorf("the .Type was %s, but the value was a %T", p.Type, p.Default)
+		f, ok := v.(float64)
+		if !ok {
+			return "", fmt.Errorf("a %T, which is not a float64", v)
 		}
-		return nil
+		switch {
+		case math.IsNaN(f):
+			return "", fmt.Errorf("NaN, which cannot be passed as a real")
+		case math.IsInf(f, 1):
+			return "real(+inf)", nil
+		case math.IsInf(f, -1):
+			return "real(-inf)", nil
+		}
+		return fmt.Sprintf("real(%s)", strconv.FormatFloat(f, 'g', -1, 64)), nil
 	case types.String:
-		if _, ok := p.Default.(string); !ok {
-			return fmt.Errorf("the .Type was %s, but the value was a %T", p.Type, p.Default)
+		str, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("a %T, which is not a string", v)
 		}
-		return nil
+		return str, nil
 	case types.Timespan:
-		if _, ok := p.Default.(time.Duration); !ok {
-			return fmt.Errorf("the .Type was %s, but the value was a %T", p.Type, p.Default)
+		d, ok := v.(time.Duration)
+		if !ok {
+			return "", fmt.Errorf("a %T, which is not a time.Duration", v)
 		}
-		return nil
+		return fmt.Sprintf("timespan(%s)", value.Timespan{Value: d, Valid: true}.Marshal()), nil
 	case types.Decimal:
-		switch v := p.Default.(type) {
+		switch d := v.(type) {
 		case string:
-			if !value.DecRE.MatchString(v) {
-				return fmt.Errorf("string representing decimal does not appear to be a decimal number, was %v", v)
+			if !value.DecRE.MatchString(d) {
+				return "", fmt.Errorf("%q, which does not appear to be a decimal number", d)
 			}
-			return nil
+			return fmt.Sprintf("decimal(%s)", d), nil
 		case *big.Float:
-			if v == nil {
-				return fmt.Errorf("*big.Float type cannot be set to the nil value")
+			if d == nil {
+				return "decimal(null)", nil
 			}
-			return nil
+			if d.IsInf() {
+				return "", fmt.Errorf("an infinite *big.Float, which cannot be passed as a decimal")
+			}
+			return fmt.Sprintf("decimal(%s)", d.Text('f', -1)), nil
 		case *big.Int:
-			if v == nil {
-				return fmt.Errorf("*big.Int type cannot be set to the nil value")
+			if d == nil {
+				return "decimal(null)", nil
+			}
+			return fmt.Sprintf("decimal(%s)", d.String()), nil
+		case value.Decimal:
+			if !d.Valid {
+				return "decimal(null)", nil
 			}
-			return nil
+			if !value.DecRE.MatchString(d.Value) {
+				return "", fmt.Errorf("%q, which does not appear to be a decimal number", d.Value)
+			}
+			return fmt.Sprintf("decimal(%s)", d.Value), nil
 		}
-		return fmt.Errorf("the .Type was %s, but the value was a %T", p.Type, p.Default)
+		return "", fmt.Errorf("a %T, which is not a string, *big.Float, *big.Int or value.Decimal", v)
 	}
-	return fmt.Errorf("received a field type %q we don't recognize", p.Type)
+	return "", fmt.Errorf("of a type %q we don't recognize", t)
 }
 
-func (p ParamType) string() string {
-	switch p.Type {
-	case types.Bool:
-		if p.Default == nil {
-			return p.name + ":bool"
-		}
-		v := p.Default.(bool)
-		return fmt.Sprintf("%s:bool = %v", p.name, v)
-	case types.DateTime:
-		if p.Default == nil {
-			return p.name + ":datetime"
-		}
-		v := p.Default.(time.Time)
-		return fmt.Sprintf("%s:datetime = %s", p.name, v.Format(time.RFC3339Nano))
-	case types.Dynamic:
-		return p.name + ":dynamic"
-	case types.GUID:
-		if p.Default == nil {
-			return p.name + ":guid"
-		}
-		v := p.Default.(uuid.UUID)
-		return fmt.Sprintf("%s:guid = %s", p.name, v.String())
-	case types.Int:
-		if p.Default == nil {
-			return p.name + ":int"
-		}
-		v := p.Default.(int32)
-		return fmt.Sprintf("%s:int = %d", p.name, v)
-	case types.Long:
-		if p.Default == nil {
-			return p.name + ":long"
-		}
-		v := p.Default.(int64)
-		return fmt.Sprintf("%s:long = %d", p.name, v)
-	case types.Real:
-		if p.Default == nil {
-			return p.name + ":real"
-		}
-		v := p.Default.(float64)
-		return fmt.Sprintf("%s:real = %f", p.name, v)
-	case types.String:
-		if p.Default == nil {
-			return p.name + ":string"
-		}
-		v := p.Default.(string)
-		return fmt.Sprintf(`%s:string = "%s"`, p.name, v)
-	case types.Timespan:
-		if p.Default == nil {
-			return p.name + ":timespan"
-		}
-		v := p.Default.(time.Duration)
-		return fmt.Sprintf("%s:timespan = %s", p.name, value.Timespan{Value: v, Valid: true}.Marshal())
-	case types.Decimal:
-		if p.Default == nil {
-			return p.name + ":decimal"
-		}
+// quoteString returns s as a Kusto string literal.
+func quoteString(s string) string {
+	return `"` + stringEscaper.Replace(s) + `"`
+}
 
-		var sval string
-		switch v := p.Default.(type) {
-		case string:
-			sval = v
-		case *big.Float:
-			sval = v.String()
-		}
-		return fmt.Sprintf("%s:decimal = %s", p.name, sval)
-	}
-	panic("internal bug: ParamType.string() called without a call to .validate()")
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// quoteName returns name as a bracketed Kusto identifier, which allows any character in the name.
+func quoteName(name string) string {
+	return `["` + stringEscaper.Replace(name) + `"]`
 }
 
 // Definitions represents definitions of parameters that are substituted for variables in
@@ -242,7 +271,8 @@ func (p Definitions) With(types ParamTypes) (Definitions, error) {
 			return p, fmt.Errorf("parameter %q could not be added: %s", name, err)
 		}
 	}
-	p.m = types
+	// A copy, so that changing the map passed does not change Stmts built with these Definitions.
+	p.m = types.clone()
 	return p, nil
 }
 
@@ -309,7 +339,8 @@ func (p Definitions) clone() Definitions {
 
 // QueryValues represents a set of values that are substituted in Parameters. Every QueryValue key
 // must have a corresponding Parameter name. All values must be compatible with the Kusto Column type
-// it will go into (int64 for a long, int32 for int, time.Time for datetime, ...)
+// it will go into (int64 for a long, int32 for int, time.Time for datetime, ...), or nil for the null of the type.
+// A real cannot be NaN and a datetime must be within the years 1 to 9999.
 type QueryValues map[string]interface{}
 
 func (v QueryValues) clone() QueryValues {
@@ -347,7 +378,8 @@ func (q Parameters) IsZero() bool {
 // With returns a Parameters set to "values". values' keys represents Definitions names
 // that will substituted for and the values to be subsituted.
 func (q Parameters) With(values QueryValues) (Parameters, error) {
-	q.m = values
+	// A copy, so that changing the map passed does not change Stmts built with these Parameters.
+	q.m = values.clone()
 	return q, nil
 }
 
@@ -400,79 +432,11 @@ func (q Parameters) validate(p Definitions) (Parameters, error) {
 		if !ok {
 			return q, fmt.Errorf("Parameters contains key %q that is not defined in the Stmt's Parameters", k)
 		}
-		switch paramType.Type {
-		case types.Bool:
-			b, ok := v.(bool)
-			if !ok {
-				return q, fmt.Errorf("Parameters[%s](bool) = %T, which is not a bool", k, v)
-			}
-			if b {
-				out[k] = "bool(true)"
-				break
-			}
-			out[k] = "bool(false)"
-		case types.DateTime:
-			t, ok := v.(time.Time)
-			if !ok {
-				return q, fmt.Errorf("Parameters[%s](datetime) = %T, which is not a time.Time", k, v)
-			}
-			out[k] = fmt.Sprintf("datetime(%s)", t.Format(time.RFC3339Nano))
-		case types.Dynamic:
-			b, err := json.Marshal(v)
-			if err != nil {
-				return q, fmt.Errorf("Parameters[%s](dynamic), %T could not be marshalled into JSON, err: %s", k, v, err)
-			}
-			out[k] = fmt.Sprintf("dynamic(%s)", string(b))
-		case types.GUID:
-			u, ok := v.(uuid.UUID)
-			if !ok {
-				return q, fmt.Errorf("Parameters[%s](guid) = %T, which is not a uuid.UUID", k, v)
-			}
-			out[k] = fmt.Sprintf("guid(%s)", u.String())
-		case types.Int:
-			i, ok := v.(int32)
-			if !ok {
-				return q, fmt.Errorf("Parameters[%s](int) = %T, which is not an int32", k, v)
-			}
-			out[k] = fmt.Sprintf("int(%d)", i)
-		case types.Long:
-			i, ok := v.(int64)
-			if !ok {
-				return q, fmt.Errorf("Parameters[%s](long) = %T, which is not an int64", k, v)
-			}
-			out[k] = fmt.Sprintf("long(%d)", i)
-		case types.Real:
-			i, ok := v.(float64)
-			if !ok {
-				return q, fmt.Errorf("Parameters[%s](real) = %T, which is not a float64", k, v)
-			}
-			out[k] = fmt.Sprintf("real(%f)", i)
-		case types.String:
-			s, ok := v.(string)
-			if !ok {
-				return q, fmt.Errorf("Parameters[%s](string) = %T, which is not a string", k, v)
-			}
-			out[k] = fmt.Sprintf("%s", s)
-		case types.Timespan:
-			d, ok := v.(time.Duration)
-			if !ok {
-				return q, fmt.Errorf("Parameters[%s](timespan) = %T, which is not a time.Duration", k, v)
-			}
-			out[k] = fmt.Sprintf("timespan(%s)", value.Timespan{Value: d, Valid: true}.Marshal())
-		case types.Decimal:
-			var sval string
-			switch v := v.(type) {
-			case string:
-				sval = v
-			case *big.Float:
-				sval = v.String()
-			case *big.Int:
-				sval = v.String()
-			default:
-				return q, fmt.Errorf("Parameters[%s](decimal) = %T, which is not a string or *big.Float", k, v)
-			}
-			out[k] = fmt.Sprintf("decimal(%s)", sval)
+		lit, err := literal(paramType.Type, v)
+		if err != nil {
+			return q, fmt.Errorf("Parameters[%s](%s) = %s", k, paramType.Type, err)
 		}
+		out[k] = lit
 	}
 	q.outM = out
 	return q, nil
@@ -531,6 +495,73 @@ func (s Stmt) UnsafeAdd(query string) Stmt {
 	return s
 }
 
+// AddTable adds name, the name of a table, as a quoted identifier, such as ["my table"]. Any name is quoted so that
+// it cannot change the rest of the query, without UnsafeAdd(), such as a name read from a configuration. Names that
+// are empty, that are not UTF-8 or that have control characters, such as a newline, are refused.
+func (s Stmt) AddTable(name string) (Stmt, error) {
+	return s.addName("AddTable", name)
+}
+
+// AddColumn adds name, the name of a column, as a quoted identifier, such as ["my column"]. See AddTable().
+func (s Stmt) AddColumn(name string) (Stmt, error) {
+	return s.addName("AddColumn", name)
+}
+
+// AddDatabase adds a reference to the database called name, such as database("other"), for a query to use a table
+// of another database, followed by Add(".") and AddTable(). Names are refused as with AddTable().
+func (s Stmt) AddDatabase(name string) (Stmt, error) {
+	if err := validName(name); err != nil {
+		return s, fmt.Errorf("AddDatabase(): %w", err)
+	}
+	s.queryStr = s.queryStr + "database(" + quoteString(name) + ")"
+	return s, nil
+}
+
+// AddLiteral adds v as a literal of the column type t, such as long(1), datetime(2021-01-01T00:00:00Z), dynamic([1])
+// or a string between quotes, in which quotes, backslashes and line breaks are escaped. v is of the Go type of a
+// ParamType.Default of t, and nil is the null of t, or an empty string. Only the values of the types can be added, so
+// that v cannot change the rest of the query.
+func (s Stmt) AddLiteral(t types.Column, v interface{}) (Stmt, error) {
+	if !t.Valid() {
+		return s, fmt.Errorf("AddLiteral(): %q is not a valid column type", t)
+	}
+	lit, err := literal(t, v)
+	if err != nil {
+		return s, fmt.Errorf("AddLiteral(): the type was %s, but the value was %s", t, err)
+	}
+	if t == types.String {
+		lit = quoteString(lit)
+	}
+	s.queryStr = s.queryStr + lit
+	return s, nil
+}
+
+// addName adds name as a quoted identifier for method, which refuses the names that validName() does.
+func (s Stmt) addName(method string, name string) (Stmt, error) {
+	if err := validName(name); err != nil {
+		return s, fmt.Errorf("%s(): %w", method, err)
+	}
+	s.queryStr = s.queryStr + quoteName(name)
+	return s, nil
+}
+
+// validName checks that name can be the name of an entity, such as a table: it is not empty, and it is UTF-8 without
+// control characters.
+func validName(name string) error {
+	if name == "" {
+		return fmt.Errorf("the name cannot be empty")
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("the name %q is not UTF-8", name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("the name %q has the control character %U", name, r)
+		}
+	}
+	return nil
+}
+
 // WithDefinitions will return a Stmt that can be used in a Query() with Kusto
 // Parameters to protect against SQL-like injection attacks. These Parameters must align with
 // the placeholders in the statement. The new Stmt object will have a copy of the Parameters passed,
@@ -0,0 +1,25 @@
+//go:build go1.18
+// +build go1.18
+
+package kusto
+
+import "testing"
+
+func FuzzAddTable(f *testing.F) {
+	for _, input := range quotingInputs {
+		f.Add(input)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		checkQuoted(t, input, true, addTable)
+		checkQuoted(t, input, true, addColumn)
+	})
+}
+
+func FuzzAddLiteral(f *testing.F) {
+	for _, input := range quotingInputs {
+		f.Add(input)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		checkQuoted(t, input, false, addString)
+	})
+}
@@ -1,12 +1,18 @@
 package kusto
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"math/big"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
 	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
@@ -14,7 +20,7 @@ import (
 func TestParamType(t *testing.T) {
 	t.Parallel()
 
-	now := time.Now()
+	now := time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.UTC)
 	uu := uuid.New()
 
 	tests := []struct {
@@ -141,7 +147,7 @@ func TestParamType(t *testing.T) {
 				Default: true,
 				name:    "my_value",
 			},
-			wantStr: "my_value:bool = true",
+			wantStr: "my_value:bool = bool(true)",
 		},
 		{
 			desc: "Success Default for types.DateTime",
@@ -150,7 +156,7 @@ func TestParamType(t *testing.T) {
 				Default: now,
 				name:    "my_value",
 			},
-			wantStr: fmt.Sprintf("my_value:datetime = %s", now.Format(time.RFC3339Nano)),
+			wantStr: "my_value:datetime = datetime(2021-03-04T05:06:07.1234567Z)",
 		},
 		{
 			desc: "Success Default for types.Dynamic",
@@ -167,7 +173,7 @@ func TestParamType(t *testing.T) {
 				Default: uu,
 				name:    "my_value",
 			},
-			wantStr: fmt.Sprintf("my_value:guid = %s", uu.String()),
+			wantStr: fmt.Sprintf("my_value:guid = guid(%s)", uu.String()),
 		},
 		{
 			desc: "Success Default for types.Int",
@@ -176,7 +182,7 @@ func TestParamType(t *testing.T) {
 				Default: int32(1),
 				name:    "my_value",
 			},
-			wantStr: "my_value:int = 1",
+			wantStr: "my_value:int = int(1)",
 		},
 		{
 			desc: "Success Default for types.Long",
@@ -185,7 +191,7 @@ func TestParamType(t *testing.T) {
 				Default: int64(1),
 				name:    "my_value",
 			},
-			wantStr: "my_value:long = 1",
+			wantStr: "my_value:long = long(1)",
 		},
 		{
 			desc: "Success Default for types.Real",
@@ -194,7 +200,7 @@ func TestParamType(t *testing.T) {
 				Default: 1.0,
 				name:    "my_value",
 			},
-			wantStr: "my_value:real = 1.000000",
+			wantStr: "my_value:real = real(1)",
 		},
 		{
 			desc: "Success Default for types.String",
@@ -205,17 +211,32 @@ func TestParamType(t *testing.T) {
 			},
 			wantStr: "my_value:string = \"hello\"",
 		},
-		/*
-			{
-				desc: "Success Default for types.Timespan",
-				param: ParamType{
-					Type:    types.Decimal,
-					Default: ....,
-					name: "my_value"
-				},
-				wantStr: "my_value:timespan = true",
+		{
+			desc: "Success Default for types.String with quotes",
+			param: ParamType{
+				Type:    types.String,
+				Default: "say \"hi\"\\\n",
+				name:    "my_value",
+			},
+			wantStr: `my_value:string = "say \"hi\"\\\n"`,
+		},
+		{
+			desc: "Success Default for types.Timespan",
+			param: ParamType{
+				Type:    types.Timespan,
+				Default: 90 * time.Minute,
+				name:    "my_value",
 			},
-		*/
+			wantStr: "my_value:timespan = timespan(01:30:00)",
+		},
+		{
+			desc: "Bad Default for types.Real - NaN",
+			param: ParamType{
+				Type:    types.Real,
+				Default: math.NaN(),
+			},
+			err: true,
+		},
 		{
 			desc: "Success Default for types.Decimal",
 			param: ParamType{
@@ -223,7 +244,7 @@ func TestParamType(t *testing.T) {
 				Default: "1.349",
 				name:    "my_value",
 			},
-			wantStr: "my_value:decimal = 1.349",
+			wantStr: "my_value:decimal = decimal(1.349)",
 		},
 		{
 			desc: "Success no decimal point for types.Decimal",
@@ -232,7 +253,7 @@ func TestParamType(t *testing.T) {
 				Default: "1",
 				name:    "my_value",
 			},
-			wantStr: "my_value:decimal = 1",
+			wantStr: "my_value:decimal = decimal(1)",
 		},
 		{
 			desc: "Success elided left side for types.Decimal",
@@ -241,7 +262,7 @@ func TestParamType(t *testing.T) {
 				Default: ".1",
 				name:    "my_value",
 			},
-			wantStr: "my_value:decimal = .1",
+			wantStr: "my_value:decimal = decimal(.1)",
 		},
 		{
 			desc: "Success elided right side for types.Decimal",
@@ -250,7 +271,7 @@ func TestParamType(t *testing.T) {
 				Default: "1.",
 				name:    "my_value",
 			},
-			wantStr: "my_value:decimal = 1.",
+			wantStr: "my_value:decimal = decimal(1.)",
 		},
 	}
 
@@ -306,7 +327,7 @@ func TestDefinitions(t *testing.T) {
 				"HasLicense": ParamType{Type: types.Bool, Default: false},
 				"FirstName":  ParamType{Type: types.String},
 			},
-			wantStr: "declare query_parameters(FirstName:string, HasLicense:bool = false);",
+			wantStr: "declare query_parameters(FirstName:string, HasLicense:bool = bool(false));",
 		},
 	}
 
@@ -343,7 +364,7 @@ func TestDefinitions(t *testing.T) {
 func TestParameters(t *testing.T) {
 	t.Parallel()
 
-	now := time.Now()
+	now := time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.FixedZone("UTC+1", 3600)).Add(time.Hour)
 	uu := uuid.New()
 
 	tests := []struct {
@@ -411,7 +432,7 @@ func TestParameters(t *testing.T) {
 			desc:    "Success time.Time",
 			qParams: NewDefinitions().Must(map[string]ParamType{"key1": {Type: types.DateTime}}),
 			qValues: NewParameters().Must(map[string]interface{}{"key1": now}),
-			want:    map[string]string{"key1": fmt.Sprintf("datetime(%s)", now.Format(time.RFC3339Nano))},
+			want:    map[string]string{"key1": "datetime(2021-03-04T05:06:07.1234567Z)"},
 		},
 		{
 			desc:    "Success uuid.UUID",
@@ -435,7 +456,7 @@ func TestParameters(t *testing.T) {
 			desc:    "Success float64",
 			qParams: NewDefinitions().Must(map[string]ParamType{"key1": {Type: types.Real}}),
 			qValues: NewParameters().Must(map[string]interface{}{"key1": 1.1}),
-			want:    map[string]string{"key1": fmt.Sprintf("real(%f)", 1.1)},
+			want:    map[string]string{"key1": "real(1.1)"},
 		},
 		{
 			desc:    "Success string",
@@ -535,15 +556,15 @@ func TestStmt(t *testing.T) {
 			desc: "Success: Everything",
 			params: NewDefinitions().Must(
 				ParamTypes{
-					"key1": ParamType{Type: types.Bool},
-					"key2": ParamType{Type: types.DateTime},
-					"key3": ParamType{Type: types.Dynamic},
-					"key4": ParamType{Type: types.GUID},
-					"key5": ParamType{Type: types.Int},
-					"key6": ParamType{Type: types.Long},
-					"key7": ParamType{Type: types.Real},
-					"key8": ParamType{Type: types.String},
-					// "key9": ParamType{Type: types.Timespan},
+					"key1":  ParamType{Type: types.Bool},
+					"key2":  ParamType{Type: types.DateTime},
+					"key3":  ParamType{Type: types.Dynamic},
+					"key4":  ParamType{Type: types.GUID},
+					"key5":  ParamType{Type: types.Int},
+					"key6":  ParamType{Type: types.Long},
+					"key7":  ParamType{Type: types.Real},
+					"key8":  ParamType{Type: types.String},
+					"key9":  ParamType{Type: types.Timespan},
 					"key10": ParamType{Type: types.Decimal},
 				},
 			),
@@ -598,3 +619,314 @@ func buildQueryStr(query string, params Definitions) string {
 	}
 	return query
 }
+
+func TestLiteral(t *testing.T) {
+	t.Parallel()
+
+	uu := uuid.MustParse("b6b1c5b2-5c4f-4a0e-8a43-3f6a0f5d6b41")
+	maxTime := time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC)
+
+	tests := []struct {
+		desc  string
+		typ   types.Column
+		value interface{}
+		want  string
+		err   bool
+	}{
+		{desc: "bool", typ: types.Bool, value: true, want: "bool(true)"},
+		{desc: "bool null", typ: types.Bool, value: nil, want: "bool(null)"},
+		{desc: "datetime min", typ: types.DateTime, value: time.Time{}, want: "datetime(0001-01-01T00:00:00Z)"},
+		{desc: "datetime max", typ: types.DateTime, value: maxTime, want: "datetime(9999-12-31T23:59:59.9999999Z)"},
+		{desc: "datetime in another zone", typ: types.DateTime, value: time.Date(2021, 1, 1, 1, 0, 0, 0, time.FixedZone("UTC+1", 3600)), want: "datetime(2021-01-01T00:00:00Z)"},
+		{desc: "datetime over year 9999", typ: types.DateTime, value: maxTime.Add(time.Second), err: true},
+		{desc: "datetime null", typ: types.DateTime, value: nil, want: "datetime(null)"},
+		{desc: "dynamic", typ: types.Dynamic, value: map[string]interface{}{"a": []int{1, 2}, "b": `"q"`}, want: `dynamic({"a":[1,2],"b":"\"q\""})`},
+		{desc: "dynamic null", typ: types.Dynamic, value: nil, want: "dynamic(null)"},
+		{desc: "dynamic not JSON", typ: types.Dynamic, value: make(chan int), err: true},
+		{desc: "guid", typ: types.GUID, value: uu, want: "guid(b6b1c5b2-5c4f-4a0e-8a43-3f6a0f5d6b41)"},
+		{desc: "guid null", typ: types.GUID, value: nil, want: "guid(null)"},
+		{desc: "int min", typ: types.Int, value: int32(math.MinInt32), want: "int(-2147483648)"},
+		{desc: "int max", typ: types.Int, value: int32(math.MaxInt32), want: "int(2147483647)"},
+		{desc: "int null", typ: types.Int, value: nil, want: "int(null)"},
+		{desc: "long min", typ: types.Long, value: int64(math.MinInt64), want: "long(-9223372036854775808)"},
+		{desc: "long max", typ: types.Long, value: int64(math.MaxInt64), want: "long(9223372036854775807)"},
+		{desc: "long null", typ: types.Long, value: nil, want: "long(null)"},
+		{desc: "real", typ: types.Real, value: 0.1, want: "real(0.1)"},
+		{desc: "real large", typ: types.Real, value: math.MaxFloat64, want: "real(1.7976931348623157e+308)"},
+		{desc: "real small", typ: types.Real, value: -math.SmallestNonzeroFloat64, want: "real(-5e-324)"},
+		{desc: "real +inf", typ: types.Real, value: math.Inf(1), want: "real(+inf)"},
+		{desc: "real -inf", typ: types.Real, value: math.Inf(-1), want: "real(-inf)"},
+		{desc: "real NaN", typ: types.Real, value: math.NaN(), err: true},
+		{desc: "real null", typ: types.Real, value: nil, want: "real(null)"},
+		{desc: "string", typ: types.String, value: `it's "quoted"`, want: `it's "quoted"`},
+		{desc: "string null", typ: types.String, value: nil, want: ""},
+		{desc: "timespan", typ: types.Timespan, value: 36*time.Hour + 1500*time.Millisecond, want: "timespan(1.12:00:01.5)"},
+		{desc: "timespan tick", typ: types.Timespan, value: 100 * time.Nanosecond, want: "timespan(00:00:00.0000001)"},
+		{desc: "timespan negative", typ: types.Timespan, value: -90 * time.Second, want: "timespan(-00:01:30)"},
+		{desc: "timespan null", typ: types.Timespan, value: nil, want: "timespan(null)"},
+		{desc: "decimal string", typ: types.Decimal, value: "-12.50", want: "decimal(-12.50)"},
+		{desc: "decimal bad string", typ: types.Decimal, value: "1e5", err: true},
+		{desc: "decimal double sign", typ: types.Decimal, value: "--1", err: true},
+		{desc: "decimal max", typ: types.Decimal, value: "79228162514264337593543950335", want: "decimal(79228162514264337593543950335)"},
+		{desc: "decimal value.Decimal", typ: types.Decimal, value: value.Decimal{Value: "-0.0000000000000000000000000001", Valid: true}, want: "decimal(-0.0000000000000000000000000001)"},
+		{desc: "decimal null value.Decimal", typ: types.Decimal, value: value.Decimal{}, want: "decimal(null)"},
+		{desc: "decimal bad value.Decimal", typ: types.Decimal, value: value.Decimal{Value: "abc", Valid: true}, err: true},
+		{desc: "decimal big.Float", typ: types.Decimal, value: big.NewFloat(0.25), want: "decimal(0.25)"},
+		{desc: "decimal big.Int", typ: types.Decimal, value: new(big.Int).Lsh(big.NewInt(1), 100), want: "decimal(1267650600228229401496703205376)"},
+		{desc: "decimal nil big.Int", typ: types.Decimal, value: (*big.Int)(nil), want: "decimal(null)"},
+		{desc: "decimal null", typ: types.Decimal, value: nil, want: "decimal(null)"},
+	}
+
+	for _, test := range tests {
+		got, err := literal(test.typ, test.value)
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestLiteral(%s): got err == nil, want err != nil", test.desc)
+		case err != nil && !test.err:
+			t.Errorf("TestLiteral(%s): got err == %s, want err == nil", test.desc, err)
+		case got != test.want:
+			t.Errorf("TestLiteral(%s): got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestStmtNames(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		add  func(s Stmt) (Stmt, error)
+		want string
+		err  bool
+	}{
+		{
+			desc: "Table",
+			add:  func(s Stmt) (Stmt, error) { return s.AddTable("Events") },
+			want: `T ["Events"]`,
+		},
+		{
+			desc: "Table with quotes and backslashes",
+			add:  func(s Stmt) (Stmt, error) { return s.AddTable(`a"] | drop table T; ["\`) },
+			want: `T ["a\"] | drop table T; [\"\\"]`,
+		},
+		{
+			desc: "Column with spaces and Unicode",
+			add:  func(s Stmt) (Stmt, error) { return s.AddColumn("température moyenne") },
+			want: `T ["température moyenne"]`,
+		},
+		{
+			desc: "Database",
+			add:  func(s Stmt) (Stmt, error) { return s.AddDatabase(`other "db"`) },
+			want: `T database("other \"db\"")`,
+		},
+		{desc: "Empty name", add: func(s Stmt) (Stmt, error) { return s.AddTable("") }, err: true},
+		{desc: "Newline", add: func(s Stmt) (Stmt, error) { return s.AddColumn("a\nb") }, err: true},
+		{desc: "NUL", add: func(s Stmt) (Stmt, error) { return s.AddTable("a\x00") }, err: true},
+		{desc: "C1 control character", add: func(s Stmt) (Stmt, error) { return s.AddDatabase("a\u0085") }, err: true},
+		{desc: "Not UTF-8", add: func(s Stmt) (Stmt, error) { return s.AddTable("a\xff") }, err: true},
+	}
+
+	for _, test := range tests {
+		got, err := test.add(NewStmt("T "))
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestStmtNames(%s): got err == nil, want err != nil", test.desc)
+		case err != nil && !test.err:
+			t.Errorf("TestStmtNames(%s): got err == %s, want err == nil", test.desc, err)
+		case err != nil:
+			if got.String() != "T " {
+				t.Errorf("TestStmtNames(%s): got %q, want the Stmt unchanged", test.desc, got.String())
+			}
+		case got.String() != test.want:
+			t.Errorf("TestStmtNames(%s): got %q, want %q", test.desc, got.String(), test.want)
+		}
+	}
+
+	// A query of a table of another database.
+	stmt, err := NewStmt("").AddDatabase("other")
+	assert.NoError(t, err)
+	stmt, err = stmt.Add(".").AddTable("Events")
+	assert.NoError(t, err)
+	stmt, err = stmt.Add(" | where ").AddColumn("Level")
+	assert.NoError(t, err)
+	stmt, err = stmt.Add(" == ").AddLiteral(types.String, "error")
+	assert.NoError(t, err)
+	stmt, err = stmt.Add(" and ").AddColumn("Timestamp")
+	assert.NoError(t, err)
+	stmt, err = stmt.Add(" > ago(").AddLiteral(types.Timespan, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, `database("other").["Events"] | where ["Level"] == "error" and ["Timestamp"] > ago(timespan(01:00:00)`, stmt.String())
+}
+
+func TestAddLiteral(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc  string
+		typ   types.Column
+		value interface{}
+		want  string
+		err   bool
+	}{
+		{desc: "string", typ: types.String, value: "it's \"quoted\"\\\n", want: `"it's \"quoted\"\\\n"`},
+		{desc: "string null", typ: types.String, value: nil, want: `""`},
+		{desc: "datetime", typ: types.DateTime, value: time.Date(2021, 3, 4, 5, 6, 7, 100, time.UTC), want: "datetime(2021-03-04T05:06:07.0000001Z)"},
+		{desc: "timespan", typ: types.Timespan, value: 90 * time.Second, want: "timespan(00:01:30)"},
+		{desc: "dynamic", typ: types.Dynamic, value: map[string]string{"a": `"]) | drop table T`}, want: `dynamic({"a":"\"]) | drop table T"})`},
+		{desc: "long", typ: types.Long, value: int64(-1), want: "long(-1)"},
+		{desc: "decimal", typ: types.Decimal, value: "1.5", want: "decimal(1.5)"},
+		{desc: "wrong Go type", typ: types.Long, value: 1, err: true},
+		{desc: "decimal that is not a number", typ: types.Decimal, value: "1) | drop table T", err: true},
+		{desc: "unknown type", typ: types.Column("table"), value: "T", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := NewStmt("print ").AddLiteral(test.typ, test.value)
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestAddLiteral(%s): got err == nil, want err != nil", test.desc)
+		case err != nil && !test.err:
+			t.Errorf("TestAddLiteral(%s): got err == %s, want err == nil", test.desc, err)
+		case err == nil && got.String() != "print "+test.want:
+			t.Errorf("TestAddLiteral(%s): got %q, want %q", test.desc, got.String(), "print "+test.want)
+		}
+	}
+}
+
+// unquoteString reads the Kusto string literal at the start of s, as the service does, and returns its value and the
+// rest of s. ok is false if s does not start with a string literal that ends.
+func unquoteString(s string) (value, rest string, ok bool) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", false
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], true
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", false
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(s[i])
+			}
+		case '\n', '\r':
+			// A string literal cannot span lines.
+			return "", "", false
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", false
+}
+
+// checkQuoted checks that the Stmt returned by add, for input, holds input quoted in a string literal that cannot be
+// broken out of, or in a bracketed identifier if name is set.
+func checkQuoted(t *testing.T, input string, name bool, add func(s Stmt, input string) (Stmt, error)) {
+	t.Helper()
+
+	const prefix = "T | where x == "
+	stmt, err := add(NewStmt(prefix), input)
+	if err != nil {
+		if !name {
+			t.Fatalf("checkQuoted(%q): got err == %s, want err == nil", input, err)
+		}
+		return
+	}
+	got := strings.TrimPrefix(stmt.String(), prefix)
+	if name {
+		if !strings.HasPrefix(got, "[") {
+			t.Fatalf("checkQuoted(%q): got %q, want a bracketed identifier", input, got)
+		}
+		got = got[1:]
+	}
+	value, rest, ok := unquoteString(got)
+	if !ok {
+		t.Fatalf("checkQuoted(%q): got %q, which is not a string literal", input, got)
+	}
+	wantRest := ""
+	if name {
+		wantRest = "]"
+	}
+	if rest != wantRest {
+		t.Fatalf("checkQuoted(%q): got %q after the literal, want %q", input, rest, wantRest)
+	}
+	if value != input {
+		t.Fatalf("checkQuoted(%q): got the value %q, want the input", input, value)
+	}
+}
+
+// quotingInputs are inputs that try to break out of a string literal or of a quoted identifier.
+var quotingInputs = []string{
+	"", `"`, `\`, `\"`, `\\"`, `"]`, `"] | drop table T; ["`, `']`, "\n| drop table T", "a\rb", "\t", `\x22`, `\u0022`,
+	"é\"ü", "\u2028", "\x00", "\xff\"", "dynamic(\")", "'", "\"\\\"\\\\\"",
+}
+
+func addTable(s Stmt, input string) (Stmt, error)  { return s.AddTable(input) }
+func addColumn(s Stmt, input string) (Stmt, error) { return s.AddColumn(input) }
+func addString(s Stmt, input string) (Stmt, error) { return s.AddLiteral(types.String, input) }
+
+func TestQuoting(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range quotingInputs {
+		checkQuoted(t, input, true, addTable)
+		checkQuoted(t, input, true, addColumn)
+		checkQuoted(t, input, false, addString)
+	}
+}
+
+func TestQueryParameters(t *testing.T) {
+	t.Parallel()
+
+	stmt := NewStmt("T | where Name == name and Count > count").MustDefinitions(
+		NewDefinitions().Must(ParamTypes{
+			"name":  {Type: types.String},
+			"count": {Type: types.Long, Default: int64(0)},
+		}),
+	)
+
+	// One Stmt is used by many goroutines, each with its own values.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			values := QueryValues{"name": fmt.Sprintf("name%d", i), "count": int64(i)}
+			opts, err := (&Client{}).setQueryOptions(context.Background(), errors.OpQuery, stmt, QueryParameters(NewParameters().Must(values)))
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, map[string]string{"name": fmt.Sprintf("name%d", i), "count": fmt.Sprintf("long(%d)", i)}, opts.requestProperties.Parameters)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "declare query_parameters(count:long = long(0), name:string);\nT | where Name == name and Count > count", stmt.String())
+
+	// The values must suit the Definitions of the Stmt.
+	_, err := (&Client{}).setQueryOptions(context.Background(), errors.OpQuery, stmt, QueryParameters(NewParameters().Must(QueryValues{"count": 1})))
+	assert.Error(t, err)
+	_, err = (&Client{}).setQueryOptions(context.Background(), errors.OpQuery, stmt, QueryParameters(NewParameters().Must(QueryValues{"other": "x"})))
+	assert.Error(t, err)
+	_, err = (&Client{}).setQueryOptions(context.Background(), errors.OpQuery, NewStmt("T"), QueryParameters(NewParameters()))
+	assert.Error(t, err)
+
+	// Changing the map passed does not change the Parameters.
+	values := QueryValues{"name": "a"}
+	params := NewParameters().Must(values)
+	values["name"] = "b"
+	got, err := params.toParameters(stmt.defs)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"name": "a"}, got)
+}
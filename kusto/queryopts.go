@@ -16,10 +16,18 @@ import (
 type requestProperties struct {
 	Options    map[string]interface{}
 	Parameters map[string]string
+	// ClientRequestID is the id the request is sent with. It is also sent in the x-ms-client-request-id header.
+	ClientRequestID string `json:"ClientRequestId,omitempty"`
 }
 
 type queryOptions struct {
 	requestProperties *requestProperties
+	// params are the values set with QueryParameters(), if any.
+	params *Parameters
+	// onProgress is the callback set with ResultsProgressCallback(), if any.
+	onProgress func(percent float64)
+	// timeoutNote is added to the error of a call that timed out, see serverTimeoutNote().
+	timeoutNote string
 }
 
 // TODO(jdoak/daniel): These really need to be tested.  I didn't find that NoTruncation worked, I had to add the
@@ -45,6 +53,25 @@ func NoTruncation() QueryOption {
 }
 */
 
+// QueryRequestProperties sets the ClientRequestProperties of the Query() call. They win over the server timeout that
+// the client sets from the deadline of the context.
+func QueryRequestProperties(p *ClientRequestProperties) QueryOption {
+	return func(q *queryOptions) error {
+		return p.applyQuery(q.requestProperties)
+	}
+}
+
+// QueryParameters sets the values of the Definitions of the Stmt for this Query() call, instead of the Parameters
+// of the Stmt. This lets one Stmt, such as a package level variable, be used by many goroutines with different
+// values, without building a Stmt for each call.
+func QueryParameters(params Parameters) QueryOption {
+	return func(q *queryOptions) error {
+		params := params.clone()
+		q.params = &params
+		return nil
+	}
+}
+
 // ResultsProgressiveDisable disables the progressive query stream.
 func ResultsProgressiveDisable() QueryOption {
 	return func(q *queryOptions) error {
@@ -53,6 +80,16 @@ func ResultsProgressiveDisable() QueryOption {
 	}
 }
 
+// ResultsProgressCallback sets f to be called with the progress of the query, 0-100%, each time the service reports
+// it in a progressive stream. f is called from the goroutine that reads the results, so rows are not read while it
+// runs and it should return quickly. It is not called if the stream is not progressive.
+func ResultsProgressCallback(f func(percent float64)) QueryOption {
+	return func(q *queryOptions) error {
+		q.onProgress = f
+		return nil
+	}
+}
+
 // queryServerTimeout is the amount of time the server will allow a query to take.
 // NOTE: I have made the serverTimeout private. For the moment, I'm going to use the context.Context timer
 // to set timeouts via this private method.
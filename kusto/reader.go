@@ -76,8 +76,15 @@ type RowIterator struct {
 	nonPrimary map[frames.TableKind]v2.DataTable
 	// dsCompletion is the completion frame for a non-progressive query.
 	dsCompletion v2.DataSetCompletion
+	// completionErr is the error that dsCompletion reports, which is returned once all rows have been read.
+	completionErr error
+	// complete is set once all the frames of the response were received without an error.
+	complete bool
 
-	columns table.Columns
+	// columns are the columns of the primary result, which every row shares. columnsReady is closed once they are
+	// set, or the stream failed or was stopped before they were.
+	columns      table.Columns
+	columnsReady chan struct{}
 
 	// error holds an error that was encountered. Once this is set, all calls on Rowiterator will
 	// just return the error here.
@@ -106,8 +113,8 @@ func newRowIterator(ctx context.Context, cancel context.CancelFunc, execResp exe
 		rows:       make(chan Row, 1000),
 		nonPrimary: make(map[frames.TableKind]v2.DataTable),
 	}
-	columnsReady := ri.start()
-	return ri, columnsReady
+	ri.columnsReady = ri.start()
+	return ri, ri.columnsReady
 }
 
 func (r *RowIterator) start() chan struct{} {
@@ -124,11 +131,24 @@ func (r *RowIterator) start() chan struct{} {
 			select {
 			case <-r.ctx.Done():
 			case sent := <-r.inColumns:
-				r.columns = sent.inColumns
+				r.setColumns(sent.inColumns)
 				sent.done()
 				closeDone()
 			case sent, ok := <-r.inRows:
+				// The columns are sent before the rows, but select can pick the rows first. Query() only returns
+				// once the columns are set, so the rows would block on r.rows forever if there were more than fit.
+				select {
+				case sent := <-r.inColumns:
+					r.setColumns(sent.inColumns)
+					sent.done()
+					closeDone()
+				default:
+				}
+
 				if !ok {
+					r.mu.Lock()
+					r.complete = true
+					r.mu.Unlock()
 					close(r.rows)
 					return
 				}
@@ -164,6 +184,9 @@ func (r *RowIterator) start() chan struct{} {
 			case sent := <-r.inCompletion:
 				r.mu.Lock()
 				r.dsCompletion = sent.inCompletion
+				if err := sent.inCompletion.Err(); err != nil {
+					r.completionErr = err
+				}
 				sent.done()
 				r.mu.Unlock()
 			case sent := <-r.inErr:
@@ -177,6 +200,12 @@ func (r *RowIterator) start() chan struct{} {
 	return done
 }
 
+// ClientRequestID returns the id that the call was sent with, as set with ClientRequestProperties.SetClientRequestID()
+// or made up by the client. It is empty for a RowIterator that was not returned by a call.
+func (r *RowIterator) ClientRequestID() string {
+	return r.RequestHeader.Get("x-ms-client-request-id")
+}
+
 // Mock is used to tell the RowIterator to return specific data for tests. This is useful when building
 // fakes of the client's Query() call for hermetic tests. This can only be called in a test or it will panic.
 func (r *RowIterator) Mock(m *MockRows) error {
@@ -214,6 +243,8 @@ func (r *RowIterator) Do(f func(r *table.Row) error) error {
 // DoOnRowOrError calls f for every row returned by the query. If errors occur inline within the rows, they are passed to f.
 // Other errors will stop the iteration and be returned.
 // If f returns a non-nil error, iteration stops.
+// When the service reports that the query failed in part, once all the rows were read the returned error has all the
+// failures it reported, which include those passed to f.
 func (r *RowIterator) DoOnRowOrError(f func(r *table.Row, e *errors.Error) error) error {
 	for {
 		row, inlineErr, err := r.NextRowOrError()
@@ -257,6 +288,8 @@ func (r *RowIterator) Next() (row *table.Row, finalError error) {
 // Once finalError returns non-nil, all subsequent calls will return the same error.
 // finalError will be set to io.EOF is when frame parsing completed with success or partial success (data + errors).
 // if finalError is not io.EOF, reading the frame has resulted in a failure state (no data is expected).
+// If the service reports a failure of the query when the stream completes, finalError is that failure, which is
+// returned after all the rows that were sent before it.
 func (r *RowIterator) NextRowOrError() (row *table.Row, inlineError *errors.Error, finalError error) {
 	if err := r.getError(); err != nil {
 		return nil, nil, err
@@ -266,11 +299,7 @@ func (r *RowIterator) NextRowOrError() (row *table.Row, inlineError *errors.Erro
 		if r.ctx.Err() != nil {
 			return nil, nil, r.ctx.Err()
 		}
-		nextRow, err := r.mock.nextRow()
-		if err != nil {
-			return nil, nil, err
-		}
-		return nextRow, nil, nil
+		return r.mock.nextRowOrError()
 	}
 
 	select {
@@ -281,13 +310,63 @@ func (r *RowIterator) NextRowOrError() (row *table.Row, inlineError *errors.Erro
 			if err := r.getError(); err != nil {
 				return nil, nil, err
 			}
+			// The service can report a failure after it sent rows, which we return after those rows.
+			if err := r.getCompletionErr(); err != nil {
+				r.setError(err)
+				return nil, nil, err
+			}
 			return nil, nil, io.EOF
 		}
 		if kvs.Error != nil {
 			return nil, kvs.Error, nil
 		}
-		return &table.Row{ColumnTypes: r.columns, Values: kvs.Values, Op: r.op, Replace: kvs.Replace}, nil, nil
+		return &table.Row{ColumnTypes: r.getColumns(), Values: kvs.Values, Op: r.op, Replace: kvs.Replace}, nil, nil
+	}
+}
+
+// Columns returns the columns of the primary result, with the name and the Kusto type of each. They are known once
+// Query() or Mgmt() returned, so Columns can be called before the first row is read, and after the last one. Every
+// row shares them as its ColumnTypes, which must not be changed. If the call failed or was stopped before the
+// service sent the columns, Columns returns that error, or NoColumnsErr if the response had no primary result.
+func (r *RowIterator) Columns() (table.Columns, error) {
+	if r.mock != nil {
+		return r.mock.columns, nil
+	}
+	if r.columnsReady != nil {
+		select {
+		case <-r.columnsReady:
+		case <-r.ctx.Done():
+		}
+	}
+
+	if cols := r.getColumns(); cols != nil {
+		return cols, nil
+	}
+	if err := r.getError(); err != nil {
+		return nil, err
+	}
+	if err := r.getCompletionErr(); err != nil {
+		return nil, err
+	}
+	if r.ctx != nil && r.ctx.Err() != nil {
+		return nil, r.ctx.Err()
 	}
+	return nil, NoColumnsErr
+}
+
+// NoColumnsErr is returned by RowIterator.Columns() for a response that had no primary result.
+var NoColumnsErr = errors.ES(errors.OpQuery, errors.KInternal, "the response had no primary result to get the columns of").SetNoRetry()
+
+func (r *RowIterator) getColumns() table.Columns {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.columns
+}
+
+func (r *RowIterator) setColumns(cols table.Columns) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.columns = cols
 }
 
 func (r *RowIterator) getError() error {
@@ -296,6 +375,12 @@ func (r *RowIterator) getError() error {
 	return r.error
 }
 
+func (r *RowIterator) getCompletionErr() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.completionErr
+}
+
 func (r *RowIterator) setError(e error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -314,7 +399,8 @@ func (r *RowIterator) Progressive() bool {
 	return r.progressive
 }
 
-// GetNonPrimary will return a non-primary dataTable if it exists from the last query. The non-primary table and common names are defined under the frames.TableKind enum.
+// GetNonPrimary will return a non-primary dataTable if it exists from the last query. Use NonPrimaryResults() instead,
+// which tells apart tables that are missing from tables that were not received yet. The non-primary table and common names are defined under the frames.TableKind enum.
 // Returns io.ErrUnexpectedEOF if not found. May not have all tables until RowIterator has reached io.EOF.
 func (r *RowIterator) GetNonPrimary(tableKind, tableName frames.TableKind) (v2.DataTable, error) {
 	r.mu.Lock()
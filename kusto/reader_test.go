@@ -0,0 +1,180 @@
+package kusto
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRowIteratorColumns(t *testing.T) {
+	t.Parallel()
+
+	want := table.Columns{{Name: "x", Type: types.Long}, {Name: "name", Type: types.String}}
+
+	tests := []struct {
+		desc     string
+		response string
+	}{
+		{
+			desc: "Progressive",
+			response: `[{"FrameType":"DataSetHeader","IsProgressive":true,"Version":"v2.0"},
+				{"FrameType":"TableHeader","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+					"Columns":[{"ColumnName":"x","ColumnType":"long"},{"ColumnName":"name","ColumnType":"string"}]},
+				{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":0,"Rows":[[1,"a"]]},
+				{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":0,"Rows":[[2,"b"]]},
+				{"FrameType":"TableCompletion","TableId":0,"RowCount":2},
+				{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}]`,
+		},
+		{
+			desc: "Not progressive",
+			response: `[{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0"},
+				{"FrameType":"DataTable","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+					"Columns":[{"ColumnName":"x","ColumnType":"long"},{"ColumnName":"name","ColumnType":"string"}],"Rows":[[1,"a"],[2,"b"]]},
+				{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}]`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			server := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(test.response))
+			})
+			iter, err := testClient(t, server).Query(context.Background(), "db", NewStmt("T"))
+			require.NoError(t, err)
+			defer iter.Stop()
+
+			// The columns are known before the first row is read.
+			cols, err := iter.Columns()
+			require.NoError(t, err)
+			assert.Equal(t, want, cols)
+
+			count := 0
+			for {
+				row, err := iter.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				count++
+				// The rows share the columns rather than each having a copy.
+				assert.Same(t, &cols[0], &row.ColumnTypes[0])
+			}
+			assert.Equal(t, 2, count)
+
+			cols, err = iter.Columns()
+			require.NoError(t, err)
+			assert.Equal(t, want, cols)
+		})
+	}
+}
+
+func TestRowIteratorColumnsErrors(t *testing.T) {
+	t.Parallel()
+
+	// The query failed before the service sent a primary result.
+	server := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0"},
+			{"FrameType":"DataSetCompletion","HasErrors":true,"Cancelled":false,
+				"OneApiErrors":[{"error":{"code":"LimitsExceeded","message":"Request is invalid and cannot be executed."}}]}]`))
+	})
+	iter, err := testClient(t, server).Query(context.Background(), "db", NewStmt("T"))
+	require.NoError(t, err)
+	defer iter.Stop()
+	_, err = iter.Columns()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "LimitsExceeded")
+
+	// Mocked rows have the columns of the MockRows.
+	want := table.Columns{{Name: "x", Type: types.Long}}
+	m, err := NewMockRows(want)
+	require.NoError(t, err)
+	require.NoError(t, m.Row(value.Values{value.Long{Value: 1, Valid: true}}))
+	iter = &RowIterator{}
+	require.NoError(t, iter.Mock(m))
+	cols, err := iter.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, want, cols)
+}
+
+func TestRowIteratorPartialFailure(t *testing.T) {
+	t.Parallel()
+
+	// With deferpartialqueryfailures, a shard that failed is reported by an error frame between the data frames, and
+	// the failures of the query are reported again when it completes.
+	const response = `[{"FrameType":"DataSetHeader","IsProgressive":true,"Version":"v2.0"},
+		{"FrameType":"TableHeader","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+			"Columns":[{"ColumnName":"x","ColumnType":"long"}]},
+		{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":0,"Rows":[[1]]},
+		{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":0,"Rows":[
+			{"OneApiErrors":[{"error":{"code":"LimitsExceeded","message":"Shard 1 failed."}}]}]},
+		{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":0,"Rows":[[2]]},
+		{"FrameType":"TableCompletion","TableId":0,"RowCount":2},
+		{"FrameType":"DataSetCompletion","HasErrors":true,"Cancelled":false,"OneApiErrors":[
+			{"error":{"code":"LimitsExceeded","message":"Shard 1 failed."}},
+			{"error":{"code":"LimitsExceeded","message":"Shard 2 failed."}}]}]`
+
+	query := func(t *testing.T) *RowIterator {
+		server := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(response))
+		})
+		iter, err := testClient(t, server).Query(context.Background(), "db", NewStmt("T"))
+		require.NoError(t, err)
+		t.Cleanup(iter.Stop)
+		return iter
+	}
+
+	t.Run("DoOnRowOrError", func(t *testing.T) {
+		t.Parallel()
+
+		iter := query(t)
+		var got []string
+		err := iter.DoOnRowOrError(func(row *table.Row, e *errors.Error) error {
+			if e != nil {
+				got = append(got, "error: "+e.Error())
+				return nil
+			}
+			got = append(got, row.Values[0].String())
+			return nil
+		})
+		require.Len(t, got, 3)
+		assert.Equal(t, "1", got[0])
+		assert.Contains(t, got[1], "Shard 1 failed.")
+		assert.Equal(t, "2", got[2])
+
+		// The error once all the rows were read has all the failures of the query.
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Shard 1 failed.")
+		assert.Contains(t, err.Error(), "Shard 2 failed.")
+		assert.Equal(t, errors.KLimitsExceeded, errors.KindOf(err))
+	})
+
+	t.Run("Do", func(t *testing.T) {
+		t.Parallel()
+
+		iter := query(t)
+		var got []string
+		err := iter.Do(func(row *table.Row) error {
+			got = append(got, row.Values[0].String())
+			return nil
+		})
+		// Do stops at the first error frame, and returns it.
+		assert.Equal(t, []string{"1"}, got)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Shard 1 failed.")
+		assert.NotContains(t, err.Error(), "Shard 2 failed.")
+
+		_, err = iter.Next()
+		assert.Contains(t, err.Error(), "Shard 1 failed.", "the error stays")
+	})
+}
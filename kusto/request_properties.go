@@ -0,0 +1,232 @@
+package kusto
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+)
+
+const (
+	// maxServerTimeout is the longest server timeout that the service allows.
+	maxServerTimeout = 1 * time.Hour
+	// serverTimeoutSkew is how much shorter than the time left to the deadline of the context the server timeout
+	// is, so that the service gives up on a call before the client does.
+	serverTimeoutSkew = 1 * time.Second
+	// queryConsistencyOption is the request property of the QueryConsistency.
+	queryConsistencyOption = "queryconsistency"
+)
+
+// ClientRequestProperties are properties that apply to a single Query() or Mgmt() call, such as the time the service
+// lets it run for. Set them with the Set methods, which can be chained, and pass them to a call with
+// QueryRequestProperties() or MgmtRequestProperties(). A ClientRequestProperties can be used for many calls, but must
+// not be changed while a call uses it.
+// For more information please look at: https://docs.microsoft.com/en-us/azure/kusto/api/netfx/request-properties
+type ClientRequestProperties struct {
+	options         map[string]interface{}
+	clientRequestID string
+	// consistency is set by SetQueryConsistency(), "" for the client default.
+	consistency QueryConsistency
+}
+
+// QueryConsistency is how consistent the results of a query are with the latest changes to the data, which the
+// service sends as the queryconsistency request property. A weak consistency lets any node of the cluster run the
+// query, on metadata that can be a little behind, which spreads the load of queries of follower or read-only
+// databases. Commands always run with strong consistency.
+type QueryConsistency string
+
+const (
+	// StrongConsistency runs the query on the latest metadata, on the node that manages it. It is the default of the
+	// service.
+	StrongConsistency QueryConsistency = "strongconsistency"
+	// WeakConsistency runs the query on any node, on metadata that can be a few minutes behind.
+	WeakConsistency QueryConsistency = "weakconsistency"
+	// WeakConsistencyByQuery is WeakConsistency, with the same query text run on the same node, for its caches.
+	WeakConsistencyByQuery QueryConsistency = "weakconsistency_by_query"
+	// WeakConsistencyByDatabase is WeakConsistency, with the queries of a database run on the same node.
+	WeakConsistencyByDatabase QueryConsistency = "weakconsistency_by_database"
+	// WeakConsistencyBySession is WeakConsistency, with the queries of a session run on the same node.
+	WeakConsistencyBySession QueryConsistency = "weakconsistency_by_session"
+)
+
+// validate checks that q is one of the QueryConsistency constants, or "" for none.
+func (q QueryConsistency) validate() error {
+	switch q {
+	case "", StrongConsistency, WeakConsistency, WeakConsistencyByQuery, WeakConsistencyByDatabase, WeakConsistencyBySession:
+		return nil
+	}
+	return errors.ES(errors.OpQuery, errors.KClientArgs, "QueryConsistency %q is not one of the QueryConsistency constants", string(q)).SetNoRetry()
+}
+
+// WithQueryConsistency sets the QueryConsistency of the Query() calls of the client, unless a call sets its own with
+// ClientRequestProperties.SetQueryConsistency(). Mgmt() calls are not affected. By default, the service default of
+// StrongConsistency applies.
+func WithQueryConsistency(q QueryConsistency) Option {
+	return func(c *Client) {
+		c.consistency = q
+	}
+}
+
+// NewClientRequestProperties returns a ClientRequestProperties with no properties set.
+func NewClientRequestProperties() *ClientRequestProperties {
+	return &ClientRequestProperties{options: map[string]interface{}{}}
+}
+
+// SetServerTimeout sets how long the service lets the call run for, which can be at most 1 hour.
+func (p *ClientRequestProperties) SetServerTimeout(d time.Duration) *ClientRequestProperties {
+	return p.SetOption("servertimeout", d)
+}
+
+// SetNoTruncation stops the service from truncating the results of the call to its default row and size limits.
+func (p *ClientRequestProperties) SetNoTruncation() *ClientRequestProperties {
+	return p.SetOption("notruncation", true)
+}
+
+// SetNoRequestTimeout sets the request timeout of the call to its maximum.
+func (p *ClientRequestProperties) SetNoRequestTimeout() *ClientRequestProperties {
+	return p.SetOption("norequesttimeout", true)
+}
+
+// SetDeferPartialQueryFailures makes the service report the failures of parts of a query inline with the results,
+// instead of failing the whole query.
+func (p *ClientRequestProperties) SetDeferPartialQueryFailures() *ClientRequestProperties {
+	return p.SetOption("deferpartialqueryfailures", true)
+}
+
+// SetQueryResultsCacheMaxAge lets the service return cached results of the query that are at most d old.
+func (p *ClientRequestProperties) SetQueryResultsCacheMaxAge(d time.Duration) *ClientRequestProperties {
+	return p.SetOption("query_results_cache_max_age", d)
+}
+
+// SetQueryConsistency sets the QueryConsistency of the call, over the one of WithQueryConsistency(). It only applies
+// to Query() calls, Mgmt() calls ignore it.
+func (p *ClientRequestProperties) SetQueryConsistency(q QueryConsistency) *ClientRequestProperties {
+	p.consistency = q
+	return p
+}
+
+// SetOption sets the request property name to v, for properties that have no Set method. v must encode to JSON
+// as the service expects, except a time.Duration, which is sent as a Kusto timespan. Note that the service does not
+// fail on a property it does not know or a bad value, the property just has no effect.
+func (p *ClientRequestProperties) SetOption(name string, v interface{}) *ClientRequestProperties {
+	if p.options == nil {
+		p.options = map[string]interface{}{}
+	}
+	p.options[name] = v
+	return p
+}
+
+// SetClientRequestID sets the id that the call is sent with, which identifies it in the service logs and in
+// .show queries. Without one, the client makes up an id for each call. RowIterator.ClientRequestID() and
+// errors.Error.ClientRequestId() return the id of a call.
+func (p *ClientRequestProperties) SetClientRequestID(id string) *ClientRequestProperties {
+	p.clientRequestID = id
+	return p
+}
+
+// ClientRequestID returns the id set with SetClientRequestID().
+func (p *ClientRequestProperties) ClientRequestID() string {
+	return p.clientRequestID
+}
+
+// apply adds the properties to the properties of a request.
+func (p *ClientRequestProperties) apply(rp *requestProperties) error {
+	if p == nil {
+		return nil
+	}
+
+	for name, v := range p.options {
+		if name == "" {
+			return errors.ES(errors.OpQuery, errors.KClientArgs, "a ClientRequestProperties option cannot have an empty name")
+		}
+		if d, ok := v.(time.Duration); ok {
+			if name == "servertimeout" && (d <= 0 || d > maxServerTimeout) {
+				return errors.ES(errors.OpQuery, errors.KClientArgs, "ServerTimeout option was set to %v, but must be more than 0 and can't be more than 1 hour", d)
+			}
+			v = value.Timespan{Valid: true, Value: d}.Marshal()
+		}
+		rp.Options[name] = v
+	}
+	if p.clientRequestID != "" {
+		rp.ClientRequestID = p.clientRequestID
+	}
+	return nil
+}
+
+// applyQuery adds the properties to the properties of a Query() request, which are those of apply() and the
+// QueryConsistency.
+func (p *ClientRequestProperties) applyQuery(rp *requestProperties) error {
+	if err := p.apply(rp); err != nil || p == nil {
+		return err
+	}
+	if p.consistency != "" {
+		if err := p.consistency.validate(); err != nil {
+			return err
+		}
+		rp.Options[queryConsistencyOption] = string(p.consistency)
+	}
+	return nil
+}
+
+// deadlineServerTimeout returns the server timeout for a call that must end by deadline, which is 0 if the deadline
+// has passed.
+func deadlineServerTimeout(deadline time.Time) time.Duration {
+	d := deadline.Sub(nower())
+	if d > serverTimeoutSkew {
+		d -= serverTimeoutSkew
+	}
+	if d > maxServerTimeout {
+		d = maxServerTimeout
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// callDeadline returns when a call with ctx must end: the deadline of ctx, or the end of the Timeout of the client of
+// WithHTTPClient() if that comes first.
+func (c *Client) callDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	if c.httpClient == nil || c.httpClient.Timeout <= 0 {
+		return deadline, ok
+	}
+	timeout := nower().Add(c.httpClient.Timeout)
+	if !ok || timeout.Before(deadline) {
+		return timeout, true
+	}
+	return deadline, true
+}
+
+// serverTimeoutNote returns why the service did not give up on a call with properties rp before the client did, when
+// the server timeout that the caller set is longer than the time left to the deadline of ctx. It is "" otherwise, such
+// as when the server timeout is derived, the one the client set from the deadline.
+func serverTimeoutNote(ctx context.Context, rp *requestProperties, derived time.Duration) string {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ""
+	}
+	v := rp.Options["servertimeout"]
+	if v == nil || v == (value.Timespan{Valid: true, Value: derived}.Marshal()) {
+		return ""
+	}
+	st := value.Timespan{}
+	if err := st.Unmarshal(v); err != nil || !st.Valid {
+		return ""
+	}
+	if left := deadline.Sub(nower()); st.Value > left {
+		return fmt.Sprintf("the servertimeout request property(%s) is longer than the time left to the deadline of the context(%s), so the client gave up on the call before the service", st.Value, left.Round(time.Millisecond))
+	}
+	return ""
+}
+
+// annotateTimeout adds note to err, if the call failed because the deadline of ctx passed.
+func annotateTimeout(ctx context.Context, err error, note string) error {
+	e, ok := err.(*errors.Error)
+	if note == "" || !ok || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	return errors.W(e, errors.ES(e.Op, errors.KTimeout, "%s", note))
+}
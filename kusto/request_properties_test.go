@@ -0,0 +1,363 @@
+package kusto
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRequestProperties(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc  string
+		props *ClientRequestProperties
+		// deadline is the deadline of the context of the call, if not zero.
+		deadline time.Duration
+		want     string
+		wantErr  bool
+	}{
+		{
+			desc:  "No properties",
+			props: nil,
+			want:  `{"Options":{"results_progressive_enabled":true},"Parameters":null}`,
+		},
+		{
+			desc:  "Typed setters",
+			props: NewClientRequestProperties().SetServerTimeout(30 * time.Minute).SetNoTruncation().SetNoRequestTimeout().SetDeferPartialQueryFailures(),
+			want: `{"Options":{"deferpartialqueryfailures":true,"norequesttimeout":true,"notruncation":true,` +
+				`"results_progressive_enabled":true,"servertimeout":"00:30:00"},"Parameters":null}`,
+		},
+		{
+			desc:  "Cache max age and client request id",
+			props: NewClientRequestProperties().SetQueryResultsCacheMaxAge(90 * time.Second).SetClientRequestID("MyApp.Query;1"),
+			want: `{"Options":{"query_results_cache_max_age":"00:01:30","results_progressive_enabled":true},"Parameters":null,` +
+				`"ClientRequestId":"MyApp.Query;1"}`,
+		},
+		{
+			desc:  "Generic options",
+			props: (&ClientRequestProperties{}).SetOption("truncationmaxrecords", 10).SetOption("query_language", "kql").SetOption("request_readonly", true),
+			want: `{"Options":{"query_language":"kql","request_readonly":true,"results_progressive_enabled":true,` +
+				`"truncationmaxrecords":10},"Parameters":null}`,
+		},
+		{
+			desc:     "Server timeout wins over the deadline",
+			props:    NewClientRequestProperties().SetServerTimeout(2 * time.Minute),
+			deadline: 10 * time.Minute,
+			want:     `{"Options":{"results_progressive_enabled":true,"servertimeout":"00:02:00"},"Parameters":null}`,
+		},
+		{
+			desc:    "Server timeout over an hour",
+			props:   NewClientRequestProperties().SetServerTimeout(2 * time.Hour),
+			wantErr: true,
+		},
+		{
+			desc:    "Empty option name",
+			props:   NewClientRequestProperties().SetOption("", 1),
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			if test.deadline != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.deadline)
+				defer cancel()
+			}
+
+			c := &Client{}
+			opts, err := c.setQueryOptions(ctx, errors.OpQuery, NewStmt("T"), QueryRequestProperties(test.props))
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			got, err := json.Marshal(opts.requestProperties)
+			require.NoError(t, err)
+			assert.JSONEq(t, test.want, string(got))
+
+			mgmtOpts, err := c.setMgmtOptions(ctx, errors.OpMgmt, NewStmt(".show tables"), MgmtRequestProperties(test.props))
+			require.NoError(t, err)
+			assert.Equal(t, opts.requestProperties.ClientRequestID, mgmtOpts.requestProperties.ClientRequestID)
+		})
+	}
+}
+
+func TestQueryConsistency(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc   string
+		client QueryConsistency
+		call   QueryConsistency
+		// want is the queryconsistency request property of the query, "" when it is not sent.
+		want    string
+		wantErr bool
+	}{
+		{desc: "Not set"},
+		{desc: "Client default", client: WeakConsistency, want: "weakconsistency"},
+		{desc: "Call", call: WeakConsistencyByQuery, want: "weakconsistency_by_query"},
+		{desc: "Call over the client default", client: WeakConsistencyByDatabase, call: StrongConsistency, want: "strongconsistency"},
+		{desc: "Call with the client default", client: WeakConsistencyBySession, call: WeakConsistencyBySession, want: "weakconsistency_by_session"},
+		{desc: "Strong client default", client: StrongConsistency, want: "strongconsistency"},
+		{desc: "Unknown call value", call: "eventual", wantErr: true},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			c := &Client{consistency: test.client}
+			props := NewClientRequestProperties()
+			if test.call != "" {
+				props.SetQueryConsistency(test.call)
+			}
+
+			opts, err := c.setQueryOptions(context.Background(), errors.OpQuery, NewStmt("T"), QueryRequestProperties(props))
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			want := map[string]interface{}{"results_progressive_enabled": true}
+			if test.want != "" {
+				want["queryconsistency"] = test.want
+			}
+			got, err := json.Marshal(opts.requestProperties.Options)
+			require.NoError(t, err)
+			wantJSON, err := json.Marshal(want)
+			require.NoError(t, err)
+			assert.JSONEq(t, string(wantJSON), string(got))
+
+			// Commands always run with strong consistency, which is the default of the service.
+			mgmtOpts, err := c.setMgmtOptions(context.Background(), errors.OpMgmt, NewStmt(".show tables"), MgmtRequestProperties(props))
+			require.NoError(t, err)
+			got, err = json.Marshal(mgmtOpts.requestProperties)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"Options":{},"Parameters":null}`, string(got))
+		})
+	}
+}
+
+func TestWithQueryConsistency(t *testing.T) {
+	t.Parallel()
+
+	auth := Authorization{Authorizer: autorest.NullAuthorizer{}}
+	client, err := New("https://help.kusto.windows.net", auth, WithQueryConsistency(WeakConsistency))
+	require.NoError(t, err)
+	assert.Equal(t, WeakConsistency, client.consistency)
+
+	_, err = New("https://help.kusto.windows.net", auth, WithQueryConsistency("eventual"))
+	require.Error(t, err)
+	assert.Equal(t, errors.KClientArgs, errors.KindOf(err))
+}
+
+// fakeQueryService serves a query or mgmt response and records the request it got.
+type fakeQueryService struct {
+	status int
+	body   string
+
+	header http.Header
+	msg    map[string]interface{}
+}
+
+func (f *fakeQueryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.header = r.Header
+	b, _ := ioutil.ReadAll(r.Body)
+	_ = json.Unmarshal(b, &f.msg)
+
+	w.Header().Set("x-ms-activity-id", "activity")
+	w.WriteHeader(f.status)
+	_, _ = w.Write([]byte(f.body))
+}
+
+func (f *fakeQueryService) client(t *testing.T) *Client {
+	return testClient(t, f)
+}
+
+// testClient returns a Client that sends its calls to a server with handler h.
+func testClient(t *testing.T, h http.Handler) *Client {
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	return &Client{
+		endpoint: server.URL,
+		conn: &conn{
+			auth:     autorest.NullAuthorizer{},
+			endQuery: &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/v2/rest/query"},
+			endMgmt:  &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/v1/rest/mgmt"},
+			client:   server.Client(),
+		},
+	}
+}
+
+func TestClientRequestID(t *testing.T) {
+	t.Parallel()
+
+	const v2Response = `[
+		{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0"},
+		{"FrameType":"DataTable","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+			"Columns":[{"ColumnName":"x","ColumnType":"long"}],"Rows":[[1]]},
+		{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}
+	]`
+
+	t.Run("Set id is sent and echoed", func(t *testing.T) {
+		t.Parallel()
+
+		service := &fakeQueryService{status: http.StatusOK, body: v2Response}
+		props := NewClientRequestProperties().SetClientRequestID("MyApp.Query;1").SetNoTruncation()
+		iter, err := service.client(t).Query(context.Background(), "db", NewStmt("T"), QueryRequestProperties(props))
+		require.NoError(t, err)
+		defer iter.Stop()
+
+		assert.Equal(t, "MyApp.Query;1", service.header.Get("x-ms-client-request-id"))
+		properties := service.msg["properties"].(map[string]interface{})
+		assert.Equal(t, "MyApp.Query;1", properties["ClientRequestId"])
+		assert.Equal(t, true, properties["Options"].(map[string]interface{})["notruncation"])
+		assert.Equal(t, "MyApp.Query;1", iter.ClientRequestID())
+	})
+
+	t.Run("Made up id is the same in the header and the body", func(t *testing.T) {
+		t.Parallel()
+
+		service := &fakeQueryService{status: http.StatusOK, body: v2Response}
+		iter, err := service.client(t).Query(context.Background(), "db", NewStmt("T"))
+		require.NoError(t, err)
+		defer iter.Stop()
+
+		id := service.header.Get("x-ms-client-request-id")
+		assert.Contains(t, id, "KGC.execute;")
+		assert.Equal(t, id, service.msg["properties"].(map[string]interface{})["ClientRequestId"])
+		assert.Equal(t, id, iter.ClientRequestID())
+	})
+
+	t.Run("Failed call", func(t *testing.T) {
+		t.Parallel()
+
+		service := &fakeQueryService{status: http.StatusBadRequest, body: `{"error":{"code":"BadRequest","message":"bad"}}`}
+		props := NewClientRequestProperties().SetClientRequestID("MyApp.Mgmt;2")
+		_, err := service.client(t).Mgmt(context.Background(), "db", NewStmt(".show tables"), MgmtRequestProperties(props))
+		require.Error(t, err)
+
+		e, ok := err.(*errors.Error)
+		require.True(t, ok)
+		assert.Equal(t, "MyApp.Mgmt;2", e.ClientRequestId())
+		assert.Equal(t, "activity", e.ActivityId())
+	})
+}
+
+func TestServerTimeoutFromDeadline(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		// deadline is the deadline of the context of the call, if not zero.
+		deadline time.Duration
+		props    *ClientRequestProperties
+		// want is the server timeout sent, if any.
+		want     time.Duration
+		wantNote bool
+	}{
+		{desc: "No deadline"},
+		{desc: "Deadline", deadline: 30 * time.Second, want: 29 * time.Second},
+		{desc: "Short deadline", deadline: 500 * time.Millisecond, want: 500 * time.Millisecond},
+		{desc: "Deadline over the maximum", deadline: 2 * time.Hour, want: time.Hour},
+		{desc: "Set server timeout", deadline: 30 * time.Second, props: NewClientRequestProperties().SetServerTimeout(10 * time.Second), want: 10 * time.Second},
+		{
+			desc:     "Set server timeout longer than the deadline",
+			deadline: 30 * time.Second,
+			props:    NewClientRequestProperties().SetServerTimeout(10 * time.Minute),
+			want:     10 * time.Minute,
+			wantNote: true,
+		},
+		{desc: "Set server timeout without a deadline", props: NewClientRequestProperties().SetServerTimeout(10 * time.Minute), want: 10 * time.Minute},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			if test.deadline != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.deadline)
+				defer cancel()
+			}
+
+			c := &Client{}
+			qOpts, err := c.setQueryOptions(ctx, errors.OpQuery, NewStmt("T"), QueryRequestProperties(test.props))
+			require.NoError(t, err)
+			mOpts, err := c.setMgmtOptions(ctx, errors.OpMgmt, NewStmt(".show tables"), MgmtRequestProperties(test.props))
+			require.NoError(t, err)
+
+			for _, rp := range []*requestProperties{qOpts.requestProperties, mOpts.requestProperties} {
+				got, ok := rp.Options["servertimeout"]
+				if test.want == 0 {
+					assert.False(t, ok)
+					continue
+				}
+				ts := value.Timespan{}
+				require.NoError(t, ts.Unmarshal(got))
+				assert.InDelta(t, test.want, ts.Value, float64(time.Second))
+				assert.LessOrEqual(t, ts.Value, test.want)
+			}
+			assert.Equal(t, test.wantNote, qOpts.timeoutNote != "")
+			assert.Equal(t, test.wantNote, mOpts.timeoutNote != "")
+		})
+	}
+}
+
+func TestServerTimeoutMismatch(t *testing.T) {
+	t.Parallel()
+
+	// The service takes longer than the context of the call allows.
+	done := make(chan struct{})
+	defer close(done)
+	client := testClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	client.conn.(*conn).retry = retryPolicy{attempts: 1}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	props := NewClientRequestProperties().SetServerTimeout(10 * time.Minute)
+	_, err := client.Query(ctx, "db", NewStmt("T"), QueryRequestProperties(props))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the servertimeout request property(10m0s) is longer than the time left to the deadline of the context")
+	e, ok := err.(*errors.Error)
+	require.True(t, ok)
+	assert.Equal(t, errors.KTimeout, e.Kind)
+
+	// Without a server timeout of its own, the error is as it was.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.Query(ctx, "db", NewStmt("T"))
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "servertimeout")
+}
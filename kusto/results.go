@@ -0,0 +1,142 @@
+package kusto
+
+// results.go holds the accessors of RowIterator for the tables that a query returns besides the primary result.
+
+import (
+	goErrors "errors"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/internal/frames"
+	"github.com/google/uuid"
+)
+
+// ErrResultsNotReady is returned by the accessors of the non-primary tables of a RowIterator, such as
+// QueryCompletionInformation(), before all the frames of the response were received. The service sends those tables
+// after the primary result, so read the rows until io.EOF before calling them.
+var ErrResultsNotReady = goErrors.New("the non-primary tables of the query have not been received yet, read the rows until io.EOF first")
+
+// NonPrimaryResult is a table that a query returned besides the primary result, such as the QueryProperties table.
+type NonPrimaryResult struct {
+	// TableID is the position of the table in the response.
+	TableID int
+	// Kind is the kind of the table, such as "QueryProperties" or "QueryCompletionInformation".
+	Kind string
+	// Name is the name of the table, such as "@ExtendedProperties".
+	Name string
+	// Columns are the columns of the table.
+	Columns table.Columns
+	// Rows are the rows of the table, which can be decoded with ToStruct().
+	Rows table.Rows
+}
+
+// QueryProperty is a row of the QueryProperties table, which holds properties of the query, such as how to
+// visualize the results when the query uses the render operator.
+type QueryProperty struct {
+	// TableID is the id of the table that the property is about.
+	TableID int32 `kusto:"TableId"`
+	// Key is the name of the property, such as "Visualization".
+	Key string
+	// Value is the value of the property, which is usually a JSON object.
+	Value value.Dynamic
+}
+
+// QueryCompletionRecord is a row of the QueryCompletionInformation table, which tells how the query completed and
+// which resources it used. The Payload of the record with EventTypeName "QueryResourceConsumption" holds the resource
+// usage of the query as JSON.
+type QueryCompletionRecord struct {
+	Timestamp        time.Time
+	ClientRequestID  string    `kusto:"ClientRequestId"`
+	ActivityID       uuid.UUID `kusto:"ActivityId"`
+	SubActivityID    uuid.UUID `kusto:"SubActivityId"`
+	ParentActivityID uuid.UUID `kusto:"ParentActivityId"`
+	Level            int32
+	LevelName        string
+	StatusCode       int32
+	StatusCodeName   string
+	EventType        int32
+	EventTypeName    string
+	Payload          string
+}
+
+// NonPrimaryResults returns the tables that the query returned besides the primary result, in the order of the
+// response. It returns ErrResultsNotReady until all the frames of the response were received, and the error of the
+// RowIterator if the response failed.
+func (r *RowIterator) NonPrimaryResults() ([]NonPrimaryResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.error != nil {
+		return nil, r.error
+	}
+	if !r.complete {
+		return nil, ErrResultsNotReady
+	}
+
+	results := make([]NonPrimaryResult, 0, len(r.nonPrimary))
+	for _, dt := range r.nonPrimary {
+		res := NonPrimaryResult{
+			TableID: dt.TableID,
+			Kind:    string(dt.TableKind),
+			Name:    string(dt.TableName),
+			Columns: dt.Columns,
+		}
+		for _, values := range dt.KustoRows {
+			res.Rows = append(res.Rows, &table.Row{ColumnTypes: dt.Columns, Values: values, Op: r.op})
+		}
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].TableID < results[j].TableID })
+	return results, nil
+}
+
+// QueryProperties returns the rows of the QueryProperties table of the query, which is empty if the query returned
+// none. See NonPrimaryResults() for when it can be called.
+func (r *RowIterator) QueryProperties() ([]QueryProperty, error) {
+	var props []QueryProperty
+	err := r.decodeNonPrimary(frames.QueryProperties, func(row *table.Row) error {
+		prop := QueryProperty{}
+		if err := row.ToStruct(&prop); err != nil {
+			return err
+		}
+		props = append(props, prop)
+		return nil
+	})
+	return props, err
+}
+
+// QueryCompletionInformation returns the rows of the QueryCompletionInformation table of the query, which is
+// empty if the query returned none. See NonPrimaryResults() for when it can be called.
+func (r *RowIterator) QueryCompletionInformation() ([]QueryCompletionRecord, error) {
+	var records []QueryCompletionRecord
+	err := r.decodeNonPrimary(frames.QueryCompletionInformation, func(row *table.Row) error {
+		rec := QueryCompletionRecord{}
+		if err := row.ToStruct(&rec); err != nil {
+			return err
+		}
+		records = append(records, rec)
+		return nil
+	})
+	return records, err
+}
+
+// decodeNonPrimary calls f for each row of the non-primary tables of kind.
+func (r *RowIterator) decodeNonPrimary(kind frames.TableKind, f func(row *table.Row) error) error {
+	results, err := r.NonPrimaryResults()
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if res.Kind != string(kind) {
+			continue
+		}
+		for _, row := range res.Rows {
+			if err := f(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
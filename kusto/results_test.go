@@ -0,0 +1,147 @@
+package kusto
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/internal/frames"
+	v2 "github.com/Azure/azure-kusto-go/kusto/internal/frames/v2"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNonPrimaryResults(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	server := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"FrameType":"DataSetHeader","IsProgressive":true,"Version":"v2.0"},
+			{"FrameType":"DataTable","TableId":0,"TableKind":"QueryProperties","TableName":"@ExtendedProperties",
+				"Columns":[{"ColumnName":"TableId","ColumnType":"int"},{"ColumnName":"Key","ColumnType":"string"},{"ColumnName":"Value","ColumnType":"dynamic"}],
+				"Rows":[[1,"Visualization","{\"Visualization\":\"table\"}"]]},
+			{"FrameType":"TableHeader","TableId":1,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+				"Columns":[{"ColumnName":"x","ColumnType":"long"}]},
+			{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":1,"Rows":[[1],[2]]}`))
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+
+		w.Write([]byte(`,{"FrameType":"TableCompletion","TableId":1,"RowCount":2},
+			{"FrameType":"TableHeader","TableId":2,"TableKind":"QueryCompletionInformation","TableName":"QueryCompletionInformation",
+				"Columns":[{"ColumnName":"Timestamp","ColumnType":"datetime"},{"ColumnName":"ClientRequestId","ColumnType":"string"},
+					{"ColumnName":"ActivityId","ColumnType":"guid"},{"ColumnName":"Level","ColumnType":"int"},
+					{"ColumnName":"EventTypeName","ColumnType":"string"},{"ColumnName":"Payload","ColumnType":"string"}]},
+			{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":2,"Rows":[
+				["2021-03-04T05:06:07Z","KGC.execute;1","b6b1c5b2-5c4f-4a0e-8a43-3f6a0f5d6b41",4,"QueryInfo","{}"]]},
+			{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":2,"Rows":[
+				["2021-03-04T05:06:08Z","KGC.execute;1","b6b1c5b2-5c4f-4a0e-8a43-3f6a0f5d6b41",4,"QueryResourceConsumption","{\"ExecutionTime\":0.1}"]]},
+			{"FrameType":"TableCompletion","TableId":2,"RowCount":2},
+			{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}]`))
+	})
+
+	iter, err := testClient(t, server).Query(context.Background(), "db", NewStmt("T"))
+	require.NoError(t, err)
+	defer iter.Stop()
+
+	// The tables after the primary result were not sent yet.
+	_, err = iter.NonPrimaryResults()
+	assert.Equal(t, ErrResultsNotReady, err)
+	_, err = iter.QueryCompletionInformation()
+	assert.Equal(t, ErrResultsNotReady, err)
+
+	close(release)
+	count := 0
+	require.NoError(t, iter.DoOnRowOrError(func(*table.Row, *errors.Error) error {
+		count++
+		return nil
+	}))
+	assert.Equal(t, 2, count)
+
+	results, err := iter.NonPrimaryResults()
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "QueryProperties", results[0].Kind)
+	assert.Equal(t, "@ExtendedProperties", results[0].Name)
+	assert.Equal(t, "QueryCompletionInformation", results[1].Kind)
+	assert.Equal(t, 2, results[1].TableID)
+	assert.Len(t, results[1].Rows, 2)
+
+	props, err := iter.QueryProperties()
+	require.NoError(t, err)
+	assert.Equal(t, []QueryProperty{{
+		TableID: 1,
+		Key:     "Visualization",
+		Value:   value.Dynamic{Value: []byte(`{"Visualization":"table"}`), Valid: true},
+	}}, props)
+
+	records, err := iter.QueryCompletionInformation()
+	require.NoError(t, err)
+	activity := uuid.MustParse("b6b1c5b2-5c4f-4a0e-8a43-3f6a0f5d6b41")
+	assert.Equal(t, []QueryCompletionRecord{
+		{
+			Timestamp:       time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+			ClientRequestID: "KGC.execute;1",
+			ActivityID:      activity,
+			Level:           4,
+			EventTypeName:   "QueryInfo",
+			Payload:         "{}",
+		},
+		{
+			Timestamp:       time.Date(2021, 3, 4, 5, 6, 8, 0, time.UTC),
+			ClientRequestID: "KGC.execute;1",
+			ActivityID:      activity,
+			Level:           4,
+			EventTypeName:   "QueryResourceConsumption",
+			Payload:         `{"ExecutionTime":0.1}`,
+		},
+	}, records)
+}
+
+func TestNonPrimaryResultsFailed(t *testing.T) {
+	t.Parallel()
+
+	server := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0"},
+			{"FrameType":"DataTable","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+				"Columns":[{"ColumnName":"x","ColumnType":"long"}],"Rows":[[1]]}]`))
+	})
+
+	iter, err := testClient(t, server).Query(context.Background(), "db", NewStmt("T"))
+	require.NoError(t, err)
+	defer iter.Stop()
+
+	for {
+		_, _, err = iter.NextRowOrError()
+		if err != nil {
+			break
+		}
+	}
+	require.NotEqual(t, io.EOF, err)
+
+	// The error of the stream is returned, instead of tables that may be missing.
+	_, gotErr := iter.NonPrimaryResults()
+	assert.Equal(t, err, gotErr)
+
+	// A table of the wrong column types is an error.
+	iter = &RowIterator{complete: true, nonPrimary: map[frames.TableKind]v2.DataTable{
+		frames.QueryProperties: {
+			TableKind: frames.QueryProperties,
+			Columns:   table.Columns{{Name: "TableId", Type: types.String}},
+			KustoRows: []value.Values{{value.String{Value: "1", Valid: true}}},
+		},
+	}}
+	_, err = iter.QueryProperties()
+	assert.Error(t, err)
+}
@@ -0,0 +1,123 @@
+package kusto
+
+// retry.go holds how Query() and Mgmt() calls are retried when the service is throttling or unavailable.
+
+import (
+	goErrors "errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/cenkalti/backoff/v4"
+)
+
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryMaxElapsed = time.Minute
+	defaultRetryInterval   = 500 * time.Millisecond
+)
+
+// retryPolicy is how calls are retried, as set with WithRetries().
+type retryPolicy struct {
+	attempts   int
+	maxElapsed time.Duration
+	// interval is the wait before the first retry. It is only changed by tests.
+	interval time.Duration
+}
+
+// defaultRetryPolicy is the retryPolicy of a Client that is not given WithRetries().
+var defaultRetryPolicy = retryPolicy{attempts: defaultRetryAttempts, maxElapsed: defaultRetryMaxElapsed}
+
+// WithRetries sets how the client retries a Query() or Mgmt() call that fails before it got the results: a response
+// of 429, or of 502, 503 or 504 or a network failure for a call that is safe to send again, which is a Query() or a
+// Mgmt() command that starts with ".show". It makes at most maxAttempts attempts, and gives up once maxElapsed has
+// passed if it is not 0. The wait between attempts grows exponentially with jitter, unless the service asks for a
+// wait with a Retry-After header. The wait ends early if the context of the call is done.
+// A call that failed after it started to read the results is never retried, as the rows before the failure were
+// already returned. errors.Error.Attempts() returns how many attempts a failed call made.
+// By default, the client makes 3 attempts within a minute. WithRetries(1, 0) turns retries off.
+func WithRetries(maxAttempts int, maxElapsed time.Duration) Option {
+	return func(c *Client) {
+		c.retry = retryPolicy{attempts: maxAttempts, maxElapsed: maxElapsed}
+	}
+}
+
+func (p retryPolicy) validate() error {
+	if p.attempts < 1 || p.maxElapsed < 0 {
+		return errors.ES(errors.OpServConn, errors.KClientArgs, "WithRetries(%d, %s): must make at least 1 attempt and maxElapsed cannot be negative", p.attempts, p.maxElapsed).SetNoRetry()
+	}
+	return nil
+}
+
+// backOff returns the backoff.BackOff for the retries after the first attempt.
+func (p retryPolicy) backOff() *retryBackOff {
+	exp := backoff.NewExponentialBackOff()
+	exp.InitialInterval = defaultRetryInterval
+	if p.interval > 0 {
+		exp.InitialInterval = p.interval
+	}
+	exp.MaxElapsedTime = p.maxElapsed
+
+	var max uint64
+	if p.attempts > 1 {
+		max = uint64(p.attempts - 1)
+	}
+	return &retryBackOff{exp: exp, max: max, maxElapsed: p.maxElapsed}
+}
+
+// retryBackOff is an exponential backoff that waits for what the service asked for instead, when it did.
+type retryBackOff struct {
+	exp        *backoff.ExponentialBackOff
+	max        uint64
+	tries      uint64
+	maxElapsed time.Duration
+	// retryAfter is the wait asked for by the last response, if any.
+	retryAfter time.Duration
+}
+
+// NextBackOff implements backoff.BackOff.
+func (r *retryBackOff) NextBackOff() time.Duration {
+	next := r.exp.NextBackOff()
+	if next == backoff.Stop || r.tries >= r.max {
+		return backoff.Stop
+	}
+	r.tries++
+
+	if r.retryAfter > 0 {
+		next, r.retryAfter = r.retryAfter, 0
+		if r.maxElapsed > 0 && r.exp.GetElapsedTime()+next > r.maxElapsed {
+			return backoff.Stop
+		}
+	}
+	return next
+}
+
+// Reset implements backoff.BackOff.
+func (r *retryBackOff) Reset() {
+	r.exp.Reset()
+	r.tries = 0
+	r.retryAfter = 0
+}
+
+// idempotent reports if a call of execType with query can be sent again after the service may have run it.
+func idempotent(execType int, query Stmt) bool {
+	if execType == execQuery {
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(query.String())), ".show")
+}
+
+// isTransientErr reports if a call that failed with err before it got the results may succeed if sent again, see
+// errors.Retryable(). A throttled call was not run, so it can always be sent again. Otherwise the call must be
+// idempotent, as the service may have run it.
+func isTransientErr(err error, idempotent bool) bool {
+	if !errors.Retryable(err) {
+		return false
+	}
+	var e *errors.Error
+	if goErrors.As(err, &e) && e.StatusCode() == http.StatusTooManyRequests {
+		return true
+	}
+	return idempotent
+}
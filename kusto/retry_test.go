@@ -0,0 +1,188 @@
+package kusto
+
+import (
+	"context"
+	goErrors "errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const retryV2Response = `[
+	{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0"},
+	{"FrameType":"DataTable","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+		"Columns":[{"ColumnName":"x","ColumnType":"long"}],"Rows":[[1]]},
+	{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}
+]`
+
+const retryV1Response = `{"Tables":[{"TableName":"Table_0","Columns":[{"ColumnName":"x","DataType":"Int64","ColumnType":"long"}],"Rows":[[1]]}]}`
+
+// flakyService fails the first requests with statuses, in order, and then succeeds.
+type flakyService struct {
+	statuses   []int
+	retryAfter string
+	body       string
+
+	requests int32
+}
+
+func (f *flakyService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := int(atomic.AddInt32(&f.requests, 1))
+	if n <= len(f.statuses) {
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		w.WriteHeader(f.statuses[n-1])
+		w.Write([]byte(`{"error":{"code":"Throttled","message":"try again"}}`))
+		return
+	}
+	w.Write([]byte(f.body))
+}
+
+func (f *flakyService) client(t *testing.T, attempts int, maxElapsed time.Duration) *Client {
+	client := testClient(t, f)
+	client.conn.(*conn).retry = retryPolicy{attempts: attempts, maxElapsed: maxElapsed, interval: time.Millisecond}
+	return client
+}
+
+func TestRetries(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc         string
+		mgmt         string
+		statuses     []int
+		attempts     int
+		wantRequests int
+		wantStatus   int
+	}{
+		{desc: "Succeeds after transient failures", statuses: []int{503, 502, 504}, attempts: 4, wantRequests: 4},
+		{desc: "Gives up after the last attempt", statuses: []int{503, 429, 503}, attempts: 3, wantRequests: 3, wantStatus: 503},
+		{desc: "Bad request is not retried", statuses: []int{400}, attempts: 3, wantRequests: 1, wantStatus: 400},
+		{desc: "One attempt", statuses: []int{429}, attempts: 1, wantRequests: 1, wantStatus: 429},
+		{desc: "Show command is retried", mgmt: ".show tables", statuses: []int{503}, attempts: 3, wantRequests: 2},
+		{desc: "Other command is only retried when throttled", mgmt: ".drop table T", statuses: []int{429, 503}, attempts: 3, wantRequests: 2, wantStatus: 503},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			service := &flakyService{statuses: test.statuses, body: retryV2Response}
+			var err error
+			if test.mgmt != "" {
+				service.body = retryV1Response
+				var iter *RowIterator
+				iter, err = service.client(t, test.attempts, 0).Mgmt(context.Background(), "db", NewStmt(stringConstant(test.mgmt)))
+				if err == nil {
+					iter.Stop()
+				}
+			} else {
+				var iter *RowIterator
+				iter, err = service.client(t, test.attempts, 0).Query(context.Background(), "db", NewStmt("T"))
+				if err == nil {
+					iter.Stop()
+				}
+			}
+
+			assert.Equal(t, test.wantRequests, int(atomic.LoadInt32(&service.requests)))
+			if test.wantStatus == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			var e *errors.Error
+			require.True(t, goErrors.As(err, &e))
+			assert.Equal(t, test.wantStatus, e.StatusCode())
+			assert.Equal(t, test.wantRequests, e.Attempts())
+			assert.NotEmpty(t, e.ClientRequestId())
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	service := &flakyService{statuses: []int{429}, retryAfter: "1", body: retryV2Response}
+	start := time.Now()
+	iter, err := service.client(t, 2, time.Minute).Query(context.Background(), "db", NewStmt("T"))
+	require.NoError(t, err)
+	iter.Stop()
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Equal(t, 2, int(atomic.LoadInt32(&service.requests)))
+
+	// A wait that would go over the time allowed for retries gives up instead.
+	service = &flakyService{statuses: []int{429}, retryAfter: "3600", body: retryV2Response}
+	_, err = service.client(t, 2, time.Minute).Query(context.Background(), "db", NewStmt("T"))
+	require.Error(t, err)
+	assert.Equal(t, 1, int(atomic.LoadInt32(&service.requests)))
+
+	// The wait ends when the context is done.
+	service = &flakyService{statuses: []int{429}, retryAfter: "30", body: retryV2Response}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = service.client(t, 2, 0).Query(ctx, "db", NewStmt("T"))
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	var e *errors.Error
+	require.True(t, goErrors.As(err, &e))
+	assert.Equal(t, 1, e.Attempts())
+}
+
+func TestNoRetryAfterResults(t *testing.T) {
+	t.Parallel()
+
+	// The response is cut after the first frames, which fails reading the rows after the call returned.
+	var requests int32
+	server := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`[{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0"},
+			{"FrameType":"DataTable","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",
+				"Columns":[{"ColumnName":"x","ColumnType":"long"}],"Rows":[[1]]},`))
+	})
+	client := testClient(t, server)
+	client.conn.(*conn).retry = retryPolicy{attempts: 3, interval: time.Millisecond}
+
+	iter, err := client.Query(context.Background(), "db", NewStmt("T"))
+	require.NoError(t, err)
+	defer iter.Stop()
+
+	for {
+		_, inlineErr, err := iter.NextRowOrError()
+		require.Nil(t, inlineErr)
+		if err != nil {
+			assert.NotEqual(t, io.EOF, err)
+			break
+		}
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestWithRetries(t *testing.T) {
+	t.Parallel()
+
+	auth := Authorization{Authorizer: autorest.NullAuthorizer{}}
+
+	client, err := New("https://test.kusto.windows.net", auth)
+	require.NoError(t, err)
+	assert.Equal(t, defaultRetryPolicy, client.retry)
+	assert.Equal(t, defaultRetryPolicy, client.conn.(*conn).retry)
+
+	client, err = New("https://test.kusto.windows.net", auth, WithRetries(5, 0))
+	require.NoError(t, err)
+	assert.Equal(t, retryPolicy{attempts: 5}, client.conn.(*conn).retry)
+
+	_, err = New("https://test.kusto.windows.net", auth, WithRetries(0, time.Minute))
+	assert.Error(t, err)
+	_, err = New("https://test.kusto.windows.net", auth, WithRetries(3, -time.Second))
+	assert.Error(t, err)
+}
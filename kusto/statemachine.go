@@ -145,6 +145,8 @@ Either:
 
 	If DataTableCompletion:
 		End, but we had to have had a TableHeader
+
+Rows are sent to the RowIterator as each Fragment arrives, so a result is never held in memory as a whole.
 */
 type progressiveSM struct {
 	op            errors.Op
@@ -157,6 +159,9 @@ type progressiveSM struct {
 	currentFrame  frames.Frame
 	nonPrimary    *v2.DataTable
 
+	// onProgress is called with each TableProgress of the primary table, if set.
+	onProgress func(percent float64)
+
 	wg *sync.WaitGroup
 }
 
@@ -276,7 +281,12 @@ func (p *progressiveSM) fragment() (stateFn, error) {
 		case p.iter.inRows <- send{inRows: table.KustoRows, inRowErrors: table.RowErrors, inTableFragmentType: table.TableFragmentType, wg: p.wg}:
 		}
 	} else {
-		p.nonPrimary.Rows = append(p.nonPrimary.Rows, p.currentFrame.(v2.TableFragment).Rows...)
+		fragment := p.currentFrame.(v2.TableFragment)
+		if fragment.TableFragmentType == "DataReplace" {
+			p.nonPrimary.KustoRows, p.nonPrimary.RowErrors = nil, nil
+		}
+		p.nonPrimary.KustoRows = append(p.nonPrimary.KustoRows, fragment.KustoRows...)
+		p.nonPrimary.RowErrors = append(p.nonPrimary.RowErrors, fragment.RowErrors...)
 	}
 	return p.nextFrame, nil
 }
@@ -285,8 +295,18 @@ func (p *progressiveSM) progress() (stateFn, error) {
 	if p.currentHeader == nil {
 		return nil, errors.ES(p.op, errors.KInternal, "received a TableProgress without a tableHeader")
 	}
+	progress := p.currentFrame.(v2.TableProgress)
+
 	p.wg.Add(1)
-	p.iter.inProgress <- send{inProgress: p.currentFrame.(v2.TableProgress), wg: p.wg}
+	select {
+	case <-p.ctx.Done():
+		return nil, p.ctx.Err()
+	case p.iter.inProgress <- send{inProgress: progress, wg: p.wg}:
+	}
+
+	if p.onProgress != nil && p.currentHeader.TableKind == frames.PrimaryResult {
+		p.onProgress(progress.TableProgress)
+	}
 	return p.nextFrame, nil
 }
 
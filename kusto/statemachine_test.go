@@ -1,9 +1,15 @@
 package kusto
 
 import (
+	"bufio"
 	"context"
 	goErr "errors"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -16,6 +22,7 @@ import (
 	v2 "github.com/Azure/azure-kusto-go/kusto/internal/frames/v2"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func init() {
@@ -1519,3 +1526,185 @@ func TestV1SM(t *testing.T) {
 		})
 	}
 }
+
+// progressiveResponse writes a progressive v2 response with rows rows of a long and a string column, in fragments of
+// fragmentSize rows with a TableProgress after each, and ends it with completion. afterFirst is called after the
+// first fragment is written and flushed.
+func progressiveResponse(w http.ResponseWriter, rows, fragmentSize int, completion string, afterFirst func()) {
+	flusher := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	bw.WriteString(`[{"FrameType":"DataSetHeader","IsProgressive":true,"Version":"v2.0"},`)
+	bw.WriteString(`{"FrameType":"TableHeader","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",` +
+		`"Columns":[{"ColumnName":"id","ColumnType":"long"},{"ColumnName":"text","ColumnType":"string"}]}`)
+
+	text := strings.Repeat("x", 100)
+	for sent := 0; sent < rows; {
+		bw.WriteString(`,{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":0,"Rows":[`)
+		for i := 0; i < fragmentSize && sent < rows; i++ {
+			if i > 0 {
+				bw.WriteString(",")
+			}
+			fmt.Fprintf(bw, `[%d,"%s"]`, sent, text)
+			sent++
+		}
+		bw.WriteString("]}")
+		fmt.Fprintf(bw, `,{"FrameType":"TableProgress","TableId":0,"TableProgress":%g}`, float64(sent)*100/float64(rows))
+
+		if sent <= fragmentSize {
+			bw.Flush()
+			flusher.Flush()
+			afterFirst()
+		}
+	}
+	fmt.Fprintf(bw, `,{"FrameType":"TableCompletion","TableId":0,"RowCount":%d},%s]`, rows, completion)
+}
+
+func TestProgressiveStreaming(t *testing.T) {
+	const (
+		rows         = 500000
+		fragmentSize = 5000
+	)
+
+	firstRead := make(chan struct{})
+	server := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		progressiveResponse(w, rows, fragmentSize, `{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}`, func() {
+			// The rest is only sent after the first row was read, which fails the test if rows were held back.
+			select {
+			case <-firstRead:
+			case <-r.Context().Done():
+			}
+		})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var progress []float64
+	iter, err := testClient(t, server).Query(ctx, "db", NewStmt("T"), ResultsProgressCallback(func(percent float64) {
+		progress = append(progress, percent)
+	}))
+	require.NoError(t, err)
+	defer iter.Stop()
+	assert.True(t, iter.Progressive())
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+	maxHeap := uint64(0)
+
+	count := 0
+	err = iter.DoOnRowOrError(func(row *table.Row, inlineErr *errors.Error) error {
+		require.Nil(t, inlineErr)
+		if count == 0 {
+			close(firstRead)
+		}
+		require.Equal(t, value.Long{Value: int64(count), Valid: true}, row.Values[0])
+		count++
+
+		if count%(rows/10) == 0 {
+			runtime.GC()
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > maxHeap {
+				maxHeap = stats.HeapInuse
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, rows, count)
+
+	// The response is over 50MiB, the rows in flight are a small part of it.
+	if maxHeap > baseline {
+		assert.Less(t, maxHeap-baseline, uint64(32<<20), "heap grew by %d bytes while streaming", maxHeap-baseline)
+	}
+
+	require.Len(t, progress, rows/fragmentSize)
+	assert.Equal(t, float64(fragmentSize)*100/rows, progress[0])
+	assert.Equal(t, float64(100), progress[len(progress)-1])
+	assert.Equal(t, float64(100), iter.Progress())
+}
+
+func TestCompletionErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc       string
+		progressed bool
+		completion string
+		wantErr    string
+		wantKind   errors.Kind
+	}{
+		{
+			desc:       "Partial failure",
+			progressed: true,
+			completion: `{"FrameType":"DataSetCompletion","HasErrors":true,"Cancelled":false,"OneApiErrors":[` +
+				`{"error":{"code":"LimitsExceeded","message":"Request is invalid and cannot be executed.","@permanent":false}}]}`,
+			wantErr:  "Request is invalid and cannot be executed.",
+			wantKind: errors.KLimitsExceeded,
+		},
+		{
+			desc: "Partial failure, not progressive",
+			completion: `{"FrameType":"DataSetCompletion","HasErrors":true,"Cancelled":false,"OneApiErrors":[` +
+				`{"error":{"code":"LimitsExceeded","message":"Request is invalid and cannot be executed.","@permanent":false}}]}`,
+			wantErr:  "Request is invalid and cannot be executed.",
+			wantKind: errors.KLimitsExceeded,
+		},
+		{
+			desc:       "Errors without details",
+			progressed: true,
+			completion: `{"FrameType":"DataSetCompletion","HasErrors":true,"Cancelled":false}`,
+			wantErr:    "the service reported errors after it sent part of the results",
+		},
+		{
+			desc:       "Cancelled",
+			progressed: true,
+			completion: `{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":true}`,
+			wantErr:    "the service cancelled the request after it sent part of the results",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			server := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.progressed {
+					progressiveResponse(w, 10, 4, test.completion, func() {})
+					return
+				}
+				fmt.Fprintf(w, `[{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0"},`+
+					`{"FrameType":"DataTable","TableId":0,"TableKind":"PrimaryResult","TableName":"PrimaryResult",`+
+					`"Columns":[{"ColumnName":"id","ColumnType":"long"}],"Rows":[[0],[1],[2],[3],[4],[5],[6],[7],[8],[9]]},%s]`, test.completion)
+			})
+
+			iter, err := testClient(t, server).Query(context.Background(), "db", NewStmt("T"))
+			require.NoError(t, err)
+			defer iter.Stop()
+
+			// Every row is read before the error.
+			count := 0
+			for {
+				_, inlineErr, err := iter.NextRowOrError()
+				require.Nil(t, inlineErr)
+				if err != nil {
+					require.NotEqual(t, io.EOF, err)
+					assert.Contains(t, err.Error(), test.wantErr)
+					var e *errors.Error
+					require.True(t, goErr.As(err, &e))
+					assert.Equal(t, test.wantKind, e.Kind)
+					break
+				}
+				count++
+			}
+			assert.Equal(t, 10, count)
+
+			// The error stays.
+			_, _, err = iter.NextRowOrError()
+			assert.Contains(t, err.Error(), test.wantErr)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package kusto
+
+// tls.go holds the TLS settings of the connections that a Client opens, such as for clusters behind proxies that
+// intercept TLS or private endpoints with certificates of an internal CA.
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+)
+
+// WithTLSConfig makes the client open its connections with config, such as to trust the RootCAs of an internal CA or
+// to present client Certificates. The ingestion clients made from the Client, and the storage clients of queued
+// ingestion, use it too unless they are given their own *http.Client. config is cloned, so it can be changed after.
+// It cannot be used with WithHTTPClient(), whose transport sets its own TLS config, nor set InsecureSkipVerify,
+// which takes WithInsecureSkipTLSVerify().
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = config.Clone()
+	}
+}
+
+// WithInsecureSkipTLSVerify makes the client accept any certificate that the service presents, and any host name in
+// it. This is INSECURE: anyone who can intercept the connections can read and change the queries, their results and
+// the ingested data, and steal the tokens that the client signs in with. It is meant for tests against a local
+// emulator only; trust the CA of the service with WithTLSConfig() instead.
+func WithInsecureSkipTLSVerify() Option {
+	return func(c *Client) {
+		c.insecureSkipVerify = true
+	}
+}
+
+// TLSConfig returns the TLS config that the client opens its connections with, as set by WithTLSConfig() and
+// WithInsecureSkipTLSVerify(), or nil for the default one. It must not be changed.
+func (c *Client) TLSConfig() *tls.Config {
+	return c.tlsConfig
+}
+
+// setupTLS validates the TLS settings of the client, and makes the transport that they are used with.
+func (c *Client) setupTLS() error {
+	if c.tlsConfig == nil && !c.insecureSkipVerify {
+		return nil
+	}
+	if c.httpClient != nil {
+		return errors.ES(errors.OpServConn, errors.KClientArgs, "WithTLSConfig() and WithInsecureSkipTLSVerify() cannot be used with WithHTTPClient(), set the TLS config on the transport of the client").SetNoRetry()
+	}
+	if c.tlsConfig == nil {
+		c.tlsConfig = &tls.Config{}
+	}
+	if c.tlsConfig.InsecureSkipVerify && !c.insecureSkipVerify {
+		return errors.ES(errors.OpServConn, errors.KClientArgs, "WithTLSConfig(): InsecureSkipVerify can only be set with WithInsecureSkipTLSVerify()").SetNoRetry()
+	}
+	c.tlsConfig.InsecureSkipVerify = c.insecureSkipVerify
+
+	c.transport = tlsTransport(c.tlsConfig)
+	return nil
+}
+
+// tlsTransport returns a transport like http.DefaultTransport that opens its connections with config.
+func tlsTransport(config *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = config
+	return t
+}
@@ -0,0 +1,96 @@
+package kusto
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	// The server presents a self-signed certificate, which only a client that trusts it can connect with.
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/rest/mgmt" {
+			io.WriteString(w, retryV1Response)
+			return
+		}
+		io.WriteString(w, retryV2Response)
+	}))
+	t.Cleanup(server.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tests := []struct {
+		desc    string
+		options []Option
+		// newErr is set when New() fails, and callErr when the calls fail.
+		newErr, callErr bool
+	}{
+		{desc: "Default roots do not trust the server", callErr: true},
+		{desc: "RootCAs", options: []Option{WithTLSConfig(&tls.Config{RootCAs: roots})}},
+		{desc: "Insecure skip verify", options: []Option{WithInsecureSkipTLSVerify()}},
+		{desc: "InsecureSkipVerify without its option", options: []Option{WithTLSConfig(&tls.Config{InsecureSkipVerify: true})}, newErr: true},
+		{
+			desc:    "With an HTTP client",
+			options: []Option{WithTLSConfig(&tls.Config{RootCAs: roots}), WithHTTPClient(&http.Client{})},
+			newErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			client, err := New(server.URL, Authorization{Authorizer: autorest.NullAuthorizer{}}, test.options...)
+			if test.newErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			iter, err := client.Query(ctx, "db", NewStmt("T"))
+			if test.callErr {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "certificate")
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, iter.Do(func(*table.Row) error { return nil }))
+
+			iter, err = client.Mgmt(ctx, "db", NewStmt(".show tables"))
+			require.NoError(t, err)
+			require.NoError(t, iter.Do(func(*table.Row) error { return nil }))
+		})
+	}
+}
+
+func TestTLSConfigIsCloned(t *testing.T) {
+	t.Parallel()
+
+	config := &tls.Config{ServerName: "mycluster.kusto.windows.net"}
+	client, err := New("https://mycluster.kusto.windows.net", Authorization{Authorizer: autorest.NullAuthorizer{}}, WithTLSConfig(config))
+	require.NoError(t, err)
+	config.ServerName = "other"
+
+	assert.Equal(t, "mycluster.kusto.windows.net", client.TLSConfig().ServerName)
+	assert.Same(t, client.TLSConfig(), client.conn.(*conn).client.Transport.(*http.Transport).TLSClientConfig)
+
+	client, err = New("https://mycluster.kusto.windows.net", Authorization{Authorizer: autorest.NullAuthorizer{}})
+	require.NoError(t, err)
+	assert.Nil(t, client.TLSConfig())
+}
@@ -3,6 +3,7 @@ package kusto
 import (
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"reflect"
 	"strings"
 	"time"
@@ -213,8 +214,11 @@ func colToValueCheck(cols table.Columns, values value.Values) error {
 func convertBool(v reflect.Value) (value.Bool, error) {
 	t := v.Type()
 
-	// If it is a pointer, dereference it.
+	// If it is a pointer, dereference it. A nil pointer is a null value.
 	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return value.Bool{}, nil
+		}
 		t = t.Elem()
 		v = v.Elem()
 	}
@@ -235,8 +239,11 @@ func convertBool(v reflect.Value) (value.Bool, error) {
 func convertDateTime(v reflect.Value) (value.DateTime, error) {
 	t := v.Type()
 
-	// If it is a pointer, dereference it.
+	// If it is a pointer, dereference it. A nil pointer is a null value.
 	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return value.DateTime{}, nil
+		}
 		t = t.Elem()
 		v = v.Elem()
 	}
@@ -257,8 +264,11 @@ func convertDateTime(v reflect.Value) (value.DateTime, error) {
 func convertTimespan(v reflect.Value) (value.Timespan, error) {
 	t := v.Type()
 
-	// If it is a pointer, dereference it.
+	// If it is a pointer, dereference it. A nil pointer is a null value.
 	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return value.Timespan{}, nil
+		}
 		t = t.Elem()
 		v = v.Elem()
 	}
@@ -279,8 +289,11 @@ func convertTimespan(v reflect.Value) (value.Timespan, error) {
 func convertDynamic(v reflect.Value) (value.Dynamic, error) {
 	t := v.Type()
 
-	// If it is a pointer, dereference it.
+	// If it is a pointer, dereference it. A nil pointer is a null value.
 	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return value.Dynamic{}, nil
+		}
 		t = t.Elem()
 		v = v.Elem()
 	}
@@ -311,8 +324,11 @@ func convertDynamic(v reflect.Value) (value.Dynamic, error) {
 func convertGUID(v reflect.Value) (value.GUID, error) {
 	t := v.Type()
 
-	// If it is a pointer, dereference it.
+	// If it is a pointer, dereference it. A nil pointer is a null value.
 	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return value.GUID{}, nil
+		}
 		t = t.Elem()
 		v = v.Elem()
 	}
@@ -333,8 +349,11 @@ func convertGUID(v reflect.Value) (value.GUID, error) {
 func convertInt(v reflect.Value) (value.Int, error) {
 	t := v.Type()
 
-	// If it is a pointer, dereference it.
+	// If it is a pointer, dereference it. A nil pointer is a null value.
 	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return value.Int{}, nil
+		}
 		t = t.Elem()
 		v = v.Elem()
 	}
@@ -355,8 +374,11 @@ func convertInt(v reflect.Value) (value.Int, error) {
 func convertLong(v reflect.Value) (value.Long, error) {
 	t := v.Type()
 
-	// If it is a pointer, dereference it.
+	// If it is a pointer, dereference it. A nil pointer is a null value.
 	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return value.Long{}, nil
+		}
 		t = t.Elem()
 		v = v.Elem()
 	}
@@ -377,8 +399,11 @@ func convertLong(v reflect.Value) (value.Long, error) {
 func convertReal(v reflect.Value) (value.Real, error) {
 	t := v.Type()
 
-	// If it is a pointer, dereference it.
+	// If it is a pointer, dereference it. A nil pointer is a null value.
 	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return value.Real{}, nil
+		}
 		t = t.Elem()
 		v = v.Elem()
 	}
@@ -399,8 +424,11 @@ func convertReal(v reflect.Value) (value.Real, error) {
 func convertString(v reflect.Value) (value.String, error) {
 	t := v.Type()
 
-	// If it is a pointer, dereference it.
+	// If it is a pointer, dereference it. A nil pointer is a null value.
 	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return value.String{}, nil
+		}
 		t = t.Elem()
 		v = v.Elem()
 	}
@@ -421,8 +449,11 @@ func convertString(v reflect.Value) (value.String, error) {
 func convertDecimal(v reflect.Value) (value.Decimal, error) {
 	t := v.Type()
 
-	// If it is a pointer, dereference it.
+	// If it is a pointer, dereference it. A nil pointer is a null decimal.
 	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return value.Decimal{}, nil
+		}
 		t = t.Elem()
 		v = v.Elem()
 	}
@@ -437,5 +468,55 @@ func convertDecimal(v reflect.Value) (value.Decimal, error) {
 		return value.Decimal{Value: v.Interface().(string), Valid: true}, nil
 	}
 
-	return value.Decimal{}, fmt.Errorf("value was expected to be either a types.Decimal, *string or string, was %T", v.Interface())
+	// Was a big.Float or big.Rat, so return all of its digits.
+	if (t == reflect.TypeOf(big.Float{}) || t == reflect.TypeOf(big.Rat{})) && !v.CanAddr() {
+		c := reflect.New(t).Elem()
+		c.Set(v)
+		v = c
+	}
+	switch t {
+	case reflect.TypeOf(big.Float{}):
+		f := v.Addr().Interface().(*big.Float)
+		if f.IsInf() {
+			return value.Decimal{}, fmt.Errorf("value was an infinite *big.Float, which cannot be a decimal")
+		}
+		return value.Decimal{Value: f.Text('f', -1), Valid: true}, nil
+	case reflect.TypeOf(big.Rat{}):
+		r := v.Addr().Interface().(*big.Rat)
+		places, ok := decimalPlaces(r.Denom())
+		if !ok {
+			return value.Decimal{}, fmt.Errorf("value was a *big.Rat(%s) that has no exact decimal form", r)
+		}
+		return value.Decimal{Value: r.FloatString(places), Valid: true}, nil
+	}
+
+	return value.Decimal{}, fmt.Errorf("value was expected to be either a types.Decimal, *string, string, *big.Float or *big.Rat, was %T", v.Interface())
+}
+
+// decimalPlaces returns the number of decimal places that a fraction with the positive denominator d needs to be
+// written exactly, which it can only if d has no prime factors other than 2 and 5.
+func decimalPlaces(d *big.Int) (int, bool) {
+	var (
+		n         = new(big.Int).Set(d)
+		m         = new(big.Int)
+		two, five = big.NewInt(2), big.NewInt(5)
+		twos      int
+		fives     int
+	)
+	for n.Cmp(big.NewInt(1)) != 0 {
+		switch {
+		case m.Mod(n, two).Sign() == 0:
+			n.Quo(n, two)
+			twos++
+		case m.Mod(n, five).Sign() == 0:
+			n.Quo(n, five)
+			fives++
+		default:
+			return 0, false
+		}
+	}
+	if twos > fives {
+		return twos, true
+	}
+	return fives, true
 }
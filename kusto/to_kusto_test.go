@@ -2,6 +2,7 @@ package kusto
 
 import (
 	"encoding/json"
+	"math/big"
 	"reflect"
 	"testing"
 	"time"
@@ -115,6 +116,83 @@ func TestStructToKustoValues(t *testing.T) {
 	}
 }
 
+func TestStructToKustoValuesPointers(t *testing.T) {
+	t.Parallel()
+
+	type pointers struct {
+		Bool     *bool
+		DateTime *time.Time
+		Dynamic  *map[string]interface{}
+		GUID     *uuid.UUID
+		Int      *int32
+		Long     *int64
+		Real     *float64
+		String   *string
+		Timespan *time.Duration
+		Decimal  *string
+	}
+	cols := table.Columns{
+		{Name: "Bool", Type: types.Bool},
+		{Name: "DateTime", Type: types.DateTime},
+		{Name: "Dynamic", Type: types.Dynamic},
+		{Name: "GUID", Type: types.GUID},
+		{Name: "Int", Type: types.Int},
+		{Name: "Long", Type: types.Long},
+		{Name: "Real", Type: types.Real},
+		{Name: "String", Type: types.String},
+		{Name: "Timespan", Type: types.Timespan},
+		{Name: "Decimal", Type: types.Decimal},
+	}
+
+	// Nil pointers are null values, which decode back into nil pointers.
+	got, err := structToKustoValues(cols, &pointers{})
+	if err != nil {
+		t.Fatalf("TestStructToKustoValuesPointers(nil): got err == %s", err)
+	}
+	for i, v := range got {
+		if v.HasValue() {
+			t.Errorf("TestStructToKustoValuesPointers(nil): column %s: got %v, want null", cols[i].Name, v)
+		}
+	}
+	back := pointers{}
+	if err := (&table.Row{ColumnTypes: cols, Values: got}).ToStruct(&back, table.ErrorOnNull()); err != nil {
+		t.Fatalf("TestStructToKustoValuesPointers(nil): ToStruct got err == %s", err)
+	}
+	if diff := pretty.Compare(pointers{}, back); diff != "" {
+		t.Errorf("TestStructToKustoValuesPointers(nil): -want/+got:\n%s", diff)
+	}
+
+	var (
+		b    = true
+		dt   = time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+		dyn  = map[string]interface{}{"a": "b"}
+		g    = uuid.New()
+		i32  = int32(1)
+		i64  = int64(2)
+		f64  = 1.5
+		str  = "s"
+		ts   = time.Minute
+		dec  = "-0.5"
+		want = pointers{&b, &dt, &dyn, &g, &i32, &i64, &f64, &str, &ts, &dec}
+	)
+	got, err = structToKustoValues(cols, &want)
+	if err != nil {
+		t.Fatalf("TestStructToKustoValuesPointers: got err == %s", err)
+	}
+	for i, v := range got {
+		if !v.HasValue() {
+			t.Errorf("TestStructToKustoValuesPointers: column %s: got null, want a value", cols[i].Name)
+		}
+	}
+	back = pointers{}
+	if err := (&table.Row{ColumnTypes: cols, Values: got}).ToStruct(&back, table.ErrorOnNull()); err != nil {
+		t.Fatalf("TestStructToKustoValuesPointers: ToStruct got err == %s", err)
+	}
+	if diff := pretty.Compare(want, back); diff != "" {
+		t.Errorf("TestStructToKustoValuesPointers: -want/+got:\n%s", diff)
+	}
+}
+
 func TestDefaultRow(t *testing.T) {
 	t.Parallel()
 
@@ -567,6 +645,13 @@ func TestConvertDecimal(t *testing.T) {
 		{value: val, want: value.Decimal{Value: "1.3333333333", Valid: true}},
 		{value: ptr, want: value.Decimal{Value: "1.3333333333", Valid: true}},
 		{value: ty, want: value.Decimal{Value: "1.3333333333", Valid: true}},
+		{value: (*string)(nil), want: value.Decimal{}},
+		{value: big.NewFloat(-0.125), want: value.Decimal{Value: "-0.125", Valid: true}},
+		{value: *big.NewFloat(2.5), want: value.Decimal{Value: "2.5", Valid: true}},
+		{value: new(big.Float).SetInf(false), err: true},
+		{value: big.NewRat(-1, 8), want: value.Decimal{Value: "-0.125", Valid: true}},
+		{value: big.NewRat(7, 1), want: value.Decimal{Value: "7", Valid: true}},
+		{value: big.NewRat(1, 3), err: true},
 	}
 	for _, test := range tests {
 		got, err := convertDecimal(reflect.ValueOf(test.value))
@@ -0,0 +1,157 @@
+package kusto
+
+// token.go holds the authorizer that signs calls with bearer tokens that the client fetches itself.
+
+import (
+	"context"
+	goErrors "errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// tokenRefreshWindow is how long before it expires that a token is fetched again.
+const tokenRefreshWindow = 5 * time.Minute
+
+// TokenProvider provides the access tokens that the client signs in with, for credential sources that the other
+// ways to sign in do not cover.
+type TokenProvider interface {
+	// AcquireToken returns an access token for resource, which is the endpoint of the cluster, and the time it
+	// expires. The client keeps the token until it is about to expire, or asks for a new one for each call if
+	// the time is zero.
+	AcquireToken(ctx context.Context, resource string) (token string, expiresOn time.Time, err error)
+}
+
+// TokenProviderFunc is a function that implements TokenProvider.
+type TokenProviderFunc func(ctx context.Context, resource string) (token string, expiresOn time.Time, err error)
+
+// AcquireToken implements TokenProvider.
+func (f TokenProviderFunc) AcquireToken(ctx context.Context, resource string) (string, time.Time, error) {
+	return f(ctx, resource)
+}
+
+// providerFetch returns the fetchToken of p, whose errors are of kind errors.KAuth.
+func providerFetch(p TokenProvider) fetchToken {
+	return func(ctx context.Context, resource string) (string, time.Time, error) {
+		token, expiresOn, err := p.AcquireToken(ctx, resource)
+		if err != nil {
+			var e *errors.Error
+			if goErrors.As(err, &e) && e.Kind == errors.KAuth {
+				return "", time.Time{}, err
+			}
+			return "", time.Time{}, errors.E(errors.OpServConn, errors.KAuth, err)
+		}
+		if token == "" {
+			return "", time.Time{}, errors.ES(errors.OpServConn, errors.KAuth, "the TokenProvider returned an empty token")
+		}
+		return token, expiresOn, nil
+	}
+}
+
+// fetchToken fetches an access token for resource, and returns it with the time it expires.
+type fetchToken func(ctx context.Context, resource string) (token string, expiresOn time.Time, err error)
+
+// tokenAuthorizer is an autorest.Authorizer that sets the Authorization header to a bearer token for resource. It
+// keeps the token until it is about to expire, and then fetches a new one.
+type tokenAuthorizer struct {
+	resource string
+	fetch    fetchToken
+
+	mu        sync.Mutex
+	token     string
+	expiresOn time.Time
+}
+
+func newTokenAuthorizer(resource string, fetch fetchToken) *tokenAuthorizer {
+	return &tokenAuthorizer{resource: resource, fetch: fetch}
+}
+
+// WithAuthorization implements autorest.Authorizer. The token is fetched with the context of the request.
+func (a *tokenAuthorizer) WithAuthorization() autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			token, err := a.getToken(r.Context())
+			if err != nil {
+				return r, err
+			}
+			return autorest.Prepare(r, autorest.WithBearerAuthorization(token))
+		})
+	}
+}
+
+// getToken returns the token, fetching a new one if there is none or it is about to expire.
+func (a *tokenAuthorizer) getToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Until(a.expiresOn) > tokenRefreshWindow {
+		return a.token, nil
+	}
+
+	token, expiresOn, err := a.fetch(ctx, a.resource)
+	if err != nil {
+		return "", err
+	}
+	a.token, a.expiresOn = token, expiresOn
+	return token, nil
+}
+
+// refresh fetches a new token if the one that the service rejected is still the one a keeps. Calls that were rejected
+// with the same token at the same time then fetch a single new token.
+func (a *tokenAuthorizer) refresh(ctx context.Context, rejected string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && a.token != rejected {
+		return nil
+	}
+	token, expiresOn, err := a.fetch(ctx, a.resource)
+	if err != nil {
+		return err
+	}
+	a.token, a.expiresOn = token, expiresOn
+	return nil
+}
+
+// refresherWithContext is implemented by the adal tokens that can be fetched again, such as the one of the
+// autorest.BearerAuthorizer of a client credentials Config.
+type refresherWithContext interface {
+	RefreshWithContext(ctx context.Context) error
+}
+
+// Refresh makes the Authorizer fetch a new token for the next calls, after the service rejected the token of a call
+// with a 401. rejected is the Authorization header of that call: the token is only fetched again if the Authorizer
+// still has it, so that calls rejected at the same time fetch a single token. It reports if the Authorizer can fetch
+// a new token, which the ones made from ManagedIdentity, AzCli, DeviceCode, TokenProvider and Config can. Other
+// Authorizers are expected to keep their tokens valid themselves. Failures are of kind errors.KAuth.
+// For internal use only.
+func (a *Authorization) Refresh(ctx context.Context, rejected string) (bool, error) {
+	rejected = strings.TrimPrefix(rejected, "Bearer ")
+
+	switch authorizer := a.Authorizer.(type) {
+	case *tokenAuthorizer:
+		return true, authorizer.refresh(ctx, rejected)
+	case *autorest.BearerAuthorizer:
+		tp := authorizer.TokenProvider()
+		r, ok := tp.(refresherWithContext)
+		if !ok {
+			return false, nil
+		}
+		if tp.OAuthToken() != rejected {
+			return true, nil
+		}
+		if err := r.RefreshWithContext(ctx); err != nil {
+			return true, errors.E(errors.OpServConn, errors.KAuth, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,193 @@
+package kusto
+
+import (
+	"context"
+	goErrors "errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingProvider is a TokenProvider that returns tokens that expire after lifetime, and counts the calls.
+type countingProvider struct {
+	lifetime time.Duration
+	err      error
+
+	mu        sync.Mutex
+	calls     int
+	resources []string
+}
+
+func (p *countingProvider) AcquireToken(ctx context.Context, resource string) (string, time.Time, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.calls++
+	p.resources = append(p.resources, resource)
+	if p.err != nil {
+		return "", time.Time{}, p.err
+	}
+	var expiresOn time.Time
+	if p.lifetime != 0 {
+		expiresOn = time.Now().Add(p.lifetime)
+	}
+	return "token", expiresOn, nil
+}
+
+func TestTokenProvider(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc      string
+		lifetime  time.Duration
+		wantCalls int
+	}{
+		{desc: "Token is reused until it is about to expire", lifetime: time.Hour, wantCalls: 1},
+		{desc: "Token that is about to expire is not reused", lifetime: time.Minute, wantCalls: 3},
+		{desc: "Token without an expiry is not reused", wantCalls: 3},
+	}
+
+	for _, test := range tests {
+		test := test // capture
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				mu      sync.Mutex
+				headers []string
+			)
+			client := testClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				headers = append(headers, r.Header.Get("Authorization"))
+				mu.Unlock()
+				w.Write([]byte(retryV2Response))
+			}))
+			provider := &countingProvider{lifetime: test.lifetime}
+			a := Authorization{TokenProvider: provider}
+			require.NoError(t, a.Validate("https://mycluster.kusto.windows.net"))
+			client.conn.(*conn).auth = a.Authorizer
+
+			for i := 0; i < 3; i++ {
+				iter, err := client.Query(context.Background(), "db", NewStmt("T"))
+				require.NoError(t, err)
+				iter.Stop()
+			}
+
+			assert.Equal(t, test.wantCalls, provider.calls)
+			assert.Equal(t, "https://mycluster.kusto.windows.net", provider.resources[0])
+			assert.Equal(t, []string{"Bearer token", "Bearer token", "Bearer token"}, headers)
+		})
+	}
+}
+
+func TestTokenProviderErrors(t *testing.T) {
+	t.Parallel()
+
+	client := testClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the call was sent without a token")
+	}))
+	brokerErr := goErrors.New("the broker is down")
+	a := Authorization{TokenProvider: &countingProvider{err: brokerErr}}
+	require.NoError(t, a.Validate("https://mycluster.kusto.windows.net"))
+	client.conn.(*conn).auth = a.Authorizer
+
+	_, err := client.Mgmt(context.Background(), "db", NewStmt(".show tables"))
+	require.Error(t, err)
+	var e *errors.Error
+	require.True(t, goErrors.As(err, &e))
+	assert.Equal(t, errors.KAuth, e.Kind)
+	assert.True(t, goErrors.Is(err, brokerErr))
+
+	empty := TokenProviderFunc(func(ctx context.Context, resource string) (string, time.Time, error) {
+		return "", time.Time{}, nil
+	})
+	_, _, err = providerFetch(empty)(context.Background(), "https://mycluster.kusto.windows.net")
+	require.True(t, goErrors.As(err, &e))
+	assert.Equal(t, errors.KAuth, e.Kind)
+
+	// The streaming and ingestion connections are made from Client.Auth(), which keeps the provider.
+	provider := &countingProvider{lifetime: time.Hour}
+	kc, err := New("https://mycluster.kusto.windows.net", Authorization{TokenProvider: provider})
+	require.NoError(t, err)
+	ia := kc.Auth()
+	require.NoError(t, ia.Validate("https://ingest-mycluster.kusto.windows.net"))
+	_, err = ia.Authorizer.(*tokenAuthorizer).getToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://ingest-mycluster.kusto.windows.net"}, provider.resources)
+
+	_, err = New("https://mycluster.kusto.windows.net", Authorization{TokenProvider: provider, AzCli: &AzCliConfig{}})
+	assert.Error(t, err)
+}
+
+// refreshableToken is an adal token of an autorest.BearerAuthorizer that can be fetched again.
+type refreshableToken struct {
+	token     string
+	err       error
+	refreshes int
+}
+
+func (r *refreshableToken) OAuthToken() string {
+	return r.token
+}
+
+func (r *refreshableToken) RefreshWithContext(ctx context.Context) error {
+	r.refreshes++
+	if r.err != nil {
+		return r.err
+	}
+	r.token = fmt.Sprintf("token-%d", r.refreshes)
+	return nil
+}
+
+func TestAuthorizationRefresh(t *testing.T) {
+	t.Parallel()
+
+	provider := &countingProvider{lifetime: time.Hour}
+	a := Authorization{TokenProvider: provider}
+	require.NoError(t, a.Validate("https://mycluster.kusto.windows.net"))
+	_, err := a.Authorizer.(*tokenAuthorizer).getToken(context.Background())
+	require.NoError(t, err)
+
+	// A token that was replaced already is not fetched again.
+	refreshed, err := a.Refresh(context.Background(), "Bearer old")
+	require.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, 1, provider.calls)
+	refreshed, err = a.Refresh(context.Background(), "Bearer token")
+	require.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, 2, provider.calls, "the rejected token is fetched again before it expires")
+
+	brokerErr := goErrors.New("the broker is down")
+	provider.err = brokerErr
+	_, err = a.Refresh(context.Background(), "Bearer token")
+	assert.Equal(t, errors.KAuth, errors.KindOf(err))
+	assert.True(t, goErrors.Is(err, brokerErr))
+
+	token := &refreshableToken{token: "token-0"}
+	a = Authorization{Authorizer: autorest.NewBearerAuthorizer(token)}
+	refreshed, err = a.Refresh(context.Background(), "Bearer token-0")
+	require.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, "token-1", token.token)
+	refreshed, err = a.Refresh(context.Background(), "Bearer token-0")
+	require.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, 1, token.refreshes)
+	token.err = brokerErr
+	_, err = a.Refresh(context.Background(), "Bearer token-1")
+	assert.Equal(t, errors.KAuth, errors.KindOf(err))
+
+	// Other authorizers keep their tokens valid themselves.
+	a = Authorization{Authorizer: autorest.NullAuthorizer{}}
+	refreshed, err = a.Refresh(context.Background(), "Bearer token")
+	require.NoError(t, err)
+	assert.False(t, refreshed)
+}
@@ -0,0 +1,123 @@
+package kusto
+
+// trace.go holds the hooks that are called around the HTTP requests of a Client, for diagnosing slow calls, and
+// what the requests tell the service about who sends them.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+)
+
+// TraceCall describes an HTTP request of a call to the service. Its headers, such as Authorization, are never
+// part of it.
+type TraceCall struct {
+	// Op is the operation of the call, such as errors.OpQuery, errors.OpMgmt or errors.OpIngestStream.
+	Op errors.Op
+	// Endpoint is the URL that the request is sent to.
+	Endpoint string
+	// ClientRequestID is the x-ms-client-request-id header of the request.
+	ClientRequestID string
+	// CSLHash is the SHA-256 of the text of the query or command in hex, which tells calls of the same text apart
+	// without the text. Empty for ingestion.
+	CSLHash string
+	// CSL is the text of the query or command, only set for a Client made WithTraceCSL().
+	CSL string
+	// Attempt is the number of the attempt of the query or command that the request is, starting at 1. It is 0 for
+	// streaming ingestion, whose retries are traced as requests of their own.
+	Attempt int
+	// Start is when the request was sent.
+	Start time.Time
+
+	// The fields below are set for Tracer.TraceEnd().
+
+	// StatusCode is the HTTP status of the response, 0 if there was none.
+	StatusCode int
+	// ActivityID is the x-ms-activity-id header of the response, which identifies the request in the service's logs.
+	ActivityID string
+	// Duration is how long the request took to get the headers of its response, or to fail.
+	Duration time.Duration
+	// Err is the error of the request, nil if the service answered with 200 OK.
+	Err error
+}
+
+// Tracer is called around each HTTP request that a Client, and the streaming ingestion of the ingestion clients made
+// from it, sends. A Tracer must be safe for concurrent use.
+type Tracer interface {
+	// TraceStart is called before a request is sent. The request is sent with the returned context, so TraceStart
+	// can add an httptrace.ClientTrace to ctx for the DNS, connect, TLS and first byte timings of the request.
+	TraceStart(ctx context.Context, call TraceCall) context.Context
+	// TraceEnd is called with the context that TraceStart returned once the request got the headers of its response,
+	// or failed.
+	TraceEnd(ctx context.Context, call TraceCall)
+}
+
+// WithTracer makes the client call tracer around each of its HTTP requests. Without it, requests are not traced
+// and nothing is computed for tracing.
+func WithTracer(tracer Tracer) Option {
+	return func(c *Client) {
+		c.tracer = tracer
+	}
+}
+
+// WithTraceCSL makes the TraceCall of the Tracer of WithTracer() hold the text of the query or command, not just
+// its hash. The text can hold data, such as the literals of the query, so it is left out by default.
+func WithTraceCSL() Option {
+	return func(c *Client) {
+		c.traceCSL = true
+	}
+}
+
+// Tracer returns the Tracer passed to WithTracer(), or nil if there is none.
+func (c *Client) Tracer() Tracer {
+	return c.tracer
+}
+
+// cslHash returns the SHA-256 of csl in hex.
+func cslHash(csl string) string {
+	sum := sha256.Sum256([]byte(csl))
+	return hex.EncodeToString(sum[:])
+}
+
+// WithApplicationForTracing sets the name, and the version if not empty, of the application that sends the
+// requests, which the service logs with each request for the cluster admins to tell which application the load comes
+// from. It is sent as the x-ms-app header, as "name:version". The default is the name of the process.
+func WithApplicationForTracing(name, version string) Option {
+	return func(c *Client) {
+		c.app = name
+		if version != "" {
+			c.app += ":" + version
+		}
+	}
+}
+
+// WithUserForTracing sets the user that the requests are sent for, which the service logs with each request. It is
+// sent as the x-ms-user header. By default there is none, as the service knows the identity that signed in.
+func WithUserForTracing(user string) Option {
+	return func(c *Client) {
+		c.user = user
+	}
+}
+
+// ApplicationForTracing returns the application that the requests are sent by, see WithApplicationForTracing().
+func (c *Client) ApplicationForTracing() string {
+	return c.app
+}
+
+// UserForTracing returns the user that the requests are sent for, see WithUserForTracing().
+func (c *Client) UserForTracing() string {
+	return c.user
+}
+
+// processName returns the name of the executable of the process, the default of WithApplicationForTracing().
+func processName() string {
+	if len(os.Args) == 0 || os.Args[0] == "" {
+		return ""
+	}
+	return filepath.Base(os.Args[0])
+}
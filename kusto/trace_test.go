@@ -0,0 +1,140 @@
+package kusto
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type traceKey struct{}
+
+// recordingTracer records the calls it is called with, and checks that TraceEnd gets the context of TraceStart.
+type recordingTracer struct {
+	mu         sync.Mutex
+	starts     []TraceCall
+	ends       []TraceCall
+	firstBytes int
+	badCtx     bool
+}
+
+func (r *recordingTracer) TraceStart(ctx context.Context, call TraceCall) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.starts = append(r.starts, call)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.firstBytes++
+		},
+	})
+	return context.WithValue(ctx, traceKey{}, call.ClientRequestID)
+}
+
+func (r *recordingTracer) TraceEnd(ctx context.Context, call TraceCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ctx.Value(traceKey{}) != call.ClientRequestID {
+		r.badCtx = true
+	}
+	r.ends = append(r.ends, call)
+}
+
+// failingTransport fails the requests without a response.
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, context.DeadlineExceeded
+}
+
+func TestTracer(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	client := testClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("x-ms-activity-id", "activity"+string(rune('0'+n)))
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":{"code":"ServiceUnavailable","message":"try again"}}`))
+			return
+		}
+		w.Write([]byte(retryV2Response))
+	}))
+	tracer := &recordingTracer{}
+	c := client.conn.(*conn)
+	c.tracer = tracer
+	c.retry = retryPolicy{attempts: 2, interval: time.Millisecond}
+
+	// The first attempt fails, and the second one succeeds.
+	iter, err := client.Query(context.Background(), "db", NewStmt("T"), QueryRequestProperties(NewClientRequestProperties().SetClientRequestID("request1")))
+	require.NoError(t, err)
+	iter.Stop()
+
+	sum := sha256.Sum256([]byte("T"))
+	require.Len(t, tracer.starts, 2)
+	require.Len(t, tracer.ends, 2)
+	assert.False(t, tracer.badCtx, "TraceEnd should get the context that TraceStart returned")
+	assert.Equal(t, 2, tracer.firstBytes, "the request should be sent with the context that TraceStart returned")
+	for i, call := range tracer.ends {
+		assert.Equal(t, errors.OpQuery, call.Op)
+		assert.Equal(t, c.endQuery.String(), call.Endpoint)
+		assert.Equal(t, "request1", call.ClientRequestID)
+		assert.Equal(t, hex.EncodeToString(sum[:]), call.CSLHash)
+		assert.Empty(t, call.CSL, "the text should only be traced WithTraceCSL()")
+		assert.Equal(t, i+1, call.Attempt)
+		assert.Equal(t, tracer.starts[i].Start, call.Start)
+		assert.Greater(t, int64(call.Duration), int64(0))
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, tracer.ends[0].StatusCode)
+	assert.Equal(t, "activity1", tracer.ends[0].ActivityID)
+	var e *errors.Error
+	require.ErrorAs(t, tracer.ends[0].Err, &e)
+	assert.Equal(t, errors.OpQuery, e.Op)
+	assert.Equal(t, http.StatusOK, tracer.ends[1].StatusCode)
+	assert.Equal(t, "activity2", tracer.ends[1].ActivityID)
+	assert.NoError(t, tracer.ends[1].Err)
+
+	// A request that gets no response is traced with its error.
+	tracer = &recordingTracer{}
+	c.tracer, c.traceCSL = tracer, true
+	c.client = &http.Client{Transport: failingTransport{}}
+	_, err = client.Mgmt(context.Background(), "db", NewStmt(".show tables"))
+	require.Error(t, err)
+	require.Len(t, tracer.ends, 2)
+	call := tracer.ends[0]
+	assert.Equal(t, errors.OpMgmt, call.Op)
+	assert.Equal(t, ".show tables", call.CSL)
+	assert.Equal(t, 0, call.StatusCode)
+	assert.Empty(t, call.ActivityID)
+	assert.ErrorIs(t, call.Err, context.DeadlineExceeded)
+}
+
+func TestWithTracer(t *testing.T) {
+	t.Parallel()
+
+	tracer := &recordingTracer{}
+	client, err := New("https://mycluster.kusto.windows.net", Authorization{Authorizer: autorest.NullAuthorizer{}}, WithTracer(tracer), WithTraceCSL())
+	require.NoError(t, err)
+	assert.Same(t, tracer, client.Tracer())
+	c := client.conn.(*conn)
+	assert.Same(t, tracer, c.tracer)
+	assert.True(t, c.traceCSL)
+
+	// Without the option, nothing is traced.
+	client, err = New("https://mycluster.kusto.windows.net", Authorization{Authorizer: autorest.NullAuthorizer{}})
+	require.NoError(t, err)
+	assert.Nil(t, client.Tracer())
+	assert.Nil(t, client.conn.(*conn).tracer)
+}